@@ -43,9 +43,10 @@ func (a *Aggregator) getGroupByTupleDesc() *TupleDesc {
 }
 
 func (a *Aggregator) getAggStateTupleDesc() *TupleDesc {
-	var aggtd TupleDesc = *a.newAggState[0].GetTupleDesc()
-	for i := 1; i < len(a.newAggState); i++ {
-		aggtd = *aggtd.merge(a.newAggState[i].GetTupleDesc())
+	// a group by without aggregates returns just the distinct groups
+	var aggtd TupleDesc
+	for _, as := range a.newAggState {
+		aggtd = *aggtd.merge(as.GetTupleDesc())
 	}
 	return &aggtd
 }
@@ -72,9 +73,10 @@ func (a *Aggregator) Descriptor() *TupleDesc {
 // and the iterator should iterate through each group's result. In the case where there
 // is no group-by, the iterator simply iterates through only one tuple, representing the
 // aggregation of all child tuples.
-func (a *Aggregator) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
-	// the child iterator
-	childIter, err := a.child.Iterator(tid)
+func (a *Aggregator) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
+	// the child iterator, which reads the child's tuples in blocks, since they
+	// are all aggregated
+	childIter, err := drainIterator(a.child, tid)
 	if err != nil {
 		return nil, err
 	}
@@ -290,3 +290,134 @@ func TestRepeatedIteration(t *testing.T) {
 	}
 
 }
+
+func TestGroupByExpressionsAndHaving(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	for _, tc := range []struct {
+		sql      string
+		expected []int64
+	}{
+		{"select s_id from r where r_id < 105 group by s_id having count(*) > 2", []int64{0, 1, 2, 3, 4}},
+		{"select s_id from r group by s_id having sum(r_id) < 2300", []int64{0, 1, 2, 3, 4}},
+		{"select s_id, count(*) n from r group by s_id having n >= 10 and s_id < 3", []int64{0, 1, 2}},
+		{"select s_id / 10 from r group by s_id / 10", []int64{0, 1, 2, 3, 4}},
+		{"select s_id / 10 + 1 from r group by s_id / 10 having count(*) = 100", []int64{1, 2, 3, 4, 5}},
+		{"select t_id from s group by t_id", []int64{0, 1, 2, 3, 4}},
+	} {
+		_, vals := sortedIntColumn(t, c, bp, tc.sql)
+		if len(vals) != len(tc.expected) {
+			t.Errorf("expected %v for %s, got %v", tc.expected, tc.sql, vals)
+			continue
+		}
+		for i := range vals {
+			if vals[i] != tc.expected[i] {
+				t.Errorf("expected %v for %s, got %v", tc.expected, tc.sql, vals)
+				break
+			}
+		}
+	}
+
+	// aggregates and group by expressions can be sorted on without being selected
+	_, vals := runIntColumnQuery(t, c, bp, "select s_id from r where r_id < 105 group by s_id order by count(*) desc, s_id limit 2", 0)
+	if len(vals) != 2 || vals[0] != 0 || vals[1] != 1 {
+		t.Errorf("expected [0 1], got %v", vals)
+	}
+	_, vals = runIntColumnQuery(t, c, bp, "select count(*) from r group by s_id / 10 order by s_id / 10 desc", 0)
+	if len(vals) != 5 || vals[0] != 100 {
+		t.Errorf("expected 5 groups of 100, got %v", vals)
+	}
+
+	for _, sql := range []string{
+		"select r_id from r having r_id > 1",
+		"select r_id from r group by s_id / 10",
+	} {
+		if _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected error parsing %s", sql)
+		}
+	}
+}
+
+func TestHavingOverSimilarity(t *testing.T) {
+	c, hf, bp, _ := makeTweetsTestCatalog(t)
+	tweets := readFirstTweets(t, hf, bp, 1)
+	startFakeEmbeddingServer(t, tweets[0].Fields[2].(EmbeddedStringField).Emb)
+
+	counts := make(map[string]int64)
+	run := func(sql string, each func(tup *Tuple)) {
+		_, plan, err := Parse(c, sql)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		tid := bp.Transactions().Begin()
+		defer tid.Commit()
+		iter, err := plan.Iterator(tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			each(tup)
+		}
+	}
+	run("select sentiment, count(*) from tweets_test group by sentiment", func(tup *Tuple) {
+		counts[tup.Fields[0].(StringField).Value] = tup.Fields[1].(IntField).Value
+	})
+	expected := 0
+	for _, n := range counts {
+		if n > 10 {
+			expected++
+		}
+	}
+	if expected == 0 || expected == len(counts) {
+		t.Fatalf("expected some but not all sentiments to have more than 10 tweets")
+	}
+
+	got := 0
+	run("select sentiment, avg(content ailike 'q') from tweets_test group by sentiment having count(*) > 10", func(tup *Tuple) {
+		if n := counts[tup.Fields[0].(StringField).Value]; n <= 10 {
+			t.Errorf("expected only sentiments with more than 10 tweets, got %v with %d", tup.Fields[0], n)
+		}
+		got++
+	})
+	if got != expected {
+		t.Errorf("expected %d sentiments, got %d", expected, got)
+	}
+}
+
+func TestAggregatesSkipNulls(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	runIntColumnQuery(t, c, bp, "update r set s_id = null where r_id < 100", 0)
+
+	_, rows := queryRows(t, c, bp, "select count(*), count(s_id), sum(s_id), avg(s_id), min(s_id), max(s_id) from r")
+	if len(rows) != 1 {
+		t.Fatalf("expected one result, got %d", len(rows))
+	}
+	// r_id 100 to 499 have s_id r_id % 50, which sum to 8 * 1225
+	for i, expected := range []int64{500, 400, 9800, 24, 0, 49} {
+		if rows[0][i] != (IntField{expected}) {
+			t.Errorf("expected aggregate %d to be %d, got %v", i, expected, rows[0][i])
+		}
+	}
+
+	// aggregates other than COUNT of only NULLs are NULL
+	_, rows = queryRows(t, c, bp, "select count(s_id), sum(s_id), avg(s_id), min(s_id), max(s_id) from r where s_id is null")
+	if len(rows) != 1 || rows[0][0] != (IntField{0}) {
+		t.Fatalf("expected a count of 0, got %v", rows)
+	}
+	if countNulls(rows, 1)+countNulls(rows, 2)+countNulls(rows, 3)+countNulls(rows, 4) != 4 {
+		t.Errorf("expected aggregates of only NULLs to be NULL, got %v", rows[0])
+	}
+
+	// NULLs form a group of their own
+	_, rows = queryRows(t, c, bp, "select s_id, count(*) from r group by s_id")
+	if len(rows) != 51 {
+		t.Errorf("expected 51 groups, got %d", len(rows))
+	}
+	for _, row := range rows {
+		if row[0] == nil && row[1] != (IntField{100}) {
+			t.Errorf("expected the NULL group to have 100 records, got %v", row[1])
+		}
+	}
+}
@@ -27,15 +27,23 @@ type AggState interface {
 
 	// Gets the tuple description of the tuple that Finalize() returns.
 	GetTupleDesc() *TupleDesc
+
+	// Returns the expression evaluated on each input tuple.
+	inputExpr() Expr
 }
 
-// Implements the aggregation state for COUNT
+// Implements the aggregation state for COUNT.  Records whose expression is
+// NULL are not counted, except by COUNT(*), whose expression is nil.
 type CountAggState struct {
 	alias string
 	expr  Expr
 	count int
 }
 
+func (a *CountAggState) inputExpr() Expr {
+	return a.expr
+}
+
 func (a *CountAggState) Copy() AggState {
 	return &CountAggState{a.alias, a.expr, a.count}
 }
@@ -48,6 +56,11 @@ func (a *CountAggState) Init(alias string, expr Expr, getter func(DBValue) any)
 }
 
 func (a *CountAggState) AddTuple(t *Tuple) {
+	if a.expr != nil {
+		if v, err := a.expr.EvalExpr(t); err == nil && v == nil {
+			return
+		}
+	}
 	a.count++
 }
 
@@ -66,15 +79,21 @@ func (a *CountAggState) GetTupleDesc() *TupleDesc {
 	return &td
 }
 
-// Implements the aggregation state for SUM
+// Implements the aggregation state for SUM.  Like the other aggregates, other
+// than COUNT, SUM skips NULLs, and is NULL if it has no values to add.
 type SumAggState[T Number] struct {
 	alias string
 	expr  Expr
 	sum   int64
+	count int64
+}
+
+func (a *SumAggState[T]) inputExpr() Expr {
+	return a.expr
 }
 
 func (a *SumAggState[T]) Copy() AggState {
-	return &SumAggState[T]{alias: a.alias, expr: a.expr, sum: a.sum}
+	return &SumAggState[T]{alias: a.alias, expr: a.expr, sum: a.sum, count: a.count}
 }
 
 func intAggGetter(v DBValue) any {
@@ -89,6 +108,7 @@ func (a *SumAggState[T]) Init(alias string, expr Expr, getter func(DBValue) any)
 	a.alias = alias
 	a.expr = expr
 	a.sum = 0
+	a.count = 0
 	return nil
 }
 
@@ -97,8 +117,12 @@ func (a *SumAggState[T]) AddTuple(t *Tuple) {
 	if err != nil {
 		panic("Encountered an error when evaluating expression.")
 	}
+	if v == nil {
+		return
+	}
 	val := intAggGetter(v)
 	a.sum += val.(int64)
+	a.count++
 }
 
 func (a *SumAggState[T]) GetTupleDesc() *TupleDesc {
@@ -109,15 +133,17 @@ func (a *SumAggState[T]) GetTupleDesc() *TupleDesc {
 
 func (a *SumAggState[T]) Finalize() *Tuple {
 	td := a.GetTupleDesc()
-	f := IntField{a.sum}
+	var f DBValue
+	if a.count > 0 {
+		f = IntField{a.sum}
+	}
 	fs := []DBValue{f}
 	t := Tuple{*td, fs, nil}
 	return &t
 }
 
 // Implements the aggregation state for AVG
-// Note that we always AddTuple() at least once before Finalize()
-// so no worries for divide-by-zero
+// The average of no values, e.g. when they are all NULL, is NULL
 type AvgAggState[T Number] struct {
 	alias string
 	expr  Expr
@@ -125,6 +151,10 @@ type AvgAggState[T Number] struct {
 	count int64
 }
 
+func (a *AvgAggState[T]) inputExpr() Expr {
+	return a.expr
+}
+
 func (a *AvgAggState[T]) Copy() AggState {
 	return &AvgAggState[T]{alias: a.alias, expr: a.expr, sum: a.sum, count: a.count}
 }
@@ -142,6 +172,9 @@ func (a *AvgAggState[T]) AddTuple(t *Tuple) {
 	if err != nil {
 		panic("Encountered an error when evaluating expression.")
 	}
+	if v == nil {
+		return
+	}
 	val := intAggGetter(v)
 	a.sum += val.(int64)
 	a.count++
@@ -155,11 +188,8 @@ func (a *AvgAggState[T]) GetTupleDesc() *TupleDesc {
 
 func (a *AvgAggState[T]) Finalize() *Tuple {
 	td := a.GetTupleDesc()
-	var f IntField
-	if a.count == 0 {
-		// Return 0 if no values to average
-		f = IntField{a.count}
-	} else {
+	var f DBValue
+	if a.count > 0 {
 		f = IntField{a.sum / a.count}
 	}
 	fs := []DBValue{f}
@@ -168,8 +198,7 @@ func (a *AvgAggState[T]) Finalize() *Tuple {
 }
 
 // Implements the aggregation state for MAX
-// Note that we always AddTuple() at least once before Finalize()
-// so no worries for NaN max
+// The max of no values, e.g. when they are all NULL, is NULL
 type MaxAggState[T constraints.Ordered] struct {
 	alias  string
 	expr   Expr
@@ -178,6 +207,10 @@ type MaxAggState[T constraints.Ordered] struct {
 	getter func(DBValue) any
 }
 
+func (a *MaxAggState[T]) inputExpr() Expr {
+	return a.expr
+}
+
 func (a *MaxAggState[T]) Copy() AggState {
 	// Note: we reset the value of null to true, so this is not a pure Copy.
 	return &MaxAggState[T]{a.alias, a.expr, a.max, true, a.getter}
@@ -193,7 +226,7 @@ func (a *MaxAggState[T]) Init(alias string, expr Expr, getter func(DBValue) any)
 
 func (a *MaxAggState[T]) AddTuple(t *Tuple) {
 	v, err := a.expr.EvalExpr(t)
-	if err != nil {
+	if err != nil || v == nil {
 		return
 	}
 	val := a.getter(v).(T)
@@ -219,6 +252,9 @@ func (a *MaxAggState[T]) GetTupleDesc() *TupleDesc {
 
 func (a *MaxAggState[T]) Finalize() *Tuple {
 	td := a.GetTupleDesc()
+	if a.null {
+		return &Tuple{*td, []DBValue{nil}, nil}
+	}
 	var f any
 	switch any(a.max).(type) {
 	case string:
@@ -231,8 +267,7 @@ func (a *MaxAggState[T]) Finalize() *Tuple {
 }
 
 // Implements the aggregation state for MIN
-// Note that we always AddTuple() at least once before Finalize()
-// so no worries for NaN min
+// The min of no values, e.g. when they are all NULL, is NULL
 type MinAggState[T constraints.Ordered] struct {
 	alias  string
 	expr   Expr
@@ -241,6 +276,10 @@ type MinAggState[T constraints.Ordered] struct {
 	getter func(DBValue) any
 }
 
+func (a *MinAggState[T]) inputExpr() Expr {
+	return a.expr
+}
+
 func (a *MinAggState[T]) Copy() AggState {
 	// Note: we reset the value of null to true, so this is not a pure Copy.
 	return &MinAggState[T]{a.alias, a.expr, a.min, true, a.getter}
@@ -256,7 +295,7 @@ func (a *MinAggState[T]) Init(alias string, expr Expr, getter func(DBValue) any)
 
 func (a *MinAggState[T]) AddTuple(t *Tuple) {
 	v, err := a.expr.EvalExpr(t)
-	if err != nil {
+	if err != nil || v == nil {
 		return
 	}
 	val := a.getter(v).(T)
@@ -282,6 +321,9 @@ func (a *MinAggState[T]) GetTupleDesc() *TupleDesc {
 
 func (a *MinAggState[T]) Finalize() *Tuple {
 	td := a.GetTupleDesc()
+	if a.null {
+		return &Tuple{*td, []DBValue{nil}, nil}
+	}
 	var f any
 	switch any(a.min).(type) {
 	case string:
@@ -0,0 +1,94 @@
+package godb
+
+// Operators that read all of their input, such as sorts and aggregates, pull
+// it from their children a block of tuples at a time, rather than one tuple at
+// a time, where the children support it: a heap scan returns the tuples of a
+// page as a block, filters and projections pass blocks through, and a
+// projection evaluates distance functions over a whole block at once (see
+// [FuncExpr.evalDistanceBatch]).  Operators that may stop reading their input
+// early, such as a limit, still read it a tuple at a time, so that no more of
+// it is computed than is returned.
+
+// The most tuples that operators without batches of their own are read in at
+// once, by [batchesOf].
+const BATCH_SIZE = 256
+
+// batchOperator is implemented by operators that can return their tuples in
+// blocks.
+type batchOperator interface {
+	Operator
+	// Returns an iterator over the tuples of the operator, in blocks of any
+	// size, which returns nil once they have all been returned; blocks are
+	// never empty.
+	batchIterator(tid *Transaction) (func() ([]*Tuple, error), error)
+}
+
+// Returns an iterator over blocks of the tuples of op: its own if it is a
+// [batchOperator], or else blocks of up to BATCH_SIZE tuples read from its
+// iterator.
+func batchesOf(op Operator, tid *Transaction) (func() ([]*Tuple, error), error) {
+	if bop, ok := op.(batchOperator); ok {
+		return bop.batchIterator(tid)
+	}
+	iter, err := op.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	return func() ([]*Tuple, error) {
+		var block []*Tuple
+		for len(block) < BATCH_SIZE {
+			t, err := iter()
+			if err != nil {
+				return nil, err
+			}
+			if t == nil {
+				break
+			}
+			block = append(block, t)
+		}
+		return block, nil
+	}, nil
+}
+
+// Returns an iterator over the tuples of the blocks of batches.
+func unbatch(batches func() ([]*Tuple, error)) func() (*Tuple, error) {
+	var block []*Tuple
+	return func() (*Tuple, error) {
+		for len(block) == 0 {
+			var err error
+			if block, err = batches(); err != nil || block == nil {
+				return nil, err
+			}
+		}
+		t := block[0]
+		block = block[1:]
+		return t, nil
+	}
+}
+
+// Returns an iterator over the tuples of op, which reads them from op in
+// blocks; for operators that read all of their input.
+func drainIterator(op Operator, tid *Transaction) (func() (*Tuple, error), error) {
+	batches, err := batchesOf(op, tid)
+	if err != nil {
+		return nil, err
+	}
+	return unbatch(batches), nil
+}
+
+// Returns the values of e for each of the tuples of block.  Distance functions
+// are evaluated over the whole block at once.
+func evalBatch(e Expr, block []*Tuple) ([]DBValue, error) {
+	if f, ok := e.(*FuncExpr); ok && isDistanceFunc(f.op) {
+		return f.evalDistanceBatch(block)
+	}
+	vals := make([]DBValue, len(block))
+	for i, t := range block {
+		val, err := e.EvalExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = val
+	}
+	return vals, nil
+}
@@ -0,0 +1,253 @@
+package godb
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// Hides the batch iterator of an operator, so that it is read a tuple at a
+// time.
+type tupleAtATime struct {
+	Operator
+}
+
+// Evaluates a distance function through its entry in funcs, as all functions
+// were before distances were evaluated by kernels.
+type boxedFuncExpr struct {
+	*FuncExpr
+}
+
+func (f boxedFuncExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	// check the arguments for each tuple, as FuncExpr.EvalExpr did
+	for _, arg := range f.args {
+		(*arg).GetExprType()
+	}
+	args := make([]any, len(f.args))
+	for i, arg := range f.args {
+		val, err := (*arg).EvalExpr(t)
+		if err != nil || val == nil {
+			return nil, err
+		}
+		args[i] = val
+	}
+	return IntField{funcs[f.op].f(args).(int64)}, nil
+}
+
+func distanceExpr(op string, a Expr, b Expr) *FuncExpr {
+	return &FuncExpr{op: op, args: []*Expr{&a, &b}}
+}
+
+// Returns a random embedding of the length of those of text.
+func randomEmbedding(r *rand.Rand) EmbeddingType {
+	return EmbeddingType(randomVector(r, TextEmbeddingDim))
+}
+
+// Creates a heap file (id int, content text) of n records, whose contents have
+// random embeddings, and every seventh of which is NULL, read through a buffer
+// pool of poolPages pages.
+func makeDistanceTestFile(tb testing.TB, n int, poolPages int) (*HeapFile, *BufferPool) {
+	td := TupleDesc{Fields: []FieldType{
+		{Fname: "id", Ftype: IntType},
+		{Fname: "content", Ftype: EmbeddedStringType},
+	}}
+	bp := NewBufferPool(poolPages)
+	hf, err := NewHeapFile(tb.TempDir()+"/distance_test.dat", &td, bp)
+	if err != nil {
+		tb.Fatalf(err.Error())
+	}
+	r := rand.New(rand.NewSource(4))
+	tid := bp.Transactions().Begin()
+	for i := 0; i < n; i++ {
+		tup := Tuple{Desc: td, Fields: []DBValue{IntField{int64(i)}, nil}}
+		if i%7 != 0 {
+			tup.Fields[1] = EmbeddedStringField{Value: fmt.Sprintf("t%d", i), Emb: randomEmbedding(r)}
+		}
+		// keep the random embeddings, rather than asking the embedding server
+		if err := hf.insertEmbeddedTuple(&tup, tid); err != nil {
+			tb.Fatalf(err.Error())
+		}
+	}
+	tid.Commit()
+	return hf, bp
+}
+
+// Embeddings read from a heap file carry their norms, so that scans compute
+// them once per page rather than with each distance.
+func TestRowNorms(t *testing.T) {
+	hf, bp := makeDistanceTestFile(t, 20, 10)
+	tid := bp.Transactions().Begin()
+	defer tid.Commit()
+	iter, err := hf.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		content, ok := tup.Fields[1].(EmbeddedStringField)
+		if !ok {
+			continue
+		}
+		if content.norm == 0 || content.norm != normOf(content.Emb) {
+			t.Errorf("%s: expected norm %v, got %v", content.Value, normOf(content.Emb), content.norm)
+		}
+	}
+}
+
+// Distances evaluated over a block have the values the functions in funcs give
+// each tuple.
+func TestDistanceBatch(t *testing.T) {
+	td := TupleDesc{Fields: []FieldType{
+		{Fname: "id", Ftype: IntType},
+		{Fname: "content", Ftype: EmbeddedStringType},
+		{Fname: "vec", Ftype: VectorFieldType},
+	}}
+	r := rand.New(rand.NewSource(5))
+	var block []*Tuple
+	for i := 0; i < 100; i++ {
+		tup := &Tuple{Desc: td, Fields: []DBValue{IntField{int64(i)}, nil, VectorField{Emb: randomEmbedding(r)}}}
+		if i%7 != 0 {
+			tup.Fields[1] = EmbeddedStringField{Value: fmt.Sprintf("t%d", i), Emb: randomEmbedding(r)}
+		}
+		block = append(block, tup)
+	}
+	content, vec := &FieldExpr{td.Fields[1]}, &FieldExpr{td.Fields[2]}
+	query := &ConstExpr{EmbeddedStringField{Value: "q", Emb: randomEmbedding(r)}, EmbeddedStringType}
+	for _, f := range []*FuncExpr{
+		distanceExpr("ailike", content, query),
+		distanceExpr("ailike", query, content),
+		distanceExpr("ailike_cos", content, query),
+		distanceExpr("ailike_cos", content, content),
+		distanceExpr("ailike_vec", vec, query),
+		distanceExpr("ailike_vec", vec, content),
+	} {
+		counters := &execCounterSet{}
+		countDistancesIn(f, counters)
+		vals, err := evalBatch(f, block)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		computed := counters.distanceComputations.Load()
+		nonNull := int64(0)
+		for i, tup := range block {
+			expected, err := boxedFuncExpr{f}.EvalExpr(tup)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			got, err := f.EvalExpr(tup)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if vals[i] != expected || got != expected {
+				t.Fatalf("%s of tuple %d: expected %v, got %v over the block and %v alone", f.op, i, expected, vals[i], got)
+			}
+			if expected != nil {
+				nonNull++
+			}
+		}
+		if computed != nonNull {
+			t.Errorf("%s: expected %d distance computations, got %d", f.op, nonNull, computed)
+		}
+	}
+
+	short := &Tuple{Desc: td, Fields: []DBValue{IntField{100}, EmbeddedStringField{Value: "short", Emb: EmbeddingType{1}}, nil}}
+	if _, err := evalBatch(distanceExpr("ailike", content, query), append(block, short)); err == nil {
+		t.Errorf("expected an error for embeddings of different lengths")
+	}
+}
+
+// An operator returns the same tuples in blocks as it does a tuple at a time,
+// and operators without blocks of their own are read in blocks of BATCH_SIZE.
+func TestBatchIterator(t *testing.T) {
+	hf, bp := makeDistanceTestFile(t, 300, 200)
+	tid := bp.Transactions().Begin()
+	defer tid.Commit()
+	td := hf.Descriptor()
+	filter, err := NewIntFilter(&ConstExpr{IntField{3}, IntType}, OpGt, &FieldExpr{td.Fields[0]}, hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	query := &ConstExpr{EmbeddedStringField{Value: "q", Emb: randomEmbedding(rand.New(rand.NewSource(6)))}, EmbeddedStringType}
+	proj, err := NewProjectOp([]Expr{&FieldExpr{td.Fields[0]}, distanceExpr("ailike", &FieldExpr{td.Fields[1]}, query)}, []string{"id", "dist"}, false, filter)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	expected := collectTuples(t, tupleAtATime{proj}, tid)
+	if len(expected) != 296 {
+		t.Fatalf("expected 296 tuples, got %d", len(expected))
+	}
+	for _, op := range []Operator{proj, tupleAtATime{proj}} {
+		batches, err := batchesOf(op, tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		var got []*Tuple
+		for block, err := batches(); block != nil || err != nil; block, err = batches() {
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if len(block) == 0 || len(block) > BATCH_SIZE {
+				t.Fatalf("expected blocks of 1 to %d tuples, got %d", BATCH_SIZE, len(block))
+			}
+			if _, ok := op.(tupleAtATime); ok && len(got) == 0 && len(block) != BATCH_SIZE {
+				t.Errorf("expected a first block of %d tuples, got %d", BATCH_SIZE, len(block))
+			}
+			got = append(got, block...)
+		}
+		if len(got) != len(expected) {
+			t.Fatalf("expected %d tuples, got %d", len(expected), len(got))
+		}
+		for i := range got {
+			if fmt.Sprint(got[i].Fields) != fmt.Sprint(expected[i].Fields) {
+				t.Fatalf("tuple %d: expected %v, got %v", i, expected[i].Fields, got[i].Fields)
+			}
+		}
+	}
+}
+
+// A brute-force AILIKE scan of a cached table, as the top 10 of
+//
+//	select id, content ailike 'q' as dist from t order by dist limit 10
+//
+// with the distances computed through funcs a tuple at a time, with the
+// kernels a tuple at a time, and with the kernels a block at a time.
+func BenchmarkAilikeScan(b *testing.B) {
+	hf, bp := makeDistanceTestFile(b, 2000, 1200)
+	td := hf.Descriptor()
+	query := &ConstExpr{EmbeddedStringField{Value: "q", Emb: randomEmbedding(rand.New(rand.NewSource(7)))}, EmbeddedStringType}
+	dist := distanceExpr("ailike", &FieldExpr{td.Fields[1]}, query)
+	scan := func(b *testing.B, distance Expr, batched bool) {
+		var proj Operator
+		proj, err := NewProjectOp([]Expr{&FieldExpr{td.Fields[0]}, distance}, []string{"id", "dist"}, false, hf)
+		if err != nil {
+			b.Fatalf(err.Error())
+		}
+		if !batched {
+			proj = tupleAtATime{proj}
+		}
+		topK, err := NewTopK([]Expr{&FieldExpr{FieldType{Fname: "dist", Ftype: IntType}}}, proj, []bool{true}, &ConstExpr{IntField{10}, IntType})
+		if err != nil {
+			b.Fatalf(err.Error())
+		}
+		tid := bp.Transactions().Begin()
+		defer tid.Commit()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			iter, err := topK.Iterator(tid)
+			if err != nil {
+				b.Fatalf(err.Error())
+			}
+			for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+				if err != nil {
+					b.Fatalf(err.Error())
+				}
+			}
+		}
+	}
+	b.Run("boxed", func(b *testing.B) { scan(b, boxedFuncExpr{dist}, false) })
+	b.Run("tuple", func(b *testing.B) { scan(b, dist, false) })
+	b.Run("batch", func(b *testing.B) { scan(b, dist, true) })
+}
@@ -38,7 +38,7 @@ func BenchmarkingInfra(queryName string, query string, config BenchMetaData) (ti
 	if desc == nil {
 		return time.Duration(0), ailikeError{ParseError, "Descriptor was nil"}
 	}
-	tid := NewTID()
+	tid := bp.Transactions().Begin()
 	iter, err := plan.Iterator(tid)
 	if err != nil {
 		return time.Duration(0), err
@@ -112,7 +112,7 @@ func RunWikiArticleQuery(query string, c *Catalog, colNo int, bp *BufferPool) ([
 	if desc == nil {
 		return nil, ailikeError{ParseError, "Descriptor was nil"}
 	}
-	tid := NewTID()
+	tid := bp.Transactions().Begin()
 	iter, err := plan.Iterator(tid)
 	if err != nil {
 		return nil, err
@@ -134,7 +134,7 @@ func RunWikiArticleQuery(query string, c *Catalog, colNo int, bp *BufferPool) ([
 		result = append(result, tup.Fields[colNo].(IntField).Value)
 	}
 
-	bp.CommitTransaction(tid)
+	tid.Commit()
 
 	return result, nil
 }
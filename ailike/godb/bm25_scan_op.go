@@ -0,0 +1,126 @@
+package godb
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Returns the text index for the given field, or nil if the field's table has no text index on it.
+func textIndexForField(field FieldType, c *Catalog) (*TextIndexFile, error) {
+	tableName := field.TableQualifier
+	if t, ok := c.tableMap[tableName]; ok && t != nil {
+		dbFile, err := c.GetTable(tableName)
+		if err != nil {
+			return nil, ailikeError{NoSuchTableError, fmt.Sprintf("no table '%s' found", tableName)}
+		}
+		hf, ok := dbFile.(*HeapFile)
+		if !ok {
+			return nil, ailikeError{NoSuchTableError, fmt.Sprintf("Issue reading table '%s'", tableName)}
+		}
+		return getTextIndexForField(field, hf), nil
+	}
+	return nil, nil
+}
+
+// Get text index for field
+func getTextIndexForField(field FieldType, hf *HeapFile) *TextIndexFile {
+	colName := field.Fname
+	if index, ok := hf.textIndexes[colName]; ok && index != nil {
+		return index
+	}
+	return nil
+}
+
+// BM25Scan uses the postings of a text index to return the limitNo records of
+// a heap file with the highest BM25 score for a keyword query, best first.  If
+// fewer records contain a query term, the rest are records that score 0, in
+// the order of the file, as a sort of the whole file would return.
+type BM25Scan struct {
+	indexField FieldType
+	query      string
+	heapFile   *HeapFile
+	textIndex  *TextIndexFile
+	limitNo    int // number of tuples to limit to
+}
+
+// Create a BM25Scan over heapFile for the text index on indexField.
+func NewBM25Scan(heapFile *HeapFile, limit Expr, indexField FieldType, query string) (*BM25Scan, error) {
+	index := getTextIndexForField(indexField, heapFile)
+	if index == nil {
+		return nil, ailikeError{NoSuchTableError, fmt.Sprintf("No text index found for field '%s'", indexField.Fname)}
+	}
+
+	limitVal, err := limit.EvalExpr(nil)
+	if err != nil {
+		return nil, err
+	}
+	limitNo := int(limitVal.(IntField).Value)
+
+	return &BM25Scan{indexField, query, heapFile, index, limitNo}, nil
+}
+
+func (v *BM25Scan) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
+	err := v.textIndex.load(tid)
+	if err != nil {
+		return nil, err
+	}
+	scores := v.textIndex.scoreRecords(tokenizeText(v.query), tid)
+	rids := make([]heapRecordId, 0, len(scores))
+	for rid := range scores {
+		rids = append(rids, rid)
+	}
+	// order by score, breaking ties by position in the file so results are deterministic
+	sort.Slice(rids, func(i, j int) bool {
+		if scores[rids[i]] != scores[rids[j]] {
+			return scores[rids[i]] > scores[rids[j]]
+		}
+		if rids[i].pageNo != rids[j].pageNo {
+			return rids[i].pageNo < rids[j].pageNo
+		}
+		return rids[i].slotNo < rids[j].slotNo
+	})
+	if len(rids) > v.limitNo {
+		rids = rids[:v.limitNo]
+	}
+
+	i := 0
+	var unscored func() (*Tuple, error)
+	return func() (*Tuple, error) {
+		if i < len(rids) {
+			t, err := v.heapFile.findTuple(rids[i], tid)
+			if err != nil {
+				return nil, err
+			}
+			i++
+			return t, nil
+		}
+		if i >= v.limitNo {
+			return nil, nil
+		}
+		if unscored == nil {
+			iter, err := v.heapFile.Iterator(tid)
+			if err != nil {
+				return nil, err
+			}
+			unscored = iter
+		}
+		for {
+			t, err := unscored()
+			if t == nil || err != nil {
+				return nil, err
+			}
+			if _, ok := scores[t.Rid.(heapRecordId)]; !ok {
+				i++
+				return t, nil
+			}
+		}
+	}, nil
+}
+
+func (v *BM25Scan) Descriptor() *TupleDesc {
+	return v.heapFile.Descriptor()
+}
+
+func (v *BM25Scan) PrettyPrint() string {
+	return fmt.Sprintf("{column: %v, table: %v, limit: %v, query: %v}", v.indexField.Fname, v.indexField.TableQualifier, v.limitNo, v.query)
+}
@@ -1,125 +1,322 @@
 package godb
 
 import (
-	"math"
+	"bytes"
 	"sync"
-	"time"
 )
 
 //BufferPool provides methods to cache pages that have been read from disk.
 //It has a fixed capacity to limit the total amount of memory used by ailike.
 //It is also the primary way in which transactions are enforced, by using page
-//level locking (you will not need to worry about this until lab3).
+//level locking, which is done by its [LockManager].  Which page it evicts when
+//it is full is chosen by its [ReplacementPolicy].
 
 // Permissions used when reading / locking pages
 type RWPerm int
 
-// If the ALLOW_RESERVATIONS flag is set to true, then we allow transactions to "reserve" exclusive locks before other
-// transactions have released their shared locks. If false, then we wait for transactions to release shared locks.
-const ALLOW_RESERVATIONS = true
-
 // If the ABORT_TRANSACTIONS flag is set to true, then the buffer pool will abort transactions when it detects deadlock.
 // if false, the buffer pool relies on the calling code to abort transactions.
 const ABORT_TRANSACTIONS = true
 
-// My code will pass all the tests under the following configurations:
-//   - ALLOW_RESERVATIONS = true, ABORT_TRANSACTIONS = true
-//   - ALLOW_RESERVATIONS = false, ABORT_TRANSACTIONS = true
-//   - ALLOW_RESERVATIONS = true, ABORT_TRANSACTIONS = false
-
-const BLOCK_TIME = 2 * time.Millisecond // time to wait before attempting to acquire a lock again
-const CYCLE_CHECK_INTERVAL = 2          // number of attempts at acquiring a lock before we check for deadlock
-const USE_EVICT_QUEUE = false           // if true, use eviction queue to evict pages. Otherwise, evict pages based on number of empty slots.
-
 const (
 	ReadPerm  RWPerm = iota
 	WritePerm RWPerm = iota
 )
 
-type Lock struct {
-	pageKey BufferPoolKey
-	perm    RWPerm // WritePerm for exclusive locks, ReadPerm for shared locks
-}
+// Which transaction in a deadlock new buffer pools abort.
+const DEFAULT_VICTIM_POLICY = YoungestVictim
 
 type BufferPool struct {
-	numPages              int
-	pageMap               map[BufferPoolKey]Page
-	mutex                 *sync.Mutex
-	sharedLockMap         map[BufferPoolKey]int           // maps BufferPoolKeys to the number of transactions that are holding a shared lock on the page
-	exclusiveLockMap      map[BufferPoolKey]TransactionID // maps BufferPoolKeys to the TransactionID that is holding an exclusive lock
-	transactionWaitingFor map[TransactionID]Lock          // maps TransactionIDs to the Lock they are waiting for
-	transactionLocks      map[TransactionID]map[Lock]bool // maps TransactionIDs to the Locks they hold or have reserved
-	steal                 bool
-	evictQueue            []BufferPoolKey
-}
-
-// Create a new BufferPool with the specified number of pages
+	numPages int
+	pageMap  map[BufferPoolKey]Page
+	mutex    *sync.Mutex // guards the page cache; locks are guarded by the lock manager
+	locks    *LockManager
+	steal    bool
+	policy   ReplacementPolicy
+	replacer replacer
+	// the number of times each page is pinned; pinned pages are not evicted
+	pins     map[BufferPoolKey]int
+	stats    BufferPoolStats
+	prefetch *prefetcher
+	// the write-ahead log, if the buffer pool is used with a catalog; without
+	// one, the buffer pool is FORCE/NO STEAL
+	log *LogFile
+	// the image of each page each transaction has locked for writing, as of
+	// when the transaction last logged its changes to it, or locked it
+	beforeImages map[*Transaction]map[BufferPoolKey][]byte
+	transactions *TransactionManager
+	// the text indexes on the buffer pool's files, by postings file name, so
+	// that each is read into memory once rather than by every query using it
+	textIndexes map[string]*TextIndexFile
+	textLatch   *sync.Mutex // guards textIndexes
+}
+
+// BufferPoolStats counts how often the pages a buffer pool was asked for were
+// cached, how many pages it evicted, and how many it read ahead of the scans
+// using them, of which PrefetchHits were used before being evicted.
+type BufferPoolStats struct {
+	Hits         int64
+	Misses       int64
+	Evictions    int64
+	Prefetches   int64
+	PrefetchHits int64
+}
+
+// Create a new BufferPool with the specified number of pages, which uses the
+// [DEFAULT_REPLACEMENT_POLICY].
 func NewBufferPool(numPages int) *BufferPool {
-	pageMap := make(map[BufferPoolKey]Page, numPages)
+	return NewBufferPoolWithPolicy(numPages, DEFAULT_REPLACEMENT_POLICY)
+}
+
+// Create a new BufferPool with the specified number of pages, which evicts
+// pages according to the given replacement policy.
+func NewBufferPoolWithPolicy(numPages int, policy ReplacementPolicy) *BufferPool {
 	var mutex sync.Mutex
-	sharedLockMap := make(map[BufferPoolKey]int, 0)
-	exclusiveLockMap := make(map[BufferPoolKey]TransactionID, 0)
-	transactionWaitingFor := make(map[TransactionID]Lock, 0)
-	transactionLocks := make(map[TransactionID]map[Lock]bool, 0)
-	evictQueue := make([]BufferPoolKey, 0)
-	return &BufferPool{numPages, pageMap, &mutex, sharedLockMap, exclusiveLockMap, transactionWaitingFor, transactionLocks, false, evictQueue}
+	bp := &BufferPool{
+		numPages:     numPages,
+		pageMap:      make(map[BufferPoolKey]Page, numPages),
+		mutex:        &mutex,
+		locks:        NewLockManager(DEFAULT_VICTIM_POLICY),
+		policy:       policy,
+		replacer:     newReplacer(policy, numPages),
+		pins:         make(map[BufferPoolKey]int),
+		beforeImages: make(map[*Transaction]map[BufferPoolKey][]byte),
+		prefetch:     newPrefetcher(&mutex),
+		textIndexes:  make(map[string]*TextIndexFile),
+		textLatch:    &sync.Mutex{},
+	}
+	bp.transactions = newTransactionManager(bp)
+	return bp
 }
 
-func (bp *BufferPool) EvictPage() error {
+// Returns the replacement policy of the buffer pool.
+func (bp *BufferPool) ReplacementPolicy() ReplacementPolicy {
+	return bp.policy
+}
 
-	var evictK BufferPoolKey
-	var evictP Page = nil
-	minOpenSlots := uint(math.Inf(1))
+// Returns the number of hits, misses and evictions of the buffer pool so far.
+func (bp *BufferPool) Stats() BufferPoolStats {
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	return bp.stats
+}
 
-	// Evict page with the least number of empty slots
-	for k, page := range bp.pageMap {
-		if !page.isDirty() || bp.steal {
-			if uint(page.getNumOpenSlots()) <= minOpenSlots {
-				minOpenSlots = uint(page.getNumOpenSlots())
-				evictK = k
-				evictP = page
-			}
-			if page.getNumOpenSlots() == 0 {
-				break // break early if we find a full page.
-			}
+// Returns the transaction manager that issues the transactions that use the
+// buffer pool.
+func (bp *BufferPool) Transactions() *TransactionManager {
+	return bp.transactions
+}
+
+// Sets how the transaction aborted to break a deadlock is chosen.
+func (bp *BufferPool) SetVictimPolicy(policy VictimPolicy) {
+	bp.locks.SetVictimPolicy(policy)
+}
+
+// Attaches the write-ahead log l to the buffer pool, unless it already has one,
+// after which the buffer pool is STEAL/NO FORCE.
+func (bp *BufferPool) attachLog(l *LogFile) {
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	if bp.log == nil {
+		bp.log = l
+	}
+}
+
+// Returns the key of page in the log, or false if changes to it are not logged.
+func (bp *BufferPool) loggedPage(page Page) (HeapFilePageKey, bool) {
+	hp, ok := page.(*heapPage)
+	if bp.log == nil || !ok || hp.filePointer.unlogged {
+		return HeapFilePageKey{}, false
+	}
+	return HeapFilePageKey{hp.filePointer.fileName, hp.pageNo}, true
+}
+
+func pageImage(page Page) ([]byte, error) {
+	b, err := page.(*heapPage).toBuffer()
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Saves the image of a page that tid has just locked for writing, so that the
+// changes it makes to it can be logged.
+func (bp *BufferPool) saveBeforeImage(tid *Transaction, page Page) error {
+	key, ok := bp.loggedPage(page)
+	if !ok {
+		return nil
+	}
+	if _, ok := bp.beforeImages[tid][key]; ok {
+		return nil
+	}
+	image, err := pageImage(page)
+	if err != nil {
+		return err
+	}
+	if _, ok := bp.beforeImages[tid]; !ok {
+		bp.beforeImages[tid] = make(map[BufferPoolKey][]byte)
+	}
+	bp.beforeImages[tid][key] = image
+	return nil
+}
+
+// Logs the changes tid has made to page since it last logged them.  If other
+// transactions also write the page, the logged image includes their changes.
+func (bp *BufferPool) logChanges(tid *Transaction, page Page) error {
+	key, ok := bp.loggedPage(page)
+	if !ok || !page.isDirty() {
+		return nil
+	}
+	before, ok := bp.beforeImages[tid][key]
+	if !ok {
+		return nil
+	}
+	after, err := pageImage(page)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(before, after) {
+		return nil
+	}
+	bp.log.logUpdate(tid, key, before, after, page.(*heapPage).versionSlotSize())
+	bp.beforeImages[tid][key] = after
+	return nil
+}
+
+// Writes page to disk.  Following the write-ahead rule, the changes made to it
+// by the transactions holding locks to write it are logged, and the log
+// forced, first.
+func (bp *BufferPool) writePage(key BufferPoolKey, page Page) error {
+	if logKey, ok := bp.loggedPage(page); ok {
+		if err := bp.logWriters(key, page); err != nil {
+			return err
+		}
+		if err := bp.log.pageWritten(logKey); err != nil {
+			return err
 		}
 	}
-	if evictP != nil {
-		err := evictP.flushPage()
-		if err != nil {
+	return page.flushPage()
+}
+
+// Logs the changes made to page by each transaction holding a lock to write
+// it.  Transactions writing records of the same page each log an image of the
+// whole page, so the changes of all of them are logged together, and each is
+// undone from the log if its transaction does not commit.
+func (bp *BufferPool) logWriters(key BufferPoolKey, page Page) error {
+	for _, tid := range bp.locks.writers(key) {
+		if err := bp.logChanges(tid, page); err != nil {
 			return err
 		}
-		delete(bp.pageMap, evictK)
+	}
+	return nil
+}
+
+// Writes the changes committed to page to disk without a log, as tid commits.
+// Transactions holding record locks on a page with versions may have changed
+// it too, so its image is written without their versions, and it stays dirty
+// until they complete.
+func (bp *BufferPool) forcePage(key BufferPoolKey, page Page, tid *Transaction) error {
+	hp, ok := page.(*heapPage)
+	others := bp.otherWriters(key, tid)
+	if !ok || !hp.versioned || len(others) == 0 {
+		return page.flushPage()
+	}
+	image, err := pageImage(page)
+	if err != nil {
+		return err
+	}
+	for _, other := range others {
+		image = scrubVersions(image, other.id, hp.versionSlotSize())
+	}
+	return writePageImage(HeapFilePageKey{hp.filePointer.fileName, hp.pageNo}, image)
+}
+
+// Returns the transactions other than tid that hold locks to write the page.
+func (bp *BufferPool) otherWriters(key BufferPoolKey, tid *Transaction) []*Transaction {
+	var others []*Transaction
+	for _, writer := range bp.locks.writers(key) {
+		if writer != tid {
+			others = append(others, writer)
+		}
+	}
+	return others
+}
+
+// Replaces the cached page with the given image.
+func (bp *BufferPool) restorePage(key BufferPoolKey, page Page, image []byte) error {
+	hp := page.(*heapPage)
+	restored, err := hp.filePointer.pageFromImage(hp.pageNo, image)
+	if err != nil {
+		return err
+	}
+	(*restored).setDirty(true)
+	bp.pageMap[key] = *restored
+	return nil
+}
+
+// Writes a checkpoint to the log, so that recovery after a crash need only read
+// the log from it.  Checkpoints are also taken as transactions commit, every
+// [CHECKPOINT_INTERVAL] bytes of log.
+func (bp *BufferPool) Checkpoint() error {
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	if bp.log == nil {
 		return nil
 	}
+	return bp.log.checkpoint()
+}
 
-	return ailikeError{BufferPoolFullError, "Cannot evict page; all pages are dirty."}
+// Evicts the page chosen by the replacement policy, writing it out first.
+// Pinned pages are never evicted, and without a log, neither are dirty pages,
+// as this would violate NO STEAL.
+func (bp *BufferPool) EvictPage() error {
+	key, ok := bp.replacer.victim(bp.evictable)
+	if !ok {
+		return ailikeError{BufferPoolFullError, "Cannot evict page; all pages are dirty or pinned."}
+	}
+	if err := bp.writePage(key, bp.pageMap[key]); err != nil {
+		bp.replacer.admit(key)
+		return err
+	}
+	delete(bp.pageMap, key)
+	delete(bp.prefetch.unused, key)
+	bp.stats.Evictions++
+	return nil
+}
 
+// Returns true if the cached page with the given key may be evicted.
+func (bp *BufferPool) evictable(key BufferPoolKey) bool {
+	page, ok := bp.pageMap[key]
+	return ok && bp.pins[key] == 0 && (!page.isDirty() || bp.steal || bp.log != nil)
 }
 
-func (bp *BufferPool) EvictPageQueue() error {
-	// Evict page using eviction queue
-	for i, evictK := range bp.evictQueue {
-		var evictP Page = bp.pageMap[evictK]
-		if !evictP.isDirty() || bp.steal {
-			err := evictP.flushPage()
-			if err != nil {
-				return err
-			}
-			delete(bp.pageMap, evictK)
-			bp.evictQueue = append(bp.evictQueue[:i], bp.evictQueue[i+1:]...)
-			return nil
-		}
+// Pins the page with the given key, so that it is not evicted until it is
+// unpinned as many times.  Must be called with the mutex held.
+func (bp *BufferPool) pin(key BufferPoolKey) {
+	bp.pins[key]++
+}
+
+// Releases a pin on the page with the given key taken when it was retrieved
+// for a [HeapFile] to use.
+func (bp *BufferPool) unpinPage(key BufferPoolKey) {
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	if bp.pins[key] <= 1 {
+		delete(bp.pins, key)
+		return
 	}
-	return ailikeError{BufferPoolFullError, "Cannot evict page; all pages are dirty."}
+	bp.pins[key]--
 }
 
 // Testing method -- iterate through all pages in the buffer pool
-// and flush them using [DBFile.flushPage]. Does not need to be thread/transaction safe
+// and flush them using [DBFile.flushPage]. Does not need to be transaction
+// safe, but takes the mutex, since pages may be read ahead meanwhile.
 func (bp *BufferPool) FlushAllPages() {
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
 	for k := range bp.pageMap {
 		page := bp.pageMap[k]
-		err := page.flushPage()
+		err := bp.writePage(k, page)
 		if err != nil {
 			panic("Could not flush all pages.")
 		}
@@ -127,304 +324,335 @@ func (bp *BufferPool) FlushAllPages() {
 }
 
 func (bp *BufferPool) ClearAllPages() {
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
 	bp.pageMap = make(map[BufferPoolKey]Page, bp.numPages)
+	clear(bp.prefetch.unused)
+	bp.cancelPrefetches(nil)
 }
 
-// _cleanUpTransaction releases all locks held by the transactions and removes the transaction from
-// BufferPool data structures. We assume the calling method holds the mutex for the buffer pool.
-func (bp *BufferPool) _cleanUpTransaction(tid TransactionID) {
-	for lock := range bp.transactionLocks[tid] {
-		if lock.perm == ReadPerm {
-			bp.sharedLockMap[lock.pageKey] -= 1
-		} else if lock.perm == WritePerm {
-			delete(bp.exclusiveLockMap, lock.pageKey)
-		}
-	}
-	delete(bp.transactionLocks, tid)
-	delete(bp.transactionWaitingFor, tid)
+// _cleanUpTransaction releases all locks held by the transaction, and removes
+// its pages' before images. We assume the calling method holds the mutex for
+// the buffer pool.
+func (bp *BufferPool) _cleanUpTransaction(tid *Transaction) {
+	delete(bp.beforeImages, tid)
+	bp.locks.releaseAll(tid)
 }
 
-// Abort the transaction, releasing locks. Because ailike is FORCE/NO STEAL, none
-// of the pages tid has dirtired will be on disk so it is sufficient to just
-// release locks to abort. You do not need to implement this for lab 1.
-func (bp *BufferPool) AbortTransaction(tid TransactionID) {
+// Abort the transaction, releasing locks; called by [Transaction.Abort]. Without a log, the buffer pool is
+// FORCE/NO STEAL, so none of the pages tid has dirtired will be on disk and it
+// is sufficient to drop them from the buffer pool to abort, unless other
+// transactions are writing records of them too, in which case only the
+// versions of tid are removed.  With one, pages tid changed may have been
+// written, so its changes are rolled back: the pages it changed since it last
+// logged them get their logged images back, and the changes it logged are
+// undone from the log.
+func (bp *BufferPool) abortTransaction(tid *Transaction) {
 	bp.mutex.Lock()
 	defer bp.mutex.Unlock()
-	for lock := range bp.transactionLocks[tid] {
-		if lock.perm == WritePerm {
-			delete(bp.pageMap, lock.pageKey)
+	if bp.log != nil {
+		if err := bp.rollback(tid); err != nil {
+			panic("Unable to roll back transaction. " + err.Error())
 		}
+		bp._cleanUpTransaction(tid)
+		return
+	}
+	for _, key := range tid.WriteSet() {
+		if hp, ok := bp.pageMap[key].(*heapPage); ok && hp.versioned && len(bp.otherWriters(key, tid)) > 0 {
+			hp.undoVersions(tid.id)
+			continue
+		}
+		delete(bp.pageMap, key)
+		delete(bp.prefetch.unused, key)
+		bp.replacer.remove(key)
 	}
 	bp._cleanUpTransaction(tid)
 }
 
-// Commit the transaction, releasing locks. Because ailike is FORCE/NO STEAL, none
-// of the pages tid has dirtied will be on disk, so prior to releasing locks you
-// should iterate through pages and write them to disk.  In ailike lab3 we assume
-// that the system will not crash while doing this, allowing us to avoid using a
-// WAL. You do not need to implement this for lab 1.
-func (bp *BufferPool) CommitTransaction(tid TransactionID) {
+// Commit the transaction, releasing locks; called by [Transaction.Commit]. Without a log, the buffer pool is
+// FORCE/NO STEAL, so none of the pages tid has dirtied will be on disk, and
+// prior to releasing locks they are written to disk; this assumes that the
+// system will not crash while doing so.  With one, the changes to the pages
+// are logged instead, and the transaction commits once its commit record is
+// on disk; the pages are written when they are evicted.
+func (bp *BufferPool) commitTransaction(tid *Transaction) {
 	bp.mutex.Lock()
 	defer bp.mutex.Unlock()
-	for lock := range bp.transactionLocks[tid] {
-		if lock.perm == WritePerm {
-			// It is possible for a clean page to be evicted from the pageMap even if a transaction has an exclusive lock on it.
-			// Therefore, we need this check.
-			if page := bp.pageMap[lock.pageKey]; page != nil {
-				err := bp.pageMap[lock.pageKey].flushPage()
-				if err != nil {
-					panic("Unable to flush page when commiting transaction. " + err.Error())
+	if bp.log != nil {
+		for _, key := range tid.WriteSet() {
+			if page := bp.pageMap[key]; page != nil {
+				if err := bp.logWriters(key, page); err != nil {
+					panic("Unable to log page when commiting transaction. " + err.Error())
 				}
 			}
 		}
+		if err := bp.log.logCommit(tid); err != nil {
+			panic("Unable to log commit. " + err.Error())
+		}
+		if err := sharedFiles.commit(); err != nil {
+			panic("Unable to sync files when commiting transaction. " + err.Error())
+		}
+		bp._cleanUpTransaction(tid)
+		if bp.log.sinceCheckpoint() > CHECKPOINT_INTERVAL {
+			if err := bp.log.checkpoint(); err != nil {
+				panic("Unable to write checkpoint. " + err.Error())
+			}
+		}
+		return
+	}
+	for _, key := range tid.WriteSet() {
+		// It is possible for a clean page to be evicted from the pageMap even if a transaction has an exclusive lock on it.
+		// Therefore, we need this check.
+		if page := bp.pageMap[key]; page != nil {
+			err := bp.forcePage(key, page, tid)
+			if err != nil {
+				panic("Unable to flush page when commiting transaction. " + err.Error())
+			}
+		}
+	}
+	if err := sharedFiles.commit(); err != nil {
+		panic("Unable to sync files when commiting transaction. " + err.Error())
 	}
 	bp._cleanUpTransaction(tid)
 }
 
-func (bp *BufferPool) BeginTransaction(tid TransactionID) error {
-	return nil
-}
-
-// // Used for debugging
-// func (bp *BufferPool) printLockState() {
-// 	fmt.Println("START STATE")
-// 	fmt.Println("transaction waiting for: ")
-// 	for k, v := range bp.transactionWaitingFor {
-// 		fmt.Println(k, v)
-// 	}
-// 	fmt.Println("shared map: ")
-// 	for k, v := range bp.sharedLockMap {
-// 		fmt.Println(k, v)
-// 	}
-// 	fmt.Println("exclusive map: ")
-// 	for k, v := range bp.exclusiveLockMap {
-// 		fmt.Println(k, v)
-// 	}
-// 	fmt.Println("END STATE")
-// }
-
-// // Used for debugging
-// // For each transaction in the cycle, print its:
-// //   - tid
-// //   - the lock it is waiting for
-// //   - the locks it is currently holding/has reserved
-// func (bp *BufferPool) printCycle(path []TransactionID, lasttid TransactionID) {
-// 	fmt.Println(path, lasttid)
-// 	for _, tid := range path {
-// 		fmt.Println(tid, bp.transactionWaitingFor[tid], bp.transactionLocks[tid])
-// 	}
-// 	fmt.Println(lasttid, bp.transactionWaitingFor[lasttid], bp.transactionLocks[lasttid])
-// }
-
-// Checks if the given transaction is involved in any cycles in the wait-for graph.
-func (bp *BufferPool) checkTransactionInCycle(tid TransactionID) bool {
-	path := make([]TransactionID, 0)
-	path = append(path, tid)
-	visited := make(map[TransactionID]bool, 0)
-	visited[tid] = true
-	return bp._checkPathInCycle(path, visited)
-}
-
-// Checks if the given path is involved in any cycles in the wait-for graph.
-// We do depth-first seach from the last transaction in the path. This method is called recursively
-// until a cycle is detected involving the starting transaction, or the depth first search completes.
-// Args:
-// -- path: the current sequence of transactions we are exploring
-// -- visited: a map keeping track of all transactions we have already visited
-func (bp *BufferPool) _checkPathInCycle(path []TransactionID, visited map[TransactionID]bool) bool {
-	curTid := path[len(path)-1]
-	curLock := bp.transactionWaitingFor[curTid]
-	curPageKey := curLock.pageKey
-	curPerm := curLock.perm
-
-	// Make a copy of the visited map
-	newVisited := make(map[TransactionID]bool, len(visited))
-	for k, v := range visited {
-		newVisited[k] = v
-	}
-
-	// Check if another transaction is holding an exclusive lock on the desired pageKey.
-	// It is possible for a transaction to be waiting for an exclusive lock that it already has "reserved";
-	// if nextTid == curTid, that means we must be waiting another transaction to release a shared lock.
-	nextTid, ok := bp.exclusiveLockMap[curPageKey]
-	if ok && nextTid != nil && nextTid != curTid {
-		// If nextTid is the first transaction in the path, we have found a cycle.
-		if path[0] == nextTid {
-			// bp.printCycle(path, tid)
-			return true
+// Rolls back the changes of tid, which holds write locks on the pages it
+// changed, or on their records.  Cached pages with versions are rolled back in
+// place, since other transactions may be changing them too.
+func (bp *BufferPool) rollback(tid *Transaction) error {
+	for _, key := range tid.WriteSet() {
+		page := bp.pageMap[key]
+		if hp, ok := page.(*heapPage); ok && hp.versioned {
+			// the changes of the other transactions writing the page are logged
+			// before the images of the undo that include them
+			if err := bp.logWriters(key, page); err != nil {
+				return err
+			}
+			hp.undoVersions(tid.id)
+			continue
 		}
-		// Otherwise, we explore nextTid's dependancies unless it was already visited.
-		if _, ok := visited[nextTid]; !ok {
-			if _, ok := bp.transactionWaitingFor[nextTid]; ok {
-				pathCopy := make([]TransactionID, len(path))
-				copy(pathCopy, path)
-				pathCopy = append(pathCopy, nextTid)
-				newVisited[nextTid] = true
-				if bp._checkPathInCycle(pathCopy, newVisited) {
-					return true
-				}
+		before, ok := bp.beforeImages[tid][key]
+		if ok && page != nil && page.isDirty() {
+			if err := bp.restorePage(key, page, before); err != nil {
+				return err
 			}
 		}
 	}
-	// If we are waiting for an exclusive lock, then we also need to consider all the transactions holding shared locks.
-	if curPerm == WritePerm {
-		for nextTid, heldLocks := range bp.transactionLocks {
-			if _, ok := heldLocks[Lock{curPageKey, ReadPerm}]; ok && nextTid != path[len(path)-1] {
-				// If nextTid is the first transaction in the path, we have found a cycle.
-				if path[0] == nextTid {
-					// bp.printCycle(path, tid)
-					return true
-				}
-				// Otherwise, we explore nextTid's dependancies unless it was already visited.
-				if _, ok := visited[nextTid]; !ok {
-					if _, ok := bp.transactionWaitingFor[nextTid]; ok {
-						// We need to make a copy of visited.
-						newPath := make([]TransactionID, len(path))
-						copy(newPath, path)
-						newPath = append(newPath, nextTid)
-						newVisited[nextTid] = true
-						if bp._checkPathInCycle(newPath, newVisited) {
-							return true
-						}
-					}
-				}
-			}
+	delete(bp.beforeImages, tid)
+	current := func(key HeapFilePageKey) ([]byte, error) {
+		if page := bp.pageMap[key]; page != nil {
+			return pageImage(page)
 		}
+		return readPageImage(key)
 	}
-	return false
+	return bp.log.logAbort(tid, current, func(key HeapFilePageKey, image []byte, clr LSN) error {
+		if page := bp.pageMap[key]; page != nil {
+			bp.log.pageChanged(key, clr)
+			if page.(*heapPage).versioned {
+				return nil
+			}
+			return bp.restorePage(key, page, image)
+		}
+		if err := bp.log.force(); err != nil {
+			return err
+		}
+		// a page of the file being read ahead would not see the undo
+		bp.cancelPrefetches(func(name string) bool { return name == key.fileName })
+		return writePageImage(key, image)
+	})
 }
 
 // Retrieve the specified page from the specified DBFile (e.g., a HeapFile), on
 // behalf of the specified transaction. If a page is not cached in the buffer pool,
 // you can read it from disk uing [DBFile.readPage]. If the buffer pool is full (i.e.,
-// already stores numPages pages), a page should be evicted.  Should not evict
-// pages that are dirty, as this would violate NO STEAL. If the buffer pool is
-// full of dirty pages, you should return an error. For lab 1, you do not need to
-// implement locking or deadlock detection. [For future labs, before returning the page,
-// attempt to lock it with the specified permission. If the lock is
-// unavailable, should block until the lock is free. If a deadlock occurs, abort
-// one of the transactions in the deadlock]. You will likely want to store a list
-// of pages in the BufferPool in a map keyed by the [DBFile.pageKey].
-func (bp *BufferPool) GetPage(file DBFile, pageNo int, tid TransactionID, perm RWPerm) (*Page, error) {
-	pageKey := file.pageKey(pageNo)
-	var attempts int = 0
-	bp.mutex.Lock()
-	defer bp.mutex.Unlock()
+// already stores numPages pages), a page should be evicted.  Without a log,
+// should not evict pages that are dirty, as this would violate NO STEAL. If the
+// buffer pool is full of dirty pages, you should return an error.  With one,
+// dirty pages are written out once their changes are logged. Before the page
+// is returned, it is locked with the specified permission by the lock manager,
+// blocking until the lock is granted. If the transaction is chosen as the
+// victim of a deadlock, a DeadlockError is returned, and if it times out, a
+// TransactionTimeoutError; in both cases the transaction is aborted if
+// ABORT_TRANSACTIONS is set. Transactions that have completed cannot read
+// pages. Pages are cached in a map keyed by the [DBFile.pageKey].
+func (bp *BufferPool) GetPage(file DBFile, pageNo int, tid *Transaction, perm RWPerm) (*Page, error) {
+	return bp.getLockedPage(file, pageNo, tid, perm, file.pageKey(pageNo), lockModeFor(perm), false)
+}
 
-	// Add tid to the transactionLocks map if it is not already present
-	if _, ok := bp.transactionLocks[tid]; !ok {
-		bp.transactionLocks[tid] = make(map[Lock]bool)
-	}
+// Like [BufferPool.GetPage], but pins the page, so that it is not evicted
+// while the caller uses it; the caller unpins it with [BufferPool.unpinPage].
+// The other methods that retrieve pages for a [HeapFile] pin them too.
+func (bp *BufferPool) getPinnedPage(file DBFile, pageNo int, tid *Transaction, perm RWPerm) (*Page, error) {
+	return bp.getLockedPage(file, pageNo, tid, perm, file.pageKey(pageNo), lockModeFor(perm), true)
+}
 
-	var desiredLock Lock = Lock{pageKey, perm}
-	bp.transactionWaitingFor[tid] = desiredLock
+// Retrieves the page of the record with the given rid, like
+// [BufferPool.GetPage], but locks the record with the given permission, and the
+// page only with an intention lock, so that other transactions can lock the
+// other records of the page.
+func (bp *BufferPool) getRecordPage(file DBFile, rid heapRecordId, tid *Transaction, perm RWPerm) (*Page, error) {
+	return bp.getLockedPage(file, rid.pageNo, tid, perm, rid, lockModeFor(perm), true)
+}
 
-	// Block while another transaction is holding the exclusive lock for this page.
-	for exclusiveLockHolder, ok := bp.exclusiveLockMap[pageKey]; ok && exclusiveLockHolder != nil; exclusiveLockHolder, ok = bp.exclusiveLockMap[pageKey] {
-		// If the exclusive lock is being held by the current transaction, then we do not need to block.
-		if exclusiveLockHolder == tid {
-			break
-		}
-		// If the current transaction already holds a shared lock, then that means the exclusiveLockHoler is waiting
-		// on the current transaction to release its shared lock so it can convert its "reservation" to a full lock.
-		if _, ok := bp.transactionLocks[tid][desiredLock]; ok && perm == ReadPerm {
-			break
-		}
+// Retrieves the specified page for tid to insert records into, locking it with
+// an IX lock, so that other transactions can insert into it too; tid locks the
+// records it inserts with [BufferPool.lockRecord].
+func (bp *BufferPool) getInsertPage(file DBFile, pageNo int, tid *Transaction) (*Page, error) {
+	return bp.getLockedPage(file, pageNo, tid, WritePerm, file.pageKey(pageNo), IntentionExclusiveLock, true)
+}
 
-		attempts += 1
-		if attempts%CYCLE_CHECK_INTERVAL == 0 {
-			if bp.checkTransactionInCycle(tid) {
-				if ABORT_TRANSACTIONS {
-					bp.mutex.Unlock()
-					bp.AbortTransaction(tid)
-					time.Sleep(BLOCK_TIME)
-					bp.mutex.Lock()
-				}
-				return nil, ailikeError{DeadlockError, "Deadlock detected."}
-			}
+// Locks the record with the given rid for tid with the given permission.
+func (bp *BufferPool) lockRecord(tid *Transaction, rid heapRecordId, perm RWPerm) error {
+	if err := bp.locks.acquireRecord(tid, rid, perm); err != nil {
+		if ABORT_TRANSACTIONS {
+			tid.Abort()
 		}
-		bp.mutex.Unlock()
-		time.Sleep(BLOCK_TIME)
-		bp.mutex.Lock()
+		return err
 	}
+	return nil
+}
 
-	switch perm {
-	case ReadPerm:
-		if _, ok := bp.sharedLockMap[pageKey]; !ok {
-			bp.sharedLockMap[pageKey] = 0
-		}
-		if _, ok := bp.transactionLocks[tid][desiredLock]; !ok {
-			bp.transactionLocks[tid][desiredLock] = true
-			bp.sharedLockMap[pageKey] += 1
-		}
-	case WritePerm:
-		if ALLOW_RESERVATIONS {
-			// Allow a transaction to "reserve" an exclusive lock to prevent new pages from acquiring shared locks.
-			// The lock is not full "granted" until other transactions release their shared locks.
-			bp.exclusiveLockMap[pageKey] = tid
-			bp.transactionLocks[tid][desiredLock] = true
-		}
-		attempts = 0
-		// Block until all transactions let go of shared locks.
-		for numSharedHolders, ok := bp.sharedLockMap[pageKey]; ok && numSharedHolders > 0; numSharedHolders, ok = bp.sharedLockMap[pageKey] {
-			_, transactionHoldsSharedLock := bp.transactionLocks[tid][Lock{pageKey, ReadPerm}]
-			if numSharedHolders == 1 && transactionHoldsSharedLock {
-				// If the only transaction holding a shared lock is this transaction, then we do not need to block.
-				break
-			}
-			attempts += 1
-			if attempts%CYCLE_CHECK_INTERVAL == 0 {
-				if bp.checkTransactionInCycle(tid) {
-					if ABORT_TRANSACTIONS {
-						bp.mutex.Unlock()
-						bp.AbortTransaction(tid)
-						time.Sleep(BLOCK_TIME)
-						bp.mutex.Lock()
-					}
-					return nil, ailikeError{DeadlockError, "Deadlock detected."}
-				}
-			}
-			bp.mutex.Unlock()
-			time.Sleep(BLOCK_TIME)
-			bp.mutex.Lock()
+// Retrieves the specified page for tid once it holds a lock on key in the
+// given mode, which allows it to access the page with the given permission,
+// pinning it if pin is set.
+func (bp *BufferPool) getLockedPage(file DBFile, pageNo int, tid *Transaction, perm RWPerm, key lockKey, mode LockMode, pin bool) (*Page, error) {
+	if err := bp.checkTransaction(tid); err != nil {
+		return nil, err
+	}
+	if err := bp.locks.lock(tid, key, mode); err != nil {
+		if ABORT_TRANSACTIONS {
+			tid.Abort()
 		}
-		if !ALLOW_RESERVATIONS {
-			// If we do not allow reservations, then we wait until shared locks are released before acquiring exclusive locks.
-			bp.exclusiveLockMap[pageKey] = tid
-			bp.transactionLocks[tid][desiredLock] = true
+		return nil, err
+	}
+	tid.recordAccess(file.pageKey(pageNo), perm)
+	return bp.cachedPage(file, pageNo, tid, perm, pin)
+}
+
+// Locks the whole of file for tid with the given permission, as if tid's locks
+// on its pages had been escalated, so that the pages tid then reads are not
+// locked one at a time.  Parallel plans lock the files their workers read
+// before starting them, since the workers read pages for tid at once.
+func (bp *BufferPool) lockFile(file DBFile, tid *Transaction, perm RWPerm) error {
+	if err := bp.checkTransaction(tid); err != nil {
+		return err
+	}
+	if err := bp.locks.lock(tid, tableLockKey{file.pageKey(0).getFileName()}, lockModeFor(perm)); err != nil {
+		if ABORT_TRANSACTIONS {
+			tid.Abort()
 		}
+		return err
+	}
+	return nil
+}
+
+// Retrieves the specified page for tid to read the versions of its tuples in
+// tid's snapshot, without locking it, as [BufferPool.GetPage] otherwise does.
+// The page is pinned.
+func (bp *BufferPool) getSnapshotPage(file DBFile, pageNo int, tid *Transaction) (*Page, error) {
+	if err := bp.checkTransaction(tid); err != nil {
+		return nil, err
+	}
+	return bp.cachedPage(file, pageNo, tid, ReadPerm, true)
+}
 
+// Returns an error if tid cannot read pages, aborting it if it has timed out
+// and ABORT_TRANSACTIONS is set.
+func (bp *BufferPool) checkTransaction(tid *Transaction) error {
+	err := tid.check()
+	if err != nil && ABORT_TRANSACTIONS && err.(ailikeError).code == TransactionTimeoutError {
+		tid.Abort()
 	}
-	delete(bp.transactionWaitingFor, tid)
+	return err
+}
 
+// Returns the specified page from the cache, reading it from file if it is not
+// cached, and saving its image if it is to be written.  If the page is being
+// read ahead, the read is waited for rather than repeated.  The replacement
+// policy is told of the use of the page, and the page is pinned if pin is set.
+func (bp *BufferPool) cachedPage(file DBFile, pageNo int, tid *Transaction, perm RWPerm, pin bool) (*Page, error) {
+	pageKey := file.pageKey(pageNo)
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+
+	tid.counters.pagesRequested.Add(1)
+	if hf, ok := file.(*HeapFile); ok && hf.indexFile {
+		tid.counters.indexPagesRead.Add(1)
+	}
+	bp.awaitPrefetch(pageKey)
 	if page, ok := bp.pageMap[pageKey]; ok {
+		tid.counters.bufferHits.Add(1)
+		bp.stats.Hits++
+		bp.replacer.access(pageKey)
+		bp.usePrefetched(pageKey)
+		if perm == WritePerm {
+			if err := bp.saveBeforeImage(tid, page); err != nil {
+				return nil, err
+			}
+		}
+		if pin {
+			bp.pin(pageKey)
+		}
 		return &page, nil
 	}
+	tid.counters.bufferMisses.Add(1)
+	bp.stats.Misses++
 
 	page, err := file.readPage(pageNo)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(bp.pageMap) == bp.numPages {
-		evictMethod := bp.EvictPage
-		if USE_EVICT_QUEUE {
-			evictMethod = bp.EvictPageQueue
-		}
-		if err := evictMethod(); err != nil {
+	if len(bp.pageMap) >= bp.numPages {
+		if err := bp.EvictPage(); err != nil {
 			return nil, err
 		}
 	}
 
 	bp.pageMap[pageKey] = *page
-	bp.evictQueue = append(bp.evictQueue, pageKey)
+	bp.replacer.admit(pageKey)
+	if perm == WritePerm {
+		if err := bp.saveBeforeImage(tid, *page); err != nil {
+			return nil, err
+		}
+	}
+	if pin {
+		bp.pin(pageKey)
+	}
 	return page, nil
 }
 
-func (bp *BufferPool) hasPageCached(file DBFile, pageNo int, tid TransactionID, perm RWPerm) bool {
+func (bp *BufferPool) hasPageCached(file DBFile, pageNo int, tid *Transaction, perm RWPerm) bool {
 	pageKey := file.pageKey(pageNo)
-	if _, ok := bp.pageMap[pageKey]; ok {
-		return true
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	_, ok := bp.pageMap[pageKey]
+	return ok
+}
+
+// Writes the cached pages of file to disk, removes them from the buffer pool,
+// and releases any locks on them.  This is for temporary files, such as the
+// sorted runs of an external sort, that are private to a single operator: they
+// need neither locking nor NO STEAL, and their dirty pages would otherwise fill
+// the buffer pool until the transaction commits.
+func (bp *BufferPool) releaseFile(file DBFile) error {
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	fileName := file.pageKey(0).getFileName()
+	for k, page := range bp.pageMap {
+		if k.getFileName() != fileName {
+			continue
+		}
+		if page.isDirty() {
+			if err := page.flushPage(); err != nil {
+				return err
+			}
+		}
+		delete(bp.pageMap, k)
+		delete(bp.prefetch.unused, k)
+		bp.replacer.remove(k)
 	}
-	return false
+	bp.cancelPrefetches(func(name string) bool { return name == fileName })
+	bp.locks.releaseFile(fileName)
+	return nil
 }
@@ -6,10 +6,9 @@ import (
 
 func TestGetPage(t *testing.T) {
 	_, t1, t2, hf, bp, _ := makeTestVars()
-	tid := NewTID()
 	nInsertedTuples := 300
 	for i := 0; i < nInsertedTuples; i++ {
-		bp.BeginTransaction(tid)
+		tid := bp.Transactions().Begin()
 		err := hf.insertTuple(&t1, tid)
 		if err != nil {
 			t.Fatalf("%v", err)
@@ -18,7 +17,7 @@ func TestGetPage(t *testing.T) {
 		if err != nil {
 			t.Fatalf("%v", err)
 		}
-		bp.CommitTransaction(tid)
+		tid.Commit()
 
 		//hack to force dirty pages to disk
 		//because CommitTransaction may not be implemented
@@ -36,7 +35,7 @@ func TestGetPage(t *testing.T) {
 		// }
 
 	}
-	bp.BeginTransaction(tid)
+	tid := bp.Transactions().Begin()
 
 	expectedPages := (nInsertedTuples * hf.desc.sizeInBytes()) / PageSize
 	//expect 6 pages
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"sync"
 )
 
 type Table struct {
@@ -19,6 +20,12 @@ type Catalog struct {
 	columnMap map[string][]*Table
 	bp        *BufferPool
 	rootPath  string
+	// statistics collected by ANALYZE, by table name.  They are kept in memory
+	// only, so ANALYZE must be rerun after a restart.
+	stats      map[string]*TableStats
+	statsLatch *sync.Mutex // guards stats, which ANALYZE writes while other queries plan
+	// the most workers a parallel plan may use; 1 disables parallel plans
+	maxParallelWorkers int
 }
 
 func (c *Catalog) SaveToFile(catalogFile string, rootPath string) error {
@@ -37,8 +44,9 @@ func (c *Catalog) dropTable(table string) error {
 		if t.name == table {
 			c.tableMap[table] = nil
 			c.columnMap[table] = nil
+			c.setTableStats(table, nil)
 			c.tables = append(c.tables[:i], c.tables[i+1:]...)
-			os.Remove(c.tableNameToFile(table))
+			sharedFiles.remove(c.tableNameToFile(table))
 			return nil
 		}
 	}
@@ -127,7 +135,13 @@ func NewCatalogFromFile(catalogFile string, bp *BufferPool, rootPath string) (*C
 	if err != nil {
 		return nil, err
 	}
-	c := &Catalog{make([]*Table, 0), make(map[string]*Table), make(map[string][]*Table), bp, rootPath}
+	// recover from the log before any pages of the tables are read
+	log, err := openLogFile(logFileName(catalogFile, rootPath))
+	if err != nil {
+		return nil, err
+	}
+	bp.attachLog(log)
+	c := &Catalog{make([]*Table, 0), make(map[string]*Table), make(map[string][]*Table), bp, rootPath, make(map[string]*TableStats), &sync.Mutex{}, DEFAULT_MAX_PARALLEL_WORKERS}
 	for i, t := range tabs {
 		c.addTable(names[i], t)
 	}
@@ -171,7 +185,8 @@ func (c *Catalog) GetTable(named string) (DBFile, error) {
 	}
 
 	iFilenames := make(map[string]map[string]string)
-	indexTypeMap := make(map[string]string) // maps column name to whether or not index is clustered on that column
+	indexTypeMap := make(map[string]string)             // maps column name to whether or not index is clustered on that column
+	textFilenames := make(map[string]map[string]string) // maps column name to the files of its text index
 	files, err := ioutil.ReadDir(c.rootPath)
 	if err == nil {
 		for _, f := range files {
@@ -188,11 +203,19 @@ func (c *Catalog) GetTable(named string) (DBFile, error) {
 			col := split_name[2]
 			fileType := split_name[3]
 
-			if indexType != "clustered" && indexType != "secondary" {
+			if tableName != named {
 				continue
 			}
 
-			if tableName != named {
+			if indexType == "text" {
+				if _, found := textFilenames[col]; !found {
+					textFilenames[col] = make(map[string]string)
+				}
+				textFilenames[col][fileType] = c.rootPath + "/" + f.Name()
+				continue
+			}
+
+			if indexType != "clustered" && indexType != "secondary" {
 				continue
 			}
 
@@ -229,7 +252,7 @@ func (c *Catalog) GetTable(named string) (DBFile, error) {
 		if indexType == "clustered" {
 			indexDataDesc = t.desc.copy()
 		}
-		index, err := NewNNIndexFileFile(named, col, indexDataDesc, dataFileName, centroidFileName,
+		index, err := NewNNIndexFileFile(c.tableNameToFile(named), col, indexDataDesc, dataFileName, centroidFileName,
 			mappingFileName, c.bp)
 		if err != nil {
 			break
@@ -237,8 +260,50 @@ func (c *Catalog) GetTable(named string) (DBFile, error) {
 		NNindexes[col] = index
 	}
 
-	return NewHeapFileIndex(c.tableNameToFile(named), t.desc.copy(), c.bp, NNindexes)
+	hf, err := NewHeapFileIndex(c.tableNameToFile(named), t.desc.copy(), c.bp, NNindexes)
+	if err != nil {
+		return nil, err
+	}
+
+	for col, val := range textFilenames {
+		postingsFileName, found := val["postings"]
+		if !found {
+			continue
+		}
+		docsFileName, found := val["docs"]
+		if !found {
+			continue
+		}
+		index, err := NewTextIndexFile(hf.fileName, col, postingsFileName, docsFileName, c.bp)
+		if err != nil {
+			// without the index, MATCH and bm25 would silently miss records
+			return nil, err
+		}
+		hf.textIndexes[col] = index
+	}
+	hf.stats = c.tableStats(named)
+
+	return hf, nil
+}
 
+// Returns the statistics ANALYZE last collected for the table, or nil if it
+// has not been analyzed since the catalog was loaded.
+func (c *Catalog) tableStats(table string) *TableStats {
+	c.statsLatch.Lock()
+	defer c.statsLatch.Unlock()
+	return c.stats[table]
+}
+
+// Saves the statistics of the table for the files later opened by GetTable;
+// nil stats forget them.
+func (c *Catalog) setTableStats(table string, stats *TableStats) {
+	c.statsLatch.Lock()
+	defer c.statsLatch.Unlock()
+	if stats == nil {
+		delete(c.stats, table)
+		return
+	}
+	c.stats[table] = stats
 }
 
 func (c *Catalog) findTablesWithColumn(named string) []*Table {
@@ -247,6 +312,17 @@ func (c *Catalog) findTablesWithColumn(named string) []*Table {
 
 }
 
+// Sets the most workers a parallel plan of a query of the catalog may use, as
+// SET max_parallel_workers = n does.  With one worker, plans are not parallel.
+func (c *Catalog) SetMaxParallelWorkers(n int) {
+	c.maxParallelWorkers = max(1, n)
+}
+
+// Returns the most workers a parallel plan may use.
+func (c *Catalog) MaxParallelWorkers() int {
+	return c.maxParallelWorkers
+}
+
 func (c *Catalog) NumTables() int {
 	return len(c.tables)
 }
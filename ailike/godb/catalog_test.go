@@ -0,0 +1,64 @@
+package godb
+
+import (
+	"os"
+	"testing"
+)
+
+// Writes a catalog of the given tables, in the format of catalog.txt, to dir,
+// and loads it with a buffer pool of the given number of pages.  The tables
+// are read from, or created as, files in dir.
+func makeTestCatalog(t *testing.T, dir string, tables string, pages int) (*Catalog, *BufferPool) {
+	if err := os.WriteFile(dir+"/catalog.txt", []byte(tables), 0644); err != nil {
+		t.Fatalf("failed to write catalog, %s", err.Error())
+	}
+	bp := NewBufferPool(pages)
+	c, err := NewCatalogFromFile("catalog.txt", bp, dir)
+	if err != nil {
+		t.Fatalf("failed to load catalog, %s", err.Error())
+	}
+	return c, bp
+}
+
+// Runs a query over the catalog and returns its plan and the fields of its
+// results.
+func queryRows(t *testing.T, c *Catalog, bp *BufferPool, sql string) (Operator, [][]DBValue) {
+	_, plan, err := Parse(c, sql)
+	if err != nil {
+		t.Fatalf("failed to parse, q=%s, %s", sql, err.Error())
+	}
+	tid := bp.Transactions().Begin()
+	defer tid.Commit()
+	var rows [][]DBValue
+	for _, tup := range collectTuples(t, plan, tid) {
+		rows = append(rows, tup.Fields)
+	}
+	return plan, rows
+}
+
+// Runs a query over the catalog and returns its plan and the values of the
+// given int column of its results.
+func runIntColumnQuery(t *testing.T, c *Catalog, bp *BufferPool, sql string, col int) (Operator, []int64) {
+	plan, rows := queryRows(t, c, bp, sql)
+	var vals []int64
+	for _, row := range rows {
+		vals = append(vals, row[col].(IntField).Value)
+	}
+	return plan, vals
+}
+
+// Returns the results of op, failing the test on an error.
+func collectTuples(t *testing.T, op Operator, tid *Transaction) []*Tuple {
+	iter, err := op.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var ts []*Tuple
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		ts = append(ts, tup)
+	}
+	return ts
+}
@@ -53,3 +53,14 @@ func GenerateChatGPTFactCheck(fact string, query_matches []int64, withContext bo
 
 	return chatGPTResp.Response, nil
 }
+
+// Returns the query used to retrieve the context for a fact check: retCol of the
+// k rows of table whose textCol is most similar to the fact. When more than one
+// row is retrieved, the rows are diversified with mmr() so that near duplicates
+// do not crowd out other evidence.
+func FactCheckRetrievalQuery(fact string, table string, retCol string, textCol string, k int, lambda float64) string {
+	if k <= 1 {
+		return fmt.Sprintf("SELECT %s,%s,('%s' AILIKE %s) sim FROM %s ORDER BY sim ASC LIMIT 1;", retCol, textCol, fact, textCol, table)
+	}
+	return fmt.Sprintf("SELECT %s,mmr(%s,'%s',%v) diverse FROM %s ORDER BY diverse DESC LIMIT %d;", retCol, textCol, fact, lambda, table, k)
+}
@@ -218,7 +218,7 @@ func (c *Clustering) deleteAllMembers() error {
 func KMeansClustering(op Operator, nClusters int, embDim int,
 	maxIterations int, deltaThr float64,
 	embGetterFunc func(t *Tuple) (*EmbeddingType, error),
-	storeEmbs bool) (*Clustering, error) {
+	storeEmbs bool, tid *Transaction) (*Clustering, error) {
 
 	clustering := newClustering(nClusters, embDim, storeEmbs)
 	nIteration := 0
@@ -226,7 +226,7 @@ func KMeansClustering(op Operator, nClusters int, embDim int,
 
 	for (nIteration < maxIterations) && (true) {
 		//Renew iterator
-		iterator, err := op.Iterator(NewTID())
+		iterator, err := op.Iterator(tid)
 		if err != nil {
 			return nil, err
 		}
@@ -248,6 +248,10 @@ func KMeansClustering(op Operator, nClusters int, embDim int,
 			if err != nil {
 				return nil, err
 			}
+			if newEmb == nil {
+				// records without an embedding are not clustered
+				continue
+			}
 			clusterAssignment, distToCentroid, err := clustering.addRecordToClustering((*newTuple).Rid, newEmb)
 			if err != nil {
 				return nil, err
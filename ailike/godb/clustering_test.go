@@ -26,7 +26,7 @@ type SliceEmbeddingOperator struct {
 	RecordIDs []recordID
 }
 
-func (sOp *SliceEmbeddingOperator) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+func (sOp *SliceEmbeddingOperator) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
 	idx := 0
 
 	return func() (*Tuple, error) {
@@ -70,7 +70,7 @@ func TestGetSliceOperator(t *testing.T) {
 	operator := getSliceOperator()
 	tdesc := operator.Descriptor()
 	getterFunc := GetSimpleGetterFunc(tdesc.Fields[0].Fname)
-	iterator, err := operator.Iterator(NewTID())
+	iterator, err := operator.Iterator(NewBufferPool(1).Transactions().Begin())
 	if err != nil {
 		t.Errorf("Error.")
 	}
@@ -133,7 +133,7 @@ func TestKMeansClusteringSmall(t *testing.T) {
 	operator := getSliceOperator()
 	tdesc := operator.Descriptor()
 	getterFunc := GetSimpleGetterFunc(tdesc.Fields[0].Fname)
-	clustering, err := KMeansClustering(&operator, 4, 2, 10, 1.0, getterFunc, true)
+	clustering, err := KMeansClustering(&operator, 4, 2, 10, 1.0, getterFunc, true, NewBufferPool(1).Transactions().Begin())
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
@@ -179,6 +179,8 @@ func MakeTestDatabaseFromCsv(tableName string, csvPath string, bufPoolSize int)
 }
 
 func (c *Clustering) SampleHeapFileClusteringPrint(hf *HeapFile, bp *BufferPool, nSamples int) {
+	tid := bp.Transactions().Begin()
+	defer tid.Commit()
 	for key, _ := range c.centroidEmbs {
 		fmt.Println("Cluster ID: ", key)
 		fmt.Println("Members: ")
@@ -186,7 +188,7 @@ func (c *Clustering) SampleHeapFileClusteringPrint(hf *HeapFile, bp *BufferPool,
 		count := 0
 		for _, z := range c.clusterMemb[key] {
 			hrid := z.rid.(heapRecordId)
-			page, err := bp.GetPage(hf, hrid.pageNo, NewTID(), ReadPerm)
+			page, err := bp.GetPage(hf, hrid.pageNo, tid, ReadPerm)
 			if err != nil {
 				panic(err.Error())
 			}
@@ -210,7 +212,7 @@ func TestKMeansHeapFile(t *testing.T) {
 		t.Fatalf(err.Error())
 	}
 	getterFunc := GetSimpleGetterFunc("content")
-	clustering, err := KMeansClustering(hfile, 1000, TextEmbeddingDim, 1, 1.0, getterFunc, false)
+	clustering, err := KMeansClustering(hfile, 1000, TextEmbeddingDim, 1, 1.0, getterFunc, false, bp.Transactions().Begin())
 
 	if VerboseClusterTests {
 		clustering.SampleHeapFileClusteringPrint(hfile, bp, 10)
@@ -0,0 +1,606 @@
+package godb
+
+import (
+	"math"
+	"strings"
+)
+
+// PlanCost is the optimizer's estimate for a plan: the number of rows it
+// produces, and the total cost of producing them, in units of sequential
+// page reads (see CostPageRead and the other cost weights).
+type PlanCost struct {
+	Rows float64
+	Cost float64
+}
+
+// Returns the inputs of op.
+func planChildren(op Operator) []Operator {
+	switch op := op.(type) {
+	case *EqualityJoin[int64]:
+		return []Operator{*op.left, *op.right}
+	case *EqualityJoin[string]:
+		return []Operator{*op.left, *op.right}
+	case *GraceHashJoin:
+		return []Operator{op.left, op.right}
+	case *SortMergeJoin:
+		return []Operator{op.left, op.right}
+	case *Project:
+		return []Operator{op.child}
+	case *Filter:
+		return []Operator{op.child}
+	case *OrderBy:
+		return []Operator{op.child}
+	case *LimitOp:
+		return []Operator{op.child}
+	case *Aggregator:
+		return []Operator{op.child}
+	case *MMR:
+		return []Operator{op.child}
+	case *RRFusion:
+		return op.children
+	case *SetOp:
+		return []Operator{op.left, op.right}
+	case *InsertOp:
+		return []Operator{op.child}
+	case *DeleteOp:
+		return []Operator{op.child}
+	case *UpdateOp:
+		return []Operator{op.child}
+	case *SubqueryOp:
+		children := []Operator{op.child}
+		for _, s := range op.subqueries {
+			children = append(children, s.op)
+		}
+		return children
+	case *Gather:
+		return op.children
+	case *GatherMerge:
+		return op.children
+	case *InstrumentedOp:
+		return planChildren(op.op)
+	}
+	return nil
+}
+
+// Returns the statistics of the table read by op that contains field, or nil if
+// no such table has been analyzed.
+func statsForField(op Operator, field FieldType) *TableStats {
+	var hf *HeapFile
+	switch o := op.(type) {
+	case *HeapFile:
+		hf = o
+	case *heapScanPartition:
+		hf = o.file
+	case *NNScan:
+		hf = o.heapFile
+	case *MultiNNScan:
+		hf = o.scans[0].heapFile
+	case *BM25Scan:
+		hf = o.heapFile
+	case *InstrumentedOp:
+		return statsForField(o.op, field)
+	}
+	if hf != nil {
+		if _, err := findFieldInTd(FieldType{field.Fname, field.TableQualifier, UnknownType}, hf.Descriptor()); err == nil {
+			return hf.stats
+		}
+		return nil
+	}
+	for _, child := range planChildren(op) {
+		if stats := statsForField(child, field); stats != nil {
+			return stats
+		}
+	}
+	return nil
+}
+
+// Returns the estimated number of distinct values of expr in the output of op.
+func distinctValues(op Operator, expr Expr, rows float64) float64 {
+	if key, ok := expr.(*compositeKeyExpr); ok {
+		// the columns of the key are assumed to be independent
+		ndv := 1.0
+		for _, e := range key.exprs {
+			ndv *= distinctValues(op, e, rows)
+		}
+		return math.Min(ndv, rows)
+	}
+	field, ok := expr.(*FieldExpr)
+	if !ok {
+		return rows
+	}
+	stats := statsForField(op, field.selectField)
+	if stats == nil || stats.Columns[field.selectField.Fname] == nil {
+		return rows
+	}
+	return math.Min(rows, float64(stats.Columns[field.selectField.Fname].NumDistinct))
+}
+
+// Returns the number of records in a table, from its statistics if it has been analyzed.
+func tableRows(hf *HeapFile) float64 {
+	if hf.stats != nil {
+		return float64(hf.stats.NumTuples)
+	}
+	return float64(hf.ApproximateNumTuples())
+}
+
+// Returns the estimated cost of evaluating e on each row, and the cost incurred once
+// per query, such as computing the embeddings of query literals.
+func exprCost(e Expr) (perRow float64, once float64) {
+	switch e := e.(type) {
+	case *ConstExpr:
+		if e.constType == EmbeddedStringType {
+			return 0, CostEmbeddingCall
+		}
+	case *FuncExpr:
+		perRow = CostTupleCPU
+		if strings.HasPrefix(e.op, "ailike") {
+			perRow = CostDistance
+		}
+		for _, arg := range e.args {
+			argPerRow, argOnce := exprCost(*arg)
+			perRow += argPerRow
+			once += argOnce
+		}
+	case *MultiVectorExpr:
+		return float64(len(e.queries)) * CostDistance, float64(len(e.queries)) * CostEmbeddingCall
+	case *BM25Expr:
+		return float64(len(e.queryTerms)) * CostTupleCPU, 0
+	case *CompareExpr:
+		return exprsCostPerRow(e.left, e.right)
+	case *AndExpr:
+		return predsCostPerRow(e.preds)
+	case *OrExpr:
+		return predsCostPerRow(e.preds)
+	case *NotExpr:
+		return exprCost(e.pred)
+	case *InExpr:
+		return exprsCostPerRow(append([]Expr{e.left}, e.list...)...)
+	case *BetweenExpr:
+		return exprsCostPerRow(e.val, e.low, e.high)
+	case *IsNullExpr:
+		return exprCost(e.expr)
+	}
+	return perRow, once
+}
+
+// Returns the summed per row and one-time costs of exprs.
+func exprsCostPerRow(exprs ...Expr) (perRow float64, once float64) {
+	for _, e := range exprs {
+		p, o := exprCost(e)
+		perRow += p
+		once += o
+	}
+	return perRow, once
+}
+
+func predsCostPerRow(preds []PredicateExpr) (perRow float64, once float64) {
+	for _, p := range preds {
+		pr, o := exprCost(p)
+		perRow += pr
+		once += o
+	}
+	return perRow, once
+}
+
+// Returns the estimated cost of evaluating each of exprs on rows rows.
+func exprsCost(exprs []Expr, rows float64) float64 {
+	cost := 0.0
+	for _, e := range exprs {
+		perRow, once := exprCost(e)
+		cost += rows*perRow + once
+	}
+	return cost
+}
+
+// Returns the estimated cost of sorting rows rows in memory.
+func sortCost(rows float64) float64 {
+	return rows * math.Log2(rows+1) * CostTupleCPU
+}
+
+// Returns the estimated number of pages needed to store rows records with the
+// given descriptor in a temporary file.
+func spillPages(desc *TupleDesc, rows float64) float64 {
+	if !canSpill(desc) {
+		return 0
+	}
+	return math.Ceil(rows * float64(desc.sizeInBytes()) / float64(PageSize))
+}
+
+// Returns the estimated cost of the disk accesses of an external sort of rows
+// records: once they exceed the memory budget, each pass writes and reads them.
+func spillSortCost(op *OrderBy, rows float64) float64 {
+	desc := op.child.Descriptor()
+	if op.bufPool == nil || op.limit != nil || !canSpill(desc) {
+		return 0
+	}
+	bytes := rows * float64(desc.sizeInBytes())
+	if bytes <= float64(op.memoryBudget) {
+		return 0
+	}
+	runs := math.Ceil(bytes / float64(max(op.memoryBudget, 1)))
+	fanIn := float64(max(2, op.memoryBudget/PageSize))
+	passes := 1 + math.Max(math.Ceil(math.Log(runs)/math.Log(fanIn))-1, 0)
+	return 2 * passes * spillPages(desc, rows) * CostPageRead
+}
+
+// Returns the value of a limit expression, or -1 if it cannot be evaluated.
+func limitValue(limit Expr) float64 {
+	v, err := limit.EvalExpr(nil)
+	if err != nil {
+		return -1
+	}
+	if v, ok := v.(IntField); ok {
+		return float64(v.Value)
+	}
+	return -1
+}
+
+// Estimates the cost of an NNScan: the centroids are all compared to the query,
+// and then the pages of the probed clusters are read, along with the table page of
+// each candidate for a secondary index.
+func nnScanCost(v *NNScan) PlanCost {
+	index := v.nnIndexFile
+	nCentroids, candidates, dataPages := nnScanProbes(v)
+	// each partition of a parallel scan chooses the same clusters, but reads
+	// only its share of their pages
+	candidates /= float64(v.parts)
+
+	cost := float64(index.centroidHeapFile.NumPages()+index.mappingHeapFile.NumPages()) * CostPageRead
+	cost += nCentroids*CostDistance + sortCost(nCentroids)
+	cost += dataPages / float64(v.parts) * CostPageRead
+	if !index.clustered {
+		cost += candidates * CostRandomPageRead
+	}
+	cost += candidates * CostTupleCPU
+	if v.filter != nil {
+		cost += exprsCost([]Expr{v.filter}, candidates)
+		return PlanCost{candidates * predicateSelectivity(v.heapFile, v.filter), cost}
+	}
+	return PlanCost{candidates, cost}
+}
+
+// Returns the number of clusters of the index of an NNScan, and the number of
+// candidates and data pages of the clusters it is expected to probe.
+func nnScanProbes(v *NNScan) (nCentroids float64, candidates float64, dataPages float64) {
+	index := v.nnIndexFile
+	rows := tableRows(v.heapFile)
+	nCentroids = float64(index.NCentroids())
+	var sizes []int
+	if v.heapFile.stats != nil {
+		sizes = v.heapFile.stats.ClusterSizes[v.indexField.Fname]
+	}
+	if len(sizes) > 0 {
+		nCentroids = float64(len(sizes))
+	}
+	if nCentroids < 1 {
+		nCentroids = 1
+	}
+	avgClusterSize := math.Max(rows/nCentroids, 1)
+	probes := math.Min(math.Floor(float64(v.candidatesNeeded())/avgClusterSize)+float64(DefaultProbe), nCentroids)
+	candidates = math.Min(probes*avgClusterSize, rows)
+	dataPages = float64(index.dataHeapFile.NumPages()) * probes / nCentroids
+	return nCentroids, candidates, dataPages
+}
+
+// Estimates the cost of an exchange of the given children, whose workers run
+// at once, so that the cost is that of the most costly of them, plus the cost
+// of passing each tuple to the consumer and of mergeCost comparisons of it.
+func gatherCost(children []Operator, mergeCost float64) PlanCost {
+	total := PlanCost{}
+	for _, child := range children {
+		c := EstimatePlanCost(child)
+		total.Rows += c.Rows
+		total.Cost = math.Max(total.Cost, c.Cost)
+	}
+	total.Cost += total.Rows * (1 + mergeCost) * CostTupleCPU
+	return total
+}
+
+// Returns the number of workers a parallel plan of scan should use, given that
+// it may use at most maxWorkers, or 1 if scan should not be run in parallel:
+// scan must be one that [partitionScan] can partition, and each worker must
+// read at least PARALLEL_PAGES_PER_WORKER pages.  The pages an NNScan reads
+// are the data pages of the clusters it is expected to probe, and the table
+// pages of their records if the index is unclustered.
+func parallelWorkers(scan Operator, maxWorkers int) int {
+	var pages float64
+	switch op := scan.(type) {
+	case *HeapFile:
+		pages = float64(op.NumPages())
+	case *Filter:
+		return parallelWorkers(op.child, maxWorkers)
+	case *Project:
+		if op.distinct {
+			return 1
+		}
+		return parallelWorkers(op.child, maxWorkers)
+	case *NNScan:
+		_, candidates, dataPages := nnScanProbes(op)
+		pages = dataPages
+		if !op.nnIndexFile.clustered {
+			pages += candidates
+		}
+	default:
+		return 1
+	}
+	return max(1, min(maxWorkers, int(pages)/PARALLEL_PAGES_PER_WORKER))
+}
+
+// Returns the estimated number of rows produced by an equality join of inputs
+// with estimates l and r.
+func joinRows(left Operator, leftField Expr, l PlanCost, right Operator, rightField Expr, r PlanCost, joinType JoinType) float64 {
+	leftNdv, rightNdv := distinctValues(left, leftField, l.Rows), distinctValues(right, rightField, r.Rows)
+	rows := l.Rows * r.Rows / math.Max(math.Max(leftNdv, rightNdv), 1)
+	// the values of the input with fewer distinct values are assumed to be among
+	// those of the other, so that is the fraction of left records that match
+	matching := l.Rows * math.Min(rightNdv/math.Max(leftNdv, 1), 1)
+	switch joinType {
+	// an outer join returns every record of its outer input at least once
+	case LeftOuterJoin:
+		rows = math.Max(rows, l.Rows)
+	case RightOuterJoin:
+		rows = math.Max(rows, r.Rows)
+	case SemiJoin:
+		rows = matching
+	case AntiJoin, NullAwareAntiJoin:
+		rows = l.Rows - matching
+	}
+	return rows
+}
+
+// Estimates the cost of a join that builds a hash table over blocks of the left input
+// and scans the right input once per block.
+func joinCost(left Operator, leftField Expr, right Operator, rightField Expr, maxBufferSize int, joinType JoinType) PlanCost {
+	l := EstimatePlanCost(left)
+	r := EstimatePlanCost(right)
+	rows := joinRows(left, leftField, l, right, rightField, r, joinType)
+	blocks := math.Max(math.Ceil(l.Rows/float64(maxBufferSize)), 1)
+	cost := l.Cost + blocks*r.Cost + (l.Rows+blocks*r.Rows)*CostTupleCPU + rows*CostTupleCPU
+	return PlanCost{rows, cost}
+}
+
+// Estimates the cost of a grace hash join: both inputs are written to partitions
+// and read back, and then each pair of partitions is joined by a hash join.
+func graceJoinCost(op *GraceHashJoin) PlanCost {
+	l := EstimatePlanCost(op.left)
+	r := EstimatePlanCost(op.right)
+	leftKey, rightKey := joinKeyExpr(op.leftFields), joinKeyExpr(op.rightFields)
+	rows := joinRows(op.left, leftKey, l, op.right, rightKey, r, op.joinType)
+	leftPages := spillPages(op.left.Descriptor(), l.Rows)
+	rightPages := spillPages(op.right.Descriptor(), r.Rows)
+	build, probePages := l.Rows, rightPages
+	if op.joinType == RightOuterJoin {
+		build, probePages = r.Rows, leftPages
+	}
+	// a partition too large to hash at once is hashed in blocks, and the other
+	// partition of the pair is read once per block
+	blocks := math.Max(math.Ceil(build/float64(op.numPartitions)/float64(op.maxBufferSize)), 1)
+	cost := l.Cost + r.Cost + (2*(leftPages+rightPages)+(blocks-1)*probePages)*CostPageRead
+	cost += 2*(l.Rows+r.Rows)*CostTupleCPU + rows*CostTupleCPU
+	return PlanCost{rows, cost}
+}
+
+// Estimates the cost of a merge join, whose inputs are sorted, and so include the
+// cost of any sorting.
+func mergeJoinCost(op *SortMergeJoin) PlanCost {
+	l := EstimatePlanCost(op.left)
+	r := EstimatePlanCost(op.right)
+	leftKey, rightKey := joinKeyExpr(op.leftFields), joinKeyExpr(op.rightFields)
+	rows := joinRows(op.left, leftKey, l, op.right, rightKey, r, op.joinType)
+	return PlanCost{rows, l.Cost + r.Cost + (l.Rows+r.Rows)*CostTupleCPU + rows*CostTupleCPU}
+}
+
+// Returns the estimated fraction of the rows of child that satisfy the comparison
+// of left to right.
+func compareSelectivity(child Operator, left Expr, op BoolOp, right Expr) float64 {
+	if _, ok := left.(*FieldExpr); !ok {
+		left, right, op = right, left, flipOp(op)
+	}
+	field, ok := left.(*FieldExpr)
+	if !ok || op == OpLike {
+		return DefaultRangeSelectivity
+	}
+	v, err := right.EvalExpr(nil)
+	if err != nil {
+		// compared to another column, so the value is unknown
+		v = nil
+	}
+	return statsForField(child, field.selectField).selectivity(field.selectField.Fname, op, v)
+}
+
+// Returns the estimated fraction of the rows of child that satisfy pred.  Conjuncts
+// and disjuncts are assumed to be independent.
+func predicateSelectivity(child Operator, pred PredicateExpr) float64 {
+	switch p := pred.(type) {
+	case *CompareExpr:
+		return compareSelectivity(child, p.left, p.op, p.right)
+	case *AndExpr:
+		sel := 1.0
+		for _, sub := range p.preds {
+			sel *= predicateSelectivity(child, sub)
+		}
+		return sel
+	case *OrExpr:
+		sel := 0.0
+		for _, sub := range p.preds {
+			s := predicateSelectivity(child, sub)
+			sel = sel + s - sel*s
+		}
+		return sel
+	case *NotExpr:
+		return 1 - predicateSelectivity(child, p.pred)
+	case *InExpr:
+		sel := 0.0
+		for _, item := range p.list {
+			sel += compareSelectivity(child, p.left, OpEq, item)
+		}
+		sel = math.Min(sel, 1)
+		if p.negated {
+			return 1 - sel
+		}
+		return sel
+	case *BetweenExpr:
+		sel := compareSelectivity(child, p.val, OpGe, p.low) + compareSelectivity(child, p.val, OpLe, p.high) - 1
+		if _, ok := p.val.(*FieldExpr); !ok || sel <= 0 {
+			sel = DefaultRangeSelectivity * DefaultRangeSelectivity
+		}
+		if p.negated {
+			return 1 - sel
+		}
+		return sel
+	case *IsNullExpr:
+		if p.negated {
+			return 1
+		}
+		return 0
+	}
+	return DefaultRangeSelectivity
+}
+
+// Estimates the cost of a filter with the given predicate.
+func filterCost(child Operator, pred PredicateExpr) PlanCost {
+	c := EstimatePlanCost(child)
+	sel := predicateSelectivity(child, pred)
+	return PlanCost{c.Rows * sel, c.Cost + c.Rows*CostTupleCPU + exprsCost([]Expr{pred}, c.Rows)}
+}
+
+// Estimates the number of rows produced by op and the cost of producing them.
+// Estimates use the statistics collected by ANALYZE where they are available.
+func EstimatePlanCost(op Operator) PlanCost {
+	switch op := op.(type) {
+	case *InstrumentedOp:
+		return EstimatePlanCost(op.op)
+	case *HeapFile:
+		rows := tableRows(op)
+		return PlanCost{rows, float64(op.NumPages())*CostPageRead + rows*CostTupleCPU}
+	case *heapScanPartition:
+		rows := tableRows(op.file) / float64(op.parts)
+		return PlanCost{rows, float64(op.file.NumPages())/float64(op.parts)*CostPageRead + rows*CostTupleCPU}
+	case *NNScan:
+		return nnScanCost(op)
+	case *Gather:
+		return gatherCost(op.children, 0)
+	case *GatherMerge:
+		// each tuple is merged through a heap of the workers' next tuples
+		return gatherCost(op.children, math.Log2(float64(len(op.children))+1))
+	case *MultiNNScan:
+		total := PlanCost{}
+		for _, scan := range op.scans {
+			c := nnScanCost(scan)
+			total.Rows += c.Rows
+			total.Cost += c.Cost
+		}
+		total.Rows = math.Min(total.Rows, tableRows(op.scans[0].heapFile))
+		return total
+	case *BM25Scan:
+		indexPages := op.textIndex.postingsHeapFile.NumPages() + op.textIndex.docsHeapFile.NumPages()
+		rows := math.Min(float64(op.limitNo), tableRows(op.heapFile))
+		return PlanCost{rows, float64(indexPages)*CostPageRead + rows*CostRandomPageRead}
+	case *EqualityJoin[int64]:
+		return joinCost(*op.left, op.leftField, *op.right, op.rightField, op.maxBufferSize, op.joinType)
+	case *EqualityJoin[string]:
+		return joinCost(*op.left, op.leftField, *op.right, op.rightField, op.maxBufferSize, op.joinType)
+	case *GraceHashJoin:
+		return graceJoinCost(op)
+	case *SortMergeJoin:
+		return mergeJoinCost(op)
+	case *Filter:
+		return filterCost(op.child, op.pred)
+	case *Project:
+		c := EstimatePlanCost(op.child)
+		return PlanCost{c.Rows, c.Cost + exprsCost(op.selectFields, c.Rows)}
+	case *OrderBy:
+		c := EstimatePlanCost(op.child)
+		cost := c.Cost + exprsCost(op.orderBy, c.Rows)
+		if op.limit != nil {
+			// each tuple is compared to the worst of the first k in a heap
+			if k := limitValue(op.limit); k >= 0 && k < c.Rows {
+				return PlanCost{k, cost + c.Rows*math.Log2(k+1)*CostTupleCPU}
+			}
+		}
+		return PlanCost{c.Rows, cost + sortCost(c.Rows) + spillSortCost(op, c.Rows)}
+	case *LimitOp:
+		c := EstimatePlanCost(op.child)
+		if op.offset != nil {
+			c.Rows = math.Max(c.Rows-math.Max(limitValue(op.offset), 0), 0)
+		}
+		if limit := limitValue(op.limitTups); limit >= 0 {
+			c.Rows = math.Min(c.Rows, limit)
+		}
+		return c
+	case *Aggregator:
+		c := EstimatePlanCost(op.child)
+		groups := 1.0
+		for _, gby := range op.groupByFields {
+			groups *= distinctValues(op.child, gby, c.Rows)
+		}
+		groups = math.Max(math.Min(groups, c.Rows), 1)
+		return PlanCost{groups, c.Cost + c.Rows*float64(len(op.newAggState))*CostTupleCPU}
+	case *MMR:
+		c := EstimatePlanCost(op.child)
+		k := c.Rows
+		if limit := limitValue(op.limit); limit >= 0 {
+			k = math.Min(k, limit)
+		}
+		return PlanCost{k, c.Cost + c.Rows*(k+1)*CostDistance}
+	case *SubqueryOp:
+		// an uncorrelated subquery runs once, and a correlated one for each record
+		c := EstimatePlanCost(op.child)
+		for _, s := range op.subqueries {
+			runs := 1.0
+			if len(s.params) > 0 {
+				runs = c.Rows
+			}
+			c.Cost += runs * EstimatePlanCost(s.op).Cost
+		}
+		return c
+	case *SetOp:
+		// each record of the inputs is hashed or looked up in a hash table
+		l, r := EstimatePlanCost(op.left), EstimatePlanCost(op.right)
+		total := PlanCost{l.Rows + r.Rows, l.Cost + r.Cost + (l.Rows+r.Rows)*CostTupleCPU}
+		switch op.op {
+		case Intersect:
+			total.Rows = math.Min(l.Rows, r.Rows)
+		case Except:
+			total.Rows = l.Rows
+		}
+		return total
+	case *RRFusion:
+		total := PlanCost{}
+		for _, child := range op.children {
+			c := EstimatePlanCost(child)
+			total.Rows += c.Rows
+			total.Cost += c.Cost
+		}
+		total.Cost += sortCost(total.Rows)
+		return total
+	}
+	// other operators are assumed to do a constant amount of work per input row
+	total := PlanCost{}
+	for i, child := range planChildren(op) {
+		c := EstimatePlanCost(child)
+		if i == 0 {
+			total.Rows = c.Rows
+		}
+		total.Cost += c.Cost + c.Rows*CostTupleCPU
+	}
+	return total
+}
+
+// Chooses between scanning the whole table hf with seqScan, which also applies any
+// filters on the table, and reading the candidates produced by a vector index scan,
+// given the expressions projected from each row and sorted on.  Without statistics
+// for hf the index scan is always used.
+func chooseAccessPath(hf *HeapFile, seqScan Operator, indexScan Operator, exprs []Expr) Operator {
+	if hf.stats == nil {
+		return indexScan
+	}
+	total := func(scan Operator) float64 {
+		c := EstimatePlanCost(scan)
+		return c.Cost + exprsCost(exprs, c.Rows) + sortCost(c.Rows)
+	}
+	if total(seqScan) < total(indexScan) {
+		return seqScan
+	}
+	return indexScan
+}
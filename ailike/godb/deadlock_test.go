@@ -37,20 +37,20 @@ func TestReadWriteDeadlock(t *testing.T) {
 		}
 
 		if lg1Write.getError() != nil {
-			bp.AbortTransaction(tid1) // at most abort twice; should be able to abort twice
+			tid1.Abort() // at most abort twice; should be able to abort twice
 			time.Sleep(time.Duration((float64(WAIT_INTERVAL) * rand.Float64())))
 
-			tid1 = NewTID()
+			tid1 = bp.Transactions().Begin()
 			lg1Read = startGrabber(bp, tid1, hf, 0, ReadPerm)
 			time.Sleep(POLL_INTERVAL)
 			lg1Write = startGrabber(bp, tid1, hf, 1, WritePerm)
 		}
 
 		if lg2Write.getError() != nil {
-			bp.AbortTransaction(tid2) // at most abort twice; should be able to abort twice
+			tid2.Abort() // at most abort twice; should be able to abort twice
 			time.Sleep(time.Duration((float64(WAIT_INTERVAL) * rand.Float64())))
 
-			tid2 = NewTID()
+			tid2 = bp.Transactions().Begin()
 			lg2Read = startGrabber(bp, tid2, hf, 1, ReadPerm)
 			time.Sleep(POLL_INTERVAL)
 			lg2Write = startGrabber(bp, tid2, hf, 0, WritePerm)
@@ -89,20 +89,20 @@ func TestWriteWriteDeadlock(t *testing.T) {
 		}
 
 		if lg1WriteB.getError() != nil {
-			bp.AbortTransaction(tid1) // at most abort twice; should be able to abort twice
+			tid1.Abort() // at most abort twice; should be able to abort twice
 			time.Sleep(time.Duration((float64(WAIT_INTERVAL) * rand.Float64())))
 
-			tid1 = NewTID()
+			tid1 = bp.Transactions().Begin()
 			lg1WriteA = startGrabber(bp, tid1, hf, 0, WritePerm)
 			time.Sleep(POLL_INTERVAL)
 			lg1WriteB = startGrabber(bp, tid1, hf, 1, WritePerm)
 		}
 
 		if lg2WriteB.getError() != nil {
-			bp.AbortTransaction(tid2) // at most abort twice; should be able to abort twice
+			tid2.Abort() // at most abort twice; should be able to abort twice
 			time.Sleep(time.Duration((float64(WAIT_INTERVAL) * rand.Float64())))
 
-			tid2 = NewTID()
+			tid2 = bp.Transactions().Begin()
 			lg2WriteA = startGrabber(bp, tid2, hf, 1, WritePerm)
 			time.Sleep(POLL_INTERVAL)
 			lg2WriteB = startGrabber(bp, tid2, hf, 0, WritePerm)
@@ -141,20 +141,20 @@ func TestUpgradeWriteDeadlock(t *testing.T) {
 		}
 
 		if lg1Write.getError() != nil {
-			bp.AbortTransaction(tid1) // at most abort twice; should be able to abort twice
+			tid1.Abort() // at most abort twice; should be able to abort twice
 			time.Sleep(time.Duration((float64(WAIT_INTERVAL) * rand.Float64())))
 
-			tid1 = NewTID()
+			tid1 = bp.Transactions().Begin()
 			lg1Read = startGrabber(bp, tid1, hf, 0, ReadPerm)
 			time.Sleep(POLL_INTERVAL)
 			lg1Write = startGrabber(bp, tid1, hf, 0, WritePerm)
 		}
 
 		if lg2Write.getError() != nil {
-			bp.AbortTransaction(tid2) // at most abort twice; should be able to abort twice
+			tid2.Abort() // at most abort twice; should be able to abort twice
 			time.Sleep(time.Duration((float64(WAIT_INTERVAL) * rand.Float64())))
 
-			tid2 = NewTID()
+			tid2 = bp.Transactions().Begin()
 			lg2Read = startGrabber(bp, tid2, hf, 0, ReadPerm)
 			time.Sleep(POLL_INTERVAL)
 			lg2Write = startGrabber(bp, tid2, hf, 0, WritePerm)
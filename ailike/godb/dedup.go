@@ -0,0 +1,270 @@
+package godb
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DuplicateGroup is a set of records whose embeddings are all transitively
+// within the similarity threshold of one another.  The representative is the
+// record that appears first in the table; it is the one kept when a group is
+// deduplicated.
+type DuplicateGroup struct {
+	Representative *Tuple
+	Duplicates     []*Tuple
+}
+
+// Returns true if rid a comes before rid b in the table.
+func ridLess(a, b heapRecordId) bool {
+	if a.pageNo != b.pageNo {
+		return a.pageNo < b.pageNo
+	}
+	return a.slotNo < b.slotNo
+}
+
+// Reads the records of each cluster of a nearest neighbor index.  For a secondary index,
+// the data entries are resolved back to the records in hf; entries whose records no longer
+// exist are skipped.  Returns the records keyed by centroid id, along with each centroid.
+func readIndexClusters(index *NNIndexFile, hf *HeapFile, tid *Transaction) (map[int][]*Tuple, map[int]EmbeddingType, error) {
+	centroids := make(map[int]EmbeddingType)
+	iter, err := index.centroidHeapFile.Iterator(tid)
+	if err != nil {
+		return nil, nil, err
+	}
+	for ct, err := iter(); ct != nil || err != nil; ct, err = iter() {
+		if err != nil {
+			return nil, nil, err
+		}
+		centroids[int(ct.Fields[1].(IntField).Value)] = ct.Fields[0].(VectorField).Emb
+	}
+
+	clusterPages := make(map[int][]int)
+	iter, err = index.mappingHeapFile.Iterator(tid)
+	if err != nil {
+		return nil, nil, err
+	}
+	for mt, err := iter(); mt != nil || err != nil; mt, err = iter() {
+		if err != nil {
+			return nil, nil, err
+		}
+		centroidId := int(mt.Fields[0].(IntField).Value)
+		clusterPages[centroidId] = append(clusterPages[centroidId], int(mt.Fields[1].(IntField).Value))
+	}
+
+	clusters := make(map[int][]*Tuple)
+	for centroidId, pageNos := range clusterPages {
+		for _, pageNo := range pageNos {
+			entries, err := index.dataHeapFile.visibleTuples(pageNo, tid)
+			if err != nil {
+				return nil, nil, err
+			}
+			tupleIter := sliceIter(entries)
+			for t, err := tupleIter(); t != nil || err != nil; t, err = tupleIter() {
+				if err != nil {
+					return nil, nil, err
+				}
+				if !index.clustered {
+					rid := heapRecordId{hf.fileName, int(t.Fields[1].(IntField).Value), int(t.Fields[2].(IntField).Value)}
+					t, err = hf.findTuple(rid, tid)
+					if err != nil {
+						if e, ok := err.(ailikeError); ok && e.code == IllegalOperationError {
+							// stale index entry for a deleted record
+							continue
+						}
+						return nil, nil, err
+					}
+				}
+				clusters[centroidId] = append(clusters[centroidId], t)
+			}
+		}
+	}
+	return clusters, centroids, nil
+}
+
+// Returns the ids of the n centroids nearest to each centroid.
+func neighbouringCentroids(centroids map[int]EmbeddingType, n int) (map[int][]int, error) {
+	ids := make([]int, 0, len(centroids))
+	for id := range centroids {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	norms := make(map[int]float64)
+	for _, id := range ids {
+		norms[id] = normOf(centroids[id])
+	}
+
+	neighbours := make(map[int][]int)
+	for _, id := range ids {
+		emb := centroids[id]
+		others := make([]int, 0, len(ids)-1)
+		sims := make(map[int]float64)
+		for _, other := range ids {
+			if other == id {
+				continue
+			}
+			sim, err := cosineWithNorms(emb, centroids[other], norms[id], norms[other])
+			if err != nil {
+				return nil, err
+			}
+			sims[other] = sim
+			others = append(others, other)
+		}
+		sort.SliceStable(others, func(i, j int) bool {
+			return sims[others[i]] > sims[others[j]]
+		})
+		if len(others) > n {
+			others = others[:n]
+		}
+		neighbours[id] = others
+	}
+	return neighbours, nil
+}
+
+// Finds groups of near-duplicate records in the column col of hf, where two records
+// are near-duplicates if the cosine similarity of their embeddings is at least threshold.
+// If the column has a nearest neighbor index, records are only compared against records in
+// the same cluster or in one of the [DedupNeighbourCentroids] nearest clusters; otherwise
+// every pair of records is compared.  Groups are returned in table order of their
+// representatives.
+func FindSemanticDuplicates(hf *HeapFile, col string, threshold float64, tid *Transaction) ([]*DuplicateGroup, error) {
+	if threshold < 0 || threshold > 1 {
+		return nil, ailikeError{IllegalOperationError, fmt.Sprintf("similarity threshold must be between 0 and 1, got %v", threshold)}
+	}
+	colIdx, err := findFieldInTd(FieldType{Fname: col}, hf.Descriptor())
+	if err != nil {
+		return nil, err
+	}
+	colType := hf.Descriptor().Fields[colIdx].Ftype
+	if colType != EmbeddedStringType && colType != VectorFieldType {
+		return nil, ailikeError{TypeMismatchError, fmt.Sprintf("column '%s' does not have embeddings", col)}
+	}
+
+	// records grouped into the clusters they should be compared within
+	clusters := make(map[int][]*Tuple)
+	neighbours := make(map[int][]int)
+	if index := getIndexForField(FieldType{Fname: col}, hf); index != nil {
+		var centroids map[int]EmbeddingType
+		clusters, centroids, err = readIndexClusters(index, hf, tid)
+		if err != nil {
+			return nil, err
+		}
+		neighbours, err = neighbouringCentroids(centroids, DedupNeighbourCentroids)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		iter, err := hf.Iterator(tid)
+		if err != nil {
+			return nil, err
+		}
+		for t, err := iter(); t != nil || err != nil; t, err = iter() {
+			if err != nil {
+				return nil, err
+			}
+			clusters[0] = append(clusters[0], t)
+		}
+	}
+
+	// number the records so that duplicates can be merged with union-find
+	var records []*Tuple
+	var embs []EmbeddingType
+	var norms []float64 // the norm of each embedding, computed once for all its comparisons
+	clusterMembers := make(map[int][]int)
+	for centroidId, tuples := range clusters {
+		for _, t := range tuples {
+			emb, err := embeddingOfField(t.Fields[colIdx])
+			if err != nil {
+				return nil, err
+			}
+			if emb == nil {
+				// NULL text has no embedding, so it duplicates nothing
+				continue
+			}
+			clusterMembers[centroidId] = append(clusterMembers[centroidId], len(records))
+			records = append(records, t)
+			embs = append(embs, emb)
+			norms = append(norms, normOf(emb))
+		}
+	}
+
+	parent := make([]int, len(records))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	compare := func(i, j int) error {
+		if find(i) == find(j) {
+			return nil
+		}
+		sim, err := cosineWithNorms(embs[i], embs[j], norms[i], norms[j])
+		if err != nil {
+			return err
+		}
+		if sim >= threshold {
+			parent[find(i)] = find(j)
+		}
+		return nil
+	}
+
+	for centroidId, members := range clusterMembers {
+		for i := 0; i < len(members); i++ {
+			for j := i + 1; j < len(members); j++ {
+				if err := compare(members[i], members[j]); err != nil {
+					return nil, err
+				}
+			}
+		}
+		for _, other := range neighbours[centroidId] {
+			// neighbouring is not symmetric, so a pair of clusters may be visited twice;
+			// only the first visit does any work since compare skips merged records
+			for _, i := range members {
+				for _, j := range clusterMembers[other] {
+					if err := compare(i, j); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+
+	byRoot := make(map[int][]*Tuple)
+	for i, t := range records {
+		root := find(i)
+		byRoot[root] = append(byRoot[root], t)
+	}
+	var groups []*DuplicateGroup
+	for _, members := range byRoot {
+		if len(members) < 2 {
+			continue
+		}
+		sort.Slice(members, func(i, j int) bool {
+			return ridLess(members[i].Rid.(heapRecordId), members[j].Rid.(heapRecordId))
+		})
+		groups = append(groups, &DuplicateGroup{members[0], members[1:]})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return ridLess(groups[i].Representative.Rid.(heapRecordId), groups[j].Representative.Rid.(heapRecordId))
+	})
+	return groups, nil
+}
+
+// Deletes every record in the given groups except the representatives, returning the
+// number of records deleted.  The caller is responsible for committing or aborting tid.
+func DeleteSemanticDuplicates(hf *HeapFile, groups []*DuplicateGroup, tid *Transaction) (int, error) {
+	deleted := 0
+	for _, group := range groups {
+		for _, t := range group.Duplicates {
+			if err := hf.deleteTuple(t, tid); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,169 @@
+package godb
+
+import (
+	"testing"
+)
+
+func TestFindSemanticDuplicates(t *testing.T) {
+	td, _, _, hf, bp, tid := makeVecTestVars()
+	tuples := []Tuple{
+		{Desc: td, Fields: []DBValue{StringField{"a"}, IntField{1}, VectorField{Emb: makeTestEmbedding(1)}}},
+		{Desc: td, Fields: []DBValue{StringField{"b"}, IntField{2}, VectorField{Emb: makeTestEmbedding(0, 1)}}},
+		{Desc: td, Fields: []DBValue{StringField{"a copy"}, IntField{3}, VectorField{Emb: makeTestEmbedding(1, 0.05)}}},
+		{Desc: td, Fields: []DBValue{StringField{"c"}, IntField{4}, VectorField{Emb: makeTestEmbedding(1, 1)}}},
+		{Desc: td, Fields: []DBValue{StringField{"b copy"}, IntField{5}, VectorField{Emb: makeTestEmbedding(0.02, 1)}}},
+		{Desc: td, Fields: []DBValue{StringField{"a copy 2"}, IntField{6}, VectorField{Emb: makeTestEmbedding(1, 0, 0.05)}}},
+	}
+	for i := range tuples {
+		if err := hf.insertTuple(&tuples[i], tid); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	tid.Commit()
+	tid = bp.Transactions().Begin()
+	defer tid.Commit()
+
+	groups, err := FindSemanticDuplicates(hf, "biography", 0.95, tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := [][]string{{"a", "a copy", "a copy 2"}, {"b", "b copy"}}
+	if len(groups) != len(expected) {
+		t.Fatalf("expected %d groups, got %d", len(expected), len(groups))
+	}
+	for i, group := range groups {
+		names := []string{group.Representative.Fields[0].(StringField).Value}
+		for _, dup := range group.Duplicates {
+			names = append(names, dup.Fields[0].(StringField).Value)
+		}
+		if len(names) != len(expected[i]) {
+			t.Fatalf("expected group %v, got %v", expected[i], names)
+		}
+		for j := range names {
+			if names[j] != expected[i][j] {
+				t.Fatalf("expected group %v, got %v", expected[i], names)
+			}
+		}
+	}
+
+	deleted, err := DeleteSemanticDuplicates(hf, groups, tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if deleted != 3 {
+		t.Errorf("expected 3 records to be deleted, got %d", deleted)
+	}
+	if n := hf.NumTuples(tid); n != 3 {
+		t.Errorf("expected 3 records to remain, got %d", n)
+	}
+
+	if _, err := FindSemanticDuplicates(hf, "age", 0.95, tid); err == nil {
+		t.Errorf("expected error when deduplicating a non-embedding column")
+	}
+	if _, err := FindSemanticDuplicates(hf, "biography", 1.5, tid); err == nil {
+		t.Errorf("expected error for threshold outside [0, 1]")
+	}
+}
+
+func TestFindSemanticDuplicatesWithIndex(t *testing.T) {
+	_, hf, bp, dir := makeTweetsTestCatalog(t)
+
+	tid := bp.Transactions().Begin()
+	iter, _ := hf.Iterator(tid)
+	first, err := iter()
+	if err != nil || first == nil {
+		t.Fatalf("failed to read test table")
+	}
+	emb := first.Fields[2].(EmbeddedStringField).Emb
+	copyTup := Tuple{Desc: *hf.Descriptor(), Fields: []DBValue{
+		IntField{-1},
+		first.Fields[1],
+		EmbeddedStringField{Value: "copy of the first tweet", Emb: emb},
+	}}
+	// bypass insertTuple, which would need to compute an embedding
+	if _, err := hf.insertTupleIntoNewPage(&copyTup, tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	firstRid := first.Rid.(heapRecordId)
+	copyRid := copyTup.Rid.(heapRecordId)
+	tid.Commit()
+
+	index, err := ConstructNNIndexFileFromHeapFile(hf, "content", 5, false, dir, "tweets_test", bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	tid = bp.Transactions().Begin()
+	defer tid.Commit()
+	groups, err := FindSemanticDuplicates(hf, "content", 0.999, tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var found *DuplicateGroup
+	for _, group := range groups {
+		if group.Representative.Rid.(heapRecordId) == firstRid {
+			found = group
+		}
+	}
+	if found == nil {
+		t.Fatalf("expected a group represented by the first tweet")
+	}
+	var copyFound bool
+	for _, dup := range found.Duplicates {
+		if dup.Rid.(heapRecordId) == copyRid {
+			copyFound = true
+		}
+	}
+	if !copyFound {
+		t.Fatalf("expected the copy to be grouped with the first tweet")
+	}
+
+	if _, err := DeleteSemanticDuplicates(hf, []*DuplicateGroup{found}, tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := hf.findTuple(copyRid, tid); err == nil {
+		t.Errorf("expected the copy to be deleted")
+	}
+	if _, err := hf.findTuple(firstRid, tid); err != nil {
+		t.Errorf("expected the representative to be kept, %s", err.Error())
+	}
+	// the index should no longer refer to the deleted copy
+	iter, _ = index.dataHeapFile.Iterator(tid)
+	for dt, err := iter(); dt != nil || err != nil; dt, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if int(dt.Fields[1].(IntField).Value) == copyRid.pageNo && int(dt.Fields[2].(IntField).Value) == copyRid.slotNo {
+			t.Fatalf("expected the index entry for the copy to be removed")
+		}
+	}
+}
+
+// Records whose column is NULL are not duplicates of anything, even of each
+// other.
+func TestFindSemanticDuplicatesNulls(t *testing.T) {
+	td, _, _, hf, bp, tid := makeVecTestVars()
+	tuples := []Tuple{
+		{Desc: td, Fields: []DBValue{StringField{"a"}, IntField{1}, VectorField{Emb: makeTestEmbedding(1)}}},
+		{Desc: td, Fields: []DBValue{StringField{"null"}, IntField{2}, nil}},
+		{Desc: td, Fields: []DBValue{StringField{"a copy"}, IntField{3}, VectorField{Emb: makeTestEmbedding(1, 0.05)}}},
+		{Desc: td, Fields: []DBValue{StringField{"null 2"}, IntField{4}, nil}},
+	}
+	for i := range tuples {
+		if err := hf.insertTuple(&tuples[i], tid); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	tid.Commit()
+	tid = bp.Transactions().Begin()
+	defer tid.Commit()
+
+	groups, err := FindSemanticDuplicates(hf, "biography", 0.95, tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(groups) != 1 || groups[0].Representative.Fields[0] != (StringField{"a"}) ||
+		len(groups[0].Duplicates) != 1 || groups[0].Duplicates[0].Fields[0] != (StringField{"a copy"}) {
+		t.Errorf("expected only a and a copy to be duplicates, got %d groups", len(groups))
+	}
+}
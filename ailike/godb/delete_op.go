@@ -24,7 +24,7 @@ func (i *DeleteOp) Descriptor() *TupleDesc {
 // one-field tuple with a "count" field indicating the number of tuples that
 // were deleted.  Tuples should be deleted using the [DBFile.deleteTuple]
 // method.
-func (dop *DeleteOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+func (dop *DeleteOp) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
 	childIter, err := dop.child.Iterator(tid)
 	if err != nil {
 		return nil, err
@@ -8,7 +8,7 @@ func TestDelete(t *testing.T) {
 	_, t1, t2, hf, bp, tid := makeTestVars()
 	hf.insertTuple(&t1, tid)
 	hf.insertTuple(&t2, tid)
-	bp.CommitTransaction(tid)
+	tid.Commit()
 	var f FieldType = FieldType{"age", "", IntType}
 	filt, err := NewIntFilter(&ConstExpr{IntField{25}, IntType}, OpGt, &FieldExpr{f}, hf)
 	if err != nil {
@@ -18,8 +18,7 @@ func TestDelete(t *testing.T) {
 	if dop == nil {
 		t.Fatalf("delete op was nil")
 	}
-	tid = NewTID()
-	bp.BeginTransaction(tid)
+	tid = bp.Transactions().Begin()
 	iter, _ := dop.Iterator(tid)
 	if iter == nil {
 		t.Fatalf("iter was nil")
@@ -38,10 +37,9 @@ func TestDelete(t *testing.T) {
 		t.Errorf("invalid output tuple")
 		return
 	}
-	bp.CommitTransaction(tid)
+	tid.Commit()
 
-	tid = NewTID()
-	bp.BeginTransaction(tid)
+	tid = bp.Transactions().Begin()
 
 	iter, _ = hf.Iterator(tid)
 
@@ -175,8 +175,7 @@ func _parseTestHelper(t *testing.T, c *Catalog, bp *BufferPool, resultFileTempla
 	printOutput := false //print the result set during testing
 	qNo := 0
 	for _, sql := range queries {
-		tid := NewTID()
-		bp.BeginTransaction(tid)
+		tid := bp.Transactions().Begin()
 		qNo++
 		if qNo == 1 {
 			continue
@@ -286,7 +285,7 @@ func _parseTestHelper(t *testing.T, c *Catalog, bp *BufferPool, resultFileTempla
 			fmt.Printf("(%d results)\n\n", nresults)
 		}
 		if save {
-			//outfile.bufPool.CommitTransaction(tid)
+			//tid.Commit()
 			outfile_csv.Close()
 		} else {
 			iter, err := plan.Iterator(tid)
@@ -17,7 +17,6 @@ type EmbeddingResponse struct {
 var portNumberEmb string = "7010"
 
 func generateEmbeddings(text string) (*EmbeddingResponse, error) {
-
 	//Format text to string
 	data := map[string]interface{}{
 		"text": text,
@@ -97,11 +96,7 @@ func dotProduct(v1, v2 *EmbeddingType) (float64, error) {
 	if len(*v1) != len(*v2) {
 		return 0.0, fmt.Errorf("Length mismatch: %d vs %d", len(*v1), len(*v2))
 	}
-	var dotprod float64 = 0.0
-	for i := 0; i < len(*v1); i++ {
-		dotprod += (*v1)[i] * (*v2)[i]
-	}
-	return dotprod, nil
+	return dotKernel(*v1, *v2), nil
 }
 
 func NegativeDotProduct(v1, v2 *EmbeddingType) (float64, error) {
@@ -110,20 +105,11 @@ func NegativeDotProduct(v1, v2 *EmbeddingType) (float64, error) {
 }
 
 func CosDist(v1, v2 *EmbeddingType) (float64, error) {
-
 	if len(*v1) != len(*v2) {
 		return 0.0, fmt.Errorf("Length mismatch: %d vs %d", len(*v1), len(*v2))
 	}
-	var dotprod float64 = 0.0
-	var squaredSumV1 float64 = 0.0
-	var squaredSumV2 float64 = 0.0
-
-	for i := 0; i < len(*v1); i++ {
-		dotprod += (*v1)[i] * (*v2)[i]
-		squaredSumV1 += (*v1)[i] * (*v1)[i]
-		squaredSumV2 += (*v2)[i] * (*v2)[i]
-	}
-	normV1 := math.Sqrt(squaredSumV1)
+	dotprod, squaredSumV2 := dotSqNormKernel(*v1, *v2)
+	normV1 := math.Sqrt(sqNormKernel(*v1))
 	normV2 := math.Sqrt(squaredSumV2)
 
 	cosdist := dotprod / (normV1 * normV2)
@@ -131,13 +117,23 @@ func CosDist(v1, v2 *EmbeddingType) (float64, error) {
 	return cosdist, nil
 }
 
-func MSEDist(e1, e2 *EmbeddingType) (float64, error) {
-	sum_dist := float64(0.0)
-	for idx, e1_idx := range *e1 {
-		e2_idx := (*e2)[idx]
-		sum_dist += (e1_idx - e2_idx) * (e1_idx - e2_idx)
+// Returns the Euclidean norm of v, for [cosineWithNorms].
+func normOf(v EmbeddingType) float64 {
+	return math.Sqrt(sqNormKernel(v))
+}
+
+// Returns the cosine of v1 and v2, as [CosDist] does, given their norms, for
+// callers that compare each of a set of vectors with many others, and so
+// compute the norm of each once rather than for every pair.
+func cosineWithNorms(v1, v2 EmbeddingType, norm1, norm2 float64) (float64, error) {
+	if len(v1) != len(v2) {
+		return 0.0, fmt.Errorf("Length mismatch: %d vs %d", len(v1), len(v2))
 	}
-	return sum_dist / float64(len(*e1)), nil
+	return dotKernel(v1, v2) / (norm1 * norm2), nil
+}
+
+func MSEDist(e1, e2 *EmbeddingType) (float64, error) {
+	return sqDistKernel(*e1, *e2) / float64(len(*e1)), nil
 }
 
 func equal(v1, v2 *EmbeddingType) bool {
@@ -0,0 +1,375 @@
+package godb
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// Parallel plans split the scan of a table into partitions, each read by a copy
+// of the operators above the scan in its own worker goroutine, and combine the
+// workers' results with a [Gather] or [GatherMerge].  The workers share their
+// transaction, so the exchange locks the files they read before they start.
+
+// The number of workers parallel plans use at most, unless set for a catalog
+// with [Catalog.SetMaxParallelWorkers].
+const DEFAULT_MAX_PARALLEL_WORKERS = 4
+
+// The number of pages each worker of a parallel plan is expected to read at
+// least; scans of fewer pages than two workers would read are not run in
+// parallel, since starting the workers would cost more than it saves.
+const PARALLEL_PAGES_PER_WORKER = 64
+
+// A partition of a parallel scan of a heap file, which reads the records of a
+// contiguous range of its pages: partition part of parts reads the part-th of
+// parts roughly equal ranges of the pages the file has when the scan starts.
+type heapScanPartition struct {
+	file  *HeapFile
+	part  int
+	parts int
+}
+
+func (p *heapScanPartition) Descriptor() *TupleDesc {
+	return p.file.Descriptor()
+}
+
+func (p *heapScanPartition) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
+	batches, err := p.batchIterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	return unbatch(batches), nil
+}
+
+func (p *heapScanPartition) batchIterator(tid *Transaction) (func() ([]*Tuple, error), error) {
+	numPages := p.file.NumPages()
+	return p.file.pageRangeBatches(tid, p.part*numPages/p.parts, (p.part+1)*numPages/p.parts)
+}
+
+// Returns parts copies of op, each of which reads one partition of the scan at
+// its bottom, or false if op is not a scan that can be partitioned: a heap
+// file, an [NNScan], or a filter or projection without DISTINCT of either.
+func partitionScan(op Operator, parts int) ([]Operator, bool) {
+	partitions := make([]Operator, parts)
+	switch op := op.(type) {
+	case *HeapFile:
+		for i := range partitions {
+			partitions[i] = &heapScanPartition{op, i, parts}
+		}
+	case *NNScan:
+		for i := range partitions {
+			partitions[i] = op.partition(i, parts)
+		}
+	case *Filter:
+		children, ok := partitionScan(op.child, parts)
+		if !ok {
+			return nil, false
+		}
+		for i, child := range children {
+			partitions[i] = &Filter{op.pred, child}
+		}
+	case *Project:
+		children, ok := partitionScan(op.child, parts)
+		if !ok || op.distinct {
+			return nil, false
+		}
+		for i, child := range children {
+			partitions[i] = &Project{op.selectFields, op.outputNames, false, child}
+		}
+	default:
+		return nil, false
+	}
+	return partitions, true
+}
+
+// Returns the heap files that op reads, for the scans that [partitionScan]
+// partitions and the operators above them.
+func scannedFiles(op Operator) []*HeapFile {
+	switch op := op.(type) {
+	case *HeapFile:
+		return []*HeapFile{op}
+	case *heapScanPartition:
+		return []*HeapFile{op.file}
+	case *NNScan:
+		index := op.nnIndexFile
+		return []*HeapFile{op.heapFile, index.dataHeapFile, index.centroidHeapFile, index.mappingHeapFile}
+	}
+	var files []*HeapFile
+	for _, child := range planChildren(op) {
+		files = append(files, scannedFiles(child)...)
+	}
+	return files
+}
+
+// Locks the files the children of an exchange read for tid, before their
+// workers start.
+func lockScannedFiles(children []Operator, tid *Transaction) error {
+	locked := make(map[string]bool)
+	for _, child := range children {
+		for _, file := range scannedFiles(child) {
+			if locked[file.fileName] {
+				continue
+			}
+			if err := file.bufPool.lockFile(file, tid, ReadPerm); err != nil {
+				return err
+			}
+			locked[file.fileName] = true
+		}
+	}
+	return nil
+}
+
+// Returns a Gather of workers partitions of scan.
+func makeGather(scan Operator, workers int) (Operator, error) {
+	partitions, ok := partitionScan(scan, workers)
+	if !ok {
+		return nil, ailikeError{IllegalOperationError, "scan cannot be run in parallel"}
+	}
+	return NewGather(partitions)
+}
+
+// Returns workers partitions of scan, each projected onto the columns of
+// exprList, unless selectAll is set, for the sorts of a parallel plan.
+func projectPartitions(scan Operator, workers int, selectAll bool, exprList []Expr, fieldNames []string) ([]Operator, error) {
+	partitions, ok := partitionScan(scan, workers)
+	if !ok {
+		return nil, ailikeError{IllegalOperationError, "scan cannot be run in parallel"}
+	}
+	if selectAll {
+		return partitions, nil
+	}
+	for i, partition := range partitions {
+		projected, err := NewProjectOp(exprList, fieldNames, false, partition)
+		if err != nil {
+			return nil, err
+		}
+		partitions[i] = projected
+	}
+	return partitions, nil
+}
+
+// Returns a parallel top-k sort of the given partitions: each worker keeps the
+// first limit tuples of its partition, and a [GatherMerge] merges them.
+func makeParallelTopK(orderByFields []Expr, partitions []Operator, ascending []bool, limit Expr) (Operator, error) {
+	sorts := make([]Operator, len(partitions))
+	for i, partition := range partitions {
+		sort, err := NewTopK(orderByFields, partition, ascending, limit)
+		if err != nil {
+			return nil, err
+		}
+		sorts[i] = sort
+	}
+	return NewGatherMerge(orderByFields, sorts, ascending)
+}
+
+// Gather returns the tuples of its children, which are run by workers in
+// parallel, in the order the workers produce them.  It is planned below
+// operators that read all of their input, such as aggregates and sorts.
+type Gather struct {
+	children []Operator
+}
+
+// The number of tuples the workers of a [Gather] produce ahead of its
+// consumer.
+const GATHER_BUFFER_SIZE = 256
+
+// Constructs a Gather of the given children, which must all have the same
+// descriptor.
+func NewGather(children []Operator) (*Gather, error) {
+	if len(children) == 0 {
+		return nil, ailikeError{MalformedDataError, "Gather needs at least one child."}
+	}
+	return &Gather{children}, nil
+}
+
+func (g *Gather) Descriptor() *TupleDesc {
+	return g.children[0].Descriptor()
+}
+
+type gatherResult struct {
+	tuple *Tuple // nil once the worker's child is exhausted
+	err   error
+}
+
+// The workers start on the first call of the iterator, and are stopped when one
+// of them fails or when tid commits or aborts, so that they are not left
+// blocked with their pages pinned.
+func (g *Gather) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
+	if err := lockScannedFiles(g.children, tid); err != nil {
+		return nil, err
+	}
+	results := make(chan gatherResult, GATHER_BUFFER_SIZE)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	var workers sync.WaitGroup
+	cancel := func() {
+		stopOnce.Do(func() { close(stop) })
+	}
+	// the first error of a worker, which it may not have sent once stopped
+	var failure error
+	var failureOnce sync.Once
+	started := false
+	running := len(g.children)
+	return func() (*Tuple, error) {
+		if !started {
+			started = true
+			tid.onFinish(cancel)
+			for _, child := range g.children {
+				workers.Add(1)
+				go func(child Operator) {
+					defer workers.Done()
+					if err := gatherWorker(child, tid, results, stop); err != nil {
+						failureOnce.Do(func() { failure = err })
+					}
+				}(child)
+			}
+		}
+		for running > 0 {
+			var r gatherResult
+			select {
+			case r = <-results:
+			case <-stop:
+				// tid completed while the workers ran
+				workers.Wait()
+				running = 0
+				if failure != nil {
+					return nil, failure
+				}
+				return nil, tid.check()
+			}
+			if r.err != nil {
+				cancel()
+				workers.Wait()
+				running = 0
+				return nil, r.err
+			}
+			if r.tuple == nil {
+				running--
+				continue
+			}
+			return r.tuple, nil
+		}
+		return nil, nil
+	}, nil
+}
+
+// Sends the tuples of child to results, followed by a nil tuple or an error,
+// until stop is closed.  Returns the error, if any.
+func gatherWorker(child Operator, tid *Transaction, results chan<- gatherResult, stop <-chan struct{}) error {
+	iter, err := drainIterator(child, tid)
+	if err != nil {
+		iter = func() (*Tuple, error) { return nil, err }
+	}
+	for {
+		t, err := iter()
+		select {
+		case results <- gatherResult{t, err}:
+		case <-stop:
+			return err
+		}
+		if t == nil || err != nil {
+			return err
+		}
+	}
+}
+
+// GatherMerge merges the ordered results of its children, which are run by
+// workers in parallel, into one ordered result.  Its children are top-k sorts,
+// so the workers run to completion and the merge holds at most limit tuples
+// per worker.
+type GatherMerge struct {
+	children  []Operator
+	orderBy   []Expr
+	ascending []bool
+}
+
+// Constructs a GatherMerge of the given children, which must all have the same
+// descriptor, and all be sorted by orderByFields, in the order given by
+// ascending, as in [NewOrderBy].
+func NewGatherMerge(orderByFields []Expr, children []Operator, ascending []bool) (*GatherMerge, error) {
+	if len(children) == 0 {
+		return nil, ailikeError{MalformedDataError, "GatherMerge needs at least one child."}
+	}
+	return &GatherMerge{children, orderByFields, ascending}, nil
+}
+
+func (g *GatherMerge) Descriptor() *TupleDesc {
+	return g.children[0].Descriptor()
+}
+
+func (g *GatherMerge) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
+	if err := lockScannedFiles(g.children, tid); err != nil {
+		return nil, err
+	}
+	// the heap holds the next tuple of each child that has not been exhausted,
+	// and sourceOf maps each of them to its child and position in the child's
+	// results
+	order := &OrderBy{orderBy: g.orderBy, ascending: g.ascending}
+	next := &tupleHeap{less: order.less}
+	sourceOf := make(map[*Tuple][2]int)
+	var sorted [][]*Tuple
+	started := false
+	return func() (*Tuple, error) {
+		if !started {
+			started = true
+			var err error
+			if sorted, err = runWorkers(g.children, tid); err != nil {
+				return nil, err
+			}
+			for i, results := range sorted {
+				if len(results) > 0 {
+					heap.Push(next, results[0])
+					sourceOf[results[0]] = [2]int{i, 0}
+				}
+			}
+		}
+		if next.Len() == 0 {
+			return nil, nil
+		}
+		t := next.tuples[0]
+		source := sourceOf[t]
+		delete(sourceOf, t)
+		if results := sorted[source[0]]; source[1]+1 < len(results) {
+			following := results[source[1]+1]
+			sourceOf[following] = [2]int{source[0], source[1] + 1}
+			next.tuples[0] = following
+			heap.Fix(next, 0)
+		} else {
+			heap.Pop(next)
+		}
+		return t, nil
+	}, nil
+}
+
+// Runs each of children to completion in its own worker, returning the tuples
+// of each, or the first error of any of them.
+func runWorkers(children []Operator, tid *Transaction) ([][]*Tuple, error) {
+	results := make([][]*Tuple, len(children))
+	errs := make([]error, len(children))
+	var wg sync.WaitGroup
+	for i, child := range children {
+		wg.Add(1)
+		go func(i int, child Operator) {
+			defer wg.Done()
+			iter, err := drainIterator(child, tid)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			for {
+				t, err := iter()
+				if t == nil || err != nil {
+					errs[i] = err
+					return
+				}
+				results[i] = append(results[i], t)
+			}
+		}(i, child)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
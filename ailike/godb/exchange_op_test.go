@@ -0,0 +1,289 @@
+package godb
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Creates a catalog with a table nums (id int, name string) of at least
+// numPages pages, whose ids are 0 up to the number of records, which is
+// returned.
+func makeParallelTestCatalog(t *testing.T, numPages int) (*Catalog, *BufferPool, int) {
+	dir := t.TempDir()
+	c, bp := makeTestCatalog(t, dir, "nums (id int, name string)\n", 40)
+	file, err := c.GetTable("nums")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	hf := file.(*HeapFile)
+	n := fillPages(t, hf, bp, numPages, func(n int) *Tuple {
+		return &Tuple{Desc: *hf.Descriptor(), Fields: []DBValue{IntField{int64(n)}, StringField{fmt.Sprintf("n%d", n%7)}}}
+	})
+	return c, bp, n
+}
+
+func isExchange(op Operator) bool {
+	switch op.(type) {
+	case *Gather, *GatherMerge:
+		return true
+	}
+	return false
+}
+
+func TestHeapScanPartitions(t *testing.T) {
+	hf, bp, numTuples := makePrefetchTestFile(t, 10, 20)
+	tid := bp.Transactions().Begin()
+	defer tid.Commit()
+	partitions, ok := partitionScan(hf, 3)
+	if !ok {
+		t.Fatalf("expected a heap file to be partitioned")
+	}
+	// the partitions read disjoint ranges of pages that cover the file
+	total := 0
+	for _, partition := range partitions {
+		pages := make(map[int]bool)
+		for _, tup := range collectTuples(t, partition, tid) {
+			pages[tup.Rid.(heapRecordId).pageNo] = true
+			total++
+		}
+		if len(pages) < 3 || len(pages) > 4 {
+			t.Errorf("expected each partition to read 3 or 4 pages, got %d", len(pages))
+		}
+	}
+	if total != numTuples {
+		t.Errorf("expected the partitions to read %d tuples, got %d", numTuples, total)
+	}
+
+	gather, err := NewGather(partitions)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if got := len(collectTuples(t, gather, tid)); got != numTuples {
+		t.Errorf("expected the gather to return %d tuples, got %d", numTuples, got)
+	}
+}
+
+// A consumer that stops reading a Gather early, as a sort above it that fails
+// partway does, leaves its workers blocked until the transaction completes,
+// which stops them.
+func TestGatherConsumerStopsEarly(t *testing.T) {
+	c, bp, _ := makeParallelTestCatalog(t, 2*PARALLEL_PAGES_PER_WORKER)
+	file, err := c.GetTable("nums")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	gather, err := makeGather(file.(*HeapFile), 4)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	before := runtime.NumGoroutine()
+	tid := bp.Transactions().Begin()
+	iter, err := gather.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if tup, err := iter(); tup == nil || err != nil {
+		t.Fatalf("expected a tuple, got %v", err)
+	}
+	// the workers fill the buffer, and wait for the consumer
+	if err := tid.Commit(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	waitForPrefetches(t, bp)
+	for start := time.Now(); runtime.NumGoroutine() > before; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("expected the commit to stop the workers of an abandoned gather, %d goroutines remain of %d", runtime.NumGoroutine(), before)
+		}
+	}
+}
+
+// A parallel scan that times out is aborted by the worker that finds it has,
+// and the abort releases its locks, so that a writer can then lock the table.
+func TestGatherTimeout(t *testing.T) {
+	c, bp, n := makeParallelTestCatalog(t, 2*PARALLEL_PAGES_PER_WORKER)
+	file, err := c.GetTable("nums")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	hf := file.(*HeapFile)
+	gather, err := makeGather(hf, 4)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tm := bp.Transactions()
+	tm.SetTimeout(100 * time.Millisecond)
+	tid := tm.Begin()
+	tm.SetTimeout(0)
+	iter, err := gather.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if tup, err := iter(); tup == nil || err != nil {
+		t.Fatalf("expected a tuple, got %v", err)
+	}
+	// the workers fill the buffer, and time out reading their next pages
+	time.Sleep(150 * time.Millisecond)
+	done := make(chan error)
+	go func() {
+		for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err == nil || err.(ailikeError).code != TransactionTimeoutError {
+			t.Fatalf("expected the scan to time out, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the scan to time out, it did not complete")
+	}
+	if tid.Status() != TransactionAborted {
+		t.Fatalf("expected the transaction to be aborted, got %s", tid.Status())
+	}
+
+	go func() {
+		writer := tm.Begin()
+		tup := Tuple{Desc: *hf.Descriptor(), Fields: []DBValue{IntField{int64(n)}, StringField{"new"}}}
+		if err := hf.insertTuple(&tup, writer); err != nil {
+			done <- err
+			return
+		}
+		done <- writer.Commit()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the abort to release the lock on the table, the writer is still waiting")
+	}
+}
+
+// A parallel top-k query returns the same results as a serial one, and a
+// max_parallel_workers of 1 turns parallel plans off.
+func TestParallelTopK(t *testing.T) {
+	c, bp, n := makeParallelTestCatalog(t, 3*PARALLEL_PAGES_PER_WORKER)
+	sql := "select id, name from nums where name <> 'n3' order by id desc limit 10 offset 2"
+	plan, parallel := runIntColumnQuery(t, c, bp, sql, 0)
+	if !planHas(plan, func(op Operator) bool { _, ok := op.(*GatherMerge); return ok }) {
+		t.Fatalf("expected a parallel plan for a scan of %d pages", 3*PARALLEL_PAGES_PER_WORKER)
+	}
+	var expected []int64
+	for id := int64(n - 1); len(expected) < 12; id-- {
+		if id%7 != 3 {
+			expected = append(expected, id)
+		}
+	}
+	expected = expected[2:]
+	if fmt.Sprint(parallel) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, parallel)
+	}
+
+	if _, _, err := Parse(c, "set max_parallel_workers = 1"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	plan, serial := runIntColumnQuery(t, c, bp, sql, 0)
+	if planHas(plan, isExchange) {
+		t.Errorf("expected a serial plan with one worker")
+	}
+	if fmt.Sprint(serial) != fmt.Sprint(parallel) {
+		t.Errorf("expected the serial plan to return %v, got %v", parallel, serial)
+	}
+}
+
+// Sorts and aggregates without a limit gather all of the partitions.
+func TestParallelGather(t *testing.T) {
+	c, bp, n := makeParallelTestCatalog(t, 2*PARALLEL_PAGES_PER_WORKER)
+	c.SetMaxParallelWorkers(2)
+	plan, rows := queryRows(t, c, bp, "select count(*), sum(id) from nums")
+	if !planHas(plan, func(op Operator) bool { g, ok := op.(*Gather); return ok && len(g.children) == 2 }) {
+		t.Errorf("expected the aggregate to gather two workers")
+	}
+	if len(rows) != 1 || rows[0][0].(IntField).Value != int64(n) || rows[0][1].(IntField).Value != int64(n*(n-1)/2) {
+		t.Errorf("expected %d rows summing to %d, got %v", n, n*(n-1)/2, rows)
+	}
+
+	plan, ids := runIntColumnQuery(t, c, bp, "select id from nums order by id", 0)
+	if !planHas(plan, func(op Operator) bool { _, ok := op.(*Gather); return ok }) {
+		t.Errorf("expected the sort to gather the workers")
+	}
+	if len(ids) != n || !sort.SliceIsSorted(ids, func(i, j int) bool { return ids[i] < ids[j] }) || ids[n-1] != int64(n-1) {
+		t.Errorf("expected the %d ids in order", n)
+	}
+
+	// small tables are not worth the workers
+	c2, bp2, _ := makeParallelTestCatalog(t, PARALLEL_PAGES_PER_WORKER)
+	if plan, _ := runIntColumnQuery(t, c2, bp2, "select id from nums order by id limit 3", 0); planHas(plan, isExchange) {
+		t.Errorf("expected a serial plan for a table of %d pages", PARALLEL_PAGES_PER_WORKER)
+	}
+}
+
+// The partitions of an NNScan together return the records of the clusters the
+// scan probes.
+func TestParallelNNScan(t *testing.T) {
+	c, hf, bp, dir := makeTweetsTestCatalog(t)
+	query := readFirstTweets(t, hf, bp, 1)[0].Fields[2].(EmbeddedStringField).Emb
+	startFakeEmbeddingServerFunc(t, func(text string) EmbeddingType { return query })
+	if _, err := ConstructNNIndexFileFromHeapFile(hf, "content", 5, false, dir, "tweets_test", bp); err != nil {
+		t.Fatalf(err.Error())
+	}
+	plan, _ := queryRows(t, c, bp, "select tweet_id from tweets_test order by content ailike 'q' limit 5")
+	var scan *NNScan
+	planHas(plan, func(op Operator) bool {
+		scan, _ = op.(*NNScan)
+		return scan != nil
+	})
+	if scan == nil {
+		t.Fatalf("expected the query to use the vector index")
+	}
+
+	tid := bp.Transactions().Begin()
+	defer tid.Commit()
+	serial := collectTuples(t, scan, tid)
+	partitions, ok := partitionScan(scan, 3)
+	if !ok {
+		t.Fatalf("expected an NNScan to be partitioned")
+	}
+	gather, err := NewGather(partitions)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ids := func(tuples []*Tuple) []int64 {
+		var ids []int64
+		for _, tup := range tuples {
+			ids = append(ids, tup.Fields[0].(IntField).Value)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		return ids
+	}
+	if got := ids(collectTuples(t, gather, tid)); fmt.Sprint(got) != fmt.Sprint(ids(serial)) {
+		t.Errorf("expected the partitions to return %v, got %v", ids(serial), got)
+	}
+}
+
+func TestSetMaxParallelWorkers(t *testing.T) {
+	c, _, _ := makeParallelTestCatalog(t, 1)
+	if c.MaxParallelWorkers() != DEFAULT_MAX_PARALLEL_WORKERS {
+		t.Errorf("expected %d workers by default, got %d", DEFAULT_MAX_PARALLEL_WORKERS, c.MaxParallelWorkers())
+	}
+	qtype, _, err := Parse(c, "SET max_parallel_workers = 8")
+	if err != nil || qtype != SetQueryType {
+		t.Fatalf("expected a SET statement, got %v", err)
+	}
+	if c.MaxParallelWorkers() != 8 {
+		t.Errorf("expected 8 workers, got %d", c.MaxParallelWorkers())
+	}
+	for _, sql := range []string{"set max_parallel_workers = 0", "set max_parallel_workers = 'x'", "set work_mem = 4"} {
+		if _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected %s to fail", sql)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package godb
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ExecCounters counts the work done while executing queries.  The counters of
+// the transaction a query runs in, and of the query itself, are incremented where
+// the work is done, and EXPLAIN ANALYZE attributes it to operators by comparing
+// the counters before and after each call into an operator.
+type ExecCounters struct {
+	PagesRequested       int64 `json:"pages_requested"`
+	BufferHits           int64 `json:"buffer_hits"`
+	BufferMisses         int64 `json:"buffer_misses"`
+	EmbeddingCalls       int64 `json:"embedding_calls"`
+	DistanceComputations int64 `json:"distance_computations"`
+	ClustersProbed       int64 `json:"clusters_probed,omitempty"`
+	IndexPagesRead       int64 `json:"index_pages_read,omitempty"`
+	SortRunsSpilled      int64 `json:"sort_runs_spilled,omitempty"`
+	JoinPartitions       int64 `json:"join_partitions,omitempty"`
+}
+
+// execCounterSet holds running totals of the counters, updated atomically since
+// the workers of a parallel plan update them at once.  Every transaction has one,
+// to which the buffer pool and operators add the work they do for it, and an
+// instrumented plan has one, to which its expressions add the distances they
+// compute, since they are evaluated without a transaction.
+type execCounterSet struct {
+	pagesRequested       atomic.Int64
+	bufferHits           atomic.Int64
+	bufferMisses         atomic.Int64
+	embeddingCalls       atomic.Int64
+	distanceComputations atomic.Int64
+	clustersProbed       atomic.Int64
+	indexPagesRead       atomic.Int64
+	sortRunsSpilled      atomic.Int64
+	joinPartitions       atomic.Int64
+}
+
+// Returns the current values of the counters.
+func (s *execCounterSet) read() ExecCounters {
+	return ExecCounters{
+		PagesRequested:       s.pagesRequested.Load(),
+		BufferHits:           s.bufferHits.Load(),
+		BufferMisses:         s.bufferMisses.Load(),
+		EmbeddingCalls:       s.embeddingCalls.Load(),
+		DistanceComputations: s.distanceComputations.Load(),
+		ClustersProbed:       s.clustersProbed.Load(),
+		IndexPagesRead:       s.indexPagesRead.Load(),
+		SortRunsSpilled:      s.sortRunsSpilled.Load(),
+		JoinPartitions:       s.joinPartitions.Load(),
+	}
+}
+
+// Counts n distance computations; s is nil for the expressions of plans that
+// are not instrumented, whose distances are not counted.
+func (s *execCounterSet) countDistances(n int) {
+	if s != nil {
+		s.distanceComputations.Add(int64(n))
+	}
+}
+
+// Adds the difference between the counters after and before to c.
+func (c *ExecCounters) addDelta(after ExecCounters, before ExecCounters) {
+	c.PagesRequested += after.PagesRequested - before.PagesRequested
+	c.BufferHits += after.BufferHits - before.BufferHits
+	c.BufferMisses += after.BufferMisses - before.BufferMisses
+	c.EmbeddingCalls += after.EmbeddingCalls - before.EmbeddingCalls
+	c.DistanceComputations += after.DistanceComputations - before.DistanceComputations
+	c.ClustersProbed += after.ClustersProbed - before.ClustersProbed
+	c.IndexPagesRead += after.IndexPagesRead - before.IndexPagesRead
+	c.SortRunsSpilled += after.SortRunsSpilled - before.SortRunsSpilled
+	c.JoinPartitions += after.JoinPartitions - before.JoinPartitions
+}
+
+// OperatorStats are the runtime statistics of an operator.  Like its time, the work
+// counted for an operator includes the work done by its inputs.
+type OperatorStats struct {
+	Rows  int64 // number of tuples produced
+	Loops int64 // number of times the operator was iterated, such as the inner side of a join
+	Time  time.Duration
+	ExecCounters
+}
+
+// InstrumentedOp wraps an operator to collect its runtime statistics.
+type InstrumentedOp struct {
+	op       Operator
+	stats    OperatorStats
+	children []*InstrumentedOp
+	query    *execCounterSet // shared by the operators of the plan
+}
+
+// Replaces the inputs of op with children, which are in the order returned by planChildren.
+func setPlanChildren(op Operator, children []Operator) {
+	switch op := op.(type) {
+	case *EqualityJoin[int64]:
+		op.left, op.right = &children[0], &children[1]
+	case *EqualityJoin[string]:
+		op.left, op.right = &children[0], &children[1]
+	case *GraceHashJoin:
+		op.left, op.right = children[0], children[1]
+	case *SortMergeJoin:
+		op.left, op.right = children[0], children[1]
+	case *Project:
+		op.child = children[0]
+	case *Filter:
+		op.child = children[0]
+	case *OrderBy:
+		op.child = children[0]
+	case *LimitOp:
+		op.child = children[0]
+	case *Aggregator:
+		op.child = children[0]
+	case *MMR:
+		op.child = children[0]
+	case *RRFusion:
+		op.children = children
+	case *Gather:
+		op.children = children
+	case *GatherMerge:
+		op.children = children
+	case *SetOp:
+		op.left, op.right = children[0], children[1]
+	case *SubqueryOp:
+		op.child = children[0]
+		for i, s := range op.subqueries {
+			s.op = children[i+1]
+		}
+	case *InsertOp:
+		op.child = children[0]
+	case *DeleteOp:
+		op.child = children[0]
+	case *UpdateOp:
+		op.child = children[0]
+	}
+}
+
+// Returns the expressions op evaluates on the tuples of its inputs.
+func planExprs(op Operator) []Expr {
+	switch op := op.(type) {
+	case *EqualityJoin[int64]:
+		return []Expr{op.leftField, op.rightField}
+	case *EqualityJoin[string]:
+		return []Expr{op.leftField, op.rightField}
+	case *GraceHashJoin:
+		return append(append([]Expr{}, op.leftFields...), op.rightFields...)
+	case *SortMergeJoin:
+		return append(append([]Expr{}, op.leftFields...), op.rightFields...)
+	case *Project:
+		return op.selectFields
+	case *Filter:
+		return []Expr{op.pred}
+	case *OrderBy:
+		return op.orderBy
+	case *GatherMerge:
+		return op.orderBy
+	case *Aggregator:
+		exprs := append([]Expr{}, op.groupByFields...)
+		for _, agg := range op.newAggState {
+			exprs = append(exprs, agg.inputExpr())
+		}
+		return exprs
+	case *MMR:
+		return []Expr{op.field}
+	case *NNScan:
+		if op.filter != nil {
+			return []Expr{op.filter}
+		}
+	case *UpdateOp:
+		return op.setExprs
+	}
+	return nil
+}
+
+// Makes the distance functions in e count the distances they compute in counters.
+func countDistancesIn(e Expr, counters *execCounterSet) {
+	switch e := e.(type) {
+	case *FuncExpr:
+		e.counters = counters
+		for _, arg := range e.args {
+			countDistancesIn(*arg, counters)
+		}
+	case *MultiVectorExpr:
+		e.counters = counters
+	case *compositeKeyExpr:
+		for _, k := range e.exprs {
+			countDistancesIn(k, counters)
+		}
+	case *CompareExpr:
+		countDistancesIn(e.left, counters)
+		countDistancesIn(e.right, counters)
+	case *AndExpr:
+		for _, p := range e.preds {
+			countDistancesIn(p, counters)
+		}
+	case *OrExpr:
+		for _, p := range e.preds {
+			countDistancesIn(p, counters)
+		}
+	case *NotExpr:
+		countDistancesIn(e.pred, counters)
+	case *InExpr:
+		countDistancesIn(e.left, counters)
+		for _, item := range e.list {
+			countDistancesIn(item, counters)
+		}
+	case *BetweenExpr:
+		countDistancesIn(e.val, counters)
+		countDistancesIn(e.low, counters)
+		countDistancesIn(e.high, counters)
+	case *IsNullExpr:
+		countDistancesIn(e.expr, counters)
+	case *InSubqueryExpr:
+		countDistancesIn(e.left, counters)
+	}
+}
+
+// Wraps every operator of the plan rooted at op so that its runtime statistics are
+// collected when the plan runs.  The plan is modified in place, so should not be
+// shared with other queries.
+func InstrumentPlan(op Operator) *InstrumentedOp {
+	return instrumentPlan(op, &execCounterSet{})
+}
+
+func instrumentPlan(op Operator, query *execCounterSet) *InstrumentedOp {
+	instrumented := &InstrumentedOp{op: op, query: query}
+	for _, e := range planExprs(op) {
+		countDistancesIn(e, query)
+	}
+	children := planChildren(op)
+	if len(children) == 0 {
+		return instrumented
+	}
+	wrapped := make([]Operator, len(children))
+	for i, child := range children {
+		c := instrumentPlan(child, query)
+		instrumented.children = append(instrumented.children, c)
+		wrapped[i] = c
+	}
+	setPlanChildren(op, wrapped)
+	return instrumented
+}
+
+func (o *InstrumentedOp) Descriptor() *TupleDesc {
+	return o.op.Descriptor()
+}
+
+// Returns the counters of the work done for tid by the plan, which are those
+// of tid and those of the plan's expressions.
+func (o *InstrumentedOp) readCounters(tid *Transaction) [2]ExecCounters {
+	return [2]ExecCounters{tid.counters.read(), o.query.read()}
+}
+
+// Adds the work counted between before and after to the operator's statistics.
+func (o *InstrumentedOp) addDelta(after [2]ExecCounters, before [2]ExecCounters) {
+	o.stats.addDelta(after[0], before[0])
+	o.stats.addDelta(after[1], before[1])
+}
+
+func (o *InstrumentedOp) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
+	before := o.readCounters(tid)
+	start := time.Now()
+	iter, err := o.op.Iterator(tid)
+	o.stats.Time += time.Since(start)
+	o.addDelta(o.readCounters(tid), before)
+	if err != nil {
+		return nil, err
+	}
+	o.stats.Loops++
+	return func() (*Tuple, error) {
+		before := o.readCounters(tid)
+		start := time.Now()
+		t, err := iter()
+		o.stats.Time += time.Since(start)
+		o.addDelta(o.readCounters(tid), before)
+		if t != nil {
+			o.stats.Rows++
+		}
+		return t, err
+	}, nil
+}
+
+// ExplainNode is the EXPLAIN ANALYZE output for one operator, with its estimated
+// and actual costs.
+type ExplainNode struct {
+	Operator      string  `json:"operator"`
+	EstimatedCost float64 `json:"estimated_cost"`
+	EstimatedRows float64 `json:"estimated_rows"`
+	Rows          int64   `json:"rows"`
+	Loops         int64   `json:"loops"`
+	TimeMs        float64 `json:"time_ms"`
+	ExecCounters
+	Children []*ExplainNode `json:"children,omitempty"`
+}
+
+// Returns the EXPLAIN ANALYZE output for the instrumented plan rooted at o.
+func (o *InstrumentedOp) ExplainNode() *ExplainNode {
+	est := EstimatePlanCost(o.op)
+	node := &ExplainNode{
+		Operator:      planLabel(o.op),
+		EstimatedCost: est.Cost,
+		EstimatedRows: est.Rows,
+		Rows:          o.stats.Rows,
+		Loops:         o.stats.Loops,
+		TimeMs:        float64(o.stats.Time.Microseconds()) / 1000,
+		ExecCounters:  o.stats.ExecCounters,
+	}
+	for _, child := range o.children {
+		node.Children = append(node.Children, child.ExplainNode())
+	}
+	return node
+}
+
+// Runs the plan to completion, discarding its results, and returns its EXPLAIN
+// ANALYZE output.  The plan is modified to collect statistics, so should not be
+// run again.
+func ExplainAnalyze(plan Operator, tid *Transaction) (*ExplainNode, error) {
+	instrumented := InstrumentPlan(plan)
+	iter, err := instrumented.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	for t, err := iter(); t != nil || err != nil; t, err = iter() {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return instrumented.ExplainNode(), nil
+}
+
+// Returns the output as an indented tree, one operator per line.
+func (n *ExplainNode) String() string {
+	var sb strings.Builder
+	n.writeTree(&sb, "")
+	return sb.String()
+}
+
+func (n *ExplainNode) writeTree(sb *strings.Builder, indent string) {
+	fmt.Fprintf(sb, "%s%s  (cost=%.1f rows=%.0f) (actual rows=%d loops=%d time=%.3fms pages=%d hits=%d misses=%d embeddings=%d distances=%d",
+		indent, n.Operator, n.EstimatedCost, n.EstimatedRows, n.Rows, n.Loops, n.TimeMs,
+		n.PagesRequested, n.BufferHits, n.BufferMisses, n.EmbeddingCalls, n.DistanceComputations)
+	if n.ClustersProbed > 0 || n.IndexPagesRead > 0 {
+		fmt.Fprintf(sb, " clusters probed=%d index pages=%d", n.ClustersProbed, n.IndexPagesRead)
+	}
+	if n.SortRunsSpilled > 0 {
+		fmt.Fprintf(sb, " sort runs spilled=%d", n.SortRunsSpilled)
+	}
+	if n.JoinPartitions > 0 {
+		fmt.Fprintf(sb, " join partitions=%d", n.JoinPartitions)
+	}
+	sb.WriteString(")\n")
+	for _, child := range n.Children {
+		child.writeTree(sb, indent+"\t")
+	}
+}
+
+// Returns the output as indented JSON.
+func (n *ExplainNode) JSON() (string, error) {
+	out, err := json.MarshalIndent(n, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
@@ -0,0 +1,176 @@
+package godb
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// Returns the first node of the tree rooted at n whose operator starts with prefix.
+func findExplainNode(n *ExplainNode, prefix string) *ExplainNode {
+	if strings.HasPrefix(n.Operator, prefix) {
+		return n
+	}
+	for _, child := range n.Children {
+		if found := findExplainNode(child, prefix); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// Parses and runs the query under EXPLAIN ANALYZE.
+func explainAnalyzeQuery(t *testing.T, c *Catalog, bp *BufferPool, sql string) *ExplainNode {
+	_, plan, err := Parse(c, sql)
+	if err != nil {
+		t.Fatalf("failed to parse, q=%s, %s", sql, err.Error())
+	}
+	tid := bp.Transactions().Begin()
+	defer tid.Commit()
+	result, err := ExplainAnalyze(plan, tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return result
+}
+
+func TestExplainAnalyzeJoin(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	result := explainAnalyzeQuery(t, c, bp, "select r.r_id, t.name from r join s on r.s_id = s.s_id join t on s.t_id = t.t_id where r.r_id < 100")
+
+	if !strings.HasPrefix(result.Operator, "Project") || result.Rows != 100 || result.Loops != 1 {
+		t.Fatalf("expected the projection to produce 100 rows in one loop, got %s %d rows %d loops", result.Operator, result.Rows, result.Loops)
+	}
+	filter := findExplainNode(result, "Filter")
+	if filter == nil || filter.Rows != 100 {
+		t.Fatalf("expected a filter producing 100 rows, got %+v", filter)
+	}
+	if len(filter.Children) != 1 || filter.Children[0].Rows != 500 {
+		t.Errorf("expected the filter to read the 500 rows of r")
+	}
+	// work is counted inclusively, so a parent never does less than its inputs
+	for _, child := range result.Children {
+		if child.PagesRequested > result.PagesRequested || child.TimeMs > result.TimeMs {
+			t.Errorf("expected the root to include the work of its inputs")
+		}
+	}
+	if result.PagesRequested == 0 || result.PagesRequested != result.BufferHits+result.BufferMisses {
+		t.Errorf("expected every page request to be a hit or a miss, got %d requests, %d hits, %d misses",
+			result.PagesRequested, result.BufferHits, result.BufferMisses)
+	}
+
+	out := result.String()
+	if lines := strings.Count(out, "\n"); lines != 7 {
+		t.Errorf("expected one line per operator, got\n%s", out)
+	}
+	if !strings.Contains(out, "actual rows=100 loops=1") {
+		t.Errorf("expected actual rows in the tree output, got\n%s", out)
+	}
+
+	js, err := result.JSON()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var decoded ExplainNode
+	if err := json.Unmarshal([]byte(js), &decoded); err != nil {
+		t.Fatalf("failed to decode JSON output, %s", err.Error())
+	}
+	if decoded.Operator != result.Operator || decoded.Rows != result.Rows || len(decoded.Children) != len(result.Children) ||
+		decoded.PagesRequested != result.PagesRequested {
+		t.Errorf("expected JSON output to match the tree")
+	}
+}
+
+func TestExplainAnalyzeNNScan(t *testing.T) {
+	c, hf, bp, dir := makeTweetsTestCatalog(t)
+	tweets := readFirstTweets(t, hf, bp, 1)
+	startFakeEmbeddingServer(t, tweets[0].Fields[2].(EmbeddedStringField).Emb)
+
+	// records are embedded when they are inserted
+	values := &ValueOp{hf.Descriptor(), [][]Expr{{
+		&ConstExpr{IntField{1000}, IntType},
+		&ConstExpr{StringField{"positive"}, StringType},
+		&ConstExpr{EmbeddedStringField{Value: "a new tweet"}, EmbeddedStringType},
+	}}}
+	tid := bp.Transactions().Begin()
+	result, err := ExplainAnalyze(NewInsertOp(hf, values), tid)
+	tid.Commit()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if result.Rows != 1 || len(result.Children) != 1 || result.Children[0].Rows != 1 {
+		t.Errorf("expected one inserted row, got\n%s", result.String())
+	}
+	if result.EmbeddingCalls != 1 {
+		t.Errorf("expected one embedding call for the insert, got %d", result.EmbeddingCalls)
+	}
+
+	_, err = ConstructNNIndexFileFromHeapFile(hf, "content", 10, true, dir, "tweets_test", bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	result = explainAnalyzeQuery(t, c, bp, "select tweet_id, content ailike 'query' d from tweets_test order by d limit 1")
+	scan := findExplainNode(result, "NN Index Scan")
+	if scan == nil {
+		t.Fatalf("expected the plan to use the vector index, got\n%s", result.String())
+	}
+	if scan.ClustersProbed != int64(DefaultProbe) {
+		t.Errorf("expected %d clusters to be probed, got %d", DefaultProbe, scan.ClustersProbed)
+	}
+	if scan.IndexPagesRead == 0 || scan.DistanceComputations == 0 {
+		t.Errorf("expected the scan to read index pages and compare centroids, got %+v", scan.ExecCounters)
+	}
+	// index pages are counted as the scan requests them from the buffer pool
+	if scan.IndexPagesRead > scan.PagesRequested {
+		t.Errorf("expected the index pages read to be among the %d pages requested, got %d", scan.PagesRequested, scan.IndexPagesRead)
+	}
+	project := findExplainNode(result, "Project")
+	if project.DistanceComputations != project.Children[0].DistanceComputations+project.Children[0].Rows {
+		t.Errorf("expected one distance computation per projected row")
+	}
+	if !strings.Contains(result.String(), "clusters probed=3") {
+		t.Errorf("expected the index statistics in the tree output, got\n%s", result.String())
+	}
+}
+
+// The work of queries running at the same time in other transactions is not
+// counted for the operators of a query under EXPLAIN ANALYZE.
+func TestExplainAnalyzeConcurrentQueries(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	sql := "select r.r_id, s.s_id from r join s on r.s_id = s.s_id"
+	alone := explainAnalyzeQuery(t, c, bp, sql)
+
+	table, err := c.GetTable("r")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			tid := bp.Transactions().Begin()
+			iter, err := table.Iterator(tid)
+			if err != nil {
+				tid.Abort()
+				return
+			}
+			for tup, err := iter(); tup != nil && err == nil; tup, err = iter() {
+			}
+			tid.Commit()
+		}
+	}()
+	concurrent := explainAnalyzeQuery(t, c, bp, sql)
+	close(stop)
+	<-done
+
+	if concurrent.PagesRequested != alone.PagesRequested || concurrent.Rows != alone.Rows {
+		t.Errorf("expected the query to request %d pages as it does alone, got %d", alone.PagesRequested, concurrent.PagesRequested)
+	}
+}
@@ -3,6 +3,7 @@ package godb
 import (
 	"fmt"
 	"math/rand"
+	"strings"
 	"time"
 )
 
@@ -49,8 +50,9 @@ func (c *ConstExpr) EvalExpr(_ *Tuple) (DBValue, error) {
 }
 
 type FuncExpr struct {
-	op   string
-	args []*Expr
+	op       string
+	args     []*Expr
+	counters *execCounterSet // where distance functions count their distances, if they are counted
 }
 
 func (f *FuncExpr) GetExprType() FieldType {
@@ -70,6 +72,123 @@ func (f *FuncExpr) GetExprType() FieldType {
 
 }
 
+// RidExpr is rid(), the position of a record in the heap file it was read from,
+// as its page number times 65536 plus its slot.  It is NULL for records that were
+// not read from a heap file, such as the results of a join.  It breaks ties
+// between records in keyset pagination, since it is unique within a table.
+type RidExpr struct{}
+
+func (r *RidExpr) GetExprType() FieldType {
+	return FieldType{"rid", "", IntType}
+}
+
+func (r *RidExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	rid, ok := t.Rid.(heapRecordId)
+	if !ok {
+		return nil, nil
+	}
+	return IntField{int64(rid.pageNo)<<16 | int64(rid.slotNo)}, nil
+}
+
+// BM25Expr scores the text of a field against a keyword query, using the corpus
+// statistics of the field's text index. Scores are scaled by 1000 and truncated
+// to an int, so larger values indicate a better match.
+type BM25Expr struct {
+	field      *FieldExpr
+	query      string
+	queryTerms []string
+	index      *TextIndexFile
+	matchOnly  bool // 1 if the text contains any of the query terms, else 0, rather than the score
+}
+
+// Create a BM25Expr; the index must already have been loaded.
+func NewBM25Expr(field *FieldExpr, query string, index *TextIndexFile) *BM25Expr {
+	return &BM25Expr{field, query, tokenizeText(query), index, false}
+}
+
+// Create a BM25Expr that is 1 for text that contains any of the terms of query,
+// and 0 otherwise, as MATCH ... AGAINST is in a WHERE clause.
+func NewTextMatchExpr(field *FieldExpr, query string, index *TextIndexFile) *BM25Expr {
+	return &BM25Expr{field, query, tokenizeText(query), index, true}
+}
+
+func (b *BM25Expr) GetExprType() FieldType {
+	ft := b.field.GetExprType()
+	return FieldType{ft.Fname, ft.TableQualifier, IntType}
+}
+
+func (b *BM25Expr) EvalExpr(t *Tuple) (DBValue, error) {
+	val, err := b.field.EvalExpr(t)
+	if err != nil || val == nil {
+		return nil, err
+	}
+	text, err := textOfField(val)
+	if err != nil {
+		return nil, err
+	}
+	if b.matchOnly {
+		if containsAnyTerm(b.queryTerms, text) {
+			return IntField{1}, nil
+		}
+		return IntField{0}, nil
+	}
+	return IntField{int64(b.index.scoreText(b.queryTerms, text) * 1000)}, nil
+}
+
+// MultiVectorExpr compares a field against several example queries, as in
+// col AILIKE ANY('a', 'b') or col AILIKE ALL('a', 'b'). Each comparison is an
+// AILIKE distance; ANY takes the distance to the nearest example, and ALL takes
+// the distance to the farthest, so smaller values are better in both cases.
+type MultiVectorExpr struct {
+	field    *FieldExpr
+	queries  []EmbeddedStringField
+	all      bool
+	counters *execCounterSet // where the distances are counted, if they are counted
+}
+
+func NewMultiVectorExpr(field *FieldExpr, queries []EmbeddedStringField, all bool) *MultiVectorExpr {
+	return &MultiVectorExpr{field: field, queries: queries, all: all}
+}
+
+func (m *MultiVectorExpr) GetExprType() FieldType {
+	ft := m.field.GetExprType()
+	return FieldType{ft.Fname, ft.TableQualifier, IntType}
+}
+
+func (m *MultiVectorExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	val, err := m.field.EvalExpr(t)
+	if err != nil || val == nil {
+		return nil, err
+	}
+	field, ok := val.(EmbeddedStringField)
+	if !ok {
+		return nil, ailikeError{TypeMismatchError, "AILIKE ANY and ALL expect an embedded text field"}
+	}
+	var dist int64
+	for i, q := range m.queries {
+		d := ailikeFunc([]any{field, q}).(int64)
+		if i == 0 || (m.all && d > dist) || (!m.all && d < dist) {
+			dist = d
+		}
+	}
+	m.counters.countDistances(len(m.queries))
+	return IntField{dist}, nil
+}
+
+// Returns the average of the example embeddings, which is used to probe an
+// index for records that are like all of the examples.
+func (m *MultiVectorExpr) meanQuery() EmbeddedStringField {
+	values := make([]string, len(m.queries))
+	emb := make(EmbeddingType, len(m.queries[0].Emb))
+	for i, q := range m.queries {
+		values[i] = q.Value
+		for j := range emb {
+			emb[j] += q.Emb[j] / float64(len(m.queries))
+		}
+	}
+	return EmbeddedStringField{Value: strings.Join(values, ", "), Emb: emb}
+}
+
 type FuncType struct {
 	argTypes []DBType
 	outType  DBType
@@ -213,29 +332,57 @@ func subStrFunc(args []any) any {
 	return substr
 }
 
-func (f *FuncExpr) EvalExpr(t *Tuple) (DBValue, error) {
+// Returns the type of the values of e.  The type of a constant is read
+// directly, since its GetExprType formats its value, which for an embedding is
+// slower than computing a distance from it.
+func exprFtype(e Expr) DBType {
+	if c, ok := e.(*ConstExpr); ok {
+		return c.constType
+	}
+	return e.GetExprType().Ftype
+}
+
+// Returns the function f calls, checking that f has the arguments it expects.
+func (f *FuncExpr) funcType() (FuncType, error) {
 	fType, exists := funcs[f.op]
 	if !exists {
-		return nil, ailikeError{ParseError, fmt.Sprintf("unknown function %s", f.op)}
+		return fType, ailikeError{ParseError, fmt.Sprintf("unknown function %s", f.op)}
 	}
 	if len(f.args) != len(fType.argTypes) {
-		return nil, ailikeError{ParseError, fmt.Sprintf("function %s expected %d args", f.op, len(fType.argTypes))}
+		return fType, ailikeError{ParseError, fmt.Sprintf("function %s expected %d args", f.op, len(fType.argTypes))}
 	}
-	argvals := make([]any, len(fType.argTypes))
 	for i, argType := range fType.argTypes {
-		arg := *f.args[i]
-		if arg.GetExprType().Ftype != argType {
+		if ftype := exprFtype(*f.args[i]); ftype != argType && ftype != UnknownType {
 			typeName := "string"
 			switch argType {
 			case IntType:
 				typeName = "int"
 			}
-			return nil, ailikeError{ParseError, fmt.Sprintf("function %s expected arg of type %s", f.op, typeName)}
+			return fType, ailikeError{ParseError, fmt.Sprintf("function %s expected arg of type %s", f.op, typeName)}
 		}
+	}
+	return fType, nil
+}
+
+func (f *FuncExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	fType, err := f.funcType()
+	if err != nil {
+		return nil, err
+	}
+	if isDistanceFunc(f.op) {
+		return f.evalDistance(t)
+	}
+	argvals := make([]any, len(fType.argTypes))
+	for i, argType := range fType.argTypes {
+		arg := *f.args[i]
 		val, err := arg.EvalExpr(t)
 		if err != nil {
 			return nil, err
 		}
+		if val == nil {
+			// a function of NULL, e.g. AILIKE over NULL text, is NULL
+			return nil, nil
+		}
 		switch argType {
 		case IntType:
 			argvals[i] = val.(IntField).Value
@@ -300,3 +447,191 @@ func ailikeVecFunc(args []any) any {
 
 	return int64(-r * 1000)
 }
+
+// The AILIKE functions are evaluated by [FuncExpr.evalDistance] and
+// [FuncExpr.evalDistanceBatch] rather than through their entries in funcs,
+// which box their arguments, and compute the norms of both of them for each
+// pair; their values are the same.
+func isDistanceFunc(op string) bool {
+	switch op {
+	case "ailike", "ailike_cos", "ailike_vec":
+		return true
+	}
+	return false
+}
+
+// Returns the embedding of a text or vector value.
+func embeddingOf(v DBValue) EmbeddingType {
+	switch v := v.(type) {
+	case EmbeddedStringField:
+		return v.Emb
+	case VectorField:
+		return v.Emb
+	}
+	return nil
+}
+
+// Returns the norm of the embedding of a text or vector value: the one kept
+// with values read from pages, so that it is computed once per row rather than
+// for each distance, or else computed now.
+func normOfValue(v DBValue) float64 {
+	var emb EmbeddingType
+	switch v := v.(type) {
+	case EmbeddedStringField:
+		if v.norm != 0 {
+			return v.norm
+		}
+		emb = v.Emb
+	case VectorField:
+		if v.norm != 0 {
+			return v.norm
+		}
+		emb = v.Emb
+	}
+	return normOf(emb)
+}
+
+// Returns the value of the distance function op for embeddings whose dot
+// product is dot, and the product of whose norms is norms, which is only used
+// by ailike_cos.
+func distanceValue(op string, dot float64, norms float64) DBValue {
+	if op == "ailike_cos" {
+		return IntField{int64(dot / norms)}
+	}
+	// the negative of the dot product indicates similarity
+	return IntField{int64(-dot * 1000)}
+}
+
+func distanceLengthError(op string, len1 int, len2 int) error {
+	return ailikeError{TypeMismatchError, fmt.Sprintf("embeddings of different lengths in %s: %d vs %d", op, len1, len2)}
+}
+
+// Evaluates a distance function on t.  Its arguments must have been checked.
+func (f *FuncExpr) evalDistance(t *Tuple) (DBValue, error) {
+	a, err := (*f.args[0]).EvalExpr(t)
+	if err != nil {
+		return nil, err
+	}
+	b, err := (*f.args[1]).EvalExpr(t)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil || b == nil {
+		// a function of NULL, e.g. AILIKE over NULL text, is NULL
+		return nil, nil
+	}
+	v1, v2 := embeddingOf(a), embeddingOf(b)
+	if len(v1) != len(v2) {
+		return nil, distanceLengthError(f.op, len(v1), len(v2))
+	}
+	f.counters.countDistances(1)
+	if f.op == "ailike_cos" {
+		return distanceValue(f.op, dotKernel(v1, v2), normOfValue(a)*normOfValue(b)), nil
+	}
+	return distanceValue(f.op, dotKernel(v1, v2), 0), nil
+}
+
+// Evaluates a distance function on each tuple of block, which must all have
+// the same descriptor.  The fields of column arguments are found once for the
+// block, and when an argument is a constant, as the query of a brute-force
+// AILIKE scan is, its embedding and norm are computed once, and the distances
+// of the other argument's embeddings from it are computed by a batch kernel,
+// with the norms kept with the rows.
+func (f *FuncExpr) evalDistanceBatch(block []*Tuple) ([]DBValue, error) {
+	if _, err := f.funcType(); err != nil {
+		return nil, err
+	}
+	vals := make([]DBValue, len(block))
+	if len(block) == 0 {
+		return vals, nil
+	}
+	left, right := *f.args[0], *f.args[1]
+	if _, ok := left.(*ConstExpr); ok {
+		// the functions are symmetric
+		left, right = right, left
+	}
+	lefts, err := argumentValues(left, block)
+	if err != nil {
+		return nil, err
+	}
+	query, ok := right.(*ConstExpr)
+	if !ok {
+		rights, err := argumentValues(right, block)
+		if err != nil {
+			return nil, err
+		}
+		computed := 0
+		for i := range block {
+			if lefts[i] == nil || rights[i] == nil {
+				continue
+			}
+			v1, v2 := embeddingOf(lefts[i]), embeddingOf(rights[i])
+			if len(v1) != len(v2) {
+				return nil, distanceLengthError(f.op, len(v1), len(v2))
+			}
+			if f.op == "ailike_cos" {
+				vals[i] = distanceValue(f.op, dotKernel(v1, v2), normOfValue(lefts[i])*normOfValue(rights[i]))
+			} else {
+				vals[i] = distanceValue(f.op, dotKernel(v1, v2), 0)
+			}
+			computed++
+		}
+		f.counters.countDistances(computed)
+		return vals, nil
+	}
+	queryVal, err := query.EvalExpr(nil)
+	if err != nil || queryVal == nil {
+		return vals, err
+	}
+	queryEmb := embeddingOf(queryVal)
+	// the rows of the tuples that are not NULL, and their positions in block
+	rows := make([][]float64, 0, len(block))
+	positions := make([]int, 0, len(block))
+	for i, v := range lefts {
+		if v == nil {
+			continue
+		}
+		row := embeddingOf(v)
+		if len(row) != len(queryEmb) {
+			return nil, distanceLengthError(f.op, len(row), len(queryEmb))
+		}
+		rows = append(rows, row)
+		positions = append(positions, i)
+	}
+	out := make([]float64, len(rows))
+	if f.op == "ailike_cos" {
+		rowNorms := make([]float64, len(rows))
+		for j, i := range positions {
+			rowNorms[j] = normOfValue(lefts[i])
+		}
+		cosineBatchKernel(queryEmb, normOfValue(queryVal), rows, rowNorms, out)
+		for j, i := range positions {
+			vals[i] = IntField{int64(out[j])}
+		}
+	} else {
+		dotBatchKernel(queryEmb, rows, out)
+		for j, i := range positions {
+			vals[i] = distanceValue(f.op, out[j], 0)
+		}
+	}
+	f.counters.countDistances(len(rows))
+	return vals, nil
+}
+
+// Returns the values of the argument e of a function for each tuple of block.
+// The field a column argument reads is found once for the block.
+func argumentValues(e Expr, block []*Tuple) ([]DBValue, error) {
+	field, ok := e.(*FieldExpr)
+	if !ok {
+		return evalBatch(e, block)
+	}
+	col, err := projectedFieldIndex(field.selectField, &block[0].Desc)
+	if err != nil {
+		return nil, err
+	}
+	vals := make([]DBValue, len(block))
+	for i, t := range block {
+		vals[i] = t.Fields[col]
+	}
+	return vals, nil
+}
@@ -0,0 +1,383 @@
+package godb
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// A FileManager does the I/O of the pages of heap files, keeping a handle open
+// to each file it reads or writes, rather than opening and closing the file for
+// every page, and reading and writing pages at their offsets with ReadAt and
+// WriteAt, so that the handle can be shared by concurrent transactions.  Heap,
+// index and temporary files all share one file manager (see
+// [SharedFileManager]), so that the number of handles it keeps open stays
+// within its budget: once it is reached, the handles used least recently are
+// closed, unless they are in use.
+//
+// Files that are read much more often than they are written, such as the
+// centroid files of nearest neighbor indexes, can be mapped into memory, where
+// the platform supports it, so that reading a page is a copy out of the page
+// cache rather than a system call.
+//
+// Handles that are cached would outlive the files they refer to if the files
+// were removed or renamed, so files are removed and renamed through the file
+// manager, which closes their handles first.
+type FileManager struct {
+	mutex      sync.Mutex
+	handles    map[string]*fileHandle
+	lru        *list.List // of *fileHandle, most recently used first
+	maxOpen    int
+	syncPolicy SyncPolicy
+	mmap       bool            // whether read-mostly files are mapped into memory
+	readMostly map[string]bool // the files that are mapped if mmap is set
+	// the scans of the transaction stamps of each heap file, which are only
+	// needed the first time the file is opened; see [FileManager.scanOnce]
+	stampScans map[string]*stampScan
+}
+
+type stampScan struct {
+	mutex sync.Mutex
+	done  bool
+}
+
+type fileHandle struct {
+	name  string
+	file  *os.File
+	elem  *list.Element
+	users int  // the number of I/Os in progress on the handle, which cannot be closed until they finish
+	dirty bool // whether the file has been written since it was last synced
+	// the file mapped into memory, as of its size when it was mapped, or nil
+	mapped []byte
+	// set when the file grows past its mapping, so that it is mapped again once
+	// no I/O is using the old mapping
+	remap bool
+	// set once the handle is dropped from the file manager, so that the last
+	// I/O using it closes it
+	dropped bool
+}
+
+// When the changes written to heap files are synced to disk.
+type SyncPolicy int
+
+const (
+	// files are never synced, leaving it to the operating system to write
+	// them out; with a write-ahead log, which is synced at each commit, this is
+	// enough to recover committed transactions
+	SyncNever SyncPolicy = iota
+	// the files written since the last commit are synced when a transaction
+	// commits, which makes commits durable without a log
+	SyncOnCommit SyncPolicy = iota
+	// files are synced after every page written
+	SyncEveryWrite SyncPolicy = iota
+)
+
+// The number of file handles the shared file manager keeps open.
+const DEFAULT_MAX_OPEN_FILES = 64
+
+// The sync policy of the shared file manager.
+const DEFAULT_SYNC_POLICY = SyncNever
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncNever:
+		return "never"
+	case SyncOnCommit:
+		return "on commit"
+	case SyncEveryWrite:
+		return "every write"
+	}
+	return fmt.Sprintf("SyncPolicy(%d)", int(p))
+}
+
+// the file manager shared by every file of the database
+var sharedFiles = NewFileManager(DEFAULT_MAX_OPEN_FILES)
+
+// Returns the file manager that does the I/O of every heap file.
+func SharedFileManager() *FileManager {
+	return sharedFiles
+}
+
+// Creates a FileManager that keeps at most maxOpen handles open, other than
+// those in use.
+func NewFileManager(maxOpen int) *FileManager {
+	return &FileManager{
+		handles:    make(map[string]*fileHandle),
+		lru:        list.New(),
+		maxOpen:    max(1, maxOpen),
+		syncPolicy: DEFAULT_SYNC_POLICY,
+		mmap:       mmapSupported,
+		readMostly: make(map[string]bool),
+		stampScans: make(map[string]*stampScan),
+	}
+}
+
+// Sets the number of handles the file manager keeps open, closing the handles
+// used least recently if there are more.
+func (fm *FileManager) SetMaxOpenFiles(maxOpen int) error {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	fm.maxOpen = max(1, maxOpen)
+	return fm.closeIdle()
+}
+
+// Sets when the files written are synced to disk.
+func (fm *FileManager) SetSyncPolicy(policy SyncPolicy) {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	fm.syncPolicy = policy
+}
+
+// Sets whether read-mostly files are mapped into memory.  Returns false if
+// mapping files is not supported on this platform, in which case they are read
+// with ReadAt.
+func (fm *FileManager) SetMmap(enabled bool) bool {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	fm.mmap = enabled && mmapSupported
+	return fm.mmap == enabled
+}
+
+// Returns the number of handles the file manager has open.
+func (fm *FileManager) OpenFiles() int {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	return len(fm.handles)
+}
+
+// Marks the file with the given name as read-mostly, so that it is mapped into
+// memory when it is next read, if mapping files is enabled.
+func (fm *FileManager) setReadMostly(name string) {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	fm.readMostly[name] = true
+}
+
+// Runs scan the first time it is called for the file with the given name, and
+// not again once it succeeds; callers that arrive while it runs wait for it.
+// The transaction stamps of a heap file are scanned this way, since once its
+// largest stamp is known, every later stamp is of a transaction of this run.
+func (fm *FileManager) scanOnce(name string, scan func() error) error {
+	fm.mutex.Lock()
+	s, ok := fm.stampScans[name]
+	if !ok {
+		s = &stampScan{}
+		fm.stampScans[name] = s
+	}
+	fm.mutex.Unlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.done {
+		return nil
+	}
+	if err := scan(); err != nil {
+		return err
+	}
+	s.done = true
+	return nil
+}
+
+// Returns the handle of the file with the given name, opening it if it is not
+// open, and marks it in use until it is released.  Also returns the mapping of
+// the file, if it is mapped, which stays valid until the handle is released.
+func (fm *FileManager) acquire(name string) (*fileHandle, []byte, error) {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	h, ok := fm.handles[name]
+	if !ok {
+		file, err := os.OpenFile(name, os.O_RDWR, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		h = &fileHandle{name: name, file: file}
+		h.elem = fm.lru.PushFront(h)
+		fm.handles[name] = h
+		if err := fm.closeIdle(); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		fm.lru.MoveToFront(h.elem)
+	}
+	if h.mapped == nil && fm.mmap && fm.readMostly[name] {
+		if info, err := h.file.Stat(); err == nil && info.Size() > 0 {
+			// files that cannot be mapped are read with ReadAt instead
+			h.mapped, _ = mmapFile(h.file, int(info.Size()))
+		}
+	}
+	h.users++
+	return h, h.mapped, nil
+}
+
+// Marks an I/O on h as finished.
+func (fm *FileManager) release(h *fileHandle) error {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	h.users--
+	if h.users > 0 {
+		return nil
+	}
+	if h.dropped {
+		return fm.closeHandle(h)
+	}
+	if h.remap {
+		h.remap = false
+		if err := munmapFile(h.mapped); err != nil {
+			return ailikeError{OSError, err.Error()}
+		}
+		h.mapped = nil
+	}
+	return fm.closeIdle()
+}
+
+// Closes the handles used least recently that are not in use, until no more
+// than maxOpen are open.  Must be called with the mutex held.
+func (fm *FileManager) closeIdle() error {
+	for e := fm.lru.Back(); e != nil && len(fm.handles) > fm.maxOpen; {
+		h := e.Value.(*fileHandle)
+		e = e.Prev()
+		if h.users > 0 {
+			continue
+		}
+		if err := fm.drop(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes h from the file manager, closing it unless it is in use, in which
+// case the last I/O using it closes it.  Must be called with the mutex held.
+func (fm *FileManager) drop(h *fileHandle) error {
+	fm.lru.Remove(h.elem)
+	delete(fm.handles, h.name)
+	h.dropped = true
+	if h.users > 0 {
+		return nil
+	}
+	return fm.closeHandle(h)
+}
+
+// Unmaps and closes h, syncing it first if it was written and the sync policy
+// calls for it.  Must be called with the mutex held.
+func (fm *FileManager) closeHandle(h *fileHandle) error {
+	if h.mapped != nil {
+		if err := munmapFile(h.mapped); err != nil {
+			return ailikeError{OSError, err.Error()}
+		}
+		h.mapped = nil
+	}
+	if h.dirty && fm.syncPolicy != SyncNever {
+		if err := h.file.Sync(); err != nil {
+			return ailikeError{OSError, err.Error()}
+		}
+	}
+	if err := h.file.Close(); err != nil {
+		return ailikeError{OSError, err.Error()}
+	}
+	return nil
+}
+
+// Reads len(b) bytes of the file with the given name at offset off, like
+// [os.File.ReadAt].  Reads of mapped files within their mapping copy the bytes
+// out of it.
+func (fm *FileManager) readAt(name string, b []byte, off int64) (int, error) {
+	h, mapped, err := fm.acquire(name)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	if off+int64(len(b)) <= int64(len(mapped)) {
+		n = copy(b, mapped[off:])
+	} else {
+		n, err = h.file.ReadAt(b, off)
+	}
+	if releaseErr := fm.release(h); err == nil {
+		err = releaseErr
+	}
+	return n, err
+}
+
+// Writes b to the file with the given name at offset off, like
+// [os.File.WriteAt], syncing it if the sync policy is [SyncEveryWrite].
+func (fm *FileManager) writeAt(name string, b []byte, off int64) (int, error) {
+	h, _, err := fm.acquire(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := h.file.WriteAt(b, off)
+	fm.mutex.Lock()
+	h.dirty = true
+	if h.mapped != nil && off+int64(n) > int64(len(h.mapped)) {
+		h.remap = true
+	}
+	policy := fm.syncPolicy
+	fm.mutex.Unlock()
+	if err == nil && policy == SyncEveryWrite {
+		err = h.file.Sync()
+	}
+	if releaseErr := fm.release(h); err == nil {
+		err = releaseErr
+	}
+	return n, err
+}
+
+// Syncs the files written since they were last synced, if the sync policy is
+// [SyncOnCommit]; called as a transaction commits.
+func (fm *FileManager) commit() error {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	if fm.syncPolicy != SyncOnCommit {
+		return nil
+	}
+	for _, h := range fm.handles {
+		if !h.dirty {
+			continue
+		}
+		if err := h.file.Sync(); err != nil {
+			return ailikeError{OSError, err.Error()}
+		}
+		h.dirty = false
+	}
+	return nil
+}
+
+// Closes the handle of the file with the given name, if it is open, so that it
+// is opened again when it is next used.  Files are forgotten when they are
+// created, removed or renamed, since their handles would refer to the old file.
+func (fm *FileManager) forget(name string) error {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	if h, ok := fm.handles[name]; ok {
+		return fm.drop(h)
+	}
+	return nil
+}
+
+// Removes the file with the given name, like [os.Remove], closing its handle.
+func (fm *FileManager) remove(name string) error {
+	if err := fm.forget(name); err != nil {
+		return err
+	}
+	fm.mutex.Lock()
+	delete(fm.readMostly, name)
+	delete(fm.stampScans, name)
+	fm.mutex.Unlock()
+	return os.Remove(name)
+}
+
+// Renames the file oldName to newName, like [os.Rename], closing the handles of
+// both.
+func (fm *FileManager) rename(oldName string, newName string) error {
+	if err := fm.forget(oldName); err != nil {
+		return err
+	}
+	if err := fm.forget(newName); err != nil {
+		return err
+	}
+	fm.mutex.Lock()
+	delete(fm.stampScans, oldName)
+	delete(fm.stampScans, newName)
+	fm.mutex.Unlock()
+	return os.Rename(oldName, newName)
+}
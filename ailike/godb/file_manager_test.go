@@ -0,0 +1,161 @@
+package godb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// Creates a file of the given number of pages, each filled with its page
+// number, in a temporary directory.
+func makeFileManagerTestFile(t *testing.T, name string, numPages int) string {
+	fileName := t.TempDir() + "/" + name
+	var b []byte
+	for pageNo := 0; pageNo < numPages; pageNo++ {
+		b = append(b, bytes.Repeat([]byte{byte(pageNo)}, PageSize)...)
+	}
+	if err := os.WriteFile(fileName, b, 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	return fileName
+}
+
+func expectFilePage(t *testing.T, fm *FileManager, fileName string, pageNo int, fill byte) {
+	b := make([]byte, PageSize)
+	if _, err := fm.readAt(fileName, b, int64(pageNo*PageSize)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !bytes.Equal(b, bytes.Repeat([]byte{fill}, PageSize)) {
+		t.Errorf("expected page %d of %s to be filled with %d, got %d", pageNo, fileName, fill, b[0])
+	}
+}
+
+func TestFileManagerHandles(t *testing.T) {
+	fm := NewFileManager(2)
+	var fileNames []string
+	for i := 0; i < 3; i++ {
+		fileNames = append(fileNames, makeFileManagerTestFile(t, fmt.Sprintf("file%d.dat", i), 2))
+	}
+	expectFilePage(t, fm, fileNames[0], 1, 1)
+	h := fm.handles[fileNames[0]]
+	expectFilePage(t, fm, fileNames[0], 0, 0)
+	if fm.handles[fileNames[0]] != h {
+		t.Errorf("expected the handle to be kept open between reads")
+	}
+	// the third file closes the handle of the file used least recently
+	expectFilePage(t, fm, fileNames[1], 1, 1)
+	expectFilePage(t, fm, fileNames[2], 1, 1)
+	if fm.OpenFiles() != 2 || fm.handles[fileNames[0]] != nil {
+		t.Errorf("expected the handle of the first file to be closed, got %d open", fm.OpenFiles())
+	}
+	expectFilePage(t, fm, fileNames[0], 1, 1)
+
+	// handles in use are not closed until the I/O using them finishes
+	inUse, _, err := fm.acquire(fileNames[1])
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := fm.SetMaxOpenFiles(1); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if fm.OpenFiles() != 1 || fm.handles[fileNames[1]] != inUse {
+		t.Errorf("expected only the handle in use to stay open")
+	}
+	if err := fm.forget(fileNames[1]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := inUse.file.Stat(); err != nil {
+		t.Errorf("expected the handle in use not to be closed when forgotten")
+	}
+	if err := fm.release(inUse); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := inUse.file.Stat(); err == nil {
+		t.Errorf("expected the forgotten handle to be closed once released")
+	}
+}
+
+func TestFileManagerRemoveAndRename(t *testing.T) {
+	fm := NewFileManager(DEFAULT_MAX_OPEN_FILES)
+	fileName := makeFileManagerTestFile(t, "file.dat", 1)
+	other := makeFileManagerTestFile(t, "other.dat", 2)
+	expectFilePage(t, fm, fileName, 0, 0)
+	if err := fm.remove(fileName); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := fm.readAt(fileName, make([]byte, PageSize), 0); !os.IsNotExist(err) {
+		t.Errorf("expected the removed file not to be read, got %v", err)
+	}
+
+	// a file renamed over one with an open handle is read, not the old file
+	expectFilePage(t, fm, other, 1, 1)
+	if err := os.WriteFile(fileName, bytes.Repeat([]byte{7}, 2*PageSize), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := fm.rename(fileName, other); err != nil {
+		t.Fatalf(err.Error())
+	}
+	expectFilePage(t, fm, other, 1, 7)
+}
+
+func TestFileManagerMmap(t *testing.T) {
+	fm := NewFileManager(DEFAULT_MAX_OPEN_FILES)
+	if !fm.SetMmap(true) {
+		t.Skip("mapping files is not supported on this platform")
+	}
+	fileName := makeFileManagerTestFile(t, "centroids.dat", 2)
+	fm.setReadMostly(fileName)
+	expectFilePage(t, fm, fileName, 1, 1)
+	h := fm.handles[fileName]
+	if len(h.mapped) != 2*PageSize {
+		t.Fatalf("expected the file to be mapped, got a mapping of %d bytes", len(h.mapped))
+	}
+
+	// writes within the mapping are seen through it
+	if _, err := fm.writeAt(fileName, bytes.Repeat([]byte{5}, PageSize), int64(PageSize)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	expectFilePage(t, fm, fileName, 1, 5)
+	// and pages appended past it are read from the file, which is mapped again
+	if _, err := fm.writeAt(fileName, bytes.Repeat([]byte{6}, PageSize), int64(2*PageSize)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	expectFilePage(t, fm, fileName, 2, 6)
+	if len(h.mapped) != 3*PageSize {
+		t.Errorf("expected the file to be mapped again, got a mapping of %d bytes", len(h.mapped))
+	}
+
+	// files that are not read-mostly are not mapped
+	other := makeFileManagerTestFile(t, "data.dat", 1)
+	expectFilePage(t, fm, other, 0, 0)
+	if fm.handles[other].mapped != nil {
+		t.Errorf("expected the data file not to be mapped")
+	}
+}
+
+func TestFileManagerSyncPolicy(t *testing.T) {
+	fm := NewFileManager(DEFAULT_MAX_OPEN_FILES)
+	fileName := makeFileManagerTestFile(t, "file.dat", 1)
+	if _, err := fm.writeAt(fileName, bytes.Repeat([]byte{3}, PageSize), 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := fm.commit(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !fm.handles[fileName].dirty {
+		t.Errorf("expected the file not to be synced under %v", SyncNever)
+	}
+	fm.SetSyncPolicy(SyncOnCommit)
+	if err := fm.commit(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if fm.handles[fileName].dirty {
+		t.Errorf("expected the file to be synced under %v", SyncOnCommit)
+	}
+	fm.SetSyncPolicy(SyncEveryWrite)
+	if _, err := fm.writeAt(fileName, bytes.Repeat([]byte{4}, PageSize), 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	expectFilePage(t, fm, fileName, 0, 4)
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package godb
+
+import (
+	"os"
+)
+
+const mmapSupported = false
+
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return nil, ailikeError{IllegalOperationError, "Mapping files into memory is not supported on this platform."}
+}
+
+func munmapFile(mapped []byte) error {
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package godb
+
+import (
+	"os"
+	"syscall"
+)
+
+const mmapSupported = true
+
+// Maps the first size bytes of file into memory, read-only.  The mapping is
+// shared, so it sees the pages later written to the file within it.
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(mapped []byte) error {
+	if mapped == nil {
+		return nil
+	}
+	return syscall.Munmap(mapped)
+}
@@ -1,17 +1,13 @@
 package godb
 
-import (
-	"golang.org/x/exp/constraints"
-)
-
-type Filter[T constraints.Ordered] struct {
-	op     BoolOp
-	left   Expr
-	right  Expr
-	child  Operator
-	getter func(DBValue) T
+// Filter returns the tuples of its child that satisfy a predicate.
+type Filter struct {
+	pred  PredicateExpr
+	child Operator
 }
 
+// Getters read a value of the desired type from a field of a tuple, and are
+// used by joins to build hash tables keyed by the join value
 func intFilterGetter(v DBValue) int64 {
 	intV := v.(IntField)
 	return intV.Value
@@ -22,48 +18,45 @@ func stringFilterGetter(v DBValue) string {
 	return stringV.Value
 }
 
+// Constructor for a filter operator with an arbitrary predicate
+func NewFilter(pred PredicateExpr, child Operator) (*Filter, error) {
+	if child == nil {
+		return nil, ailikeError{MalformedDataError, "NewFilter child pointer is nil."}
+	}
+	return &Filter{pred, child}, nil
+}
+
 // Constructor for a filter operator on ints
-func NewIntFilter(constExpr Expr, op BoolOp, field Expr, child Operator) (*Filter[int64], error) {
+func NewIntFilter(constExpr Expr, op BoolOp, field Expr, child Operator) (*Filter, error) {
 	if constExpr.GetExprType().Ftype != IntType || field.GetExprType().Ftype != IntType {
 		return nil, ailikeError{IncompatibleTypesError, "cannot apply int filter to non int-types"}
 	}
 	if child == nil {
 		return nil, ailikeError{MalformedDataError, "NewIntFilter child pointer is nil."}
 	}
-	f, err := newFilter[int64](constExpr, op, field, child, intFilterGetter)
-	return f, err
+	return &Filter{&CompareExpr{field, constExpr, op}, child}, nil
 }
 
 // Constructor for a filter operator on strings
-func NewStringFilter(constExpr Expr, op BoolOp, field Expr, child Operator) (*Filter[string], error) {
+func NewStringFilter(constExpr Expr, op BoolOp, field Expr, child Operator) (*Filter, error) {
 	if constExpr.GetExprType().Ftype != StringType || field.GetExprType().Ftype != StringType {
 		return nil, ailikeError{IncompatibleTypesError, "cannot apply string filter to non string-types"}
 	}
 	if child == nil {
 		return nil, ailikeError{MalformedDataError, "NewStringFilter child pointer is nil."}
 	}
-	f, err := newFilter[string](constExpr, op, field, child, stringFilterGetter)
-	return f, err
-}
-
-// Getter is a function that reads a value of the desired type
-// from a field of a tuple
-// This allows us to have a generic interface for filters that work
-// with any ordered type
-func newFilter[T constraints.Ordered](constExpr Expr, op BoolOp, field Expr, child Operator, getter func(DBValue) T) (*Filter[T], error) {
-	return &Filter[T]{op, field, constExpr, child, getter}, nil
+	return &Filter{&CompareExpr{field, constExpr, op}, child}, nil
 }
 
 // Return a TupleDescriptor for this filter op.
-func (f *Filter[T]) Descriptor() *TupleDesc {
+func (f *Filter) Descriptor() *TupleDesc {
 	return f.child.Descriptor()
 }
 
 // Filter operator implementation. This function should iterate over
 // the results of the child iterator and return a tuple if it satisfies
 // the predicate.
-// HINT: you can use the evalPred function defined in types.go to compare two values
-func (f *Filter[T]) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+func (f *Filter) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
 	childIter, err := f.child.Iterator(tid)
 	if err != nil {
 		return nil, err
@@ -77,22 +70,44 @@ func (f *Filter[T]) Iterator(tid TransactionID) (func() (*Tuple, error), error)
 			if err != nil {
 				return nil, err
 			}
-			leftV, err := f.left.EvalExpr(t)
-			if err != nil {
-				return nil, err
-			}
-			rightV, err := f.right.EvalExpr(t)
+			ok, err := f.pred.EvalBool(t)
 			if err != nil {
 				return nil, err
 			}
-
-			leftFieldVal := f.getter(leftV)
-			rightFieldVal := f.getter(rightV)
-
-			if evalPred(leftFieldVal, rightFieldVal, f.op) {
+			if ok {
 				return t, nil
 			}
 		}
 		return nil, nil
 	}, nil
 }
+
+// Returns the tuples of the child's blocks that satisfy the predicate, in
+// blocks.
+func (f *Filter) batchIterator(tid *Transaction) (func() ([]*Tuple, error), error) {
+	batches, err := batchesOf(f.child, tid)
+	if err != nil {
+		return nil, err
+	}
+	return func() ([]*Tuple, error) {
+		for {
+			block, err := batches()
+			if err != nil || block == nil {
+				return nil, err
+			}
+			var kept []*Tuple
+			for _, t := range block {
+				ok, err := f.pred.EvalBool(t)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					kept = append(kept, t)
+				}
+			}
+			if len(kept) > 0 {
+				return kept, nil
+			}
+		}
+	}, nil
+}
@@ -0,0 +1,104 @@
+package godb
+
+import (
+	"sort"
+)
+
+// RRFusion merges several ranked inputs with reciprocal rank fusion: a tuple
+// that appears at rank r (starting from 1) in an input receives 1/(k+r) from
+// that input, and tuples are returned in decreasing order of their summed
+// scores. The score is appended to each tuple as an "rrf" field, scaled by
+// 1e6 and truncated to an int.
+//
+// All children must produce the same tuples (e.g., different orderings of the
+// same table), and must return them best first. Tuples are matched across
+// children by their Rid, or by their contents if they have no Rid.
+type RRFusion struct {
+	children []Operator
+	k        int
+}
+
+// Construct a fusion operator over children, which must have identical descriptors.
+func NewRRFusion(children []Operator, k int) (*RRFusion, error) {
+	if len(children) == 0 {
+		return nil, ailikeError{MalformedDataError, "RRFusion requires at least one child."}
+	}
+	for _, child := range children[1:] {
+		if !child.Descriptor().equals(children[0].Descriptor()) {
+			return nil, ailikeError{TypeMismatchError, "RRFusion children must have the same descriptor."}
+		}
+	}
+	return &RRFusion{children, k}, nil
+}
+
+// The descriptor of the children, with the fused score appended.
+func (r *RRFusion) Descriptor() *TupleDesc {
+	scoreDesc := TupleDesc{Fields: []FieldType{{Fname: "rrf", TableQualifier: "", Ftype: IntType}}}
+	return r.children[0].Descriptor().merge(&scoreDesc)
+}
+
+func (r *RRFusion) rrfKey(t *Tuple) any {
+	if t.Rid != nil {
+		return t.Rid
+	}
+	return t.tupleKey()
+}
+
+// Fusion is blocking: every child is read to completion before the first
+// tuple is returned.
+func (r *RRFusion) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
+	var (
+		keys   []any
+		tuples = make(map[any]*Tuple)
+		scores = make(map[any]float64)
+	)
+	desc := r.Descriptor()
+	fused := false
+	i := 0
+
+	return func() (*Tuple, error) {
+		if !fused {
+			for _, child := range r.children {
+				childIter, err := child.Iterator(tid)
+				if err != nil {
+					return nil, err
+				}
+				seen := make(map[any]bool)
+				rank := 0
+				for t, err := childIter(); t != nil || err != nil; t, err = childIter() {
+					if err != nil {
+						return nil, err
+					}
+					key := r.rrfKey(t)
+					if seen[key] {
+						continue
+					}
+					seen[key] = true
+					rank++
+					if _, ok := tuples[key]; !ok {
+						// children may reuse the tuple they return, so keep a copy
+						tc := *t
+						tuples[key] = &tc
+						keys = append(keys, key)
+					}
+					scores[key] += 1.0 / float64(r.k+rank)
+				}
+			}
+			// stable, so ties keep the order in which tuples were first seen
+			sort.SliceStable(keys, func(a, b int) bool {
+				return scores[keys[a]] > scores[keys[b]]
+			})
+			fused = true
+		}
+		if i >= len(keys) {
+			return nil, nil
+		}
+		key := keys[i]
+		i++
+		t := tuples[key]
+		fields := make([]DBValue, len(t.Fields), len(t.Fields)+1)
+		copy(fields, t.Fields)
+		fields = append(fields, IntField{int64(scores[key] * 1e6)})
+		return &Tuple{Desc: *desc, Fields: fields, Rid: t.Rid}, nil
+	}, nil
+}
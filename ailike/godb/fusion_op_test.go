@@ -0,0 +1,108 @@
+package godb
+
+import (
+	"testing"
+)
+
+// Checks that RRFusion combines the ranks of its children, using three tuples
+// ranked in opposite orders by two children.
+func TestRRFusion(t *testing.T) {
+	td, t1, t2, hf, bp, tid := makeTestVars()
+	t3 := Tuple{Desc: td, Fields: []DBValue{StringField{"alice"}, IntField{1}}}
+	tuples := []Tuple{t1, t2, t3}
+	for i := range tuples {
+		if err := hf.insertTuple(&tuples[i], tid); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	tid.Commit()
+	tid = bp.Transactions().Begin()
+
+	age := &FieldExpr{td.Fields[1]}
+	// george jones, sam, alice
+	byAgeDesc, _ := NewOrderBy([]Expr{age}, hf, []bool{false})
+	// alice, sam
+	byAgeAsc, _ := NewOrderBy([]Expr{age}, hf, []bool{true})
+	two := &ConstExpr{IntField{2}, IntType}
+	rrf, err := NewRRFusion([]Operator{byAgeDesc, NewLimitOp(two, byAgeAsc)}, RRFK)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(rrf.Descriptor().Fields) != 3 || rrf.Descriptor().Fields[2].Fname != "rrf" {
+		t.Fatalf("expected rrf field to be appended to descriptor")
+	}
+
+	iter, err := rrf.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// alice: 1/(k+3) + 1/(k+1), sam: 1/(k+2) + 1/(k+2), george jones: 1/(k+1)
+	expected := []string{"alice", "sam", "george jones"}
+	k := float64(RRFK)
+	expectedScores := []int64{int64((1/(k+3) + 1/(k+1)) * 1e6), int64((1/(k+2) + 1/(k+2)) * 1e6), int64(1 / (k + 1) * 1e6)}
+	i := 0
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if i >= len(expected) {
+			t.Fatalf("too many results")
+		}
+		if tup.Fields[0].(StringField).Value != expected[i] {
+			t.Errorf("expected %s at rank %d, got %s", expected[i], i+1, tup.Fields[0].(StringField).Value)
+		}
+		if tup.Fields[2].(IntField).Value != expectedScores[i] {
+			t.Errorf("expected score %d at rank %d, got %d", expectedScores[i], i+1, tup.Fields[2].(IntField).Value)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Errorf("expected %d results, got %d", len(expected), i)
+	}
+	tid.Commit()
+}
+
+func TestRRFusionMismatchedChildren(t *testing.T) {
+	_, _, _, hf, _, _ := makeTestVars()
+	_, _, _, hf2, _, _ := makeTextTestVars()
+	_, err := NewRRFusion([]Operator{hf, hf2}, RRFK)
+	if err == nil {
+		t.Errorf("expected error when fusing inputs with different descriptors")
+	}
+}
+
+func TestRRFParse(t *testing.T) {
+	c, _, bp := makeTextIndexTestVars(t)
+
+	sql := "select tweet_id, rrf(bm25(content, 'friday'), match(content) against('sad')) fused from tweets_test order by fused desc limit 5"
+	_, plan, err := Parse(c, sql)
+	if err != nil {
+		t.Fatalf("failed to parse, q=%s, %s", sql, err.Error())
+	}
+
+	tid := bp.Transactions().Begin()
+	iter, err := plan.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var last int64 = -1
+	cnt := 0
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if len(tup.Fields) != 2 {
+			t.Fatalf("expected 2 output fields, got %d", len(tup.Fields))
+		}
+		score := tup.Fields[1].(IntField).Value
+		if score <= 0 || (last != -1 && score > last) {
+			t.Errorf("expected positive scores in descending order, got %d after %d", score, last)
+		}
+		last = score
+		cnt++
+	}
+	tid.Commit()
+	if cnt == 0 {
+		t.Errorf("expected fused results")
+	}
+}
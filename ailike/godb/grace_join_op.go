@@ -0,0 +1,174 @@
+package godb
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+)
+
+// GraceHashJoin joins inputs that are too large to hash in memory.  Both inputs
+// are first partitioned into temporary files by a hash of their join keys, so
+// that records that join are in partitions with the same number, and then each
+// pair of partitions is joined by an [EqualityJoin] that hashes one of them.
+// With enough partitions that each fits in maxBufferSize records, each input is
+// read once, and written and read once more.
+type GraceHashJoin struct {
+	// Expressions that when applied to tuples from the left or right operators,
+	// respectively, return the values of the keys of the join
+	leftFields, rightFields []Expr
+
+	left, right Operator
+
+	joinType JoinType
+
+	numPartitions int
+
+	// The number of records of a partition that are hashed at a time
+	maxBufferSize int
+
+	// The buffer pool through which the partitions are written and read
+	bufPool *BufferPool
+}
+
+// Constructor for a grace hash join of the given type, on the equality of each
+// of leftFields to the corresponding expression of rightFields.  The inputs are
+// split into numPartitions partitions, which are written to temporary files
+// through bp.
+func NewGraceHashJoin(left Operator, leftFields []Expr, right Operator, rightFields []Expr, joinType JoinType, numPartitions int, maxBufferSize int, bp *BufferPool) (*GraceHashJoin, error) {
+	if left == nil || right == nil {
+		return nil, ailikeError{MalformedDataError, "NewGraceHashJoin left or right pointer is nil."}
+	}
+	if err := checkJoinKeys(leftFields, rightFields); err != nil {
+		return nil, err
+	}
+	if joinType.filtersLeft() {
+		return nil, ailikeError{IllegalOperationError, "semi and anti joins are only supported by hash joins"}
+	}
+	if numPartitions < 1 || bp == nil {
+		return nil, ailikeError{MalformedDataError, "a grace hash join needs at least one partition and a buffer pool"}
+	}
+	if !canSpill(left.Descriptor()) || !canSpill(right.Descriptor()) {
+		return nil, ailikeError{TypeMismatchError, "the inputs of a grace hash join cannot be written to temporary files"}
+	}
+	return &GraceHashJoin{leftFields, rightFields, left, right, joinType, numPartitions, maxBufferSize, bp}, nil
+}
+
+func (j *GraceHashJoin) Descriptor() *TupleDesc {
+	return j.left.Descriptor().merge(j.right.Descriptor())
+}
+
+// Returns the partition of a record whose join key has the given value.  Records
+// whose key is NULL match nothing, so they are all in the first partition.
+func partitionOf(key DBValue, numPartitions int) int {
+	h := fnv.New64a()
+	switch v := key.(type) {
+	case nil:
+		return 0
+	case IntField:
+		binary.Write(h, binary.LittleEndian, v.Value)
+	case StringField:
+		h.Write([]byte(v.Value))
+	}
+	return int(h.Sum64() % uint64(numPartitions))
+}
+
+// Writes the records of op to a temporary file per partition, by the hash of key.
+func (j *GraceHashJoin) partition(op Operator, key Expr, tid *Transaction) ([]*tempFile, error) {
+	parts := make([]*tempFile, 0, j.numPartitions)
+	for i := 0; i < j.numPartitions; i++ {
+		part, err := newTempFile(op.Descriptor(), j.bufPool, "godb_join_partition_*.dat", tid)
+		if err != nil {
+			removeTempFiles(parts)
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	iter, err := op.Iterator(tid)
+	if err != nil {
+		removeTempFiles(parts)
+		return nil, err
+	}
+	for t, err := iter(); t != nil || err != nil; t, err = iter() {
+		var v DBValue
+		if err == nil {
+			v, err = key.EvalExpr(t)
+		}
+		if err == nil {
+			err = parts[partitionOf(v, j.numPartitions)].append(t, tid)
+		}
+		if err != nil {
+			removeTempFiles(parts)
+			return nil, err
+		}
+	}
+	for _, part := range parts {
+		if err := part.finish(); err != nil {
+			removeTempFiles(parts)
+			return nil, err
+		}
+	}
+	tid.counters.joinPartitions.Add(int64(len(parts)))
+	return parts, nil
+}
+
+// Join operator implementation.  Both inputs are partitioned on the first
+// invocation of the iterator function, and then the pairs of partitions are
+// joined in turn; the files of each pair are deleted once they have been joined.
+func (j *GraceHashJoin) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
+	leftKey, rightKey := joinKeyExpr(j.leftFields), joinKeyExpr(j.rightFields)
+	var (
+		leftParts, rightParts []*tempFile
+		partIter              func() (*Tuple, error) // the join of the current pair of partitions
+		p                     = -1                   // the number of the current pair
+	)
+	// deletes the partitions that have not been joined yet
+	cleanUp := func() {
+		if p < len(leftParts) {
+			removeTempFiles(leftParts[max(p, 0):])
+			removeTempFiles(rightParts[max(p, 0):])
+		}
+	}
+	return func() (*Tuple, error) {
+		if leftParts == nil {
+			var err error
+			leftParts, err = j.partition(j.left, leftKey, tid)
+			if err != nil {
+				return nil, err
+			}
+			rightParts, err = j.partition(j.right, rightKey, tid)
+			if err != nil {
+				removeTempFiles(leftParts)
+				leftParts = nil
+				return nil, err
+			}
+		}
+		for p < len(leftParts) {
+			if partIter != nil {
+				t, err := partIter()
+				if err != nil {
+					cleanUp()
+					return nil, err
+				}
+				if t != nil {
+					return t, nil
+				}
+				if err := removeTempFiles([]*tempFile{leftParts[p], rightParts[p]}); err != nil {
+					return nil, err
+				}
+				partIter = nil
+			}
+			p++
+			if p == len(leftParts) {
+				break
+			}
+			join, err := NewEqualityJoin(leftParts[p], leftKey, rightParts[p], rightKey, j.joinType, j.maxBufferSize)
+			if err == nil {
+				partIter, err = join.Iterator(tid)
+			}
+			if err != nil {
+				cleanUp()
+				return nil, err
+			}
+		}
+		return nil, nil
+	}, nil
+}
@@ -28,6 +28,20 @@ type HeapFile struct {
 	pageFull *sync.Map
 	// maps column names to indexes that exist for that column; we currently assume at most one index per column
 	indexes map[string]*NNIndexFile
+	// maps column names to the inverted text indexes that exist for that column
+	textIndexes map[string]*TextIndexFile
+	// statistics collected by ANALYZE, or nil if the table has not been analyzed
+	stats *TableStats
+	// true if changes to the file are not logged, as for temporary files
+	unlogged bool
+	// true if the file stores an index, whose pages are counted as index pages
+	// when they are read
+	indexFile bool
+	// true if new pages are written without versions, as for temporary files,
+	// which only the operator that writes them reads
+	unversioned bool
+	// held while a page is appended to the file
+	growLatch *sync.Mutex
 }
 
 // Create a HeapFile.
@@ -43,6 +57,11 @@ func NewHeapFile(fromFile string, td *TupleDesc, bp *BufferPool) (*HeapFile, err
 
 func NewHeapFileIndex(fromFile string, td *TupleDesc, bp *BufferPool, indexes map[string]*NNIndexFile) (*HeapFile, error) {
 	var pageFull sync.Map
+	// a handle the file manager has open may be to a file since removed or
+	// replaced
+	if err := sharedFiles.forget(fromFile); err != nil {
+		return nil, err
+	}
 	_, err := os.Stat(fromFile)
 	if os.IsNotExist(err) {
 		file, err := os.Create(fromFile)
@@ -53,7 +72,30 @@ func NewHeapFileIndex(fromFile string, td *TupleDesc, bp *BufferPool, indexes ma
 	} else if err != nil {
 		return nil, ailikeError{OSError, err.Error()}
 	}
-	return &HeapFile{fileName: fromFile, desc: *td.copy(), bufPool: bp, pageFull: &pageFull, indexes: indexes}, nil
+	hf := &HeapFile{fileName: fromFile, desc: *td.copy(), bufPool: bp, pageFull: &pageFull, indexes: indexes,
+		textIndexes: make(map[string]*TextIndexFile), growLatch: &sync.Mutex{}}
+	if err := hf.advancePastStamps(); err != nil {
+		return nil, err
+	}
+	return hf, nil
+}
+
+// Makes the ids of the transactions that begin from now on larger than those
+// stamped on the pages of the file, which may have been written by an earlier
+// run of the database whose log is not replayed, so that its tuples are in
+// their snapshots.  The pages are only read the first time the file is opened.
+func (f *HeapFile) advancePastStamps() error {
+	return sharedFiles.scanOnce(f.fileName, func() error {
+		image := make([]byte, PageSize)
+		for pageNo := 0; pageNo < f.NumPages(); pageNo++ {
+			n, err := sharedFiles.readAt(f.fileName, image, int64(pageNo*PageSize))
+			if err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+			advanceTransactionIds(largestStamp(image[:n], f.desc.sizeInBytes()))
+		}
+		return nil
+	})
 }
 
 // Return the number of bytes in file
@@ -86,17 +128,15 @@ func (f *HeapFile) ApproximateNumTuples() int {
 	return n_tuples_per_page * f.NumPages()
 }
 
-// Return the number of tuples in the heap file
-func (f *HeapFile) NumTuples(tid TransactionID) int {
+// Return the number of tuples in the heap file that are visible to tid
+func (f *HeapFile) NumTuples(tid *Transaction) int {
 	var numTuples int = 0
 	for pageNo := 0; pageNo < f.NumPages(); pageNo++ {
-		hp, err := f.getHeapPage(pageNo, tid, ReadPerm)
+		tuples, err := f.visibleTuples(pageNo, tid)
 		if err != nil {
 			return -1
 		}
-		pageTuples := int(hp.numSlots - hp.numOpenSlots)
-		numTuples += pageTuples
-		// fmt.Println("Page: ", pageNo, "Tuples: ", pageTuples)
+		numTuples += len(tuples)
 	}
 
 	return numTuples
@@ -106,6 +146,7 @@ func (f *HeapFile) NumTuples(tid TransactionID) int {
 // - hasHeader:  whether or not the CSV file has a header
 // - sep: the character to use to separate fields
 // - skipLastField: if true, the final field is skipped (some TPC datasets include a trailing separator on each line)
+// Fields missing from the end of a line, and empty int fields, are loaded as NULL.
 // Returns an error if the field cannot be opened or if a line is malformed
 // We provide the implementation of this method, but it won't work until
 // [HeapFile.insertTuple] is implemented
@@ -124,17 +165,21 @@ func (f *HeapFile) LoadFromCSV(file *os.File, hasHeader bool, sep string, skipLa
 		}
 		numFields := len(fields)
 		cnt++
-		if numFields != len(desc.Fields) {
+		if numFields > len(desc.Fields) {
 			return ailikeError{MalformedDataError, fmt.Sprintf("LoadFromCSV:  line %d (%s) does not have expected number of fields (expected %d, got %d)", cnt, line, len(f.Descriptor().Fields), numFields)}
 		}
 		if cnt == 1 && hasHeader {
 			continue
 		}
-		var newFields []DBValue
+		newFields := make([]DBValue, 0, len(desc.Fields))
 		for fno, field := range fields {
 			switch f.Descriptor().Fields[fno].Ftype {
 			case IntType:
 				field = strings.TrimSpace(field)
+				if field == "" {
+					newFields = append(newFields, nil)
+					continue
+				}
 				floatVal, err := strconv.ParseFloat(field, 64)
 				if err != nil {
 					return ailikeError{TypeMismatchError, fmt.Sprintf("LoadFromCSV: couldn't convert value %s to int, tuple %d", field, cnt)}
@@ -155,10 +200,12 @@ func (f *HeapFile) LoadFromCSV(file *os.File, hasHeader bool, sep string, skipLa
 				return ailikeError{code: IncompatibleTypesError, errString: "(LoadFromCSV): Unknown type."}
 			}
 		}
+		for len(newFields) < len(desc.Fields) {
+			newFields = append(newFields, nil)
+		}
 		newT := Tuple{*f.Descriptor(), newFields, nil}
-		tid := NewTID()
 		bp := f.bufPool
-		bp.BeginTransaction(tid)
+		tid := bp.Transactions().Begin()
 		f.insertTuple(&newT, tid)
 
 		// hack to force dirty pages to disk
@@ -178,7 +225,7 @@ func (f *HeapFile) LoadFromCSV(file *os.File, hasHeader bool, sep string, skipLa
 
 		//commit frequently, to avoid all pages in BP being full
 		//todo fix
-		bp.CommitTransaction(tid)
+		tid.Commit()
 	}
 	return nil
 }
@@ -187,49 +234,115 @@ func (f *HeapFile) LoadFromCSV(file *os.File, hasHeader bool, sep string, skipLa
 // called by the [BufferPool.GetPage] method when it cannot find the page in its
 // cache.
 //
-// This method will need to open the file supplied to the constructor, seek to the
-// appropriate offset, read the bytes in, and construct a [heapPage] object, using
-// the [heapPage.initFromBuffer] method.
+// The page is read at its offset through the shared [FileManager], which keeps
+// the file open, and a [heapPage] object is constructed from it, using the
+// [heapPage.initFromBuffer] method.
 func (f *HeapFile) readPage(pageNo int) (*Page, error) {
-	if pageNo >= f.NumPages() {
+	pageBytes := make([]byte, PageSize)
+	n, err := sharedFiles.readAt(f.fileName, pageBytes, int64(pageNo*PageSize))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	// pages past the end of the file do not exist
+	if n == 0 {
 		return nil, ailikeError{IllegalOperationError, "Cannot read non-existant page."}
 	}
+	return f.pageFromImage(pageNo, pageBytes[0:n])
+}
 
-	pageBytes := make([]byte, PageSize)
-	filePointer, err := os.OpenFile(f.fileName, os.O_RDWR, os.ModePerm)
+// Constructs page pageNo of the file from its image, as written by
+// [heapPage.toBuffer].
+func (f *HeapFile) pageFromImage(pageNo int, image []byte) (*Page, error) {
+	hp := &heapPage{pageNo: pageNo, filePointer: f}
+	if err := hp.initFromBuffer(bytes.NewBuffer(image)); err != nil {
+		return nil, err
+	}
+	f.pageFull.Store(pageNo, hp.getNumOpenSlots() == 0)
+	var p Page = hp
+	return &p, nil
+}
+
+// Returns the page locked with the given permission.  Like the pages returned
+// by the other methods that retrieve pages for the file to use, it is pinned,
+// and the caller unpins it with [HeapFile.unpin] once it is done with it.
+func (f *HeapFile) getHeapPage(pageNo int, tid *Transaction, perm RWPerm) (*heapPage, error) {
+	p, err := f.bufPool.getPinnedPage(f, pageNo, tid, perm)
 	if err != nil {
 		return nil, err
 	}
-	n, err := filePointer.ReadAt(pageBytes, int64(pageNo*PageSize))
-	if err != nil && !errors.Is(err, io.EOF) {
+	hp := (*p).(*heapPage)
+	return hp, nil
+}
+
+// Unpins a page the file retrieved, so that the buffer pool can evict it.
+func (f *HeapFile) unpin(hp *heapPage) {
+	f.bufPool.unpinPage(f.pageKey(hp.pageNo))
+}
+
+// Returns the page for tid to read the tuples in its snapshot from.  Pages
+// with versions are not locked; pages written before versions are locked with
+// the given permission, as their tuples cannot be told apart from those of
+// transactions that have not committed.
+func (f *HeapFile) getSnapshotPage(pageNo int, tid *Transaction, perm RWPerm) (*heapPage, error) {
+	p, err := f.bufPool.getSnapshotPage(f, pageNo, tid)
+	if err != nil {
 		return nil, err
 	}
-	err = filePointer.Close()
+	hp := (*p).(*heapPage)
+	if hp.versioned {
+		return hp, nil
+	}
+	f.unpin(hp)
+	return f.getHeapPage(pageNo, tid, perm)
+}
+
+// Returns the page for tid to insert tuples into.  Pages with versions are
+// locked with an intention lock, so that other transactions can insert into
+// them too, and tid locks the records it inserts; pages without are locked
+// exclusively.
+func (f *HeapFile) getInsertPage(pageNo int, tid *Transaction) (*heapPage, error) {
+	p, err := f.bufPool.getInsertPage(f, pageNo, tid)
 	if err != nil {
 		return nil, err
 	}
-	hp := newHeapPage(f.Descriptor(), pageNo, f)
-	buf := bytes.NewBuffer(pageBytes[0:n])
-	if err := hp.initFromBuffer(buf); err != nil {
+	hp := (*p).(*heapPage)
+	if hp.versioned {
+		return hp, nil
+	}
+	f.unpin(hp)
+	return f.getHeapPage(pageNo, tid, WritePerm)
+}
+
+// Returns the page of the record with the given rid for tid to write it.
+// Pages with versions are locked with an intention lock and the record with an
+// exclusive one, so that other transactions can write the other records of
+// the page; pages without are locked exclusively.
+func (f *HeapFile) getRecordPage(rid heapRecordId, tid *Transaction) (*heapPage, error) {
+	hp, err := f.getSnapshotPage(rid.pageNo, tid, WritePerm)
+	if err != nil || !hp.versioned {
+		return hp, err
+	}
+	f.unpin(hp)
+	p, err := f.bufPool.getRecordPage(f, rid, tid, WritePerm)
+	if err != nil {
 		return nil, err
 	}
-	f.pageFull.Store(pageNo, hp.numOpenSlots == 0)
-	var p Page = hp
-	return &p, nil
+	return (*p).(*heapPage), nil
 }
 
-func (f *HeapFile) getHeapPage(pageNo int, tid TransactionID, perm RWPerm) (*heapPage, error) {
-	p, err := f.bufPool.GetPage(f, pageNo, tid, perm)
+// Returns the tuples of the page that are visible to tid.
+func (f *HeapFile) visibleTuples(pageNo int, tid *Transaction) ([]*Tuple, error) {
+	hp, err := f.getSnapshotPage(pageNo, tid, ReadPerm)
 	if err != nil {
 		return nil, err
 	}
-	hp := (*p).(*heapPage)
-	return hp, nil
+	defer f.unpin(hp)
+	return hp.visibleTuples(tid), nil
 }
 
-// GetPageForInsert finds a page with an available slot for inserting
-// If all pages are full, returns nil pointer.
-func (f *HeapFile) getPageForInsert(tid TransactionID) (*heapPage, error) {
+// GetPageForInsert finds a page with an available slot for inserting t
+// If all pages are full, returns nil pointer.  The page is pinned.
+func (f *HeapFile) getPageForInsert(t *Tuple, tid *Transaction) (*heapPage, error) {
 	for {
 		// Iterate over all pages and check if the cached pages have open slots.
 		for pageNo := f.NumPages(); pageNo >= 0; pageNo-- {
@@ -237,11 +350,12 @@ func (f *HeapFile) getPageForInsert(tid TransactionID) (*heapPage, error) {
 				continue
 			}
 			if f.bufPool.hasPageCached(f, pageNo, tid, WritePerm) {
-				hp, err := f.getHeapPage(pageNo, tid, WritePerm)
+				hp, err := f.getInsertPage(pageNo, tid)
 				if err == nil {
-					if hp.numOpenSlots > 0 {
+					if hp.hasRoomFor(t) {
 						return hp, nil
 					}
+					f.unpin(hp)
 				}
 			}
 		}
@@ -251,47 +365,55 @@ func (f *HeapFile) getPageForInsert(tid TransactionID) (*heapPage, error) {
 			if isFull, loaded := f.pageFull.Load(pageNo); loaded && isFull.(bool) {
 				continue
 			}
-			hp, err := f.getHeapPage(pageNo, tid, WritePerm)
+			hp, err := f.getInsertPage(pageNo, tid)
 			if err == nil {
-				if hp.numOpenSlots > 0 {
+				if hp.hasRoomFor(t) {
 					return hp, nil
 				}
+				f.unpin(hp)
 			}
 		}
 
-		newPageNo := f.NumPages()
-		// It is possible a different thread has already created this page, so we try to get it.
-		// This also gets an exclusive lock on the new page number, preventing another transaction from creating the page.
-		hp, err := f.getHeapPage(newPageNo, tid, WritePerm)
-		if err == nil {
-			if hp.numOpenSlots > 0 {
-				return hp, nil
-			}
-			// page was already full, so we try to get a different page by retrying from beginning
-		} else {
-			// The new page didn't exist, so we create a new page now.
-			np := newHeapPage(f.Descriptor(), newPageNo, f)
-			err = np.flushPage() // flush the empty page to disk to update the page count
-			if err != nil {
-				return nil, err
-			}
-			// get new page from bufPool
-			hp, err := f.getHeapPage(newPageNo, tid, WritePerm)
-			if err != nil {
-				return nil, err
-			}
+		newPageNo, err := f.appendPage()
+		if err != nil {
+			return nil, err
+		}
+		hp, err := f.getInsertPage(newPageNo, tid)
+		if err != nil {
+			return nil, err
+		}
+		if hp.hasRoomFor(t) {
 			return hp, nil
 		}
+		f.unpin(hp)
+		// other transactions filled the new page first, so we retry from the beginning
 	}
 }
 
-func (f *HeapFile) _insertTupleHelper(hp *heapPage, t *Tuple, tid TransactionID) error {
-	rid, err := hp.insertTuple(t)
+// Appends an empty page to the file and returns its page number.  The file
+// grows under a latch rather than a lock on the new page, so that other
+// transactions can insert into the page as soon as it exists.
+func (f *HeapFile) appendPage() (int, error) {
+	f.growLatch.Lock()
+	defer f.growLatch.Unlock()
+	newPageNo := f.NumPages()
+	np := newHeapPage(f.Descriptor(), newPageNo, f)
+	// flush the empty page to disk to update the page count
+	return newPageNo, np.flushPage()
+}
+
+func (f *HeapFile) _insertTupleHelper(hp *heapPage, t *Tuple, tid *Transaction) error {
+	rid, err := hp.insertVersion(t, tid.id)
 	if err != nil {
 		return err
 	}
 	t.Rid = rid
-	f.pageFull.Store(hp.pageNo, hp.numOpenSlots == 0)
+	f.pageFull.Store(hp.pageNo, hp.getNumOpenSlots() == 0)
+	if hp.versioned {
+		if err := f.bufPool.lockRecord(tid, rid.(heapRecordId), WritePerm); err != nil {
+			return err
+		}
+	}
 
 	// Insert tuple into all associated secondary indexes
 	for _, index := range f.indexes {
@@ -303,6 +425,17 @@ func (f *HeapFile) _insertTupleHelper(hp *heapPage, t *Tuple, tid TransactionID)
 			return err
 		}
 	}
+	return f.insertIntoTextIndexes(t, tid)
+}
+
+// Insert tuple into all associated text indexes; t.Rid must already be set.
+func (f *HeapFile) insertIntoTextIndexes(t *Tuple, tid *Transaction) error {
+	for _, index := range f.textIndexes {
+		err := index.insertTuple(t, tid)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -318,94 +451,118 @@ func (f *HeapFile) _insertTupleHelper(hp *heapPage, t *Tuple, tid TransactionID)
 // rather than directly reading pages itself. For lab 1, you do not need to
 // worry about concurrent transactions modifying the Page or HeapFile.  We will
 // add support for concurrent modifications in lab 3.
-func (f *HeapFile) insertTuple(t *Tuple, tid TransactionID) error {
+func (f *HeapFile) insertTuple(t *Tuple, tid *Transaction) error {
 	// Create embedding for every embedded string field; note we do not call
 	// this method in insertTupleIntoPage or insertTupleIntoNewPage because
 	// those methods are only called once the embedding has already been
 	// generated; TODO: consider refactoring this to be more explicit about this behavior.
+	// NULL text has no embedding.
 	for i, field := range t.Desc.Fields {
-		if field.Ftype == EmbeddedStringType {
+		if field.Ftype == EmbeddedStringType && t.Fields[i] != nil {
 			EmbeddedStringField := t.Fields[i].(EmbeddedStringField)
+			tid.counters.embeddingCalls.Add(1)
 			embResp, err := generateEmbeddings(EmbeddedStringField.Value)
 			if err != nil {
 				return err
 			}
 			EmbeddedStringField.Emb = embResp.Embedding
+			EmbeddedStringField.norm = normOf(embResp.Embedding)
 			t.Fields[i] = EmbeddedStringField
 		}
 	}
+	return f.insertEmbeddedTuple(t, tid)
+}
 
+// Returns the clustered index of the file, or nil if it has none.
+func (f *HeapFile) clusteredIndex() (*NNIndexFile, error) {
 	var clusteredIndex *NNIndexFile = nil
 	for _, index := range f.indexes {
 		if index.clustered {
 			if clusteredIndex != nil {
-				return ailikeError{IncompatibleTypesError, "(insertTuple): Multiple clustered indexes found."}
+				return nil, ailikeError{IncompatibleTypesError, "Multiple clustered indexes found."}
 			}
 			clusteredIndex = index
 		}
 	}
+	return clusteredIndex, nil
+}
+
+// Add a tuple whose embeddings have already been generated to the HeapFile and
+// its indexes.
+func (f *HeapFile) insertEmbeddedTuple(t *Tuple, tid *Transaction) error {
+	clusteredIndex, err := f.clusteredIndex()
+	if err != nil {
+		return err
+	}
 	if clusteredIndex != nil {
-		return clusteredIndex.insertTuple(t, tid)
+		// the clustered index writes the tuple through its own HeapFile, so the
+		// other indexes of this file have to be maintained here
+		err := clusteredIndex.insertTuple(t, tid)
+		if err != nil {
+			return err
+		}
+		for _, index := range f.indexes {
+			if index.clustered {
+				continue
+			}
+			if err := index.insertTuple(t, tid); err != nil {
+				return err
+			}
+		}
+		return f.insertIntoTextIndexes(t, tid)
 	}
-	hp, err := f.getPageForInsert(tid)
-	if err != nil {
+	for {
+		hp, err := f.getPageForInsert(t, tid)
+		if err != nil {
+			return err
+		}
+		err = f._insertTupleHelper(hp, t, tid)
+		f.unpin(hp)
+		if e, ok := err.(ailikeError); ok && e.code == PageFullError {
+			// another transaction inserting into the page filled it first
+			continue
+		}
 		return err
 	}
-	return f._insertTupleHelper(hp, t, tid)
 }
 
 // Add the tuple to the HeapFile to a specific page. If that page is full,
 // returns an error.
-func (f *HeapFile) insertTupleIntoPage(t *Tuple, pageNo int, tid TransactionID) error {
-	hp, err := f.getHeapPage(pageNo, tid, WritePerm)
+func (f *HeapFile) insertTupleIntoPage(t *Tuple, pageNo int, tid *Transaction) error {
+	hp, err := f.getInsertPage(pageNo, tid)
 	if err != nil {
 		return err
 	}
-	if hp.numOpenSlots <= 0 {
+	defer f.unpin(hp)
+	if !hp.hasRoomFor(t) {
 		return ailikeError{PageFullError, "Cannot insert into full page."}
 	}
 	return f._insertTupleHelper(hp, t, tid)
 }
 
 // Makes a new heap page and returns it's page number, a pointer to the page, and an error.
-func (f *HeapFile) makeNewPage(tid TransactionID) (*heapPage, int, error) {
-	var np *heapPage = nil
-	var newPageNo int = -1
-	for np == nil {
-		newPageNo = f.NumPages()
-
-		// It is possible a different thread has already created this page, so we try to get it.
-		// This also gets an exclusive lock on the new page number, preventing another transaction from creating the page.
-		// If this does not fail; that means another transaction already created the page, so we need
-		// to try and create another one.
-		_, err := f.getHeapPage(newPageNo, tid, WritePerm)
-		if err == nil {
-			continue
-		} else {
-			// The new page didn't exist, so we create a new page now.
-			hp := newHeapPage(f.Descriptor(), newPageNo, f)
-			err = hp.flushPage() // flush the empty page to disk to update the page count
-			if err != nil {
-				return nil, -1, err
-			}
-			// get new page from bufPool
-			np, err = f.getHeapPage(newPageNo, tid, WritePerm)
-			if err != nil {
-				return nil, -1, err
-			}
-		}
+// The page is pinned.
+func (f *HeapFile) makeNewPage(tid *Transaction) (*heapPage, int, error) {
+	newPageNo, err := f.appendPage()
+	if err != nil {
+		return nil, -1, err
+	}
+	np, err := f.getInsertPage(newPageNo, tid)
+	if err != nil {
+		return nil, -1, err
 	}
 	return np, newPageNo, nil
 }
 
 // Add the tuple to the HeapFile to a new page. Returns the page number of the
 // new page.
-func (f *HeapFile) insertTupleIntoNewPage(t *Tuple, tid TransactionID) (int, error) {
+func (f *HeapFile) insertTupleIntoNewPage(t *Tuple, tid *Transaction) (int, error) {
 	np, newPageNo, err := f.makeNewPage(tid)
 	if err != nil {
 		return -1, err
 	}
-	if np.numOpenSlots <= 0 {
+	defer f.unpin(np)
+	if !np.hasRoomFor(t) {
 		return -1, ailikeError{PageFullError, "Cannot insert into full page."}
 	}
 	err = f._insertTupleHelper(np, t, tid)
@@ -415,16 +572,17 @@ func (f *HeapFile) insertTupleIntoNewPage(t *Tuple, tid TransactionID) (int, err
 	return newPageNo, nil
 }
 
-// Finds the tuple with the given rid and returns it.
-func (f *HeapFile) findTuple(rid heapRecordId, tid TransactionID) (*Tuple, error) {
+// Finds the tuple with the given rid and returns it, if it is visible to tid.
+func (f *HeapFile) findTuple(rid heapRecordId, tid *Transaction) (*Tuple, error) {
 	if rid.fileName != f.fileName {
 		return nil, ailikeError{TupleNotFoundError, "Tuple does not exist within this file."}
 	}
-	hp, err := f.getHeapPage(rid.pageNo, tid, WritePerm)
+	hp, err := f.getSnapshotPage(rid.pageNo, tid, WritePerm)
 	if err != nil {
 		return nil, err
 	}
-	return hp.findTuple(rid)
+	defer f.unpin(hp)
+	return hp.findVisibleTuple(rid, tid)
 }
 
 // Remove the provided tuple from the HeapFile.  This method should use the
@@ -434,20 +592,34 @@ func (f *HeapFile) findTuple(rid heapRecordId, tid TransactionID) (*Tuple, error
 // for tuples as they are read via [Iterator].  Note that Rid is an empty interface,
 // so you can supply any object you wish.  You will likely want to identify the
 // heap page and slot within the page that the tuple came from.
-func (f *HeapFile) deleteTuple(t *Tuple, tid TransactionID) error {
+//
+// On pages with versions, the version is stamped as deleted by tid rather than
+// removed, since transactions with earlier snapshots may still read it.  If
+// another transaction has changed the record since tid's snapshot, a
+// WriteConflictError is returned, and tid is aborted if ABORT_TRANSACTIONS is
+// set.
+func (f *HeapFile) deleteTuple(t *Tuple, tid *Transaction) error {
 	rid := t.Rid.(heapRecordId)
 	if rid.fileName != f.fileName {
 		return ailikeError{TupleNotFoundError, "Tuple does not exist within this file."}
 	}
-	hp, err := f.getHeapPage(rid.pageNo, tid, WritePerm)
+	hp, err := f.getRecordPage(rid, tid)
 	if err != nil {
 		return err
 	}
-	err = hp.deleteTuple(rid)
+	defer f.unpin(hp)
+	if hp.versioned {
+		err = hp.deleteVersion(rid, tid)
+		if e, ok := err.(ailikeError); ok && e.code == WriteConflictError && ABORT_TRANSACTIONS {
+			tid.Abort()
+		}
+	} else {
+		err = hp.deleteTuple(rid)
+		f.pageFull.Store(hp.pageNo, false)
+	}
 	if err != nil {
 		return err
 	}
-	f.pageFull.Store(hp.pageNo, false)
 
 	for _, index := range f.indexes {
 		err = index.deleteTuple(t, tid)
@@ -455,6 +627,108 @@ func (f *HeapFile) deleteTuple(t *Tuple, tid TransactionID) error {
 			return err
 		}
 	}
+	for _, index := range f.textIndexes {
+		err = index.deleteTuple(t, tid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replace the record old with updated, which has the same descriptor.  The
+// embedding of each embedded string whose text changed is regenerated, and
+// the indexes on changed columns are updated.  On pages with versions, old is
+// deleted and updated inserted as a new version, so that transactions with
+// earlier snapshots still read old.  On pages without, the record is rewritten
+// in place, unless its clustered index column changed, in which case it moves
+// to the cluster closest to its new embedding; updated.Rid is set to where it
+// is stored.  Like inserts and deletes, the records involved, or their pages
+// if they have no versions, are locked for writing until the transaction
+// completes.
+func (f *HeapFile) updateTuple(old *Tuple, updated *Tuple, tid *Transaction) error {
+	rid, ok := old.Rid.(heapRecordId)
+	if !ok || rid.fileName != f.fileName {
+		return ailikeError{TupleNotFoundError, "Tuple does not exist within this file."}
+	}
+	if len(old.Fields) != len(updated.Fields) {
+		return ailikeError{TypeMismatchError, "Updated tuple does not match the table."}
+	}
+	changed := make(map[string]bool)
+	for i, field := range old.Desc.Fields {
+		switch newVal := updated.Fields[i].(type) {
+		case EmbeddedStringField:
+			oldVal, wasSet := old.Fields[i].(EmbeddedStringField)
+			if wasSet && newVal.Value == oldVal.Value {
+				newVal.Emb, newVal.norm = oldVal.Emb, oldVal.norm
+			} else {
+				tid.counters.embeddingCalls.Add(1)
+				embResp, err := generateEmbeddings(newVal.Value)
+				if err != nil {
+					return err
+				}
+				newVal.Emb, newVal.norm = embResp.Embedding, normOf(embResp.Embedding)
+				changed[field.Fname] = true
+			}
+			updated.Fields[i] = newVal
+		case VectorField:
+			// vectors hold slices, so they cannot be compared with !=
+			oldVal, wasSet := old.Fields[i].(VectorField)
+			changed[field.Fname] = !wasSet || !equal(&newVal.Emb, &oldVal.Emb)
+		default:
+			changed[field.Fname] = updated.Fields[i] != old.Fields[i]
+		}
+	}
+
+	clusteredIndex, err := f.clusteredIndex()
+	if err != nil {
+		return err
+	}
+	if clusteredIndex != nil && changed[clusteredIndex.indexedColName] {
+		if err := f.deleteTuple(old, tid); err != nil {
+			return err
+		}
+		return f.insertEmbeddedTuple(updated, tid)
+	}
+
+	hp, err := f.getRecordPage(rid, tid)
+	if err != nil {
+		return err
+	}
+	defer f.unpin(hp)
+	if hp.versioned || (!hp.nullBitmaps && updated.hasNulls()) {
+		// a new version is written, or the page predates null bitmaps, so the
+		// record moves to one that has them
+		if err := f.deleteTuple(old, tid); err != nil {
+			return err
+		}
+		return f.insertEmbeddedTuple(updated, tid)
+	}
+	if err := hp.updateTuple(rid, updated); err != nil {
+		return err
+	}
+	for col, index := range f.indexes {
+		if index.clustered || !changed[col] {
+			continue
+		}
+		if err := index.deleteTuple(old, tid); err != nil {
+			return err
+		}
+		if err := index.insertTuple(updated, tid); err != nil {
+			return err
+		}
+	}
+	for col, index := range f.textIndexes {
+		if !changed[col] {
+			continue
+		}
+		if err := index.deleteTuple(old, tid); err != nil {
+			return err
+		}
+		if err := index.insertTuple(updated, tid); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -470,15 +744,7 @@ func (f *HeapFile) flushPage(p *Page) error {
 		return err
 	}
 	b := pageBuf.Bytes()
-	filePointer, err := os.OpenFile(f.fileName, os.O_RDWR, os.ModePerm)
-	if err != nil {
-		return err
-	}
-	_, err = filePointer.WriteAt(b, int64(hp.pageNo*PageSize))
-	if err != nil {
-		return err
-	}
-	err = filePointer.Close()
+	_, err = sharedFiles.writeAt(f.fileName, b, int64(hp.pageNo*PageSize))
 	if err != nil {
 		return err
 	}
@@ -500,34 +766,66 @@ func (f *HeapFile) Descriptor() *TupleDesc {
 // transactions
 // You should esnure that Tuples returned by this method have their Rid object
 // set appropriate so that [deleteTuple] will work (see additional comments there).
-func (f *HeapFile) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
-	var pageNo int = 0
-	var tupleIter func() (*Tuple, error) = func() (*Tuple, error) {
-		return nil, nil
+func (f *HeapFile) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
+	return f.pageRangeIterator(tid, 0, -1)
+}
+
+// Returns a function that iterates through the records of pages from up to, but
+// not including, to, or through the end of the file if to is negative, as it is
+// when the iterator is called, so that pages appended during the scan are read.
+func (f *HeapFile) pageRangeIterator(tid *Transaction, from int, to int) (func() (*Tuple, error), error) {
+	batches, err := f.pageRangeBatches(tid, from, to)
+	if err != nil {
+		return nil, err
 	}
-	return func() (*Tuple, error) {
-		var t *Tuple
-		t, err := tupleIter()
-		if err != nil {
-			return nil, err
+	return unbatch(batches), nil
+}
+
+// Like [HeapFile.pageRangeIterator], but returns the records of each page as a
+// block, skipping pages with none.
+func (f *HeapFile) pageRangeBatches(tid *Transaction, from int, to int) (func() ([]*Tuple, error), error) {
+	var pageNo int = from
+	end := func() int {
+		if to < 0 {
+			return f.NumPages()
 		}
-		for t == nil && pageNo < f.NumPages() {
-			// Try to get the tuple iter for the next page and return that tuple
-			hp, err := f.getHeapPage(pageNo, tid, ReadPerm)
+		return to
+	}
+	distance := f.bufPool.prefetchDistance()
+	prefetchedTo := from + 1 // the first page is read as it is needed
+	return func() ([]*Tuple, error) {
+		for pageNo < end() {
+			// the pages after this one are read ahead while its tuples are used
+			if ahead := min(pageNo+1+distance, end()); prefetchedTo < ahead {
+				f.prefetch(prefetchedTo, ahead)
+				prefetchedTo = ahead
+			}
+			tuples, err := f.visibleTuples(pageNo, tid)
 			pageNo += 1
 			if err != nil {
 				return nil, err
 			}
-			tupleIter = hp.tupleIter()
-			t, err = tupleIter()
-			if err != nil {
-				return nil, err
+			if len(tuples) > 0 {
+				return tuples, nil
 			}
 		}
-		return t, nil
-
+		return nil, nil
 	}, nil
+}
 
+// Returns the records of the file a page at a time.
+func (f *HeapFile) batchIterator(tid *Transaction) (func() ([]*Tuple, error), error) {
+	return f.pageRangeBatches(tid, 0, -1)
+}
+
+// Asks the buffer pool to read the pages of the file numbered from from up to,
+// but not including, to, ahead of a scan.
+func (f *HeapFile) prefetch(from int, to int) {
+	pageNos := make([]int, 0, to-from)
+	for pageNo := from; pageNo < to; pageNo++ {
+		pageNos = append(pageNos, pageNo)
+	}
+	f.bufPool.prefetchPages(f, pageNos)
 }
 
 // internal strucuture to use as key for a heap page
@@ -1,6 +1,8 @@
 package godb
 
 import (
+	"bytes"
+	"encoding/binary"
 	"math/rand"
 	"os"
 	"testing"
@@ -9,7 +11,7 @@ import (
 const TestingFile string = "test.dat"
 const TestingFile2 string = "test2.dat"
 
-func makeTestVars() (TupleDesc, Tuple, Tuple, *HeapFile, *BufferPool, TransactionID) {
+func makeTestVars() (TupleDesc, Tuple, Tuple, *HeapFile, *BufferPool, *Transaction) {
 	var td = TupleDesc{Fields: []FieldType{
 		{Fname: "name", Ftype: StringType},
 		{Fname: "age", Ftype: IntType},
@@ -37,14 +39,13 @@ func makeTestVars() (TupleDesc, Tuple, Tuple, *HeapFile, *BufferPool, Transactio
 		panic(err)
 	}
 
-	tid := NewTID()
-	bp.BeginTransaction(tid)
+	tid := bp.Transactions().Begin()
 
 	return td, t1, t2, hf, bp, tid
 
 }
 
-func makeTextTestVars() (TupleDesc, Tuple, Tuple, *HeapFile, *BufferPool, TransactionID) {
+func makeTextTestVars() (TupleDesc, Tuple, Tuple, *HeapFile, *BufferPool, *Transaction) {
 	var td = TupleDesc{Fields: []FieldType{
 		{Fname: "name", Ftype: StringType},
 		{Fname: "age", Ftype: IntType},
@@ -77,14 +78,13 @@ func makeTextTestVars() (TupleDesc, Tuple, Tuple, *HeapFile, *BufferPool, Transa
 		panic(err)
 	}
 
-	tid := NewTID()
-	bp.BeginTransaction(tid)
+	tid := bp.Transactions().Begin()
 
 	return td, t1, t2, hf, bp, tid
 
 }
 
-func makeVecTestVars() (TupleDesc, Tuple, Tuple, *HeapFile, *BufferPool, TransactionID) {
+func makeVecTestVars() (TupleDesc, Tuple, Tuple, *HeapFile, *BufferPool, *Transaction) {
 	var td = TupleDesc{Fields: []FieldType{
 		{Fname: "name", Ftype: StringType},
 		{Fname: "age", Ftype: IntType},
@@ -124,13 +124,32 @@ func makeVecTestVars() (TupleDesc, Tuple, Tuple, *HeapFile, *BufferPool, Transac
 		panic(err)
 	}
 
-	tid := NewTID()
-	bp.BeginTransaction(tid)
+	tid := bp.Transactions().Begin()
 
 	return td, t1, t2, hf, bp, tid
 
 }
 
+// Inserts the tuples tuple(0), tuple(1), ... into hf until it has numPages
+// pages, and returns the number inserted. Each page is committed as it is
+// added, so that a small buffer pool does not fill with dirty pages.
+func fillPages(t *testing.T, hf *HeapFile, bp *BufferPool, numPages int, tuple func(n int) *Tuple) int {
+	tid := bp.Transactions().Begin()
+	n := 0
+	for pages := 0; pages < numPages; n++ {
+		if err := hf.insertTuple(tuple(n), tid); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if hf.NumPages() > pages {
+			pages = hf.NumPages()
+			tid.Commit()
+			tid = bp.Transactions().Begin()
+		}
+	}
+	tid.Commit()
+	return n
+}
+
 func TestCreateAndInsertHeapFile(t *testing.T) {
 	_, t1, t2, hf, _, tid := makeTestVars()
 	hf.insertTuple(&t1, tid)
@@ -218,8 +237,7 @@ func TestDeleteFromWrongFile(t *testing.T) {
 func testSerializeN(t *testing.T, n int) {
 	td, t1, t2, hf, bp, _ := makeTestVars()
 	for i := 0; i < n; i++ {
-		tid := NewTID()
-		bp.BeginTransaction(tid)
+		tid := bp.Transactions().Begin()
 		err := hf.insertTuple(&t1, tid)
 		if err != nil {
 			t.Errorf(err.Error())
@@ -249,14 +267,13 @@ func testSerializeN(t *testing.T, n int) {
 
 		//commit frequently to prevent buffer pool from filling
 		//todo fix
-		bp.CommitTransaction(tid)
+		tid.Commit()
 
 	}
 	bp.FlushAllPages()
 	bp2 := NewBufferPool(1)
 	hf2, _ := NewHeapFile(TestingFile, &td, bp2)
-	tid := NewTID()
-	bp2.BeginTransaction(tid)
+	tid := bp2.Transactions().Begin()
 	iter, _ := hf2.Iterator(tid)
 	i := 0
 	for {
@@ -339,3 +356,101 @@ func TestHeapFilePageKey(t *testing.T) {
 		}
 	}
 }
+
+func TestLoadCSVWithNulls(t *testing.T) {
+	_, _, _, hf, bp, tid := makeTestVars()
+	tid.Commit()
+	csvFile := t.TempDir() + "/nulls.csv"
+	if err := os.WriteFile(csvFile, []byte("name,age\nsam,25\nbob,\ncarol\n"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	f, err := os.Open(csvFile)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer f.Close()
+	if err := hf.LoadFromCSV(f, true, ",", false); err != nil {
+		t.Fatalf("Load failed, %s", err)
+	}
+
+	tid = bp.Transactions().Begin()
+	defer tid.Commit()
+	iter, _ := hf.Iterator(tid)
+	ages := make(map[string]DBValue)
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		ages[tup.Fields[0].(StringField).Value] = tup.Fields[1]
+	}
+	if len(ages) != 3 || ages["sam"] != (IntField{25}) {
+		t.Fatalf("expected 3 records with sam aged 25, got %v", ages)
+	}
+	if age, ok := ages["bob"]; !ok || age != nil {
+		t.Errorf("expected an empty int field to be NULL, got %v", age)
+	}
+	if age, ok := ages["carol"]; !ok || age != nil {
+		t.Errorf("expected a missing field to be NULL, got %v", age)
+	}
+}
+
+func TestHeapFileNullsOnLegacyPages(t *testing.T) {
+	td, t1, _, hf, bp, tid := makeTestVars()
+	tid.Commit()
+
+	// write a full page in the format used before null bitmaps
+	legacySlots := int32((PageSize - 8) / (td.sizeInBytes() - td.nullBitmapBytes()))
+	legacy := new(bytes.Buffer)
+	binary.Write(legacy, binary.LittleEndian, legacySlots)
+	binary.Write(legacy, binary.LittleEndian, legacySlots-1)
+	t1.writeFieldsTo(legacy)
+	page := make([]byte, PageSize)
+	copy(page, legacy.Bytes())
+	if err := os.WriteFile(TestingFile, page, 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	tid = bp.Transactions().Begin()
+	withNull := Tuple{Desc: td, Fields: []DBValue{StringField{"nobody"}, nil}}
+	if err := hf.insertTuple(&withNull, tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if rid := withNull.Rid.(heapRecordId); rid.pageNo != 1 {
+		t.Errorf("expected the tuple with a NULL to be stored on a new page, got page %d", rid.pageNo)
+	}
+	george := Tuple{Desc: td, Fields: []DBValue{StringField{"george"}, IntField{40}}}
+	if err := hf.insertTuple(&george, tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// updating the legacy record to NULL moves it to a page with null bitmaps
+	iter, _ := hf.Iterator(tid)
+	first, err := iter()
+	if err != nil || first == nil {
+		t.Fatalf("expected to read the legacy record, got %v", err)
+	}
+	updated := &Tuple{Desc: td, Fields: []DBValue{first.Fields[0], nil}}
+	if err := hf.updateTuple(first, updated, tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if rid := updated.Rid.(heapRecordId); rid.pageNo != 1 {
+		t.Errorf("expected the updated record to move to page 1, got page %d", rid.pageNo)
+	}
+	tid.Commit()
+
+	tid = bp.Transactions().Begin()
+	defer tid.Commit()
+	iter, _ = hf.Iterator(tid)
+	nulls, cnt := 0, 0
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup.Fields[1] == nil {
+			nulls++
+		}
+		cnt++
+	}
+	if cnt != 3 || nulls != 2 {
+		t.Errorf("expected 3 records, 2 with NULL ages, got %d and %d", cnt, nulls)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 )
@@ -33,7 +32,7 @@ func ConstructWikiHeapFile(tableName string, bp *BufferPool, resetFile bool, lim
 
 	fileName := tableName + ".dat"
 	if resetFile {
-		os.Remove(fileName)
+		sharedFiles.remove(fileName)
 		hf, err := NewHeapFile(fileName, td, bp)
 		if err != nil {
 			return nil, err
@@ -111,11 +110,10 @@ func (f *HeapFile) LoadFromAPI(portNumber int, limit int, random bool) error {
 		}
 		counter++
 		newT := Tuple{*desc, newFields, nil}
-		tid := NewTID()
 		bp := f.bufPool
-		bp.BeginTransaction(tid)
+		tid := bp.Transactions().Begin()
 		f.insertTuple(&newT, tid)
-		bp.CommitTransaction(tid)
+		tid.Commit()
 		if (counter % 100) == 0 {
 			fmt.Println("Inserted tuple: ", counter)
 		}
@@ -24,7 +24,7 @@ func TestConstructWikiHeapFile(t *testing.T) {
 			t.Fatalf(err.Error())
 		}
 		fmt.Println("Number of tuples in heap file: ", hfile.ApproximateNumTuples())
-		tid := NewTID()
+		tid := bp.Transactions().Begin()
 		hfileIter, err := hfile.Iterator(tid)
 		if err != nil {
 			t.Fatalf(err.Error())
@@ -3,6 +3,9 @@ package godb
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
 )
 
 /* HeapPage implements the Page interface for pages of HeapFiles. We have
@@ -26,11 +29,28 @@ we encode them as byte arrays of StringLength, so they are size
 ((int)(unsafe.Sizeof(byte('a')))) * StringLength bytes.  The size in bytes  of a
 tuple is just the sum of the size in bytes of its fields.
 
+Each tuple is preceded by a null bitmap with one bit per field (see
+[Tuple.writeTo]).  Pages written before tuples could be NULL have no bitmaps;
+pages with bitmaps are marked by setting nullBitmapPageFlag in the number of
+slots written in the header, so that older files can still be read.  Pages
+without bitmaps can only hold tuples without NULLs.
+
+Each tuple is also stamped with the ids of the transactions that created and
+deleted it (see [tupleVersion]), so that a page can hold several versions of a
+record, each visible to the transactions whose snapshots include its creation
+but not its deletion.  On pages with versions, marked by versionedPageFlag in
+the header, every slot is written, with its stamps followed by its tuple, or by
+emptySlotStamp and zeros if it is free, so that tuples keep their slots when
+the page is written out and read again.  Pages written before versions have no
+stamps, nor do the pages of temporary files, which only the operator that
+writes them reads; their tuples are visible to every transaction, and they are
+locked to be read.
+
 Once you have figured out how big a record is, you can determine the number of
 slots on on the page as:
 
 remPageSize = PageSize - 8 // bytes after header
-numSlots = remPageSize / bytesPerTuple //integer division will round down
+numSlots = remPageSize / (bytesPerTuple + versionStampBytes) //integer division will round down
 
 To serialize a page to a buffer, you can then:
 
@@ -59,21 +79,61 @@ type heapPage struct {
 	pageNo       int
 	filePointer  *HeapFile
 	records      []*Tuple
-	dirty        bool
+	versions     []tupleVersion // the stamps of the tuple in each slot
+	dirty        atomic.Bool
+	nullBitmaps  bool // whether the tuples on the page are stored with null bitmaps
+	versioned    bool // whether the tuples on the page are stored with their stamps
+	// guards the records and versions of the page, which transactions reading
+	// a snapshot read without locking the page
+	latch sync.RWMutex
+}
+
+// The stamps of a version of a tuple: the ids of the transactions that created
+// and deleted it.  A creation stamp of zero marks a version that is visible to
+// every transaction, and a deletion stamp of zero one that is not deleted.
+type tupleVersion struct {
+	xmin int64
+	xmax int64
 }
 
+// Set in the number of slots in the header of pages whose tuples have null bitmaps
+const nullBitmapPageFlag int32 = 1 << 30
+
+// Set in the number of slots in the header of pages whose tuples have stamps
+const versionedPageFlag int32 = 1 << 29
+
+// The size of the stamps of a tuple, and the creation stamp written for a free
+// slot
+const versionStampBytes = 16
+const emptySlotStamp int64 = -1
+
 // Construct a new heap page
 func newHeapPage(desc *TupleDesc, pageNo int, f *HeapFile) *heapPage {
 	numSlots, err := desc.getNumSlotsPerPage(PageSize)
 	if err != nil {
 		panic(err.Error())
 	}
+	versioned := !f.unversioned
+	if !versioned {
+		numSlots = int32((PageSize - 8) / desc.sizeInBytes())
+	}
 	records := make([]*Tuple, numSlots)
+	versions := make([]tupleVersion, numSlots)
+
+	return &heapPage{numSlots: int32(numSlots), numOpenSlots: numSlots, pageNo: pageNo, filePointer: f, records: records, versions: versions, nullBitmaps: true, versioned: versioned}
+}
 
-	return &heapPage{numSlots: int32(numSlots), numOpenSlots: numSlots, pageNo: pageNo, filePointer: f, records: records}
+// Returns true if t can be inserted into the page: there must be a free slot,
+// and the page must store null bitmaps if t has NULL fields.
+func (h *heapPage) hasRoomFor(t *Tuple) bool {
+	h.latch.RLock()
+	defer h.latch.RUnlock()
+	return h.numOpenSlots > 0 && (h.nullBitmaps || !t.hasNulls())
 }
 
 func (h *heapPage) getNumOpenSlots() int {
+	h.latch.RLock()
+	defer h.latch.RUnlock()
 	return int(h.numOpenSlots)
 }
 
@@ -82,14 +142,28 @@ func (h *heapPage) getNumSlots() int {
 }
 
 // Insert the tuple into a free slot on the page, or return an error if there are
-// no free slots.  Set the tuples rid and return it.
+// no free slots.  Set the tuples rid and return it.  The tuple is visible to
+// every transaction.
 func (h *heapPage) insertTuple(t *Tuple) (recordID, error) {
+	return h.insertVersion(t, 0)
+}
+
+// Insert the tuple into a free slot on the page as a version created by the
+// transaction with id xmin, returning its rid.
+func (h *heapPage) insertVersion(t *Tuple, xmin int64) (recordID, error) {
+	h.latch.Lock()
+	defer h.latch.Unlock()
 	if h.numOpenSlots == 0 {
 		return nil, ailikeError{PageFullError, "No empty slots in heap page."}
 	}
+	if !h.nullBitmaps && t.hasNulls() {
+		return nil, ailikeError{PageFullError, "Heap page cannot store NULL values."}
+	}
+	t.keepNorms()
 	for i, r := range h.records {
 		if r == nil {
 			h.records[i] = t
+			h.versions[i] = tupleVersion{xmin: xmin}
 			h.numOpenSlots -= 1
 			h.setDirty(true)
 			return heapRecordId{pageNo: h.pageNo, slotNo: i, fileName: h.filePointer.fileName}, nil
@@ -112,15 +186,204 @@ func (h *heapPage) findTuple(rid recordID) (*Tuple, error) {
 	return nil, ailikeError{IllegalOperationError, "Trying to find a non-existant tuple."}
 }
 
+// Returns the tuple with the specified rid if it is visible to tid, or an error
+// if there is none.
+func (h *heapPage) findVisibleTuple(rid recordID, tid *Transaction) (*Tuple, error) {
+	if rid.(heapRecordId).pageNo != h.pageNo {
+		panic("Trying to find record from wrong page.")
+	}
+	h.latch.RLock()
+	defer h.latch.RUnlock()
+	slotNo := rid.(heapRecordId).slotNo
+	if slotNo < len(h.records) && h.records[slotNo] != nil && h.visible(slotNo, tid) {
+		return h.records[slotNo], nil
+	}
+	return nil, ailikeError{IllegalOperationError, "Trying to find a non-existant tuple."}
+}
+
+// Returns true if the tuple in the slot is visible to tid.
+func (h *heapPage) visible(slotNo int, tid *Transaction) bool {
+	return !h.versioned || tid.canSee(h.versions[slotNo])
+}
+
+// Returns the tuples on the page that are visible to tid.
+func (h *heapPage) visibleTuples(tid *Transaction) []*Tuple {
+	h.latch.RLock()
+	defer h.latch.RUnlock()
+	var tuples []*Tuple
+	for i, r := range h.records {
+		if r != nil && h.visible(i, tid) {
+			tuples = append(tuples, r)
+		}
+	}
+	return tuples
+}
+
+// Stamps the version with the specified rid as deleted by tid, which must be
+// able to see it.  Returns a WriteConflictError if another transaction has
+// deleted the version, or created it after tid's snapshot was taken: the first
+// transaction to commit a change to a record wins.
+func (h *heapPage) deleteVersion(rid recordID, tid *Transaction) error {
+	if rid.(heapRecordId).pageNo != h.pageNo {
+		panic("Trying to delete record from wrong page.")
+	}
+	h.latch.Lock()
+	defer h.latch.Unlock()
+	slotNo := rid.(heapRecordId).slotNo
+	version := &h.versions[slotNo]
+	if h.records[slotNo] == nil || version.xmax == tid.id {
+		return ailikeError{IllegalOperationError, "Trying to delete a non-existant tuple."}
+	}
+	if version.xmax != 0 || !tid.sees(version.xmin) {
+		return ailikeError{WriteConflictError, "Record was changed by a concurrent transaction."}
+	}
+	version.xmax = tid.id
+	h.setDirty(true)
+	return nil
+}
+
+// Removes the versions deleted below horizon, which no transaction can see,
+// and clears the creation stamps below horizon, since every transaction sees
+// those versions.  Returns the rids of the versions removed.
+func (h *heapPage) prune(horizon int64) []recordID {
+	h.latch.Lock()
+	defer h.latch.Unlock()
+	var removed []recordID
+	for i, r := range h.records {
+		if r == nil {
+			continue
+		}
+		version := &h.versions[i]
+		if version.xmax != 0 && version.xmax < horizon {
+			removed = append(removed, r.Rid)
+			h.records[i] = nil
+			*version = tupleVersion{}
+			h.numOpenSlots += 1
+			h.setDirty(true)
+		} else if version.xmin != 0 && version.xmin < horizon {
+			version.xmin = 0
+			h.setDirty(true)
+		}
+	}
+	return removed
+}
+
+// Rolls back the changes of the transaction with id tid to the page: the
+// versions it created are removed, and those it deleted are restored.  Other
+// transactions may have changed the page since, so it is undone by the stamps
+// of its versions rather than by restoring an earlier image of the page.
+func (h *heapPage) undoVersions(tid int64) {
+	h.latch.Lock()
+	defer h.latch.Unlock()
+	for i, r := range h.records {
+		if r == nil {
+			continue
+		}
+		version := &h.versions[i]
+		if version.xmin == tid {
+			h.records[i] = nil
+			*version = tupleVersion{}
+			h.numOpenSlots += 1
+			h.setDirty(true)
+		} else if version.xmax == tid {
+			version.xmax = 0
+			h.setDirty(true)
+		}
+	}
+}
+
+// Like [heapPage.undoVersions], but undoes the changes of tid to the image of a
+// versioned page whose slots are slotSize bytes, returning the new image.
+func scrubVersions(image []byte, tid int64, slotSize int) []byte {
+	scrubbed := make([]byte, len(image))
+	copy(scrubbed, image)
+	numSlots := int32(binary.LittleEndian.Uint32(scrubbed)) &^ (nullBitmapPageFlag | versionedPageFlag)
+	numOpenSlots := int32(binary.LittleEndian.Uint32(scrubbed[4:]))
+	empty := emptySlotStamp
+	for i := 0; i < int(numSlots); i++ {
+		slot := scrubbed[8+i*slotSize : 8+(i+1)*slotSize]
+		xmin := int64(binary.LittleEndian.Uint64(slot))
+		xmax := int64(binary.LittleEndian.Uint64(slot[8:]))
+		if xmin == tid {
+			clear(slot)
+			binary.LittleEndian.PutUint64(slot, uint64(empty))
+			numOpenSlots += 1
+		} else if xmin != empty && xmax == tid {
+			binary.LittleEndian.PutUint64(slot[8:], 0)
+		}
+	}
+	binary.LittleEndian.PutUint32(scrubbed[4:], uint32(numOpenSlots))
+	return scrubbed
+}
+
+// Returns the largest transaction id stamped on the image of a page whose
+// tuples are tupleSize bytes, or zero if the page has no versions.
+func largestStamp(image []byte, tupleSize int) int64 {
+	if len(image) < 8 {
+		return 0
+	}
+	header := int32(binary.LittleEndian.Uint32(image))
+	if header&versionedPageFlag == 0 {
+		return 0
+	}
+	numSlots := int(header &^ (nullBitmapPageFlag | versionedPageFlag))
+	slotSize := versionStampBytes + tupleSize
+	var largest int64
+	for i := 0; i < numSlots && 8+(i+1)*slotSize <= len(image); i++ {
+		slot := image[8+i*slotSize:]
+		xmin := int64(binary.LittleEndian.Uint64(slot))
+		xmax := int64(binary.LittleEndian.Uint64(slot[8:]))
+		if xmin == emptySlotStamp {
+			continue
+		}
+		largest = max(largest, xmin, xmax)
+	}
+	return largest
+}
+
+// Returns the size of the slots of the page's image if it has versions, and
+// zero otherwise.
+func (h *heapPage) versionSlotSize() int {
+	if !h.versioned {
+		return 0
+	}
+	return versionStampBytes + h.filePointer.Descriptor().sizeInBytes()
+}
+
+// Replace the tuple in the specified slot number with t, or return an error if
+// the slot is empty
+func (h *heapPage) updateTuple(rid recordID, t *Tuple) error {
+	if rid.(heapRecordId).pageNo != h.pageNo {
+		panic("Trying to update record on wrong page.")
+	}
+	slotNo := rid.(heapRecordId).slotNo
+	if h.records[slotNo] == nil {
+		return ailikeError{IllegalOperationError, "Trying to update a non-existant tuple."}
+	}
+	if !h.nullBitmaps && t.hasNulls() {
+		return ailikeError{IllegalOperationError, "Heap page cannot store NULL values."}
+	}
+	h.latch.Lock()
+	defer h.latch.Unlock()
+	t.Rid = rid
+	t.keepNorms()
+	h.records[slotNo] = t
+	h.setDirty(true)
+	return nil
+}
+
 // Delete the tuple in the specified slot number, or return an error if
 // the slot is invalid
 func (h *heapPage) deleteTuple(rid recordID) error {
 	if rid.(heapRecordId).pageNo != h.pageNo {
 		panic("Trying to delete record from wrong page.")
 	}
+	h.latch.Lock()
+	defer h.latch.Unlock()
 	slotNo := rid.(heapRecordId).slotNo
 	if h.records[slotNo] != nil {
 		h.records[slotNo] = nil
+		h.versions[slotNo] = tupleVersion{}
 		h.numOpenSlots += 1
 		h.setDirty(true)
 		return nil
@@ -130,12 +393,12 @@ func (h *heapPage) deleteTuple(rid recordID) error {
 
 // Page method - return whether or not the page is dirty
 func (h *heapPage) isDirty() bool {
-	return h.dirty //replace me
+	return h.dirty.Load()
 }
 
 // Page method - mark the page as dirty
 func (h *heapPage) setDirty(dirty bool) {
-	h.dirty = dirty
+	h.dirty.Store(dirty)
 }
 
 // Page method - return the corresponding HeapFile
@@ -156,8 +419,18 @@ func (p *heapPage) flushPage() error {
 // the binary.Write method in LittleEndian order, followed by the tuples of the
 // page, written using the Tuple.writeTo method.
 func (h *heapPage) toBuffer() (*bytes.Buffer, error) {
+	h.latch.RLock()
+	defer h.latch.RUnlock()
 	b := new(bytes.Buffer)
-	err := binary.Write(b, binary.LittleEndian, h.numSlots)
+	b.Grow(PageSize)
+	header := h.numSlots
+	if h.nullBitmaps {
+		header |= nullBitmapPageFlag
+	}
+	if h.versioned {
+		header |= versionedPageFlag
+	}
+	err := binary.Write(b, binary.LittleEndian, header)
 	if err != nil {
 		return nil, err
 	}
@@ -165,23 +438,58 @@ func (h *heapPage) toBuffer() (*bytes.Buffer, error) {
 	if err != nil {
 		return nil, err
 	}
+	if h.versioned {
+		return b, h.writeVersions(b)
+	}
 	for _, r := range h.records {
-		if r != nil {
-			if err := r.writeTo(b); err != nil {
-				return nil, err
-			}
+		if r == nil {
+			continue
+		}
+		if h.nullBitmaps {
+			err = r.writeTo(b)
+		} else {
+			err = r.writeFieldsTo(b)
+		}
+		if err != nil {
+			return nil, err
 		}
 	}
 	return b, nil
 }
 
+// Writes every slot of a versioned page: the stamps of its tuple followed by
+// the tuple, or emptySlotStamp followed by zeros if it is free.
+func (h *heapPage) writeVersions(b *bytes.Buffer) error {
+	empty := make([]byte, h.filePointer.Descriptor().sizeInBytes())
+	stamps := make([]byte, versionStampBytes)
+	for i, r := range h.records {
+		version := h.versions[i]
+		if r == nil {
+			version = tupleVersion{xmin: emptySlotStamp}
+		}
+		binary.LittleEndian.PutUint64(stamps, uint64(version.xmin))
+		binary.LittleEndian.PutUint64(stamps[8:], uint64(version.xmax))
+		b.Write(stamps)
+		if r == nil {
+			b.Write(empty)
+		} else if err := r.writeTo(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Read the contents of the HeapPage from the supplied buffer.
 func (h *heapPage) initFromBuffer(buf *bytes.Buffer) error {
 	var numSlots int32
 	if err := binary.Read(buf, binary.LittleEndian, &numSlots); err != nil {
 		return err
 	}
+	nullBitmaps := numSlots&nullBitmapPageFlag != 0
+	versioned := numSlots&versionedPageFlag != 0
+	numSlots &^= nullBitmapPageFlag | versionedPageFlag
 	records := make([]*Tuple, numSlots)
+	versions := make([]tupleVersion, numSlots)
 
 	var numOpenSlots int32
 	if err := binary.Read(buf, binary.LittleEndian, &numOpenSlots); err != nil {
@@ -189,8 +497,19 @@ func (h *heapPage) initFromBuffer(buf *bytes.Buffer) error {
 	}
 
 	fileName := (*h.getFile()).(*HeapFile).fileName
-	for i := 0; i < int(numSlots-numOpenSlots); i++ {
-		t, err := readTupleFrom(buf, h.filePointer.Descriptor())
+	if versioned {
+		if err := h.readVersions(buf, records, versions); err != nil {
+			return err
+		}
+	}
+	for i := 0; !versioned && i < int(numSlots-numOpenSlots); i++ {
+		var t *Tuple
+		var err error
+		if nullBitmaps {
+			t, err = readTupleFrom(buf, h.filePointer.Descriptor())
+		} else {
+			t, err = readLegacyTupleFrom(buf, h.filePointer.Descriptor())
+		}
 		if err != nil {
 			return err
 		}
@@ -205,6 +524,37 @@ func (h *heapPage) initFromBuffer(buf *bytes.Buffer) error {
 	h.numSlots = numSlots
 	h.numOpenSlots = numOpenSlots
 	h.records = records
+	h.versions = versions
+	h.nullBitmaps = nullBitmaps
+	h.versioned = versioned
+	return nil
+}
+
+// Reads the slots of a versioned page, as written by [heapPage.writeVersions],
+// into records and versions.
+func (h *heapPage) readVersions(buf *bytes.Buffer, records []*Tuple, versions []tupleVersion) error {
+	desc := h.filePointer.Descriptor()
+	for i := range records {
+		stamps := buf.Next(versionStampBytes)
+		if len(stamps) < versionStampBytes {
+			return io.ErrUnexpectedEOF
+		}
+		version := tupleVersion{
+			xmin: int64(binary.LittleEndian.Uint64(stamps)),
+			xmax: int64(binary.LittleEndian.Uint64(stamps[8:])),
+		}
+		if version.xmin == emptySlotStamp {
+			buf.Next(desc.sizeInBytes())
+			continue
+		}
+		t, err := readTupleFrom(buf, desc)
+		if err != nil {
+			return err
+		}
+		t.Rid = heapRecordId{pageNo: h.pageNo, slotNo: i, fileName: h.filePointer.fileName}
+		records[i] = t
+		versions[i] = version
+	}
 	return nil
 }
 
@@ -1,6 +1,8 @@
 package godb
 
 import (
+	"bytes"
+	"encoding/binary"
 	"testing"
 	"unsafe"
 )
@@ -8,7 +10,9 @@ import (
 func TestInsertHeapPage(t *testing.T) {
 	td, t1, t2, hf, _, _ := makeTestVars()
 	pg := newHeapPage(&td, 0, hf)
-	var expectedSlots = (PageSize - 8) / (StringLength + int(unsafe.Sizeof(int64(0))))
+	// each tuple is preceded by its creation and deletion stamps and a one
+	// byte null bitmap
+	var expectedSlots = (PageSize - 8) / (versionStampBytes + 1 + StringLength + int(unsafe.Sizeof(int64(0))))
 	if pg.getNumSlots() != expectedSlots {
 		t.Fatalf("Incorrect number of slots, expected %d, got %d", expectedSlots, pg.getNumSlots())
 	}
@@ -218,3 +222,62 @@ func TestHeapPageSerialization(t *testing.T) {
 		}
 	}
 }
+
+func TestHeapPageNulls(t *testing.T) {
+	td, t1, _, hf, _, _ := makeTestVars()
+	withNull := Tuple{Desc: td, Fields: []DBValue{StringField{"nobody"}, nil}}
+
+	pg := newHeapPage(&td, 0, hf)
+	if !pg.hasRoomFor(&withNull) {
+		t.Fatalf("expected a new page to hold tuples with NULLs")
+	}
+	pg.insertTuple(&t1)
+	if _, err := pg.insertTuple(&withNull); err != nil {
+		t.Fatalf(err.Error())
+	}
+	buf, err := pg.toBuffer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	pg2 := newHeapPage(&td, 0, hf)
+	if err := pg2.initFromBuffer(buf); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !pg2.nullBitmaps || pg2.getNumSlots() != pg.getNumSlots() {
+		t.Errorf("expected the page to be read back with null bitmaps and %d slots", pg.getNumSlots())
+	}
+	if tup, _ := pg2.findTuple(heapRecordId{pageNo: 0, slotNo: 1}); tup == nil || tup.Fields[1] != nil {
+		t.Errorf("expected the NULL field to be read back, got %v", tup)
+	}
+
+	// pages written before null bitmaps have no flag in their header and no
+	// bitmap before each tuple
+	legacySlots := int32((PageSize - 8) / (StringLength + int(unsafe.Sizeof(int64(0)))))
+	legacy := new(bytes.Buffer)
+	binary.Write(legacy, binary.LittleEndian, legacySlots)
+	binary.Write(legacy, binary.LittleEndian, legacySlots-1)
+	t1.writeFieldsTo(legacy)
+	pg3 := newHeapPage(&td, 0, hf)
+	if err := pg3.initFromBuffer(legacy); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if pg3.nullBitmaps || pg3.getNumSlots() != int(legacySlots) {
+		t.Errorf("expected a legacy page with %d slots, got %d", legacySlots, pg3.getNumSlots())
+	}
+	if tup, _ := pg3.findTuple(heapRecordId{pageNo: 0, slotNo: 0}); tup == nil || !tup.equals(&t1) {
+		t.Errorf("expected to read %v from the legacy page, got %v", t1.Fields, tup)
+	}
+	if pg3.hasRoomFor(&withNull) || !pg3.hasRoomFor(&t1) {
+		t.Errorf("expected a legacy page to only hold tuples without NULLs")
+	}
+	if _, err := pg3.insertTuple(&withNull); err == nil {
+		t.Errorf("expected an error inserting a NULL into a legacy page")
+	}
+	buf, err = pg3.toBuffer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if buf.Len() != 8+int(td.sizeInBytes()-td.nullBitmapBytes()) {
+		t.Errorf("expected a legacy page to be written without null bitmaps")
+	}
+}
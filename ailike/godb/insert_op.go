@@ -23,7 +23,7 @@ func (i *InsertOp) Descriptor() *TupleDesc {
 // one-field tuple with a "count" field indicating the number of tuples that
 // were inserted.  Tuples should be inserted using the [DBFile.insertTuple]
 // method.
-func (iop *InsertOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+func (iop *InsertOp) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
 	childIter, err := iop.child.Iterator(tid)
 	if err != nil {
 		return nil, err
@@ -11,14 +11,13 @@ func TestInsert(t *testing.T) {
 	td, t1, _, hf, bp, tid := makeTestVars()
 	hf.insertTuple(&t1, tid)
 	hf.insertTuple(&t1, tid)
-	bp.CommitTransaction(tid)
+	tid.Commit()
 	os.Remove(InsertTestFile)
 	hf2, _ := NewHeapFile(InsertTestFile, &td, bp)
 	if hf2 == nil {
 		t.Fatalf("hf was nil")
 	}
-	tid = NewTID()
-	bp.BeginTransaction(tid)
+	tid = bp.Transactions().Begin()
 	ins := NewInsertOp(hf2, hf)
 	iter, _ := ins.Iterator(tid)
 	if iter == nil {
@@ -38,9 +37,8 @@ func TestInsert(t *testing.T) {
 		t.Errorf("invalid output tuple")
 		return
 	}
-	bp.CommitTransaction(tid)
-	tid = NewTID()
-	bp.BeginTransaction(tid)
+	tid.Commit()
+	tid = bp.Transactions().Begin()
 
 	cnt := 0
 	iter, _ = hf2.Iterator(tid)
@@ -1,5 +1,39 @@
 package godb
 
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// JoinType determines which records of the inputs of a join are returned.  An
+// inner join only returns records that match, while an outer join also returns
+// each record of its left (or right) input that matches nothing, with NULLs in
+// place of the fields of the other input.
+//
+// Semi and anti joins only return the records of the left input, once each: a
+// semi join those that match some record of the right input, and an anti join
+// those that match none.  They implement IN and EXISTS subqueries.  A null-aware
+// anti join implements NOT IN, which is unknown rather than true for a record
+// whose key is NULL, or when the right input contains a NULL key.
+type JoinType int
+
+const (
+	InnerJoin         JoinType = iota
+	LeftOuterJoin     JoinType = iota
+	RightOuterJoin    JoinType = iota
+	SemiJoin          JoinType = iota
+	AntiJoin          JoinType = iota
+	NullAwareAntiJoin JoinType = iota
+)
+
+var joinTypeNames = map[JoinType]string{InnerJoin: "inner", LeftOuterJoin: "left outer", RightOuterJoin: "right outer",
+	SemiJoin: "semi", AntiJoin: "anti", NullAwareAntiJoin: "null-aware anti"}
+
+// Returns true if the join only returns records of its left input.
+func (joinType JoinType) filtersLeft() bool {
+	return joinType == SemiJoin || joinType == AntiJoin || joinType == NullAwareAntiJoin
+}
+
 type EqualityJoin[T comparable] struct {
 	// Expressions that when applied to tuples from the left or right operators,
 	// respectively, return the value of the left or right side of the join
@@ -14,6 +48,8 @@ type EqualityJoin[T comparable] struct {
 	// The maximum number of records of intermediate state that the join should use
 	// (only required for optional exercise)
 	maxBufferSize int
+
+	joinType JoinType
 }
 
 // Constructor for a  join of integer expressions
@@ -29,7 +65,7 @@ func NewIntJoin(left Operator, leftField Expr, right Operator, rightField Expr,
 	case StringType:
 		return nil, ailikeError{TypeMismatchError, "join field is not an int"}
 	case IntType:
-		return &EqualityJoin[int64]{leftField, rightField, &left, &right, intFilterGetter, maxBufferSize}, nil
+		return &EqualityJoin[int64]{leftField, rightField, &left, &right, intFilterGetter, maxBufferSize, InnerJoin}, nil
 	}
 	return nil, ailikeError{TypeMismatchError, "unknown type"}
 }
@@ -45,44 +81,181 @@ func NewStringJoin(left Operator, leftField Expr, right Operator, rightField Exp
 	}
 	switch leftField.GetExprType().Ftype {
 	case StringType:
-		return &EqualityJoin[string]{leftField, rightField, &left, &right, stringFilterGetter, maxBufferSize}, nil
+		return &EqualityJoin[string]{leftField, rightField, &left, &right, stringFilterGetter, maxBufferSize, InnerJoin}, nil
 	case IntType:
 		return nil, ailikeError{TypeMismatchError, "join field is not a string"}
 	}
 	return nil, ailikeError{TypeMismatchError, "unknown type"}
 }
 
+// Constructor for a join of the given type on int or string expressions
+func NewEqualityJoin(left Operator, leftField Expr, right Operator, rightField Expr, joinType JoinType, maxBufferSize int) (Operator, error) {
+	switch leftField.GetExprType().Ftype {
+	case IntType:
+		j, err := NewIntJoin(left, leftField, right, rightField, maxBufferSize)
+		if err != nil {
+			return nil, err
+		}
+		j.joinType = joinType
+		return j, nil
+	case StringType:
+		j, err := NewStringJoin(left, leftField, right, rightField, maxBufferSize)
+		if err != nil {
+			return nil, err
+		}
+		j.joinType = joinType
+		return j, nil
+	}
+	return nil, ailikeError{TypeMismatchError, "join fields must be ints or strings"}
+}
+
+// Returns an error unless each of the left join keys can be compared to the
+// corresponding right key: both must be ints, or both strings.
+func checkJoinKeys(leftFields []Expr, rightFields []Expr) error {
+	if len(leftFields) != len(rightFields) || len(leftFields) == 0 {
+		return ailikeError{MalformedDataError, "a join needs the same number of keys from each input"}
+	}
+	for i := range leftFields {
+		lType, rType := leftFields[i].GetExprType().Ftype, rightFields[i].GetExprType().Ftype
+		if lType != rType {
+			return ailikeError{TypeMismatchError, "can't join fields of different types"}
+		}
+		if lType != IntType && lType != StringType {
+			return ailikeError{TypeMismatchError, "join fields must be ints or strings"}
+		}
+	}
+	return nil
+}
+
+// compositeKeyExpr is the key of a join on several columns.  It evaluates to
+// the values of its expressions encoded in a single string, so that joins that
+// hash a single value can join on several.  It is NULL if any of the values is
+// NULL, since such a key matches nothing.
+type compositeKeyExpr struct {
+	exprs []Expr
+}
+
+// Returns an expression for the join key made of exprs: the expression itself
+// for a single column, and otherwise a composite of them.
+func joinKeyExpr(exprs []Expr) Expr {
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	return &compositeKeyExpr{exprs}
+}
+
+func (k *compositeKeyExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	var b bytes.Buffer
+	for _, e := range k.exprs {
+		v, err := e.EvalExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case nil:
+			return nil, nil
+		case IntField:
+			binary.Write(&b, binary.LittleEndian, v.Value)
+		case StringField:
+			// strings are prefixed by their length, so that e.g. ("ab", "c") and
+			// ("a", "bc") have different keys
+			binary.Write(&b, binary.LittleEndian, int64(len(v.Value)))
+			b.WriteString(v.Value)
+		default:
+			return nil, ailikeError{TypeMismatchError, "join fields must be ints or strings"}
+		}
+	}
+	return StringField{b.String()}, nil
+}
+
+func (k *compositeKeyExpr) GetExprType() FieldType {
+	return FieldType{"key", "", StringType}
+}
+
+// Returns the values of the join key exprs for t.
+func evalJoinKey(exprs []Expr, t *Tuple) ([]DBValue, error) {
+	key := make([]DBValue, len(exprs))
+	for i, e := range exprs {
+		v, err := e.EvalExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		key[i] = v
+	}
+	return key, nil
+}
+
+// Returns true if any value of the join key is NULL, so that it matches nothing.
+func joinKeyHasNull(key []DBValue) bool {
+	for _, v := range key {
+		if v == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Compares two join keys without NULLs column by column, in the order that
+// [OrderBy] sorts them in ascending order.
+func compareJoinKeys(k1 []DBValue, k2 []DBValue) orderByState {
+	for i := range k1 {
+		switch v1 := k1[i].(type) {
+		case IntField:
+			v2 := k2[i].(IntField)
+			if v1.Value < v2.Value {
+				return OrderedLessThan
+			} else if v1.Value > v2.Value {
+				return OrderedGreaterThan
+			}
+		case StringField:
+			v2 := k2[i].(StringField)
+			if v1.Value < v2.Value {
+				return OrderedLessThan
+			} else if v1.Value > v2.Value {
+				return OrderedGreaterThan
+			}
+		}
+	}
+	return OrderedEqual
+}
+
 // Return a TupleDescriptor for this join. The returned descriptor should contain
 // the union of the fields in the descriptors of the left and right operators.
 // HINT: use the merge function you implemented for TupleDesc in lab1
 // TODO: what happens with duplicate field names?
 func (hj *EqualityJoin[T]) Descriptor() *TupleDesc {
+	if hj.joinType.filtersLeft() {
+		return (*hj.left).Descriptor()
+	}
 	return (*hj.left).Descriptor().merge((*hj.right).Descriptor())
 }
 
-func (joinOp *EqualityJoin[T]) buildBlockHashMap(leftIter func() (*Tuple, error)) (map[T][]*Tuple, error) {
+// Reads up to maxBufferSize records from iter, and returns them along with a
+// hash map from the value of field to the records with that value.  Records
+// whose value is NULL do not match anything, so they are not in the map.
+func (joinOp *EqualityJoin[T]) buildBlockHashMap(iter func() (*Tuple, error), field Expr) (map[T][]*Tuple, []*Tuple, error) {
 	blockHashMap := make(map[T][]*Tuple)
+	var block []*Tuple
 	for i := 0; i < joinOp.maxBufferSize; i++ {
-		curLeftT, err := leftIter()
+		t, err := iter()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		if curLeftT == nil {
+		if t == nil {
 			break
 		}
-		leftV, err := joinOp.leftField.EvalExpr(curLeftT)
+		block = append(block, t)
+		v, err := field.EvalExpr(t)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		leftFieldVal := joinOp.getter(leftV)
-		bucket, ok := blockHashMap[leftFieldVal]
-		if !ok {
-			bucket = make([]*Tuple, 0, 10)
+		if v == nil {
+			continue
 		}
-		bucket = append(bucket, curLeftT)
-		blockHashMap[leftFieldVal] = bucket
+		fieldVal := joinOp.getter(v)
+		blockHashMap[fieldVal] = append(blockHashMap[fieldVal], t)
 	}
-	return blockHashMap, nil
+	return blockHashMap, block, nil
 }
 
 // Join operator implementation.  This function should iterate over the results
@@ -99,97 +272,178 @@ func (joinOp *EqualityJoin[T]) buildBlockHashMap(leftIter func() (*Tuple, error)
 // maxBufferSize records, and should pass the testBigJoin test without timing
 // out.  To pass this test, you will need to use something other than a nested
 // loops join.
-func (joinOp *EqualityJoin[T]) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
-	leftIter, err := (*joinOp.left).Iterator(tid)
+//
+// The records of one input are read in blocks into a hash table, and the other
+// input is scanned once per block.  For a right outer join the right input is
+// hashed, so that the records of the outer input that find no match are known
+// once the other input has been scanned.  Likewise a semi or anti join hashes
+// the left input, and returns the records of each block that did, or did not,
+// match once the right input has been scanned.
+func (joinOp *EqualityJoin[T]) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
+	build, probe := *joinOp.left, *joinOp.right
+	buildField, probeField := joinOp.leftField, joinOp.rightField
+	swapped := joinOp.joinType == RightOuterJoin
+	if swapped {
+		build, probe = probe, build
+		buildField, probeField = probeField, buildField
+	}
+	outer := joinOp.joinType == LeftOuterJoin || joinOp.joinType == RightOuterJoin
+	filtering := joinOp.joinType.filtersLeft()
+	// for a null-aware anti join, whether the right input is empty or has a NULL key
+	probeEmpty, probeHasNull := true, false
+	// returns true if a record of the block that matched is returned by a semi or
+	// anti join, given whether it matched
+	keep := func(buildT *Tuple, matched bool) (bool, error) {
+		switch joinOp.joinType {
+		case SemiJoin:
+			return matched, nil
+		case AntiJoin:
+			return !matched, nil
+		}
+		if matched || probeHasNull {
+			return false, nil
+		}
+		if probeEmpty {
+			return true, nil
+		}
+		v, err := buildField.EvalExpr(buildT)
+		return v != nil, err
+	}
+	nullProbeT := &Tuple{Desc: *probe.Descriptor(), Fields: make([]DBValue, len(probe.Descriptor().Fields))}
+	// returns the joined record, with the fields of the left input first
+	joined := func(buildT *Tuple, probeT *Tuple) *Tuple {
+		if swapped {
+			return joinTuples(probeT, buildT)
+		}
+		return joinTuples(buildT, probeT)
+	}
+
+	buildIter, err := build.Iterator(tid)
 	if err != nil {
 		return nil, err
 	}
-	if leftIter == nil {
+	if buildIter == nil {
 		return nil, ailikeError{MalformedDataError, "EqualityJoin left Iterator unexpectedly nil."}
 	}
 
-	rightIter, err := (*joinOp.right).Iterator(tid)
+	probeIter, err := probe.Iterator(tid)
 	if err != nil {
 		return nil, err
 	}
-	if rightIter == nil {
+	if probeIter == nil {
 		return nil, ailikeError{MalformedDataError, "EqualityJoin right Iterator unexpectedly nil."}
 	}
 
-	blockHashMap, err := joinOp.buildBlockHashMap(leftIter)
+	blockHashMap, block, err := joinOp.buildBlockHashMap(buildIter, buildField)
+	if err != nil {
+		return nil, err
+	}
+	// Returns the records of the current block that match t.
+	matches := func(t *Tuple) ([]*Tuple, error) {
+		if t == nil {
+			return nil, nil
+		}
+		v, err := probeField.EvalExpr(t)
+		if err != nil || v == nil {
+			probeHasNull = probeHasNull || v == nil
+			return nil, err
+		}
+		probeEmpty = false
+		return blockHashMap[joinOp.getter(v)], nil
+	}
+
+	curProbeT, err := probeIter()
 	if err != nil {
 		return nil, err
 	}
-	curRightT, err := rightIter()
+	curBucket, err := matches(curProbeT)
 	if err != nil {
 		return nil, err
 	}
 
 	var (
-		curBucketVal   T
-		curBucket      []*Tuple
 		curBucketIndex int = 0
-		curLeftT       *Tuple
-		ok             bool
+		matched            = make(map[*Tuple]bool) // records of the block that have been joined
+		unmatchedIndex int = 0                     // next record of the block to check for a match
 	)
 
 	return func() (*Tuple, error) {
-		for len(blockHashMap) > 0 {
-			for curRightT != nil {
-				// Compute the rightFieldVal for the curren right tuple
-				rightV, err := joinOp.rightField.EvalExpr(curRightT)
+		for len(block) > 0 {
+			for curProbeT != nil {
+				if filtering {
+					for _, buildT := range curBucket {
+						matched[buildT] = true
+					}
+					curBucketIndex = len(curBucket)
+				}
+				if curBucketIndex < len(curBucket) {
+					// return the next record of the block that matches the current probe record
+					buildT := curBucket[curBucketIndex]
+					curBucketIndex++
+					if outer {
+						matched[buildT] = true
+					}
+					return joined(buildT, curProbeT), nil
+				}
+				// the matches of this probe record are exhausted, so move on to the next one
+				curProbeT, err = probeIter()
+				if err != nil {
+					return nil, err
+				}
+				curBucket, err = matches(curProbeT)
 				if err != nil {
 					return nil, err
 				}
-				rightFieldVal := joinOp.getter(rightV)
+				curBucketIndex = 0
+			}
 
-				if rightFieldVal == curBucketVal && curBucketIndex < len(curBucket) {
-					// If rightFieldVal matches the value for the current bucket we are iterating over,
-					// and there are remaining tuples in the bucket, get the next left-hand tuple from
-					// that bucket and return the joined tuple.
-					curLeftT = curBucket[curBucketIndex]
-					curBucketIndex++
-					return joinTuples(curLeftT, curRightT), nil
-				} else if rightFieldVal == curBucketVal && curBucketIndex == len(curBucket) && len(curBucket) > 0 {
-					// If we have reached the end of the bucket, we need to get the next right-hand tuple.
-					curBucketIndex = 0
-					curRightT, err = rightIter()
-					if err != nil {
-						return nil, err
-					}
-				} else {
-					// If current rightFieldVal does not currently match bucket value, we check if
-					// the rightFieldValue is in the hash map and fetch the matching bucket if
-					// present. Otherwise, we know there are no matching tuples so we get the next
-					// right-hand tuple. Note: When we find a matching bucket, a tuple will not get
-					// returned until the next iteration through this for loop.
-					curBucket, ok = blockHashMap[rightFieldVal]
-					if ok {
-						curBucketVal = rightFieldVal
-					} else {
-						curRightT, err = rightIter()
-						if err != nil {
-							return nil, err
-						}
-					}
+			// For an outer join, the records of this block that matched nothing are
+			// returned with NULLs in place of the other input's fields.
+			for outer && unmatchedIndex < len(block) {
+				buildT := block[unmatchedIndex]
+				unmatchedIndex++
+				if !matched[buildT] {
+					return joined(buildT, nullProbeT), nil
+				}
+			}
+			// A semi or anti join returns the records of the block themselves.
+			for filtering && unmatchedIndex < len(block) {
+				buildT := block[unmatchedIndex]
+				unmatchedIndex++
+				ok, err := keep(buildT, matched[buildT])
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					return buildT, nil
 				}
 			}
 
-			// When we have finished iterating through the right-hand iterator for this block,
+			// When we have finished iterating through the probe input for this block,
 			// we build the next block's hash map...
-			blockHashMap, err = joinOp.buildBlockHashMap(leftIter)
+			blockHashMap, block, err = joinOp.buildBlockHashMap(buildIter, buildField)
+			if err != nil {
+				return nil, err
+			}
+			if len(block) == 0 {
+				break
+			}
+			matched = make(map[*Tuple]bool)
+			unmatchedIndex = 0
+			// and reset the probe iterator.
+			probeIter, err = probe.Iterator(tid)
 			if err != nil {
 				return nil, err
 			}
-			// and reset the right-hand iterator.
-			rightIter, err = (*joinOp.right).Iterator(tid)
+			curProbeT, err = probeIter()
 			if err != nil {
 				return nil, err
 			}
-			curRightT, err = rightIter()
+			curBucket, err = matches(curProbeT)
 			if err != nil {
 				return nil, err
 			}
+			curBucketIndex = 0
 		}
 		return nil, nil
 	}, nil
@@ -2,6 +2,8 @@ package godb
 
 import (
 	"os"
+	"path/filepath"
+	"sort"
 	"testing"
 	"time"
 )
@@ -98,7 +100,7 @@ func TestBigJoinOptional(t *testing.T) {
 			done <- true
 			return
 		}
-		var tid TransactionID
+		var tid *Transaction
 
 		for i := 0; i < ntups; i++ {
 			if i%5000 == 0 {
@@ -130,10 +132,9 @@ func TestBigJoinOptional(t *testing.T) {
 					}
 
 					// commit transaction
-					bp.CommitTransaction(tid)
+					tid.Commit()
 				}
-				tid = NewTID()
-				bp.BeginTransaction(tid)
+				tid = bp.Transactions().Begin()
 			}
 
 			tup := Tuple{td, []DBValue{IntField{int64(i)}}, nil}
@@ -150,9 +151,8 @@ func TestBigJoinOptional(t *testing.T) {
 			}
 
 		}
-		bp.CommitTransaction(tid)
-		tid = NewTID()
-		bp.BeginTransaction(tid)
+		tid.Commit()
+		tid = bp.Transactions().Begin()
 		leftField := FieldExpr{td.Fields[0]}
 		join, err := NewIntJoin(hf1, &leftField, hf2, &leftField, 100000)
 		if err != nil {
@@ -196,3 +196,398 @@ func TestBigJoinOptional(t *testing.T) {
 	}
 
 }
+
+// Returns the number of rows whose field col is NULL.
+func countNulls(rows [][]DBValue, col int) int {
+	n := 0
+	for _, row := range rows {
+		if row[col] == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func TestOuterJoinOp(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	// s_id 40 to 49 of r match nothing in s, and s_id 0 to 9 of s match nothing in r
+	runIntColumnQuery(t, c, bp, "delete from s where s_id >= 40", 0)
+	runIntColumnQuery(t, c, bp, "delete from r where s_id < 10", 0)
+	r, _ := c.GetTable("r")
+	s, _ := c.GetTable("s")
+	rKey := &FieldExpr{FieldType{"s_id", "", IntType}}
+	sKey := &FieldExpr{FieldType{"s_id", "", IntType}}
+
+	for _, tc := range []struct {
+		joinType       JoinType
+		rows, nullLeft int
+		nullRight      int
+		maxBufferSize  int
+	}{
+		{InnerJoin, 300, 0, 0, 1000},
+		{LeftOuterJoin, 400, 0, 100, 1000},
+		{RightOuterJoin, 310, 10, 0, 1000},
+		// several blocks of the hashed input
+		{LeftOuterJoin, 400, 0, 100, 7},
+		{RightOuterJoin, 310, 10, 0, 7},
+	} {
+		join, err := NewEqualityJoin(r, rKey, s, sKey, tc.joinType, tc.maxBufferSize)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		tid := bp.Transactions().Begin()
+		iter, err := join.Iterator(tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		rows, nullLeft, nullRight := 0, 0, 0
+		for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if len(tup.Fields) != 4 {
+				t.Fatalf("expected joined records to have 4 fields, got %v", tup.Fields)
+			}
+			if tup.Fields[0] == nil {
+				nullLeft++
+			}
+			if tup.Fields[2] == nil {
+				nullRight++
+			}
+			rows++
+		}
+		tid.Commit()
+		if rows != tc.rows || nullLeft != tc.nullLeft || nullRight != tc.nullRight {
+			t.Errorf("%s join with buffer %d: expected %d rows, %d and %d padded, got %d, %d and %d",
+				joinTypeNames[tc.joinType], tc.maxBufferSize, tc.rows, tc.nullLeft, tc.nullRight, rows, nullLeft, nullRight)
+		}
+	}
+}
+
+func TestOuterJoinParse(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	runIntColumnQuery(t, c, bp, "delete from s where s_id >= 40", 0)
+	runIntColumnQuery(t, c, bp, "delete from r where s_id < 10", 0)
+
+	for _, tc := range []struct {
+		sql        string
+		rows       int
+		nullCol    int
+		nullValues int
+	}{
+		{"select r.r_id, s.t_id from r left join s on r.s_id = s.s_id", 400, 1, 100},
+		{"select r.r_id, s.t_id from r left outer join s on s.s_id = r.s_id", 400, 1, 100},
+		{"select r.r_id, s.s_id from r right join s on r.s_id = s.s_id", 310, 0, 10},
+		{"select r.r_id, s.s_id from s left join r on r.s_id = s.s_id", 310, 0, 10},
+		// filters on the inner side apply to the padded records
+		{"select r.r_id, s.t_id from r left join s on r.s_id = s.s_id where s.t_id is null", 100, 1, 100},
+		{"select r.r_id, s.t_id from r left join s on r.s_id = s.s_id where s.t_id = 1", 60, 1, 0},
+		{"select r.r_id, s.t_id from r left join s on r.s_id = s.s_id where r.r_id < 50", 40, 1, 10},
+		{"select r.r_id, t.name from r left join s on r.s_id = s.s_id left join t on s.t_id = t.t_id", 400, 1, 100},
+		{"select r.r_id, t.name from r left join s on r.s_id = s.s_id join t on s.t_id = t.t_id", 300, 1, 0},
+	} {
+		_, rows := queryRows(t, c, bp, tc.sql)
+		if len(rows) != tc.rows || countNulls(rows, tc.nullCol) != tc.nullValues {
+			t.Errorf("expected %d results with %d NULLs for %s, got %d with %d", tc.rows, tc.nullValues, tc.sql, len(rows), countNulls(rows, tc.nullCol))
+		}
+	}
+
+	// the filter on the inner side of the join is applied above it
+	_, plan, err := Parse(c, "select r.r_id from r left join s on r.s_id = s.s_id where s.t_id is null and r.r_id < 50")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	filter, ok := plan.(*Project).child.(*Filter)
+	if !ok {
+		t.Fatalf("expected the filter on s to be applied above the join")
+	}
+	join, ok := filter.child.(*EqualityJoin[int64])
+	if !ok || join.joinType != LeftOuterJoin {
+		t.Fatalf("expected a left outer join below the filter")
+	}
+	if _, ok := (*join.left).(*Filter); !ok {
+		t.Errorf("expected the filter on r to be applied below the join")
+	}
+
+	for _, sql := range []string{
+		"select r.r_id from r left join s on r.s_id < s.s_id",
+		"select r.r_id from r left join s on r.s_id = s.s_id and s.t_id = 1",
+		"select r.r_id from r left join (s join t on s.t_id = t.t_id) on r.s_id = s.s_id",
+	} {
+		if _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected error parsing %s", sql)
+		}
+	}
+}
+
+// Returns the results of op as sorted strings, to compare the results of joins
+// that return them in different orders.
+func sortedResultStrings(t *testing.T, op Operator, tid *Transaction) []string {
+	var results []string
+	for _, tup := range collectTuples(t, op, tid) {
+		results = append(results, tup.PrettyPrintString(false))
+	}
+	sort.Strings(results)
+	return results
+}
+
+// Returns true if some operator of the plan satisfies match.
+func planHas(op Operator, match func(Operator) bool) bool {
+	if match(op) {
+		return true
+	}
+	for _, child := range planChildren(op) {
+		if planHas(child, match) {
+			return true
+		}
+	}
+	return false
+}
+
+// The partitions of a grace hash join whose consumer stops reading before the
+// end are deleted when the transaction completes.
+func TestGraceJoinStopsEarly(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	r, _ := c.GetTable("r")
+	s, _ := c.GetTable("s")
+	key := []Expr{&FieldExpr{FieldType{"s_id", "", IntType}}}
+	partitions := func() int {
+		files, _ := filepath.Glob(filepath.Join(os.TempDir(), "godb_join_partition_*"))
+		return len(files)
+	}
+	before := partitions()
+	join, err := NewGraceHashJoin(r, key, s, key, InnerJoin, 4, 1000, bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := bp.Transactions().Begin()
+	iter, err := join.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if tup, err := iter(); tup == nil || err != nil {
+		t.Fatalf("expected a result, got %v", err)
+	}
+	if partitions() <= before {
+		t.Fatalf("expected the join to write partitions")
+	}
+	tid.Commit()
+	if after := partitions(); after != before {
+		t.Errorf("expected the partitions to be deleted when the transaction commits, found %d more files", after-before)
+	}
+}
+
+func TestGraceAndMergeJoinOps(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	// s_id 40 to 49 of r match nothing in s, and s_id 0 to 9 of s match nothing in
+	// r; some of r's join keys are NULL
+	runIntColumnQuery(t, c, bp, "delete from s where s_id >= 40", 0)
+	runIntColumnQuery(t, c, bp, "delete from r where s_id < 10", 0)
+	runIntColumnQuery(t, c, bp, "update r set s_id = null where r_id >= 490", 0)
+	r, _ := c.GetTable("r")
+	s, _ := c.GetTable("s")
+	rKey := []Expr{&FieldExpr{FieldType{"s_id", "", IntType}}}
+	sKey := []Expr{&FieldExpr{FieldType{"s_id", "", IntType}}}
+
+	partitionsBefore, _ := filepath.Glob(filepath.Join(os.TempDir(), "godb_join_partition_*"))
+	for _, joinType := range []JoinType{InnerJoin, LeftOuterJoin, RightOuterJoin} {
+		tid := bp.Transactions().Begin()
+		hashJoin, err := NewEqualityJoin(r, rKey[0], s, sKey[0], joinType, 1000)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		expected := sortedResultStrings(t, hashJoin, tid)
+
+		var joins []Operator
+		for _, partitions := range []int{1, 4, 16} {
+			// with a buffer of 3 records, partitions are hashed in several blocks
+			for _, buffer := range []int{3, 1000} {
+				join, err := NewGraceHashJoin(r, rKey, s, sKey, joinType, partitions, buffer, bp)
+				if err != nil {
+					t.Fatalf(err.Error())
+				}
+				joins = append(joins, join)
+			}
+		}
+		for _, budget := range []int{10 * 1024 * 1024, 500} {
+			join, err := NewSortMergeJoin(r, rKey, s, sKey, joinType, bp, budget)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			joins = append(joins, join)
+		}
+		for _, join := range joins {
+			results := sortedResultStrings(t, join, tid)
+			if len(results) != len(expected) {
+				t.Errorf("%s: expected %d results, got %d", planLabel(join), len(expected), len(results))
+				continue
+			}
+			for i := range results {
+				if results[i] != expected[i] {
+					t.Errorf("%s: expected %s, got %s", planLabel(join), expected[i], results[i])
+					break
+				}
+			}
+		}
+		tid.Commit()
+	}
+	partitionsAfter, _ := filepath.Glob(filepath.Join(os.TempDir(), "godb_join_partition_*"))
+	if len(partitionsAfter) != len(partitionsBefore) {
+		t.Errorf("expected the partitions to be deleted after the join, found %d more files", len(partitionsAfter)-len(partitionsBefore))
+	}
+
+	// the keys must be comparable
+	name := []Expr{&FieldExpr{FieldType{"name", "", StringType}}}
+	if _, err := NewSortMergeJoin(r, rKey, s, name, InnerJoin, bp, 1000); err == nil {
+		t.Errorf("expected error joining an int to a string")
+	}
+	if _, err := NewGraceHashJoin(r, rKey, s, append(sKey, sKey...), InnerJoin, 2, 1000, bp); err == nil {
+		t.Errorf("expected error joining keys of different lengths")
+	}
+}
+
+func TestMergeJoinOfSortedInputs(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	plan, rows := queryRows(t, c, bp, "select a.s_id, b.t_id from (select s_id from s order by s_id) a join (select s_id, t_id from s order by s_id) b on a.s_id = b.s_id")
+	merge := func(op Operator) bool { _, ok := op.(*SortMergeJoin); return ok }
+	sorts := func(op Operator) bool { _, ok := op.(*OrderBy); return ok }
+	if !planHas(plan, merge) {
+		t.Errorf("expected inputs sorted on the join keys to be merged")
+	}
+	if len(rows) != 50 {
+		t.Fatalf("expected 50 results, got %d", len(rows))
+	}
+	for i, row := range rows {
+		if row[0] != (IntField{int64(i)}) || row[1] != (IntField{int64(i % 5)}) {
+			t.Fatalf("expected the results in order of the join key, got %v at position %d", row, i)
+		}
+	}
+
+	// the output of a merge join is sorted, so it needs no sort for a further merge
+	c2, _ := makeJoinStatsTestCatalog(t)
+	r, _ := c2.GetTable("r")
+	s, _ := c2.GetTable("s")
+	rKey := []Expr{&FieldExpr{FieldType{"s_id", "r", IntType}}}
+	sKey := []Expr{&FieldExpr{FieldType{"s_id", "s", IntType}}}
+	first, err := NewSortMergeJoin(r, rKey, s, sKey, InnerJoin, bp, 1000000)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	second, err := NewSortMergeJoin(first, sKey, s, sKey, InnerJoin, bp, 1000000)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if second.left != first || !planHas(second.right, sorts) {
+		t.Errorf("expected only the unsorted input of the second join to be sorted")
+	}
+}
+
+func TestJoinPlanning(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+
+	// a join on several columns is a single join with a composite key
+	plan, rows := queryRows(t, c, bp, "select r.r_id from r, s where r.s_id = s.s_id and r.r_id = s.t_id")
+	if len(rows) != 5 {
+		t.Errorf("expected 5 results of a join on two columns, got %d", len(rows))
+	}
+	joins := 0
+	planHas(plan, func(op Operator) bool {
+		if _, ok := op.(*EqualityJoin[string]); ok {
+			joins++
+		}
+		if _, ok := op.(*EqualityJoin[int64]); ok {
+			joins++
+		}
+		return false
+	})
+	if joins != 1 {
+		t.Errorf("expected a single join on a composite key, got %d joins", joins)
+	}
+	_, rows = queryRows(t, c, bp, "select r.r_id from r left join s on r.s_id = s.s_id and r.r_id = s.t_id")
+	if len(rows) != 500 || countNulls(rows, 0) != 0 {
+		t.Errorf("expected 500 results of an outer join on two columns, got %d", len(rows))
+	}
+
+	// a condition between tables that are already joined filters the join
+	_, rows = queryRows(t, c, bp, "select r.r_id from r, s, t where r.s_id = s.s_id and s.t_id = t.t_id and r.s_id = t.t_id")
+	if len(rows) != 50 {
+		t.Errorf("expected 50 results of a cycle of join conditions, got %d", len(rows))
+	}
+
+	// inputs larger than the join buffer are partitioned
+	bufferSize := JoinBufferSize
+	JoinBufferSize = 100
+	defer func() { JoinBufferSize = bufferSize }()
+	grace := func(op Operator) bool { _, ok := op.(*GraceHashJoin); return ok }
+	for _, tc := range []struct {
+		sql  string
+		rows int
+	}{
+		{"select r.r_id, s.t_id from s join r on r.s_id = s.s_id", 500},
+		{"select r.r_id, s.t_id from s left join r on r.s_id = s.s_id", 500},
+		{"select r.r_id from r, s where r.s_id = s.s_id and r.r_id = s.t_id", 5},
+	} {
+		plan, rows := queryRows(t, c, bp, tc.sql)
+		if !planHas(plan, grace) {
+			t.Errorf("expected a grace hash join for %s, got\n%s", tc.sql, planLabel(plan))
+		}
+		if len(rows) != tc.rows {
+			t.Errorf("expected %d results for %s, got %d", tc.rows, tc.sql, len(rows))
+		}
+	}
+}
+
+func TestSemiAndAntiJoinOps(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	// s_id 0 to 9 of r match nothing in s, and neither do the NULLs
+	runIntColumnQuery(t, c, bp, "delete from s where s_id < 10", 0)
+	runIntColumnQuery(t, c, bp, "update r set s_id = null where r_id >= 490", 0)
+	r, _ := c.GetTable("r")
+	s, _ := c.GetTable("s")
+	key := &FieldExpr{FieldType{"s_id", "", IntType}}
+	tKey := &FieldExpr{FieldType{"t_id", "", IntType}}
+	// with a buffer of 7 records, the left input is hashed in several blocks
+	for _, buffer := range []int{7, 1000} {
+		for _, tc := range []struct {
+			joinType JoinType
+			right    Operator
+			rightKey Expr
+			expected int
+		}{
+			{SemiJoin, s, key, 390},
+			{AntiJoin, s, key, 110},
+			{NullAwareAntiJoin, s, key, 100},
+			// t_id 0 to 4 of s match r's s_id 0 to 4, which have been deleted from s
+			{SemiJoin, s, tKey, 50},
+		} {
+			join, err := NewEqualityJoin(r, key, tc.right, tc.rightKey, tc.joinType, buffer)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if len(join.Descriptor().Fields) != len(r.Descriptor().Fields) {
+				t.Errorf("expected a %s join to return the fields of its left input", joinTypeNames[tc.joinType])
+			}
+			tid := bp.Transactions().Begin()
+			results := sortedResultStrings(t, join, tid)
+			tid.Commit()
+			if len(results) != tc.expected {
+				t.Errorf("%s join with buffer %d: expected %d results, got %d", joinTypeNames[tc.joinType], buffer, tc.expected, len(results))
+			}
+		}
+	}
+
+	// a NULL key in the right input makes NOT IN unknown for every record
+	runIntColumnQuery(t, c, bp, "update s set s_id = null where s_id = 10", 0)
+	join, err := NewEqualityJoin(r, key, s, key, NullAwareAntiJoin, 7)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := bp.Transactions().Begin()
+	defer tid.Commit()
+	if results := sortedResultStrings(t, join, tid); len(results) != 0 {
+		t.Errorf("expected no results of a null-aware anti join with a NULL key, got %d", len(results))
+	}
+	if _, err := NewSortMergeJoin(r, []Expr{key}, s, []Expr{key}, SemiJoin, bp, 1000); err == nil {
+		t.Errorf("expected an error for a semi merge join")
+	}
+}
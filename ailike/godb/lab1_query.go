@@ -35,7 +35,7 @@ func computeFieldSum(fileName string, td TupleDesc, sumField string) (int, error
 		return -1, err
 	}
 
-	tid := NewTID()
+	tid := bp.Transactions().Begin()
 	nextTuple, err := hf.Iterator(tid)
 	if err != nil {
 		return -1, err
@@ -48,7 +48,7 @@ func computeFieldSum(fileName string, td TupleDesc, sumField string) (int, error
 		sum += v
 	}
 
-	err = os.Remove(TEMP_FILE_NAME)
+	err = sharedFiles.remove(TEMP_FILE_NAME)
 	if err != nil {
 		return -1, err
 	}
@@ -81,11 +81,10 @@ func makeOrderByOrderingVars() (*HeapFile, Tuple, TupleDesc, *BufferPool) {
 func TestSetDirty(t *testing.T) {
 
 	_, t1, _, hf, bp, _ := makeTestVars()
-	tid := NewTID()
+	tid := bp.Transactions().Begin()
 
-	bp.BeginTransaction(tid)
-
-	nTuplesperPage := PageSize / hf.desc.sizeInBytes()
+	slots, _ := hf.desc.getNumSlotsPerPage(PageSize)
+	nTuplesperPage := int(slots)
 	nPages := bp.numPages
 
 	nTuplesInserted := nPages * nTuplesperPage
@@ -97,15 +96,14 @@ func TestSetDirty(t *testing.T) {
 			t.Fatalf("%v", err)
 		}
 	}
-	bp.CommitTransaction(tid)
+	tid.Commit()
 	t.Fatalf("Expected error due to all pages in BufferPool being dirty")
 }
 
 func TestDirtyBit(t *testing.T) {
 	_, t1, _, hf, bp, _ := makeTestVars()
 
-	tid := NewTID()
-	bp.BeginTransaction(tid)
+	tid := bp.Transactions().Begin()
 	hf.insertTuple(&t1, tid)
 	hf.insertTuple(&t1, tid)
 	page, _ := bp.GetPage(hf, 0, tid, ReadPerm)
@@ -117,8 +115,7 @@ func TestDirtyBit(t *testing.T) {
 func TestJoinFieldOrder(t *testing.T) {
 	hf1, hf2, t1, t2, bp := makeJoinOrderingVars()
 
-	tid := NewTID()
-	bp.BeginTransaction(tid)
+	tid := bp.Transactions().Begin()
 
 	hf1.insertTuple(&t1, tid)
 	hf2.insertTuple(&t2, tid)
@@ -159,8 +156,7 @@ func TestJoinFieldOrder(t *testing.T) {
 func TestOrderByFieldsOrder(t *testing.T) {
 	hf, tup, td, bp := makeOrderByOrderingVars()
 
-	tid := NewTID()
-	bp.BeginTransaction(tid)
+	tid := bp.Transactions().Begin()
 	hf.insertTuple(&tup, tid)
 
 	bs := make([]bool, 2)
@@ -199,8 +195,7 @@ func TestOrderByFieldsOrder(t *testing.T) {
 func TestProjectOrdering(t *testing.T) {
 	hf, tup, td, bp := makeOrderByOrderingVars()
 
-	tid := NewTID()
-	bp.BeginTransaction(tid)
+	tid := bp.Transactions().Begin()
 	hf.insertTuple(&tup, tid)
 
 	var outNames = []string{"out1", "out2"}
@@ -360,8 +355,7 @@ func TestProjectExtra(t *testing.T) {
 
 func TestHeapFileIteratorExtra(t *testing.T) {
 	_, t1, _, hf, bp, _ := makeTestVars()
-	tid := NewTID()
-	bp.BeginTransaction(tid)
+	tid := bp.Transactions().Begin()
 
 	it, err := hf.Iterator(tid)
 	_, err = it()
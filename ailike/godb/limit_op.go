@@ -3,6 +3,7 @@ package godb
 type LimitOp struct {
 	child     Operator //required fields for parser
 	limitTups Expr
+	offset    Expr // if non-nil, the number of tuples to skip before the first one returned
 }
 
 // Limit constructor -- should save how many tuples to return and the child op.
@@ -11,6 +12,12 @@ func NewLimitOp(lim Expr, child Operator) *LimitOp {
 	return &LimitOp{child: child, limitTups: lim}
 }
 
+// Skips the first offset tuples of the child, as in LIMIT n OFFSET m.  Like the
+// limit, offset must be a constant.
+func (l *LimitOp) SetOffset(offset Expr) {
+	l.offset = offset
+}
+
 // Return a TupleDescriptor for this limit
 func (l *LimitOp) Descriptor() *TupleDesc {
 	return l.child.Descriptor()
@@ -19,7 +26,7 @@ func (l *LimitOp) Descriptor() *TupleDesc {
 // Limit operator implementation. This function should iterate over the
 // results of the child iterator, and limit the result set to the first
 // [lim] tuples it sees (where lim is specified in the constructor).
-func (l *LimitOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+func (l *LimitOp) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
 	childIter, err := l.child.Iterator(tid)
 	if err != nil {
 		return nil, err
@@ -33,8 +40,27 @@ func (l *LimitOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
 		return nil, err
 	}
 	limit := limitVal.(IntField).Value
+	var skip int64 = 0
+	if l.offset != nil {
+		offsetVal, err := l.offset.EvalExpr(nil)
+		if err != nil {
+			return nil, err
+		}
+		skip = offsetVal.(IntField).Value
+	}
 	var i int64 = 0
 	return func() (*Tuple, error) {
+		for ; skip > 0; skip-- {
+			t, err := childIter()
+			if err != nil {
+				return nil, err
+			}
+			if t == nil {
+				// fewer tuples than the offset
+				skip, i = 0, limit
+				return nil, nil
+			}
+		}
 		if i < limit {
 			t, err := childIter()
 			if err != nil {
@@ -1,6 +1,7 @@
 package godb
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -8,8 +9,7 @@ func testLimitCount(t *testing.T, n int) {
 	_, t1, t2, hf, bp, _ := makeTestVars()
 
 	for i := 0; i < n; i++ {
-		tid := NewTID()
-		bp.BeginTransaction(tid)
+		tid := bp.Transactions().Begin()
 		err := hf.insertTuple(&t1, tid)
 		if err != nil {
 			t.Errorf(err.Error())
@@ -39,13 +39,12 @@ func testLimitCount(t *testing.T, n int) {
 
 		//commit frequently to prevent buffer pool from filling
 		//todo fix
-		bp.CommitTransaction(tid)
+		tid.Commit()
 
 	}
 
 	// check results
-	tid := NewTID()
-	bp.BeginTransaction(tid)
+	tid := bp.Transactions().Begin()
 	lim := NewLimitOp(&ConstExpr{IntField{int64(n)}, IntType}, hf)
 	if lim == nil {
 		t.Fatalf("Op was nil")
@@ -73,7 +72,7 @@ func testLimitCount(t *testing.T, n int) {
 		t.Errorf("unexpected number of results")
 	}
 
-	bp.CommitTransaction(tid)
+	tid.Commit()
 }
 
 func TestLimit5(t *testing.T) {
@@ -87,3 +86,99 @@ func TestLimit50(t *testing.T) {
 func TestLimit100(t *testing.T) {
 	testLimitCount(t, 100)
 }
+
+func TestLimitOffset(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	for _, tc := range []struct {
+		sql      string
+		expected []int64
+	}{
+		{"select r_id from r order by r_id limit 3 offset 20", []int64{20, 21, 22}},
+		{"select r_id from r order by r_id desc limit 3 offset 1", []int64{498, 497, 496}},
+		{"select r_id from r order by r_id limit 20, 3", []int64{20, 21, 22}},
+		{"select r_id from r order by r_id limit 5 offset 498", []int64{498, 499}},
+		{"select r_id from r order by r_id limit 5 offset 500", nil},
+		{"select t_id from t union select s_id from s where s_id < 8 order by t_id limit 2 offset 5", []int64{5, 6}},
+	} {
+		_, vals := runIntColumnQuery(t, c, bp, tc.sql, 0)
+		if len(vals) != len(tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.sql, tc.expected, vals)
+			continue
+		}
+		for i := range vals {
+			if vals[i] != tc.expected[i] {
+				t.Errorf("%s: expected %v, got %v", tc.sql, tc.expected, vals)
+				break
+			}
+		}
+	}
+
+	// the sort keeps the records up to the end of the window
+	_, plan, err := Parse(c, "select r_id from r order by r_id limit 3 offset 20")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if oby := plan.(*LimitOp).child.(*OrderBy); oby.limit == nil || limitValue(oby.limit) != 23 {
+		t.Errorf("expected a top 23 sort, got %s", planLabel(oby))
+	}
+
+	for _, sql := range []string{
+		"select r_id from r order by r_id limit 3 offset r_id",
+		"select r_id from r order by r_id limit s_id offset 3",
+	} {
+		if _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected an error parsing %s", sql)
+		}
+	}
+}
+
+func TestKeysetPagination(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	// r has 10 records with each s_id, so pages end in the middle of ties
+	for _, order := range []string{"asc", "desc"} {
+		seen := make(map[int64]bool)
+		sql := "select r_id, s_id, rid() from r order by s_id " + order + " limit 7"
+		last := int64(-1)
+		for pages := 0; pages < 100; pages++ {
+			_, rows := queryRows(t, c, bp, sql)
+			if len(rows) == 0 {
+				break
+			}
+			for _, row := range rows {
+				rid, sid := row[0].(IntField).Value, row[1].(IntField).Value
+				if seen[rid] {
+					t.Fatalf("record %d returned twice, %s", rid, sql)
+				}
+				seen[rid] = true
+				if last >= 0 && (order == "asc" && sid < last || order == "desc" && sid > last) {
+					t.Fatalf("records out of order, %s", sql)
+				}
+				last = sid
+			}
+			end := rows[len(rows)-1]
+			sql = fmt.Sprintf("select r_id, s_id, rid() from r order by s_id %s limit 7 after %d, %d", order, end[1].(IntField).Value, end[2].(IntField).Value)
+		}
+		if len(seen) != 500 {
+			t.Errorf("expected 500 records over all pages, got %d", len(seen))
+		}
+	}
+
+	// the cursor can be on a column that is not selected, and on a filtered table
+	_, vals := runIntColumnQuery(t, c, bp, "select r_id from r where r_id < 100 order by s_id limit 3 after 49, 0", 0)
+	if len(vals) != 2 || vals[0] != 49 || vals[1] != 99 {
+		t.Errorf("expected 49 and 99, got %v", vals)
+	}
+	for _, sql := range []string{
+		"select r_id from r order by s_id after 3, 0",
+		"select r_id from r order by s_id, r_id limit 3 after 3, 0",
+		"select r_id from r order by s_id limit 3 offset 3 after 3, 0",
+		"select s_id, count(*) from r group by s_id order by s_id limit 3 after 3, 0",
+		"select r_id from r order by s_id limit 3 after 3",
+		"select r_id from r order by s_id limit 3 after 3, 0 where r_id > 3",
+		"delete from r where r_id < 3 after 3, 0",
+	} {
+		if _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected an error parsing %s", sql)
+		}
+	}
+}
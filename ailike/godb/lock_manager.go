@@ -0,0 +1,574 @@
+package godb
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A LockManager grants the locks transactions hold until they complete.  Locks
+// are hierarchical: a transaction can lock a table, a page of it, or a record
+// on a page, and before it locks a page or a record, it takes an intention
+// lock on each level above, which says that it holds locks below it.  So a
+// transaction writing one record holds an IX lock on the table, an IX lock on
+// the page and an X lock on the record, and other transactions can write the
+// other records of the page, but not lock the whole page or table.  A lock on
+// a table or page covers everything below it, so a transaction that holds one
+// takes no locks below it.
+//
+// A transaction that locks many records of a page, or many pages or records of
+// a table, has its locks escalated: it locks the page or table instead, and
+// releases the locks below it, so that the number of locks it holds stays
+// small (see [LockManager.SetEscalationThresholds]).
+//
+// Each lockable item has a queue of the requests waiting for a lock on it,
+// which are granted in FIFO order: a request is not granted while an earlier
+// one is waiting, so a transaction waiting for a write lock is not starved by
+// transactions that keep asking for read locks.  The exception is a lock
+// upgrade, by a transaction that holds a lock and asks for a stronger one,
+// which goes to the front of the queue, since the requests behind it could
+// never be granted before it anyway.
+//
+// Waiting transactions sleep on a condition variable of the item's queue, and
+// are woken when requests are granted.  Deadlocks are detected as a request
+// starts to wait, by looking for a cycle in the graph of which transactions
+// wait for which, across the items of every level; one transaction in the
+// cycle is chosen as the victim by the [VictimPolicy], and its waiting request
+// fails with a DeadlockError.
+type LockManager struct {
+	mutex      sync.Mutex
+	queues     map[lockKey]*lockQueue
+	held       map[*Transaction]map[lockKey]LockMode // the locks each transaction holds
+	heldBelow  map[*Transaction]map[lockKey]int      // the number of those below each table and page
+	waitingFor map[*Transaction]*lockRequest         // the request each transaction is waiting on
+	policy     VictimPolicy
+	// the number of record locks a transaction may hold on a page, and of page
+	// and record locks on a table, before they are escalated
+	pageThreshold  int
+	tableThreshold int
+}
+
+// Which transaction in a deadlock is aborted to break it.
+type VictimPolicy int
+
+const (
+	// the transaction that started last, which has likely done the least work
+	YoungestVictim VictimPolicy = iota
+	// the transaction that holds the fewest locks, or the youngest of those
+	FewestLocksVictim VictimPolicy = iota
+)
+
+// The modes in which locks are held.  S and X locks allow a transaction to
+// read, and to read and write, the item they lock and everything below it.
+// Intention locks allow it to take locks of the corresponding mode below the
+// item: IS locks allow S locks, and IX locks allow S and X locks.  A SIX lock
+// is an S lock and an IX lock together, held by a transaction that reads a
+// whole item and writes parts of it.
+type LockMode int
+
+const (
+	IntentionSharedLock          LockMode = iota // IS
+	IntentionExclusiveLock       LockMode = iota // IX
+	SharedLock                   LockMode = iota // S
+	SharedIntentionExclusiveLock LockMode = iota // SIX
+	ExclusiveLock                LockMode = iota // X
+)
+
+func (m LockMode) String() string {
+	switch m {
+	case IntentionSharedLock:
+		return "IS"
+	case IntentionExclusiveLock:
+		return "IX"
+	case SharedLock:
+		return "S"
+	case SharedIntentionExclusiveLock:
+		return "SIX"
+	case ExclusiveLock:
+		return "X"
+	}
+	return fmt.Sprintf("LockMode(%d)", int(m))
+}
+
+// lockCompatible[a][b] is true if one transaction can hold a lock in mode a
+// while another holds one in mode b on the same item.
+var lockCompatible = [5][5]bool{
+	IntentionSharedLock:          {true, true, true, true, false},
+	IntentionExclusiveLock:       {true, true, false, false, false},
+	SharedLock:                   {true, false, true, false, false},
+	SharedIntentionExclusiveLock: {true, false, false, false, false},
+	ExclusiveLock:                {false, false, false, false, false},
+}
+
+// Returns true if a lock in mode m allows everything a lock in mode other does.
+func (m LockMode) covers(other LockMode) bool {
+	switch m {
+	case ExclusiveLock:
+		return true
+	case SharedIntentionExclusiveLock:
+		return other != ExclusiveLock
+	case SharedLock, IntentionExclusiveLock:
+		return other == m || other == IntentionSharedLock
+	}
+	return other == IntentionSharedLock
+}
+
+// Returns the weakest mode that allows everything modes m and other do.
+func (m LockMode) combine(other LockMode) LockMode {
+	if m.covers(other) {
+		return m
+	}
+	if other.covers(m) {
+		return other
+	}
+	// S and IX are the only modes neither of which covers the other
+	return SharedIntentionExclusiveLock
+}
+
+// Returns true if a lock in mode m on an item allows a transaction to lock the
+// items below it in the given mode without locking them.
+func (m LockMode) coversBelow(mode LockMode) bool {
+	if m == ExclusiveLock {
+		return true
+	}
+	return (m == SharedLock || m == SharedIntentionExclusiveLock) && (mode == SharedLock || mode == IntentionSharedLock)
+}
+
+// Returns the intention lock to take above an item locked in mode m.
+func (m LockMode) intention() LockMode {
+	if m == IntentionSharedLock || m == SharedLock {
+		return IntentionSharedLock
+	}
+	return IntentionExclusiveLock
+}
+
+// Returns true if a lock in mode m allows a transaction to write.
+func (m LockMode) writes() bool {
+	return m == IntentionExclusiveLock || m == SharedIntentionExclusiveLock || m == ExclusiveLock
+}
+
+// Returns the mode of the lock that gives a transaction the permission.
+func lockModeFor(perm RWPerm) LockMode {
+	if perm == WritePerm {
+		return ExclusiveLock
+	}
+	return SharedLock
+}
+
+// The items that can be locked: tables, identified by a [tableLockKey], pages,
+// identified by their [BufferPoolKey], and records, identified by their
+// [heapRecordId].
+type lockKey interface {
+	getFileName() string
+}
+
+type tableLockKey struct {
+	fileName string
+}
+
+func (k tableLockKey) getFileName() string {
+	return k.fileName
+}
+
+func (rid heapRecordId) getFileName() string {
+	return rid.fileName
+}
+
+// Returns the item above key, which is nil for tables.
+func parentLockKey(key lockKey) lockKey {
+	switch key := key.(type) {
+	case tableLockKey:
+		return nil
+	case heapRecordId:
+		return HeapFilePageKey{key.fileName, key.pageNo}
+	}
+	return tableLockKey{key.getFileName()}
+}
+
+type lockQueue struct {
+	holders map[*Transaction]LockMode
+	waiting []*lockRequest
+	cond    *sync.Cond
+}
+
+type lockRequest struct {
+	tid     *Transaction
+	key     lockKey
+	mode    LockMode
+	granted bool
+	err     error // set if the request failed while waiting
+}
+
+// The number of record locks a transaction may hold on a page before they are
+// escalated to a lock on the page, and of page and record locks on a table
+// before they are escalated to a lock on the table.
+const DEFAULT_PAGE_LOCK_THRESHOLD = 32
+const DEFAULT_TABLE_LOCK_THRESHOLD = 512
+
+func NewLockManager(policy VictimPolicy) *LockManager {
+	return &LockManager{
+		queues:         make(map[lockKey]*lockQueue),
+		held:           make(map[*Transaction]map[lockKey]LockMode),
+		heldBelow:      make(map[*Transaction]map[lockKey]int),
+		waitingFor:     make(map[*Transaction]*lockRequest),
+		policy:         policy,
+		pageThreshold:  DEFAULT_PAGE_LOCK_THRESHOLD,
+		tableThreshold: DEFAULT_TABLE_LOCK_THRESHOLD,
+	}
+}
+
+// Sets how victims of deadlocks are chosen.
+func (lm *LockManager) SetVictimPolicy(policy VictimPolicy) {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	lm.policy = policy
+}
+
+// Sets how many record locks a transaction may hold on one page, and how many
+// page and record locks it may hold on one table, before they are escalated
+// to a lock on the page or table.
+func (lm *LockManager) SetEscalationThresholds(page int, table int) {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	lm.pageThreshold = page
+	lm.tableThreshold = table
+}
+
+func (lm *LockManager) queue(key lockKey) *lockQueue {
+	q, ok := lm.queues[key]
+	if !ok {
+		q = &lockQueue{holders: make(map[*Transaction]LockMode), cond: sync.NewCond(&lm.mutex)}
+		lm.queues[key] = q
+	}
+	return q
+}
+
+// Blocks until tid holds a lock on the page with the given key, with at least
+// the given permission, and the intention locks above it.  Returns a
+// DeadlockError if tid is chosen as the victim of a deadlock while it waits, a
+// TransactionTimeoutError if it reaches its deadline, or an
+// IllegalTransactionError if it is aborted.
+func (lm *LockManager) acquire(tid *Transaction, key BufferPoolKey, perm RWPerm) error {
+	return lm.lock(tid, key, lockModeFor(perm))
+}
+
+// Like [LockManager.acquire], but locks the record with the given rid.
+func (lm *LockManager) acquireRecord(tid *Transaction, rid heapRecordId, perm RWPerm) error {
+	return lm.lock(tid, rid, lockModeFor(perm))
+}
+
+// Blocks until tid holds a lock on key in at least the given mode, taking the
+// intention locks above it first, and then escalates tid's locks if it holds
+// too many.  Nothing is locked if tid holds a lock above key that covers it.
+func (lm *LockManager) lock(tid *Transaction, key lockKey, mode LockMode) error {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	var path []lockKey
+	for k := key; k != nil; k = parentLockKey(k) {
+		path = append([]lockKey{k}, path...)
+	}
+	for _, k := range path[:len(path)-1] {
+		if held, ok := lm.held[tid][k]; ok && held.coversBelow(mode) {
+			return nil
+		}
+		if err := lm.wait(tid, k, mode.intention()); err != nil {
+			return err
+		}
+	}
+	if err := lm.wait(tid, key, mode); err != nil {
+		return err
+	}
+	return lm.escalate(tid, key)
+}
+
+// Blocks until tid holds a lock on key in at least the given mode.  Must be
+// called with the mutex held.
+func (lm *LockManager) wait(tid *Transaction, key lockKey, mode LockMode) error {
+	q := lm.queue(key)
+	held, upgrade := q.holders[tid]
+	if upgrade && held.covers(mode) {
+		return nil
+	}
+	req := &lockRequest{tid: tid, key: key, mode: mode}
+	if upgrade {
+		req.mode = held.combine(mode)
+		q.waiting = append([]*lockRequest{req}, q.waiting...)
+	} else {
+		q.waiting = append(q.waiting, req)
+	}
+	lm.grant(q)
+	if req.granted {
+		return nil
+	}
+	lm.waitingFor[tid] = req
+	if cycle := lm.findCycle(tid); cycle != nil {
+		lm.cancel(lm.waitingFor[lm.chooseVictim(cycle)], ailikeError{DeadlockError, "Deadlock detected."})
+	}
+	if !req.granted && req.err == nil && !tid.deadline.IsZero() {
+		timer := time.AfterFunc(time.Until(tid.deadline), func() {
+			lm.mutex.Lock()
+			defer lm.mutex.Unlock()
+			if !req.granted && req.err == nil {
+				lm.cancel(req, tid.timeoutError())
+			}
+		})
+		defer timer.Stop()
+	}
+	for !req.granted && req.err == nil {
+		q.cond.Wait()
+	}
+	return req.err
+}
+
+// Escalates tid's locks below the page or table of key if it holds more of
+// them than the thresholds allow, locking the page or table in S mode, or in
+// X mode if any of them allow writes, and then releasing them.  Must be called
+// with the mutex held.
+func (lm *LockManager) escalate(tid *Transaction, key lockKey) error {
+	for parent := parentLockKey(key); parent != nil; parent = parentLockKey(parent) {
+		threshold := lm.pageThreshold
+		if _, ok := parent.(tableLockKey); ok {
+			threshold = lm.tableThreshold
+		}
+		if lm.heldBelow[tid][parent] <= threshold {
+			continue
+		}
+		below := lm.locksBelow(tid, parent)
+		mode := SharedLock
+		if lm.held[tid][parent].writes() {
+			mode = ExclusiveLock
+		}
+		if err := lm.wait(tid, parent, mode); err != nil {
+			return err
+		}
+		for _, k := range below {
+			lm.release(tid, k)
+		}
+	}
+	return nil
+}
+
+// Returns the items below parent that tid holds locks on.
+func (lm *LockManager) locksBelow(tid *Transaction, parent lockKey) []lockKey {
+	var below []lockKey
+	for k := range lm.held[tid] {
+		for p := parentLockKey(k); p != nil; p = parentLockKey(p) {
+			if p == parent {
+				below = append(below, k)
+				break
+			}
+		}
+	}
+	return below
+}
+
+// Grants the requests at the front of the queue that are compatible with the
+// locks that are held, waking the transactions waiting on it if any are.
+func (lm *LockManager) grant(q *lockQueue) {
+	granted := false
+	for len(q.waiting) > 0 && q.compatible(q.waiting[0]) {
+		req := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		if held, ok := q.holders[req.tid]; ok {
+			q.holders[req.tid] = held.combine(req.mode)
+		} else {
+			q.holders[req.tid] = req.mode
+		}
+		if _, ok := lm.held[req.tid]; !ok {
+			lm.held[req.tid] = make(map[lockKey]LockMode)
+			lm.heldBelow[req.tid] = make(map[lockKey]int)
+		}
+		if _, ok := lm.held[req.tid][req.key]; !ok {
+			lm.countBelow(req.tid, req.key, 1)
+		}
+		lm.held[req.tid][req.key] = q.holders[req.tid]
+		delete(lm.waitingFor, req.tid)
+		req.granted = true
+		granted = true
+	}
+	if granted {
+		q.cond.Broadcast()
+	}
+}
+
+// Adds delta to the number of locks tid holds below each item above key.
+func (lm *LockManager) countBelow(tid *Transaction, key lockKey, delta int) {
+	for p := parentLockKey(key); p != nil; p = parentLockKey(p) {
+		lm.heldBelow[tid][p] += delta
+		if lm.heldBelow[tid][p] == 0 {
+			delete(lm.heldBelow[tid], p)
+		}
+	}
+}
+
+// Returns true if req can be granted given the locks held by other
+// transactions.
+func (q *lockQueue) compatible(req *lockRequest) bool {
+	for tid, mode := range q.holders {
+		if tid != req.tid && !lockCompatible[req.mode][mode] {
+			return false
+		}
+	}
+	return true
+}
+
+// Fails a waiting request with err, removing it from its queue.
+func (lm *LockManager) cancel(req *lockRequest, err error) {
+	q := lm.queues[req.key]
+	for i, waiting := range q.waiting {
+		if waiting == req {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			break
+		}
+	}
+	delete(lm.waitingFor, req.tid)
+	req.err = err
+	q.cond.Broadcast()
+	// the requests behind it may now be granted
+	lm.grant(q)
+}
+
+// Returns the transactions req waits for: those holding locks it conflicts
+// with, and those with requests ahead of it in the queue.
+func (lm *LockManager) waitsFor(req *lockRequest) []*Transaction {
+	q := lm.queues[req.key]
+	var tids []*Transaction
+	for tid, mode := range q.holders {
+		if tid != req.tid && !lockCompatible[req.mode][mode] {
+			tids = append(tids, tid)
+		}
+	}
+	for _, waiting := range q.waiting {
+		if waiting == req {
+			break
+		}
+		if waiting.tid != req.tid {
+			tids = append(tids, waiting.tid)
+		}
+	}
+	return tids
+}
+
+// Returns the transactions in a cycle of the wait-for graph through tid, or nil
+// if there is none.
+func (lm *LockManager) findCycle(tid *Transaction) []*Transaction {
+	visited := make(map[*Transaction]bool)
+	var path []*Transaction
+	var search func(*Transaction) bool
+	search = func(cur *Transaction) bool {
+		req, waiting := lm.waitingFor[cur]
+		if !waiting {
+			return false
+		}
+		visited[cur] = true
+		path = append(path, cur)
+		for _, next := range lm.waitsFor(req) {
+			if next == tid {
+				return true
+			}
+			if !visited[next] && search(next) {
+				return true
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if search(tid) {
+		return path
+	}
+	return nil
+}
+
+// Chooses the transaction in cycle to abort according to the victim policy.
+// Transaction ids are handed out in increasing order, so the youngest
+// transaction has the largest id.
+func (lm *LockManager) chooseVictim(cycle []*Transaction) *Transaction {
+	victim := cycle[0]
+	for _, tid := range cycle[1:] {
+		younger := tid.id > victim.id
+		switch lm.policy {
+		case YoungestVictim:
+			if younger {
+				victim = tid
+			}
+		case FewestLocksVictim:
+			locks, victimLocks := len(lm.held[tid]), len(lm.held[victim])
+			if locks < victimLocks || (locks == victimLocks && younger) {
+				victim = tid
+			}
+		default:
+			panic(fmt.Sprintf("unknown victim policy %d", lm.policy))
+		}
+	}
+	return victim
+}
+
+// Releases the locks held by tid, and fails the request it is waiting on, if
+// any.
+func (lm *LockManager) releaseAll(tid *Transaction) {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	if req, ok := lm.waitingFor[tid]; ok {
+		lm.cancel(req, ailikeError{IllegalTransactionError, "Transaction completed while waiting for a lock."})
+	}
+	for key := range lm.held[tid] {
+		lm.release(tid, key)
+	}
+	delete(lm.held, tid)
+	delete(lm.heldBelow, tid)
+}
+
+// Releases tid's lock on key.
+func (lm *LockManager) release(tid *Transaction, key lockKey) {
+	q := lm.queues[key]
+	delete(q.holders, tid)
+	if _, ok := lm.held[tid][key]; ok {
+		delete(lm.held[tid], key)
+		lm.countBelow(tid, key, -1)
+	}
+	lm.grant(q)
+	if len(q.holders) == 0 && len(q.waiting) == 0 {
+		delete(lm.queues, key)
+	}
+}
+
+// Releases the locks on the file with the given name and on its pages and
+// records; the file is private to one operator.
+func (lm *LockManager) releaseFile(fileName string) {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	for tid, locks := range lm.held {
+		for key := range locks {
+			if key.getFileName() == fileName {
+				lm.release(tid, key)
+			}
+		}
+	}
+}
+
+// Returns the transactions that may write the page with the given key: those
+// holding locks on it that allow writes, and those holding X locks on its
+// table.
+func (lm *LockManager) writers(key BufferPoolKey) []*Transaction {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	var tids []*Transaction
+	for _, k := range []lockKey{key, parentLockKey(key)} {
+		if q, ok := lm.queues[k]; ok {
+			for tid, mode := range q.holders {
+				if mode.writes() && (k == key || mode == ExclusiveLock) {
+					tids = append(tids, tid)
+				}
+			}
+		}
+	}
+	return tids
+}
+
+// Returns the mode of tid's lock on key, and false if it holds none.
+func (lm *LockManager) heldMode(tid *Transaction, key lockKey) (LockMode, bool) {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	mode, ok := lm.held[tid][key]
+	return mode, ok
+}
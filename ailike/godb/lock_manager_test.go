@@ -0,0 +1,258 @@
+package godb
+
+import (
+	"testing"
+	"time"
+)
+
+// Starts acquiring a lock in the background, returning a channel that receives
+// the result once the lock is granted or the request fails.
+func startAcquire(lm *LockManager, tid *Transaction, page int, perm RWPerm) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- lm.acquire(tid, HeapFilePageKey{"lock_test.dat", page}, perm)
+	}()
+	return done
+}
+
+func acquireNow(t *testing.T, lm *LockManager, tid *Transaction, page int, perm RWPerm) {
+	if err := <-startAcquire(lm, tid, page, perm); err != nil {
+		t.Fatalf("failed to acquire lock, %s", err.Error())
+	}
+}
+
+// Returns the result of a request, or false if it is still waiting.
+func requestDone(done chan error) (error, bool) {
+	select {
+	case err := <-done:
+		return err, true
+	case <-time.After(50 * time.Millisecond):
+		return nil, false
+	}
+}
+
+func expectGranted(t *testing.T, done chan error, what string) {
+	if err, ok := requestDone(done); !ok || err != nil {
+		t.Errorf("expected %s to be granted (done %t, err %v)", what, ok, err)
+	}
+}
+
+func expectWaiting(t *testing.T, done chan error, what string) {
+	if _, ok := requestDone(done); ok {
+		t.Errorf("expected %s to wait", what)
+	}
+}
+
+func expectDeadlock(t *testing.T, done chan error, what string) {
+	err, ok := requestDone(done)
+	if !ok || err == nil || err.(ailikeError).code != DeadlockError {
+		t.Errorf("expected %s to fail with a deadlock (done %t, err %v)", what, ok, err)
+	}
+}
+
+func TestLockManagerFIFO(t *testing.T) {
+	lm, tm := NewLockManager(YoungestVictim), NewBufferPool(1).Transactions()
+	tid1, tid2, tid3 := tm.Begin(), tm.Begin(), tm.Begin()
+	acquireNow(t, lm, tid1, 0, ReadPerm)
+
+	// a reader that arrives after a waiting writer waits behind it
+	write2 := startAcquire(lm, tid2, 0, WritePerm)
+	expectWaiting(t, write2, "write lock behind a read lock")
+	read3 := startAcquire(lm, tid3, 0, ReadPerm)
+	expectWaiting(t, read3, "read lock behind a waiting write lock")
+
+	lm.releaseAll(tid1)
+	expectGranted(t, write2, "write lock once the read lock is released")
+	expectWaiting(t, read3, "read lock behind a granted write lock")
+	lm.releaseAll(tid2)
+	expectGranted(t, read3, "read lock once the write lock is released")
+
+	// locks that are held are granted again at once, and a write lock covers
+	// reads
+	acquireNow(t, lm, tid3, 0, ReadPerm)
+	acquireNow(t, lm, tid1, 1, WritePerm)
+	acquireNow(t, lm, tid1, 1, ReadPerm)
+	if writers := lm.writers(HeapFilePageKey{"lock_test.dat", 1}); len(writers) != 1 || writers[0] != tid1 {
+		t.Errorf("expected the first transaction to hold the write lock, got %v", writers)
+	}
+	if mode, _ := lm.heldMode(tid1, tableLockKey{"lock_test.dat"}); mode != IntentionExclusiveLock {
+		t.Errorf("expected an IX lock on the table, got %v", mode)
+	}
+}
+
+// Starts locking a record in the background, like [startAcquire].
+func startAcquireRecord(lm *LockManager, tid *Transaction, page int, slot int, perm RWPerm) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- lm.acquireRecord(tid, heapRecordId{"lock_test.dat", page, slot}, perm)
+	}()
+	return done
+}
+
+func TestLockManagerIntentions(t *testing.T) {
+	lm, tm := NewLockManager(YoungestVictim), NewBufferPool(1).Transactions()
+	tid1, tid2, tid3, tid4 := tm.Begin(), tm.Begin(), tm.Begin(), tm.Begin()
+
+	// transactions writing different records of a page do not wait for each
+	// other, but a transaction locking the whole page or table does
+	expectGranted(t, startAcquireRecord(lm, tid1, 0, 0, WritePerm), "write lock on a record")
+	expectGranted(t, startAcquireRecord(lm, tid2, 0, 1, WritePerm), "write lock on another record of the page")
+	expectWaiting(t, startAcquireRecord(lm, tid3, 0, 0, ReadPerm), "read lock on a record being written")
+	read3 := startAcquire(lm, tid3, 0, ReadPerm)
+	expectWaiting(t, read3, "read lock on a page with records being written")
+	table4 := make(chan error, 1)
+	go func() { table4 <- lm.lock(tid4, tableLockKey{"lock_test.dat"}, SharedLock) }()
+	expectWaiting(t, table4, "read lock on a table with records being written")
+	if mode, _ := lm.heldMode(tid1, HeapFilePageKey{"lock_test.dat", 0}); mode != IntentionExclusiveLock {
+		t.Errorf("expected an IX lock on the page, got %v", mode)
+	}
+
+	lm.releaseAll(tid1)
+	lm.releaseAll(tid2)
+	expectGranted(t, table4, "read lock on the table once the writers are done")
+
+	// a lock on the table covers its pages and records
+	acquireNow(t, lm, tid4, 3, ReadPerm)
+	if _, ok := lm.heldMode(tid4, HeapFilePageKey{"lock_test.dat", 3}); ok {
+		t.Errorf("expected no page lock under a table lock")
+	}
+	if !SharedLock.covers(IntentionSharedLock) || ExclusiveLock.combine(SharedLock) != ExclusiveLock || SharedLock.combine(IntentionExclusiveLock) != SharedIntentionExclusiveLock {
+		t.Errorf("unexpected lock mode ordering")
+	}
+}
+
+func TestLockManagerEscalation(t *testing.T) {
+	lm, tm := NewLockManager(YoungestVictim), NewBufferPool(1).Transactions()
+	lm.SetEscalationThresholds(2, 3)
+	tid1, tid2 := tm.Begin(), tm.Begin()
+	for slot := 0; slot < 3; slot++ {
+		expectGranted(t, startAcquireRecord(lm, tid1, 0, slot, WritePerm), "write lock on a record")
+	}
+	// the third record lock on the page escalates to a lock on the page
+	if mode, _ := lm.heldMode(tid1, HeapFilePageKey{"lock_test.dat", 0}); mode != ExclusiveLock {
+		t.Errorf("expected an X lock on the page, got %v", mode)
+	}
+	if len(lm.held[tid1]) != 2 {
+		t.Errorf("expected only the page and table locks to remain, got %v", lm.held[tid1])
+	}
+
+	// the fourth page lock on the table escalates to a lock on the table
+	for page := 1; page < 4; page++ {
+		acquireNow(t, lm, tid1, page, ReadPerm)
+	}
+	if mode, _ := lm.heldMode(tid1, tableLockKey{"lock_test.dat"}); mode != ExclusiveLock {
+		t.Errorf("expected an X lock on the table, got %v", mode)
+	}
+	if len(lm.held[tid1]) != 1 {
+		t.Errorf("expected only the table lock to remain, got %v", lm.held[tid1])
+	}
+	read2 := startAcquireRecord(lm, tid2, 5, 0, ReadPerm)
+	expectWaiting(t, read2, "read lock on a record of an escalated table")
+	lm.releaseAll(tid1)
+	expectGranted(t, read2, "read lock once the escalated locks are released")
+}
+
+func TestLockManagerDeadlockAcrossLevels(t *testing.T) {
+	lm, tm := NewLockManager(YoungestVictim), NewBufferPool(1).Transactions()
+	tid1, tid2 := tm.Begin(), tm.Begin()
+	expectGranted(t, startAcquireRecord(lm, tid1, 0, 0, WritePerm), "write lock on a record")
+	expectGranted(t, startAcquireRecord(lm, tid2, 1, 0, WritePerm), "write lock on a record of another page")
+
+	// the first transaction waits for a page the second writes a record of,
+	// and the second for the record the first writes
+	read1 := startAcquire(lm, tid1, 1, ReadPerm)
+	expectWaiting(t, read1, "read lock on a page with a record being written")
+	expectDeadlock(t, startAcquireRecord(lm, tid2, 0, 0, ReadPerm), "read lock on the record of the waiting transaction")
+	lm.releaseAll(tid2)
+	expectGranted(t, read1, "read lock once the victim aborts")
+}
+
+func TestLockManagerUpgrade(t *testing.T) {
+	lm, tm := NewLockManager(YoungestVictim), NewBufferPool(1).Transactions()
+	tid1, tid2, tid3 := tm.Begin(), tm.Begin(), tm.Begin()
+	acquireNow(t, lm, tid1, 0, ReadPerm)
+	acquireNow(t, lm, tid2, 0, ReadPerm)
+	write3 := startAcquire(lm, tid3, 0, WritePerm)
+	expectWaiting(t, write3, "write lock behind read locks")
+
+	// the upgrade goes ahead of the waiting writer
+	upgrade1 := startAcquire(lm, tid1, 0, WritePerm)
+	expectWaiting(t, upgrade1, "upgrade while another transaction reads")
+	lm.releaseAll(tid2)
+	expectGranted(t, upgrade1, "upgrade once the only other reader is done")
+	expectWaiting(t, write3, "write lock behind an upgraded lock")
+	lm.releaseAll(tid1)
+	expectGranted(t, write3, "write lock once the upgraded lock is released")
+
+	// two readers upgrading deadlock, and the younger is the victim
+	tid4, tid5 := tm.Begin(), tm.Begin()
+	acquireNow(t, lm, tid4, 1, ReadPerm)
+	acquireNow(t, lm, tid5, 1, ReadPerm)
+	upgrade4 := startAcquire(lm, tid4, 1, WritePerm)
+	expectWaiting(t, upgrade4, "first upgrade")
+	upgrade5 := startAcquire(lm, tid5, 1, WritePerm)
+	expectDeadlock(t, upgrade5, "second upgrade")
+	lm.releaseAll(tid5)
+	expectGranted(t, upgrade4, "first upgrade once the victim is aborted")
+}
+
+func TestLockManagerVictimPolicy(t *testing.T) {
+	for _, policy := range []VictimPolicy{YoungestVictim, FewestLocksVictim} {
+		lm, tm := NewLockManager(policy), NewBufferPool(1).Transactions()
+		// the older transaction holds one lock, and the younger holds two
+		older, younger := tm.Begin(), tm.Begin()
+		acquireNow(t, lm, older, 0, WritePerm)
+		acquireNow(t, lm, younger, 1, WritePerm)
+		acquireNow(t, lm, younger, 2, ReadPerm)
+
+		// the younger transaction starts waiting first, so that the deadlock
+		// is found when the older one does
+		youngerWaits := startAcquire(lm, younger, 0, WritePerm)
+		expectWaiting(t, youngerWaits, "first request of the deadlock")
+		olderWaits := startAcquire(lm, older, 1, ReadPerm)
+		victim, survivor := youngerWaits, olderWaits
+		victimTid := younger
+		if policy == FewestLocksVictim {
+			victim, survivor = olderWaits, youngerWaits
+			victimTid = older
+		}
+		expectDeadlock(t, victim, "the victim's request")
+		expectWaiting(t, survivor, "the other request until the victim aborts")
+		lm.releaseAll(victimTid)
+		expectGranted(t, survivor, "the other request once the victim aborts")
+	}
+}
+
+func TestLockManagerReleaseWhileWaiting(t *testing.T) {
+	lm, tm := NewLockManager(YoungestVictim), NewBufferPool(1).Transactions()
+	tid1, tid2 := tm.Begin(), tm.Begin()
+	acquireNow(t, lm, tid1, 0, WritePerm)
+	write2 := startAcquire(lm, tid2, 0, WritePerm)
+	expectWaiting(t, write2, "write lock behind a write lock")
+
+	// a transaction that completes while it waits gives up its request
+	lm.releaseAll(tid2)
+	if err, ok := requestDone(write2); !ok || err == nil {
+		t.Errorf("expected the request of a completed transaction to fail")
+	}
+	lm.releaseAll(tid1)
+	if len(lm.queues) != 0 || len(lm.held) != 0 || len(lm.waitingFor) != 0 {
+		t.Errorf("expected no locks to remain")
+	}
+}
+
+// Transactions that take turns writing a page wait for each other without
+// polling.
+func BenchmarkLockContention(b *testing.B) {
+	lm, tm := NewLockManager(YoungestVictim), NewBufferPool(1).Transactions()
+	key := HeapFilePageKey{"lock_test.dat", 0}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			tid := tm.Begin()
+			if err := lm.acquire(tid, key, WritePerm); err != nil {
+				b.Error(err)
+			}
+			lm.releaseAll(tid)
+		}
+	})
+}
@@ -8,7 +8,7 @@ import (
 
 type LockGrabber struct {
 	bp   *BufferPool
-	tid  TransactionID
+	tid  *Transaction
 	file DBFile
 	pgNo int
 	perm RWPerm
@@ -18,7 +18,7 @@ type LockGrabber struct {
 	alock, elock sync.Mutex
 }
 
-func NewLockGrabber(bp *BufferPool, tid TransactionID, file DBFile, pgNo int, perm RWPerm) *LockGrabber {
+func NewLockGrabber(bp *BufferPool, tid *Transaction, file DBFile, pgNo int, perm RWPerm) *LockGrabber {
 	return &LockGrabber{bp, tid, file, pgNo, perm,
 		false, nil, sync.Mutex{}, sync.Mutex{}}
 }
@@ -35,7 +35,7 @@ func (lg *LockGrabber) run() {
 		lg.err = err
 		lg.elock.Unlock()
 
-		lg.bp.AbortTransaction(lg.tid)
+		lg.tid.Abort()
 	}
 }
 
@@ -51,14 +51,14 @@ func (lg *LockGrabber) getError() error {
 	return lg.err
 }
 
-func startGrabber(bp *BufferPool, tid TransactionID, file DBFile, pgNo int, perm RWPerm) *LockGrabber {
+func startGrabber(bp *BufferPool, tid *Transaction, file DBFile, pgNo int, perm RWPerm) *LockGrabber {
 	lg := NewLockGrabber(bp, tid, file, pgNo, perm)
 	go lg.run()
 	return lg
 }
 
 func grabLock(t *testing.T,
-	bp *BufferPool, tid TransactionID, file DBFile, pgNo int, perm RWPerm,
+	bp *BufferPool, tid *Transaction, file DBFile, pgNo int, perm RWPerm,
 	expected bool) {
 
 	lg := startGrabber(bp, tid, file, pgNo, perm)
@@ -74,14 +74,14 @@ func grabLock(t *testing.T,
 }
 
 func metaLockTester(t *testing.T, bp *BufferPool,
-	tid1 TransactionID, file1 DBFile, pgNo1 int, perm1 RWPerm,
-	tid2 TransactionID, file2 DBFile, pgNo2 int, perm2 RWPerm,
+	tid1 *Transaction, file1 DBFile, pgNo1 int, perm1 RWPerm,
+	tid2 *Transaction, file2 DBFile, pgNo2 int, perm2 RWPerm,
 	expected bool) {
 	bp.GetPage(file1, pgNo1, tid1, perm1)
 	grabLock(t, bp, tid2, file2, pgNo2, perm2, expected)
 }
 
-func lockingTestSetUp(t *testing.T) (*BufferPool, *HeapFile, TransactionID, TransactionID) {
+func lockingTestSetUp(t *testing.T) (*BufferPool, *HeapFile, *Transaction, *Transaction) {
 	bp, hf, tid1, tid2, _ := transactionTestSetUp(t)
 	return bp, hf, tid1, tid2
 }
@@ -0,0 +1,287 @@
+package godb
+
+// SortMergeJoin joins inputs that are in order of their join keys by merging
+// them, so that each input is read once.  Inputs that are not already sorted on
+// their keys, e.g. by an ORDER BY in a subquery or by another merge join, are
+// sorted first by an [OrderBy] with a memory budget, which becomes the input of
+// the join.  The records of each input that share a key are held in memory while
+// they are joined.
+type SortMergeJoin struct {
+	// Expressions that when applied to tuples from the left or right operators,
+	// respectively, return the values of the keys of the join
+	leftFields, rightFields []Expr
+
+	left, right Operator
+
+	joinType JoinType
+}
+
+// Constructor for a merge join of the given type, on the equality of each of
+// leftFields to the corresponding expression of rightFields.  An input that is
+// not known to be sorted on its keys is sorted by an external sort that spills
+// to temporary files through bp once it holds memoryBudget bytes.
+func NewSortMergeJoin(left Operator, leftFields []Expr, right Operator, rightFields []Expr, joinType JoinType, bp *BufferPool, memoryBudget int) (*SortMergeJoin, error) {
+	if left == nil || right == nil {
+		return nil, ailikeError{MalformedDataError, "NewSortMergeJoin left or right pointer is nil."}
+	}
+	if err := checkJoinKeys(leftFields, rightFields); err != nil {
+		return nil, err
+	}
+	if joinType.filtersLeft() {
+		return nil, ailikeError{IllegalOperationError, "semi and anti joins are only supported by hash joins"}
+	}
+	left, err := sortedInput(left, leftFields, bp, memoryBudget)
+	if err != nil {
+		return nil, err
+	}
+	right, err = sortedInput(right, rightFields, bp, memoryBudget)
+	if err != nil {
+		return nil, err
+	}
+	return &SortMergeJoin{leftFields, rightFields, left, right, joinType}, nil
+}
+
+// Returns op if it is known to be sorted on keys, and otherwise op sorted on them.
+func sortedInput(op Operator, keys []Expr, bp *BufferPool, memoryBudget int) (Operator, error) {
+	if sortedOn(op, keys) {
+		return op, nil
+	}
+	ascending := make([]bool, len(keys))
+	for i := range ascending {
+		ascending[i] = true
+	}
+	orderBy, err := NewOrderBy(keys, op, ascending)
+	if err != nil {
+		return nil, err
+	}
+	orderBy.SetMemoryBudget(bp, memoryBudget)
+	return orderBy, nil
+}
+
+// Returns true if the output of op is known to be in ascending order of keys,
+// which are fields of its output.
+func sortedOn(op Operator, keys []Expr) bool {
+	cols := fieldColumns(keys, op.Descriptor())
+	for _, c := range cols {
+		if c < 0 {
+			return false
+		}
+	}
+	return sortedOnColumns(op, cols)
+}
+
+// Returns true if cols, which are indexes of fields of an operator's output,
+// are a prefix of sorted, the fields that the output is in order of.
+func columnsPrefix(cols []int, sorted []int) bool {
+	if len(cols) > len(sorted) {
+		return false
+	}
+	for i, c := range cols {
+		if sorted[i] != c {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if the output of op is known to be in ascending order of the
+// fields at the indexes cols.
+func sortedOnColumns(op Operator, cols []int) bool {
+	switch op := op.(type) {
+	case *InstrumentedOp:
+		return sortedOnColumns(op.op, cols)
+	case *OrderBy:
+		for i := range cols {
+			if i < len(op.ascending) && !op.ascending[i] {
+				return false
+			}
+		}
+		return columnsPrefix(cols, op.sortedCols)
+	case *Filter:
+		return sortedOnColumns(op.child, cols)
+	case *LimitOp:
+		return sortedOnColumns(op.child, cols)
+	case *Project:
+		// the fields that are projected are in the same order as in the input
+		childCols := make([]int, len(cols))
+		for i, c := range cols {
+			f, ok := op.selectFields[c].(*FieldExpr)
+			if !ok {
+				return false
+			}
+			idx, err := findFieldInTd(f.selectField, op.child.Descriptor())
+			if err != nil {
+				return false
+			}
+			childCols[i] = idx
+		}
+		return sortedOnColumns(op.child, childCols)
+	case *SortMergeJoin:
+		// the output is in order of the keys of the input whose records are all
+		// returned, which for an inner join is either of them
+		leftCols := fieldColumns(op.leftFields, op.left.Descriptor())
+		rightCols := fieldColumns(op.rightFields, op.right.Descriptor())
+		for i := range rightCols {
+			if rightCols[i] >= 0 {
+				rightCols[i] += len(op.left.Descriptor().Fields)
+			}
+		}
+		return (op.joinType != RightOuterJoin && columnsPrefix(cols, leftCols)) ||
+			(op.joinType != LeftOuterJoin && columnsPrefix(cols, rightCols))
+	}
+	return false
+}
+
+func (j *SortMergeJoin) Descriptor() *TupleDesc {
+	return j.left.Descriptor().merge(j.right.Descriptor())
+}
+
+// keyGroupReader reads the records of an input that is sorted on its join key in
+// groups that share a key.  A record whose key is NULL matches nothing, so it is
+// in a group of its own.
+type keyGroupReader struct {
+	iter    func() (*Tuple, error)
+	keys    []Expr
+	group   []*Tuple  // the current group, or nil once the input is exhausted
+	key     []DBValue // the key of the current group
+	next    *Tuple    // the first record of the following group, if it has been read
+	nextKey []DBValue // the key of next
+	done    bool      // true once iter has returned nil
+}
+
+// Reads the next group of records.
+func (g *keyGroupReader) advance() error {
+	g.group, g.key = nil, nil
+	if g.next == nil && !g.done {
+		if err := g.readNext(); err != nil {
+			return err
+		}
+	}
+	if g.next == nil {
+		return nil
+	}
+	g.group, g.key = []*Tuple{g.next}, g.nextKey
+	g.next, g.nextKey = nil, nil
+	for !g.done {
+		if err := g.readNext(); err != nil {
+			return err
+		}
+		if g.next == nil || joinKeyHasNull(g.key) || joinKeyHasNull(g.nextKey) || compareJoinKeys(g.key, g.nextKey) != OrderedEqual {
+			break
+		}
+		g.group = append(g.group, g.next)
+		g.next, g.nextKey = nil, nil
+	}
+	return nil
+}
+
+// Reads the next record of the input into next.
+func (g *keyGroupReader) readNext() error {
+	t, err := g.iter()
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		g.done = true
+		return nil
+	}
+	key, err := evalJoinKey(g.keys, t)
+	if err != nil {
+		return err
+	}
+	g.next, g.nextKey = t, key
+	return nil
+}
+
+// Join operator implementation.  The inputs are read a group of records with
+// the same key at a time.  The group with the lesser key is skipped, or for an
+// outer join returned with NULLs in place of the other input's fields, until the
+// groups have equal keys, when every pair of their records is returned.
+func (j *SortMergeJoin) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
+	leftIter, err := j.left.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	rightIter, err := j.right.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	if leftIter == nil || rightIter == nil {
+		return nil, ailikeError{MalformedDataError, "SortMergeJoin child Iterator unexpectedly nil."}
+	}
+	leftGroups := &keyGroupReader{iter: leftIter, keys: j.leftFields}
+	rightGroups := &keyGroupReader{iter: rightIter, keys: j.rightFields}
+	nullLeftT := &Tuple{Desc: *j.left.Descriptor(), Fields: make([]DBValue, len(j.left.Descriptor().Fields))}
+	nullRightT := &Tuple{Desc: *j.right.Descriptor(), Fields: make([]DBValue, len(j.right.Descriptor().Fields))}
+
+	var (
+		started bool
+		// the groups whose records are being returned: a pair of groups that
+		// match, or one group of an outer join that matches nothing
+		lGroup, rGroup []*Tuple
+		li, ri         int // the next records of lGroup and rGroup to return
+	)
+	return func() (*Tuple, error) {
+		if !started {
+			started = true
+			if err := leftGroups.advance(); err != nil {
+				return nil, err
+			}
+			if err := rightGroups.advance(); err != nil {
+				return nil, err
+			}
+		}
+		for {
+			switch {
+			case len(lGroup) > 0 && len(rGroup) > 0:
+				if li < len(lGroup) {
+					t := joinTuples(lGroup[li], rGroup[ri])
+					ri++
+					if ri == len(rGroup) {
+						li, ri = li+1, 0
+					}
+					return t, nil
+				}
+			case li < len(lGroup):
+				li++
+				return joinTuples(lGroup[li-1], nullRightT), nil
+			case ri < len(rGroup):
+				ri++
+				return joinTuples(nullLeftT, rGroup[ri-1]), nil
+			}
+
+			// the current groups are exhausted, so move on to the next ones
+			lGroup, rGroup, li, ri = nil, nil, 0, 0
+			for lGroup == nil && rGroup == nil {
+				l, r := leftGroups, rightGroups
+				if l.group == nil && r.group == nil {
+					return nil, nil
+				}
+				var err error
+				switch {
+				case r.group == nil || (l.group != nil && (joinKeyHasNull(l.key) ||
+					(!joinKeyHasNull(r.key) && compareJoinKeys(l.key, r.key) == OrderedLessThan))):
+					// the left group matches nothing
+					if j.joinType == LeftOuterJoin {
+						lGroup = l.group
+					}
+					err = l.advance()
+				case l.group == nil || joinKeyHasNull(r.key) || compareJoinKeys(l.key, r.key) == OrderedGreaterThan:
+					// the right group matches nothing
+					if j.joinType == RightOuterJoin {
+						rGroup = r.group
+					}
+					err = r.advance()
+				default:
+					lGroup, rGroup = l.group, r.group
+					if err = l.advance(); err == nil {
+						err = r.advance()
+					}
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}, nil
+}
@@ -0,0 +1,164 @@
+package godb
+
+import (
+	"math"
+)
+
+// MMR reorders the candidates produced by its child with maximal marginal
+// relevance, so that near duplicates of rows that were already returned are
+// pushed down the ranking. Rows are picked greedily; at each step the next row
+// is the candidate d maximizing
+//
+//	lambda * sim(d, query) - (1 - lambda) * max_{s already picked} sim(d, s)
+//
+// where sim is cosine similarity between embeddings. lambda = 1 is a plain
+// similarity ranking, and smaller values trade relevance for diversity.
+//
+// The child provides the candidate pool (typically the best matches for the
+// query from an NNScan) and is read to completion before the first row is returned.
+// Rows whose column is NULL have no embedding, and are left out.
+// The marginal score of each row is appended as an "mmr" field, scaled by 1000
+// and truncated to an int; scores never increase from one row to the next.
+type MMR struct {
+	child  Operator
+	field  Expr // the embedded text or vector column being diversified
+	query  EmbeddedStringField
+	lambda float64
+	limit  Expr // number of rows to pick from the candidates
+}
+
+// Construct an MMR operator. lambda must be between 0 and 1.
+func NewMMR(child Operator, field Expr, query EmbeddedStringField, lambda float64, limit Expr) (*MMR, error) {
+	if lambda < 0 || lambda > 1 {
+		return nil, ailikeError{IllegalOperationError, "mmr lambda must be between 0 and 1"}
+	}
+	ftype := field.GetExprType().Ftype
+	if ftype != EmbeddedStringType && ftype != VectorFieldType {
+		return nil, ailikeError{TypeMismatchError, "mmr can only diversify embedded text or vector fields"}
+	}
+	return &MMR{child, field, query, lambda, limit}, nil
+}
+
+// The descriptor of the child, with the marginal score appended.
+func (m *MMR) Descriptor() *TupleDesc {
+	scoreDesc := TupleDesc{Fields: []FieldType{{Fname: "mmr", TableQualifier: "", Ftype: IntType}}}
+	return m.child.Descriptor().merge(&scoreDesc)
+}
+
+// Returns the embedding stored in an EmbeddedStringField or VectorField, or nil
+// if v is NULL.
+func embeddingOfField(v DBValue) (EmbeddingType, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case EmbeddedStringField:
+		return v.Emb, nil
+	case VectorField:
+		return v.Emb, nil
+	}
+	return nil, ailikeError{TypeMismatchError, "expected an embedded text or vector field"}
+}
+
+func (m *MMR) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
+	childIter, err := m.child.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	if childIter == nil {
+		return nil, ailikeError{MalformedDataError, "MMR child Iterator unexpectedly nil."}
+	}
+	limitVal, err := m.limit.EvalExpr(nil)
+	if err != nil {
+		return nil, err
+	}
+	limit := int(limitVal.(IntField).Value)
+
+	var (
+		candidates []Tuple
+		embs       []EmbeddingType
+		norms      []float64 // the norm of each embedding, computed once
+		querySims  []float64
+		maxSelSims []float64 // for each candidate, its largest similarity to a picked row
+		picked     []bool
+	)
+	desc := m.Descriptor()
+	loaded := false
+	nPicked := 0
+
+	return func() (*Tuple, error) {
+		if !loaded {
+			queryNorm := normOf(m.query.Emb)
+			for t, err := childIter(); t != nil || err != nil; t, err = childIter() {
+				if err != nil {
+					return nil, err
+				}
+				val, err := m.field.EvalExpr(t)
+				if err != nil {
+					return nil, err
+				}
+				emb, err := embeddingOfField(val)
+				if err != nil {
+					return nil, err
+				}
+				if emb == nil {
+					// NULL text has no embedding, so it is not similar to
+					// anything and is never picked
+					continue
+				}
+				norm := normOf(emb)
+				querySim, err := cosineWithNorms(emb, m.query.Emb, norm, queryNorm)
+				if err != nil {
+					return nil, err
+				}
+				tid.counters.distanceComputations.Add(1)
+				candidates = append(candidates, *t)
+				embs = append(embs, emb)
+				norms = append(norms, norm)
+				querySims = append(querySims, querySim)
+				maxSelSims = append(maxSelSims, math.Inf(-1))
+				picked = append(picked, false)
+			}
+			loaded = true
+		}
+		if nPicked >= limit || nPicked >= len(candidates) {
+			return nil, nil
+		}
+
+		best := -1
+		bestScore := math.Inf(-1)
+		for i := range candidates {
+			if picked[i] {
+				continue
+			}
+			score := m.lambda * querySims[i]
+			if nPicked > 0 {
+				score -= (1 - m.lambda) * maxSelSims[i]
+			}
+			if best == -1 || score > bestScore {
+				best = i
+				bestScore = score
+			}
+		}
+		picked[best] = true
+		nPicked++
+		for i := range candidates {
+			if picked[i] {
+				continue
+			}
+			sim, err := cosineWithNorms(embs[i], embs[best], norms[i], norms[best])
+			if err != nil {
+				return nil, err
+			}
+			tid.counters.distanceComputations.Add(1)
+			if sim > maxSelSims[i] {
+				maxSelSims[i] = sim
+			}
+		}
+
+		t := candidates[best]
+		fields := make([]DBValue, len(t.Fields), len(t.Fields)+1)
+		copy(fields, t.Fields)
+		fields = append(fields, IntField{int64(bestScore * 1000)})
+		return &Tuple{Desc: *desc, Fields: fields, Rid: t.Rid}, nil
+	}, nil
+}
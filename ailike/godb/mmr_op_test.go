@@ -0,0 +1,181 @@
+package godb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Serves emb as the embedding of any text, in place of the embedding server.
+func startFakeEmbeddingServer(t *testing.T, emb EmbeddingType) {
+	startFakeEmbeddingServerFunc(t, func(string) EmbeddingType { return emb })
+}
+
+// Serves embed(text) as the embedding of text, in place of the embedding server.
+func startFakeEmbeddingServerFunc(t *testing.T, embed func(text string) EmbeddingType) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Text string `json:"text"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(EmbeddingResponse{Embedding: embed(req.Text)})
+	}))
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	oldPort := portNumberEmb
+	portNumberEmb = u.Port()
+	t.Cleanup(func() {
+		portNumberEmb = oldPort
+		server.Close()
+	})
+}
+
+// Returns a unit vector mixing the first few dimensions with the given weights.
+func makeTestEmbedding(weights ...float64) EmbeddingType {
+	emb := make(EmbeddingType, TextEmbeddingDim)
+	copy(emb, weights)
+	return emb
+}
+
+func runMMR(t *testing.T, hf *HeapFile, lambda float64, tid *Transaction) []string {
+	field := &FieldExpr{hf.Descriptor().Fields[2]}
+	query := EmbeddedStringField{Value: "q", Emb: makeTestEmbedding(1)}
+	mmr, err := NewMMR(hf, field, query, lambda, &ConstExpr{IntField{3}, IntType})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, err := mmr.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var names []string
+	var last int64
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		score := tup.Fields[3].(IntField).Value
+		if len(names) > 0 && score > last {
+			t.Errorf("expected non-increasing mmr scores, got %d after %d", score, last)
+		}
+		last = score
+		names = append(names, tup.Fields[0].(StringField).Value)
+	}
+	return names
+}
+
+func TestMMR(t *testing.T) {
+	td, _, _, hf, bp, tid := makeVecTestVars()
+	// "exact" matches the query, "dup" is nearly the same as "exact", and
+	// "other" is less similar to the query but different from both
+	tuples := []Tuple{
+		{Desc: td, Fields: []DBValue{StringField{"exact"}, IntField{1}, VectorField{Emb: makeTestEmbedding(1)}}},
+		{Desc: td, Fields: []DBValue{StringField{"dup"}, IntField{2}, VectorField{Emb: makeTestEmbedding(0.99, 0, 0.141)}}},
+		{Desc: td, Fields: []DBValue{StringField{"other"}, IntField{3}, VectorField{Emb: makeTestEmbedding(0.8, 0.6)}}},
+	}
+	for i := range tuples {
+		if err := hf.insertTuple(&tuples[i], tid); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	tid.Commit()
+	tid = bp.Transactions().Begin()
+	defer tid.Commit()
+
+	// with lambda = 1 this is a plain similarity ranking
+	names := runMMR(t, hf, 1.0, tid)
+	expected := []string{"exact", "dup", "other"}
+	for i := range expected {
+		if i >= len(names) || names[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, names)
+		}
+	}
+
+	// favoring diversity pushes the near duplicate down
+	names = runMMR(t, hf, 0.3, tid)
+	expected = []string{"exact", "other", "dup"}
+	for i := range expected {
+		if i >= len(names) || names[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, names)
+		}
+	}
+
+	if _, err := NewMMR(hf, &FieldExpr{td.Fields[2]}, EmbeddedStringField{}, 1.5, &ConstExpr{IntField{3}, IntType}); err == nil {
+		t.Errorf("expected error for lambda outside [0, 1]")
+	}
+	if _, err := NewMMR(hf, &FieldExpr{td.Fields[1]}, EmbeddedStringField{}, 0.5, &ConstExpr{IntField{3}, IntType}); err == nil {
+		t.Errorf("expected error when diversifying a non-embedding field")
+	}
+}
+
+func TestMMRParse(t *testing.T) {
+	c, hf, bp, _ := makeTweetsTestCatalog(t)
+
+	// use the embedding of the first tweet as the query embedding
+	tid := bp.Transactions().Begin()
+	iter, _ := hf.Iterator(tid)
+	first, err := iter()
+	if err != nil || first == nil {
+		t.Fatalf("failed to read test table")
+	}
+	tid.Commit()
+	startFakeEmbeddingServer(t, first.Fields[2].(EmbeddedStringField).Emb)
+
+	sql := "select tweet_id, mmr(content, 'first tweet', 0.5) diverse from tweets_test order by diverse desc limit 5"
+	_, plan, err := Parse(c, sql)
+	if err != nil {
+		t.Fatalf("failed to parse, q=%s, %s", sql, err.Error())
+	}
+	tid = bp.Transactions().Begin()
+	defer tid.Commit()
+	iter, err = plan.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var ids []int64
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		ids = append(ids, tup.Fields[0].(IntField).Value)
+	}
+	if len(ids) != 5 {
+		t.Fatalf("expected 5 results, got %d", len(ids))
+	}
+	if ids[0] != first.Fields[0].(IntField).Value {
+		t.Errorf("expected the tweet matching the query to come first")
+	}
+
+	sql = FactCheckRetrievalQuery("first tweet", "tweets_test", "tweet_id", "content", 3, DefaultMMRLambda)
+	_, _, err = Parse(c, sql)
+	if err != nil {
+		t.Fatalf("failed to parse fact check query, q=%s, %s", sql, err.Error())
+	}
+}
+
+// Candidates whose column is NULL are left out of the ranking.
+func TestMMRNulls(t *testing.T) {
+	td, _, _, hf, bp, tid := makeVecTestVars()
+	tuples := []Tuple{
+		{Desc: td, Fields: []DBValue{StringField{"null"}, IntField{1}, nil}},
+		{Desc: td, Fields: []DBValue{StringField{"exact"}, IntField{2}, VectorField{Emb: makeTestEmbedding(1)}}},
+		{Desc: td, Fields: []DBValue{StringField{"other"}, IntField{3}, VectorField{Emb: makeTestEmbedding(0.8, 0.6)}}},
+	}
+	for i := range tuples {
+		if err := hf.insertTuple(&tuples[i], tid); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	tid.Commit()
+	tid = bp.Transactions().Begin()
+	defer tid.Commit()
+
+	names := runMMR(t, hf, 0.5, tid)
+	if len(names) != 2 || names[0] != "exact" || names[1] != "other" {
+		t.Errorf("expected [exact other], got %v", names)
+	}
+}
@@ -0,0 +1,167 @@
+package godb
+
+// Transactions read the database through snapshots: a transaction sees the
+// versions of tuples created by the transactions that committed before it
+// began, and by itself, unless they were deleted by one of those.  Readers of
+// a snapshot take no page locks, so that long scans neither block nor are
+// blocked by writers.  Writers still lock the pages they change until they
+// complete, and the first of two transactions to change a record wins: the
+// other gets a WriteConflictError when it tries to (see
+// [heapPage.deleteVersion]).
+//
+// Versions that no transaction can see any more are left on their pages until
+// they are pruned by VACUUM (see [HeapFile.vacuum]).  Versions created by an
+// aborted transaction never need to be, since rolling the transaction back
+// restores its pages.
+
+// The transactions whose changes a snapshot sees.
+type snapshot struct {
+	// transactions with this id or larger began after the snapshot was taken
+	xmax int64
+	// the transactions that were active when the snapshot was taken
+	active map[int64]bool
+	// the oldest transaction whose changes the snapshot may not see
+	low int64
+}
+
+// Takes the snapshot of a transaction with the given id, which is beginning.
+// Must be called with the manager's mutex held.
+func (tm *TransactionManager) takeSnapshot(id int64) snapshot {
+	s := snapshot{xmax: id, active: make(map[int64]bool, len(tm.active)), low: id}
+	for activeId := range tm.active {
+		s.active[activeId] = true
+		s.low = min(s.low, activeId)
+	}
+	return s
+}
+
+// Returns the horizon of the active transactions: changes by transactions with
+// smaller ids are seen by all of them, so versions created below the horizon
+// are visible to every transaction, and versions deleted below it to none.
+func (tm *TransactionManager) horizon() int64 {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	horizon := nextTid.Load() + 1
+	for _, t := range tm.active {
+		horizon = min(horizon, t.snapshot.low)
+	}
+	return horizon
+}
+
+// Returns true if t sees the changes of the transaction with the given id: its
+// own, and those of transactions that committed before it began.  Stamps of
+// zero are seen by every transaction, as are those of transactions of earlier
+// runs of the database, which committed, since recovery rolls back the rest.
+func (t *Transaction) sees(id int64) bool {
+	return id == t.id || (id < t.snapshot.xmax && !t.snapshot.active[id])
+}
+
+// Returns true if the version with the given stamps is in t's snapshot.
+func (t *Transaction) canSee(v tupleVersion) bool {
+	return t.sees(v.xmin) && (v.xmax == 0 || !t.sees(v.xmax))
+}
+
+// Prunes the versions of the file's tuples, and of the entries of its indexes,
+// that no active transaction can see, freeing their slots for new tuples.
+// Each page is locked for writing by tid while it is pruned.  Returns the
+// number of versions removed.
+func (f *HeapFile) vacuum(tid *Transaction) (int, error) {
+	removed, err := f.prune(tid)
+	if err != nil {
+		return removed, err
+	}
+	var files []*HeapFile
+	for _, index := range f.indexes {
+		if !index.clustered {
+			files = append(files, index.dataHeapFile)
+		}
+		files = append(files, index.centroidHeapFile, index.mappingHeapFile)
+	}
+	for _, index := range f.textIndexes {
+		files = append(files, index.postingsHeapFile, index.docsHeapFile)
+	}
+	for _, file := range files {
+		n, err := file.prune(tid)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// Prunes the pages of the file, returning the number of versions removed.
+func (f *HeapFile) prune(tid *Transaction) (int, error) {
+	horizon := tid.manager.horizon()
+	removed := 0
+	for pageNo := 0; pageNo < f.NumPages(); pageNo++ {
+		hp, err := f.getHeapPage(pageNo, tid, WritePerm)
+		if err != nil {
+			return removed, err
+		}
+		if hp.versioned {
+			if rids := hp.prune(horizon); len(rids) > 0 {
+				removed += len(rids)
+				f.pageFull.Store(pageNo, false)
+			}
+		}
+		f.unpin(hp)
+	}
+	return removed, nil
+}
+
+// VacuumOp prunes the versions that no transaction can see from a table, or
+// from every table, when iterated, and returns the number removed from each.
+type VacuumOp struct {
+	c      *Catalog
+	tables []string
+}
+
+var vacuumDesc = TupleDesc{Fields: []FieldType{
+	{Fname: "table", Ftype: StringType},
+	{Fname: "removed", Ftype: IntType},
+}}
+
+// Returns a VacuumOp for the named table, or for every table in the catalog if
+// table is empty.
+func NewVacuumOp(c *Catalog, table string) (*VacuumOp, error) {
+	if table != "" {
+		if _, err := c.GetTable(table); err != nil {
+			return nil, err
+		}
+		return &VacuumOp{c, []string{table}}, nil
+	}
+	tables := make([]string, len(c.tables))
+	for i, t := range c.tables {
+		tables[i] = t.name
+	}
+	return &VacuumOp{c, tables}, nil
+}
+
+func (v *VacuumOp) Descriptor() *TupleDesc {
+	return &vacuumDesc
+}
+
+func (v *VacuumOp) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
+	i := 0
+	return func() (*Tuple, error) {
+		for i < len(v.tables) {
+			name := v.tables[i]
+			i++
+			file, err := v.c.GetTable(name)
+			if err != nil {
+				return nil, err
+			}
+			hf, ok := file.(*HeapFile)
+			if !ok {
+				continue
+			}
+			removed, err := hf.vacuum(tid)
+			if err != nil {
+				return nil, err
+			}
+			return &Tuple{Desc: vacuumDesc, Fields: []DBValue{StringField{name}, IntField{int64(removed)}}}, nil
+		}
+		return nil, nil
+	}, nil
+}
@@ -0,0 +1,362 @@
+package godb
+
+import (
+	"testing"
+	"time"
+)
+
+// Returns the ages of the records in hf that tid can see.
+func visibleAges(t *testing.T, hf *HeapFile, tid *Transaction) map[int64]bool {
+	iter, err := hf.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ages := make(map[int64]bool)
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		ages[tup.Fields[1].(IntField).Value] = true
+	}
+	return ages
+}
+
+func insertAges(t *testing.T, hf *HeapFile, tid *Transaction, from int, to int) {
+	for i := from; i < to; i++ {
+		tup := Tuple{Desc: hf.desc, Fields: []DBValue{StringField{"sam"}, IntField{int64(i)}}}
+		if err := hf.insertTuple(&tup, tid); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+}
+
+// Returns the record with the given age that tid can see.
+func findAge(t *testing.T, hf *HeapFile, tid *Transaction, age int64) *Tuple {
+	iter, err := hf.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup.Fields[1].(IntField).Value == age {
+			return tup
+		}
+	}
+	t.Fatalf("no record with age %d", age)
+	return nil
+}
+
+func TestSnapshotReads(t *testing.T) {
+	_, _, _, hf, bp, tid := makeTestVars()
+	tm := bp.Transactions()
+	insertAges(t, hf, tid, 0, 10)
+	tid.Commit()
+
+	reader := tm.Begin()
+	writer := tm.Begin()
+	insertAges(t, hf, writer, 10, 20)
+	if err := hf.deleteTuple(findAge(t, hf, writer, 0), writer); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// the reader is not blocked by the writer's locks, and sees neither its
+	// uncommitted changes nor those it commits after the reader began
+	done := make(chan map[int64]bool, 1)
+	go func() { done <- visibleAges(t, hf, reader) }()
+	select {
+	case ages := <-done:
+		if len(ages) != 10 || !ages[0] {
+			t.Errorf("expected the reader to see the 10 committed records, got %v", ages)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the reader not to wait for the writer")
+	}
+	if ages := visibleAges(t, hf, writer); len(ages) != 19 || ages[0] {
+		t.Errorf("expected the writer to see its own changes, got %v", ages)
+	}
+	writer.Commit()
+	if ages := visibleAges(t, hf, reader); len(ages) != 10 || !ages[0] {
+		t.Errorf("expected the reader to keep its snapshot, got %v", ages)
+	}
+	if n := hf.NumTuples(reader); n != 10 {
+		t.Errorf("expected the reader to count 10 records, got %d", n)
+	}
+	reader.Commit()
+
+	tid = tm.Begin()
+	if ages := visibleAges(t, hf, tid); len(ages) != 19 || ages[0] {
+		t.Errorf("expected a later transaction to see the writer's changes, got %v", ages)
+	}
+	tid.Commit()
+}
+
+func TestWriteConflict(t *testing.T) {
+	_, _, _, hf, bp, tid := makeTestVars()
+	tm := bp.Transactions()
+	insertAges(t, hf, tid, 0, 2)
+	tid.Commit()
+
+	first, second := tm.Begin(), tm.Begin()
+	old := findAge(t, hf, second, 0)
+	if err := hf.deleteTuple(findAge(t, hf, first, 0), first); err != nil {
+		t.Fatalf(err.Error())
+	}
+	first.Commit()
+
+	// the record changed after the second transaction's snapshot was taken
+	err := hf.deleteTuple(old, second)
+	if e, ok := err.(ailikeError); !ok || e.code != WriteConflictError {
+		t.Fatalf("expected a write conflict, got %v", err)
+	}
+	if ABORT_TRANSACTIONS && second.Status() != TransactionAborted {
+		t.Errorf("expected the second transaction to be aborted")
+	}
+
+	// records that did not change can still be written
+	tid = tm.Begin()
+	if err := hf.deleteTuple(findAge(t, hf, tid, 1), tid); err != nil {
+		t.Errorf("expected to delete an unchanged record, got %v", err)
+	}
+	tid.Commit()
+}
+
+func TestWritersSharePage(t *testing.T) {
+	_, _, _, hf, bp, tid := makeTestVars()
+	tm := bp.Transactions()
+	insertAges(t, hf, tid, 0, 2)
+	tid.Commit()
+
+	// transactions writing different records of a page do not wait for each
+	// other, and each is rolled back on its own
+	first, second := tm.Begin(), tm.Begin()
+	done := make(chan bool, 1)
+	go func() {
+		insertAges(t, hf, first, 10, 20)
+		hf.deleteTuple(findAge(t, hf, first, 0), first)
+		insertAges(t, hf, second, 20, 30)
+		hf.deleteTuple(findAge(t, hf, second, 1), second)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the writers not to wait for each other")
+	}
+	if hf.NumPages() != 1 {
+		t.Errorf("expected the writers to share a page, got %d pages", hf.NumPages())
+	}
+	first.Abort()
+	second.Commit()
+	tid = tm.Begin()
+	ages := visibleAges(t, hf, tid)
+	if len(ages) != 11 || !ages[0] || ages[1] || ages[10] || !ages[20] {
+		t.Errorf("expected only the second writer's changes, got %v", ages)
+	}
+	tid.Commit()
+}
+
+func TestVacuum(t *testing.T) {
+	_, _, _, hf, bp, tid := makeTestVars()
+	tm := bp.Transactions()
+	insertAges(t, hf, tid, 0, 10)
+	tid.Commit()
+	tid = tm.Begin()
+	for age := int64(0); age < 4; age++ {
+		if err := hf.deleteTuple(findAge(t, hf, tid, age), tid); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	tid.Commit()
+
+	// a transaction that began before the deletes committed keeps them
+	reader := tm.Begin()
+	tid = tm.Begin()
+	hf.deleteTuple(findAge(t, hf, tid, 4), tid)
+	tid.Commit()
+	vacuum := tm.Begin()
+	removed, err := hf.vacuum(vacuum)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	vacuum.Commit()
+	if removed != 4 {
+		t.Errorf("expected 4 versions to be removed, got %d", removed)
+	}
+	if ages := visibleAges(t, hf, reader); len(ages) != 6 || !ages[4] {
+		t.Errorf("expected the reader to still see the record it began with, got %v", ages)
+	}
+	reader.Commit()
+
+	vacuum = tm.Begin()
+	if removed, _ = hf.vacuum(vacuum); removed != 1 {
+		t.Errorf("expected 1 version to be removed, got %d", removed)
+	}
+	vacuum.Commit()
+
+	// the freed slots are reused
+	tid = tm.Begin()
+	insertAges(t, hf, tid, 10, 15)
+	if ages := visibleAges(t, hf, tid); len(ages) != 10 {
+		t.Errorf("expected 10 records, got %v", ages)
+	}
+	tid.Commit()
+	if hf.NumPages() != 1 {
+		t.Errorf("expected the records to fit on one page, got %d", hf.NumPages())
+	}
+}
+
+func TestVacuumParse(t *testing.T) {
+	c, _, bp, _ := makeTweetsTestCatalog(t)
+	for _, query := range []string{"vacuum tweets_test;", "VACUUM"} {
+		qType, op, err := Parse(c, query)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if qType != IteratorType {
+			t.Errorf("expected an iterator for %s", query)
+		}
+		tid := bp.Transactions().Begin()
+		iter, err := op.Iterator(tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		rows := 0
+		for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			rows++
+		}
+		tid.Commit()
+		if rows != len(op.(*VacuumOp).tables) {
+			t.Errorf("expected a row per table, got %d", rows)
+		}
+	}
+	if _, _, err := Parse(c, "vacuum a b"); err == nil {
+		t.Errorf("expected an error parsing a malformed VACUUM")
+	}
+}
+
+// Returns the number of entries of the index that tid can see.
+func visibleIndexEntries(t *testing.T, index *NNIndexFile, tid *Transaction) int {
+	entries := 0
+	for pageNo := 0; pageNo < index.dataHeapFile.NumPages(); pageNo++ {
+		tuples, err := index.dataHeapFile.visibleTuples(pageNo, tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		entries += len(tuples)
+	}
+	return entries
+}
+
+func TestIndexVisibility(t *testing.T) {
+	// the test table predates versions, so its records are copied to a table
+	// that has them
+	src, bp, err := MakeTestDatabaseFromCsv("tweets_test", "../../data/tweets/tweets_test.csv", 200)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	dir := t.TempDir()
+	hfile, err := NewHeapFile(dir+"/tweets_test.dat", src.Descriptor(), bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tm := bp.Transactions()
+	tid := tm.Begin()
+	iter, err := src.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if err := hfile.insertEmbeddedTuple(tup, tid); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	tid.Commit()
+	index, err := ConstructNNIndexFileFromHeapFile(hfile, "content", 10, false, dir, "tweets_test", bp)
+	if err != nil {
+		t.Fatalf("failed to construct index file, %s", err.Error())
+	}
+
+	reader := tm.Begin()
+	records := hfile.NumTuples(reader)
+	tid = tm.Begin()
+	iter, err = hfile.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tup, err := iter()
+	if err != nil || tup == nil {
+		t.Fatalf("expected a record to delete")
+	}
+	if err := hfile.deleteTuple(tup, tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid.Commit()
+
+	if n := visibleIndexEntries(t, index, reader); n != records {
+		t.Errorf("expected the reader to see %d index entries, got %d", records, n)
+	}
+	reader.Commit()
+	tid = tm.Begin()
+	if n := visibleIndexEntries(t, index, tid); n != records-1 {
+		t.Errorf("expected a later transaction to see %d index entries, got %d", records-1, n)
+	}
+	removed, err := hfile.vacuum(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid.Commit()
+	if removed != 2 {
+		t.Errorf("expected the record and its index entry to be removed, got %d", removed)
+	}
+}
+
+// A file written by an earlier run of the database, whose log is not replayed,
+// may be stamped with ids larger than those the process starts from; opening
+// it makes the ids handed out after them larger, so its records are visible.
+func TestOpenStampedFile(t *testing.T) {
+	saved := nextTid.Load()
+	defer advanceTransactionIds(saved)
+	td, _, _, hf, bp, tid := makeTestVars()
+	tid.Commit()
+	advanceTransactionIds(1 << 40)
+	tid = bp.Transactions().Begin()
+	insertAges(t, hf, tid, 0, 10)
+	tid.Commit()
+	bp.FlushAllPages()
+
+	// a new run starts with no ids and no files read
+	savedFiles := sharedFiles
+	defer func() { sharedFiles = savedFiles }()
+	sharedFiles = NewFileManager(DEFAULT_MAX_OPEN_FILES)
+	nextTid.Store(0)
+	bp = NewBufferPool(3)
+	hf, err := NewHeapFile(TestingFile, &td, bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid = bp.Transactions().Begin()
+	if tid.id <= 1<<40 {
+		t.Errorf("expected ids to continue past those stamped on the file, got %d", tid.id)
+	}
+	if ages := visibleAges(t, hf, tid); len(ages) != 10 {
+		t.Errorf("expected the 10 records of the earlier run, got %v", ages)
+	}
+	tid.Commit()
+
+	// the stamps are only read the first time the file is opened in a run
+	nextTid.Store(0)
+	if _, err := NewHeapFile(TestingFile, &td, bp); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if next := nextTid.Load(); next != 0 {
+		t.Errorf("expected the file's stamps not to be read again, but ids advanced to %d", next)
+	}
+}
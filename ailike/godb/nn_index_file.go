@@ -2,7 +2,6 @@ package godb
 
 import (
 	"fmt"
-	"os"
 	"sync"
 )
 
@@ -27,6 +26,9 @@ var mappingDesc = TupleDesc{Fields: []FieldType{
 	{Fname: "indexPageNo", Ftype: IntType},
 }}
 
+// Number of probed centroids held in memory at a time while joining them with the mapping heap file.
+const centroidJoinBufferSize = 10
+
 // NNIndexFile provides a nearest-neighbor index for a given table stored within a HeapFile.
 type NNIndexFile struct {
 	sourceTableFilename string // the filename of the table this is an index for
@@ -77,9 +79,27 @@ func NewNNIndexFileFile(sourceTableFilename string, indexedColName string, clust
 	if err != nil {
 		return nil, err
 	}
+	markReadMostly(centroidHeapFile, mappingHeapFile)
+	markIndexFiles(dataHeapFile, centroidHeapFile, mappingHeapFile)
 	return &NNIndexFile{sourceTableFilename, indexedColName, clustered, dataHeapFile, centroidHeapFile, mappingHeapFile}, nil
 }
 
+// The centroid and mapping files are read by every probe of the index, but only
+// written when it is built and as data pages are added, so the file manager
+// maps them into memory.
+func markReadMostly(centroidHeapFile *HeapFile, mappingHeapFile *HeapFile) {
+	sharedFiles.setReadMostly(centroidHeapFile.fileName)
+	sharedFiles.setReadMostly(mappingHeapFile.fileName)
+}
+
+// Marks the files that store an index, whose pages EXPLAIN ANALYZE counts as
+// index pages when they are read.
+func markIndexFiles(files ...*HeapFile) {
+	for _, f := range files {
+		f.indexFile = true
+	}
+}
+
 // Given an embedding, return an iterator that returns the [centroidId, pageNo] pairs ordered by distance between the centroid
 // and the embedding; multiple rows may have the same centroidId, but different pageNos.
 // Parameters
@@ -87,14 +107,15 @@ func NewNNIndexFileFile(sourceTableFilename string, indexedColName string, clust
 // - ascending: if true, return the nearest cluster pages first; if false, return the farthest cluster pages first
 // - tid: the transaction id
 // - p (optional): the number of centroids to visit; if p is negative, visit all centroids
-func (f *NNIndexFile) getCentroidPageNoIterator(e EmbeddedStringField, ascending bool, tid TransactionID, p int) (func() ([2]int, error), error) {
+func (f *NNIndexFile) getCentroidPageNoIterator(e EmbeddedStringField, ascending bool, tid *Transaction, p int) (func() ([2]int, error), error) {
 
 	var centroidIdFieldExpr Expr = &FieldExpr{FieldType{Fname: "centroidId", Ftype: IntType}}
 	var fe Expr = &FieldExpr{FieldType{Fname: "vector", Ftype: VectorFieldType}}
 	var ce Expr = &ConstExpr{e, EmbeddedStringType}
 
 	// TODO: support multiple distance metrics
-	var ailikeExpr Expr = &FuncExpr{"ailike_vec", []*Expr{&fe, &ce}}
+	// the plan is internal to the scan, so its distances are counted for tid
+	var ailikeExpr Expr = &FuncExpr{op: "ailike_vec", args: []*Expr{&fe, &ce}, counters: &tid.counters}
 
 	// Project centroid heap file elements to [centroidID, AILIKE(e,vector) AS "dist"]
 	proj, err := NewProjectOp([]Expr{centroidIdFieldExpr, ailikeExpr}, []string{"centroidId", "dist"}, false, f.centroidHeapFile)
@@ -114,7 +135,7 @@ func (f *NNIndexFile) getCentroidPageNoIterator(e EmbeddedStringField, ascending
 	}
 
 	// Join with mapping file
-	join, err := NewIntJoin(limitOrderBy, centroidIdFieldExpr, f.mappingHeapFile, centroidIdFieldExpr, 10)
+	join, err := NewIntJoin(limitOrderBy, centroidIdFieldExpr, f.mappingHeapFile, centroidIdFieldExpr, centroidJoinBufferSize)
 	if err != nil {
 		return nil, err
 	}
@@ -141,8 +162,9 @@ func (f *NNIndexFile) getCentroidPageNoIterator(e EmbeddedStringField, ascending
 }
 
 // Finds a page for the nearest centroid with room for a new record, or creates a new page for that centroid if needed
-func (f *NNIndexFile) insertTuple(t *Tuple, tid TransactionID) error {
-	if t.Rid.(heapRecordId).fileName != f.sourceTableFilename {
+func (f *NNIndexFile) insertTuple(t *Tuple, tid *Transaction) error {
+	// records inserted through a clustered index are not yet stored anywhere else
+	if rid, ok := t.Rid.(heapRecordId); !f.clustered && (!ok || rid.fileName != f.sourceTableFilename) {
 		return ailikeError{IncompatibleTypesError, "Index does not match table of tuple."}
 	}
 	colIndex, err := findFieldInTd(FieldType{Fname: f.indexedColName, TableQualifier: f.sourceTableFilename, Ftype: EmbeddedStringType},
@@ -151,6 +173,14 @@ func (f *NNIndexFile) insertTuple(t *Tuple, tid TransactionID) error {
 		return ailikeError{IncompatibleTypesError, "Given tuple does not contain indexed column."}
 	}
 
+	if t.Fields[colIndex] == nil {
+		// NULL text has no embedding, so it is not similar to anything: a
+		// secondary index leaves it out, and a clustered index cannot store it
+		if f.clustered {
+			return ailikeError{IllegalOperationError, fmt.Sprintf("column %s of a clustered index cannot be NULL", f.indexedColName)}
+		}
+		return nil
+	}
 	var embeddingField EmbeddedStringField = t.Fields[colIndex].(EmbeddedStringField)
 	centroidPageNoIter, err := f.getCentroidPageNoIterator(embeddingField, true, tid, 1)
 	if err != nil {
@@ -159,7 +189,7 @@ func (f *NNIndexFile) insertTuple(t *Tuple, tid TransactionID) error {
 	var inserted bool = false
 	var centroidId int
 	var pageNo int
-	var dt Tuple = Tuple{Desc: dataDesc, Fields: []DBValue{VectorField{embeddingField.Emb}, IntField{int64(t.Rid.(heapRecordId).pageNo)}, IntField{int64(t.Rid.(heapRecordId).slotNo)}}}
+	var dt Tuple = Tuple{Desc: dataDesc, Fields: []DBValue{VectorField{Emb: embeddingField.Emb}, IntField{int64(t.Rid.(heapRecordId).pageNo)}, IntField{int64(t.Rid.(heapRecordId).slotNo)}}}
 	if f.clustered {
 		dt = *t
 	}
@@ -195,6 +225,10 @@ func (f *NNIndexFile) insertTuple(t *Tuple, tid TransactionID) error {
 			return err
 		}
 	}
+	if f.clustered {
+		// the tuple now lives in the clustered data file; hand its location back to the caller
+		t.Rid = dt.Rid
+	}
 	return nil
 }
 
@@ -205,13 +239,39 @@ func (f *NNIndexFile) insertTuple(t *Tuple, tid TransactionID) error {
 // for tuples as they are read via [Iterator].  Note that Rid is an empty interface,
 // so you can supply any object you wish.  You will likely want to identify the
 // heap page and slot within the page that the tuple came from.
-func (f *NNIndexFile) deleteTuple(t *Tuple, tid TransactionID) error {
-	// TODO
+func (f *NNIndexFile) deleteTuple(t *Tuple, tid *Transaction) error {
+	if f.clustered {
+		// the table's heap file is the data file, so the record is already gone
+		return nil
+	}
+	rid, ok := t.Rid.(heapRecordId)
+	if !ok || rid.fileName != f.sourceTableFilename {
+		return ailikeError{TupleNotFoundError, "Tuple does not exist within this index."}
+	}
+
+	var toDelete []*Tuple
+	iter, err := f.dataHeapFile.Iterator(tid)
+	if err != nil {
+		return err
+	}
+	for dt, err := iter(); dt != nil || err != nil; dt, err = iter() {
+		if err != nil {
+			return err
+		}
+		if int(dt.Fields[1].(IntField).Value) == rid.pageNo && int(dt.Fields[2].(IntField).Value) == rid.slotNo {
+			toDelete = append(toDelete, dt)
+		}
+	}
+	for _, dt := range toDelete {
+		if err := f.dataHeapFile.deleteTuple(dt, tid); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // Returns a getter function that takes a tuple, and returns just the embedding for the
-// EmbeddedStringField specified by columnName.
+// EmbeddedStringField specified by columnName, or nil if the field is NULL.
 func GetEmbeddingGetterFunc(columnName string) func(t *Tuple) (*EmbeddingType, error) {
 	ftype := FieldType{Fname: columnName}
 	return func(t *Tuple) (*EmbeddingType, error) {
@@ -220,6 +280,9 @@ func GetEmbeddingGetterFunc(columnName string) func(t *Tuple) (*EmbeddingType, e
 			return nil, err
 		}
 		field := t.Fields[idx]
+		if field == nil {
+			return nil, nil
+		}
 		embField := field.(EmbeddedStringField)
 		return &embField.Emb, nil
 	}
@@ -247,14 +310,22 @@ func ConstructNNIndexFileFromHeapFile(hfile *HeapFile, indexedColName string, nC
 	centroidFileName := fmt.Sprintf("%s/%s__%s__%s__centroids.dat", dbPath, indexType, tableName, indexedColName)
 	mappingFileName := fmt.Sprintf("%s/%s__%s__%s__mapping.dat", dbPath, indexType, tableName, indexedColName)
 
-	tid := NewTID()
+	tid := bp.Transactions().Begin()
+	// if the index cannot be built, abort its transaction so that it does not
+	// keep its locks, and stop stealing pages
+	defer func() {
+		if tid.Status() == TransactionActive {
+			tid.Abort()
+		}
+		bp.steal = false
+	}()
 
 	fmt.Println("************STARTING clustering*******************")
 
 	//Create clustering
 	getterFunc := GetEmbeddingGetterFunc(indexedColName)
 	clustering, err := KMeansClustering(hfile, nClusters, TextEmbeddingDim,
-		MaxIterKMeans, DeltaThrKMeans, getterFunc, false)
+		MaxIterKMeans, DeltaThrKMeans, getterFunc, false, tid)
 	if err != nil {
 		return nil, err
 	}
@@ -262,7 +333,7 @@ func ConstructNNIndexFileFromHeapFile(hfile *HeapFile, indexedColName string, nC
 	fmt.Println("************END clustering*******************")
 
 	//Create data file
-	os.Remove(dataFileName)
+	sharedFiles.remove(dataFileName)
 	indexDataDesc := &dataDesc
 	if clustered {
 		indexDataDesc = hfile.Descriptor().copy()
@@ -273,36 +344,39 @@ func ConstructNNIndexFileFromHeapFile(hfile *HeapFile, indexedColName string, nC
 	}
 
 	//Create centroid file
-	os.Remove(centroidFileName)
+	sharedFiles.remove(centroidFileName)
 	centroidHeapFile, err := NewHeapFile(centroidFileName, &centroidDesc, bp)
 	if err != nil {
 		return nil, err
 	}
 
 	//Create mapping file
-	os.Remove(mappingFileName)
+	sharedFiles.remove(mappingFileName)
 	mappingHeapFile, err := NewHeapFile(mappingFileName, &mappingDesc, bp)
 	if err != nil {
 		return nil, err
 	}
+	markReadMostly(centroidHeapFile, mappingHeapFile)
+	markIndexFiles(dataHeapFile, centroidHeapFile, mappingHeapFile)
 	nnif := &NNIndexFile{hfile.fileName, indexedColName, clustered, dataHeapFile, centroidHeapFile, mappingHeapFile}
 
-	// allow stealing pages from buffer pool
+	// allow stealing pages from the buffer pool, even if it has no log
 	// NOTE: cannot create indexes cuncurrently with other transactions
 	bp.steal = true
 
 	// clustering.Print()
 	//Insert all centroids and elements into the data file
 	for centroidID, centroid := range clustering.centroidEmbs {
-		centroidTuple := Tuple{centroidDesc, []DBValue{VectorField{*centroid}, IntField{int64(centroidID)}}, nil}
+		centroidTuple := Tuple{centroidDesc, []DBValue{VectorField{Emb: *centroid}, IntField{int64(centroidID)}}, nil}
 		err = nnif.centroidHeapFile.insertTuple(&centroidTuple, tid)
 		if err != nil {
 			return nil, err
 		}
-		_, newPageNo, err := nnif.dataHeapFile.makeNewPage(tid)
+		np, newPageNo, err := nnif.dataHeapFile.makeNewPage(tid)
 		if err != nil {
 			return nil, err
 		}
+		nnif.dataHeapFile.unpin(np)
 		// We initialize the index with at least one page per centroid
 		mappingTuple := Tuple{mappingDesc, []DBValue{IntField{int64(centroidID)}, IntField{int64(newPageNo)}}, nil}
 		err = nnif.mappingHeapFile.insertTuple(&mappingTuple, tid)
@@ -325,15 +399,19 @@ func ConstructNNIndexFileFromHeapFile(hfile *HeapFile, indexedColName string, nC
 		}
 	}
 
-	bp.CommitTransaction(tid)
+	tid.Commit()
 	bp.FlushAllPages()
 	bp.steal = false
+	// nothing in the log before the index is needed to recover from a crash
+	if err := bp.Checkpoint(); err != nil {
+		return nil, err
+	}
 
 	if clustered {
 		// swap out heapfile backing data with clustered version of data
 		// NOTE: this cannot be done cuncurrently with other transactions
 		oldHeapDataFileCopyPath := hfile.fileName + ".unclustered"
-		err = os.Rename(hfile.fileName, oldHeapDataFileCopyPath)
+		err = sharedFiles.rename(hfile.fileName, oldHeapDataFileCopyPath)
 		if err != nil {
 			return nil, err
 		}
@@ -341,18 +419,29 @@ func ConstructNNIndexFileFromHeapFile(hfile *HeapFile, indexedColName string, nC
 		var newPageFull sync.Map
 		hfile.pageFull = &newPageFull
 
-		err = os.Rename(nnif.dataHeapFile.fileName, hfile.fileName)
+		err = sharedFiles.rename(nnif.dataHeapFile.fileName, hfile.fileName)
 		if err != nil {
 			return nil, err
 		}
 		nnif.dataHeapFile.fileName = hfile.fileName
 		bp.ClearAllPages() // Need to reset the bufferpool after re-naming files
 
+		// records have moved, so any text index on the table is stale
+		for col := range hfile.textIndexes {
+			_, err = ConstructTextIndexFileFromHeapFile(hfile, col, dbPath, tableName, bp)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 	}
 
+	// tid has committed, so count under a new transaction to avoid leaking its locks
+	statsTid := bp.Transactions().Begin()
 	fmt.Println("Index generation complete.")
-	fmt.Println("Heap file ", hfile.fileName, " has ", hfile.NumTuples(tid), " tuples and ", hfile.NumPages(), "pages.")
-	fmt.Println("Index file ", nnif.dataHeapFile.fileName, " has ", nnif.dataHeapFile.NumTuples(tid), " tuples and ", nnif.dataHeapFile.NumPages(), "pages.")
+	fmt.Println("Heap file ", hfile.fileName, " has ", hfile.NumTuples(statsTid), " tuples and ", hfile.NumPages(), "pages.")
+	fmt.Println("Index file ", nnif.dataHeapFile.fileName, " has ", nnif.dataHeapFile.NumTuples(statsTid), " tuples and ", nnif.dataHeapFile.NumPages(), "pages.")
+	statsTid.Commit()
 
 	hfile.indexes[indexedColName] = nnif
 
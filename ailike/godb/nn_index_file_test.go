@@ -17,7 +17,7 @@ func TestConstructIndexUnclustered(t *testing.T) {
 		t.Fatalf("failed to construct index file, %s", err.Error())
 	}
 
-	iter, _ := ifile.centroidHeapFile.Iterator(NewTID())
+	iter, _ := ifile.centroidHeapFile.Iterator(bp.Transactions().Begin())
 	centroidCount := 0
 	for t, _ := iter(); t != nil; t, _ = iter() {
 		centroidCount++
@@ -26,7 +26,7 @@ func TestConstructIndexUnclustered(t *testing.T) {
 		t.Fatalf("expected %d centroids, got %d", numClusters, centroidCount)
 	}
 
-	iter, _ = ifile.dataHeapFile.Iterator(NewTID())
+	iter, _ = ifile.dataHeapFile.Iterator(bp.Transactions().Begin())
 	dataCount := 0
 	for t, _ := iter(); t != nil; t, _ = iter() {
 		dataCount++
@@ -42,13 +42,14 @@ func TestConstructIndexClustered(t *testing.T) {
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
-	tid := NewTID()
 
 	var numClusters int = 10
 	ifile, err := ConstructNNIndexFileFromHeapFile(hfile, "content", numClusters, true, ".", "tweets_test", bp)
 	if err != nil {
 		t.Fatalf("failed to construct index file, %s", err.Error())
 	}
+	// the index is read in a snapshot taken after it was built
+	tid := bp.Transactions().Begin()
 
 	iter, _ := ifile.centroidHeapFile.Iterator(tid)
 	centroidCount := 0
@@ -1,6 +1,9 @@
 package godb
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+)
 
 // Function to be queried in parser to check whether a given heap file
 // has an index for a specific column
@@ -36,8 +39,13 @@ type NNScan struct {
 	queryEmbedding EmbeddedStringField
 	heapFile       *HeapFile // tempory hack to continue doing heap scans until vector index implemented
 	nnIndexFile    *NNIndexFile
-	limitNo        int  // number of tuples to limit to
-	ascending      bool // whether to order by most or least similar
+	limitNo        int           // number of tuples to limit to
+	ascending      bool          // whether to order by most or least similar
+	filter         PredicateExpr // if non-nil, candidates that do not satisfy it are skipped
+	// if parts > 1, the scan is one of parts partitions of a parallel scan, and
+	// reads only the pages of the probed clusters whose page number is part
+	// modulo parts; see [NNScan.partition]
+	part, parts int
 }
 
 // Create an
@@ -58,19 +66,89 @@ func NewNNScan(heapFile *HeapFile, limit Expr, indexField FieldType, queryExpr C
 	}
 	limitNo := int(limitVal.(IntField).Value)
 
-	return &NNScan{indexField, queryEmbedding, heapFile, index, limitNo, ascending}, nil
+	return &NNScan{indexField, queryEmbedding, heapFile, index, limitNo, ascending, nil, 0, 1}, nil
+}
+
+// Returns the given partition of parts partitions of the scan, which together
+// read the pages of the clusters the scan probes, so that each can be read by
+// a worker of a parallel plan.  Each partition probes more clusters, as the
+// scan does, until it finds limitNo candidates that satisfy the filter, so
+// together they find at least as many as the scan.
+func (v *NNScan) partition(part int, parts int) *NNScan {
+	p := *v
+	p.part, p.parts = part, parts
+	return &p
+}
+
+// Pushes a predicate into the scan, so that only candidates satisfying it are
+// returned.  More clusters are probed to make up for the candidates it rejects.
+func (v *NNScan) SetFilter(pred PredicateExpr) {
+	v.filter = pred
+}
+
+// Returns the number of candidates the scan needs to find to produce limitNo
+// records that satisfy its filter.
+func (v *NNScan) candidatesNeeded() int {
+	if v.filter == nil {
+		return v.limitNo
+	}
+	sel := math.Max(predicateSelectivity(v.heapFile, v.filter), MinFilterSelectivity)
+	return int(math.Ceil(float64(v.limitNo) / sel))
 }
 
 func (v *NNScan) GetNumberOfProbes() int {
 	nCentroids := v.nnIndexFile.NCentroids()
 	nTuples := v.heapFile.ApproximateNumTuples()
 	avgClusterSize := nTuples / nCentroids
-	return v.limitNo/avgClusterSize + DefaultProbe
+	return v.candidatesNeeded()/avgClusterSize + DefaultProbe
 }
 
-func (v *NNScan) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+// If fewer than limitNo candidates satisfy the filter, which may be because it
+// skips the earlier pages of keyset pagination, twice as many clusters are
+// probed, until enough are found or every cluster has been probed.
+func (v *NNScan) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
 	// TODO: test strategy for number of probes for large limits
 	nProbes := v.GetNumberOfProbes()
+	probed := make(map[int]bool)
+	iter, err := v.candidateIterator(tid, nProbes, probed)
+	if err != nil || v.filter == nil {
+		return iter, err
+	}
+	found := 0
+	done := false
+	return func() (*Tuple, error) {
+		for !done {
+			t, err := iter()
+			if err != nil {
+				return nil, err
+			}
+			if t == nil {
+				if found >= v.limitNo || nProbes <= 0 || nProbes >= v.nnIndexFile.NCentroids() {
+					done = true
+					break
+				}
+				nProbes *= 2
+				if iter, err = v.candidateIterator(tid, nProbes, probed); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			ok, err := v.filter.EvalBool(t)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				found++
+				return t, nil
+			}
+		}
+		return nil, nil
+	}, nil
+}
+
+// Returns every record of the nProbes clusters nearest to the query, other than
+// those in probed, which are added to probed once they have all been returned.
+func (v *NNScan) candidateIterator(tid *Transaction, nProbes int, probed map[int]bool) (func() (*Tuple, error), error) {
 	centroidPageIter, err := v.nnIndexFile.getCentroidPageNoIterator(v.queryEmbedding, v.ascending, tid, nProbes)
 	if err != nil {
 		return nil, err
@@ -78,28 +156,46 @@ func (v *NNScan) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
 	var indexTupleIter func() (*Tuple, error) = func() (*Tuple, error) {
 		return nil, nil
 	}
+	probing := make(map[int]bool)
 	var hrid heapRecordId
+	// the pages of the probed clusters are all listed before any is read, so
+	// that they can be read ahead
+	var probeList [][2]int
+	listed := false
 	return func() (*Tuple, error) {
 		var t *Tuple
 		t, err := indexTupleIter()
 		if err != nil {
 			return nil, err
 		}
-		for t == nil {
-			// for centroidPageNoPair, err := centroidPageIter(); t == nil && centroidPageNoPair[1] != -1; centroidPageNoPair, err = centroidPageIter() {
-			centroidPageNoPair, err := centroidPageIter()
-			if err != nil {
+		if !listed {
+			if probeList, err = v.listProbePages(centroidPageIter, probed); err != nil {
 				return nil, err
 			}
+			listed = true
+		}
+		for t == nil {
+			centroidPageNoPair := [2]int{-1, -1}
+			if len(probeList) > 0 {
+				centroidPageNoPair, probeList = probeList[0], probeList[1:]
+			}
 			if centroidPageNoPair[1] == -1 {
+				for c := range probing {
+					probed[c] = true
+				}
 				return nil, nil
 			}
+			if !probing[centroidPageNoPair[0]] {
+				probing[centroidPageNoPair[0]] = true
+				tid.counters.clustersProbed.Add(1)
+			}
 			nextPageNo := centroidPageNoPair[1]
-			nextIndexPage, err := v.nnIndexFile.dataHeapFile.getHeapPage(nextPageNo, tid, ReadPerm)
+			// only the index entries visible to tid are read
+			entries, err := v.nnIndexFile.dataHeapFile.visibleTuples(nextPageNo, tid)
 			if err != nil {
 				return nil, err
 			}
-			indexTupleIter = nextIndexPage.tupleIter()
+			indexTupleIter = sliceIter(entries)
 			t, err = indexTupleIter()
 			if err != nil {
 				return nil, err
@@ -118,6 +214,31 @@ func (v *NNScan) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
 	}, nil
 }
 
+// Returns the [centroidId, pageNo] pairs of the pages of the clusters to probe,
+// other than those in probed, in the order to probe them, and asks the buffer
+// pool to read the pages ahead.  A partition of the scan lists only its share
+// of the pages.
+func (v *NNScan) listProbePages(centroidPageIter func() ([2]int, error), probed map[int]bool) ([][2]int, error) {
+	var probeList [][2]int
+	var pageNos []int
+	for {
+		centroidPageNoPair, err := centroidPageIter()
+		if err != nil {
+			return nil, err
+		}
+		if centroidPageNoPair[1] == -1 {
+			break
+		}
+		if probed[centroidPageNoPair[0]] || (v.parts > 1 && centroidPageNoPair[1]%v.parts != v.part) {
+			continue
+		}
+		probeList = append(probeList, centroidPageNoPair)
+		pageNos = append(pageNos, centroidPageNoPair[1])
+	}
+	v.nnIndexFile.dataHeapFile.bufPool.prefetchPages(v.nnIndexFile.dataHeapFile, pageNos)
+	return probeList, nil
+}
+
 func (v *NNScan) Descriptor() *TupleDesc {
 	return v.heapFile.Descriptor()
 }
@@ -128,5 +249,89 @@ func (v *NNScan) PrettyPrint() string {
 	if v.ascending {
 		orderString = "ascending"
 	}
-	return fmt.Sprintf("{clustered: %v, column: %v, table: %v, limit: %v, %v, query: %v}", v.nnIndexFile.clustered, v.indexField.Fname, v.indexField.TableQualifier, v.limitNo, orderString, query)
+	filter := ""
+	if v.filter != nil {
+		filter = ", filter: " + predicateToStr(v.filter)
+	}
+	if v.parts > 1 {
+		filter += fmt.Sprintf(", partition: %d of %d", v.part+1, v.parts)
+	}
+	return fmt.Sprintf("{clustered: %v, column: %v, table: %v, limit: %v, %v, query: %v%s}", v.nnIndexFile.clustered, v.indexField.Fname, v.indexField.TableQualifier, v.limitNo, orderString, query, filter)
+}
+
+// MultiNNScan merges the results of one NNScan per query embedding, returning
+// each record at most once. It provides the candidates for a query by several
+// examples, such as col AILIKE ANY('a', 'b').
+type MultiNNScan struct {
+	scans []*NNScan
+}
+
+func NewMultiNNScan(heapFile *HeapFile, limit Expr, indexField FieldType, queries []EmbeddedStringField, ascending bool) (*MultiNNScan, error) {
+	if len(queries) == 0 {
+		return nil, ailikeError{IllegalOperationError, "MultiNNScan requires at least one query"}
+	}
+	scans := make([]*NNScan, len(queries))
+	for i, q := range queries {
+		scan, err := NewNNScan(heapFile, limit, indexField, ConstExpr{q, EmbeddedStringType}, ascending)
+		if err != nil {
+			return nil, err
+		}
+		scans[i] = scan
+	}
+	return &MultiNNScan{scans}, nil
+}
+
+// Pushes a predicate into each of the scans.
+func (m *MultiNNScan) SetFilter(pred PredicateExpr) {
+	for _, scan := range m.scans {
+		scan.SetFilter(pred)
+	}
+}
+
+func (m *MultiNNScan) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
+	seen := make(map[any]bool)
+	scanNo := 0
+	var scanIter func() (*Tuple, error) = func() (*Tuple, error) {
+		return nil, nil
+	}
+	return func() (*Tuple, error) {
+		for {
+			t, err := scanIter()
+			if err != nil {
+				return nil, err
+			}
+			if t == nil {
+				if scanNo == len(m.scans) {
+					return nil, nil
+				}
+				scanIter, err = m.scans[scanNo].Iterator(tid)
+				if err != nil {
+					return nil, err
+				}
+				scanNo++
+				continue
+			}
+			if seen[t.Rid] {
+				continue
+			}
+			seen[t.Rid] = true
+			return t, nil
+		}
+	}, nil
+}
+
+func (m *MultiNNScan) Descriptor() *TupleDesc {
+	return m.scans[0].Descriptor()
+}
+
+func (m *MultiNNScan) PrettyPrint() string {
+	queries := ""
+	for i, scan := range m.scans {
+		if i > 0 {
+			queries += ", "
+		}
+		queries += scan.queryEmbedding.Value
+	}
+	first := m.scans[0]
+	return fmt.Sprintf("{clustered: %v, column: %v, table: %v, limit: %v per query, queries: %v}", first.nnIndexFile.clustered, first.indexField.Fname, first.indexField.TableQualifier, first.limitNo, queries)
 }
@@ -0,0 +1,253 @@
+package godb
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+// Returns the first n tweets of the test table.
+func readFirstTweets(t *testing.T, hf *HeapFile, bp *BufferPool, n int) []*Tuple {
+	tid := bp.Transactions().Begin()
+	defer tid.Commit()
+	iter, _ := hf.Iterator(tid)
+	var tweets []*Tuple
+	for len(tweets) < n {
+		tup, err := iter()
+		if err != nil || tup == nil {
+			t.Fatalf("failed to read test table")
+		}
+		tweets = append(tweets, tup)
+	}
+	return tweets
+}
+
+// Returns true if op or any operator below it is of the same type as target.
+func planContains(op Operator, target Operator) bool {
+	switch o := op.(type) {
+	case *LimitOp:
+		return planContains(o.child, target)
+	case *OrderBy:
+		return planContains(o.child, target)
+	case *Project:
+		return planContains(o.child, target)
+	case *Gather:
+		return planContains(o.children[0], target)
+	case *GatherMerge:
+		return planContains(o.children[0], target)
+	case *NNScan:
+		_, ok := target.(*NNScan)
+		return ok
+	case *MultiNNScan:
+		_, ok := target.(*MultiNNScan)
+		return ok
+	case *BM25Scan:
+		_, ok := target.(*BM25Scan)
+		return ok
+	}
+	return false
+}
+
+func TestMultiVectorExpr(t *testing.T) {
+	td := TupleDesc{Fields: []FieldType{{Fname: "content", Ftype: EmbeddedStringType}}}
+	tup := &Tuple{Desc: td, Fields: []DBValue{EmbeddedStringField{Value: "x", Emb: makeTestEmbedding(1, 0.5)}}}
+	queries := []EmbeddedStringField{
+		{Value: "a", Emb: makeTestEmbedding(1)},
+		{Value: "b", Emb: makeTestEmbedding(0, 1)},
+	}
+	field := &FieldExpr{td.Fields[0]}
+
+	// the dot products with the examples are 1 and 0.5
+	anyVal, err := NewMultiVectorExpr(field, queries, false).EvalExpr(tup)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if anyVal.(IntField).Value != -1000 {
+		t.Errorf("expected ANY to use the nearest example, got %d", anyVal.(IntField).Value)
+	}
+	allVal, err := NewMultiVectorExpr(field, queries, true).EvalExpr(tup)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if allVal.(IntField).Value != -500 {
+		t.Errorf("expected ALL to use the farthest example, got %d", allVal.(IntField).Value)
+	}
+
+	mean := NewMultiVectorExpr(field, queries, true).meanQuery()
+	if mean.Emb[0] != 0.5 || mean.Emb[1] != 0.5 {
+		t.Errorf("expected the mean of the examples, got %v", mean.Emb[:2])
+	}
+}
+
+func TestWeightedQueryParse(t *testing.T) {
+	c, _, _, _ := makeTweetsTestCatalog(t)
+	examples := map[string]EmbeddingType{
+		"a": makeTestEmbedding(1),
+		"b": makeTestEmbedding(0, 1),
+		"c": makeTestEmbedding(0, 0, 1),
+	}
+	startFakeEmbeddingServerFunc(t, func(text string) EmbeddingType { return examples[text] })
+
+	sql := "select tweet_id, content ailike (0.7*'a' + 'b'*0.3 - 0.2*'c') d from tweets_test order by d limit 3"
+	_, plan, err := Parse(c, sql)
+	if err != nil {
+		t.Fatalf("failed to parse, q=%s, %s", sql, err.Error())
+	}
+	proj := plan.(*LimitOp).child.(*OrderBy).child.(*Project)
+	fe, ok := proj.selectFields[1].(*FuncExpr)
+	if !ok {
+		t.Fatalf("expected an ailike function, got %v", proj.selectFields[1])
+	}
+	query := (*fe.args[1]).(*ConstExpr).val.(EmbeddedStringField)
+	expected := []float64{0.7, 0.3, -0.2}
+	for i, w := range expected {
+		if math.Abs(query.Emb[i]-w) > 1e-9 {
+			t.Fatalf("expected composed query %v, got %v", expected, query.Emb[:3])
+		}
+	}
+
+	for _, bad := range []string{
+		"select tweet_id from tweets_test order by content ailike ('a' * 'b') limit 3",
+		"select tweet_id from tweets_test order by content ailike (0.7 + 'a') limit 3",
+	} {
+		if _, _, err := Parse(c, bad); err == nil {
+			t.Errorf("expected error parsing %s", bad)
+		}
+	}
+}
+
+func TestMultiVectorParse(t *testing.T) {
+	c, hf, bp, dir := makeTweetsTestCatalog(t)
+	tweets := readFirstTweets(t, hf, bp, 2)
+	examples := map[string]EmbeddingType{
+		"first":  tweets[0].Fields[2].(EmbeddedStringField).Emb,
+		"second": tweets[1].Fields[2].(EmbeddedStringField).Emb,
+	}
+	startFakeEmbeddingServerFunc(t, func(text string) EmbeddingType { return examples[text] })
+
+	// find the best records under each semantics by brute force
+	bestAny := int64(math.MaxInt64)
+	var allDists []int64
+	tid := bp.Transactions().Begin()
+	iter, _ := hf.Iterator(tid)
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		var dists []int64
+		for _, ex := range []string{"first", "second"} {
+			dists = append(dists, ailikeFunc([]any{tup.Fields[2], EmbeddedStringField{Emb: examples[ex]}}).(int64))
+		}
+		bestAny = min(bestAny, min(dists[0], dists[1]))
+		allDists = append(allDists, max(dists[0], dists[1]))
+	}
+	tid.Commit()
+	slices.Sort(allDists)
+	bestAll := allDists[0]
+
+	anySQL := "select tweet_id, content ailike any('first', 'second') d from tweets_test order by d limit 3"
+	allSQL := "select tweet_id, content ailike `all`('first', 'second') d from tweets_test order by d limit 3"
+	_, dists := runIntColumnQuery(t, c, bp, anySQL, 1)
+	if len(dists) != 3 || dists[0] != bestAny {
+		t.Fatalf("expected best ANY distance %d, got %v", bestAny, dists)
+	}
+	_, dists = runIntColumnQuery(t, c, bp, allSQL, 1)
+	if len(dists) != 3 || dists[0] != bestAll {
+		t.Fatalf("expected best ALL distance %d, got %v", bestAll, dists)
+	}
+
+	// with an index, ANY probes once per example and ALL probes with their average
+	_, err := ConstructNNIndexFileFromHeapFile(hf, "content", 5, false, dir, "tweets_test", bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	plan, dists := runIntColumnQuery(t, c, bp, anySQL, 1)
+	if !planContains(plan, &MultiNNScan{}) {
+		t.Errorf("expected ANY query to use the vector index")
+	}
+	// each example is itself a record, so probing with it finds it
+	if len(dists) != 3 || dists[0] != bestAny {
+		t.Fatalf("expected best ANY distance %d, got %v", bestAny, dists)
+	}
+	plan, dists = runIntColumnQuery(t, c, bp, allSQL, 1)
+	var scan *NNScan
+	planHas(plan, func(op Operator) bool {
+		scan, _ = op.(*NNScan)
+		return scan != nil
+	})
+	if scan == nil {
+		t.Fatalf("expected ALL query to use the vector index")
+	}
+	// probing with the average finds as many candidates for each example as
+	// are wanted, which here include the best records under ALL
+	if scan.limitNo != 3*2 {
+		t.Errorf("expected the scan to find %d candidates, got %d", 3*2, scan.limitNo)
+	}
+	if !slices.Equal(dists, allDists[:3]) {
+		t.Fatalf("expected the best ALL distances %v, got %v", allDists[:3], dists)
+	}
+}
+
+// Pages through the results of a query by an index scan, with OFFSET and with
+// keyset pagination, checking that later pages probe more clusters and that no
+// record is returned twice.
+func TestNNScanPagination(t *testing.T) {
+	c, hf, bp, dir := makeTweetsTestCatalog(t)
+	query := readFirstTweets(t, hf, bp, 1)[0].Fields[2].(EmbeddedStringField).Emb
+	startFakeEmbeddingServerFunc(t, func(text string) EmbeddingType { return query })
+	if _, err := ConstructNNIndexFileFromHeapFile(hf, "content", 5, false, dir, "tweets_test", bp); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	const pageSize = 5
+	sql := "select tweet_id, content ailike 'q' d, rid() from tweets_test order by d limit 5"
+	var offsetProbes []int
+	for _, paging := range []string{"offset", "after"} {
+		seen := make(map[int64]bool)
+		page := sql
+		last := int64(math.MinInt64)
+		for i := 0; i < 4; i++ {
+			plan, rows := queryRows(t, c, bp, page)
+			scans := []*NNScan{}
+			planHas(plan, func(op Operator) bool {
+				if scan, ok := op.(*NNScan); ok {
+					scans = append(scans, scan)
+				}
+				return false
+			})
+			if len(scans) != 1 {
+				t.Fatalf("expected %s to use the vector index", page)
+			}
+			if paging == "offset" {
+				offsetProbes = append(offsetProbes, scans[0].GetNumberOfProbes())
+				if scans[0].limitNo != pageSize*(i+1) {
+					t.Errorf("expected the scan to find %d candidates, got %d", pageSize*(i+1), scans[0].limitNo)
+				}
+			}
+			if len(rows) != pageSize {
+				t.Fatalf("expected %d results on page %d, got %d", pageSize, i+1, len(rows))
+			}
+			for _, row := range rows {
+				id, d := row[0].(IntField).Value, row[1].(IntField).Value
+				if seen[id] {
+					t.Fatalf("tweet %d returned twice paging with %s", id, paging)
+				}
+				seen[id] = true
+				if d < last {
+					t.Errorf("results out of order paging with %s", paging)
+				}
+				last = d
+			}
+			end := rows[len(rows)-1]
+			if paging == "offset" {
+				page = fmt.Sprintf("%s offset %d", sql, pageSize*(i+1))
+			} else {
+				page = fmt.Sprintf("%s after %d, %d", sql, end[1].(IntField).Value, end[2].(IntField).Value)
+			}
+		}
+	}
+	if offsetProbes[len(offsetProbes)-1] < offsetProbes[0] {
+		t.Errorf("expected later pages to probe at least as many clusters, got %v", offsetProbes)
+	}
+}
@@ -1,14 +1,28 @@
 package godb
 
 import (
+	"container/heap"
+	"math"
 	"sort"
 )
 
+// SortMemoryBudget is the number of bytes of tuples that a sort planned by the
+// parser holds in memory before it spills sorted runs to disk.
+var SortMemoryBudget = 64 * 1024 * 1024
+
 type OrderBy struct {
 	orderBy   []Expr // OrderBy should include these two fields (used by parser)
 	child     Operator
 	ascending []bool
 	tuples    []Tuple
+	limit     Expr // if non-nil, only this many tuples are produced; see NewTopK
+	// the index in the child's descriptor of each field sorted on, or -1 for
+	// other expressions; used to find plans whose output is already sorted
+	sortedCols []int
+	// if non-nil, tuples beyond memoryBudget bytes are spilled to runs in
+	// temporary heap files, read and written through bufPool
+	bufPool      *BufferPool
+	memoryBudget int
 }
 
 // Order by constructor -- should save the list of field, child, and ascending
@@ -17,8 +31,44 @@ type OrderBy struct {
 // ascending bitmap indicates whether the ith field in the orderByFields
 // list should be in ascending (true) or descending (false) order.
 func NewOrderBy(orderByFields []Expr, child Operator, ascending []bool) (*OrderBy, error) {
-	return &OrderBy{orderBy: orderByFields, child: child, ascending: ascending, tuples: nil}, nil
+	return &OrderBy{orderBy: orderByFields, child: child, ascending: ascending, tuples: nil,
+		sortedCols: fieldColumns(orderByFields, child.Descriptor())}, nil
+
+}
 
+// Top-k constructor -- like [NewOrderBy], but only the first limit tuples in
+// order are produced.  Rather than sorting all of the child's tuples, the best
+// limit tuples seen so far are kept in a heap, so memory use is proportional to
+// the limit rather than to the input.
+func NewTopK(orderByFields []Expr, child Operator, ascending []bool, limit Expr) (*OrderBy, error) {
+	return &OrderBy{orderBy: orderByFields, child: child, ascending: ascending, limit: limit,
+		sortedCols: fieldColumns(orderByFields, child.Descriptor())}, nil
+}
+
+// Returns the index in desc of the field read by each of exprs, or -1 for
+// expressions that are not fields of desc.
+func fieldColumns(exprs []Expr, desc *TupleDesc) []int {
+	cols := make([]int, len(exprs))
+	for i, e := range exprs {
+		cols[i] = -1
+		if f, ok := e.(*FieldExpr); ok {
+			if idx, err := findFieldInTd(f.selectField, desc); err == nil {
+				cols[i] = idx
+			}
+		}
+	}
+	return cols
+}
+
+// Limits the tuples held in memory by the sort to about memoryBudget bytes.  Once
+// there are more, they are sorted into a run that is written to a temporary heap
+// file through bp, and the runs are merged as the results are iterated.  Without
+// a budget, the sort is entirely in memory.  Tuples with fields of unknown type,
+// such as NULL literals, cannot be written to heap files and are always sorted in
+// memory.
+func (o *OrderBy) SetMemoryBudget(bp *BufferPool, memoryBudget int) {
+	o.bufPool = bp
+	o.memoryBudget = memoryBudget
 }
 
 func (o *OrderBy) Descriptor() *TupleDesc {
@@ -45,13 +95,14 @@ func (o *OrderBy) Swap(i, j int) {
 // less functions until it finds a comparison that discriminates between
 // the two items (one is less than the other).
 func (o *OrderBy) Less(i, j int) bool {
-	p, q := &o.tuples[i], &o.tuples[j]
+	return o.less(&o.tuples[i], &o.tuples[j])
+}
+
+// Returns true if p sorts before q.
+func (o *OrderBy) less(p *Tuple, q *Tuple) bool {
 	for k := 0; k < len(o.orderBy); k++ {
 		expr := o.orderBy[k]
-		order, err := p.compareField(q, expr)
-		if !o.ascending[k] {
-			order, err = q.compareField(p, expr)
-		}
+		order, err := p.compareFieldDirected(q, expr, o.ascending[k])
 		if err != nil {
 			panic("Error while comparing fields in OrderBy.")
 		}
@@ -71,17 +122,18 @@ func (o *OrderBy) Less(i, j int) bool {
 
 // Return a function that iterators through the results of the child iterator in
 // ascending/descending order, as specified in the construtor.  This sort is
-// "blocking" -- it should first construct an in-memory sorted list of results
-// to return, and then iterate through them one by one on each subsequent
-// invocation of the iterator function.
+// "blocking" -- all of the child's tuples are read on the first invocation of
+// the iterator function, and then the results are returned one by one on each
+// subsequent invocation.
 //
-// Although you are free to implement your own sorting logic, you may wish to
-// leverage the go sort pacakge and the [sort.Sort] method for this purpose.  To
-// use this you will need to implement three methods:  Len, Swap, and Less that
-// the sort algorithm will invoke to preduce a sorted list. See the first
-// example, example of SortMultiKeys, and documentation at: https://pkg.go.dev/sort
-func (o *OrderBy) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
-	childIter, err := o.child.Iterator(tid)
+// A top-k sort keeps only the first tuples in a heap (see [NewTopK]).  Otherwise,
+// if the sort has a memory budget (see [OrderBy.SetMemoryBudget]), it is an
+// external merge sort: whenever the tuples read exceed the budget they are
+// sorted and spilled as a run, and the runs are then merged.  Sorts that fit in
+// memory never touch disk.
+func (o *OrderBy) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
+	// the sort reads all of its input, so it reads it in blocks
+	childIter, err := drainIterator(o.child, tid)
 	if err != nil {
 		return nil, err
 	}
@@ -89,27 +141,231 @@ func (o *OrderBy) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
 		return nil, ailikeError{MalformedDataError, "OrderBy child Iterator unexpectedly nil."}
 	}
 
-	var sorted bool = false
-	ts := make([]Tuple, 0)
-	var i int = 0
-	var tup Tuple
-
+	var sortedIter func() (*Tuple, error)
 	return func() (*Tuple, error) {
-		if !sorted {
-			for t, err := childIter(); t != nil || err != nil; t, err = childIter() {
-				if err != nil {
-					return nil, err
-				}
-				ts = append(ts, *t)
+		if sortedIter == nil {
+			var err error
+			if o.limit != nil {
+				sortedIter, err = o.topK(childIter)
+			} else {
+				sortedIter, err = o.externalSort(childIter, tid)
+			}
+			if err != nil {
+				return nil, err
 			}
-			o.Sort(ts)
 		}
-		sorted = true
+		return sortedIter()
+	}, nil
+}
+
+// Sorts ts in place.
+func (o *OrderBy) sortTuples(ts []*Tuple) {
+	sort.Slice(ts, func(i, j int) bool {
+		return o.less(ts[i], ts[j])
+	})
+}
+
+// Returns an iterator over ts.
+func sliceIter(ts []*Tuple) func() (*Tuple, error) {
+	i := 0
+	return func() (*Tuple, error) {
 		if i < len(ts) {
-			tup = ts[i]
 			i++
-			return &tup, nil
+			return ts[i-1], nil
 		}
 		return nil, nil
+	}
+}
+
+// tupleHeap is a [heap.Interface] of tuples, whose root is the least tuple
+// according to less.
+type tupleHeap struct {
+	tuples []*Tuple
+	less   func(p *Tuple, q *Tuple) bool
+}
+
+func (h *tupleHeap) Len() int           { return len(h.tuples) }
+func (h *tupleHeap) Less(i, j int) bool { return h.less(h.tuples[i], h.tuples[j]) }
+func (h *tupleHeap) Swap(i, j int)      { h.tuples[i], h.tuples[j] = h.tuples[j], h.tuples[i] }
+func (h *tupleHeap) Push(x any)         { h.tuples = append(h.tuples, x.(*Tuple)) }
+func (h *tupleHeap) Pop() any {
+	t := h.tuples[len(h.tuples)-1]
+	h.tuples = h.tuples[:len(h.tuples)-1]
+	return t
+}
+
+// Returns an iterator over the first tuples from childIter in order, as many as
+// the limit.  The best tuples seen so far are kept in a heap whose root is the
+// worst of them, so that a better tuple can replace it.
+func (o *OrderBy) topK(childIter func() (*Tuple, error)) (func() (*Tuple, error), error) {
+	limitVal, err := o.limit.EvalExpr(nil) // the limit is a ConstExpr, so it does not depend on a tuple
+	if err != nil {
+		return nil, err
+	}
+	limit, ok := limitVal.(IntField)
+	if !ok {
+		return nil, ailikeError{TypeMismatchError, "The limit of a top-k sort must be an integer."}
+	}
+	worstFirst := &tupleHeap{less: func(p *Tuple, q *Tuple) bool { return o.less(q, p) }}
+	for t, err := childIter(); t != nil || err != nil; t, err = childIter() {
+		if err != nil {
+			return nil, err
+		}
+		if int64(worstFirst.Len()) < limit.Value {
+			heap.Push(worstFirst, t)
+		} else if worstFirst.Len() > 0 && o.less(t, worstFirst.tuples[0]) {
+			worstFirst.tuples[0] = t
+			heap.Fix(worstFirst, 0)
+		}
+	}
+	o.sortTuples(worstFirst.tuples)
+	return sliceIter(worstFirst.tuples), nil
+}
+
+// Returns an iterator over the tuples from childIter in order.  Tuples are read
+// until they exceed the memory budget, and each such batch is sorted and spilled
+// as a run.  If any runs were spilled, so is the last batch, and the runs are
+// merged; otherwise the tuples are just sorted in memory.
+func (o *OrderBy) externalSort(childIter func() (*Tuple, error), tid *Transaction) (func() (*Tuple, error), error) {
+	desc := o.child.Descriptor()
+	runLength := math.MaxInt
+	if o.bufPool != nil && canSpill(desc) {
+		runLength = max(1, o.memoryBudget/desc.sizeInBytes())
+	}
+	var runs []*tempFile
+	var ts []*Tuple
+	for t, err := childIter(); t != nil || err != nil; t, err = childIter() {
+		if err != nil {
+			removeTempFiles(runs)
+			return nil, err
+		}
+		if len(ts) == runLength {
+			o.sortTuples(ts)
+			run, err := o.writeRun(sliceIter(ts), tid)
+			if err != nil {
+				removeTempFiles(runs)
+				return nil, err
+			}
+			runs = append(runs, run)
+			ts = nil
+		}
+		ts = append(ts, t)
+	}
+	if len(runs) == 0 {
+		o.sortTuples(ts)
+		return sliceIter(ts), nil
+	}
+	if len(ts) > 0 {
+		o.sortTuples(ts)
+		run, err := o.writeRun(sliceIter(ts), tid)
+		if err != nil {
+			removeTempFiles(runs)
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return o.mergeRuns(runs, tid)
+}
+
+// Writes the tuples from iter, which are already in order, to a new run in a
+// temporary file.
+func (o *OrderBy) writeRun(iter func() (*Tuple, error), tid *Transaction) (*tempFile, error) {
+	run, err := newTempFile(o.child.Descriptor(), o.bufPool, "godb_sort_run_*.dat", tid)
+	if err != nil {
+		return nil, err
+	}
+	for t, err := iter(); t != nil || err != nil; t, err = iter() {
+		if err == nil {
+			err = run.append(t, tid)
+		}
+		if err != nil {
+			run.remove()
+			return nil, err
+		}
+	}
+	if err := run.finish(); err != nil {
+		run.remove()
+		return nil, err
+	}
+	tid.counters.sortRunsSpilled.Add(1)
+	return run, nil
+}
+
+// Returns an iterator that merges the runs.  Merging reads a page of each run
+// at a time, so if there are more runs than pages in the memory budget, groups
+// of them are first merged into longer runs.  The runs are deleted once the
+// iterator is exhausted, or when tid completes if it is not.
+func (o *OrderBy) mergeRuns(runs []*tempFile, tid *Transaction) (func() (*Tuple, error), error) {
+	fanIn := max(2, o.memoryBudget/PageSize)
+	for len(runs) > fanIn {
+		var merged []*tempFile
+		for i := 0; i < len(runs); i += fanIn {
+			group := runs[i:min(i+fanIn, len(runs))]
+			iter, err := o.mergeIter(group, tid)
+			var run *tempFile
+			if err == nil {
+				run, err = o.writeRun(iter, tid)
+			}
+			if err != nil {
+				removeTempFiles(append(merged, runs[i:]...))
+				return nil, err
+			}
+			merged = append(merged, run)
+		}
+		runs = merged
+	}
+	return o.mergeIter(runs, tid)
+}
+
+// Returns an iterator over the tuples of the runs in order, which deletes the
+// runs once all of their tuples have been returned.
+func (o *OrderBy) mergeIter(runs []*tempFile, tid *Transaction) (func() (*Tuple, error), error) {
+	// the heap holds the next tuple of each run that has not been exhausted, and
+	// runOf maps each of them to the iterator of its run
+	next := &tupleHeap{less: o.less}
+	runOf := make(map[*Tuple]func() (*Tuple, error))
+	for _, run := range runs {
+		iter, err := run.Iterator(tid)
+		if err != nil {
+			removeTempFiles(runs)
+			return nil, err
+		}
+		t, err := iter()
+		if err != nil {
+			removeTempFiles(runs)
+			return nil, err
+		}
+		if t != nil {
+			heap.Push(next, t)
+			runOf[t] = iter
+		}
+	}
+	removed := false
+	return func() (*Tuple, error) {
+		if next.Len() == 0 {
+			if !removed {
+				removed = true
+				if err := removeTempFiles(runs); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		}
+		t := next.tuples[0]
+		iter := runOf[t]
+		delete(runOf, t)
+		following, err := iter()
+		if err != nil {
+			removeTempFiles(runs)
+			return nil, err
+		}
+		if following != nil {
+			next.tuples[0] = following
+			runOf[following] = iter
+			heap.Fix(next, 0)
+		} else {
+			heap.Pop(next)
+		}
+		return t, nil
 	}, nil
 }
@@ -1,7 +1,10 @@
 package godb
 
 import (
+	"fmt"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -111,8 +114,7 @@ func TestMultiFieldOrderBy(t *testing.T) {
 		t.Fatalf(err.Error())
 	}
 
-	tid := NewTID()
-	bp.BeginTransaction(tid)
+	tid := bp.Transactions().Begin()
 	hf.insertTuple(&t1, tid)
 	hf.insertTuple(&t2, tid)
 	hf.insertTuple(&t3, tid)
@@ -157,6 +159,300 @@ func TestMultiFieldOrderBy(t *testing.T) {
 		}
 	}
 
-	bp.CommitTransaction(tid)
+	tid.Commit()
 
 }
+
+func TestOrderByExpressions(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	for _, tc := range []struct {
+		sql      string
+		expected []int64
+	}{
+		// expressions and columns that are not selected are sorted on as hidden columns
+		{"select r_id from r where r_id < 5 order by 0 - r_id", []int64{4, 3, 2, 1, 0}},
+		{"select r_id from r where r_id < 100 order by s_id, r_id desc limit 4", []int64{50, 0, 51, 1}},
+		// an expression of the select list is sorted on by repeating it or by its alias
+		{"select r_id * 2 from r where r_id < 3 order by r_id * 2 desc", []int64{4, 2, 0}},
+		{"select 0 - r_id neg from r where r_id < 3 order by neg", []int64{-2, -1, 0}},
+	} {
+		plan, vals := runIntColumnQuery(t, c, bp, tc.sql, 0)
+		if len(plan.Descriptor().Fields) != 1 {
+			t.Errorf("expected hidden columns to be removed from the results of %s, got %d columns", tc.sql, len(plan.Descriptor().Fields))
+		}
+		if len(vals) != len(tc.expected) {
+			t.Errorf("expected %v for %s, got %v", tc.expected, tc.sql, vals)
+			continue
+		}
+		for i := range vals {
+			if vals[i] != tc.expected[i] {
+				t.Errorf("expected %v for %s, got %v", tc.expected, tc.sql, vals)
+				break
+			}
+		}
+	}
+
+	if _, _, err := Parse(c, "select distinct s_id from r order by r_id"); err == nil {
+		t.Errorf("expected error ordering a distinct query by a column that is not selected")
+	}
+}
+
+func TestOrderByUnprojectedAilike(t *testing.T) {
+	c, hf, bp, dir := makeTweetsTestCatalog(t)
+	tweets := readFirstTweets(t, hf, bp, 1)
+	startFakeEmbeddingServer(t, tweets[0].Fields[2].(EmbeddedStringField).Emb)
+	_, err := ConstructNNIndexFileFromHeapFile(hf, "content", 10, false, dir, "tweets_test", bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	plan, ids := runIntColumnQuery(t, c, bp, "select tweet_id from tweets_test order by content ailike 'query' limit 5", 0)
+	if !planContains(plan, &NNScan{}) {
+		t.Errorf("expected ordering by an unprojected similarity to use the vector index")
+	}
+	if len(plan.Descriptor().Fields) != 1 {
+		t.Errorf("expected only the tweet id in the results, got %d columns", len(plan.Descriptor().Fields))
+	}
+	_, expected := runIntColumnQuery(t, c, bp, "select tweet_id, content ailike 'query' d from tweets_test order by d limit 5", 0)
+	if len(ids) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, ids)
+	}
+	for i := range ids {
+		if ids[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected, ids)
+			break
+		}
+	}
+}
+
+// Makes a heap file of n tuples with random ages, whose names are their insertion order.
+func makeSortTestFile(t *testing.T, n int) (*HeapFile, *BufferPool) {
+	td := TupleDesc{Fields: []FieldType{
+		{Fname: "name", Ftype: StringType},
+		{Fname: "age", Ftype: IntType},
+	}}
+	bp := NewBufferPool(50)
+	os.Remove(TestingFile)
+	hf, err := NewHeapFile(TestingFile, &td, bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := bp.Transactions().Begin()
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < n; i++ {
+		tup := Tuple{Desc: td, Fields: []DBValue{StringField{fmt.Sprintf("%05d", i)}, IntField{r.Int63n(100)}}}
+		if err := hf.insertTuple(&tup, tid); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	tid.Commit()
+	return hf, bp
+}
+
+// Checks that the results of two sorts on age descending and then name are the same.
+func checkSameOrder(t *testing.T, expected []*Tuple, got []*Tuple) {
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d tuples, got %d", len(expected), len(got))
+	}
+	for i := range got {
+		if !got[i].equals(expected[i]) {
+			t.Fatalf("expected %v at position %d, got %v", expected[i].Fields, i, got[i].Fields)
+		}
+	}
+}
+
+func TestExternalOrderBy(t *testing.T) {
+	const n = 2000
+	hf, bp := makeSortTestFile(t, n)
+	exprs := []Expr{&FieldExpr{hf.Descriptor().Fields[1]}, &FieldExpr{hf.Descriptor().Fields[0]}}
+	ascending := []bool{false, true}
+	tid := bp.Transactions().Begin()
+	defer tid.Commit()
+
+	inMemory, err := NewOrderBy(exprs, hf, ascending)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := collectTuples(t, inMemory, tid)
+	for i := 1; i < len(expected); i++ {
+		if inMemory.less(expected[i], expected[i-1]) {
+			t.Fatalf("tuples %d and %d are out of order", i-1, i)
+		}
+	}
+
+	runsBefore, _ := filepath.Glob(filepath.Join(os.TempDir(), "godb_sort_run_*"))
+	for _, runTuples := range []int{n, 300, 7} {
+		// the runs are much larger than the buffer pool, so their pages must be
+		// written out as they fill; with runs of 7 tuples, the budget is less
+		// than a page, so the runs are merged two at a time
+		external, err := NewOrderBy(exprs, hf, ascending)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		external.SetMemoryBudget(bp, runTuples*hf.Descriptor().sizeInBytes())
+		before := tid.counters.read()
+		checkSameOrder(t, expected, collectTuples(t, external, tid))
+		spilled := tid.counters.read().SortRunsSpilled - before.SortRunsSpilled
+		if runTuples == n && spilled != 0 {
+			t.Errorf("expected a sort that fits in memory not to spill, got %d runs", spilled)
+		}
+		if runTuples < n && spilled < int64((n+runTuples-1)/runTuples) {
+			t.Errorf("expected at least %d runs with a budget of %d tuples, got %d", n/runTuples, runTuples, spilled)
+		}
+	}
+	runsAfter, _ := filepath.Glob(filepath.Join(os.TempDir(), "godb_sort_run_*"))
+	if len(runsAfter) != len(runsBefore) {
+		t.Errorf("expected the runs to be deleted after the sort, found %d more files", len(runsAfter)-len(runsBefore))
+	}
+	if len(bp.pageMap) > bp.numPages {
+		t.Errorf("expected the sort to stay within the buffer pool")
+	}
+}
+
+// The runs of a spilled sort whose consumer stops reading before the end, as a
+// LIMIT above it does, are deleted when the transaction completes.
+func TestExternalOrderByStopsEarly(t *testing.T) {
+	hf, bp := makeSortTestFile(t, 2000)
+	runs := func() int {
+		files, _ := filepath.Glob(filepath.Join(os.TempDir(), "godb_sort_run_*"))
+		return len(files)
+	}
+	before := runs()
+	sort, err := NewOrderBy([]Expr{&FieldExpr{hf.Descriptor().Fields[1]}}, hf, []bool{true})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	sort.SetMemoryBudget(bp, 100*hf.Descriptor().sizeInBytes())
+	tid := bp.Transactions().Begin()
+	iter, err := NewLimitOp(&ConstExpr{IntField{1}, IntType}, sort).Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if runs() <= before {
+		t.Fatalf("expected the sort to spill runs")
+	}
+	tid.Commit()
+	if after := runs(); after != before {
+		t.Errorf("expected the runs to be deleted when the transaction commits, found %d more files", after-before)
+	}
+}
+
+func TestTopK(t *testing.T) {
+	const n = 500
+	hf, bp := makeSortTestFile(t, n)
+	exprs := []Expr{&FieldExpr{hf.Descriptor().Fields[1]}, &FieldExpr{hf.Descriptor().Fields[0]}}
+	ascending := []bool{false, true}
+	tid := bp.Transactions().Begin()
+	defer tid.Commit()
+
+	oby, err := NewOrderBy(exprs, hf, ascending)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	sorted := collectTuples(t, oby, tid)
+	for _, k := range []int{0, 1, 10, n, n + 10} {
+		topK, err := NewTopK(exprs, hf, ascending, &ConstExpr{IntField{int64(k)}, IntType})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		checkSameOrder(t, sorted[:min(k, n)], collectTuples(t, topK, tid))
+	}
+}
+
+// Returns the first sort in the plan.
+func findOrderBy(op Operator) *OrderBy {
+	if oby, ok := op.(*OrderBy); ok {
+		return oby
+	}
+	for _, child := range planChildren(op) {
+		if oby := findOrderBy(child); oby != nil {
+			return oby
+		}
+	}
+	return nil
+}
+
+func TestOrderByPlanning(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	budget := SortMemoryBudget
+	SortMemoryBudget = 1000
+	defer func() { SortMemoryBudget = budget }()
+
+	plan, vals := runIntColumnQuery(t, c, bp, "select r_id from r order by s_id desc, r_id limit 5", 0)
+	if oby := findOrderBy(plan); oby == nil || oby.limit == nil {
+		t.Errorf("expected a sort with a limit to keep only the first tuples")
+	}
+	expected := []int64{49, 99, 149, 199, 249}
+	for i := range expected {
+		if i >= len(vals) || vals[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, vals)
+		}
+	}
+
+	// the sort spills to disk, since it is over the memory budget
+	sql := "select r_id from r order by s_id, r_id"
+	plan, vals = runIntColumnQuery(t, c, bp, sql, 0)
+	if oby := findOrderBy(plan); oby == nil || oby.bufPool == nil {
+		t.Errorf("expected a sort without a limit to have a memory budget")
+	}
+	_, plan, err := Parse(c, sql)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := bp.Transactions().Begin()
+	explained, err := ExplainAnalyze(plan, tid)
+	tid.Commit()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if explained.SortRunsSpilled == 0 {
+		t.Errorf("expected the sort to spill runs")
+	}
+	if len(vals) != 500 {
+		t.Fatalf("expected 500 results, got %d", len(vals))
+	}
+	for i, v := range vals {
+		if v != int64(i%10*50+i/10) {
+			t.Fatalf("expected %d at position %d, got %d", i%10*50+i/10, i, v)
+		}
+	}
+}
+
+// Rows whose distance is NULL, because their text is NULL, are ranked after
+// every other row, in either direction, rather than as the best matches.
+func TestOrderByNullsLast(t *testing.T) {
+	hf, bp := makeDistanceTestFile(t, 50, 40)
+	tid := bp.Transactions().Begin()
+	defer tid.Commit()
+	td := hf.Descriptor()
+	query := &ConstExpr{EmbeddedStringField{Value: "q", Emb: randomEmbedding(rand.New(rand.NewSource(8)))}, EmbeddedStringType}
+	dist := distanceExpr("ailike", &FieldExpr{td.Fields[1]}, query)
+	for _, ascending := range []bool{true, false} {
+		topK, err := NewTopK([]Expr{dist}, hf, []bool{ascending}, &ConstExpr{IntField{5}, IntType})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		for _, tup := range collectTuples(t, topK, tid) {
+			if tup.Fields[1] == nil {
+				t.Errorf("expected no rows with NULL text among the best 5 (ascending %v), got %v", ascending, tup.Fields[0])
+			}
+		}
+
+		oby, err := NewOrderBy([]Expr{dist}, hf, []bool{ascending})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		sorted := collectTuples(t, oby, tid)
+		// every seventh of the 50 rows, from the first, is NULL
+		for i, tup := range sorted {
+			if isNull := tup.Fields[1] == nil; isNull != (i >= len(sorted)-8) {
+				t.Fatalf("expected the 8 rows with NULL text last (ascending %v), got row %v at %d", ascending, tup.Fields[0], i)
+			}
+		}
+	}
+}
@@ -2,6 +2,7 @@ package godb
 
 import (
 	"fmt"
+	"math"
 	"reflect"
 	"strconv"
 	"strings"
@@ -10,15 +11,16 @@ import (
 	"github.com/xwb1989/sqlparser"
 )
 
+// A filter is a boolean predicate over one or more tables, such as a conjunct of
+// the where clause
 type LogicalFilterNode struct {
-	fieldExpr LogicalSelectNode
-	constExpr LogicalSelectNode
-	predOp    BoolOp
+	pred *LogicalSelectNode
 }
 
 type LogicalJoinNode struct {
 	left, right *LogicalSelectNode
 	predOp      BoolOp
+	joinType    JoinType // for outer joins, left is a field of the left table of the join
 }
 
 type SelectExprType int
@@ -29,17 +31,25 @@ const (
 	ExprFunc  SelectExprType = iota
 	ExprStar  SelectExprType = iota
 	ExprAggr  SelectExprType = iota
+	ExprPred  SelectExprType = iota
+	ExprNull  SelectExprType = iota
+	// a subquery used as a value, or the subquery of IN or EXISTS
+	ExprSubquery SelectExprType = iota
+	// a field of an enclosing query, referenced by a subquery
+	ExprParam SelectExprType = iota
 )
 
 type LogicalSelectNode struct {
 	exprType    SelectExprType
 	table       string
 	field       string
-	funcOp      *string //may be nil, if no aggregate
+	funcOp      *string //may be nil, if no aggregate; for predicates, the boolean or comparison operator
 	alias       string
 	value       string
 	args        []*LogicalSelectNode //for functions other than aggregates
 	cachedField *FieldType
+	subquery    *LogicalPlan //for subqueries
+	param       *paramExpr   //for fields of an enclosing query
 }
 
 func NewFieldSelectNode(table string, field string, alias string) LogicalSelectNode {
@@ -57,6 +67,12 @@ func NewConstSelectNode(value string, alias string) LogicalSelectNode {
 	lsn.alias = alias
 	return lsn
 }
+func NewNullSelectNode(alias string) LogicalSelectNode {
+	lsn := LogicalSelectNode{}
+	lsn.exprType = ExprNull
+	lsn.alias = alias
+	return lsn
+}
 func NewStarSelectNode(table string) LogicalSelectNode {
 	lsn := LogicalSelectNode{}
 	lsn.exprType = ExprStar
@@ -83,6 +99,24 @@ func NewFuncSelectNode(op string, args []*LogicalSelectNode, alias string) Logic
 	return lsn
 }
 
+func NewSubquerySelectNode(subquery *LogicalPlan, alias string) LogicalSelectNode {
+	lsn := LogicalSelectNode{}
+	lsn.exprType = ExprSubquery
+	lsn.subquery = subquery
+	lsn.alias = alias
+	return lsn
+}
+
+// Predicate ops are "and", "or", "not", "exists", "in", "not in", "between", "not between",
+// "is null", "is not null", or a comparison operator from BoolOpMap
+func NewPredSelectNode(op string, args []*LogicalSelectNode) LogicalSelectNode {
+	lsn := LogicalSelectNode{}
+	lsn.exprType = ExprPred
+	lsn.funcOp = &op
+	lsn.args = args
+	return lsn
+}
+
 func checkNameInTablesOrSubqueries(table string, field string, c *Catalog, subqueries []*LogicalPlan, ts []*LogicalTableNode) (string, error) {
 	if table == "" && subqueries != nil {
 		for _, q := range subqueries {
@@ -105,7 +139,11 @@ func checkNameInTablesOrSubqueries(table string, field string, c *Catalog, subqu
 					if table != "" {
 						return "", ailikeError{AmbiguousNameError, fmt.Sprintf("multiple possible table names for field %s in select expression", field)}
 					}
+					// a table with an alias is only known by its alias
 					table = t.name
+					if t2.alias != "" {
+						table = t2.alias
+					}
 				}
 			}
 		}
@@ -117,10 +155,10 @@ func checkNameInTablesOrSubqueries(table string, field string, c *Catalog, subqu
 // if catalog is non null, will try to resolve table name from catalog
 // otherwise, will not
 func (lsn *LogicalSelectNode) getTableField(c *Catalog, subqueries []*LogicalPlan, ts []*LogicalTableNode) (string, string, error) {
-	if lsn.exprType == ExprConst {
+	if lsn.exprType == ExprConst || lsn.exprType == ExprNull || lsn.exprType == ExprSubquery || lsn.exprType == ExprParam {
 		return "", "", nil
 	}
-	if lsn.exprType == ExprFunc || lsn.exprType == ExprAggr {
+	if lsn.exprType == ExprFunc || lsn.exprType == ExprAggr || lsn.exprType == ExprPred {
 		tabName := ""
 		fieldName := ""
 		for _, subLsn := range lsn.args {
@@ -156,6 +194,74 @@ func (lsn *LogicalSelectNode) getTableField(c *Catalog, subqueries []*LogicalPla
 	return tabName, field, nil
 }
 
+// Returns the columns referenced by the expression, including those referenced
+// by its subqueries.
+func (lsn *LogicalSelectNode) referencedFields() []*LogicalSelectNode {
+	switch lsn.exprType {
+	case ExprField:
+		return []*LogicalSelectNode{lsn}
+	case ExprSubquery:
+		var fields []*LogicalSelectNode
+		for _, r := range lsn.subquery.outerRefs {
+			fields = append(fields, r.field.referencedFields()...)
+		}
+		return fields
+	case ExprFunc, ExprAggr, ExprPred:
+		var fields []*LogicalSelectNode
+		for _, arg := range lsn.args {
+			fields = append(fields, arg.referencedFields()...)
+		}
+		return fields
+	}
+	return nil
+}
+
+// Returns true if the two expressions compute the same value, ignoring aliases.
+func (lsn *LogicalSelectNode) sameExpr(other *LogicalSelectNode) bool {
+	if lsn.exprType != other.exprType || lsn.table != other.table || lsn.field != other.field ||
+		lsn.value != other.value || len(lsn.args) != len(other.args) ||
+		lsn.subquery != other.subquery || lsn.param != other.param {
+		return false
+	}
+	if (lsn.funcOp == nil) != (other.funcOp == nil) || (lsn.funcOp != nil && *lsn.funcOp != *other.funcOp) {
+		return false
+	}
+	for i, arg := range lsn.args {
+		if !arg.sameExpr(other.args[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the index of the first of nodes that computes the same value as lsn, or -1.
+func findSameExpr(nodes []*LogicalSelectNode, lsn *LogicalSelectNode) int {
+	for i, n := range nodes {
+		if n.sameExpr(lsn) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Makes the parts of lsn that repeat a group by expression refer to the group's
+// column of the aggregate output.  Aggregates are left alone, as their arguments
+// are evaluated before grouping.
+func (lsn *LogicalSelectNode) bindGroupBys(groupBys []*GroupBy) {
+	if lsn.exprType == ExprAggr {
+		return
+	}
+	for _, gby := range groupBys {
+		if gby.expr.exprType != ExprField && gby.expr.cachedField != nil && lsn.sameExpr(gby.expr) {
+			lsn.cachedField = gby.expr.cachedField
+			return
+		}
+	}
+	for _, arg := range lsn.args {
+		arg.bindGroupBys(groupBys)
+	}
+}
+
 type LogicalTableNode struct {
 	tableName string
 	alias     string
@@ -179,10 +285,32 @@ type LogicalPlan struct {
 	tables        []*LogicalTableNode
 	subqueries    []*LogicalPlan
 	groupByFields []*GroupBy
+	having        *LogicalSelectNode
 	orderByFields []*OrderByNode
 	limit         *LogicalSelectNode
+	offset        *LogicalSelectNode
 	distinct      bool
 	alias         string
+	outerRefs     []*outerRef   //for a subquery, its references to fields of the enclosing query
+	physical      *subqueryPlan //for a subquery evaluated as an expression, its plan
+	setOp         *logicalSetOp //for a set operation, its inputs; the plan has no tables or selects
+	after         *keysetCursor //for keyset pagination, the last record of the previous page
+}
+
+// A set operation, such as UNION, over the results of two queries.
+type logicalSetOp struct {
+	op    SetOperation
+	all   bool
+	left  *LogicalPlan
+	right *LogicalPlan
+}
+
+// A reference from a subquery to a field of an enclosing query.  In the plan of
+// the subquery the field is a parameter, which is set to the field's value for
+// each record of the enclosing query that the subquery is evaluated for.
+type outerRef struct {
+	field *LogicalSelectNode // the field, as an expression of the enclosing query
+	param *paramExpr
 }
 
 func (p *LogicalPlan) printLogicalPlan() {
@@ -235,6 +363,11 @@ func (p *LogicalPlan) printLogicalPlan() {
 	}
 	fmt.Println("----------------")
 
+	fmt.Println("----------------")
+	fmt.Println("having: ")
+	fmt.Println(p.having)
+	fmt.Println("----------------")
+
 	fmt.Println("----------------")
 	fmt.Println("orderByFields: ")
 	for _, el := range p.orderByFields {
@@ -260,6 +393,13 @@ func (p *LogicalPlan) printLogicalPlan() {
 
 func (p *LogicalPlan) getSubplanFields(c *Catalog) []*FieldType {
 	var nodes []*FieldType
+	if p.setOp != nil {
+		// a set operation has the field names of its left input
+		for _, f := range p.setOp.left.getSubplanFields(c) {
+			nodes = append(nodes, &FieldType{f.Fname, p.alias, UnknownType})
+		}
+		return nodes
+	}
 	for _, s := range p.selects {
 		_, field, _ := s.getTableField(c, p.subqueries, p.tables)
 		nodes = append(nodes, &FieldType{field, p.alias, UnknownType})
@@ -267,23 +407,32 @@ func (p *LogicalPlan) getSubplanFields(c *Catalog) []*FieldType {
 	return nodes
 }
 
+// Splits a where clause into the equality joins between tables and filter predicates.
 func parseWhere(c *Catalog, subqueries []*LogicalPlan, ts []*LogicalTableNode, expr sqlparser.Expr) ([]*LogicalFilterNode, []*LogicalJoinNode, error) {
 
 	switch expr := expr.(type) {
 	case *sqlparser.AndExpr:
 
-		filterListLeft, joinListLeft, _ := parseWhere(c, subqueries, ts, expr.Left)
-		filterListRight, joinListRight, _ := parseWhere(c, subqueries, ts, expr.Right)
+		filterListLeft, joinListLeft, err := parseWhere(c, subqueries, ts, expr.Left)
+		if err != nil {
+			return nil, nil, err
+		}
+		filterListRight, joinListRight, err := parseWhere(c, subqueries, ts, expr.Right)
+		if err != nil {
+			return nil, nil, err
+		}
 		filterExprs := append(filterListLeft, filterListRight...)
 		joinExprs := append(joinListLeft, joinListRight...)
 
 		return filterExprs, joinExprs, nil
 
-	case *sqlparser.ComparisonExpr:
-		op := BoolOpMap[expr.Operator]
-		//print(op)
-		//print("got compare")
+	case *sqlparser.ParenExpr:
+		return parseWhere(c, subqueries, ts, expr.Expr)
 
+	case *sqlparser.ComparisonExpr:
+		if expr.Operator != sqlparser.EqualStr {
+			break
+		}
 		left, err := parseExpr(c, expr.Left, "")
 		if err != nil {
 			return nil, nil, err
@@ -302,49 +451,160 @@ func parseWhere(c *Catalog, subqueries []*LogicalPlan, ts []*LogicalTableNode, e
 			return nil, nil, err
 		}
 		if lTable != "" && rTable != "" && lTable != rTable { //join
+			join := LogicalJoinNode{left, right, OpEq, InnerJoin}
+			return nil, []*LogicalJoinNode{&join}, nil
+		}
+	}
+	// anything else is a filter; comparisons between tables other than
+	// equality are applied once the tables have been joined
+	pred, err := parsePredicate(c, expr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []*LogicalFilterNode{{pred}}, nil, nil
+}
 
-			if op != OpEq {
-				return nil, nil, ailikeError{IllegalOperationError, "only equality joins are supported"}
+// Parses a boolean expression into a predicate node.
+func parsePredicate(c *Catalog, expr sqlparser.Expr) (*LogicalSelectNode, error) {
+	parseArgs := func(exprs ...sqlparser.Expr) ([]*LogicalSelectNode, error) {
+		args := make([]*LogicalSelectNode, len(exprs))
+		for i, e := range exprs {
+			arg, err := parseExpr(c, e, "")
+			if err != nil {
+				return nil, err
 			}
-			join := LogicalJoinNode{left, right, op}
-			lj := make([]*LogicalJoinNode, 1)
-			lj[0] = &join
-			return nil, lj, nil
+			args[i] = arg
+		}
+		return args, nil
+	}
+	switch expr := expr.(type) {
+	case *sqlparser.AndExpr, *sqlparser.OrExpr:
+		op, l, r := "and", sqlparser.Expr(nil), sqlparser.Expr(nil)
+		if and, ok := expr.(*sqlparser.AndExpr); ok {
+			l, r = and.Left, and.Right
 		} else {
-			filter := LogicalFilterNode{*left, *right, op}
-			lf := make([]*LogicalFilterNode, 1)
-			lf[0] = &filter
-			return lf, nil, nil
+			or := expr.(*sqlparser.OrExpr)
+			op, l, r = "or", or.Left, or.Right
 		}
-	default:
-		return nil, nil, ailikeError{ParseError, "where expression with non value or column on RHS (disjunctions and nested where expressions are not supported)"}
+		left, err := parsePredicate(c, l)
+		if err != nil {
+			return nil, err
+		}
+		right, err := parsePredicate(c, r)
+		if err != nil {
+			return nil, err
+		}
+		pred := NewPredSelectNode(op, []*LogicalSelectNode{left, right})
+		return &pred, nil
+	case *sqlparser.NotExpr:
+		sub, err := parsePredicate(c, expr.Expr)
+		if err != nil {
+			return nil, err
+		}
+		pred := NewPredSelectNode("not", []*LogicalSelectNode{sub})
+		return &pred, nil
+	case *sqlparser.ParenExpr:
+		return parsePredicate(c, expr.Expr)
+	case *sqlparser.ComparisonExpr:
+		switch expr.Operator {
+		case sqlparser.InStr, sqlparser.NotInStr:
+			if _, ok := expr.Right.(*sqlparser.Subquery); ok {
+				args, err := parseArgs(expr.Left, expr.Right)
+				if err != nil {
+					return nil, err
+				}
+				pred := NewPredSelectNode(expr.Operator, args)
+				return &pred, nil
+			}
+			list, ok := expr.Right.(sqlparser.ValTuple)
+			if !ok {
+				return nil, ailikeError{ParseError, "IN expects a list of values or a subquery"}
+			}
+			args, err := parseArgs(append(sqlparser.Exprs{expr.Left}, list...)...)
+			if err != nil {
+				return nil, err
+			}
+			pred := NewPredSelectNode(expr.Operator, args)
+			return &pred, nil
+		case sqlparser.NotLikeStr:
+			args, err := parseArgs(expr.Left, expr.Right)
+			if err != nil {
+				return nil, err
+			}
+			like := NewPredSelectNode(sqlparser.LikeStr, args)
+			pred := NewPredSelectNode("not", []*LogicalSelectNode{&like})
+			return &pred, nil
+		}
+		if _, ok := BoolOpMap[expr.Operator]; !ok {
+			return nil, ailikeError{ParseError, fmt.Sprintf("unsupported comparison operator %s", expr.Operator)}
+		}
+		args, err := parseArgs(expr.Left, expr.Right)
+		if err != nil {
+			return nil, err
+		}
+		pred := NewPredSelectNode(expr.Operator, args)
+		return &pred, nil
+	case *sqlparser.RangeCond:
+		args, err := parseArgs(expr.Left, expr.From, expr.To)
+		if err != nil {
+			return nil, err
+		}
+		pred := NewPredSelectNode(expr.Operator, args)
+		return &pred, nil
+	case *sqlparser.IsExpr:
+		if expr.Operator != sqlparser.IsNullStr && expr.Operator != sqlparser.IsNotNullStr {
+			return nil, ailikeError{ParseError, fmt.Sprintf("unsupported predicate %s", expr.Operator)}
+		}
+		args, err := parseArgs(expr.Expr)
+		if err != nil {
+			return nil, err
+		}
+		pred := NewPredSelectNode(expr.Operator, args)
+		return &pred, nil
+	case *sqlparser.ExistsExpr:
+		subplan, err := parseSubquery(c, expr.Subquery)
+		if err != nil {
+			return nil, err
+		}
+		sub := NewSubquerySelectNode(subplan, "")
+		pred := NewPredSelectNode("exists", []*LogicalSelectNode{&sub})
+		return &pred, nil
+	case *sqlparser.MatchExpr:
+		// a row matches if it contains at least one of the query terms, which
+		// is tested directly rather than as a BM25 score above 0, since the
+		// scaled score of a weak match truncates to 0
+		match, err := parseMatch(c, expr, "text_match", "")
+		if err != nil {
+			return nil, err
+		}
+		zero := NewConstSelectNode("0", "")
+		pred := NewPredSelectNode(">", []*LogicalSelectNode{match, &zero})
+		return &pred, nil
 	}
+	return nil, ailikeError{ParseError, fmt.Sprintf("unsupported where expression %s", sqlparser.String(expr))}
 }
 
-func parseFrom(c *Catalog, t sqlparser.TableExpr) ([]*LogicalTableNode, []*LogicalPlan, []*LogicalJoinNode, error) {
+func parseFrom(c *Catalog, t sqlparser.TableExpr) ([]*LogicalTableNode, []*LogicalPlan, []*LogicalJoinNode, []*LogicalFilterNode, error) {
 	switch tableEx := t.(type) {
 	case *sqlparser.AliasedTableExpr:
 		switch tableEx.Expr.(type) {
 		case *sqlparser.Subquery:
 			sq := (tableEx.Expr).(*sqlparser.Subquery)
 			//print("got subquery")
-			switch stmt := sq.Select.(type) {
-			case *sqlparser.Select:
-				subplan, err := parseStatement(c, stmt)
-				if err != nil {
-					return nil, nil, nil, err
-				}
-				subplan.alias = strings.ToLower(sqlparser.String(tableEx.As))
-				subplans := make([]*LogicalPlan, 1)
-				subplans[0] = subplan
-				return nil, subplans, nil, nil
+			subplan, err := parseSelectStatement(c, sq.Select)
+			if err != nil {
+				return nil, nil, nil, nil, err
 			}
+			subplan.alias = strings.ToLower(sqlparser.String(tableEx.As))
+			subplans := make([]*LogicalPlan, 1)
+			subplans[0] = subplan
+			return nil, subplans, nil, nil, nil
 		case sqlparser.SimpleTableExpr:
 			tableName := strings.ToLower(sqlparser.GetTableName(tableEx.Expr).CompliantName())
 			//fmt.Printf("got simple table, name %s\n", tableName)
 			dbFile, err := c.GetTable(tableName)
 			if err != nil {
-				return nil, nil, nil, err
+				return nil, nil, nil, nil, err
 			}
 			table := LogicalTableNode{tableName,
 				strings.ToLower(sqlparser.String(tableEx.As)),
@@ -352,47 +612,244 @@ func parseFrom(c *Catalog, t sqlparser.TableExpr) ([]*LogicalTableNode, []*Logic
 			table.alias = strings.ToLower(sqlparser.String(tableEx.As))
 			tables := make([]*LogicalTableNode, 1)
 			tables[0] = &table
-			return tables, nil, nil, nil
+			return tables, nil, nil, nil, nil
 		}
 	case *sqlparser.ParenTableExpr:
 		var (
 			tables   []*LogicalTableNode
 			subplans []*LogicalPlan
 			joins    []*LogicalJoinNode
+			filters  []*LogicalFilterNode
 		)
 		for _, e := range tableEx.Exprs {
-			newTables, newSubplans, newJoins, err := parseFrom(c, e)
+			newTables, newSubplans, newJoins, newFilters, err := parseFrom(c, e)
 			if err != nil {
-				return nil, nil, nil, err
+				return nil, nil, nil, nil, err
 			}
 			tables = append(tables, newTables...)
 			subplans = append(subplans, newSubplans...)
 			joins = append(joins, newJoins...)
+			filters = append(filters, newFilters...)
 		}
-		return tables, subplans, joins, nil
+		return tables, subplans, joins, filters, nil
 	case *sqlparser.JoinTableExpr:
 		joinTable, _ := t.(*sqlparser.JoinTableExpr)
-		leftTables, leftSubplans, leftJoins, err := parseFrom(c, joinTable.LeftExpr)
+		leftTables, leftSubplans, leftJoins, leftFilters, err := parseFrom(c, joinTable.LeftExpr)
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, nil, err
 		}
-		rightTables, rightSubplans, rightJoins, err := parseFrom(c, joinTable.RightExpr)
+		rightTables, rightSubplans, rightJoins, rightFilters, err := parseFrom(c, joinTable.RightExpr)
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, nil, err
+		}
+		joinType := InnerJoin
+		switch joinTable.Join {
+		case sqlparser.JoinStr:
+		case sqlparser.LeftJoinStr:
+			joinType = LeftOuterJoin
+		case sqlparser.RightJoinStr:
+			joinType = RightOuterJoin
+		default:
+			return nil, nil, nil, nil, ailikeError{ParseError, fmt.Sprintf("unsupported join type %s", joinTable.Join)}
+		}
+		// the inner side of an outer join, whose fields are NULL when nothing matches
+		innerTables, innerSubplans, innerJoins := rightTables, rightSubplans, rightJoins
+		if joinType == RightOuterJoin {
+			innerTables, innerSubplans, innerJoins = leftTables, leftSubplans, leftJoins
 		}
-		if joinTable.Join != "join" {
-			return nil, nil, nil, ailikeError{ParseError, fmt.Sprintf("unsupported join type %s", joinTable.Join)}
+		if joinType != InnerJoin && (len(innerTables)+len(innerSubplans) != 1 || len(innerJoins) != 0) {
+			return nil, nil, nil, nil, ailikeError{ParseError, "the inner side of an outer join must be a single table or subquery"}
 		}
 		tabList := append(leftTables, rightTables...)
 		subPlanList := append(leftSubplans, rightSubplans...)
-		_, joins, err := parseWhere(c, subPlanList, tabList, joinTable.Condition.On)
+		// for an inner join, any other conditions are the same as filters in the where clause
+		filters, joins, err := parseWhere(c, subPlanList, tabList, joinTable.Condition.On)
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, nil, err
+		}
+		if joinType != InnerJoin {
+			// an outer join's condition decides which records are padded with NULLs,
+			// rather than filtering the result, so only equalities are supported
+			if len(joins) == 0 || len(filters) != 0 {
+				return nil, nil, nil, nil, ailikeError{ParseError, "an outer join must be on equalities between the joined tables"}
+			}
+			for _, j := range joins {
+				tabName, _, err := j.left.getTableField(c, subPlanList, tabList)
+				if err != nil {
+					return nil, nil, nil, nil, err
+				}
+				if !fromContains(tabName, leftTables, leftSubplans) {
+					j.left, j.right = j.right, j.left
+				}
+				j.joinType = joinType
+			}
+		}
+		return tabList, subPlanList, append(leftJoins, append(rightJoins, joins...)...), append(leftFilters, append(rightFilters, filters...)...), nil
+
+	}
+	return nil, nil, nil, nil, ailikeError{ParseError, "unknown query type in parseFrom"}
+}
+
+// Returns true if tabName is the name of one of the tables or subqueries; a
+// table with an alias is only known by its alias.
+func fromContains(tabName string, tables []*LogicalTableNode, subplans []*LogicalPlan) bool {
+	for _, t := range tables {
+		if t.alias == tabName || (t.alias == "" && t.tableName == tabName) {
+			return true
+		}
+	}
+	for _, sp := range subplans {
+		if sp.alias == tabName {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if field refers to a table or subquery in the FROM clause of p.
+func (p *LogicalPlan) inScope(c *Catalog, field *LogicalSelectNode) bool {
+	if field.table != "" {
+		return fromContains(field.table, p.tables, p.subqueries)
+	}
+	tabName, _, err := field.getTableField(c, p.subqueries, p.tables)
+	return err != nil || tabName != ""
+}
+
+// Finds the references of a subquery to fields of the enclosing query, which are
+// the fields that are not in scope of its FROM clause, and replaces them with
+// parameters.  A join condition with such a field becomes a filter on the
+// subquery's tables.
+func (p *LogicalPlan) bindOuterRefs(c *Catalog) {
+	var joins []*LogicalJoinNode
+	for _, j := range p.joins {
+		correlated := false
+		for _, f := range append(j.left.referencedFields(), j.right.referencedFields()...) {
+			correlated = correlated || !p.inScope(c, f)
+		}
+		if !correlated || j.joinType != InnerJoin {
+			joins = append(joins, j)
+			continue
+		}
+		pred := NewPredSelectNode(sqlparser.EqualStr, []*LogicalSelectNode{j.left, j.right})
+		p.filters = append(p.filters, &LogicalFilterNode{&pred})
+	}
+	p.joins = joins
+	for _, f := range p.filters {
+		p.bindOuterFields(c, f.pred)
+	}
+	for _, sel := range p.selects {
+		p.bindOuterFields(c, sel)
+	}
+}
+
+// Replaces the fields of node that are not in scope of p with parameters.
+func (p *LogicalPlan) bindOuterFields(c *Catalog, node *LogicalSelectNode) {
+	switch node.exprType {
+	case ExprField:
+		if node.field == "*" || p.inScope(c, node) {
+			return
+		}
+		field := *node
+		param := &paramExpr{}
+		p.outerRefs = append(p.outerRefs, &outerRef{&field, param})
+		node.exprType, node.param = ExprParam, param
+	case ExprSubquery:
+		// a nested subquery may refer to a query enclosing this one
+		for _, r := range node.subquery.outerRefs {
+			p.bindOuterFields(c, r.field)
+		}
+	default:
+		for _, arg := range node.args {
+			p.bindOuterFields(c, arg)
+		}
+	}
+}
+
+// Returns true if the expression refers to fields of an enclosing query.
+func (lsn *LogicalSelectNode) hasParams() bool {
+	switch lsn.exprType {
+	case ExprParam:
+		return true
+	case ExprSubquery:
+		for _, r := range lsn.subquery.outerRefs {
+			if r.field.hasParams() {
+				return true
+			}
+		}
+		return false
+	}
+	for _, arg := range lsn.args {
+		if arg.hasParams() {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the field of the enclosing query and the expression of the subquery
+// that a filter of the subquery p equates, or nils if the filter is not such an
+// equality.
+func (p *LogicalPlan) correlation(pred *LogicalSelectNode) (*LogicalSelectNode, *LogicalSelectNode) {
+	if pred.exprType != ExprPred || *pred.funcOp != sqlparser.EqualStr {
+		return nil, nil
+	}
+	for i, arg := range pred.args {
+		other := pred.args[1-i]
+		if arg.exprType != ExprParam || other.hasParams() {
+			continue
+		}
+		for _, r := range p.outerRefs {
+			if r.param == arg.param {
+				return r.field, other
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Returns the plans of the subqueries evaluated as expressions of nodes.
+func subqueryPlans(nodes ...*LogicalSelectNode) []*subqueryPlan {
+	var plans []*subqueryPlan
+	for _, n := range nodes {
+		if n == nil {
+			continue
+		}
+		if n.exprType == ExprSubquery && n.subquery.physical != nil {
+			plans = append(plans, n.subquery.physical)
 		}
-		return tabList, subPlanList, append(leftJoins, append(rightJoins, joins...)...), nil
+		plans = append(plans, subqueryPlans(n.args...)...)
+	}
+	return plans
+}
+
+// Returns the plans of the subqueries evaluated as expressions of p.
+func (p *LogicalPlan) subqueryPlans() []*subqueryPlan {
+	nodes := append([]*LogicalSelectNode{p.having, p.limit}, p.selects...)
+	for _, f := range p.filters {
+		nodes = append(nodes, f.pred)
+	}
+	for _, j := range p.joins {
+		nodes = append(nodes, j.left, j.right)
+	}
+	for _, gby := range p.groupByFields {
+		nodes = append(nodes, gby.expr)
+	}
+	for _, oby := range p.orderByFields {
+		nodes = append(nodes, oby.expr)
+	}
+	return subqueryPlans(nodes...)
+}
 
+// Returns the number of workers a parallel plan of p should use to read scan,
+// or 1 if p should not run in parallel.  Plans with subqueries evaluated as
+// expressions run serially, since their workers would share the state of the
+// subqueries, as do correlated subqueries, which run once for each record of
+// the enclosing query, and DISTINCT queries.
+func (p *LogicalPlan) parallelWorkers(c *Catalog, scan Operator) int {
+	if p.distinct || len(p.outerRefs) > 0 || len(p.subqueryPlans()) > 0 {
+		return 1
 	}
-	return nil, nil, nil, ailikeError{ParseError, "unknown query type in parseFrom"}
+	return parallelWorkers(scan, c.maxParallelWorkers)
 }
 
 func isAgg(funcName string) bool {
@@ -405,8 +862,145 @@ func isAgg(funcName string) bool {
 	return false
 }
 
+// Parses a subquery in an expression, whose references to fields of the
+// enclosing query become parameters.
+func parseSubquery(c *Catalog, sq *sqlparser.Subquery) (*LogicalPlan, error) {
+	stmt := sq.Select
+	for {
+		paren, ok := stmt.(*sqlparser.ParenSelect)
+		if !ok {
+			break
+		}
+		stmt = paren.Select
+	}
+	sel, ok := stmt.(*sqlparser.Select)
+	if !ok {
+		return nil, ailikeError{ParseError, fmt.Sprintf("unsupported subquery %s", sqlparser.String(sq))}
+	}
+	subplan, err := parseStatement(c, sel)
+	if err != nil {
+		return nil, err
+	}
+	subplan.bindOuterRefs(c)
+	return subplan, nil
+}
+
+// Parses a SELECT, which may be a set operation over several SELECTs.
+func parseSelectStatement(c *Catalog, stmt sqlparser.SelectStatement) (*LogicalPlan, error) {
+	switch stmt := stmt.(type) {
+	case *sqlparser.Select:
+		return parseStatement(c, stmt)
+	case *sqlparser.ParenSelect:
+		return parseSelectStatement(c, stmt.Select)
+	case *sqlparser.Union:
+		return parseSetOperation(c, stmt)
+	}
+	return nil, ailikeError{ParseError, fmt.Sprintf("unsupported select statement %s", sqlparser.String(stmt))}
+}
+
+// Parses a set operation.  Its ORDER BY and LIMIT apply to the combined results,
+// and can only refer to the fields of the result.
+func parseSetOperation(c *Catalog, u *sqlparser.Union) (*LogicalPlan, error) {
+	op, all, ok := setOperationOf(u.Type)
+	if !ok {
+		return nil, ailikeError{ParseError, fmt.Sprintf("unsupported set operation %s", u.Type)}
+	}
+	left, err := parseSelectStatement(c, u.Left)
+	if err != nil {
+		return nil, err
+	}
+	right, err := parseSelectStatement(c, u.Right)
+	if err != nil {
+		return nil, err
+	}
+	plan := &LogicalPlan{setOp: &logicalSetOp{op, all, left, right}}
+	for _, oby := range u.OrderBy {
+		expr, err := parseExpr(c, oby.Expr, "")
+		if err != nil {
+			return nil, err
+		}
+		plan.orderByFields = append(plan.orderByFields, &OrderByNode{expr, oby.Direction == sqlparser.AscScr})
+	}
+	if plan.limit, plan.offset, err = parseLimit(c, u.Limit); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// Parses LIMIT n [OFFSET m], returning nil if there is no limit.  An offset must
+// be a constant, as must the limit when there is an offset, since the records of
+// both are needed from the operators below the limit.
+func parseLimit(c *Catalog, lim *sqlparser.Limit) (*LogicalSelectNode, *LogicalSelectNode, error) {
+	if lim == nil {
+		return nil, nil, nil
+	}
+	limit, err := parseExpr(c, lim.Rowcount, "")
+	if err != nil || lim.Offset == nil {
+		return limit, nil, err
+	}
+	offset, err := parseExpr(c, lim.Offset, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, n := range []*LogicalSelectNode{limit, offset} {
+		if v, err := strconv.Atoi(n.value); n.exprType != ExprConst || err != nil || v < 0 {
+			return nil, nil, ailikeError{ParseError, "LIMIT and OFFSET must be non-negative integers"}
+		}
+	}
+	return limit, offset, nil
+}
+
+// Returns the number of records that the operators below the limit need to
+// produce, which is the limit plus the offset.
+func (p *LogicalPlan) window() *LogicalSelectNode {
+	if p.offset == nil {
+		return p.limit
+	}
+	limit, _ := strconv.Atoi(p.limit.value)
+	offset, _ := strconv.Atoi(p.offset.value)
+	window := NewConstSelectNode(strconv.Itoa(limit+offset), "")
+	return &window
+}
+
+// Returns the limit of the plan, which skips the records before the offset.
+func (p *LogicalPlan) makeLimit(c *Catalog, child Operator, tableMap map[string]*PlanNode) (Operator, error) {
+	limit, _, err := p.limit.generateExpr(c, child.Descriptor(), tableMap)
+	if err != nil {
+		return nil, err
+	}
+	op := NewLimitOp(limit, child)
+	if p.offset != nil {
+		offset, _, err := p.offset.generateExpr(c, child.Descriptor(), tableMap)
+		if err != nil {
+			return nil, err
+		}
+		op.SetOffset(offset)
+	}
+	return op, nil
+}
+
+// Returns the set operation named by the type of a union, as set by labelSetOperations.
+func setOperationOf(unionType string) (SetOperation, bool, bool) {
+	for op, name := range setOperationNames {
+		switch unionType {
+		case name, name + " distinct":
+			return op, false, true
+		case name + " all":
+			return op, true, true
+		}
+	}
+	return Union, false, false
+}
+
 func parseExpr(c *Catalog, expr sqlparser.Expr, alias string) (*LogicalSelectNode, error) {
 	switch expr := expr.(type) {
+	case *sqlparser.Subquery:
+		subplan, err := parseSubquery(c, expr)
+		if err != nil {
+			return nil, err
+		}
+		node := NewSubquerySelectNode(subplan, alias)
+		return &node, nil
 	case *sqlparser.FuncExpr:
 		funName := strings.ToLower(sqlparser.String(expr.Name))
 		if isAgg(funName) {
@@ -493,6 +1087,9 @@ func parseExpr(c *Catalog, expr sqlparser.Expr, alias string) (*LogicalSelectNod
 		exprList[1] = right
 		outer := NewFuncSelectNode("ailike_cos", exprList, alias)
 		return &outer, nil
+	case *sqlparser.MatchExpr:
+		// MATCH(col) AGAINST('query') is a BM25 score over the column's text index
+		return parseMatch(c, expr, "bm25", alias)
 	case *sqlparser.ParenExpr:
 		return parseExpr(c, expr.Expr, alias)
 	case *sqlparser.ColName:
@@ -513,6 +1110,16 @@ func parseExpr(c *Catalog, expr sqlparser.Expr, alias string) (*LogicalSelectNod
 		}
 		field := NewConstSelectNode(str, alias)
 		return &field, nil
+	case *sqlparser.NullVal:
+		field := NewNullSelectNode(alias)
+		return &field, nil
+	case *sqlparser.UnaryExpr:
+		// the parser only folds the sign into integer literals, e.g. -1.5 is a unary minus
+		if val, ok := expr.Expr.(*sqlparser.SQLVal); ok && expr.Operator == sqlparser.UMinusStr && val.Type == sqlparser.FloatVal {
+			field := NewConstSelectNode("-"+string(val.Val), alias)
+			return &field, nil
+		}
+		return nil, ailikeError{ParseError, fmt.Sprintf("unsupported unary operator %s", expr.Operator)}
 	default:
 		return nil, ailikeError{ParseError, fmt.Sprintf("unsupported expression type %s in select list", reflect.TypeOf(expr))}
 	}
@@ -540,7 +1147,7 @@ func extractAggs(s *LogicalSelectNode) []*LogicalSelectNode {
 	switch s.exprType {
 	case ExprAggr:
 		return []*LogicalSelectNode{s}
-	case ExprFunc:
+	case ExprFunc, ExprPred:
 		var aggs []*LogicalSelectNode
 		for _, subs := range s.args {
 			aggs = append(aggs, extractAggs(subs)...)
@@ -564,13 +1171,14 @@ func parseStatement(c *Catalog, s *sqlparser.Select) (*LogicalPlan, error) {
 	)
 
 	for _, t := range from {
-		newTables, newSubplans, newJoins, err := parseFrom(c, t)
+		newTables, newSubplans, newJoins, newFilters, err := parseFrom(c, t)
 		if err != nil {
 			return nil, err
 		}
 		tables = append(tables, newTables...)
 		subplans = append(subplans, newSubplans...)
 		joins = append(joins, newJoins...)
+		filters = append(filters, newFilters...)
 	}
 	where := s.Where
 	if where != nil {
@@ -608,26 +1216,31 @@ func parseStatement(c *Catalog, s *sqlparser.Select) (*LogicalPlan, error) {
 		groupBys = append(groupBys, &GroupBy{expr})
 	}
 
-	for _, oby := range s.OrderBy {
-		expr, err := parseExpr(c, oby.Expr, "")
+	var having *LogicalSelectNode
+	if s.Having != nil {
+		var err error
+		having, err = parsePredicate(c, s.Having.Expr)
 		if err != nil {
 			return nil, err
 		}
-		orderBys = append(orderBys, &OrderByNode{expr, oby.Direction == sqlparser.AscScr})
-
+		aggs = append(aggs, extractAggs(having)...)
 	}
 
-	lim := s.Limit
-	var limExpr *LogicalSelectNode
-	if lim != nil {
-		var err error
-		limExpr, err = parseExpr(c, lim.Rowcount, "")
+	for _, oby := range s.OrderBy {
+		expr, err := parseExpr(c, oby.Expr, "")
 		if err != nil {
 			return nil, err
 		}
+		orderBys = append(orderBys, &OrderByNode{expr, oby.Direction == sqlparser.AscScr})
+		aggs = append(aggs, extractAggs(expr)...)
+	}
+
+	limExpr, offset, err := parseLimit(c, s.Limit)
+	if err != nil {
+		return nil, err
 	}
 
-	p := LogicalPlan{filters, joins, selects, aggs, tables, subplans, groupBys, orderBys, limExpr, s.Distinct != "", ""}
+	p := LogicalPlan{filters, joins, selects, aggs, tables, subplans, groupBys, having, orderBys, limExpr, offset, s.Distinct != "", "", nil, nil, nil, nil}
 
 	return &p, nil
 }
@@ -755,20 +1368,84 @@ func (s *LogicalSelectNode) generateExpr(c *Catalog, inputDesc *TupleDesc, table
 		}
 		ce := ConstExpr{fval, constType}
 		return &ce, fieldName, nil
-	case ExprFunc:
-
-		fieldName := *s.funcOp
-		isAilikeNode := false
-
-		if fieldName == "ailike" || fieldName == "ailike_cos" {
-			isAilikeNode = true
+	case ExprNull:
+		fieldName := "null"
+		if s.alias != "" {
+			fieldName = s.alias
 		}
+		return &ConstExpr{nil, UnknownType}, fieldName, nil
+	case ExprParam:
+		fieldName := s.field
 		if s.alias != "" {
 			fieldName = s.alias
 		}
-		exprs := make([]*Expr, len(s.args))
-		for i, lsn := range s.args {
-			newExpr, _, err := lsn.generateExpr(c, inputDesc, tableMap)
+		return s.param, fieldName, nil
+	case ExprSubquery:
+		fieldName := "subquery"
+		if s.alias != "" {
+			fieldName = s.alias
+		}
+		plan, outer, err := s.planSubquery(c, inputDesc, tableMap)
+		if err != nil {
+			return nil, "", err
+		}
+		e, err := newScalarSubqueryExpr(plan, outer)
+		return e, fieldName, err
+	case ExprPred:
+		fieldName := *s.funcOp
+		if s.alias != "" {
+			fieldName = s.alias
+		}
+		if s.cachedField != nil {
+			// already computed by an operator below, e.g. a group by
+			return &FieldExpr{*s.cachedField}, fieldName, nil
+		}
+		pred, err := s.generatePredicate(c, inputDesc, tableMap)
+		if err != nil {
+			return nil, "", err
+		}
+		return pred, fieldName, nil
+	case ExprFunc:
+
+		fieldName := *s.funcOp
+		if s.alias != "" {
+			fieldName = s.alias
+		}
+		if s.cachedField != nil {
+			// already computed by an operator below, e.g. rrf()
+			return &FieldExpr{*s.cachedField}, fieldName, nil
+		}
+		if *s.funcOp == "bm25" || *s.funcOp == "text_match" {
+			e, err := s.generateBM25Expr(c, inputDesc, tableMap)
+			return e, fieldName, err
+		}
+		if *s.funcOp == "rid" {
+			if len(s.args) != 0 {
+				return nil, "", ailikeError{ParseError, "rid expects no arguments"}
+			}
+			return &RidExpr{}, fieldName, nil
+		}
+		isAilikeNode := false
+
+		if *s.funcOp == "ailike" || *s.funcOp == "ailike_cos" {
+			isAilikeNode = true
+			e, err := s.generateMultiVectorExpr(c, inputDesc, tableMap)
+			if e != nil || err != nil {
+				return e, fieldName, err
+			}
+		}
+		exprs := make([]*Expr, len(s.args))
+		for i, lsn := range s.args {
+			var newExpr Expr
+			var err error
+			if isAilikeNode && isWeightedQuery(lsn) {
+				// a weighted sum of examples is composed into a single query embedding
+				var composed EmbeddedStringField
+				composed, err = composeWeightedQuery(lsn)
+				newExpr = &ConstExpr{composed, EmbeddedStringType}
+			} else {
+				newExpr, _, err = lsn.generateExpr(c, inputDesc, tableMap)
+			}
 			if isAilikeNode {
 				if lsn.exprType == ExprConst {
 					_, e := strconv.Atoi(lsn.value)
@@ -791,14 +1468,232 @@ func (s *LogicalSelectNode) generateExpr(c *Catalog, inputDesc *TupleDesc, table
 			exprs[i] = &newExpr
 		}
 
-		fe := FuncExpr{*s.funcOp, exprs}
+		fe := FuncExpr{op: *s.funcOp, args: exprs}
 		return &fe, fieldName, nil
 	}
 	return nil, "", ailikeError{ParseError, "unhandled expression type in select list"}
 
 }
 
-const JoinBufferSize int = 10000000
+// Plans the subquery of the node, and returns the plan along with the expressions
+// over inputDesc that its parameters are set to.  The subquery is only planned
+// once, however many times the node is generated.
+func (s *LogicalSelectNode) planSubquery(c *Catalog, inputDesc *TupleDesc, tableMap map[string]*PlanNode) (*subqueryPlan, []Expr, error) {
+	sub := s.subquery
+	outer := make([]Expr, len(sub.outerRefs))
+	for i, r := range sub.outerRefs {
+		e, _, err := r.field.generateExpr(c, inputDesc, tableMap)
+		if err != nil {
+			return nil, nil, err
+		}
+		outer[i] = e
+		r.param.field = e.GetExprType()
+	}
+	if sub.physical == nil {
+		op, err := makePhysicalPlan(c, sub)
+		if err != nil {
+			return nil, nil, err
+		}
+		params := make([]*paramExpr, len(sub.outerRefs))
+		for i, r := range sub.outerRefs {
+			params[i] = r.param
+		}
+		sub.physical = &subqueryPlan{op: op, params: params}
+	}
+	return sub.physical, outer, nil
+}
+
+// Parses MATCH(col) AGAINST('query') as a call of op, which is bm25 for the
+// score of each row, or text_match for whether it matches at all.
+func parseMatch(c *Catalog, expr *sqlparser.MatchExpr, op string, alias string) (*LogicalSelectNode, error) {
+	if len(expr.Columns) != 1 {
+		return nil, ailikeError{ParseError, "MATCH expects exactly one column"}
+	}
+	col, err := parseSelect(c, expr.Columns[0])
+	if err != nil {
+		return nil, err
+	}
+	query, err := parseExpr(c, expr.Expr, "")
+	if err != nil {
+		return nil, err
+	}
+	outer := NewFuncSelectNode(op, []*LogicalSelectNode{col, query}, alias)
+	return &outer, nil
+}
+
+// Generate the expression for bm25(col, 'query'), or text_match(col, 'query'),
+// which require a text index on col.
+func (s *LogicalSelectNode) generateBM25Expr(c *Catalog, inputDesc *TupleDesc, tableMap map[string]*PlanNode) (Expr, error) {
+	if len(s.args) != 2 || s.args[0].exprType != ExprField || s.args[1].exprType != ExprConst {
+		return nil, ailikeError{ParseError, "bm25 expects a column and a string literal"}
+	}
+	colExpr, _, err := s.args[0].generateExpr(c, inputDesc, tableMap)
+	if err != nil {
+		return nil, err
+	}
+	fieldExpr, ok := colExpr.(*FieldExpr)
+	if !ok {
+		return nil, ailikeError{ParseError, "bm25 expects a column and a string literal"}
+	}
+	index, err := textIndexForField(fieldExpr.selectField, c)
+	if err != nil {
+		return nil, err
+	}
+	if index == nil {
+		return nil, ailikeError{NoSuchTableError, fmt.Sprintf("no text index on column '%s'", fieldExpr.selectField.Fname)}
+	}
+	// corpus statistics are needed to score each tuple, so read them now if
+	// no earlier query has
+	if !index.isLoaded() {
+		tid := c.bp.Transactions().Begin()
+		err = index.load(tid)
+		tid.Commit()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if *s.funcOp == "text_match" {
+		return NewTextMatchExpr(fieldExpr, s.args[1].value, index), nil
+	}
+	return NewBM25Expr(fieldExpr, s.args[1].value, index), nil
+}
+
+// Returns the embedding of a string literal used as an AILIKE query.
+func embedQueryLiteral(value string) (EmbeddedStringField, error) {
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return EmbeddedStringField{}, ailikeError{TypeMismatchError, "Cannot perform an AILIKE op with numeric literals."}
+	}
+	embResp, err := generateEmbeddings(value)
+	if err != nil || embResp == nil {
+		return EmbeddedStringField{}, ailikeError{FailedEmbedding, "Failed to produce a vector embedding."}
+	}
+	return EmbeddedStringField{Value: value, Emb: embResp.Embedding}, nil
+}
+
+// Generate the expression for col AILIKE ANY('a', ...) or col AILIKE ALL('a', ...).
+// Returns a nil expression if neither argument of the ailike node is ANY or ALL.
+func (s *LogicalSelectNode) generateMultiVectorExpr(c *Catalog, inputDesc *TupleDesc, tableMap map[string]*PlanNode) (Expr, error) {
+	for i, lsn := range s.args {
+		if lsn.exprType != ExprFunc || (*lsn.funcOp != "any" && *lsn.funcOp != "all") {
+			continue
+		}
+		if *s.funcOp != "ailike" || len(s.args) != 2 {
+			return nil, ailikeError{ParseError, fmt.Sprintf("%s can only be used with AILIKE", strings.ToUpper(*lsn.funcOp))}
+		}
+		colExpr, _, err := s.args[1-i].generateExpr(c, inputDesc, tableMap)
+		if err != nil {
+			return nil, err
+		}
+		fieldExpr, ok := colExpr.(*FieldExpr)
+		if !ok || fieldExpr.selectField.Ftype != EmbeddedStringType {
+			return nil, ailikeError{TypeMismatchError, fmt.Sprintf("AILIKE %s expects an embedded text column", strings.ToUpper(*lsn.funcOp))}
+		}
+		if len(lsn.args) == 0 {
+			return nil, ailikeError{ParseError, fmt.Sprintf("AILIKE %s expects at least one string literal", strings.ToUpper(*lsn.funcOp))}
+		}
+		queries := make([]EmbeddedStringField, len(lsn.args))
+		for j, arg := range lsn.args {
+			if arg.exprType != ExprConst {
+				return nil, ailikeError{ParseError, fmt.Sprintf("AILIKE %s expects string literals", strings.ToUpper(*lsn.funcOp))}
+			}
+			queries[j], err = embedQueryLiteral(arg.value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return NewMultiVectorExpr(fieldExpr, queries, *lsn.funcOp == "all"), nil
+	}
+	return nil, nil
+}
+
+// Returns true if the node is a sum of weighted string literals, such as 0.7*'a' + 0.3*'b' - 0.2*'c'.
+func isWeightedQuery(lsn *LogicalSelectNode) bool {
+	return lsn.exprType == ExprFunc && (*lsn.funcOp == "+" || *lsn.funcOp == "-" || *lsn.funcOp == "*")
+}
+
+type weightedQueryTerm struct {
+	value  string
+	weight float64
+}
+
+// Flattens a sum of weighted string literals into its terms, scaling each by weight.
+func weightedQueryTerms(lsn *LogicalSelectNode, weight float64, terms []weightedQueryTerm) ([]weightedQueryTerm, error) {
+	switch lsn.exprType {
+	case ExprConst:
+		if _, err := strconv.ParseFloat(lsn.value, 64); err == nil {
+			return nil, ailikeError{ParseError, fmt.Sprintf("weight %s must multiply a string literal", lsn.value)}
+		}
+		return append(terms, weightedQueryTerm{lsn.value, weight}), nil
+	case ExprFunc:
+		if len(lsn.args) != 2 {
+			break
+		}
+		left, right := lsn.args[0], lsn.args[1]
+		switch *lsn.funcOp {
+		case "+", "-":
+			terms, err := weightedQueryTerms(left, weight, terms)
+			if err != nil {
+				return nil, err
+			}
+			if *lsn.funcOp == "-" {
+				weight = -weight
+			}
+			return weightedQueryTerms(right, weight, terms)
+		case "*":
+			if _, err := strconv.ParseFloat(left.value, 64); err != nil || left.exprType != ExprConst {
+				left, right = right, left
+			}
+			if left.exprType == ExprConst {
+				if w, err := strconv.ParseFloat(left.value, 64); err == nil {
+					return weightedQueryTerms(right, weight*w, terms)
+				}
+			}
+			return nil, ailikeError{ParseError, "a weighted AILIKE query must multiply each string literal by a number"}
+		}
+	}
+	return nil, ailikeError{ParseError, "a weighted AILIKE query may only add, subtract, and scale string literals"}
+}
+
+// Composes a weighted sum of string literals into a single query embedding.
+func composeWeightedQuery(lsn *LogicalSelectNode) (EmbeddedStringField, error) {
+	terms, err := weightedQueryTerms(lsn, 1, nil)
+	if err != nil {
+		return EmbeddedStringField{}, err
+	}
+	var value string
+	var emb EmbeddingType
+	for i, term := range terms {
+		q, err := embedQueryLiteral(term.value)
+		if err != nil {
+			return EmbeddedStringField{}, err
+		}
+		if emb == nil {
+			emb = make(EmbeddingType, len(q.Emb))
+		}
+		if len(q.Emb) != len(emb) {
+			return EmbeddedStringField{}, ailikeError{FailedEmbedding, "query embeddings have different dimensions"}
+		}
+		for j := range emb {
+			emb[j] += term.weight * q.Emb[j]
+		}
+		sign, weight := " + ", term.weight
+		if weight < 0 {
+			sign, weight = " - ", -weight
+		}
+		if i == 0 {
+			sign = ""
+			if term.weight < 0 {
+				sign = "-"
+			}
+		}
+		value += fmt.Sprintf("%s%v*'%s'", sign, weight, term.value)
+	}
+	return EmbeddedStringField{Value: value, Emb: emb}, nil
+}
+
+// JoinBufferSize is the number of records that a join planned by the parser
+// hashes in memory at a time; joins of larger inputs partition them to disk.
+var JoinBufferSize = 10000000
 
 func exprToStr(e Expr) string {
 	switch ex := e.(type) {
@@ -809,6 +1704,9 @@ func exprToStr(e Expr) string {
 		}
 		return fmt.Sprintf("%s%s", tbl, ex.selectField.Fname)
 	case *ConstExpr:
+		if ex.val == nil {
+			return "NULL"
+		}
 		if ex.constType == EmbeddedStringType {
 			// For EmbeddedStringFields, printing the entire vector makes the query plan hard to read
 			// so we just print the first element.
@@ -822,6 +1720,36 @@ func exprToStr(e Expr) string {
 			argStr += fmt.Sprintf("%s,", exprToStr(*arg))
 		}
 		return fmt.Sprintf("%s(%s)", ex.op, argStr)
+	case *RidExpr:
+		return "rid()"
+	case *compositeKeyExpr:
+		strs := make([]string, len(ex.exprs))
+		for i, e := range ex.exprs {
+			strs[i] = exprToStr(e)
+		}
+		return fmt.Sprintf("(%s)", strings.Join(strs, ","))
+	case *scalarSubqueryExpr:
+		return "(subquery)"
+	case *paramExpr:
+		// a field of the enclosing query
+		return "$" + exprToStr(&FieldExpr{ex.field})
+	case *BM25Expr:
+		if ex.matchOnly {
+			return fmt.Sprintf("text_match(%s,%s)", exprToStr(ex.field), ex.query)
+		}
+		return fmt.Sprintf("bm25(%s,%s)", exprToStr(ex.field), ex.query)
+	case *MultiVectorExpr:
+		quantifier := "any"
+		if ex.all {
+			quantifier = "all"
+		}
+		queries := make([]string, len(ex.queries))
+		for i, q := range ex.queries {
+			queries[i] = q.Value
+		}
+		return fmt.Sprintf("ailike(%s,%s(%s))", exprToStr(ex.field), quantifier, strings.Join(queries, ","))
+	case PredicateExpr:
+		return predicateToStr(ex)
 	default:
 		return fmt.Sprintf("%+v, ", e)
 	}
@@ -875,51 +1803,77 @@ func getStrFromObj(obj any) string {
 	return fmt.Sprintf("%v", obj)
 }
 
-func PrintPhysicalPlan(o Operator, indent string) {
+// Returns a description of a join of the given type on leftField == rightField.
+func joinLabel(joinType JoinType, leftField Expr, rightField Expr) string {
+	label := fmt.Sprintf("Join, %+v == %+v", exprToStr(leftField), exprToStr(rightField))
+	if joinType != InnerJoin {
+		label = fmt.Sprintf("%s (%s)", label, joinTypeNames[joinType])
+	}
+	return label
+}
+
+// Returns a one line description of a physical plan operator, without its inputs.
+func planLabel(o Operator) string {
 	switch op := o.(type) {
 	case *EqualityJoin[int64]:
-		fmt.Printf("%sJoin, %+v == %+v\n", indent, exprToStr(op.leftField), exprToStr(op.rightField))
-		indent = indent + "\t"
-		PrintPhysicalPlan(*op.left, indent)
-		PrintPhysicalPlan(*op.right, indent)
+		return joinLabel(op.joinType, op.leftField, op.rightField)
 	case *EqualityJoin[string]:
-		fmt.Printf("%sJoin, %+v == %+v\n", indent, exprToStr(op.leftField), exprToStr(op.rightField))
-		indent = indent + "\t"
-		PrintPhysicalPlan(*op.left, indent)
-		PrintPhysicalPlan(*op.right, indent)
-
+		return joinLabel(op.joinType, op.leftField, op.rightField)
+	case *GraceHashJoin:
+		label := joinLabel(op.joinType, joinKeyExpr(op.leftFields), joinKeyExpr(op.rightFields))
+		return fmt.Sprintf("Grace Hash %s, %d partitions", label, op.numPartitions)
+	case *SortMergeJoin:
+		return "Merge " + joinLabel(op.joinType, joinKeyExpr(op.leftFields), joinKeyExpr(op.rightFields))
 	case *Project:
 		selectStr := ""
 		for _, ex := range op.selectFields {
 			selectStr += exprToStr(ex) + ","
 		}
-		fmt.Printf("%sProject %+v -> %+v\n", indent, selectStr, op.outputNames)
-		indent = indent + "\t"
-		PrintPhysicalPlan(op.child, indent)
-	case *Filter[int64]:
-		fmt.Printf("%sFilter %s %s %s\n", indent, exprToStr(op.left), opToStr(op.op), exprToStr(op.right))
-		indent = indent + "\t"
-		PrintPhysicalPlan(op.child, indent)
-	case *Filter[string]:
-		fmt.Printf("%sFilter %s %s %s\n", indent, exprToStr(op.left), opToStr(op.op), exprToStr(op.right))
-		indent = indent + "\t"
-		PrintPhysicalPlan(op.child, indent)
+		return fmt.Sprintf("Project %+v -> %+v", selectStr, op.outputNames)
+	case *Filter:
+		return fmt.Sprintf("Filter %s", predicateToStr(op.pred))
 	case *HeapFile:
-		fmt.Printf("%sHeap Scan %v\n", indent, getStrFromObj(op))
+		return fmt.Sprintf("Heap Scan %v", getStrFromObj(op))
+	case *heapScanPartition:
+		return fmt.Sprintf("Parallel Heap Scan %v, partition: %d of %d", getStrFromObj(op.file), op.part+1, op.parts)
+	case *Gather:
+		return fmt.Sprintf("Gather, %d workers", len(op.children))
+	case *GatherMerge:
+		orderStr := ""
+		for _, ex := range op.orderBy {
+			orderStr += exprToStr(ex) + ","
+		}
+		return fmt.Sprintf("Gather Merge By %s %d workers", orderStr, len(op.children))
 	case *NNScan:
-		fmt.Printf("%sNN Index Scan %v\n", indent, op.PrettyPrint())
+		return fmt.Sprintf("NN Index Scan %v", op.PrettyPrint())
+	case *BM25Scan:
+		return fmt.Sprintf("BM25 Index Scan %v", op.PrettyPrint())
+	case *MultiNNScan:
+		return fmt.Sprintf("Multi-Query NN Index Scan %v", op.PrettyPrint())
+	case *MMR:
+		return fmt.Sprintf("Maximal Marginal Relevance, %s, lambda = %v, query: %s", exprToStr(op.field), op.lambda, op.query.Value)
+	case *RRFusion:
+		return fmt.Sprintf("Reciprocal Rank Fusion, k = %d", op.k)
+	case *SetOp:
+		name := strings.ToUpper(setOperationNames[op.op])
+		if op.all {
+			name += " ALL"
+		}
+		return fmt.Sprintf("Set Operation %s", name)
 	case *OrderBy:
 		orderStr := ""
 		for _, ex := range op.orderBy {
 			orderStr += exprToStr(ex) + ","
 		}
-		fmt.Printf("%sOrder By %s\n", indent, orderStr)
-		indent = indent + "\t"
-		PrintPhysicalPlan(op.child, indent)
+		if op.limit != nil {
+			return fmt.Sprintf("Top %s Order By %s", exprToStr(op.limit), orderStr)
+		}
+		return fmt.Sprintf("Order By %s", orderStr)
 	case *LimitOp:
-		fmt.Printf("%sLimit %s\n", indent, exprToStr(op.limitTups))
-		indent = indent + "\t"
-		PrintPhysicalPlan(op.child, indent)
+		if op.offset != nil {
+			return fmt.Sprintf("Limit %s Offset %s", exprToStr(op.limitTups), exprToStr(op.offset))
+		}
+		return fmt.Sprintf("Limit %s", exprToStr(op.limitTups))
 	case *Aggregator:
 		gbyStr := ""
 		if len(op.groupByFields) > 0 {
@@ -935,11 +1889,33 @@ func PrintPhysicalPlan(o Operator, indent string) {
 			aggStr += fmt.Sprintf("%s(%s),", reflect.TypeOf(ex), ex.GetTupleDesc().HeaderString(false))
 		}
 
-		fmt.Printf("%sAggregate, %s %s\n", indent, aggStr, gbyStr)
-		indent = indent + "\t"
-		PrintPhysicalPlan(op.child, indent)
-	default:
-		fmt.Printf("%sUnknown op, %s\n", indent, reflect.TypeOf(op))
+		return fmt.Sprintf("Aggregate, %s %s", aggStr, gbyStr)
+	case *AnalyzeOp:
+		return fmt.Sprintf("Analyze %s", op.table)
+	case *VacuumOp:
+		return fmt.Sprintf("Vacuum %s", strings.Join(op.tables, ", "))
+	case *InsertOp:
+		return "Insert"
+	case *DeleteOp:
+		return "Delete"
+	case *UpdateOp:
+		return "Update"
+	case *ValueOp:
+		return fmt.Sprintf("Values, %d rows", len(op.exprs))
+	case *SubqueryOp:
+		return fmt.Sprintf("Subqueries, %d", len(op.subqueries))
+	case *InstrumentedOp:
+		return planLabel(op.op)
+	}
+	return fmt.Sprintf("Unknown op, %s", reflect.TypeOf(o))
+}
+
+// Prints the physical plan rooted at o, with the estimated cost of each operator.
+func PrintPhysicalPlan(o Operator, indent string) {
+	est := EstimatePlanCost(o)
+	fmt.Printf("%s%s  (cost=%.1f rows=%.0f)\n", indent, planLabel(o), est.Cost, est.Rows)
+	for _, child := range planChildren(o) {
+		PrintPhysicalPlan(child, indent+"\t")
 	}
 }
 
@@ -979,146 +1955,726 @@ func _getArgsFromAilikeFunc(expr Expr, c *Catalog) (indexField *FieldExpr, query
 	return indexField, queryVector, nil
 }
 
-func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
-	//build mapping from table names / aliases to operators
+func isRankingFunc(funcName string) bool {
+	return funcName == "rrf" || funcName == "mmr"
+}
 
-	tableMap := make(map[string]*PlanNode)
-	for _, p := range plan.subqueries {
-		subPhysP, err := makePhysicalPlan(c, p)
-		if err != nil {
-			return nil, err
-		}
-		var td *TupleDesc = subPhysP.Descriptor()
-		td.setTableAlias(p.alias)
-		//td = td.setTableAlias(p.alias)
-		tableMap[p.alias] = &PlanNode{subPhysP, td}
+// Build a maximal marginal relevance ranking for mmr(col, 'query'[, lambda]).
+// The candidates are the rows most similar to the query, found with an NNScan
+// if col has a vector index; MMR then picks the query limit (or all candidates
+// if there is no limit) from them.
+func makeMMRPlan(c *Catalog, s *LogicalSelectNode, limit *LogicalSelectNode, topOp Operator, tableMap map[string]*PlanNode) (Operator, error) {
+	if len(s.args) < 2 || len(s.args) > 3 || s.args[0].exprType != ExprField || s.args[1].exprType != ExprConst {
+		return nil, ailikeError{ParseError, "mmr expects a column, a string literal, and optionally a lambda between 0 and 1"}
 	}
-	for _, t := range plan.tables {
-		name := t.tableName
-		if t.alias != "" {
-			name = t.alias
+	lambda := DefaultMMRLambda
+	if len(s.args) == 3 {
+		var err error
+		lambda, err = strconv.ParseFloat(s.args[2].value, 64)
+		if s.args[2].exprType != ExprConst || err != nil {
+			return nil, ailikeError{ParseError, "mmr lambda must be a number between 0 and 1"}
 		}
-		var td *TupleDesc = (*t.file).Descriptor()
-		td.setTableAlias(name)
-		//td = td.setTableAlias(name)
-		tableMap[name] = &PlanNode{*t.file, td}
 	}
+	colExpr, _, err := s.args[0].generateExpr(c, topOp.Descriptor(), tableMap)
+	if err != nil {
+		return nil, err
+	}
+	fieldExpr, ok := colExpr.(*FieldExpr)
+	if !ok || fieldExpr.selectField.Ftype != EmbeddedStringType {
+		return nil, ailikeError{TypeMismatchError, "mmr can only be applied to embedded text columns"}
+	}
+	embResp, err := generateEmbeddings(s.args[1].value)
+	if err != nil {
+		return nil, ailikeError{FailedEmbedding, "Failed to produce a vector embedding."}
+	}
+	query := EmbeddedStringField{Value: s.args[1].value, Emb: embResp.Embedding}
+	queryExpr := &ConstExpr{query, EmbeddedStringType}
 
-	//now apply each filter to appropriate table
-	for _, f := range plan.filters {
-		tabName, fieldName, err := f.fieldExpr.getTableField(c, plan.subqueries, plan.tables)
+	pool := MMRCandidatePool
+	var pickExpr Expr = nil
+	if limit != nil {
+		pickExpr, _, err = limit.generateExpr(c, topOp.Descriptor(), tableMap)
 		if err != nil {
 			return nil, err
 		}
-		node, err := fieldToOp(tabName, fieldName, tableMap)
+		limitVal, err := pickExpr.EvalExpr(nil)
 		if err != nil {
 			return nil, err
 		}
-		leftExpr, _, err := f.fieldExpr.generateExpr(c, node.desc, tableMap)
+		if limitInt, ok := limitVal.(IntField); ok && int(limitInt.Value) > pool {
+			pool = int(limitInt.Value)
+		}
+	}
+	poolExpr := &ConstExpr{IntField{int64(pool)}, IntType}
+	if pickExpr == nil {
+		pickExpr = poolExpr
+	}
+
+	var child Operator = topOp
+	heapFile, topOpIsHeapFile := (topOp).(*HeapFile)
+	exists, err := nnIndexExists(fieldExpr.selectField, c)
+	if err != nil {
+		return nil, err
+	}
+	if exists && topOpIsHeapFile {
+		child, err = NewNNScan(heapFile, poolExpr, fieldExpr.selectField, *queryExpr, true)
+		if err != nil {
+			return nil, ailikeError{ParseError, "Could not create NNScan"}
+		}
+	}
+	var left Expr = fieldExpr
+	var right Expr = queryExpr
+	sim := &FuncExpr{op: "ailike", args: []*Expr{&left, &right}}
+	orderBy, err := NewTopK([]Expr{sim}, child, []bool{true}, poolExpr)
+	if err != nil {
+		return nil, err
+	}
+	return NewMMR(NewLimitOp(poolExpr, orderBy), fieldExpr, query, lambda, pickExpr)
+}
+
+// Build a reciprocal rank fusion over the arguments of an rrf(...) select
+// expression. Each argument is ranked separately over topOp: with a BM25Scan or
+// NNScan when the argument can use an index, and otherwise by sorting topOp
+// (ascending for ailike distances, descending for any other score). Each input
+// contributes at most RRFCandidatePool tuples, or the query limit if that is larger.
+func makeRRFPlan(c *Catalog, s *LogicalSelectNode, limit *LogicalSelectNode, topOp Operator, tableMap map[string]*PlanNode) (Operator, error) {
+	if len(s.args) == 0 {
+		return nil, ailikeError{ParseError, "rrf expects at least one ranking expression"}
+	}
+	pool := RRFCandidatePool
+	if limit != nil {
+		limitExpr, _, err := limit.generateExpr(c, topOp.Descriptor(), tableMap)
 		if err != nil {
 			return nil, err
 		}
-		rightExpr, _, err := f.constExpr.generateExpr(c, node.desc, tableMap)
+		limitVal, err := limitExpr.EvalExpr(nil)
 		if err != nil {
 			return nil, err
 		}
+		if limitInt, ok := limitVal.(IntField); ok && int(limitInt.Value) > pool {
+			pool = int(limitInt.Value)
+		}
+	}
+	poolExpr := &ConstExpr{IntField{int64(pool)}, IntType}
 
-		op := node.op
-		desc := *op.Descriptor()
-		desc.setTableAlias(tabName)
-
-		switch leftExpr.GetExprType().Ftype {
-		case IntType:
-			newOp, err := NewIntFilter(rightExpr, f.predOp, leftExpr, op)
+	heapFile, topOpIsHeapFile := (topOp).(*HeapFile)
+	children := make([]Operator, len(s.args))
+	for i, arg := range s.args {
+		expr, _, err := arg.generateExpr(c, topOp.Descriptor(), tableMap)
+		if err != nil {
+			return nil, err
+		}
+		if bm25Expr, ok := expr.(*BM25Expr); ok && topOpIsHeapFile {
+			children[i], err = NewBM25Scan(heapFile, poolExpr, bm25Expr.field.selectField, bm25Expr.query)
 			if err != nil {
 				return nil, err
 			}
-			tableMap[leftExpr.GetExprType().TableQualifier] = &PlanNode{newOp, &desc}
-		case StringType:
-			newOp, err := NewStringFilter(rightExpr, f.predOp, leftExpr, op)
+			continue
+		}
+
+		var child Operator = topOp
+		ascending := false
+		if funcExpr, ok := expr.(*FuncExpr); ok && funcExpr.op == "ailike" {
+			ascending = true
+			indexField, queryVector, err := _getArgsFromAilikeFunc(expr, c)
 			if err != nil {
 				return nil, err
 			}
-			tableMap[leftExpr.GetExprType().TableQualifier] = &PlanNode{newOp, &desc}
-		default:
-			return nil, ailikeError{code: MalformedDataError, errString: "Don't allow for TextFields in expressions yet."}
+			if indexField != nil && queryVector != nil && topOpIsHeapFile {
+				child, err = NewNNScan(heapFile, poolExpr, indexField.selectField, *queryVector, true)
+				if err != nil {
+					return nil, ailikeError{ParseError, "Could not create NNScan"}
+				}
+			}
 		}
-	}
-	//finally apply joins
-	for _, j := range plan.joins {
-		lTabName, lFieldName, err := j.left.getTableField(c, plan.subqueries, plan.tables)
+		orderBy, err := NewTopK([]Expr{expr}, child, []bool{ascending}, poolExpr)
 		if err != nil {
 			return nil, err
 		}
+		children[i] = NewLimitOp(poolExpr, orderBy)
+	}
+	return NewRRFusion(children, RRFK)
+}
 
-		node1, err := fieldToOp(lTabName, lFieldName, tableMap)
-		if err != nil {
-			return nil, err
+// A join built from join conditions, along with the operators and tables it joins.
+type plannedJoin struct {
+	op         Operator
+	left       Operator
+	right      Operator
+	leftTable  string
+	rightTable string
+	conds      []*LogicalJoinNode // the join conditions that the join applies
+}
+
+// Returns true if every base table of the plan has statistics collected by ANALYZE.
+func allTablesAnalyzed(plan *LogicalPlan) bool {
+	if len(plan.subqueries) > 0 {
+		return false
+	}
+	for _, t := range plan.tables {
+		hf, ok := (*t.file).(*HeapFile)
+		if !ok || hf.stats == nil {
+			return false
 		}
+	}
+	return true
+}
+
+// Returns the operators currently in tableMap that produce the left and right
+// sides of the join condition j, along with the names of their tables.
+func joinInputs(c *Catalog, plan *LogicalPlan, j *LogicalJoinNode, tableMap map[string]*PlanNode) (*PlanNode, *PlanNode, string, string, error) {
+	lTabName, lFieldName, err := j.left.getTableField(c, plan.subqueries, plan.tables)
+	if err != nil {
+		return nil, nil, "", "", err
+	}
+
+	node1, err := fieldToOp(lTabName, lFieldName, tableMap)
+	if err != nil {
+		return nil, nil, "", "", err
+	}
+
+	rTabName, rFieldName, err := j.right.getTableField(c, plan.subqueries, plan.tables)
+	if err != nil {
+		return nil, nil, "", "", err
+	}
+
+	node2, err := fieldToOp(rTabName, rFieldName, tableMap)
+	if err != nil {
+		return nil, nil, "", "", err
+	}
+	return node1, node2, lTabName, rTabName, nil
+}
+
+// Builds the join operator for the join condition j over the operators currently
+// in tableMap.  The other conditions in remaining of the same type between the
+// same operators are applied by the same join, as further columns of its key.
+func makeJoin(c *Catalog, plan *LogicalPlan, j *LogicalJoinNode, remaining []*LogicalJoinNode, tableMap map[string]*PlanNode) (*plannedJoin, error) {
+	node1, node2, lTabName, rTabName, err := joinInputs(c, plan, j, tableMap)
+	if err != nil {
+		return nil, err
+	}
+	op1 := node1.op
+	op2 := node2.op
+
+	leftExpr, _, err := j.left.generateExpr(c, node1.desc, tableMap)
+	if err != nil {
+		return nil, err
+	}
+	rightExpr, _, err := j.right.generateExpr(c, node2.desc, tableMap)
+	if err != nil {
+		return nil, err
+	}
 
-		rTabName, rFieldName, err := j.right.getTableField(c, plan.subqueries, plan.tables)
+	if op1 == op2 {
+		// the tables were already joined by other conditions, so this one
+		// filters the joined records
+		if j.joinType != InnerJoin {
+			return nil, ailikeError{ParseError, "the tables of an outer join are already joined"}
+		}
+		pred, err := NewCompareExpr(leftExpr, OpEq, rightExpr)
 		if err != nil {
 			return nil, err
 		}
-
-		node2, err := fieldToOp(rTabName, rFieldName, tableMap)
+		filter, err := NewFilter(pred, op1)
 		if err != nil {
 			return nil, err
 		}
+		return &plannedJoin{filter, op1, op2, lTabName, rTabName, []*LogicalJoinNode{j}}, nil
+	}
 
-		/*desc1 := *op1.Descriptor()
-		desc1.setTableAlias(j.t1)
-		desc2 := *op2.Descriptor()
-		desc2.setTableAlias(j.t2)
-		*/
-		op1 := node1.op
-		op2 := node2.op
-
-		/*
-			leftField, _ := fieldNameToField(j.t1, j.f1, node1)
-			rightField, _ := fieldNameToField(j.t2, j.f2, node2)
-		*/
-		leftExpr, _, err := j.left.generateExpr(c, node1.desc, tableMap)
-		if err != nil {
-			return nil, err
+	conds := []*LogicalJoinNode{j}
+	leftExprs, rightExprs := []Expr{leftExpr}, []Expr{rightExpr}
+	for _, k := range remaining {
+		if k == j || k.joinType != j.joinType {
+			continue
 		}
-		rightExpr, _, err := j.right.generateExpr(c, node2.desc, tableMap)
+		kNode1, kNode2, _, _, err := joinInputs(c, plan, k, tableMap)
 		if err != nil {
 			return nil, err
 		}
-
-		var (
-			newOp Operator
-		)
-		switch leftExpr.GetExprType().Ftype {
-		case IntType:
-			newOp, err = NewIntJoin(op1, leftExpr, op2, rightExpr, JoinBufferSize)
-		case StringType:
-			newOp, err = NewStringJoin(op1, leftExpr, op2, rightExpr, JoinBufferSize)
+		kLeft, kRight := k.left, k.right
+		switch {
+		case kNode1.op == op1 && kNode2.op == op2:
+		case kNode1.op == op2 && kNode2.op == op1:
+			kLeft, kRight = kRight, kLeft
 		default:
-			return nil, ailikeError{code: MalformedDataError, errString: "Don't allow for TextFields in expressions yet."}
+			continue
 		}
+		kLeftExpr, _, err := kLeft.generateExpr(c, node1.desc, tableMap)
 		if err != nil {
 			return nil, err
 		}
-		newNode := &PlanNode{newOp, newOp.Descriptor()}
-		for key, node := range tableMap {
-			if node.op == op1 {
-				tableMap[key] = newNode
-			}
-			if node.op == op2 {
-				tableMap[key] = newNode
-			}
+		kRightExpr, _, err := kRight.generateExpr(c, node2.desc, tableMap)
+		if err != nil {
+			return nil, err
 		}
-		tableMap[lTabName] = newNode
-		tableMap[rTabName] = newNode
-		//&PlanNode{newOp, newOp.Descriptor()}
+		conds = append(conds, k)
+		leftExprs = append(leftExprs, kLeftExpr)
+		rightExprs = append(rightExprs, kRightExpr)
+	}
 
+	newOp, err := chooseJoin(c.bp, op1, leftExprs, op2, rightExprs, j.joinType)
+	if err != nil {
+		return nil, err
 	}
+	return &plannedJoin{newOp, op1, op2, lTabName, rTabName, conds}, nil
+}
 
-	//check that all tables have the same op (all tables are joined)
-	first := true
-	var curOp Operator
+// Returns the cheapest join of left and right on the equality of leftFields to
+// rightFields: a hash join of blocks of the inputs; a grace hash join, if the
+// input that is hashed does not fit in JoinBufferSize records; or a merge join.
+// A merge join of inputs that are already sorted is preferred to a hash join of
+// the same cost, since its output is sorted too.
+func chooseJoin(bp *BufferPool, left Operator, leftFields []Expr, right Operator, rightFields []Expr, joinType JoinType) (Operator, error) {
+	if err := checkJoinKeys(leftFields, rightFields); err != nil {
+		return nil, err
+	}
+	hashJoin, err := NewEqualityJoin(left, joinKeyExpr(leftFields), right, joinKeyExpr(rightFields), joinType, JoinBufferSize)
+	if err != nil || bp == nil {
+		return hashJoin, err
+	}
+
+	var candidates []Operator
+	presorted := sortedOn(left, leftFields) && sortedOn(right, rightFields)
+	mergeJoin, err := NewSortMergeJoin(left, leftFields, right, rightFields, joinType, bp, SortMemoryBudget)
+	if err != nil {
+		return nil, err
+	}
+	if presorted {
+		candidates = append(candidates, mergeJoin)
+	}
+	candidates = append(candidates, hashJoin)
+	build := EstimatePlanCost(left).Rows
+	if joinType == RightOuterJoin {
+		build = EstimatePlanCost(right).Rows
+	}
+	// each partition being written holds a page of the buffer pool
+	partitions := min(int(math.Ceil(build/float64(JoinBufferSize))), bp.numPages/2)
+	if partitions > 1 && canSpill(left.Descriptor()) && canSpill(right.Descriptor()) {
+		graceJoin, err := NewGraceHashJoin(left, leftFields, right, rightFields, joinType, partitions, JoinBufferSize, bp)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, graceJoin)
+	}
+	if !presorted {
+		candidates = append(candidates, mergeJoin)
+	}
+
+	best, bestCost := candidates[0], EstimatePlanCost(candidates[0]).Cost
+	for _, candidate := range candidates[1:] {
+		if cost := EstimatePlanCost(candidate).Cost; cost < bestCost {
+			best, bestCost = candidate, cost
+		}
+	}
+	return best, nil
+}
+
+// Returns the value of a literal in a predicate or assignment: an int, a float,
+// or otherwise a string.  A literal compared to or assigned to a string is always
+// a string, so that e.g. name = '1' compares names rather than failing with a
+// type error.
+func typedLiteral(value string, compareTo DBType) *ConstExpr {
+	if compareTo != StringType && compareTo != EmbeddedStringType {
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return &ConstExpr{IntField{i}, IntType}
+		}
+		if f, err := strconv.ParseFloat(value, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+			return &ConstExpr{FloatField{f}, FloatType}
+		}
+	}
+	return &ConstExpr{StringField{value}, StringType}
+}
+
+// Generates the operands of a predicate.  Literals are typed to match the first
+// operand that is not a literal.
+func generatePredicateOperands(c *Catalog, args []*LogicalSelectNode, inputDesc *TupleDesc, tableMap map[string]*PlanNode) ([]Expr, error) {
+	exprs := make([]Expr, len(args))
+	compareTo := UnknownType
+	for i, arg := range args {
+		if arg.exprType == ExprConst {
+			continue
+		}
+		e, _, err := arg.generateExpr(c, inputDesc, tableMap)
+		if err != nil {
+			return nil, err
+		}
+		exprs[i] = e
+		if compareTo == UnknownType {
+			compareTo = e.GetExprType().Ftype
+		}
+	}
+	for i, arg := range args {
+		if arg.exprType == ExprConst {
+			exprs[i] = typedLiteral(arg.value, compareTo)
+		}
+	}
+	return exprs, nil
+}
+
+// Generates the boolean expression for a predicate node.
+func (s *LogicalSelectNode) generatePredicate(c *Catalog, inputDesc *TupleDesc, tableMap map[string]*PlanNode) (PredicateExpr, error) {
+	if s.exprType != ExprPred {
+		return nil, ailikeError{ParseError, "expected a boolean expression"}
+	}
+	op := *s.funcOp
+	switch op {
+	case "and", "or", "not":
+		preds := make([]PredicateExpr, len(s.args))
+		for i, arg := range s.args {
+			pred, err := arg.generatePredicate(c, inputDesc, tableMap)
+			if err != nil {
+				return nil, err
+			}
+			preds[i] = pred
+		}
+		switch op {
+		case "and":
+			return NewAndExpr(preds...), nil
+		case "or":
+			return NewOrExpr(preds...), nil
+		}
+		return NewNotExpr(preds[0]), nil
+	case "is null", "is not null":
+		e, _, err := s.args[0].generateExpr(c, inputDesc, tableMap)
+		if err != nil {
+			return nil, err
+		}
+		return NewIsNullExpr(e, op == "is not null"), nil
+	case "exists":
+		plan, outer, err := s.args[0].planSubquery(c, inputDesc, tableMap)
+		if err != nil {
+			return nil, err
+		}
+		return newExistsExpr(plan, outer), nil
+	case "in", "not in":
+		if s.args[1].exprType != ExprSubquery {
+			break
+		}
+		left, _, err := s.args[0].generateExpr(c, inputDesc, tableMap)
+		if err != nil {
+			return nil, err
+		}
+		plan, outer, err := s.args[1].planSubquery(c, inputDesc, tableMap)
+		if err != nil {
+			return nil, err
+		}
+		return newInSubqueryExpr(left, plan, outer, op == "not in")
+	}
+	operands, err := generatePredicateOperands(c, s.args, inputDesc, tableMap)
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "in", "not in":
+		return NewInExpr(operands[0], operands[1:], op == "not in")
+	case "between", "not between":
+		return NewBetweenExpr(operands[0], operands[1], operands[2], op == "not between")
+	}
+	boolOp, ok := BoolOpMap[op]
+	if !ok {
+		return nil, ailikeError{ParseError, fmt.Sprintf("unsupported comparison operator %s", op)}
+	}
+	return NewCompareExpr(operands[0], boolOp, operands[1])
+}
+
+// Applies each filter directly above the only table it references, so that rows
+// are discarded before they are joined.  Several filters on one table are
+// combined into a single Filter.  Filters that reference several tables, or none,
+// or the inner side of an outer join, whose records are padded with NULLs by the
+// join, are returned, to be applied once the tables have been joined.
+func pushDownFilters(c *Catalog, filters []*LogicalFilterNode, joins []*LogicalJoinNode, subqueries []*LogicalPlan, tables []*LogicalTableNode, tableMap map[string]*PlanNode) ([]*LogicalFilterNode, error) {
+	nullable := make(map[string]bool)
+	for _, j := range joins {
+		inner := j.right
+		switch j.joinType {
+		case InnerJoin:
+			continue
+		case RightOuterJoin:
+			inner = j.left
+		}
+		tabName, _, err := inner.getTableField(c, subqueries, tables)
+		if err != nil {
+			return nil, err
+		}
+		nullable[tabName] = true
+	}
+	var deferred []*LogicalFilterNode
+	created := make(map[*Filter]bool)
+	for _, f := range filters {
+		var node *PlanNode
+		singleTable := true
+		for _, field := range f.pred.referencedFields() {
+			tabName, fieldName, err := field.getTableField(c, subqueries, tables)
+			if err != nil {
+				return nil, err
+			}
+			fieldNode, err := fieldToOp(tabName, fieldName, tableMap)
+			if err != nil {
+				return nil, err
+			}
+			if (node != nil && fieldNode.op != node.op) || nullable[tabName] {
+				singleTable = false
+			}
+			node = fieldNode
+		}
+		if node == nil || !singleTable {
+			deferred = append(deferred, f)
+			continue
+		}
+		join, err := semiJoinFilter(c, f, node.op, tableMap)
+		if err != nil {
+			return nil, err
+		}
+		if join != nil {
+			newNode := &PlanNode{join, node.desc}
+			for key, n := range tableMap {
+				if n.op == node.op {
+					tableMap[key] = newNode
+				}
+			}
+			continue
+		}
+		pred, err := f.pred.generatePredicate(c, node.desc, tableMap)
+		if err != nil {
+			return nil, err
+		}
+		if existing, ok := node.op.(*Filter); ok && created[existing] {
+			existing.pred = NewAndExpr(existing.pred, pred)
+			continue
+		}
+		filter, err := NewFilter(pred, node.op)
+		if err != nil {
+			return nil, err
+		}
+		created[filter] = true
+		newNode := &PlanNode{filter, node.desc}
+		for key, n := range tableMap {
+			if n.op == node.op {
+				tableMap[key] = newNode
+			}
+		}
+	}
+	return deferred, nil
+}
+
+// Applies the conjunction of filters to the output of op.
+func applyFilters(c *Catalog, filters []*LogicalFilterNode, op Operator, tableMap map[string]*PlanNode) (Operator, error) {
+	var preds []PredicateExpr
+	for _, f := range filters {
+		join, err := semiJoinFilter(c, f, op, tableMap)
+		if err != nil {
+			return nil, err
+		}
+		if join != nil {
+			op = join
+			continue
+		}
+		pred, err := f.pred.generatePredicate(c, op.Descriptor(), tableMap)
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, pred)
+	}
+	if len(preds) == 0 {
+		return op, nil
+	}
+	return NewFilter(NewAndExpr(preds...), op)
+}
+
+// Returns a semi or anti join of op with the subquery of a filter that is an IN
+// or EXISTS subquery, or nil if the filter is not one, or its subquery cannot
+// be decorrelated, in which case it is evaluated for each record of op.  A
+// subquery can be decorrelated if it has no aggregates or limit, and its only
+// references to the enclosing query are in equalities between a field of the
+// enclosing query and an expression of the subquery.  These are the keys of the
+// join, along with the operand of IN.
+func semiJoinFilter(c *Catalog, f *LogicalFilterNode, op Operator, tableMap map[string]*PlanNode) (Operator, error) {
+	pred, negated := f.pred, false
+	if *pred.funcOp == "not" && pred.args[0].exprType == ExprPred {
+		pred, negated = pred.args[0], true
+	}
+	var subNode *LogicalSelectNode
+	var outerKeys, innerKeys []*LogicalSelectNode
+	isIn := false
+	switch *pred.funcOp {
+	case "exists":
+		subNode = pred.args[0]
+	case "in", "not in":
+		subNode = pred.args[1]
+		isIn = true
+		negated = negated != (*pred.funcOp == "not in")
+		outerKeys = pred.args[:1]
+	}
+	if subNode == nil || subNode.exprType != ExprSubquery {
+		return nil, nil
+	}
+	sub := subNode.subquery
+	if len(sub.aggs) > 0 || len(sub.groupByFields) > 0 || sub.having != nil || sub.limit != nil {
+		return nil, nil
+	}
+	if isIn {
+		if len(sub.selects) != 1 || sub.selects[0].exprType == ExprStar || sub.selects[0].hasParams() {
+			return nil, nil
+		}
+		innerKeys = sub.selects[:1]
+	}
+	var filters []*LogicalFilterNode
+	for _, sf := range sub.filters {
+		if !sf.pred.hasParams() {
+			filters = append(filters, sf)
+			continue
+		}
+		outerKey, innerKey := sub.correlation(sf.pred)
+		if outerKey == nil {
+			return nil, nil
+		}
+		outerKeys = append(outerKeys, outerKey)
+		innerKeys = append(innerKeys, innerKey)
+	}
+	joinType := SemiJoin
+	if negated {
+		joinType = AntiJoin
+		if isIn {
+			// NOT IN is unknown for a NULL in the subquery, which a null-aware
+			// anti join only handles for a single key
+			joinType = NullAwareAntiJoin
+			if len(outerKeys) > 1 {
+				return nil, nil
+			}
+		}
+	}
+	if len(outerKeys) == 0 {
+		// an uncorrelated EXISTS is evaluated once
+		return nil, nil
+	}
+
+	inner := *sub
+	inner.filters, inner.selects, inner.outerRefs = filters, innerKeys, nil
+	inner.orderByFields, inner.distinct = nil, false
+	innerOp, err := makePhysicalPlan(c, &inner)
+	if err != nil {
+		return nil, err
+	}
+	leftExprs := make([]Expr, len(outerKeys))
+	rightExprs := make([]Expr, len(innerKeys))
+	for i, key := range outerKeys {
+		leftExprs[i], _, err = key.generateExpr(c, op.Descriptor(), tableMap)
+		if err != nil {
+			return nil, err
+		}
+		rightExprs[i] = &FieldExpr{innerOp.Descriptor().Fields[i]}
+	}
+	if checkJoinKeys(leftExprs, rightExprs) != nil {
+		// e.g. an int compared to a float, which a hash join cannot match
+		return nil, nil
+	}
+	return NewEqualityJoin(op, joinKeyExpr(leftExprs), innerOp, joinKeyExpr(rightExprs), joinType, JoinBufferSize)
+}
+
+// Returns the table read by op and the predicate applied to it, if op scans a
+// single table and so can be replaced by an index scan with the predicate pushed
+// into it.
+func indexableScan(op Operator) (*HeapFile, PredicateExpr, bool) {
+	switch op := op.(type) {
+	case *HeapFile:
+		return op, nil, true
+	case *Filter:
+		if hf, ok := op.child.(*HeapFile); ok {
+			return hf, op.pred, true
+		}
+	}
+	return nil, nil, false
+}
+
+func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
+	if plan.setOp != nil {
+		return makeSetOpPlan(c, plan)
+	}
+	//build mapping from table names / aliases to operators
+
+	tableMap := make(map[string]*PlanNode)
+	for _, p := range plan.subqueries {
+		subPhysP, err := makePhysicalPlan(c, p)
+		if err != nil {
+			return nil, err
+		}
+		var td *TupleDesc = subPhysP.Descriptor()
+		td.setTableAlias(p.alias)
+		//td = td.setTableAlias(p.alias)
+		tableMap[p.alias] = &PlanNode{subPhysP, td}
+	}
+	for _, t := range plan.tables {
+		name := t.tableName
+		if t.alias != "" {
+			name = t.alias
+		}
+		var td *TupleDesc = (*t.file).Descriptor()
+		td.setTableAlias(name)
+		//td = td.setTableAlias(name)
+		tableMap[name] = &PlanNode{*t.file, td}
+	}
+
+	//now apply each filter to appropriate table
+	deferredFilters, err := pushDownFilters(c, plan.filters, plan.joins, plan.subqueries, plan.tables, tableMap)
+	if err != nil {
+		return nil, err
+	}
+	//finally apply joins; once every table has been analyzed, the join producing
+	//the fewest rows is applied first, otherwise joins are applied in query order.
+	//Outer joins cannot be reordered with other joins, so are always applied in
+	//query order
+	remaining := append([]*LogicalJoinNode{}, plan.joins...)
+	costBased := len(remaining) > 1 && allTablesAnalyzed(plan)
+	for _, j := range remaining {
+		costBased = costBased && j.joinType == InnerJoin
+	}
+	for len(remaining) > 0 {
+		next := 0
+		if costBased {
+			best := PlanCost{}
+			for i, j := range remaining {
+				candidate, err := makeJoin(c, plan, j, remaining, tableMap)
+				if err != nil {
+					return nil, err
+				}
+				est := EstimatePlanCost(candidate.op)
+				if i == 0 || est.Rows < best.Rows || (est.Rows == best.Rows && est.Cost < best.Cost) {
+					next, best = i, est
+				}
+			}
+		}
+		joined, err := makeJoin(c, plan, remaining[next], remaining, tableMap)
+		if err != nil {
+			return nil, err
+		}
+		var unapplied []*LogicalJoinNode
+		for _, j := range remaining {
+			applied := false
+			for _, cond := range joined.conds {
+				applied = applied || cond == j
+			}
+			if !applied {
+				unapplied = append(unapplied, j)
+			}
+		}
+		remaining = unapplied
+		newNode := &PlanNode{joined.op, joined.op.Descriptor()}
+		for key, node := range tableMap {
+			if node.op == joined.left {
+				tableMap[key] = newNode
+			}
+			if node.op == joined.right {
+				tableMap[key] = newNode
+			}
+		}
+		tableMap[joined.leftTable] = newNode
+		tableMap[joined.rightTable] = newNode
+	}
+
+	//check that all tables have the same op (all tables are joined)
+	first := true
+	var curOp Operator
 	for _, node := range tableMap {
 		if first {
 			curOp = node.op
@@ -1130,12 +2686,19 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
 		}
 	}
 
-	topOp := curOp
+	//filters over several tables apply to the joined result
+	topOp, err := applyFilters(c, deferredFilters, curOp, tableMap)
+	if err != nil {
+		return nil, err
+	}
 
 	//var fieldList []FieldType
 	var fieldNames []string
-	hasAgg := len(plan.aggs) > 0
+	hasAgg := len(plan.aggs) > 0 || len(plan.groupByFields) > 0
 	selectAll := false
+	if plan.having != nil && !hasAgg {
+		return nil, ailikeError{ParseError, "HAVING requires a GROUP BY or an aggregate"}
+	}
 
 	/*
 		for _, s := range plan.selects {
@@ -1148,14 +2711,24 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
 	var indexField *FieldExpr = nil
 	var queryVector *ConstExpr = nil
 	var ascending bool = false
-	var err error = nil
-	hasOnlyOneAgg := len(plan.aggs) == 1
+	// the same aggregate may appear in the select list, HAVING and ORDER BY, but is computed once
+	nAggs := 0
+	for i, s := range plan.aggs {
+		if findSameExpr(plan.aggs[:i], s) < 0 {
+			nAggs++
+		}
+	}
+	hasOnlyOneAgg := nAggs == 1
 	if hasAgg {
 		var gbys []Expr
 		var aggs []AggState
 
 		var aggCnt int
-		for _, s := range plan.aggs {
+		for i, s := range plan.aggs {
+			if prev := findSameExpr(plan.aggs[:i], s); prev >= 0 {
+				s.cachedField = plan.aggs[prev].cachedField
+				continue
+			}
 			/*
 				selectNode, err := fieldToOp(s.table, s.field, tableMap)
 				if err != nil {
@@ -1184,6 +2757,7 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
 					return nil, err
 				}
 
+				stateExpr := aggExpr
 				switch aggExpr.GetExprType().Ftype {
 				case IntType:
 					getter = intAggGetter
@@ -1213,6 +2787,10 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
 					as = &SumAggState[int64]{}
 				case "count":
 					as = &CountAggState{}
+					if s.args[0].field == "*" {
+						// COUNT(*) counts every record, rather than those where a column is not NULL
+						stateExpr = nil
+					}
 				default:
 					return nil, ailikeError{IllegalOperationError, fmt.Sprintf("unknown aggregate function %s", *s.funcOp)}
 				}
@@ -1222,7 +2800,7 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
 				if s.alias != "" {
 					name = s.alias
 				}
-				as.Init(name, aggExpr, getter)
+				as.Init(name, stateExpr, getter)
 				aggs = append(aggs, as)
 				s.cachedField = &as.GetTupleDesc().Fields[0] //track aggregates by reference rather than name
 
@@ -1235,33 +2813,120 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
 			}
 		}
 
-		for _, gby := range plan.groupByFields {
+		// group by expressions other than columns are computed as hidden columns by
+		// a projection below the aggregate
+		var hiddenExprs []Expr
+		var hiddenNames []string
+		for i, gby := range plan.groupByFields {
 			expr, _, err := gby.expr.generateExpr(c, topOp.Descriptor(), tableMap)
 			if err != nil {
 				return nil, err
 			}
+			if gby.expr.exprType != ExprField {
+				hiddenExprs = append(hiddenExprs, expr)
+				hiddenNames = append(hiddenNames, fmt.Sprintf("_group%d", i))
+				expr = nil
+			}
 			gbys = append(gbys, expr)
 		}
 
-		heapFile, topOpIsHeapFile := (topOp).(*HeapFile)
-		if len(plan.groupByFields) == 0 && indexField != nil && queryVector != nil && topOpIsHeapFile {
+		heapFile, scanFilter, indexable := indexableScan(topOp)
+		if len(plan.groupByFields) == 0 && indexField != nil && queryVector != nil && indexable {
 			var one IntField = IntField{1}
 			var limitExpr *ConstExpr = &ConstExpr{one, IntType}
-			if err != nil {
-				return nil, ailikeError{ParseError, "Could not determine limit for vector index."}
-			}
 			vectorIndex, err := NewNNScan(heapFile, limitExpr, (*indexField).selectField, *queryVector, ascending)
 			if err != nil {
 				return nil, ailikeError{ParseError, "Could not create NNScan"}
 			}
+			vectorIndex.SetFilter(scanFilter)
 			topOp = vectorIndex
 		}
 
+		if len(hiddenExprs) > 0 {
+			topOp, err = projectHiddenColumns(topOp, hiddenExprs, hiddenNames)
+			if err != nil {
+				return nil, err
+			}
+			// the select list, HAVING and ORDER BY refer to the group's column
+			// wherever they repeat a group by expression
+			hiddenFields := topOp.Descriptor().Fields[len(topOp.Descriptor().Fields)-len(hiddenExprs):]
+			for i, gby := range plan.groupByFields {
+				if gbys[i] == nil {
+					gby.expr.cachedField = &hiddenFields[0]
+					gbys[i] = &FieldExpr{hiddenFields[0]}
+					hiddenFields = hiddenFields[1:]
+				}
+			}
+			for _, s := range plan.selects {
+				s.bindGroupBys(plan.groupByFields)
+			}
+			for _, oby := range plan.orderByFields {
+				oby.expr.bindGroupBys(plan.groupByFields)
+			}
+			if plan.having != nil {
+				plan.having.bindGroupBys(plan.groupByFields)
+			}
+		}
+
+		// the partitions of a parallel scan are gathered for the aggregate, which
+		// reads all of them; an NNScan is read serially, since its partitions may
+		// together probe more clusters than it would
+		if _, isNNScan := topOp.(*NNScan); !isNNScan {
+			if workers := plan.parallelWorkers(c, topOp); workers > 1 {
+				if topOp, err = makeGather(topOp, workers); err != nil {
+					return nil, err
+				}
+			}
+		}
 		if len(gbys) == 0 {
 			topOp = NewAggregator(aggs, topOp)
 		} else {
 			topOp = NewGroupedAggregator(aggs, gbys, topOp)
 		}
+
+		if plan.having != nil {
+			pred, err := plan.having.generatePredicate(c, topOp.Descriptor(), tableMap)
+			if err != nil {
+				return nil, err
+			}
+			topOp, err = NewFilter(pred, topOp)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	// rrf() and mmr() rank the whole input, so they are computed by an operator
+	// below the projection that appends the score as a new column
+	var rankSelect *LogicalSelectNode = nil
+	for _, s := range plan.selects {
+		if s.exprType == ExprFunc && isRankingFunc(*s.funcOp) {
+			if hasAgg || rankSelect != nil {
+				return nil, ailikeError{ParseError, fmt.Sprintf("%s cannot be combined with aggregates or other ranking functions", *s.funcOp)}
+			}
+			rankSelect = s
+		}
+	}
+	if rankSelect != nil {
+		if *rankSelect.funcOp == "rrf" {
+			topOp, err = makeRRFPlan(c, rankSelect, plan.window(), topOp, tableMap)
+		} else {
+			topOp, err = makeMMRPlan(c, rankSelect, plan.window(), topOp, tableMap)
+		}
+		if err != nil {
+			return nil, err
+		}
+		rankField := topOp.Descriptor().Fields[len(topOp.Descriptor().Fields)-1]
+		rankSelect.cachedField = &rankField
+		// a ranking function in the order by refers to the projected output of the select list
+		outputName := rankField.Fname
+		if rankSelect.alias != "" {
+			outputName = rankSelect.alias
+		}
+		for _, oby := range plan.orderByFields {
+			if oby.expr.exprType == ExprFunc && *oby.expr.funcOp == *rankSelect.funcOp {
+				oby.expr.cachedField = &FieldType{outputName, "", IntType}
+			}
+		}
 	}
 	exprList := make([]Expr, len(plan.selects))
 	for i, s := range plan.selects {
@@ -1279,7 +2944,63 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
 			fieldNames = append(fieldNames, field)
 		}
 	}
+	if plan.after != nil {
+		// keyset pagination skips the records up to the cursor, before the scan
+		// of the table, so that an index scan probes enough clusters to replace them
+		oby := plan.orderByFields[0]
+		var key Expr
+		if col := selectListColumn(oby.expr, plan.selects, exprList, fieldNames); col >= 0 && !selectAll {
+			key = exprList[col]
+		} else if key, _, err = oby.expr.generateExpr(c, topOp.Descriptor(), tableMap); err != nil {
+			return nil, err
+		}
+		pred, err := plan.after.filter(key, oby.ascending)
+		if err != nil {
+			return nil, err
+		}
+		if topOp, err = addFilter(topOp, pred); err != nil {
+			return nil, err
+		}
+	}
+	orderByCols := make([]int, len(plan.orderByFields))
+	ridCol := -1
+	// the scan below the projection, which parallel plans partition
+	scanOp := topOp
 	if !selectAll {
+		// ORDER BY expressions are evaluated over the projected columns; those not
+		// in the select list are projected as hidden columns, which are removed
+		// again once the results are sorted
+		for i, oby := range plan.orderByFields {
+			col := selectListColumn(oby.expr, plan.selects, exprList, fieldNames)
+			if col < 0 {
+				if plan.distinct {
+					return nil, ailikeError{ParseError, "ORDER BY expressions must appear in the select list of a DISTINCT query"}
+				}
+				expr, _, err := oby.expr.generateExpr(c, topOp.Descriptor(), tableMap)
+				if err != nil {
+					return nil, err
+				}
+				exprList = append(exprList, expr)
+				fieldNames = append(fieldNames, fmt.Sprintf("_order%d", i))
+				col = len(exprList) - 1
+			}
+			orderByCols[i] = col
+		}
+		// ties are broken by rid in queries that select it, since they may be
+		// pages of keyset pagination, which need a stable order.  With a cursor
+		// rid is projected as a hidden column, since it is lost by the projection
+		for i, e := range exprList[:len(plan.selects)] {
+			if _, ok := e.(*RidExpr); ok && len(plan.orderByFields) > 0 {
+				ridCol = i
+				break
+			}
+		}
+		if plan.after != nil && ridCol < 0 {
+			exprList = append(exprList, &RidExpr{})
+			fieldNames = append(fieldNames, "_rid")
+			ridCol = len(exprList) - 1
+		}
+
 		/*
 			We can use the vector index if:
 			    - The first expression in the orderby clause refers to an ailike expression
@@ -1287,72 +3008,270 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
 				- The args of the ailike expression are a field expression (column) and a constant expression
 				- there exists a vector index on the column involved in the ailike epxression
 		*/
-		var firstOrderByField *string = nil
+		var bm25Expr *BM25Expr = nil
+		var multiVectorExpr *MultiVectorExpr = nil
 		if len(plan.orderByFields) > 0 {
-			orderByNode := *plan.orderByFields[0]
-			firstOrderByField = &(orderByNode.expr).field
-			ascending = orderByNode.ascending
-		}
-		for i, fieldName := range fieldNames {
-			if firstOrderByField != nil && fieldName == *firstOrderByField {
-				expr := exprList[i]
-				indexField, queryVector, err = _getArgsFromAilikeFunc(expr, c)
-				if err != nil {
-					return nil, err
-				}
+			ascending = plan.orderByFields[0].ascending
+			expr := exprList[orderByCols[0]]
+			indexField, queryVector, err = _getArgsFromAilikeFunc(expr, c)
+			if err != nil {
+				return nil, err
+			}
+			if e, ok := expr.(*BM25Expr); ok {
+				bm25Expr = e
+			}
+			if e, ok := expr.(*MultiVectorExpr); ok {
+				multiVectorExpr = e
 			}
 		}
 
 		heapFile, topOpIsHeapFile := (topOp).(*HeapFile)
-		if plan.limit != nil && indexField != nil && queryVector != nil && topOpIsHeapFile {
-			limitExpr, _, err := plan.limit.generateExpr(c, topOp.Descriptor(), tableMap)
+		// the vector index can also produce the candidates of a filtered table,
+		// by checking the filter on each candidate
+		indexedFile, scanFilter, indexable := indexableScan(topOp)
+		// Similarly, the text index can produce the best matches for a bm25
+		// ordering directly
+		if plan.limit != nil && bm25Expr != nil && !ascending && topOpIsHeapFile {
+			limitExpr, _, err := plan.window().generateExpr(c, topOp.Descriptor(), tableMap)
+			if err != nil {
+				return nil, ailikeError{ParseError, "Could not determine limit for text index."}
+			}
+			textIndex, err := NewBM25Scan(heapFile, limitExpr, bm25Expr.field.selectField, bm25Expr.query)
+			if err != nil {
+				return nil, err
+			}
+			topOp = textIndex
+		}
+		if plan.limit != nil && indexField != nil && queryVector != nil && indexable {
+			limitExpr, _, err := plan.window().generateExpr(c, topOp.Descriptor(), tableMap)
 			if err != nil {
 				return nil, ailikeError{ParseError, "Could not determine limit for vector index."}
 			}
-			vectorIndex, err := NewNNScan(heapFile, limitExpr, (*indexField).selectField, *queryVector, ascending)
+			vectorIndex, err := NewNNScan(indexedFile, limitExpr, (*indexField).selectField, *queryVector, ascending)
 			if err != nil {
 				return nil, ailikeError{ParseError, "Could not create NNScan"}
 			}
-			topOp = vectorIndex
+			vectorIndex.SetFilter(scanFilter)
+			topOp = chooseAccessPath(indexedFile, topOp, vectorIndex, exprList)
+		}
+		// A query by several examples can also use the vector index: records like any of the
+		// examples are found by probing once per example, and records like all of them are
+		// found by probing with the average of the examples.  The records nearest the average
+		// are not always those whose farthest example is nearest, so that probe finds as many
+		// candidates for each example as are wanted, and the ORDER BY re-ranks them; like
+		// the other index scans, the result is approximate.
+		if plan.limit != nil && multiVectorExpr != nil && indexable {
+			exists, err := nnIndexExists(multiVectorExpr.field.selectField, c)
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				limitExpr, _, err := plan.window().generateExpr(c, topOp.Descriptor(), tableMap)
+				if err != nil {
+					return nil, ailikeError{ParseError, "Could not determine limit for vector index."}
+				}
+				var indexScan Operator
+				if multiVectorExpr.all {
+					var nQueries Expr = &ConstExpr{IntField{int64(len(multiVectorExpr.queries))}, IntType}
+					candidatesExpr := &FuncExpr{op: "*", args: []*Expr{&limitExpr, &nQueries}}
+					scan, err := NewNNScan(indexedFile, candidatesExpr, multiVectorExpr.field.selectField, ConstExpr{multiVectorExpr.meanQuery(), EmbeddedStringType}, ascending)
+					if err != nil {
+						return nil, ailikeError{ParseError, "Could not create NNScan"}
+					}
+					scan.SetFilter(scanFilter)
+					indexScan = scan
+				} else {
+					scan, err := NewMultiNNScan(indexedFile, limitExpr, multiVectorExpr.field.selectField, multiVectorExpr.queries, ascending)
+					if err != nil {
+						return nil, ailikeError{ParseError, "Could not create NNScan"}
+					}
+					scan.SetFilter(scanFilter)
+					indexScan = scan
+				}
+				topOp = chooseAccessPath(indexedFile, topOp, indexScan, exprList)
+			}
 		}
+		scanOp = topOp
 		projOp, err := NewProjectOp(exprList, fieldNames, plan.distinct, topOp)
 		if err != nil {
 			return nil, err
 		}
-		topOp = projOp
+		topOp = projOp
+	}
+
+	if len(plan.orderByFields) > 0 {
+		var ascs []bool
+
+		exprs := make([]Expr, len(plan.orderByFields))
+		for i, oby := range plan.orderByFields {
+			if !selectAll {
+				exprs[i] = &FieldExpr{topOp.Descriptor().Fields[orderByCols[i]]}
+			} else {
+				expr, _, err := oby.expr.generateExpr(c, topOp.Descriptor(), tableMap)
+				if err != nil {
+					return nil, err
+				}
+				exprs[i] = expr
+			}
+			ascs = append(ascs, oby.ascending)
+
+		}
+		if ridCol >= 0 {
+			exprs = append(exprs, &FieldExpr{topOp.Descriptor().Fields[ridCol]})
+			ascs = append(ascs, true)
+		} else if plan.after != nil {
+			exprs = append(exprs, &RidExpr{})
+			ascs = append(ascs, true)
+		}
+		// in a parallel plan, each worker projects and sorts a partition of the
+		// scan, and the workers' results are merged, or gathered to be sorted
+		workers := plan.parallelWorkers(c, scanOp)
+		var partitions []Operator
+		if workers > 1 {
+			if partitions, err = projectPartitions(scanOp, workers, selectAll, exprList, fieldNames); err != nil {
+				return nil, err
+			}
+		}
+		// with a limit, only the first tuples need to be kept, rather than sorting
+		// all of them
+		if plan.limit != nil {
+			limit, _, err := plan.window().generateExpr(c, topOp.Descriptor(), tableMap)
+			if err != nil {
+				return nil, err
+			}
+			if partitions != nil {
+				topOp, err = makeParallelTopK(exprs, partitions, ascs, limit)
+			} else {
+				topOp, err = NewTopK(exprs, topOp, ascs, limit)
+			}
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			if partitions != nil {
+				if topOp, err = NewGather(partitions); err != nil {
+					return nil, err
+				}
+			}
+			orderBy, err := NewOrderBy(exprs, topOp, ascs)
+			if err != nil {
+				return nil, err
+			}
+			orderBy.SetMemoryBudget(c.bp, SortMemoryBudget)
+			topOp = orderBy
+		}
+	}
+
+	if plan.limit != nil {
+		topOp, err = plan.makeLimit(c, topOp, tableMap)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(exprList) > len(plan.selects) {
+		// remove the hidden ORDER BY columns
+		desc := topOp.Descriptor()
+		visible := make([]Expr, len(plan.selects))
+		for i := range visible {
+			visible[i] = &FieldExpr{desc.Fields[i]}
+		}
+		topOp, err = NewProjectOp(visible, fieldNames[:len(plan.selects)], false, topOp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if subqueries := plan.subqueryPlans(); len(subqueries) > 0 {
+		topOp = NewSubqueryOp(topOp, subqueries)
+	}
+	return topOp, nil
+}
+
+// Makes the plan of a set operation, followed by its ORDER BY and LIMIT.
+func makeSetOpPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
+	left, err := makePhysicalPlan(c, plan.setOp.left)
+	if err != nil {
+		return nil, err
+	}
+	right, err := makePhysicalPlan(c, plan.setOp.right)
+	if err != nil {
+		return nil, err
+	}
+	var topOp Operator
+	topOp, err = NewSetOp(left, right, plan.setOp.op, plan.setOp.all)
+	if err != nil {
+		return nil, err
+	}
+	// the fields of the result are not from any table
+	tableMap := make(map[string]*PlanNode)
+	var window Expr
+	if plan.limit != nil {
+		if window, _, err = plan.window().generateExpr(c, topOp.Descriptor(), tableMap); err != nil {
+			return nil, err
+		}
 	}
-
 	if len(plan.orderByFields) > 0 {
-		var ascs []bool
-
 		exprs := make([]Expr, len(plan.orderByFields))
+		ascs := make([]bool, len(plan.orderByFields))
 		for i, oby := range plan.orderByFields {
-			expr, _, err := oby.expr.generateExpr(c, topOp.Descriptor(), tableMap)
-			if err != nil {
+			if exprs[i], _, err = oby.expr.generateExpr(c, topOp.Descriptor(), tableMap); err != nil {
 				return nil, err
 			}
-			exprs[i] = expr
-			ascs = append(ascs, oby.ascending)
-
+			ascs[i] = oby.ascending
+		}
+		var orderBy *OrderBy
+		if window != nil {
+			orderBy, err = NewTopK(exprs, topOp, ascs, window)
+		} else {
+			orderBy, err = NewOrderBy(exprs, topOp, ascs)
+			if err == nil {
+				orderBy.SetMemoryBudget(c.bp, SortMemoryBudget)
+			}
 		}
-		var err error
-		topOp, err = NewOrderBy(exprs, topOp, ascs)
 		if err != nil {
 			return nil, err
 		}
-
+		topOp = orderBy
 	}
-
 	if plan.limit != nil {
-		expr, _, err := plan.limit.generateExpr(c, topOp.Descriptor(), tableMap)
-		if err != nil {
-			return nil, err
-		}
-		topOp = NewLimitOp(expr, topOp)
+		return plan.makeLimit(c, topOp, tableMap)
 	}
 	return topOp, nil
 }
 
+// Returns a projection of all of the columns of op, followed by the given hidden columns.
+func projectHiddenColumns(op Operator, exprs []Expr, names []string) (Operator, error) {
+	var allExprs []Expr
+	var allNames []string
+	for _, f := range op.Descriptor().Fields {
+		allExprs = append(allExprs, &FieldExpr{f})
+		allNames = append(allNames, f.Fname)
+	}
+	return NewProjectOp(append(allExprs, exprs...), append(allNames, names...), false, op)
+}
+
+// Returns the column of the select list that an ORDER BY expression refers to,
+// either by repeating a select expression or by naming an output column, or -1
+// if it refers to neither.
+func selectListColumn(oby *LogicalSelectNode, selects []*LogicalSelectNode, exprs []Expr, names []string) int {
+	if i := findSameExpr(selects, oby); i >= 0 {
+		return i
+	}
+	if oby.exprType != ExprField && oby.cachedField == nil {
+		return -1
+	}
+	name := FieldType{Fname: oby.field, TableQualifier: oby.table, Ftype: UnknownType}
+	if oby.cachedField != nil {
+		name = *oby.cachedField
+	}
+	desc := (&Project{selectFields: exprs, outputNames: names}).Descriptor()
+	i, err := findFieldInTd(name, desc)
+	if err != nil {
+		return -1
+	}
+	return i
+}
+
 func parseInsert(c *Catalog, insStmt *sqlparser.Insert) (Operator, error) {
 	if insStmt.Columns != nil {
 		return nil, ailikeError{ParseError, "ailike doesn't support inserts of incomplete tuples"}
@@ -1405,7 +3324,7 @@ func parseDelete(c *Catalog, delStmt *sqlparser.Delete) (Operator, error) {
 	if len(delStmt.TableExprs) > 1 {
 		return nil, ailikeError{ParseError, "ailike does not supporting deleting from multiple tables"}
 	}
-	tables, subplans, joins, err := parseFrom(c, delStmt.TableExprs[0])
+	tables, subplans, joins, _, err := parseFrom(c, delStmt.TableExprs[0])
 	if err != nil {
 		return nil, err
 	}
@@ -1429,42 +3348,16 @@ func parseDelete(c *Catalog, delStmt *sqlparser.Delete) (Operator, error) {
 			return nil, ailikeError{ParseError, "ailike does not supporting deleting from multiple tables"}
 		}
 	}
-	var newOp Operator
-	newOp = *tables[0].file
+	newOp, err := applyFilters(c, filters, *tables[0].file, tableMap)
+	if err != nil {
+		return nil, err
+	}
+	var preds []*LogicalSelectNode
 	for _, f := range filters {
-		tabName, fieldName, err := f.fieldExpr.getTableField(c, subplans, tables)
-		if err != nil {
-			return nil, err
-		}
-		node, err := fieldToOp(tabName, fieldName, tableMap)
-		if err != nil {
-			return nil, err
-		}
-		leftExpr, _, err := f.fieldExpr.generateExpr(c, node.desc, tableMap)
-		if err != nil {
-			return nil, err
-		}
-		rightExpr, _, err := f.constExpr.generateExpr(c, node.desc, tableMap)
-		if err != nil {
-			return nil, err
-		}
-
-		//op := node.op
-		//dbField, _ := fieldNameToField(f.table, f.field, &PlanNode{op, &desc})
-
-		switch leftExpr.GetExprType().Ftype {
-		case IntType:
-			//newInt, _ := strconv.Atoi(f.constVal)
-			newOp, err = NewIntFilter(rightExpr, f.predOp, leftExpr, newOp)
-			if err != nil {
-				return nil, err
-			}
-		case StringType:
-			newOp, err = NewStringFilter(rightExpr, f.predOp, leftExpr, newOp)
-			if err != nil {
-				return nil, err
-			}
-		}
+		preds = append(preds, f.pred)
+	}
+	if subqueries := subqueryPlans(preds...); len(subqueries) > 0 {
+		newOp = NewSubqueryOp(newOp, subqueries)
 	}
 	return NewDeleteOp(*tables[0].file, newOp), nil
 
@@ -1480,8 +3373,31 @@ const (
 	CreateTableQueryType QueryType = iota
 	DropTableQueryType   QueryType = iota
 	UnknownQueryType     QueryType = iota
+	SetQueryType         QueryType = iota
 )
 
+// Applies the settings of a SET statement to the catalog.  The only setting is
+// max_parallel_workers, the most workers a parallel plan may use.
+func processSet(c *Catalog, set *sqlparser.Set) error {
+	for _, e := range set.Exprs {
+		switch e.Name.Lowered() {
+		case "max_parallel_workers":
+			val, ok := e.Expr.(*sqlparser.SQLVal)
+			if !ok || val.Type != sqlparser.IntVal {
+				return ailikeError{ParseError, "max_parallel_workers must be an integer"}
+			}
+			n, err := strconv.Atoi(string(val.Val))
+			if err != nil || n < 1 {
+				return ailikeError{ParseError, "max_parallel_workers must be at least 1"}
+			}
+			c.SetMaxParallelWorkers(n)
+		default:
+			return ailikeError{ParseError, fmt.Sprintf("unknown setting %s", e.Name.String())}
+		}
+	}
+	return nil
+}
+
 func processDDL(c *Catalog, ddl *sqlparser.DDL) (QueryType, error) {
 	switch ddl.Action {
 	case "create":
@@ -1529,18 +3445,549 @@ func processDDL(c *Catalog, ddl *sqlparser.DDL) (QueryType, error) {
 	}
 }
 
-func Parse(c *Catalog, query string) (QueryType, Operator, error) {
+// Parses an ANALYZE statement, which the SQL parser does not support.  Returns a nil operator if
+// the query is not an ANALYZE statement, in which case the returned bool is false.
+func parseAnalyze(c *Catalog, query string) (Operator, bool, error) {
+	words := strings.Fields(strings.TrimSuffix(strings.TrimSpace(query), ";"))
+	if len(words) == 0 || strings.ToLower(words[0]) != "analyze" {
+		return nil, false, nil
+	}
+	words = words[1:]
+	if len(words) > 0 && strings.ToLower(words[0]) == "table" {
+		words = words[1:]
+	}
+	if len(words) != 1 {
+		return nil, true, ailikeError{ParseError, "expected ANALYZE [TABLE] table_name"}
+	}
+	op, err := NewAnalyzeOp(c, words[0])
+	return op, true, err
+}
+
+// Parses a VACUUM statement, which the SQL parser does not support.  Returns a nil operator if
+// the query is not a VACUUM statement, in which case the returned bool is false.
+func parseVacuum(c *Catalog, query string) (Operator, bool, error) {
+	words := strings.Fields(strings.TrimSuffix(strings.TrimSpace(query), ";"))
+	if len(words) == 0 || strings.ToLower(words[0]) != "vacuum" {
+		return nil, false, nil
+	}
+	words = words[1:]
+	if len(words) > 1 {
+		return nil, true, ailikeError{ParseError, "expected VACUUM [table_name]"}
+	}
+	table := ""
+	if len(words) == 1 {
+		table = words[0]
+	}
+	op, err := NewVacuumOp(c, table)
+	return op, true, err
+}
+
+// The cursor of keyset pagination, AFTER value, rid, which is the value of the
+// ORDER BY expression and the rid() of the last record of the previous page.
+// The next page starts with the records that follow it in the order, with ties
+// broken by rid, so that no record is returned twice even if the table has
+// changed between pages.
+type keysetCursor struct {
+	value DBValue
+	rid   int64
+}
+
+// Splits a query that ends with AFTER value, rid into the query and its cursor.
+// Other queries are returned unchanged, with a nil cursor.
+func splitAfter(query string) (string, *keysetCursor, error) {
+	tkn := sqlparser.NewStringTokenizer(query)
+	depth := 0
+	for {
+		typ, val := tkn.Scan()
+		switch typ {
+		case 0, sqlparser.LEX_ERROR:
+			return query, nil, nil
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case sqlparser.ID:
+			end := min(tkn.Position-1, len(query))
+			start := end - len(val)
+			// a quoted identifier is not a keyword
+			if depth > 0 || !strings.EqualFold(string(val), "after") || start < 0 || query[start:end] != string(val) {
+				continue
+			}
+			cursor, err := scanCursor(tkn)
+			if err != nil {
+				return "", nil, err
+			}
+			return query[:start], cursor, nil
+		}
+	}
+}
+
+// Scans the value and rid of a cursor, which must end the query.
+func scanCursor(tkn *sqlparser.Tokenizer) (*keysetCursor, error) {
+	bad := ailikeError{ParseError, "AFTER expects a value and a rid, such as AFTER 1200, 65538"}
+	cursor := &keysetCursor{}
+	typ, val := tkn.Scan()
+	sign := ""
+	if typ == '-' {
+		sign = "-"
+		typ, val = tkn.Scan()
+	}
+	switch {
+	case typ == sqlparser.INTEGRAL:
+		v, err := strconv.ParseInt(sign+string(val), 10, 64)
+		if err != nil {
+			return nil, bad
+		}
+		cursor.value = IntField{v}
+	case typ == sqlparser.STRING && sign == "":
+		cursor.value = StringField{string(val)}
+	default:
+		return nil, bad
+	}
+	if typ, _ = tkn.Scan(); typ != ',' {
+		return nil, bad
+	}
+	if typ, val = tkn.Scan(); typ != sqlparser.INTEGRAL {
+		return nil, bad
+	}
+	rid, err := strconv.ParseInt(string(val), 10, 64)
+	if err != nil {
+		return nil, bad
+	}
+	cursor.rid = rid
+	if typ, _ = tkn.Scan(); typ == ';' {
+		typ, _ = tkn.Scan()
+	}
+	if typ != 0 {
+		return nil, ailikeError{ParseError, "AFTER must be the last clause of a query"}
+	}
+	return cursor, nil
+}
+
+// Sets the cursor of keyset pagination, which requires the plan to return the
+// first records in the order of a single expression.
+func (p *LogicalPlan) setKeyset(after *keysetCursor) error {
+	if p.setOp != nil || len(p.orderByFields) != 1 || p.limit == nil || p.offset != nil {
+		return ailikeError{ParseError, "AFTER requires ORDER BY a single expression and LIMIT, without OFFSET"}
+	}
+	if len(p.aggs) > 0 || len(p.groupByFields) > 0 || p.distinct {
+		return ailikeError{ParseError, "AFTER cannot be used with aggregates or DISTINCT"}
+	}
+	p.after = after
+	return nil
+}
+
+// Returns the predicate satisfied by records that follow the cursor in the
+// order of key: key is after the cursor's value, or equal to it with a larger rid.
+func (k *keysetCursor) filter(key Expr, ascending bool) (PredicateExpr, error) {
+	valueType := IntType
+	if _, ok := k.value.(StringField); ok {
+		valueType = StringType
+	}
+	value := &ConstExpr{k.value, valueType}
+	op := OpGt
+	if !ascending {
+		op = OpLt
+	}
+	beyond, err := NewCompareExpr(key, op, value)
+	if err != nil {
+		return nil, err
+	}
+	tie, err := NewCompareExpr(key, OpEq, value)
+	if err != nil {
+		return nil, err
+	}
+	later, err := NewCompareExpr(&RidExpr{}, OpGt, &ConstExpr{IntField{k.rid}, IntType})
+	if err != nil {
+		return nil, err
+	}
+	return NewOrExpr(beyond, NewAndExpr(tie, later)), nil
+}
+
+// Adds pred to the filter at the top of op, so that a filtered table can still
+// be read by an index scan, or adds a filter if there is none.
+func addFilter(op Operator, pred PredicateExpr) (Operator, error) {
+	if f, ok := op.(*Filter); ok {
+		return NewFilter(NewAndExpr(f.pred, pred), f.child)
+	}
+	return NewFilter(pred, op)
+}
+
+// A common table expression, WITH name [(columns)] AS (query).
+type commonTableExpr struct {
+	name    string
+	columns []string
+	query   string
+}
+
+// Splits a query that starts with WITH into its common table expressions and
+// the statement that follows them, since the SQL parser does not support WITH.
+// Other queries are returned unchanged.
+func splitWith(query string) ([]commonTableExpr, string, error) {
+	tkn := sqlparser.NewStringTokenizer(query)
+	if typ, _ := tkn.Scan(); typ != sqlparser.WITH {
+		return nil, query, nil
+	}
+	// the position of the end of the last token that was scanned
+	end := func() int {
+		return min(tkn.Position-1, len(query))
+	}
+	var ctes []commonTableExpr
+	for {
+		typ, val := tkn.Scan()
+		if typ != sqlparser.ID {
+			return nil, "", ailikeError{ParseError, "expected the name of a common table expression"}
+		}
+		cte := commonTableExpr{name: strings.ToLower(string(val))}
+		for _, prev := range ctes {
+			if prev.name == cte.name {
+				return nil, "", ailikeError{ParseError, fmt.Sprintf("common table expression %s is defined more than once", cte.name)}
+			}
+		}
+		typ, _ = tkn.Scan()
+		if typ == '(' {
+			for typ != ')' {
+				typ, val = tkn.Scan()
+				if typ != sqlparser.ID {
+					return nil, "", ailikeError{ParseError, fmt.Sprintf("expected a column name of common table expression %s", cte.name)}
+				}
+				cte.columns = append(cte.columns, strings.ToLower(string(val)))
+				if typ, _ = tkn.Scan(); typ != ',' && typ != ')' {
+					return nil, "", ailikeError{ParseError, fmt.Sprintf("expected a column name of common table expression %s", cte.name)}
+				}
+			}
+			typ, _ = tkn.Scan()
+		}
+		if typ != sqlparser.AS {
+			return nil, "", ailikeError{ParseError, fmt.Sprintf("expected AS after common table expression %s", cte.name)}
+		}
+		if typ, _ = tkn.Scan(); typ != '(' {
+			return nil, "", ailikeError{ParseError, fmt.Sprintf("expected the query of common table expression %s in parentheses", cte.name)}
+		}
+		start := end()
+		for depth := 1; depth > 0; {
+			typ, _ = tkn.Scan()
+			switch typ {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			case 0, sqlparser.LEX_ERROR:
+				return nil, "", ailikeError{ParseError, fmt.Sprintf("unterminated query of common table expression %s", cte.name)}
+			}
+		}
+		cte.query = query[start : end()-1]
+		ctes = append(ctes, cte)
+		queryEnd := end()
+		if typ, _ = tkn.Scan(); typ != ',' {
+			return ctes, query[queryEnd:], nil
+		}
+	}
+}
+
+// Parses a query, which may contain set operations.  The SQL parser only supports
+// UNION, so INTERSECT and EXCEPT are replaced by UNION before parsing, and the
+// unions are then relabeled with the operations they replaced.  As in SQLite, set
+// operations have the same precedence and are evaluated left to right.
+func parseQuery(query string) (sqlparser.Statement, error) {
+	query, ops := splitSetOperations(query)
 	stmt, err := sqlparser.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	if err := labelSetOperations(stmt, ops); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// Replaces INTERSECT and EXCEPT in query with UNION, and returns the set operations
+// of the query in the order they appear.
+func splitSetOperations(query string) (string, []SetOperation) {
+	tkn := sqlparser.NewStringTokenizer(query)
+	var (
+		ops       []SetOperation
+		rewritten strings.Builder
+		copied    int // the end of the part of query that has been copied
+	)
+	for {
+		typ, val := tkn.Scan()
+		if typ == 0 || typ == sqlparser.LEX_ERROR {
+			break
+		}
+		if typ == sqlparser.UNION {
+			ops = append(ops, Union)
+			continue
+		}
+		if typ != sqlparser.ID {
+			continue
+		}
+		end := min(tkn.Position-1, len(query))
+		start := end - len(val)
+		// a quoted identifier is not a keyword
+		if start < 0 || query[start:end] != string(val) {
+			continue
+		}
+		for _, op := range []SetOperation{Intersect, Except} {
+			if strings.EqualFold(string(val), setOperationNames[op]) {
+				ops = append(ops, op)
+				rewritten.WriteString(query[copied:start])
+				rewritten.WriteString(setOperationNames[Union])
+				copied = end
+			}
+		}
+	}
+	if copied == 0 {
+		return query, ops
+	}
+	rewritten.WriteString(query[copied:])
+	return rewritten.String(), ops
+}
+
+// Sets the type of each union in stmt to the set operation it was parsed from,
+// given the set operations in the order they appear in the query.
+func labelSetOperations(stmt sqlparser.Statement, ops []SetOperation) error {
+	var unions []*sqlparser.Union
+	var inOrder func(node sqlparser.SQLNode)
+	inOrder = func(node sqlparser.SQLNode) {
+		switch node := node.(type) {
+		case *sqlparser.Union:
+			inOrder(node.Left)
+			unions = append(unions, node)
+			inOrder(node.Right)
+		case *sqlparser.ParenSelect:
+			inOrder(node.Select)
+		default:
+			// unions in subqueries
+			sqlparser.Walk(func(child sqlparser.SQLNode) (bool, error) {
+				if u, ok := child.(*sqlparser.Union); ok {
+					inOrder(u)
+					return false, nil
+				}
+				return true, nil
+			}, node)
+		}
+	}
+	inOrder(stmt)
+	if len(unions) != len(ops) {
+		return ailikeError{ParseError, "could not parse the set operations of the query"}
+	}
+	for i, u := range unions {
+		if ops[i] == Union {
+			continue
+		}
+		name := setOperationNames[ops[i]]
+		if u.Type == sqlparser.UnionAllStr {
+			name += " all"
+		}
+		u.Type = name
+	}
+	return nil
+}
+
+// Returns the first select of a set operation, or the select itself.
+func leftmostSelect(stmt sqlparser.SelectStatement) *sqlparser.Select {
+	for {
+		switch s := stmt.(type) {
+		case *sqlparser.Select:
+			return s
+		case *sqlparser.ParenSelect:
+			stmt = s.Select
+		case *sqlparser.Union:
+			stmt = s.Left
+		default:
+			return nil
+		}
+	}
+}
+
+// Parses the query of a common table expression, in which references to the
+// earlier expressions are replaced by their queries.
+func (cte *commonTableExpr) parse(earlier []commonTableExpr) (sqlparser.SelectStatement, error) {
+	stmt, err := parseQuery(cte.query)
+	if err != nil {
+		return nil, err
+	}
+	sel, ok := stmt.(sqlparser.SelectStatement)
+	if !ok {
+		return nil, ailikeError{ParseError, fmt.Sprintf("the query of common table expression %s must be a SELECT", cte.name)}
+	}
+	if len(cte.columns) > 0 {
+		// the column names rename the columns of the select list, which for a
+		// set operation are the columns of its leftmost select
+		s := leftmostSelect(sel)
+		if s == nil || len(s.SelectExprs) != len(cte.columns) {
+			return nil, ailikeError{ParseError, fmt.Sprintf("common table expression %s has %d column names, but its query does not return %d columns", cte.name, len(cte.columns), len(cte.columns))}
+		}
+		for i, e := range s.SelectExprs {
+			aliased, ok := e.(*sqlparser.AliasedExpr)
+			if !ok {
+				return nil, ailikeError{ParseError, fmt.Sprintf("common table expression %s cannot name the columns of *", cte.name)}
+			}
+			aliased.As = sqlparser.NewColIdent(cte.columns[i])
+		}
+	}
+	if err := inlineCTEs(sel, earlier); err != nil {
+		return nil, err
+	}
+	return sel, nil
+}
+
+// Replaces each table in stmt that refers to one of the common table expressions
+// with a subquery, aliased by the table's alias or the expression's name.  Each
+// reference is parsed separately, so that the subqueries can be planned
+// independently.
+func inlineCTEs(stmt sqlparser.SQLNode, ctes []commonTableExpr) error {
+	if len(ctes) == 0 {
+		return nil
+	}
+	var refs []*sqlparser.AliasedTableExpr
+	sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		if t, ok := node.(*sqlparser.AliasedTableExpr); ok {
+			refs = append(refs, t)
+		}
+		return true, nil
+	}, stmt)
+	for _, ref := range refs {
+		table, ok := ref.Expr.(sqlparser.TableName)
+		if !ok || !table.Qualifier.IsEmpty() {
+			continue
+		}
+		for i := range ctes {
+			if ctes[i].name != strings.ToLower(table.Name.String()) {
+				continue
+			}
+			sel, err := ctes[i].parse(ctes[:i])
+			if err != nil {
+				return err
+			}
+			if ref.As.IsEmpty() {
+				ref.As = sqlparser.NewTableIdent(ctes[i].name)
+			}
+			ref.Expr = &sqlparser.Subquery{Select: sel}
+		}
+	}
+	return nil
+}
+
+func parseUpdate(c *Catalog, updStmt *sqlparser.Update) (Operator, error) {
+	if len(updStmt.TableExprs) > 1 {
+		return nil, ailikeError{ParseError, "ailike does not supporting updating multiple tables"}
+	}
+	if updStmt.OrderBy != nil || updStmt.Limit != nil {
+		return nil, ailikeError{ParseError, "ailike does not support order by or limit in updates"}
+	}
+	tables, subplans, joins, _, err := parseFrom(c, updStmt.TableExprs[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(tables) != 1 || subplans != nil || joins != nil {
+		return nil, ailikeError{ParseError, "ailike does not supporting updating multiple tables"}
+	}
+	file := *tables[0].file
+	tableMap := make(map[string]*PlanNode)
+	tableMap[tables[0].tableName] = &PlanNode{file, file.Descriptor()}
+
+	var filters []*LogicalFilterNode
+	if updStmt.Where != nil {
+		filters, joins, err = parseWhere(c, subplans, tables, updStmt.Where.Expr)
+		if err != nil {
+			return nil, err
+		}
+		if joins != nil {
+			return nil, ailikeError{ParseError, "ailike does not supporting updating multiple tables"}
+		}
+	}
+	child, err := applyFilters(c, filters, file, tableMap)
+	if err != nil {
+		return nil, err
+	}
+
+	// the subqueries of the filters and of the new values run in the
+	// transaction of the update's input
+	var nodes []*LogicalSelectNode
+	for _, f := range filters {
+		nodes = append(nodes, f.pred)
+	}
+
+	desc := file.Descriptor()
+	setCols := make([]int, len(updStmt.Exprs))
+	setExprs := make([]Expr, len(updStmt.Exprs))
+	for i, upd := range updStmt.Exprs {
+		colName := strings.ToLower(sqlparser.String(upd.Name.Name))
+		col, err := findFieldInTd(FieldType{Fname: colName, Ftype: UnknownType}, desc)
+		if err != nil {
+			return nil, ailikeError{ParseError, fmt.Sprintf("no column '%s' to update", colName)}
+		}
+		for _, prev := range setCols[:i] {
+			if prev == col {
+				return nil, ailikeError{ParseError, fmt.Sprintf("column '%s' is assigned more than once", colName)}
+			}
+		}
+		setCols[i] = col
+		value, err := parseExpr(c, upd.Expr, "")
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, value)
+		if value.exprType == ExprConst {
+			setExprs[i] = typedLiteral(value.value, desc.Fields[col].Ftype)
+			continue
+		}
+		setExprs[i], _, err = value.generateExpr(c, desc, tableMap)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if subqueries := subqueryPlans(nodes...); len(subqueries) > 0 {
+		child = NewSubqueryOp(child, subqueries)
+	}
+	return NewUpdateOp(file, setCols, setExprs, child)
+}
+
+func Parse(c *Catalog, query string) (QueryType, Operator, error) {
+	if op, ok, err := parseAnalyze(c, query); ok {
+		if err != nil {
+			return UnknownQueryType, nil, err
+		}
+		return IteratorType, op, nil
+	}
+	if op, ok, err := parseVacuum(c, query); ok {
+		if err != nil {
+			return UnknownQueryType, nil, err
+		}
+		return IteratorType, op, nil
+	}
+	ctes, query, err := splitWith(query)
+	if err != nil {
+		return UnknownQueryType, nil, err
+	}
+	query, after, err := splitAfter(query)
+	if err != nil {
+		return UnknownQueryType, nil, err
+	}
+	stmt, err := parseQuery(query)
 	if err != nil {
 		fmt.Println("unknown query type check")
 		return UnknownQueryType, nil, err
 	}
+	if err := inlineCTEs(stmt, ctes); err != nil {
+		return UnknownQueryType, nil, err
+	}
+	if _, ok := stmt.(sqlparser.SelectStatement); after != nil && !ok {
+		return UnknownQueryType, nil, ailikeError{ParseError, "AFTER is only supported in queries"}
+	}
 	switch stmt := stmt.(type) {
-	case *sqlparser.Select:
-		plan, err := parseStatement(c, stmt)
+	case sqlparser.SelectStatement:
+		plan, err := parseSelectStatement(c, stmt)
 		if err != nil {
 			return UnknownQueryType, nil, err
 		}
+		if after != nil {
+			if err := plan.setKeyset(after); err != nil {
+				return UnknownQueryType, nil, err
+			}
+		}
 		op, err := makePhysicalPlan(c, plan)
 		if err != nil {
 			return UnknownQueryType, nil, err
@@ -1561,12 +4008,23 @@ func Parse(c *Catalog, query string) (QueryType, Operator, error) {
 			return UnknownQueryType, nil, err
 		}
 		return IteratorType, op, nil
+	case *sqlparser.Update:
+		op, err := parseUpdate(c, stmt)
+		if err != nil {
+			return UnknownQueryType, nil, err
+		}
+		return IteratorType, op, nil
 	case *sqlparser.Begin:
 		return BeginXactionType, nil, nil
 	case *sqlparser.Commit:
 		return CommitXactionType, nil, nil
 	case *sqlparser.Rollback:
 		return AbortXactionType, nil, nil
+	case *sqlparser.Set:
+		if err := processSet(c, stmt); err != nil {
+			return UnknownQueryType, nil, err
+		}
+		return SetQueryType, nil, nil
 	case *sqlparser.DDL:
 		qtype, err := processDDL(c, stmt)
 		if err != nil {
@@ -0,0 +1,496 @@
+package godb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PredicateExpr is a boolean expression, such as a WHERE clause.  Predicates
+// follow SQL's three-valued logic: a comparison with NULL is neither true nor
+// false but unknown, and EvalBool only reports true for predicates that are
+// true.  Used as an ordinary expression, a predicate evaluates to the int 1 if
+// it holds, 0 if it does not and NULL if it is unknown.
+type PredicateExpr interface {
+	Expr
+	EvalBool(t *Tuple) (bool, error)
+	evalLogic(t *Tuple) (logicValue, error)
+}
+
+// The truth value of a predicate under three-valued logic.
+type logicValue int
+
+const (
+	logicFalse logicValue = iota
+	logicUnknown
+	logicTrue
+)
+
+func boolToLogic(b bool) logicValue {
+	if b {
+		return logicTrue
+	}
+	return logicFalse
+}
+
+// Returns the negation of l; the negation of unknown is unknown.
+func (l logicValue) not() logicValue {
+	return logicTrue - l
+}
+
+var predicateType = FieldType{Fname: "predicate", Ftype: IntType}
+
+func boolToField(b bool) DBValue {
+	if b {
+		return IntField{1}
+	}
+	return IntField{0}
+}
+
+func logicToField(l logicValue) DBValue {
+	if l == logicUnknown {
+		return nil
+	}
+	return boolToField(l == logicTrue)
+}
+
+// Evaluates p as an ordinary expression.
+func evalPredicateExpr(p PredicateExpr, t *Tuple) (DBValue, error) {
+	l, err := p.evalLogic(t)
+	return logicToField(l), err
+}
+
+// Returns true if p is true for t; false and unknown predicates do not hold.
+func evalPredicateBool(p PredicateExpr, t *Tuple) (bool, error) {
+	l, err := p.evalLogic(t)
+	return l == logicTrue, err
+}
+
+// Returns the value of v as a float, if it is a number.
+func numericValue(v DBValue) (float64, bool) {
+	switch v := v.(type) {
+	case IntField:
+		return float64(v.Value), true
+	case FloatField:
+		return v.Value, true
+	}
+	return 0, false
+}
+
+// Returns the text of v, if it is a string.
+func stringValue(v DBValue) (string, bool) {
+	switch v := v.(type) {
+	case StringField:
+		return v.Value, true
+	case EmbeddedStringField:
+		return v.Value, true
+	}
+	return "", false
+}
+
+// Returns true if values of types t1 and t2 can be compared.  The NULL
+// literal has UnknownType, and can be compared to anything.
+func comparableTypes(t1 DBType, t2 DBType) bool {
+	if t1 == UnknownType || t2 == UnknownType {
+		return true
+	}
+	isNumeric := func(t DBType) bool { return t == IntType || t == FloatType }
+	isString := func(t DBType) bool { return t == StringType || t == EmbeddedStringType }
+	return (isNumeric(t1) && isNumeric(t2)) || (isString(t1) && isString(t2))
+}
+
+// Compares v1 to v2.  Ints and floats are compared with each other as numbers,
+// and strings and embedded strings are compared by their text.
+func compareValues(v1 DBValue, v2 DBValue, op BoolOp) (bool, error) {
+	if i1, ok := v1.(IntField); ok {
+		if i2, ok := v2.(IntField); ok {
+			return evalPred(i1.Value, i2.Value, op), nil
+		}
+	}
+	if n1, ok := numericValue(v1); ok {
+		if n2, ok := numericValue(v2); ok {
+			return evalPred(n1, n2, op), nil
+		}
+	}
+	if s1, ok := stringValue(v1); ok {
+		if s2, ok := stringValue(v2); ok {
+			return evalPred(s1, s2, op), nil
+		}
+	}
+	return false, ailikeError{TypeMismatchError, fmt.Sprintf("cannot compare %v to %v", v1, v2)}
+}
+
+// Returns the operator that gives the same result when its operands are swapped.
+func flipOp(op BoolOp) BoolOp {
+	switch op {
+	case OpGt:
+		return OpLt
+	case OpLt:
+		return OpGt
+	case OpGe:
+		return OpLe
+	case OpLe:
+		return OpGe
+	}
+	return op
+}
+
+// CompareExpr compares the values of two expressions, e.g. age > 30.
+type CompareExpr struct {
+	left  Expr
+	right Expr
+	op    BoolOp
+}
+
+func NewCompareExpr(left Expr, op BoolOp, right Expr) (*CompareExpr, error) {
+	lType, rType := left.GetExprType().Ftype, right.GetExprType().Ftype
+	if !comparableTypes(lType, rType) {
+		return nil, ailikeError{IncompatibleTypesError, fmt.Sprintf("cannot compare %s to %s", typeNames[lType], typeNames[rType])}
+	}
+	if op == OpLike && lType != StringType && lType != EmbeddedStringType {
+		return nil, ailikeError{IncompatibleTypesError, "LIKE can only be applied to strings"}
+	}
+	return &CompareExpr{left, right, op}, nil
+}
+
+func (e *CompareExpr) evalLogic(t *Tuple) (logicValue, error) {
+	v1, err := e.left.EvalExpr(t)
+	if err != nil {
+		return logicFalse, err
+	}
+	v2, err := e.right.EvalExpr(t)
+	if err != nil {
+		return logicFalse, err
+	}
+	if v1 == nil || v2 == nil {
+		return logicUnknown, nil
+	}
+	b, err := compareValues(v1, v2, e.op)
+	return boolToLogic(b), err
+}
+
+func (e *CompareExpr) EvalBool(t *Tuple) (bool, error) {
+	return evalPredicateBool(e, t)
+}
+
+func (e *CompareExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	return evalPredicateExpr(e, t)
+}
+
+func (e *CompareExpr) GetExprType() FieldType {
+	return predicateType
+}
+
+// AndExpr holds if all of its predicates hold.
+type AndExpr struct {
+	preds []PredicateExpr
+}
+
+// Returns the conjunction of preds, merging any that are themselves conjunctions.
+func NewAndExpr(preds ...PredicateExpr) PredicateExpr {
+	var flat []PredicateExpr
+	for _, p := range preds {
+		if and, ok := p.(*AndExpr); ok {
+			flat = append(flat, and.preds...)
+		} else {
+			flat = append(flat, p)
+		}
+	}
+	if len(flat) == 1 {
+		return flat[0]
+	}
+	return &AndExpr{flat}
+}
+
+// A conjunction is false if any of its predicates is false, and otherwise
+// unknown if any of them is unknown.
+func (e *AndExpr) evalLogic(t *Tuple) (logicValue, error) {
+	result := logicTrue
+	for _, p := range e.preds {
+		l, err := p.evalLogic(t)
+		if err != nil || l == logicFalse {
+			return logicFalse, err
+		}
+		result = min(result, l)
+	}
+	return result, nil
+}
+
+func (e *AndExpr) EvalBool(t *Tuple) (bool, error) {
+	return evalPredicateBool(e, t)
+}
+
+func (e *AndExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	return evalPredicateExpr(e, t)
+}
+
+func (e *AndExpr) GetExprType() FieldType {
+	return predicateType
+}
+
+// OrExpr holds if any of its predicates hold.
+type OrExpr struct {
+	preds []PredicateExpr
+}
+
+func NewOrExpr(preds ...PredicateExpr) *OrExpr {
+	return &OrExpr{preds}
+}
+
+// A disjunction is true if any of its predicates is true, and otherwise
+// unknown if any of them is unknown.
+func (e *OrExpr) evalLogic(t *Tuple) (logicValue, error) {
+	result := logicFalse
+	for _, p := range e.preds {
+		l, err := p.evalLogic(t)
+		if err != nil || l == logicTrue {
+			return l, err
+		}
+		result = max(result, l)
+	}
+	return result, nil
+}
+
+func (e *OrExpr) EvalBool(t *Tuple) (bool, error) {
+	return evalPredicateBool(e, t)
+}
+
+func (e *OrExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	return evalPredicateExpr(e, t)
+}
+
+func (e *OrExpr) GetExprType() FieldType {
+	return predicateType
+}
+
+// NotExpr holds if its predicate does not.
+type NotExpr struct {
+	pred PredicateExpr
+}
+
+func NewNotExpr(pred PredicateExpr) *NotExpr {
+	return &NotExpr{pred}
+}
+
+func (e *NotExpr) evalLogic(t *Tuple) (logicValue, error) {
+	l, err := e.pred.evalLogic(t)
+	if err != nil {
+		return logicFalse, err
+	}
+	return l.not(), nil
+}
+
+func (e *NotExpr) EvalBool(t *Tuple) (bool, error) {
+	return evalPredicateBool(e, t)
+}
+
+func (e *NotExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	return evalPredicateExpr(e, t)
+}
+
+func (e *NotExpr) GetExprType() FieldType {
+	return predicateType
+}
+
+// InExpr holds if the value of an expression is equal to one of a list of
+// values, e.g. sentiment IN ('positive', 'neutral'), or if negated, to none of them.
+type InExpr struct {
+	left    Expr
+	list    []Expr
+	negated bool
+}
+
+func NewInExpr(left Expr, list []Expr, negated bool) (*InExpr, error) {
+	for _, e := range list {
+		if !comparableTypes(left.GetExprType().Ftype, e.GetExprType().Ftype) {
+			return nil, ailikeError{IncompatibleTypesError, fmt.Sprintf("cannot compare %s to %s in IN list",
+				typeNames[left.GetExprType().Ftype], typeNames[e.GetExprType().Ftype])}
+		}
+	}
+	return &InExpr{left, list, negated}, nil
+}
+
+// As in SQL, x IN (...) is unknown if x is NULL, or if x matches none of the
+// values and one of them is NULL.
+func (e *InExpr) evalLogic(t *Tuple) (logicValue, error) {
+	v, err := e.left.EvalExpr(t)
+	if err != nil {
+		return logicFalse, err
+	}
+	if v == nil {
+		return logicUnknown, nil
+	}
+	result := logicFalse
+	for _, item := range e.list {
+		iv, err := item.EvalExpr(t)
+		if err != nil {
+			return logicFalse, err
+		}
+		if iv == nil {
+			result = logicUnknown
+			continue
+		}
+		eq, err := compareValues(v, iv, OpEq)
+		if err != nil {
+			return logicFalse, err
+		}
+		if eq {
+			result = logicTrue
+			break
+		}
+	}
+	if e.negated {
+		return result.not(), nil
+	}
+	return result, nil
+}
+
+func (e *InExpr) EvalBool(t *Tuple) (bool, error) {
+	return evalPredicateBool(e, t)
+}
+
+func (e *InExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	return evalPredicateExpr(e, t)
+}
+
+func (e *InExpr) GetExprType() FieldType {
+	return predicateType
+}
+
+// BetweenExpr holds if the value of an expression is within an inclusive range,
+// e.g. age BETWEEN 20 AND 30, or if negated, outside of it.
+type BetweenExpr struct {
+	val     Expr
+	low     Expr
+	high    Expr
+	negated bool
+}
+
+func NewBetweenExpr(val Expr, low Expr, high Expr, negated bool) (*BetweenExpr, error) {
+	for _, bound := range []Expr{low, high} {
+		if !comparableTypes(val.GetExprType().Ftype, bound.GetExprType().Ftype) {
+			return nil, ailikeError{IncompatibleTypesError, fmt.Sprintf("cannot compare %s to %s in BETWEEN",
+				typeNames[val.GetExprType().Ftype], typeNames[bound.GetExprType().Ftype])}
+		}
+	}
+	return &BetweenExpr{val, low, high, negated}, nil
+}
+
+// x BETWEEN low AND high is evaluated as x >= low AND x <= high.
+func (e *BetweenExpr) evalLogic(t *Tuple) (logicValue, error) {
+	var vals [3]DBValue
+	for i, ex := range []Expr{e.val, e.low, e.high} {
+		v, err := ex.EvalExpr(t)
+		if err != nil {
+			return logicFalse, err
+		}
+		vals[i] = v
+	}
+	bound := func(v DBValue, op BoolOp) (logicValue, error) {
+		if vals[0] == nil || v == nil {
+			return logicUnknown, nil
+		}
+		b, err := compareValues(vals[0], v, op)
+		return boolToLogic(b), err
+	}
+	aboveLow, err := bound(vals[1], OpGe)
+	if err != nil {
+		return logicFalse, err
+	}
+	belowHigh, err := bound(vals[2], OpLe)
+	if err != nil {
+		return logicFalse, err
+	}
+	result := min(aboveLow, belowHigh)
+	if e.negated {
+		return result.not(), nil
+	}
+	return result, nil
+}
+
+func (e *BetweenExpr) EvalBool(t *Tuple) (bool, error) {
+	return evalPredicateBool(e, t)
+}
+
+func (e *BetweenExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	return evalPredicateExpr(e, t)
+}
+
+func (e *BetweenExpr) GetExprType() FieldType {
+	return predicateType
+}
+
+// IsNullExpr holds if an expression has no value, or if negated, if it has one.
+type IsNullExpr struct {
+	expr    Expr
+	negated bool
+}
+
+func NewIsNullExpr(expr Expr, negated bool) *IsNullExpr {
+	return &IsNullExpr{expr, negated}
+}
+
+// IS [NOT] NULL is never unknown.
+func (e *IsNullExpr) evalLogic(t *Tuple) (logicValue, error) {
+	v, err := e.expr.EvalExpr(t)
+	if err != nil {
+		return logicFalse, err
+	}
+	return boolToLogic((v == nil) != e.negated), nil
+}
+
+func (e *IsNullExpr) EvalBool(t *Tuple) (bool, error) {
+	return evalPredicateBool(e, t)
+}
+
+func (e *IsNullExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	return evalPredicateExpr(e, t)
+}
+
+func (e *IsNullExpr) GetExprType() FieldType {
+	return predicateType
+}
+
+// Returns a readable form of a predicate, for printing query plans.
+func predicateToStr(p PredicateExpr) string {
+	join := func(preds []PredicateExpr, sep string) string {
+		strs := make([]string, len(preds))
+		for i, sub := range preds {
+			strs[i] = predicateToStr(sub)
+			if _, ok := sub.(*CompareExpr); !ok && len(preds) > 1 {
+				strs[i] = "(" + strs[i] + ")"
+			}
+		}
+		return strings.Join(strs, sep)
+	}
+	not := func(negated bool) string {
+		if negated {
+			return "NOT "
+		}
+		return ""
+	}
+	switch p := p.(type) {
+	case *CompareExpr:
+		return fmt.Sprintf("%s %s %s", exprToStr(p.left), strings.TrimSpace(opToStr(p.op)), exprToStr(p.right))
+	case *AndExpr:
+		return join(p.preds, " AND ")
+	case *OrExpr:
+		return join(p.preds, " OR ")
+	case *NotExpr:
+		return fmt.Sprintf("NOT (%s)", predicateToStr(p.pred))
+	case *InExpr:
+		items := make([]string, len(p.list))
+		for i, item := range p.list {
+			items[i] = exprToStr(item)
+		}
+		return fmt.Sprintf("%s %sIN (%s)", exprToStr(p.left), not(p.negated), strings.Join(items, ", "))
+	case *BetweenExpr:
+		return fmt.Sprintf("%s %sBETWEEN %s AND %s", exprToStr(p.val), not(p.negated), exprToStr(p.low), exprToStr(p.high))
+	case *IsNullExpr:
+		return fmt.Sprintf("%s IS %sNULL", exprToStr(p.expr), not(p.negated))
+	case *ExistsExpr:
+		return "EXISTS (subquery)"
+	case *InSubqueryExpr:
+		return fmt.Sprintf("%s %sIN (subquery)", exprToStr(p.left), not(p.negated))
+	}
+	return fmt.Sprintf("%+v", p)
+}
@@ -0,0 +1,320 @@
+package godb
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestPredicateExprs(t *testing.T) {
+	_, t1, t2, _, _, _ := makeTestVars()
+	name := &FieldExpr{FieldType{"name", "", StringType}}
+	age := &FieldExpr{FieldType{"age", "", IntType}}
+	intConst := func(v int64) Expr { return &ConstExpr{IntField{v}, IntType} }
+	strConst := func(v string) Expr { return &ConstExpr{StringField{v}, StringType} }
+
+	over30, err := NewCompareExpr(age, OpGt, intConst(30))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	isSam, err := NewCompareExpr(name, OpEq, strConst("sam"))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	under25point5, err := NewCompareExpr(age, OpLt, &ConstExpr{FloatField{25.5}, FloatType})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	jones, err := NewCompareExpr(name, OpLike, strConst("%jones"))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	inList, err := NewInExpr(name, []Expr{strConst("bob"), strConst("sam")}, false)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	notInList, err := NewInExpr(age, []Expr{intConst(25), intConst(26)}, true)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	between, err := NewBetweenExpr(age, intConst(20), intConst(25), false)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	notBetween, err := NewBetweenExpr(age, intConst(20), intConst(25), true)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	for _, tc := range []struct {
+		pred     PredicateExpr
+		expected [2]bool // for t1 (sam, 25) and t2 (george jones, 999)
+	}{
+		{over30, [2]bool{false, true}},
+		{isSam, [2]bool{true, false}},
+		{under25point5, [2]bool{true, false}},
+		{jones, [2]bool{false, true}},
+		{NewAndExpr(over30, jones), [2]bool{false, true}},
+		{NewAndExpr(over30, isSam), [2]bool{false, false}},
+		{NewOrExpr(over30, isSam), [2]bool{true, true}},
+		{NewNotExpr(isSam), [2]bool{false, true}},
+		{inList, [2]bool{true, false}},
+		{notInList, [2]bool{false, true}},
+		{between, [2]bool{true, false}},
+		{notBetween, [2]bool{false, true}},
+		{NewIsNullExpr(age, false), [2]bool{false, false}},
+		{NewIsNullExpr(age, true), [2]bool{true, true}},
+	} {
+		for i, tup := range []*Tuple{&t1, &t2} {
+			got, err := tc.pred.EvalBool(tup)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if got != tc.expected[i] {
+				t.Errorf("expected %s to be %v for %v, got %v", predicateToStr(tc.pred), tc.expected[i], tup.Fields, got)
+			}
+			v, _ := tc.pred.EvalExpr(tup)
+			if (v.(IntField).Value == 1) != got {
+				t.Errorf("expected %s to evaluate to 1 when it holds", predicateToStr(tc.pred))
+			}
+		}
+	}
+
+	// conjunctions of conjunctions are flattened
+	if and := NewAndExpr(NewAndExpr(over30, isSam), jones).(*AndExpr); len(and.preds) != 3 {
+		t.Errorf("expected a flat conjunction of 3 predicates, got %d", len(and.preds))
+	}
+	if _, err := NewCompareExpr(age, OpEq, strConst("sam")); err == nil {
+		t.Errorf("expected error comparing an int to a string")
+	}
+	if _, err := NewCompareExpr(age, OpLike, intConst(1)); err == nil {
+		t.Errorf("expected error applying LIKE to ints")
+	}
+}
+
+// Runs a query over the test catalog and returns the sorted values of its first column.
+func sortedIntColumn(t *testing.T, c *Catalog, bp *BufferPool, sql string) (Operator, []int64) {
+	plan, vals := runIntColumnQuery(t, c, bp, sql, 0)
+	sort.Slice(vals, func(i, j int) bool { return vals[i] < vals[j] })
+	return plan, vals
+}
+
+func TestPredicateParse(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+
+	for _, tc := range []struct {
+		sql      string
+		expected int
+	}{
+		{"select r_id from r where r_id < 10 or r_id >= 495", 15},
+		{"select r_id from r where not (r_id < 490)", 10},
+		{"select r_id from r where r_id in (1, 2, 3, 1000)", 3},
+		{"select r_id from r where r_id between 10 and 19 and s_id not in (10, 11)", 8},
+		{"select r_id from r where r_id not between 5 and 499", 5},
+		{"select r_id from r where r_id is not null", 500},
+		{"select r_id from r where r_id is null", 0},
+		{"select r_id from r where r_id < 2.5", 3},
+		{"select r_id from r where r_id > -0.5 and r_id < 1", 1},
+		{"select r_id from r where (r_id < 100 and s_id = 3) or (r_id >= 400 and not s_id < 49)", 4},
+		{"select t_id from t where name in ('t1', 't3') or name like 't4'", 3},
+		{"select t_id from t where name not like 't%'", 0},
+		// comparisons between tables other than equality apply to the joined rows
+		{"select r.r_id from r join s on r.s_id = s.s_id where r.r_id < 5 or s.t_id = 4", 104},
+		{"select r.r_id from r join s on r.s_id = s.s_id and r.r_id <= s.t_id", 5},
+	} {
+		_, vals := sortedIntColumn(t, c, bp, tc.sql)
+		if len(vals) != tc.expected {
+			t.Errorf("expected %d results for %s, got %d", tc.expected, tc.sql, len(vals))
+		}
+	}
+
+	// every predicate on a single table is applied in one filter directly above it
+	plan, rows := queryRows(t, c, bp, "select r.r_id from r join s on r.s_id = s.s_id where r.r_id < 100 and s.t_id in (1, 2) and r.s_id > 3")
+	join := plan.(*Project).child.(*EqualityJoin[int64])
+	left, ok := (*join.left).(*Filter)
+	if !ok {
+		t.Fatalf("expected the filters on r to be applied below the join")
+	}
+	if _, ok := left.child.(*HeapFile); !ok {
+		t.Errorf("expected the filter on r to read the table directly")
+	}
+	if and, ok := left.pred.(*AndExpr); !ok || len(and.preds) != 2 {
+		t.Errorf("expected both predicates on r in one filter, got %s", predicateToStr(left.pred))
+	}
+	if _, ok := (*join.right).(*Filter); !ok {
+		t.Errorf("expected the filter on s to be applied below the join")
+	}
+	if len(rows) != 36 {
+		t.Errorf("expected 36 results, got %d", len(rows))
+	}
+
+	for _, sql := range []string{
+		"select r_id from r where r_id = 'abc'",
+		"select r_id from r where r_id in ('a', 'b')",
+		"select r_id from r where r_id is true",
+	} {
+		if _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected error parsing %s", sql)
+		}
+	}
+}
+
+func TestPredicateDelete(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	if _, rows := queryRows(t, c, bp, "delete from r where r_id < 10 or r_id between 490 and 499"); len(rows) != 1 {
+		t.Fatalf("expected delete to return a count, got %d rows", len(rows))
+	}
+	_, vals := sortedIntColumn(t, c, bp, "select r_id from r")
+	if len(vals) != 480 || vals[0] != 10 || vals[len(vals)-1] != 489 {
+		t.Errorf("expected records 10 to 489 to remain, got %d records", len(vals))
+	}
+}
+
+func TestSimilarityPredicate(t *testing.T) {
+	c, hf, bp, dir := makeTweetsTestCatalog(t)
+	tweets := readFirstTweets(t, hf, bp, 1)
+	startFakeEmbeddingServer(t, tweets[0].Fields[2].(EmbeddedStringField).Emb)
+
+	// a similarity can be compared to a float literal
+	_, dists := runIntColumnQuery(t, c, bp, "select content ailike 'query' d from tweets_test", 0)
+	sort.Slice(dists, func(i, j int) bool { return dists[i] < dists[j] })
+	median := dists[len(dists)/2]
+	expected := 0
+	for _, d := range dists {
+		if d <= median {
+			expected++
+		}
+	}
+	_, ids := runIntColumnQuery(t, c, bp, fmt.Sprintf("select tweet_id from tweets_test where content ailike 'query' < %.1f", float64(median)+0.5), 0)
+	if len(ids) != expected {
+		t.Errorf("expected %d tweets within the similarity threshold, got %d", expected, len(ids))
+	}
+
+	// with a vector index, filters are checked on the candidates found by the index
+	_, err := ConstructNNIndexFileFromHeapFile(hf, "content", 10, true, dir, "tweets_test", bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	sql := "select tweet_id, sentiment, content ailike 'query' d from tweets_test where sentiment = 'worry' or sentiment = 'love' order by d limit 5"
+	_, plan, err := Parse(c, sql)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !planContains(plan, &NNScan{}) {
+		t.Fatalf("expected the filtered query to use the vector index")
+	}
+	scan := plan.(*LimitOp).child.(*OrderBy).child.(*Project).child.(*NNScan)
+	if scan.filter == nil {
+		t.Fatalf("expected the filter to be pushed into the index scan")
+	}
+	tid := bp.Transactions().Begin()
+	defer tid.Commit()
+	iter, err := plan.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	cnt := 0
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if s := tup.Fields[1].(StringField).Value; s != "worry" && s != "love" {
+			t.Errorf("expected only tweets expressing worry or love, got %v", tup.Fields[1])
+		}
+		cnt++
+	}
+	if cnt != 5 {
+		t.Errorf("expected 5 results, got %d", cnt)
+	}
+}
+
+func TestPredicateNulls(t *testing.T) {
+	td, _, _, _, _, _ := makeTestVars()
+	noAge := &Tuple{Desc: td, Fields: []DBValue{StringField{"sam"}, nil}}
+	age := &FieldExpr{FieldType{"age", "", IntType}}
+	name := &FieldExpr{FieldType{"name", "", StringType}}
+	intConst := func(v int64) Expr { return &ConstExpr{IntField{v}, IntType} }
+	null := &ConstExpr{nil, UnknownType}
+
+	over30, _ := NewCompareExpr(age, OpGt, intConst(30))
+	isSam, _ := NewCompareExpr(name, OpEq, &ConstExpr{StringField{"sam"}, StringType})
+	isBob, _ := NewCompareExpr(name, OpEq, &ConstExpr{StringField{"bob"}, StringType})
+	eqNull, err := NewCompareExpr(name, OpEq, null)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	inList, _ := NewInExpr(age, []Expr{intConst(1), intConst(2)}, false)
+	notInWithNull, _ := NewInExpr(name, []Expr{&ConstExpr{StringField{"bob"}, StringType}, null}, true)
+	inWithNull, _ := NewInExpr(name, []Expr{null, &ConstExpr{StringField{"sam"}, StringType}}, false)
+	between, _ := NewBetweenExpr(age, intConst(20), intConst(30), false)
+
+	for _, tc := range []struct {
+		pred     PredicateExpr
+		expected logicValue
+	}{
+		{over30, logicUnknown},
+		{NewNotExpr(over30), logicUnknown},
+		{NewAndExpr(over30, isSam), logicUnknown},
+		{NewAndExpr(over30, isBob), logicFalse},
+		{NewOrExpr(over30, isSam), logicTrue},
+		{NewOrExpr(over30, isBob), logicUnknown},
+		{eqNull, logicUnknown},
+		{inList, logicUnknown},
+		{notInWithNull, logicUnknown},
+		{inWithNull, logicTrue},
+		{between, logicUnknown},
+		{NewNotExpr(between), logicUnknown},
+		{NewIsNullExpr(age, false), logicTrue},
+		{NewIsNullExpr(age, true), logicFalse},
+		{NewIsNullExpr(over30, false), logicTrue},
+	} {
+		got, err := tc.pred.evalLogic(noAge)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if got != tc.expected {
+			t.Errorf("expected %s to be %v, got %v", predicateToStr(tc.pred), tc.expected, got)
+		}
+		if b, _ := tc.pred.EvalBool(noAge); b != (tc.expected == logicTrue) {
+			t.Errorf("expected %s to hold only if it is true", predicateToStr(tc.pred))
+		}
+		if v, _ := tc.pred.EvalExpr(noAge); (v == nil) != (tc.expected == logicUnknown) {
+			t.Errorf("expected %s to evaluate to NULL only if it is unknown, got %v", predicateToStr(tc.pred), v)
+		}
+	}
+
+	// functions of NULL are NULL, rather than panicking
+	var ageArg, oneArg Expr = age, intConst(1)
+	plusOne := &FuncExpr{op: "+", args: []*Expr{&ageArg, &oneArg}}
+	if v, err := plusOne.EvalExpr(noAge); err != nil || v != nil {
+		t.Errorf("expected NULL + 1 to be NULL, got %v, %v", v, err)
+	}
+}
+
+func TestNullPredicateParse(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	_, counts := runIntColumnQuery(t, c, bp, "update r set s_id = null where r_id < 100", 0)
+	if len(counts) != 1 || counts[0] != 100 {
+		t.Fatalf("expected update to report 100 updated records, got %v", counts)
+	}
+	for _, tc := range []struct {
+		sql      string
+		expected int
+	}{
+		{"select r_id from r where s_id is null", 100},
+		{"select r_id from r where s_id is not null", 400},
+		{"select r_id from r where s_id < 10", 80},
+		{"select r_id from r where not (s_id < 10)", 320},
+		{"select r_id from r where s_id < 10 or r_id < 50", 130},
+		{"select r_id from r where s_id = null", 0},
+		{"select r_id from r where s_id not in (1, 2)", 384},
+		{"select r_id from r where s_id + 1 is null", 100},
+		// rows with NULL join keys match nothing
+		{"select r.r_id from r join s on r.s_id = s.s_id", 400},
+	} {
+		_, vals := sortedIntColumn(t, c, bp, tc.sql)
+		if len(vals) != tc.expected {
+			t.Errorf("expected %d results for %s, got %d", tc.expected, tc.sql, len(vals))
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package godb
+
+import (
+	"sync"
+)
+
+// The buffer pool reads pages ahead of the scans that will use them, so that
+// their I/O overlaps with the scans' work on the pages before them: a
+// sequential scan of a [HeapFile] asks for the next pages of the file, and an
+// [NNScan] for all the data pages of the clusters it probes, which it knows
+// before it reads any of them.  The pages are read by a pool of worker
+// goroutines, outside the buffer pool's mutex, which start as pages are asked
+// for and exit once none are left to read.
+//
+// Prefetching takes no locks: it only brings pages into the cache, and
+// transactions lock them as they read them, as they would otherwise.  Pages
+// read ahead never evict pinned or dirty pages, and no more than a share of the
+// buffer pool holds pages read ahead that have not been used yet, so a scan
+// cannot flood the buffer pool with pages it may never read.
+type prefetcher struct {
+	workers  int // the most workers reading pages at once; 0 disables prefetching
+	distance int // the number of pages a sequential scan reads ahead
+	running  int
+	queue    []prefetchRequest
+	// the pages being read by workers; pages are removed once they are read,
+	// and when the pages a worker reads may no longer match the file, so that
+	// the worker drops them
+	inflight map[BufferPoolKey]bool
+	// signalled when workers finish reading pages
+	done *sync.Cond
+	// the pages read ahead that have not been used yet
+	unused map[BufferPoolKey]bool
+}
+
+type prefetchRequest struct {
+	file   DBFile
+	pageNo int
+}
+
+// The number of workers that read pages ahead for new buffer pools.
+const DEFAULT_PREFETCH_WORKERS = 4
+
+// The number of pages a sequential scan reads ahead in new buffer pools.
+const DEFAULT_PREFETCH_DISTANCE = 8
+
+// The share of the buffer pool that pages read ahead but not yet used may
+// take.
+const PREFETCH_SHARE = 0.25
+
+func newPrefetcher(mutex *sync.Mutex) *prefetcher {
+	return &prefetcher{
+		workers:  DEFAULT_PREFETCH_WORKERS,
+		distance: DEFAULT_PREFETCH_DISTANCE,
+		inflight: make(map[BufferPoolKey]bool),
+		done:     sync.NewCond(mutex),
+		unused:   make(map[BufferPoolKey]bool),
+	}
+}
+
+// Sets the number of workers that read pages ahead, and the number of pages a
+// sequential scan reads ahead.  With no workers, pages are not read ahead.
+func (bp *BufferPool) SetPrefetch(workers int, distance int) {
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	bp.prefetch.workers = max(0, workers)
+	bp.prefetch.distance = max(0, distance)
+	if bp.prefetch.workers == 0 {
+		bp.prefetch.queue = nil
+	}
+}
+
+// Returns the number of pages a sequential scan reads ahead, or 0 if pages are
+// not read ahead.
+func (bp *BufferPool) prefetchDistance() int {
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	if bp.prefetch.workers == 0 {
+		return 0
+	}
+	return bp.prefetch.distance
+}
+
+// Asks for the given pages of file to be read into the buffer pool, in the
+// order given, starting workers to read them if fewer than the maximum are
+// running.  Returns without waiting for them to be read.
+func (bp *BufferPool) prefetchPages(file DBFile, pageNos []int) {
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	pf := bp.prefetch
+	if pf.workers == 0 {
+		return
+	}
+	for _, pageNo := range pageNos {
+		pf.queue = append(pf.queue, prefetchRequest{file, pageNo})
+	}
+	for pf.running < pf.workers && pf.running < len(pf.queue) {
+		pf.running++
+		go bp.prefetchWorker()
+	}
+}
+
+// Reads the pages asked for until none are left.
+func (bp *BufferPool) prefetchWorker() {
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	pf := bp.prefetch
+	for len(pf.queue) > 0 {
+		req := pf.queue[0]
+		pf.queue = pf.queue[1:]
+		key := req.file.pageKey(req.pageNo)
+		if _, ok := bp.pageMap[key]; ok || pf.inflight[key] || !bp.hasPrefetchRoom() {
+			continue
+		}
+		pf.inflight[key] = true
+		bp.mutex.Unlock()
+		page, err := req.file.readPage(req.pageNo)
+		bp.mutex.Lock()
+		if !pf.inflight[key] {
+			pf.done.Broadcast()
+			continue
+		}
+		delete(pf.inflight, key)
+		if err == nil && bp.makePrefetchRoom() {
+			bp.pageMap[key] = *page
+			bp.replacer.admit(key)
+			pf.unused[key] = true
+			bp.stats.Prefetches++
+		}
+		pf.done.Broadcast()
+	}
+	pf.running--
+}
+
+// Returns true if fewer pages read ahead are unused than the buffer pool
+// allows.  Must be called with the mutex held.
+func (bp *BufferPool) hasPrefetchRoom() bool {
+	return len(bp.prefetch.unused) < max(1, int(PREFETCH_SHARE*float64(bp.numPages)))
+}
+
+// Makes room for a page read ahead, evicting a page that is neither pinned nor
+// dirty if the buffer pool is full.  Returns false if there is no room for it.
+// Must be called with the mutex held.
+func (bp *BufferPool) makePrefetchRoom() bool {
+	if !bp.hasPrefetchRoom() {
+		return false
+	}
+	if len(bp.pageMap) < bp.numPages {
+		return true
+	}
+	key, ok := bp.replacer.victim(func(key BufferPoolKey) bool {
+		page, ok := bp.pageMap[key]
+		return ok && bp.pins[key] == 0 && !page.isDirty()
+	})
+	if !ok {
+		return false
+	}
+	delete(bp.pageMap, key)
+	delete(bp.prefetch.unused, key)
+	bp.stats.Evictions++
+	return true
+}
+
+// Waits for a worker reading the page with the given key, if there is one, so
+// that the page is not read twice.  Must be called with the mutex held.
+func (bp *BufferPool) awaitPrefetch(key BufferPoolKey) {
+	for bp.prefetch.inflight[key] {
+		bp.prefetch.done.Wait()
+	}
+}
+
+// Records a use of a cached page, which is no longer unused if it was read
+// ahead.  Must be called with the mutex held.
+func (bp *BufferPool) usePrefetched(key BufferPoolKey) {
+	if bp.prefetch.unused[key] {
+		delete(bp.prefetch.unused, key)
+		bp.stats.PrefetchHits++
+	}
+}
+
+// Drops the pages being read ahead of the files for which drop returns true,
+// or of all files if drop is nil, since the files may have been changed on
+// disk since they were read.  Must be called with the mutex held.
+func (bp *BufferPool) cancelPrefetches(drop func(fileName string) bool) {
+	pf := bp.prefetch
+	queue := pf.queue[:0]
+	for _, req := range pf.queue {
+		if drop != nil && !drop(req.file.pageKey(req.pageNo).getFileName()) {
+			queue = append(queue, req)
+		}
+	}
+	pf.queue = queue
+	for key := range pf.inflight {
+		if drop == nil || drop(key.getFileName()) {
+			delete(pf.inflight, key)
+		}
+	}
+	pf.done.Broadcast()
+}
@@ -0,0 +1,114 @@
+package godb
+
+import (
+	"testing"
+	"time"
+)
+
+// Returns a heap file of numPages pages, read through a new buffer pool of
+// poolPages pages, and the number of tuples in it.
+func makePrefetchTestFile(t *testing.T, numPages int, poolPages int) (*HeapFile, *BufferPool, int) {
+	td, t1, _, hf, bp, tid := makeTestVars()
+	tid.Commit()
+	n := fillPages(t, hf, bp, numPages, func(int) *Tuple { return &t1 })
+	pool := NewBufferPool(poolPages)
+	file, err := NewHeapFile(hf.fileName, &td, pool)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return file, pool, n
+}
+
+// Waits for the workers of bp to read the pages asked for.
+func waitForPrefetches(t *testing.T, bp *BufferPool) {
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(time.Millisecond) {
+		bp.mutex.Lock()
+		idle := bp.prefetch.running == 0
+		bp.mutex.Unlock()
+		if idle {
+			return
+		}
+	}
+	t.Fatalf("expected the pages to be read ahead")
+}
+
+func TestPrefetchSequentialScan(t *testing.T) {
+	hf, bp, numTuples := makePrefetchTestFile(t, 12, 20)
+	bp.SetPrefetch(2, 4)
+	tid := bp.Transactions().Begin()
+	iter, err := hf.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	first, err := iter()
+	if err != nil || first == nil {
+		t.Fatalf("expected a tuple, got %v", err)
+	}
+	// the four pages after the first are read ahead of the scan
+	waitForPrefetches(t, bp)
+	if stats := bp.Stats(); stats.Prefetches != 4 || stats.Misses != 1 {
+		t.Errorf("expected 4 pages to be read ahead, got %+v", stats)
+	}
+	for _, pageNo := range []int{1, 4} {
+		if !bp.hasPageCached(hf, pageNo, tid, ReadPerm) {
+			t.Errorf("expected page %d to be read ahead", pageNo)
+		}
+	}
+	n := 1
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		n++
+	}
+	tid.Commit()
+	if n != numTuples {
+		t.Errorf("expected the scan to return %d tuples, got %d", numTuples, n)
+	}
+	if stats := bp.Stats(); stats.PrefetchHits < 4 || stats.Hits+stats.Misses != int64(hf.NumPages()) {
+		t.Errorf("expected the pages read ahead to be used, got %+v", stats)
+	}
+}
+
+func TestPrefetchMemoryLimit(t *testing.T) {
+	hf, bp, _ := makePrefetchTestFile(t, 12, 8)
+	bp.prefetchPages(hf, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+	waitForPrefetches(t, bp)
+	// only a quarter of the buffer pool holds pages read ahead but not used
+	if stats := bp.Stats(); stats.Prefetches != 2 || len(bp.pageMap) != 2 {
+		t.Errorf("expected 2 pages to be read ahead, got %+v", stats)
+	}
+
+	// pages read ahead do not evict pinned pages
+	tid := bp.Transactions().Begin()
+	for pageNo := 0; pageNo < 8; pageNo++ {
+		if _, err := hf.getHeapPage(pageNo, tid, ReadPerm); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	bp.prefetchPages(hf, []int{8, 9, 10, 11})
+	waitForPrefetches(t, bp)
+	if bp.hasPageCached(hf, 8, tid, ReadPerm) {
+		t.Errorf("expected a page read ahead not to evict a pinned page")
+	}
+	tid.Commit()
+}
+
+func TestPrefetchDisabled(t *testing.T) {
+	hf, bp, _ := makePrefetchTestFile(t, 4, 20)
+	bp.SetPrefetch(0, DEFAULT_PREFETCH_DISTANCE)
+	tid := bp.Transactions().Begin()
+	iter, err := hf.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	tid.Commit()
+	if stats := bp.Stats(); stats.Prefetches != 0 || stats.Misses != 4 {
+		t.Errorf("expected no pages to be read ahead, got %+v", stats)
+	}
+}
@@ -42,7 +42,7 @@ func (p *Project) Descriptor() *TupleDesc {
 // To implement this you will need to record in some data structure with the
 // distinct tuples seen so far.  Note that support for the distinct keyword is
 // optional as specified in the lab 2 assignment.
-func (p *Project) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+func (p *Project) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
 	childIter, err := p.child.Iterator(tid)
 	if err != nil {
 		return nil, err
@@ -76,3 +76,48 @@ func (p *Project) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
 		return nil, nil
 	}, nil
 }
+
+// Projects the child's tuples a block at a time, evaluating each expression
+// over the whole block, so that distance functions are computed by batch
+// kernels.
+func (p *Project) batchIterator(tid *Transaction) (func() ([]*Tuple, error), error) {
+	batches, err := batchesOf(p.child, tid)
+	if err != nil {
+		return nil, err
+	}
+	desc := *p.Descriptor()
+	seen := make(map[any]bool)
+	return func() ([]*Tuple, error) {
+		for {
+			block, err := batches()
+			if err != nil || block == nil {
+				return nil, err
+			}
+			columns := make([][]DBValue, len(p.selectFields))
+			for i, expr := range p.selectFields {
+				if columns[i], err = evalBatch(expr, block); err != nil {
+					return nil, err
+				}
+			}
+			projected := make([]*Tuple, 0, len(block))
+			for j := range block {
+				fields := make([]DBValue, len(p.selectFields))
+				for i := range fields {
+					fields[i] = columns[i][j]
+				}
+				pt := &Tuple{Desc: desc, Fields: fields, Rid: nil}
+				if p.distinct {
+					tk := pt.tupleKey()
+					if seen[tk] {
+						continue
+					}
+					seen[tk] = true
+				}
+				projected = append(projected, pt)
+			}
+			if len(projected) > 0 {
+				return projected, nil
+			}
+		}
+	}, nil
+}
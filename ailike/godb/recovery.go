@@ -0,0 +1,180 @@
+package godb
+
+// Recovers the database from the log, which must not be in use, and then
+// empties it.  Recovery follows ARIES:
+//
+//   - Analysis scans the log from the last checkpoint to find the transactions
+//     that were active at the crash, and the pages that may not have been
+//     written since they were changed.
+//   - Redo repeats history, writing the image each update and compensation
+//     record left those pages in, starting from the first record that may not
+//     have been written.
+//   - Undo rolls back the transactions that were active, latest update first,
+//     writing the image each page had before the update, or, for pages with
+//     versions, the image it has without the versions of the transaction.
+//     Each undo is logged with a compensation record, so that if recovery
+//     itself crashes, the next recovery does not undo an update twice.
+//
+// Recovery writes pages directly to their files, so it must run before any of
+// them are read into a buffer pool.
+func (l *LogFile) recover() error {
+	transactions, dirtyPages, err := l.analyze()
+	if err != nil {
+		return err
+	}
+	if err := l.redo(dirtyPages); err != nil {
+		return err
+	}
+	if err := l.undo(transactions); err != nil {
+		return err
+	}
+	return l.truncate()
+}
+
+// Returns the last record of each transaction active at the end of the log,
+// and the first record that changed each page that may not have been written.
+// The transactions of the records since the last checkpoint are counted in the
+// largest id logged, which the master record only has up to the checkpoint.
+func (l *LogFile) analyze() (map[int64]LSN, map[HeapFilePageKey]LSN, error) {
+	transactions := make(map[int64]LSN)
+	dirtyPages := make(map[HeapFilePageKey]LSN)
+	lsn := LSN(logHeaderSize)
+	if l.lastCheckpoint != noLSN {
+		lsn = l.lastCheckpoint
+	}
+	for {
+		r, err := l.readRecord(lsn)
+		if err != nil {
+			return nil, nil, err
+		}
+		if r == nil {
+			return transactions, dirtyPages, nil
+		}
+		l.highestTid = max(l.highestTid, r.tid)
+		switch r.kind {
+		case checkpointRecord:
+			for tid, last := range r.transactions {
+				transactions[tid] = last
+			}
+			for page, first := range r.dirtyPages {
+				dirtyPages[page] = first
+			}
+		case commitRecord, endRecord:
+			delete(transactions, r.tid)
+		case updateRecord, clrRecord:
+			if _, ok := dirtyPages[r.page]; !ok {
+				dirtyPages[r.page] = r.lsn
+			}
+			transactions[r.tid] = r.lsn
+		default:
+			transactions[r.tid] = r.lsn
+		}
+		lsn = r.nextLSN
+	}
+}
+
+// Writes the image left by each update and compensation record to the pages
+// that may not have been written since.
+func (l *LogFile) redo(dirtyPages map[HeapFilePageKey]LSN) error {
+	if len(dirtyPages) == 0 {
+		return nil
+	}
+	lsn := LSN(-1)
+	for _, first := range dirtyPages {
+		if lsn < 0 || first < lsn {
+			lsn = first
+		}
+	}
+	for {
+		r, err := l.readRecord(lsn)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			return nil
+		}
+		if r.kind == updateRecord || r.kind == clrRecord {
+			if first, ok := dirtyPages[r.page]; ok && r.lsn >= first {
+				if err := writePageImage(r.page, r.after); err != nil {
+					return err
+				}
+			}
+		}
+		lsn = r.nextLSN
+	}
+}
+
+// Rolls back the transactions, given the last record of each, ending with an
+// end record for each.
+func (l *LogFile) undo(transactions map[int64]LSN) error {
+	lastLSN := make(map[int64]LSN)
+	for tid, last := range transactions {
+		lastLSN[tid] = last
+	}
+	for len(transactions) > 0 {
+		// undo the latest record of any transaction first
+		var tid int64
+		lsn := noLSN
+		for t, next := range transactions {
+			if next >= lsn {
+				tid, lsn = t, next
+			}
+		}
+		r, err := l.readRecord(lsn)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			return ailikeError{MalformedDataError, "log record to undo is missing"}
+		}
+		last := lastLSN[tid]
+		next, err := l.undoRecord(r, &last, readPageImage, func(page HeapFilePageKey, image []byte, clr LSN) error {
+			if err := l.force(); err != nil {
+				return err
+			}
+			return writePageImage(page, image)
+		})
+		if err != nil {
+			return err
+		}
+		lastLSN[tid] = last
+		if next == noLSN {
+			l.append(&logRecord{kind: endRecord, tid: tid, prevLSN: lastLSN[tid]})
+			delete(transactions, tid)
+		} else {
+			transactions[tid] = next
+		}
+	}
+	return l.force()
+}
+
+// Undoes r, a record of a transaction whose last record is *last, returning
+// the next record of the transaction to undo.  An update is undone by logging
+// a compensation record, which becomes the last record of the transaction,
+// and then calling restore to give the page its image without the update: its
+// image before the update, or, if the page has versions, the image current
+// returns for it without the versions of the transaction, since other
+// transactions may have changed it since.  Removing the versions of a
+// transaction twice leaves the page as removing them once does.
+func (l *LogFile) undoRecord(r *logRecord, last *LSN, current func(page HeapFilePageKey) ([]byte, error), restore func(page HeapFilePageKey, image []byte, clr LSN) error) (LSN, error) {
+	switch r.kind {
+	case updateRecord:
+		image := r.before
+		if r.slotSize > 0 {
+			cur, err := current(r.page)
+			if err != nil {
+				return noLSN, err
+			}
+			if cur == nil {
+				cur = r.after
+			}
+			image = scrubVersions(cur, r.tid, r.slotSize)
+		}
+		*last = l.append(&logRecord{kind: clrRecord, tid: r.tid, prevLSN: *last, page: r.page, after: image, undoNext: r.prevLSN})
+		return r.prevLSN, restore(r.page, image, *last)
+	case clrRecord:
+		// the update it compensates, and any after it, are already undone
+		return r.undoNext, nil
+	}
+	return r.prevLSN, nil
+}
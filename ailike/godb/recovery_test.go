@@ -0,0 +1,249 @@
+package godb
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Opens table t (id int, name string) of the database in dir with a buffer pool
+// of the given number of pages, recovering the database if it crashed.
+func openRecoveryTestTable(t *testing.T, dir string, pages int) (*BufferPool, *HeapFile) {
+	c, bp := makeTestCatalog(t, dir, "t (id int, name string)\n", pages)
+	hf, err := c.GetTable("t")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return bp, hf.(*HeapFile)
+}
+
+// Crashes the database that uses bp: the log is closed without forcing it, and
+// the pages in the buffer pool are lost.
+func simulateCrash(t *testing.T, bp *BufferPool) {
+	if err := bp.log.close(); err != nil {
+		t.Fatalf("failed to close log, %s", err.Error())
+	}
+}
+
+func insertRecoveryTestRows(t *testing.T, hf *HeapFile, tid *Transaction, from int, to int) {
+	for i := from; i < to; i++ {
+		tup := Tuple{Desc: *hf.Descriptor(), Fields: []DBValue{IntField{int64(i)}, StringField{fmt.Sprintf("row %d", i)}}}
+		if err := hf.insertTuple(&tup, tid); err != nil {
+			t.Fatalf("failed to insert, %s", err.Error())
+		}
+	}
+}
+
+// Deletes rows as they are read, since the slots of the rows of a page change
+// when it is written out and read again.
+func deleteRecoveryTestRows(t *testing.T, hf *HeapFile, tid *Transaction, from int, to int) {
+	iter, err := hf.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if id := tup.Fields[0].(IntField).Value; id >= int64(from) && id < int64(to) {
+			if err := hf.deleteTuple(tup, tid); err != nil {
+				t.Fatalf("failed to delete, %s", err.Error())
+			}
+		}
+	}
+}
+
+// Returns the ids in the table, checking that each row has the name it was
+// inserted with.
+func recoveryTestIds(t *testing.T, bp *BufferPool, hf *HeapFile) map[int]bool {
+	tid := bp.Transactions().Begin()
+	defer tid.Commit()
+	iter, err := hf.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ids := make(map[int]bool)
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		id := int(tup.Fields[0].(IntField).Value)
+		if ids[id] {
+			t.Errorf("row %d appears twice", id)
+		}
+		if name := tup.Fields[1].(StringField).Value; name != fmt.Sprintf("row %d", id) {
+			t.Errorf("row %d has name %s", id, name)
+		}
+		ids[id] = true
+	}
+	return ids
+}
+
+func checkRecoveryTestIds(t *testing.T, bp *BufferPool, hf *HeapFile, expected map[int]bool, when string) {
+	ids := recoveryTestIds(t, bp, hf)
+	if len(ids) != len(expected) {
+		t.Errorf("%s: expected %d rows, got %d", when, len(expected), len(ids))
+		return
+	}
+	for id := range expected {
+		if !ids[id] {
+			t.Errorf("%s: row %d is missing", when, id)
+			return
+		}
+	}
+}
+
+// Runs a workload of transactions that commit, abort, or are still running,
+// with a buffer pool small enough that pages of uncommitted transactions are
+// written out, crashing it after each step in turn.  After recovery, the table
+// must hold exactly the changes of the transactions that committed before the
+// crash.
+func TestRecoveryAfterCrash(t *testing.T) {
+	var bp *BufferPool
+	var hf *HeapFile
+	var committed map[int]bool
+	tids := make(map[string]*Transaction)
+	begin := func(name string) {
+		tids[name] = bp.Transactions().Begin()
+	}
+	commit := func(name string, apply func()) {
+		tids[name].Commit()
+		apply()
+	}
+	rows := func(from int, to int, present bool) func() {
+		return func() {
+			for i := from; i < to; i++ {
+				if present {
+					committed[i] = true
+				} else {
+					delete(committed, i)
+				}
+			}
+		}
+	}
+	steps := []struct {
+		name string
+		run  func()
+	}{
+		{"insert in t1", func() { begin("t1"); insertRecoveryTestRows(t, hf, tids["t1"], 0, 600) }},
+		{"commit t1", func() { commit("t1", rows(0, 600, true)) }},
+		{"checkpoint", func() {
+			if err := bp.Checkpoint(); err != nil {
+				t.Fatalf("failed to checkpoint, %s", err.Error())
+			}
+		}},
+		{"insert in t2", func() { begin("t2"); insertRecoveryTestRows(t, hf, tids["t2"], 600, 1200) }},
+		{"abort t2", func() { tids["t2"].Abort() }},
+		{"delete in t3", func() { begin("t3"); deleteRecoveryTestRows(t, hf, tids["t3"], 0, 300) }},
+		{"insert in t3", func() { insertRecoveryTestRows(t, hf, tids["t3"], 1200, 1500) }},
+		{"checkpoint with t3 running", func() {
+			if err := bp.Checkpoint(); err != nil {
+				t.Fatalf("failed to checkpoint, %s", err.Error())
+			}
+		}},
+		{"commit t3", func() { commit("t3", func() { rows(0, 300, false)(); rows(1200, 1500, true)() }) }},
+		{"delete and insert in t4", func() {
+			begin("t4")
+			deleteRecoveryTestRows(t, hf, tids["t4"], 300, 1300)
+			insertRecoveryTestRows(t, hf, tids["t4"], 2000, 2600)
+		}},
+	}
+
+	for crashAfter := 0; crashAfter <= len(steps); crashAfter++ {
+		dir := t.TempDir()
+		bp, hf = openRecoveryTestTable(t, dir, 3)
+		committed = make(map[int]bool)
+		for _, step := range steps[:crashAfter] {
+			step.run()
+		}
+		when := "crash before any step"
+		if crashAfter > 0 {
+			when = "crash after " + steps[crashAfter-1].name
+		}
+		simulateCrash(t, bp)
+
+		bp, hf = openRecoveryTestTable(t, dir, 3)
+		checkRecoveryTestIds(t, bp, hf, committed, when)
+
+		// the recovered database can crash and recover again
+		insertTid := bp.Transactions().Begin()
+		insertRecoveryTestRows(t, hf, insertTid, 5000, 5300)
+		insertTid.Commit()
+		rows(5000, 5300, true)()
+		simulateCrash(t, bp)
+		bp, hf = openRecoveryTestTable(t, dir, 3)
+		checkRecoveryTestIds(t, bp, hf, committed, when+" and recovery")
+		simulateCrash(t, bp)
+	}
+}
+
+// Transactions that write records of the same page each have their changes
+// undone on their own, whether they abort or are running at a crash.
+func TestRecoveryOfSharedPages(t *testing.T) {
+	dir := t.TempDir()
+	bp, hf := openRecoveryTestTable(t, dir, 3)
+	t1, t2, t3 := bp.Transactions().Begin(), bp.Transactions().Begin(), bp.Transactions().Begin()
+	for i := 0; i < 30; i += 3 {
+		insertRecoveryTestRows(t, hf, t1, i, i+1)
+		insertRecoveryTestRows(t, hf, t2, i+1, i+2)
+		insertRecoveryTestRows(t, hf, t3, i+2, i+3)
+	}
+	if hf.NumPages() != 1 {
+		t.Fatalf("expected the transactions to share a page, got %d pages", hf.NumPages())
+	}
+	t2.Abort()
+	t1.Commit()
+	expected := make(map[int]bool)
+	for i := 0; i < 30; i += 3 {
+		expected[i] = true
+	}
+	checkRecoveryTestIds(t, bp, hf, expected, "after abort")
+
+	// t3 is still running at the crash, after t1 logged the page with its rows
+	simulateCrash(t, bp)
+	bp, hf = openRecoveryTestTable(t, dir, 3)
+	checkRecoveryTestIds(t, bp, hf, expected, "after recovery")
+	simulateCrash(t, bp)
+}
+
+// Transaction ids continue from the largest in the log when the database is
+// opened again, rather than from where the process starts them, so the rows of
+// an earlier run stay visible and can be deleted, whether the log still holds
+// their records or was emptied by a checkpoint.
+func TestTransactionIdsAfterRestart(t *testing.T) {
+	saved := nextTid.Load()
+	defer advanceTransactionIds(saved)
+	for _, checkpoint := range []bool{false, true} {
+		dir := t.TempDir()
+		bp, hf := openRecoveryTestTable(t, dir, 10)
+		// the earlier run hands out ids from later than the next one starts
+		advanceTransactionIds(1 << 40)
+		tid := bp.Transactions().Begin()
+		insertRecoveryTestRows(t, hf, tid, 0, 100)
+		tid.Commit()
+		if checkpoint {
+			bp.FlushAllPages()
+			if err := bp.Checkpoint(); err != nil {
+				t.Fatalf("failed to checkpoint, %s", err.Error())
+			}
+		}
+		simulateCrash(t, bp)
+
+		// as if the process that opens the database again started its ids
+		// lower, e.g. because the clock went back
+		nextTid.Store(0)
+		bp, hf = openRecoveryTestTable(t, dir, 10)
+		expected := make(map[int]bool)
+		for i := 0; i < 100; i++ {
+			expected[i] = true
+		}
+		checkRecoveryTestIds(t, bp, hf, expected, fmt.Sprintf("restart with checkpoint %t", checkpoint))
+		tid = bp.Transactions().Begin()
+		deleteRecoveryTestRows(t, hf, tid, 0, 50)
+		tid.Commit()
+		for i := 0; i < 50; i++ {
+			delete(expected, i)
+		}
+		checkRecoveryTestIds(t, bp, hf, expected, fmt.Sprintf("delete after restart with checkpoint %t", checkpoint))
+		simulateCrash(t, bp)
+	}
+}
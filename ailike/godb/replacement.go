@@ -0,0 +1,319 @@
+package godb
+
+import (
+	"container/list"
+	"fmt"
+)
+
+// ReplacementPolicy is how a [BufferPool] chooses which page to evict when it
+// is full.  Whatever the policy, pages that are pinned are never evicted, and
+// without a log, neither are dirty pages.
+type ReplacementPolicy int
+
+const (
+	// evicts the page that was used least recently
+	LRUReplacement ReplacementPolicy = iota
+	// approximates LRU with a reference bit per page, which a hand sweeping the
+	// pages clears, evicting the first page whose bit is already clear
+	ClockReplacement ReplacementPolicy = iota
+	// keeps pages that are used once, such as the data pages an NNScan probes,
+	// in a FIFO queue, and only pages that are used again after leaving it, such
+	// as centroid pages, in an LRU list, so that a scan does not evict the pages
+	// that are used over and over
+	TwoQReplacement ReplacementPolicy = iota
+)
+
+// The replacement policy of buffer pools made by [NewBufferPool].
+const DEFAULT_REPLACEMENT_POLICY = LRUReplacement
+
+func (p ReplacementPolicy) String() string {
+	switch p {
+	case LRUReplacement:
+		return "LRU"
+	case ClockReplacement:
+		return "CLOCK"
+	case TwoQReplacement:
+		return "2Q"
+	}
+	return fmt.Sprintf("ReplacementPolicy(%d)", int(p))
+}
+
+// A replacer tracks the pages in a buffer pool for a replacement policy.  Its
+// methods are called with the buffer pool's mutex held.
+type replacer interface {
+	// records that the page with the given key was read into the buffer pool
+	admit(key BufferPoolKey)
+	// records a use of a page in the buffer pool
+	access(key BufferPoolKey)
+	// forgets a page that is removed from the buffer pool other than by being
+	// evicted
+	remove(key BufferPoolKey)
+	// chooses a page to evict among those that evictable returns true for, in
+	// the order the policy prefers them, and forgets it; returns false if there
+	// is none
+	victim(evictable func(BufferPoolKey) bool) (BufferPoolKey, bool)
+}
+
+// Returns a replacer for the given policy, for a buffer pool of numPages pages.
+func newReplacer(policy ReplacementPolicy, numPages int) replacer {
+	switch policy {
+	case ClockReplacement:
+		return newClockReplacer()
+	case TwoQReplacement:
+		return newTwoQReplacer(numPages)
+	}
+	return newLRUReplacer()
+}
+
+// An LRU list of pages, most recently used first.
+type lruList struct {
+	order   *list.List
+	entries map[BufferPoolKey]*list.Element
+}
+
+func newLRUList() *lruList {
+	return &lruList{list.New(), make(map[BufferPoolKey]*list.Element)}
+}
+
+func (l *lruList) contains(key BufferPoolKey) bool {
+	_, ok := l.entries[key]
+	return ok
+}
+
+// Moves key to the front of the list, adding it if it is not in it.
+func (l *lruList) touch(key BufferPoolKey) {
+	if e, ok := l.entries[key]; ok {
+		l.order.MoveToFront(e)
+		return
+	}
+	l.entries[key] = l.order.PushFront(key)
+}
+
+func (l *lruList) remove(key BufferPoolKey) {
+	if e, ok := l.entries[key]; ok {
+		l.order.Remove(e)
+		delete(l.entries, key)
+	}
+}
+
+// Removes and returns the key nearest the back of the list that evictable
+// returns true for.
+func (l *lruList) victim(evictable func(BufferPoolKey) bool) (BufferPoolKey, bool) {
+	for e := l.order.Back(); e != nil; e = e.Prev() {
+		key := e.Value.(BufferPoolKey)
+		if evictable(key) {
+			l.remove(key)
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func (l *lruList) len() int {
+	return l.order.Len()
+}
+
+type lruReplacer struct {
+	pages *lruList
+}
+
+func newLRUReplacer() *lruReplacer {
+	return &lruReplacer{newLRUList()}
+}
+
+func (r *lruReplacer) admit(key BufferPoolKey) {
+	r.pages.touch(key)
+}
+
+func (r *lruReplacer) access(key BufferPoolKey) {
+	r.pages.touch(key)
+}
+
+func (r *lruReplacer) remove(key BufferPoolKey) {
+	r.pages.remove(key)
+}
+
+func (r *lruReplacer) victim(evictable func(BufferPoolKey) bool) (BufferPoolKey, bool) {
+	return r.pages.victim(evictable)
+}
+
+// The pages of the clock are kept in a ring of frames, which pages removed from
+// the buffer pool leave empty for the next page admitted.
+type clockFrame struct {
+	key        BufferPoolKey // nil if the frame is empty
+	referenced bool
+}
+
+type clockReplacer struct {
+	frames []clockFrame
+	slots  map[BufferPoolKey]int // the frame of each page
+	free   []int                 // the empty frames
+	hand   int
+}
+
+func newClockReplacer() *clockReplacer {
+	return &clockReplacer{slots: make(map[BufferPoolKey]int)}
+}
+
+func (r *clockReplacer) admit(key BufferPoolKey) {
+	if _, ok := r.slots[key]; ok {
+		r.access(key)
+		return
+	}
+	frame := clockFrame{key, true}
+	if n := len(r.free); n > 0 {
+		slot := r.free[n-1]
+		r.free = r.free[:n-1]
+		r.frames[slot] = frame
+		r.slots[key] = slot
+		return
+	}
+	r.slots[key] = len(r.frames)
+	r.frames = append(r.frames, frame)
+}
+
+func (r *clockReplacer) access(key BufferPoolKey) {
+	if slot, ok := r.slots[key]; ok {
+		r.frames[slot].referenced = true
+	}
+}
+
+func (r *clockReplacer) remove(key BufferPoolKey) {
+	if slot, ok := r.slots[key]; ok {
+		r.frames[slot] = clockFrame{}
+		delete(r.slots, key)
+		r.free = append(r.free, slot)
+	}
+}
+
+// The hand goes around the clock at most twice: once to clear the reference
+// bits of the pages that can be evicted, and once more to find one of them.
+func (r *clockReplacer) victim(evictable func(BufferPoolKey) bool) (BufferPoolKey, bool) {
+	for i := 0; i < 2*len(r.frames); i++ {
+		if r.hand >= len(r.frames) {
+			r.hand = 0
+		}
+		frame := &r.frames[r.hand]
+		r.hand++
+		if frame.key == nil || !evictable(frame.key) {
+			continue
+		}
+		if frame.referenced {
+			frame.referenced = false
+			continue
+		}
+		key := frame.key
+		r.remove(key)
+		return key, true
+	}
+	return nil, false
+}
+
+// A 2Q replacer, as described by Johnson and Shasha.  Pages are admitted to the
+// FIFO queue a1in; once it holds more than its share of the buffer pool, the
+// pages leaving it are remembered in a1out, which holds keys but not pages,
+// and pages that are read again while remembered are admitted to the LRU list
+// am instead.
+type twoQReplacer struct {
+	a1in   *list.List // of BufferPoolKey, oldest at the back
+	inA1in map[BufferPoolKey]*list.Element
+	am     *lruList
+	a1out  *list.List // of BufferPoolKey, oldest at the back
+	inOut  map[BufferPoolKey]*list.Element
+	kin    int // the number of pages a1in holds before pages leave it
+	kout   int // the number of keys a1out remembers
+}
+
+// The shares of the buffer pool of a1in and a1out that Johnson and Shasha
+// recommend.
+const (
+	TWOQ_IN_SHARE  = 0.25
+	TWOQ_OUT_SHARE = 0.5
+)
+
+func newTwoQReplacer(numPages int) *twoQReplacer {
+	return &twoQReplacer{
+		a1in:   list.New(),
+		inA1in: make(map[BufferPoolKey]*list.Element),
+		am:     newLRUList(),
+		a1out:  list.New(),
+		inOut:  make(map[BufferPoolKey]*list.Element),
+		kin:    max(1, int(TWOQ_IN_SHARE*float64(numPages))),
+		kout:   max(1, int(TWOQ_OUT_SHARE*float64(numPages))),
+	}
+}
+
+// a1out is only trimmed once the page is admitted, since the buffer pool
+// evicts a page to make room for it first, which may push it out of a1out.
+func (r *twoQReplacer) admit(key BufferPoolKey) {
+	defer r.trimA1out()
+	if e, ok := r.inOut[key]; ok {
+		r.a1out.Remove(e)
+		delete(r.inOut, key)
+		r.am.touch(key)
+		return
+	}
+	if r.am.contains(key) {
+		r.am.touch(key)
+		return
+	}
+	if _, ok := r.inA1in[key]; !ok {
+		r.inA1in[key] = r.a1in.PushFront(key)
+	}
+}
+
+// Forgets the oldest keys of a1out beyond the number it remembers.
+func (r *twoQReplacer) trimA1out() {
+	for r.a1out.Len() > r.kout {
+		oldest := r.a1out.Back()
+		r.a1out.Remove(oldest)
+		delete(r.inOut, oldest.Value.(BufferPoolKey))
+	}
+}
+
+// Pages used again while in a1in stay where they are, since uses close
+// together, such as the reads of the records of a page, say little about
+// whether a page will be used again.
+func (r *twoQReplacer) access(key BufferPoolKey) {
+	if r.am.contains(key) {
+		r.am.touch(key)
+	}
+}
+
+func (r *twoQReplacer) remove(key BufferPoolKey) {
+	if e, ok := r.inA1in[key]; ok {
+		r.a1in.Remove(e)
+		delete(r.inA1in, key)
+	}
+	r.am.remove(key)
+}
+
+// Evicts from a1in while it holds more than its share, and otherwise from am,
+// falling back to the other if none of the pages of one can be evicted.
+func (r *twoQReplacer) victim(evictable func(BufferPoolKey) bool) (BufferPoolKey, bool) {
+	if r.a1in.Len() > r.kin || r.am.len() == 0 {
+		if key, ok := r.a1inVictim(evictable); ok {
+			return key, true
+		}
+		return r.am.victim(evictable)
+	}
+	if key, ok := r.am.victim(evictable); ok {
+		return key, true
+	}
+	return r.a1inVictim(evictable)
+}
+
+// Removes the oldest page of a1in that can be evicted, remembering it in a1out.
+func (r *twoQReplacer) a1inVictim(evictable func(BufferPoolKey) bool) (BufferPoolKey, bool) {
+	for e := r.a1in.Back(); e != nil; e = e.Prev() {
+		key := e.Value.(BufferPoolKey)
+		if !evictable(key) {
+			continue
+		}
+		r.a1in.Remove(e)
+		delete(r.inA1in, key)
+		r.inOut[key] = r.a1out.PushFront(key)
+		return key, true
+	}
+	return nil, false
+}
@@ -0,0 +1,153 @@
+package godb
+
+import (
+	"testing"
+)
+
+func replacementTestKey(pageNo int) BufferPoolKey {
+	return HeapFilePageKey{"replacement_test.dat", pageNo}
+}
+
+func anyPage(BufferPoolKey) bool {
+	return true
+}
+
+// Runs the accesses to the given pages through a cache of numPages pages that
+// evicts the pages r chooses, returning the number of hits.
+func simulateReplacer(t *testing.T, r replacer, numPages int, accesses []int) int {
+	cached := make(map[BufferPoolKey]bool)
+	hits := 0
+	for _, pageNo := range accesses {
+		key := replacementTestKey(pageNo)
+		if cached[key] {
+			hits++
+			r.access(key)
+			continue
+		}
+		if len(cached) == numPages {
+			victim, ok := r.victim(anyPage)
+			if !ok || !cached[victim] {
+				t.Fatalf("expected a cached page to evict, got %v", victim)
+			}
+			delete(cached, victim)
+		}
+		cached[key] = true
+		r.admit(key)
+	}
+	return hits
+}
+
+func expectVictim(t *testing.T, r replacer, evictable func(BufferPoolKey) bool, pageNo int) {
+	if key, ok := r.victim(evictable); !ok || key != replacementTestKey(pageNo) {
+		t.Errorf("expected page %d to be evicted, got %v", pageNo, key)
+	}
+}
+
+func TestLRUReplacement(t *testing.T) {
+	r := newReplacer(LRUReplacement, 4)
+	for pageNo := 0; pageNo < 4; pageNo++ {
+		r.admit(replacementTestKey(pageNo))
+	}
+	r.access(replacementTestKey(0))
+	expectVictim(t, r, anyPage, 1)
+	// pages that cannot be evicted are passed over
+	expectVictim(t, r, func(key BufferPoolKey) bool { return key != replacementTestKey(2) }, 3)
+	r.remove(replacementTestKey(2))
+	expectVictim(t, r, anyPage, 0)
+	if _, ok := r.victim(anyPage); ok {
+		t.Errorf("expected no page to evict")
+	}
+}
+
+func TestClockReplacement(t *testing.T) {
+	r := newReplacer(ClockReplacement, 4)
+	for pageNo := 0; pageNo < 3; pageNo++ {
+		r.admit(replacementTestKey(pageNo))
+	}
+	// every page was referenced, so the hand clears them all before evicting
+	// the first
+	expectVictim(t, r, anyPage, 0)
+	// the referenced page gets a second chance
+	r.access(replacementTestKey(1))
+	expectVictim(t, r, anyPage, 2)
+	// the frame freed by an evicted page is reused
+	r.admit(replacementTestKey(3))
+	if len(r.(*clockReplacer).frames) != 3 {
+		t.Errorf("expected the frames to be reused, got %d", len(r.(*clockReplacer).frames))
+	}
+	expectVictim(t, r, func(key BufferPoolKey) bool { return key != replacementTestKey(1) }, 3)
+}
+
+// Queries that read the same centroid pages and then a run of data pages, as
+// an NNScan does, do not evict the centroid pages from a 2Q buffer pool, as
+// they do from an LRU one.
+func TestTwoQScanResistance(t *testing.T) {
+	var accesses []int
+	dataPage := 100
+	for query := 0; query < 20; query++ {
+		accesses = append(accesses, 0, 1)
+		for i := 0; i < 10; i++ {
+			accesses = append(accesses, dataPage)
+			dataPage++
+		}
+	}
+	lruHits := simulateReplacer(t, newReplacer(LRUReplacement, 8), 8, accesses)
+	twoQHits := simulateReplacer(t, newReplacer(TwoQReplacement, 8), 8, accesses)
+	if lruHits != 0 {
+		t.Errorf("expected the data pages to evict the centroid pages under LRU, got %d hits", lruHits)
+	}
+	// the centroid pages miss in the first two queries, before they are kept
+	if twoQHits != 36 {
+		t.Errorf("expected the centroid pages to stay cached under 2Q, got %d hits", twoQHits)
+	}
+}
+
+func TestBufferPoolPins(t *testing.T) {
+	for _, policy := range []ReplacementPolicy{LRUReplacement, ClockReplacement, TwoQReplacement} {
+		_, t1, _, hf, _, tid := makeTestVars()
+		for hf.NumPages() < 3 {
+			if err := hf.insertTuple(&t1, tid); err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+		tid.Commit()
+
+		small := NewBufferPoolWithPolicy(2, policy)
+		file, err := NewHeapFile(hf.fileName, hf.Descriptor(), small)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		tid = small.Transactions().Begin()
+		first, err := file.getHeapPage(0, tid, ReadPerm)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		second, err := file.getHeapPage(1, tid, ReadPerm)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if _, err := small.GetPage(file, 2, tid, ReadPerm); err == nil || err.(ailikeError).code != BufferPoolFullError {
+			t.Errorf("%v: expected pinned pages not to be evicted, got %v", policy, err)
+		}
+
+		// once the first page is unpinned it is the only one that can be evicted
+		file.unpin(first)
+		if _, err := small.GetPage(file, 2, tid, ReadPerm); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if !small.hasPageCached(file, 1, tid, ReadPerm) || small.hasPageCached(file, 0, tid, ReadPerm) {
+			t.Errorf("%v: expected the unpinned page to be evicted", policy)
+		}
+		file.unpin(second)
+		if _, err := small.GetPage(file, 1, tid, ReadPerm); err != nil {
+			t.Fatalf(err.Error())
+		}
+		tid.Commit()
+		if stats := small.Stats(); stats.Hits != 1 || stats.Misses != 4 || stats.Evictions != 1 {
+			t.Errorf("%v: expected 1 hit, 4 misses and 1 eviction, got %+v", policy, stats)
+		}
+		if small.ReplacementPolicy() != policy {
+			t.Errorf("expected the buffer pool to use %v", policy)
+		}
+	}
+}
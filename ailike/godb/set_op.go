@@ -0,0 +1,142 @@
+package godb
+
+import "fmt"
+
+type SetOperation int
+
+const (
+	Union SetOperation = iota
+	Intersect
+	Except
+)
+
+var setOperationNames = map[SetOperation]string{
+	Union:     "union",
+	Intersect: "intersect",
+	Except:    "except",
+}
+
+// SetOp combines the results of two queries with UNION, INTERSECT or EXCEPT.
+// Records are compared by their values, so that NULLs are equal to each other.
+// Without all, duplicates are removed from the result; with it, a record that
+// appears m times on the left and n times on the right appears m+n times in
+// the union, min(m, n) times in the intersection and max(m-n, 0) times in the
+// difference.
+//
+// The result has the field names of the left input.
+type SetOp struct {
+	left  Operator
+	right Operator
+	op    SetOperation
+	all   bool
+	desc  *TupleDesc
+}
+
+// Construct a set operation over left and right, which must return the same
+// number of fields, with the same types.
+func NewSetOp(left Operator, right Operator, op SetOperation, all bool) (*SetOp, error) {
+	lDesc, rDesc := left.Descriptor(), right.Descriptor()
+	name := setOperationNames[op]
+	if len(lDesc.Fields) != len(rDesc.Fields) {
+		return nil, ailikeError{TypeMismatchError, fmt.Sprintf("the inputs of %s return %d and %d fields", name, len(lDesc.Fields), len(rDesc.Fields))}
+	}
+	desc := lDesc.copy()
+	for i, f := range rDesc.Fields {
+		// the NULL literal has an unknown type, which takes the type of the other input
+		switch {
+		case desc.Fields[i].Ftype == UnknownType:
+			desc.Fields[i].Ftype = f.Ftype
+		case f.Ftype != UnknownType && f.Ftype != desc.Fields[i].Ftype:
+			return nil, ailikeError{TypeMismatchError, fmt.Sprintf("field %d of the inputs of %s has types %s and %s", i+1, name, typeNames[desc.Fields[i].Ftype], typeNames[f.Ftype])}
+		}
+	}
+	return &SetOp{left, right, op, all, desc}, nil
+}
+
+func (s *SetOp) Descriptor() *TupleDesc {
+	return s.desc
+}
+
+// Returns t as a record of the result, which is also used as its key.
+func (s *SetOp) resultTuple(t *Tuple) *Tuple {
+	return &Tuple{Desc: *s.desc, Fields: t.Fields}
+}
+
+// Returns the number of times each record appears in op.
+func (s *SetOp) countTuples(op Operator, tid *Transaction) (map[any]int, error) {
+	iter, err := op.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[any]int)
+	for {
+		t, err := iter()
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			return counts, nil
+		}
+		counts[s.resultTuple(t).tupleKey()]++
+	}
+}
+
+// A union reads its inputs one after the other.  An intersection or difference
+// first counts the records of the right input in a hash table, and then probes
+// it with the records of the left.
+func (s *SetOp) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
+	var right map[any]int
+	if s.op != Union {
+		var err error
+		if right, err = s.countTuples(s.right, tid); err != nil {
+			return nil, err
+		}
+	}
+	iter, err := s.left.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	readingLeft := true
+	seen := make(map[any]bool)
+	return func() (*Tuple, error) {
+		for {
+			t, err := iter()
+			if err != nil {
+				return nil, err
+			}
+			if t == nil {
+				if s.op != Union || !readingLeft {
+					return nil, nil
+				}
+				if iter, err = s.right.Iterator(tid); err != nil {
+					return nil, err
+				}
+				readingLeft = false
+				continue
+			}
+			result := s.resultTuple(t)
+			key := result.tupleKey()
+			if !s.all && seen[key] {
+				continue
+			}
+			switch s.op {
+			case Intersect:
+				if right[key] == 0 {
+					continue
+				}
+				right[key]--
+			case Except:
+				if right[key] > 0 {
+					if s.all {
+						right[key]--
+					}
+					continue
+				}
+			}
+			if !s.all {
+				seen[key] = true
+			}
+			return result, nil
+		}
+	}, nil
+}
@@ -0,0 +1,72 @@
+package godb
+
+import (
+	"testing"
+)
+
+func TestSetOp(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	for _, tc := range []struct {
+		sql      string
+		expected []int64
+	}{
+		// s has 10 records with each t_id from 0 to 4
+		{"select t_id from s union select t_id from t", []int64{0, 1, 2, 3, 4}},
+		{"select t_id from s where s_id < 3 union all select t_id from t where t_id > 2", []int64{0, 1, 2, 3, 4}},
+		{"select t_id from s intersect select s_id from s where s_id < 3", []int64{0, 1, 2}},
+		{"select t_id from s where s_id < 10 intersect all select s_id from s where s_id < 3", []int64{0, 1, 2}},
+		{"select s_id from s where s_id < 7 except select t_id from t", []int64{5, 6}},
+		{"select t_id from s where s_id < 10 except all select t_id from t where t_id < 2", []int64{0, 1, 2, 2, 3, 3, 4, 4}},
+		// set operations are evaluated left to right, unless they are parenthesized
+		{"select t_id from t union select s_id from s where s_id < 7 except select t_id from t", []int64{5, 6}},
+		{"select s_id from s where s_id < 7 except (select t_id from t union select s_id from s where s_id = 6)", []int64{5}},
+		// INTERSECT and EXCEPT are keywords in any case
+		{"SELECT s_id FROM s WHERE s_id < 7 EXCEPT SELECT t_id FROM t", []int64{5, 6}},
+		// set operations in FROM and in common table expressions
+		{"select x.t_id from (select t_id from t intersect select s_id from s where s_id > 2) x", []int64{3, 4}},
+		{"with a(id) as (select t_id from t union all select s_id from s where s_id >= 48) select id from a where id > 2", []int64{3, 4, 48, 49}},
+	} {
+		_, vals := sortedIntColumn(t, c, bp, tc.sql)
+		if len(vals) != len(tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.sql, tc.expected, vals)
+			continue
+		}
+		for i := range vals {
+			if vals[i] != tc.expected[i] {
+				t.Errorf("%s: expected %v, got %v", tc.sql, tc.expected, vals)
+				break
+			}
+		}
+	}
+
+	// ORDER BY and LIMIT apply to the combined results, whose fields are named
+	// by the left input
+	sql := "select t_id from t union select s_id from s where s_id < 7 order by t_id desc limit 3"
+	plan, vals := runIntColumnQuery(t, c, bp, sql, 0)
+	if len(vals) != 3 || vals[0] != 6 || vals[2] != 4 {
+		t.Errorf("expected 6, 5 and 4, got %v", vals)
+	}
+	if _, ok := plan.(*LimitOp).child.(*OrderBy).child.(*SetOp); !ok {
+		t.Errorf("expected the set operation to be sorted, got %s", planLabel(plan))
+	}
+	if plan.Descriptor().Fields[0].Fname != "t_id" {
+		t.Errorf("expected the result to have the field names of the left input")
+	}
+
+	// NULLs are equal to each other
+	runIntColumnQuery(t, c, bp, "update r set s_id = null where r_id >= 495", 0)
+	_, rows := queryRows(t, c, bp, "select s_id from r where r_id >= 490 union select s_id from r where r_id >= 495")
+	if len(rows) != 6 || countNulls(rows, 0) != 1 {
+		t.Errorf("expected 5 values and one NULL, got %v", rows)
+	}
+
+	for _, sql := range []string{
+		"select t_id, name from t union select s_id from s",
+		"select name from t intersect select s_id from s",
+		"select t_id from t except select s_id from s order by s_id",
+	} {
+		if queryError(c, bp, sql) == nil {
+			t.Errorf("expected an error running %s", sql)
+		}
+	}
+}
@@ -44,8 +44,7 @@ func TestSimpleQuery(t *testing.T) {
 	expr := FieldExpr{filterOp.Descriptor().Fields[0]}
 	sa.Init("count", &expr, nil)
 	agg := NewAggregator([]AggState{&sa}, filterOp)
-	tid := NewTID()
-	bp.BeginTransaction(tid)
+	tid := bp.Transactions().Begin()
 	f, err := agg.Iterator(tid)
 	if err != nil {
 		t.Fatalf("failed to get iterator, %s", err.Error())
@@ -0,0 +1,291 @@
+package godb
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ColumnStats summarizes the values of one column of a table.
+type ColumnStats struct {
+	NumDistinct int
+	// the following are only collected for int and float columns
+	Min       float64
+	Max       float64
+	Histogram []int // counts of values in NumHistogramBuckets equal-width buckets over [Min, Max+step]
+	// the width each value covers in the histogram: 1 for ints, so that a bucket
+	// holds whole numbers, and 0 for floats
+	step float64
+}
+
+// TableStats are the statistics collected by ANALYZE for a table, and are used
+// by the optimizer to estimate the cost of plans over the table.
+type TableStats struct {
+	NumTuples int
+	NumPages  int
+	Columns   map[string]*ColumnStats
+	// maps each column with a vector index to the number of records in each of its clusters
+	ClusterSizes map[string][]int
+}
+
+// Returns the value used to count the distinct values of a field.
+func distinctKey(v DBValue) any {
+	switch v := v.(type) {
+	case IntField:
+		return v.Value
+	case FloatField:
+		return v.Value
+	case StringField:
+		return v.Value
+	case EmbeddedStringField:
+		return v.Value
+	}
+	return nil
+}
+
+// Builds an equal-width histogram of vals over [min, max+step].
+func buildHistogram(vals []float64, min float64, max float64, step float64) []int {
+	hist := make([]int, NumHistogramBuckets)
+	width := (max + step - min) / float64(NumHistogramBuckets)
+	for _, v := range vals {
+		bucket := 0
+		if width > 0 {
+			bucket = int((v - min) / width)
+		}
+		if bucket >= NumHistogramBuckets {
+			bucket = NumHistogramBuckets - 1
+		}
+		hist[bucket]++
+	}
+	return hist
+}
+
+// Returns the number of records in each cluster of a vector index, ordered by centroid id.
+func indexClusterSizes(index *NNIndexFile, tid *Transaction) ([]int, error) {
+	sizes := make(map[int]int)
+	iter, err := index.mappingHeapFile.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	for mt, err := iter(); mt != nil || err != nil; mt, err = iter() {
+		if err != nil {
+			return nil, err
+		}
+		centroidId := int(mt.Fields[0].(IntField).Value)
+		hp, err := index.dataHeapFile.getHeapPage(int(mt.Fields[1].(IntField).Value), tid, ReadPerm)
+		if err != nil {
+			return nil, err
+		}
+		sizes[centroidId] += hp.getNumSlots() - hp.getNumOpenSlots()
+		index.dataHeapFile.unpin(hp)
+	}
+	ids := make([]int, 0, len(sizes))
+	for id := range sizes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	result := make([]int, len(ids))
+	for i, id := range ids {
+		result[i] = sizes[id]
+	}
+	return result, nil
+}
+
+// Scans hf to collect its row count, the number of distinct values and a histogram
+// of each column, and the cluster sizes of each of its vector indexes.
+func AnalyzeTable(hf *HeapFile, tid *Transaction) (*TableStats, error) {
+	desc := hf.Descriptor()
+	distinct := make([]map[any]bool, len(desc.Fields))
+	numVals := make([][]float64, len(desc.Fields))
+	for i := range desc.Fields {
+		distinct[i] = make(map[any]bool)
+	}
+
+	stats := &TableStats{NumPages: hf.NumPages(), Columns: make(map[string]*ColumnStats), ClusterSizes: make(map[string][]int)}
+	iter, err := hf.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	for t, err := iter(); t != nil || err != nil; t, err = iter() {
+		if err != nil {
+			return nil, err
+		}
+		stats.NumTuples++
+		for i, f := range t.Fields {
+			if key := distinctKey(f); key != nil {
+				distinct[i][key] = true
+			}
+			if v, ok := numericValue(f); ok {
+				numVals[i] = append(numVals[i], v)
+			}
+		}
+	}
+
+	for i, field := range desc.Fields {
+		cs := &ColumnStats{NumDistinct: len(distinct[i])}
+		if field.Ftype == VectorFieldType {
+			// vectors have no text to compare, so assume they are all different
+			cs.NumDistinct = stats.NumTuples
+		}
+		if (field.Ftype == IntType || field.Ftype == FloatType) && len(numVals[i]) > 0 {
+			if field.Ftype == IntType {
+				cs.step = 1
+			}
+			cs.Min, cs.Max = numVals[i][0], numVals[i][0]
+			for _, v := range numVals[i] {
+				cs.Min = min(cs.Min, v)
+				cs.Max = max(cs.Max, v)
+			}
+			cs.Histogram = buildHistogram(numVals[i], cs.Min, cs.Max, cs.step)
+		}
+		stats.Columns[field.Fname] = cs
+	}
+
+	for col, index := range hf.indexes {
+		sizes, err := indexClusterSizes(index, tid)
+		if err != nil {
+			return nil, err
+		}
+		stats.ClusterSizes[col] = sizes
+	}
+	return stats, nil
+}
+
+// Returns the fraction of values in the column that are less than v, or less than
+// or equal to v if inclusive, interpolating within histogram buckets.
+func (cs *ColumnStats) fractionBelow(v float64, inclusive bool) float64 {
+	lo, hi := cs.Min, cs.Max+cs.step
+	if lo == hi {
+		// a float column holding a single value
+		if v > lo || (inclusive && v == lo) {
+			return 1
+		}
+		return 0
+	}
+	if inclusive {
+		v += cs.step
+	}
+	if v <= lo {
+		return 0
+	}
+	if v >= hi {
+		return 1
+	}
+	total := 0
+	for _, n := range cs.Histogram {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	width := (hi - lo) / float64(len(cs.Histogram))
+	pos := (v - lo) / width
+	below := 0.0
+	for i, n := range cs.Histogram {
+		if float64(i+1) <= pos {
+			below += float64(n)
+		} else {
+			below += float64(n) * (pos - float64(i))
+			break
+		}
+	}
+	return below / float64(total)
+}
+
+// Estimates the fraction of records whose value of col satisfies the predicate
+// col op v. Columns without statistics use fixed default selectivities.
+func (s *TableStats) selectivity(col string, op BoolOp, v DBValue) float64 {
+	var cs *ColumnStats
+	if s != nil {
+		cs = s.Columns[col]
+	}
+	if cs == nil || cs.NumDistinct == 0 {
+		switch op {
+		case OpEq:
+			return DefaultEqSelectivity
+		case OpNeq:
+			return 1 - DefaultEqSelectivity
+		}
+		return DefaultRangeSelectivity
+	}
+
+	num, isNum := numericValue(v)
+	eq := 1 / float64(cs.NumDistinct)
+	if isNum && cs.Histogram != nil && (num < cs.Min || num > cs.Max) {
+		eq = 0
+	}
+	switch op {
+	case OpEq:
+		return eq
+	case OpNeq:
+		return 1 - eq
+	case OpLt, OpLe, OpGt, OpGe:
+		if !isNum || cs.Histogram == nil {
+			return DefaultRangeSelectivity
+		}
+		below := cs.fractionBelow(num, op == OpLe || op == OpGt)
+		if op == OpLt || op == OpLe {
+			return below
+		}
+		return 1 - below
+	}
+	return DefaultRangeSelectivity
+}
+
+// AnalyzeOp collects the statistics of a table when iterated, saving them in the
+// catalog for use by later queries, and returns a summary row per column.  The
+// statistics are not written to disk, so ANALYZE must be rerun after a restart.
+type AnalyzeOp struct {
+	c     *Catalog
+	table string
+	file  *HeapFile
+}
+
+var analyzeDesc = TupleDesc{Fields: []FieldType{
+	{Fname: "column", Ftype: StringType},
+	{Fname: "rows", Ftype: IntType},
+	{Fname: "distinct", Ftype: IntType},
+	{Fname: "min", Ftype: FloatType},
+	{Fname: "max", Ftype: FloatType},
+}}
+
+func NewAnalyzeOp(c *Catalog, table string) (*AnalyzeOp, error) {
+	file, err := c.GetTable(table)
+	if err != nil {
+		return nil, err
+	}
+	hf, ok := file.(*HeapFile)
+	if !ok {
+		return nil, ailikeError{IllegalOperationError, fmt.Sprintf("cannot analyze table '%s'", table)}
+	}
+	return &AnalyzeOp{c, table, hf}, nil
+}
+
+func (a *AnalyzeOp) Descriptor() *TupleDesc {
+	return &analyzeDesc
+}
+
+func (a *AnalyzeOp) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
+	stats, err := AnalyzeTable(a.file, tid)
+	if err != nil {
+		return nil, err
+	}
+	a.c.setTableStats(a.table, stats)
+	a.file.stats = stats
+
+	i := 0
+	return func() (*Tuple, error) {
+		if i >= len(a.file.desc.Fields) {
+			return nil, nil
+		}
+		name := a.file.desc.Fields[i].Fname
+		i++
+		cs := stats.Columns[name]
+		return &Tuple{Desc: analyzeDesc, Fields: []DBValue{
+			StringField{name},
+			IntField{int64(stats.NumTuples)},
+			IntField{int64(cs.NumDistinct)},
+			FloatField{cs.Min},
+			FloatField{cs.Max},
+		}}, nil
+	}, nil
+}
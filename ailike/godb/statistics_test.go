@@ -0,0 +1,267 @@
+package godb
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// Creates a catalog of three int tables, where every record of r joins with 10
+// records of s, and every record of s joins with one record of t.
+func makeJoinStatsTestCatalog(t *testing.T) (*Catalog, *BufferPool) {
+	dir := t.TempDir()
+	catalog := "r (r_id int, s_id int)\ns (s_id int, t_id int)\nt (t_id int, name string)\n"
+	c, bp := makeTestCatalog(t, dir, catalog, 20)
+
+	tid := bp.Transactions().Begin()
+	insert := func(table string, rows int, fields func(i int) []DBValue) {
+		file, err := c.GetTable(table)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		for i := 0; i < rows; i++ {
+			tup := Tuple{Desc: *file.Descriptor(), Fields: fields(i)}
+			if err := file.insertTuple(&tup, tid); err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+	}
+	insert("r", 500, func(i int) []DBValue { return []DBValue{IntField{int64(i)}, IntField{int64(i % 50)}} })
+	insert("s", 50, func(i int) []DBValue { return []DBValue{IntField{int64(i)}, IntField{int64(i % 5)}} })
+	insert("t", 5, func(i int) []DBValue { return []DBValue{IntField{int64(i)}, StringField{fmt.Sprintf("t%d", i)}} })
+	tid.Commit()
+	return c, bp
+}
+
+// Runs an ANALYZE statement on the table.
+func analyzeTestTable(t *testing.T, c *Catalog, bp *BufferPool, table string) {
+	qtype, plan, err := Parse(c, "analyze "+table)
+	if err != nil {
+		t.Fatalf("failed to parse analyze, %s", err.Error())
+	}
+	if qtype != IteratorType {
+		t.Fatalf("expected analyze to be an iterator query")
+	}
+	tid := bp.Transactions().Begin()
+	defer tid.Commit()
+	iter, err := plan.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+}
+
+func TestAnalyzeTable(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	analyzeTestTable(t, c, bp, "r")
+
+	file, _ := c.GetTable("r")
+	stats := file.(*HeapFile).stats
+	if stats == nil {
+		t.Fatalf("expected the table to have statistics after ANALYZE")
+	}
+	if stats.NumTuples != 500 {
+		t.Errorf("expected 500 rows, got %d", stats.NumTuples)
+	}
+	rId, sId := stats.Columns["r_id"], stats.Columns["s_id"]
+	if rId.NumDistinct != 500 || sId.NumDistinct != 50 {
+		t.Errorf("expected 500 and 50 distinct values, got %d and %d", rId.NumDistinct, sId.NumDistinct)
+	}
+	if rId.Min != 0 || rId.Max != 499 {
+		t.Errorf("expected range [0, 499], got [%v, %v]", rId.Min, rId.Max)
+	}
+	for _, n := range rId.Histogram {
+		if n != 50 {
+			t.Fatalf("expected uniform histogram, got %v", rId.Histogram)
+		}
+	}
+
+	// the histogram estimates range predicates, and distinct counts estimate equality
+	for _, tc := range []struct {
+		op       BoolOp
+		v        int64
+		expected float64
+	}{
+		{OpLt, 100, 0.2},
+		{OpGe, 100, 0.8},
+		{OpLe, 99, 0.2},
+		{OpGt, 499, 0},
+		{OpEq, 7, 1.0 / 500},
+		{OpEq, 1000, 0},
+	} {
+		if sel := stats.selectivity("r_id", tc.op, IntField{tc.v}); math.Abs(sel-tc.expected) > 1e-9 {
+			t.Errorf("expected selectivity %v for %s %d, got %v", tc.expected, opToStr(tc.op), tc.v, sel)
+		}
+	}
+	var noStats *TableStats
+	if sel := noStats.selectivity("r_id", OpEq, IntField{1}); sel != DefaultEqSelectivity {
+		t.Errorf("expected default selectivity without statistics, got %v", sel)
+	}
+
+	if _, _, err := Parse(c, "analyze no_such_table"); err == nil {
+		t.Errorf("expected error analyzing a missing table")
+	}
+	if _, _, err := Parse(c, "analyze table r s"); err == nil {
+		t.Errorf("expected error analyzing two tables")
+	}
+}
+
+func TestAnalyzeFloatColumn(t *testing.T) {
+	td := TupleDesc{Fields: []FieldType{{Fname: "x", Ftype: FloatType}, {Fname: "c", Ftype: FloatType}}}
+	bp := NewBufferPool(10)
+	hf, err := NewHeapFile(t.TempDir()+"/float_stats_test.dat", &td, bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := bp.Transactions().Begin()
+	for i := 0; i < 1000; i++ {
+		tup := Tuple{Desc: td, Fields: []DBValue{FloatField{float64(i) / 10}, FloatField{5}}}
+		if err := hf.insertTuple(&tup, tid); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	stats, err := AnalyzeTable(hf, tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid.Commit()
+
+	x, c := stats.Columns["x"], stats.Columns["c"]
+	if x.NumDistinct != 1000 || c.NumDistinct != 1 {
+		t.Errorf("expected 1000 and 1 distinct values, got %d and %d", x.NumDistinct, c.NumDistinct)
+	}
+	if x.Min != 0 || x.Max != 99.9 {
+		t.Errorf("expected range [0, 99.9], got [%v, %v]", x.Min, x.Max)
+	}
+	total := 0
+	for _, n := range x.Histogram {
+		total += n
+	}
+	if len(x.Histogram) != NumHistogramBuckets || total != 1000 {
+		t.Errorf("expected a histogram of all 1000 values, got %v", x.Histogram)
+	}
+
+	for _, tc := range []struct {
+		col      string
+		op       BoolOp
+		v        DBValue
+		expected float64
+	}{
+		{"x", OpLt, FloatField{25}, 0.25},
+		{"x", OpGe, IntField{50}, 0.5},
+		{"x", OpEq, FloatField{200}, 0},
+		{"c", OpLe, FloatField{5}, 1},
+		{"c", OpLt, FloatField{5}, 0},
+		{"c", OpGt, FloatField{4}, 1},
+	} {
+		if sel := stats.selectivity(tc.col, tc.op, tc.v); math.Abs(sel-tc.expected) > 0.01 {
+			t.Errorf("expected selectivity %v for %s %s %v, got %v", tc.expected, tc.col, opToStr(tc.op), tc.v, sel)
+		}
+	}
+}
+
+// ANALYZE saves statistics in the catalog while other queries read them to plan.
+func TestAnalyzeConcurrentPlanning(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			analyzeTestTable(t, c, bp, "r")
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		if _, _, err := Parse(c, "select r_id from r where r_id < 100"); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	<-done
+	if stats := c.tableStats("r"); stats == nil || stats.NumTuples != 500 {
+		t.Errorf("expected the statistics of the last ANALYZE, got %+v", stats)
+	}
+}
+
+func TestCostBasedJoinOrder(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	sql := "select r.r_id, t.name from r join s on r.s_id = s.s_id join t on s.t_id = t.t_id"
+
+	// without statistics, joins are applied in the order they are written
+	plan, rows := queryRows(t, c, bp, sql)
+	top := plan.(*Project).child.(*EqualityJoin[int64])
+	if _, ok := (*top.left).(*EqualityJoin[int64]); !ok {
+		t.Fatalf("expected r and s to be joined first")
+	}
+	if len(rows) != 500 {
+		t.Fatalf("expected 500 results, got %d", len(rows))
+	}
+
+	// s join t produces 50 rows, r join s produces 500, so s and t should be joined first
+	for _, table := range []string{"r", "s", "t"} {
+		analyzeTestTable(t, c, bp, table)
+	}
+	plan, rows = queryRows(t, c, bp, sql)
+	top = plan.(*Project).child.(*EqualityJoin[int64])
+	if _, ok := (*top.right).(*EqualityJoin[int64]); !ok {
+		t.Fatalf("expected s and t to be joined first")
+	}
+	if est := EstimatePlanCost(*top.right); est.Rows != 50 {
+		t.Errorf("expected s join t to be estimated at 50 rows, got %v", est.Rows)
+	}
+	if est := EstimatePlanCost(plan); est.Rows != 500 {
+		t.Errorf("expected the query to be estimated at 500 rows, got %v", est.Rows)
+	}
+	if len(rows) != 500 {
+		t.Fatalf("expected 500 results, got %d", len(rows))
+	}
+}
+
+func TestCostBasedAccessPath(t *testing.T) {
+	c, hf, bp, dir := makeTweetsTestCatalog(t)
+	tweets := readFirstTweets(t, hf, bp, 1)
+	startFakeEmbeddingServer(t, tweets[0].Fields[2].(EmbeddedStringField).Emb)
+	_, err := ConstructNNIndexFileFromHeapFile(hf, "content", 10, true, dir, "tweets_test", bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	query := func(limit int) Operator {
+		sql := fmt.Sprintf("select tweet_id, content ailike 'query' d from tweets_test order by d limit %d", limit)
+		_, plan, err := Parse(c, sql)
+		if err != nil {
+			t.Fatalf("failed to parse, q=%s, %s", sql, err.Error())
+		}
+		return plan
+	}
+
+	// without statistics the index is always used
+	if !planContains(query(1000), &NNScan{}) {
+		t.Fatalf("expected the index to be used without statistics")
+	}
+
+	analyzeTestTable(t, c, bp, "tweets_test")
+	file, _ := c.GetTable("tweets_test")
+	stats := file.(*HeapFile).stats
+	if len(stats.ClusterSizes["content"]) == 0 {
+		t.Fatalf("expected cluster sizes for the indexed column")
+	}
+	total := 0
+	for _, n := range stats.ClusterSizes["content"] {
+		total += n
+	}
+	if total != stats.NumTuples {
+		t.Errorf("expected clusters to hold all %d records, got %d", stats.NumTuples, total)
+	}
+
+	// a few neighbours are found by probing a few clusters, but finding many of them
+	// needs every cluster, which costs more than reading the table sequentially
+	if !planContains(query(1), &NNScan{}) {
+		t.Errorf("expected the index to be used for a small limit")
+	}
+	if planContains(query(stats.NumTuples), &NNScan{}) {
+		t.Errorf("expected a sequential scan for a limit as large as the table")
+	}
+}
@@ -0,0 +1,249 @@
+package godb
+
+import "fmt"
+
+// paramExpr is a reference from a correlated subquery to a field of the
+// enclosing query.  Its value is set to the field of each record of the
+// enclosing query before the subquery is run for that record.
+type paramExpr struct {
+	field FieldType
+	value DBValue
+}
+
+func (p *paramExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	return p.value, nil
+}
+
+func (p *paramExpr) GetExprType() FieldType {
+	return p.field
+}
+
+// subqueryPlan is the physical plan of a subquery that is evaluated as an
+// expression of the enclosing query.  The plan runs in the transaction of the
+// enclosing query, which is set by the [SubqueryOp] at the root of the enclosing
+// query's plan.
+type subqueryPlan struct {
+	op     Operator
+	params []*paramExpr
+	tid    *Transaction
+	run    int // incremented each time the enclosing query runs, invalidating cached results
+}
+
+// subqueryResult runs a subquery plan for records of the enclosing query.  The
+// results for the most recent values of the parameters are cached, so that an
+// uncorrelated subquery runs once per query.
+type subqueryResult struct {
+	plan  *subqueryPlan
+	outer []Expr // the values of the plan's parameters, over records of the enclosing query
+	limit int    // the number of results that are needed, or -1 for all of them
+
+	cached    bool
+	cachedRun int
+	cachedKey []DBValue
+	results   []*Tuple
+}
+
+func newSubqueryResult(plan *subqueryPlan, outer []Expr, limit int) *subqueryResult {
+	return &subqueryResult{plan: plan, outer: outer, limit: limit}
+}
+
+// Returns true if the values are the same, treating NULLs as equal.
+func sameValues(v1 []DBValue, v2 []DBValue) bool {
+	for i := range v1 {
+		if v1[i] == nil || v2[i] == nil {
+			if v1[i] != v2[i] {
+				return false
+			}
+			continue
+		}
+		if eq, err := compareValues(v1[i], v2[i], OpEq); err != nil || !eq {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns up to limit results of the subquery for the record t of the enclosing query.
+func (s *subqueryResult) rows(t *Tuple) ([]*Tuple, error) {
+	key := make([]DBValue, len(s.outer))
+	for i, e := range s.outer {
+		v, err := e.EvalExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		key[i] = v
+	}
+	if s.cached && s.cachedRun == s.plan.run && sameValues(key, s.cachedKey) {
+		return s.results, nil
+	}
+	if s.plan.tid == nil {
+		return nil, ailikeError{IllegalTransactionError, "subquery evaluated outside of a transaction"}
+	}
+	for i, p := range s.plan.params {
+		p.value = key[i]
+	}
+	iter, err := s.plan.op.Iterator(s.plan.tid)
+	if err != nil {
+		return nil, err
+	}
+	var results []*Tuple
+	for s.limit < 0 || len(results) < s.limit {
+		tup, err := iter()
+		if err != nil {
+			return nil, err
+		}
+		if tup == nil {
+			break
+		}
+		results = append(results, tup)
+	}
+	s.cached, s.cachedRun, s.cachedKey, s.results = true, s.plan.run, key, results
+	return results, nil
+}
+
+// scalarSubqueryExpr is a subquery that returns a single column, used as a value.
+// It is NULL if the subquery returns no records, and an error if it returns more
+// than one.
+type scalarSubqueryExpr struct {
+	*subqueryResult
+}
+
+func newScalarSubqueryExpr(plan *subqueryPlan, outer []Expr) (*scalarSubqueryExpr, error) {
+	if len(plan.op.Descriptor().Fields) != 1 {
+		return nil, ailikeError{ParseError, "a subquery used as a value must return a single column"}
+	}
+	return &scalarSubqueryExpr{newSubqueryResult(plan, outer, 2)}, nil
+}
+
+func (e *scalarSubqueryExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	results, err := e.rows(t)
+	if err != nil {
+		return nil, err
+	}
+	switch len(results) {
+	case 0:
+		return nil, nil
+	case 1:
+		return results[0].Fields[0], nil
+	}
+	return nil, ailikeError{IllegalOperationError, "a subquery used as a value returned more than one record"}
+}
+
+func (e *scalarSubqueryExpr) GetExprType() FieldType {
+	return e.plan.op.Descriptor().Fields[0]
+}
+
+// ExistsExpr holds if its subquery returns any records.
+type ExistsExpr struct {
+	*subqueryResult
+}
+
+func newExistsExpr(plan *subqueryPlan, outer []Expr) *ExistsExpr {
+	return &ExistsExpr{newSubqueryResult(plan, outer, 1)}
+}
+
+func (e *ExistsExpr) evalLogic(t *Tuple) (logicValue, error) {
+	results, err := e.rows(t)
+	return boolToLogic(len(results) > 0), err
+}
+
+func (e *ExistsExpr) EvalBool(t *Tuple) (bool, error) {
+	return evalPredicateBool(e, t)
+}
+
+func (e *ExistsExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	return evalPredicateExpr(e, t)
+}
+
+func (e *ExistsExpr) GetExprType() FieldType {
+	return predicateType
+}
+
+// InSubqueryExpr holds if the value of left is among the results of a subquery
+// that returns a single column.  Like IN with a list of values, it is unknown
+// rather than false if the value is NULL, or if no result matches and one of
+// them is NULL.
+type InSubqueryExpr struct {
+	*subqueryResult
+	left    Expr
+	negated bool
+}
+
+func newInSubqueryExpr(left Expr, plan *subqueryPlan, outer []Expr, negated bool) (*InSubqueryExpr, error) {
+	desc := plan.op.Descriptor()
+	if len(desc.Fields) != 1 {
+		return nil, ailikeError{ParseError, "a subquery used with IN must return a single column"}
+	}
+	if !comparableTypes(left.GetExprType().Ftype, desc.Fields[0].Ftype) {
+		return nil, ailikeError{IncompatibleTypesError, fmt.Sprintf("cannot compare %s to %s", typeNames[left.GetExprType().Ftype], typeNames[desc.Fields[0].Ftype])}
+	}
+	return &InSubqueryExpr{newSubqueryResult(plan, outer, -1), left, negated}, nil
+}
+
+func (e *InSubqueryExpr) evalLogic(t *Tuple) (logicValue, error) {
+	v, err := e.left.EvalExpr(t)
+	if err != nil {
+		return logicFalse, err
+	}
+	results, err := e.rows(t)
+	if err != nil {
+		return logicFalse, err
+	}
+	result := logicFalse
+	if v == nil && len(results) > 0 {
+		result = logicUnknown
+	}
+	for i := 0; v != nil && i < len(results) && result != logicTrue; i++ {
+		r := results[i].Fields[0]
+		if r == nil {
+			result = logicUnknown
+			continue
+		}
+		eq, err := compareValues(v, r, OpEq)
+		if err != nil {
+			return logicFalse, err
+		}
+		if eq {
+			result = logicTrue
+		}
+	}
+	if e.negated {
+		return result.not(), nil
+	}
+	return result, nil
+}
+
+func (e *InSubqueryExpr) EvalBool(t *Tuple) (bool, error) {
+	return evalPredicateBool(e, t)
+}
+
+func (e *InSubqueryExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	return evalPredicateExpr(e, t)
+}
+
+func (e *InSubqueryExpr) GetExprType() FieldType {
+	return predicateType
+}
+
+// SubqueryOp returns the results of its child, whose expressions include
+// subqueries, and runs the subqueries in the same transaction as the child.
+type SubqueryOp struct {
+	child      Operator
+	subqueries []*subqueryPlan
+}
+
+func NewSubqueryOp(child Operator, subqueries []*subqueryPlan) *SubqueryOp {
+	return &SubqueryOp{child, subqueries}
+}
+
+func (op *SubqueryOp) Descriptor() *TupleDesc {
+	return op.child.Descriptor()
+}
+
+func (op *SubqueryOp) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
+	for _, s := range op.subqueries {
+		s.tid = tid
+		s.run++
+	}
+	return op.child.Iterator(tid)
+}
@@ -0,0 +1,261 @@
+package godb
+
+import (
+	"testing"
+)
+
+// Returns the join type of the first semi or anti join in the plan, or
+// InnerJoin if there is none.
+func semiJoinType(plan Operator) JoinType {
+	joinType := InnerJoin
+	planHas(plan, func(op Operator) bool {
+		if j, ok := op.(*EqualityJoin[int64]); ok && j.joinType.filtersLeft() {
+			joinType = j.joinType
+		}
+		if j, ok := op.(*EqualityJoin[string]); ok && j.joinType.filtersLeft() {
+			joinType = j.joinType
+		}
+		return joinType != InnerJoin
+	})
+	return joinType
+}
+
+// Runs the query, and returns the error it fails with, if any.
+func queryError(c *Catalog, bp *BufferPool, sql string) error {
+	_, plan, err := Parse(c, sql)
+	if err != nil {
+		return err
+	}
+	tid := bp.Transactions().Begin()
+	defer tid.Commit()
+	iter, err := plan.Iterator(tid)
+	if err != nil {
+		return err
+	}
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestScalarSubquery(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	isSubqueryOp := func(op Operator) bool { _, ok := op.(*SubqueryOp); return ok }
+
+	plan, vals := sortedIntColumn(t, c, bp, "select r_id from r where r_id > (select max(s_id) from s)")
+	if len(vals) != 450 || vals[0] != 50 {
+		t.Errorf("expected the 450 records above the maximum of the subquery, got %d", len(vals))
+	}
+	if !planHas(plan, isSubqueryOp) {
+		t.Errorf("expected the subquery to run in the query's transaction")
+	}
+	// the subquery is a value in the select list, and may be an argument of an expression
+	_, rows := queryRows(t, c, bp, "select t_id, (select count(*) from s) - t_id as n from t")
+	if len(rows) != 5 {
+		t.Fatalf("expected 5 results, got %d", len(rows))
+	}
+	for _, row := range rows {
+		if row[1].(IntField).Value != 50-row[0].(IntField).Value {
+			t.Errorf("expected 50 - %v, got %v", row[0], row[1])
+		}
+	}
+
+	// a correlated subquery is evaluated for each record
+	_, rows = queryRows(t, c, bp, "select s_id, (select count(*) from r where r.s_id = s.s_id) from s")
+	if len(rows) != 50 {
+		t.Fatalf("expected 50 results, got %d", len(rows))
+	}
+	for _, row := range rows {
+		if row[1].(IntField).Value != 10 {
+			t.Errorf("expected 10 records of r for s_id %v, got %v", row[0], row[1])
+		}
+	}
+	_, vals = sortedIntColumn(t, c, bp, "select t_id from t where t_id = (select max(s_id) from s where s.t_id = t.t_id and s_id < 20)")
+	if len(vals) != 0 {
+		t.Errorf("expected no results, got %v", vals)
+	}
+	_, vals = sortedIntColumn(t, c, bp, "select s_id from s where s_id = (select max(s_id) from s s2 where s2.t_id = s.t_id)")
+	if len(vals) != 5 || vals[0] != 45 || vals[4] != 49 {
+		t.Errorf("expected the maximum s_id of each t_id, got %v", vals)
+	}
+
+	// a subquery without results is NULL, and one with more than one is an error
+	_, rows = queryRows(t, c, bp, "select t_id, (select s_id from s where s_id > 100) from t")
+	if len(rows) != 5 || countNulls(rows, 1) != 5 {
+		t.Errorf("expected NULL for a subquery without results")
+	}
+	if err := queryError(c, bp, "select r_id from r where r_id = (select s_id from s)"); err == nil {
+		t.Errorf("expected an error for a subquery with more than one result")
+	}
+	if err := queryError(c, bp, "select r_id from r where r_id = (select s_id, t_id from s where s_id = 1)"); err == nil {
+		t.Errorf("expected an error for a subquery with more than one column")
+	}
+}
+
+func TestInSubquery(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+
+	// IN is decorrelated into a semi join
+	plan, vals := sortedIntColumn(t, c, bp, "select r_id from r where s_id in (select s_id from s where t_id = 0)")
+	if len(vals) != 100 {
+		t.Errorf("expected 100 results, got %d", len(vals))
+	}
+	if semiJoinType(plan) != SemiJoin {
+		t.Errorf("expected IN to be a semi join")
+	}
+	for _, v := range vals {
+		if v%5 != 0 {
+			t.Fatalf("unexpected result %d", v)
+		}
+	}
+	plan, vals = sortedIntColumn(t, c, bp, "select r_id from r where s_id not in (select s_id from s where t_id = 0)")
+	if len(vals) != 400 {
+		t.Errorf("expected 400 results, got %d", len(vals))
+	}
+	if semiJoinType(plan) != NullAwareAntiJoin {
+		t.Errorf("expected NOT IN to be a null-aware anti join")
+	}
+
+	// with a field of the enclosing query, the join is on both the operand and the field
+	plan, vals = sortedIntColumn(t, c, bp, "select r_id from r where r_id in (select s.s_id from s where s.t_id = r.s_id)")
+	if len(vals) != 5 || vals[4] != 4 {
+		t.Errorf("expected r_id 0 to 4, got %v", vals)
+	}
+	if semiJoinType(plan) != SemiJoin {
+		t.Errorf("expected a correlated IN to be a semi join")
+	}
+
+	// NOT IN is unknown if the subquery returns a NULL, or the operand is NULL
+	runIntColumnQuery(t, c, bp, "update s set t_id = null where s_id = 3", 0)
+	runIntColumnQuery(t, c, bp, "update r set s_id = null where r_id = 0", 0)
+	_, vals = sortedIntColumn(t, c, bp, "select r_id from r where r_id not in (select t_id from s)")
+	if len(vals) != 0 {
+		t.Errorf("expected no results of NOT IN a subquery with NULLs, got %d", len(vals))
+	}
+	_, vals = sortedIntColumn(t, c, bp, "select r_id from r where r_id not in (select t_id from s where t_id is not null)")
+	if len(vals) != 495 {
+		t.Errorf("expected 495 results, got %d", len(vals))
+	}
+	_, vals = sortedIntColumn(t, c, bp, "select r_id from r where s_id not in (select s_id from s where s_id > 0)")
+	if len(vals) != 9 {
+		t.Errorf("expected the 9 records with s_id 0 but not the one with a NULL s_id, got %d", len(vals))
+	}
+	_, vals = sortedIntColumn(t, c, bp, "select r_id from r where s_id not in (select s_id from s where s_id > 100)")
+	if len(vals) != 500 {
+		t.Errorf("expected every record to be NOT IN an empty subquery, got %d", len(vals))
+	}
+
+	// IN inside a disjunction is evaluated for each record, with the same results
+	plan, vals = sortedIntColumn(t, c, bp, "select r_id from r where r_id < 2 or s_id in (select s_id from s where t_id = 0)")
+	if len(vals) != 101 {
+		t.Errorf("expected 101 results, got %d", len(vals))
+	}
+	if semiJoinType(plan) != InnerJoin {
+		t.Errorf("expected IN in a disjunction to be evaluated as a predicate")
+	}
+	_, vals = sortedIntColumn(t, c, bp, "select r_id from r where not (r_id not in (select t_id from s where t_id is not null) or r_id > 2)")
+	if len(vals) != 3 {
+		t.Errorf("expected 3 results, got %d", len(vals))
+	}
+}
+
+func TestExistsSubquery(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+
+	plan, vals := sortedIntColumn(t, c, bp, "select s_id from s where exists (select * from r where r.s_id = s.s_id and r.r_id < 20)")
+	if len(vals) != 20 || vals[19] != 19 {
+		t.Errorf("expected s_id 0 to 19, got %v", vals)
+	}
+	if semiJoinType(plan) != SemiJoin {
+		t.Errorf("expected EXISTS to be a semi join")
+	}
+	plan, vals = sortedIntColumn(t, c, bp, "select s_id from s where not exists (select r_id from r where s.s_id = r.s_id and r.r_id < 20)")
+	if len(vals) != 30 || vals[0] != 20 {
+		t.Errorf("expected s_id 20 to 49, got %v", vals)
+	}
+	if semiJoinType(plan) != AntiJoin {
+		t.Errorf("expected NOT EXISTS to be an anti join")
+	}
+	// an unqualified name refers to the subquery's tables before the enclosing query's
+	_, vals = sortedIntColumn(t, c, bp, "select t_id from t where exists (select * from s where t_id = t.t_id and s_id = 7)")
+	if len(vals) != 1 || vals[0] != 2 {
+		t.Errorf("expected t_id 2, got %v", vals)
+	}
+
+	// an uncorrelated subquery is evaluated once
+	_, vals = sortedIntColumn(t, c, bp, "select s_id from s where exists (select * from t where t_id > 10)")
+	if len(vals) != 0 {
+		t.Errorf("expected no results, got %d", len(vals))
+	}
+	_, vals = sortedIntColumn(t, c, bp, "select s_id from s where exists (select * from t where t_id > 1)")
+	if len(vals) != 50 {
+		t.Errorf("expected 50 results, got %d", len(vals))
+	}
+
+	// a correlation other than equality cannot be decorrelated
+	plan, vals = sortedIntColumn(t, c, bp, "select s_id from s where exists (select * from r where r.s_id = s.s_id and r.r_id < s.s_id + 50)")
+	if len(vals) != 50 {
+		t.Errorf("expected 50 results, got %d", len(vals))
+	}
+	if semiJoinType(plan) != InnerJoin {
+		t.Errorf("expected a subquery correlated by an inequality to be evaluated for each record")
+	}
+	_, vals = sortedIntColumn(t, c, bp, "select s_id from s where exists (select * from r where r.s_id = s.s_id and r.r_id < s.s_id * 2)")
+	if len(vals) != 49 {
+		t.Errorf("expected 49 results, got %d", len(vals))
+	}
+
+	// subqueries may be nested, and refer to any enclosing query
+	_, vals = sortedIntColumn(t, c, bp, "select t_id from t where exists (select * from s where s.t_id = t.t_id and exists (select * from r where r.s_id = s.s_id and r.r_id = t.t_id + 100))")
+	if len(vals) != 5 {
+		t.Errorf("expected 5 results of nested subqueries, got %v", vals)
+	}
+
+	// subqueries also apply to deletes
+	runIntColumnQuery(t, c, bp, "delete from r where exists (select * from s where s.s_id = r.s_id and s.t_id = 0)", 0)
+	_, vals = sortedIntColumn(t, c, bp, "select r_id from r")
+	if len(vals) != 400 {
+		t.Errorf("expected 400 records after the delete, got %d", len(vals))
+	}
+}
+
+func TestWithClause(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+
+	_, vals := sortedIntColumn(t, c, bp, "with big as (select s_id from s where s_id >= 40) select r.r_id from r join big on r.s_id = big.s_id")
+	if len(vals) != 100 {
+		t.Errorf("expected 100 results, got %d", len(vals))
+	}
+	// a common table expression can name its columns and refer to earlier ones
+	_, vals = sortedIntColumn(t, c, bp, "WITH a(id) AS (select s_id from s where t_id = 0), b AS (select id from a where id < 20) select id from b")
+	if len(vals) != 4 || vals[3] != 15 {
+		t.Errorf("expected 0, 5, 10 and 15, got %v", vals)
+	}
+	// it can be referenced more than once, and in subqueries
+	_, vals = sortedIntColumn(t, c, bp, "with a as (select s_id from s) select x.s_id from a x join a y on x.s_id = y.s_id")
+	if len(vals) != 50 {
+		t.Errorf("expected 50 results, got %d", len(vals))
+	}
+	_, vals = sortedIntColumn(t, c, bp, "with a as (select s_id from s where t_id = 1) select r_id from r where s_id in (select s_id from a)")
+	if len(vals) != 100 {
+		t.Errorf("expected 100 results, got %d", len(vals))
+	}
+	// a common table expression can have the name of a table that it reads
+	_, vals = sortedIntColumn(t, c, bp, "with s as (select s_id from s where s_id < 3) select s_id from s")
+	if len(vals) != 3 {
+		t.Errorf("expected 3 results, got %d", len(vals))
+	}
+
+	for _, sql := range []string{
+		"with a as (select s_id from s), a as (select s_id from s) select s_id from a",
+		"with a(x, y) as (select s_id from s) select x from a",
+		"with a as select s_id from s select s_id from a",
+		"with a as (select s_id from s select s_id from a",
+	} {
+		if _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected an error parsing %s", sql)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package godb
+
+import "os"
+
+// A tempFile is a heap file of intermediate results, such as the sorted runs of
+// an external sort or the partitions of a grace hash join, that is private to one
+// operator and deleted once it has been read, or, if its operator's consumer
+// stops before the end, e.g. above a LIMIT, once the transaction it was created
+// for completes.  Its pages are read and written
+// through the buffer pool, but each page is written out as soon as it is full,
+// so that the file does not fill the buffer pool with dirty pages.
+type tempFile struct {
+	*HeapFile
+	pageNo int // the page being filled, or -1 if no tuples have been appended
+}
+
+// Creates an empty temporary file for tuples with the given descriptor in the
+// system's temporary directory, which is deleted when tid completes, if it has
+// not been deleted before.  The file name is made from pattern as by
+// [os.CreateTemp].
+func newTempFile(desc *TupleDesc, bp *BufferPool, pattern string, tid *Transaction) (*tempFile, error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return nil, ailikeError{OSError, err.Error()}
+	}
+	f.Close()
+	hf, err := NewHeapFile(f.Name(), desc, bp)
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	hf.unlogged = true
+	hf.unversioned = true
+	tf := &tempFile{hf, -1}
+	tid.onFinish(func() { tf.remove() })
+	return tf, nil
+}
+
+// Returns true if tuples with the given descriptor can be written to a heap file.
+func canSpill(desc *TupleDesc) bool {
+	for _, f := range desc.Fields {
+		switch f.Ftype {
+		case IntType, StringType, EmbeddedStringType, VectorFieldType, FloatType:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Appends t to the end of the file.  Once the last page is full, it is written
+// out and a new page is started.
+func (f *tempFile) append(t *Tuple, tid *Transaction) error {
+	var err error
+	if f.pageNo >= 0 {
+		err = f.insertTupleIntoPage(t, f.pageNo, tid)
+		if err == nil || err.(ailikeError).code != PageFullError {
+			return err
+		}
+	}
+	if err := f.bufPool.releaseFile(f); err != nil {
+		return err
+	}
+	f.pageNo, err = f.insertTupleIntoNewPage(t, tid)
+	return err
+}
+
+// Writes out the last page of the file, once all of its tuples have been appended.
+func (f *tempFile) finish() error {
+	return f.bufPool.releaseFile(f)
+}
+
+// Removes the pages of the file from the buffer pool and deletes it.  Deleting
+// a file that was already deleted does nothing.
+func (f *tempFile) remove() error {
+	if err := f.bufPool.releaseFile(f); err != nil {
+		return err
+	}
+	if err := sharedFiles.remove(f.fileName); err != nil && !os.IsNotExist(err) {
+		return ailikeError{OSError, err.Error()}
+	}
+	return nil
+}
+
+// Deletes the files, returning the first error encountered.
+func removeTempFiles(files []*tempFile) error {
+	var firstErr error
+	for _, f := range files {
+		if err := f.remove(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
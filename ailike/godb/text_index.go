@@ -0,0 +1,498 @@
+package godb
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// TupleDesc for the heap file that stores the postings of the inverted index;
+// one row per (term, record) pair, along with the frequency of the term in the record.
+var postingsDesc = TupleDesc{Fields: []FieldType{
+	{Fname: "term", Ftype: StringType},
+	{Fname: "tablePageNo", Ftype: IntType},
+	{Fname: "slotNo", Ftype: IntType},
+	{Fname: "tf", Ftype: IntType},
+}}
+
+// TupleDesc for the heap file that stores the number of terms of every indexed record.
+var docsDesc = TupleDesc{Fields: []FieldType{
+	{Fname: "tablePageNo", Ftype: IntType},
+	{Fname: "slotNo", Ftype: IntType},
+	{Fname: "docLen", Ftype: IntType},
+}}
+
+// An indexed record in the in-memory copy of a text index: the frequency of
+// each of its terms, its length, and the records of the postings and docs
+// files that store them, so that deleting it does not scan those files.
+type textRecord struct {
+	tfs         map[string]int
+	docLen      int
+	postingRids []heapRecordId
+	docRid      heapRecordId
+	xmin        int64 // the transaction that inserted the record, or 0 if it was read from the files
+}
+
+// TextIndexFile is an inverted index over the words of a StringField or
+// EmbeddedStringField column, used to rank rows by BM25.  Its in-memory copy
+// is shared by the transactions using it: records inserted by a transaction
+// are only scored for the transactions that see it, but records deleted by a
+// transaction are removed at once, also for transactions with earlier
+// snapshots, and the corpus statistics include every change.
+type TextIndexFile struct {
+	sourceTableFilename string // the filename of the table this is an index for
+	indexedColName      string // the name of the column being indexed
+	// We use a heap file to store the term <-> heapRecordId postings
+	postingsHeapFile *HeapFile
+	// We use another heap file to store the length (in terms) of every indexed record
+	docsHeapFile *HeapFile
+
+	// In-memory copy of the index, populated on first use by load
+	mutex    sync.Mutex
+	loaded   bool
+	postings map[string]map[heapRecordId]int // the frequency of each term in each record containing it
+	records  map[heapRecordId]*textRecord
+	totalLen int
+	// how to undo the changes each active transaction made to the in-memory
+	// copy, in the order they were made
+	undo map[int64][]func()
+}
+
+// Create a TextIndexFile, or return the one already open on bp for the same
+// files, whose in-memory copy is kept up to date by the writes through it.
+// Parameters
+// - sourceTableFilename: the filename for the HeapFile for the Table that this index is for.
+// - indexedColName: the column in the table that is indexed
+// - fromPostingsFile: the backing file for the term <-> heapRecordId postings
+// - fromDocsFile: the backing file for the record lengths
+// - bp: the BufferPool that is used to store pages read from this index
+// May return an error if the files cannot be opened or created.
+func NewTextIndexFile(sourceTableFilename string, indexedColName string, fromPostingsFile string, fromDocsFile string, bp *BufferPool) (*TextIndexFile, error) {
+	bp.textLatch.Lock()
+	defer bp.textLatch.Unlock()
+	if index, ok := bp.textIndexes[fromPostingsFile]; ok && index.sourceTableFilename == sourceTableFilename &&
+		index.indexedColName == indexedColName && index.docsHeapFile.fileName == fromDocsFile {
+		return index, nil
+	}
+	postingsHeapFile, err := NewHeapFile(fromPostingsFile, &postingsDesc, bp)
+	if err != nil {
+		return nil, err
+	}
+	docsHeapFile, err := NewHeapFile(fromDocsFile, &docsDesc, bp)
+	if err != nil {
+		return nil, err
+	}
+	markIndexFiles(postingsHeapFile, docsHeapFile)
+	index := &TextIndexFile{sourceTableFilename: sourceTableFilename, indexedColName: indexedColName,
+		postingsHeapFile: postingsHeapFile, docsHeapFile: docsHeapFile}
+	bp.textIndexes[fromPostingsFile] = index
+	return index, nil
+}
+
+// Closes the text index open on bp with the given postings file, if any, so
+// that it is opened again from its files.
+func forgetTextIndex(postingsFileName string, bp *BufferPool) {
+	bp.textLatch.Lock()
+	defer bp.textLatch.Unlock()
+	delete(bp.textIndexes, postingsFileName)
+}
+
+// Split text into lower case terms. Letters and digits form terms; '#' and '@' are
+// kept so that hashtags and user names can be matched exactly. Terms are truncated
+// to the whole characters that fit in StringLength bytes, as that is what fits
+// into the postings file.
+func tokenizeText(text string) []string {
+	terms := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '#' || r == '@')
+	})
+	for i, term := range terms {
+		if len(term) > StringLength {
+			end := StringLength
+			for end > 0 && !utf8.RuneStart(term[end]) {
+				end--
+			}
+			terms[i] = term[:end]
+		}
+	}
+	return terms
+}
+
+// Returns the text stored in a StringField or EmbeddedStringField.
+func textOfField(v DBValue) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		// NULL has no terms
+		return "", nil
+	case StringField:
+		return v.Value, nil
+	case EmbeddedStringField:
+		return v.Value, nil
+	}
+	return "", ailikeError{TypeMismatchError, "text index can only be used on string or text fields"}
+}
+
+func termFrequencies(terms []string) map[string]int {
+	tfs := make(map[string]int)
+	for _, term := range terms {
+		tfs[term]++
+	}
+	return tfs
+}
+
+// Returns true if the postings and record lengths have been read into memory.
+func (f *TextIndexFile) isLoaded() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.loaded
+}
+
+// Read the postings and record lengths into memory, if they have not been read yet.
+func (f *TextIndexFile) load(tid *Transaction) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.loaded {
+		return nil
+	}
+	f.postings = make(map[string]map[heapRecordId]int)
+	f.records = make(map[heapRecordId]*textRecord)
+	f.totalLen = 0
+
+	iter, err := f.docsHeapFile.Iterator(tid)
+	if err != nil {
+		return err
+	}
+	for t, err := iter(); t != nil || err != nil; t, err = iter() {
+		if err != nil {
+			return err
+		}
+		rid := heapRecordId{f.sourceTableFilename, int(t.Fields[0].(IntField).Value), int(t.Fields[1].(IntField).Value)}
+		f.addRecord(rid, &textRecord{tfs: make(map[string]int), docLen: int(t.Fields[2].(IntField).Value), docRid: t.Rid.(heapRecordId)})
+	}
+
+	iter, err = f.postingsHeapFile.Iterator(tid)
+	if err != nil {
+		return err
+	}
+	for t, err := iter(); t != nil || err != nil; t, err = iter() {
+		if err != nil {
+			return err
+		}
+		term := t.Fields[0].(StringField).Value
+		rid := heapRecordId{f.sourceTableFilename, int(t.Fields[1].(IntField).Value), int(t.Fields[2].(IntField).Value)}
+		rec, ok := f.records[rid]
+		if !ok {
+			// postings of a record without a length are never scored
+			continue
+		}
+		tf := int(t.Fields[3].(IntField).Value)
+		rec.tfs[term] = tf
+		rec.postingRids = append(rec.postingRids, t.Rid.(heapRecordId))
+		f.addPosting(term, rid, tf)
+	}
+	f.loaded = true
+	return nil
+}
+
+// Return the number of records in the index
+func (f *TextIndexFile) NumDocs() int {
+	return len(f.records)
+}
+
+func (f *TextIndexFile) avgDocLen() float64 {
+	if len(f.records) == 0 {
+		return 0.0
+	}
+	return float64(f.totalLen) / float64(len(f.records))
+}
+
+// Inverse document frequency of a term; assumes the index has been loaded.
+func (f *TextIndexFile) idf(term string) float64 {
+	n := float64(len(f.records))
+	df := float64(len(f.postings[term]))
+	return math.Log(1.0 + (n-df+0.5)/(df+0.5))
+}
+
+// BM25 contribution of a single term with frequency tf in a record with docLen terms.
+func (f *TextIndexFile) termScore(term string, tf int, docLen int) float64 {
+	avgDocLen := f.avgDocLen()
+	norm := 1.0
+	if avgDocLen > 0 {
+		norm = 1.0 - BM25B + BM25B*float64(docLen)/avgDocLen
+	}
+	return f.idf(term) * float64(tf) * (BM25K1 + 1.0) / (float64(tf) + BM25K1*norm)
+}
+
+// Compute the BM25 score of the given text for the query terms, using the
+// corpus statistics of the index. The index must have been loaded.
+func (f *TextIndexFile) scoreText(queryTerms []string, text string) float64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	terms := tokenizeText(text)
+	tfs := termFrequencies(terms)
+	score := 0.0
+	for _, term := range queryTerms {
+		if tf, ok := tfs[term]; ok {
+			score += f.termScore(term, tf, len(terms))
+		}
+	}
+	return score
+}
+
+// Returns true if text contains at least one of the query terms, i.e., if its
+// BM25 score for them is above 0.
+func containsAnyTerm(queryTerms []string, text string) bool {
+	tfs := termFrequencies(tokenizeText(text))
+	for _, term := range queryTerms {
+		if _, ok := tfs[term]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Compute the BM25 score of every record visible to tid that contains at least
+// one of the query terms, using the postings lists. The index must have been
+// loaded.
+func (f *TextIndexFile) scoreRecords(queryTerms []string, tid *Transaction) map[heapRecordId]float64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	scores := make(map[heapRecordId]float64)
+	for _, term := range queryTerms {
+		for rid, tf := range f.postings[term] {
+			rec := f.records[rid]
+			if !tid.sees(rec.xmin) {
+				continue
+			}
+			scores[rid] += f.termScore(term, tf, rec.docLen)
+		}
+	}
+	return scores
+}
+
+// Add the postings for the tuple t to the index; t.Rid must already be set.
+func (f *TextIndexFile) insertTuple(t *Tuple, tid *Transaction) error {
+	rid, ok := t.Rid.(heapRecordId)
+	if !ok || rid.fileName != f.sourceTableFilename {
+		return ailikeError{IncompatibleTypesError, "Index does not match table of tuple."}
+	}
+	colIndex, err := findFieldInTd(FieldType{Fname: f.indexedColName}, &t.Desc)
+	if err != nil {
+		return ailikeError{IncompatibleTypesError, "Given tuple does not contain indexed column."}
+	}
+	text, err := textOfField(t.Fields[colIndex])
+	if err != nil {
+		return err
+	}
+	// the in-memory copy is read before it is changed, so that it never
+	// includes the changes of tid, which it could not undo
+	if err := f.load(tid); err != nil {
+		return err
+	}
+	terms := tokenizeText(text)
+	rec := &textRecord{tfs: termFrequencies(terms), docLen: len(terms), xmin: tid.id}
+	for term, tf := range rec.tfs {
+		pt := Tuple{Desc: postingsDesc, Fields: []DBValue{StringField{term}, IntField{int64(rid.pageNo)}, IntField{int64(rid.slotNo)}, IntField{int64(tf)}}}
+		err = f.postingsHeapFile.insertTuple(&pt, tid)
+		if err != nil {
+			return err
+		}
+		rec.postingRids = append(rec.postingRids, pt.Rid.(heapRecordId))
+	}
+	dt := Tuple{Desc: docsDesc, Fields: []DBValue{IntField{int64(rid.pageNo)}, IntField{int64(rid.slotNo)}, IntField{int64(len(terms))}}}
+	err = f.docsHeapFile.insertTuple(&dt, tid)
+	if err != nil {
+		return err
+	}
+	rec.docRid = dt.Rid.(heapRecordId)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.addRecord(rid, rec)
+	f.logUndo(tid, func() { f.removeRecord(rid) })
+	return nil
+}
+
+// Remove the postings of the tuple t from the index, reading only the pages
+// of the postings and docs files that hold them.
+func (f *TextIndexFile) deleteTuple(t *Tuple, tid *Transaction) error {
+	rid, ok := t.Rid.(heapRecordId)
+	if !ok || rid.fileName != f.sourceTableFilename {
+		return ailikeError{TupleNotFoundError, "Tuple does not exist within this index."}
+	}
+	if err := f.load(tid); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	rec, ok := f.records[rid]
+	f.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	for _, postingRid := range rec.postingRids {
+		if err := deleteRecordAt(f.postingsHeapFile, postingRid, tid); err != nil {
+			return err
+		}
+	}
+	if err := deleteRecordAt(f.docsHeapFile, rec.docRid, tid); err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if rec := f.removeRecord(rid); rec != nil {
+		f.logUndo(tid, func() { f.addRecord(rid, rec) })
+	}
+	return nil
+}
+
+// Deletes the record of file with the given rid.
+func deleteRecordAt(file *HeapFile, rid heapRecordId, tid *Transaction) error {
+	t, err := file.findTuple(rid, tid)
+	if err != nil {
+		return err
+	}
+	return file.deleteTuple(t, tid)
+}
+
+// Adds the record with the given rid to the in-memory copy of the index; the
+// caller holds f.mutex.
+func (f *TextIndexFile) addRecord(rid heapRecordId, rec *textRecord) {
+	for term, tf := range rec.tfs {
+		f.addPosting(term, rid, tf)
+	}
+	f.records[rid] = rec
+	f.totalLen += rec.docLen
+}
+
+func (f *TextIndexFile) addPosting(term string, rid heapRecordId, tf int) {
+	postings, ok := f.postings[term]
+	if !ok {
+		postings = make(map[heapRecordId]int)
+		f.postings[term] = postings
+	}
+	postings[rid] = tf
+}
+
+// Removes the record with the given rid from the in-memory copy of the index,
+// returning it, or nil if it is not indexed; the caller holds f.mutex.
+func (f *TextIndexFile) removeRecord(rid heapRecordId) *textRecord {
+	rec, ok := f.records[rid]
+	if !ok {
+		return nil
+	}
+	f.totalLen -= rec.docLen
+	delete(f.records, rid)
+	for term := range rec.tfs {
+		delete(f.postings[term], rid)
+		if len(f.postings[term]) == 0 {
+			delete(f.postings, term)
+		}
+	}
+	return rec
+}
+
+// Records how to undo a change tid made to the in-memory copy of the index,
+// should it abort; the caller holds f.mutex.
+func (f *TextIndexFile) logUndo(tid *Transaction, undo func()) {
+	if f.undo == nil {
+		f.undo = make(map[int64][]func())
+	}
+	if _, ok := f.undo[tid.id]; !ok {
+		tid.onFinish(func() { f.finish(tid) })
+	}
+	f.undo[tid.id] = append(f.undo[tid.id], undo)
+}
+
+// Undoes the changes of tid to the in-memory copy of the index, latest first,
+// if it aborted.
+func (f *TextIndexFile) finish(tid *Transaction) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	undo := f.undo[tid.id]
+	delete(f.undo, tid.id)
+	if tid.Status() != TransactionAborted {
+		return
+	}
+	for i := len(undo) - 1; i >= 0; i-- {
+		undo[i]()
+	}
+}
+
+// Creates an inverted text index for the given heap file column.
+// A TextIndexFile is stored by 2 heap files under the hood: a postings file and a docs file.
+//
+// NOTE: currently, constructing an index cannot be run cuncurrently with other transactions
+//
+// Parameters:
+// - hfile: the heap file to create an index for
+// - indexedColName: the column in hfile that the index is for; must be a string or text column
+// - dbPath: the path to store the index files under
+// - tableName:	the name of the table that the index is for
+// - bp: the buffer pool to use
+func ConstructTextIndexFileFromHeapFile(hfile *HeapFile, indexedColName string, dbPath string, tableName string, bp *BufferPool) (*TextIndexFile, error) {
+	colIndex, err := findFieldInTd(FieldType{Fname: indexedColName}, hfile.Descriptor())
+	if err != nil {
+		return nil, err
+	}
+	colType := hfile.Descriptor().Fields[colIndex].Ftype
+	if colType != StringType && colType != EmbeddedStringType {
+		return nil, ailikeError{TypeMismatchError, fmt.Sprintf("cannot build text index on non-text column %s", indexedColName)}
+	}
+
+	postingsFileName := fmt.Sprintf("%s/text__%s__%s__postings.dat", dbPath, tableName, indexedColName)
+	docsFileName := fmt.Sprintf("%s/text__%s__%s__docs.dat", dbPath, tableName, indexedColName)
+	forgetTextIndex(postingsFileName, bp)
+	sharedFiles.remove(postingsFileName)
+	sharedFiles.remove(docsFileName)
+
+	tif, err := NewTextIndexFile(hfile.fileName, indexedColName, postingsFileName, docsFileName, bp)
+	if err != nil {
+		return nil, err
+	}
+
+	tid := bp.Transactions().Begin()
+	// if the index cannot be built, abort its transaction so that it does not
+	// keep its locks, and stop stealing pages
+	defer func() {
+		if tid.Status() == TransactionActive {
+			tid.Abort()
+		}
+		bp.steal = false
+	}()
+
+	// allow stealing pages from the buffer pool, even if it has no log
+	// NOTE: cannot create indexes cuncurrently with other transactions
+	bp.steal = true
+
+	iter, err := hfile.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	for t, err := iter(); t != nil || err != nil; t, err = iter() {
+		if err != nil {
+			return nil, err
+		}
+		err = tif.insertTuple(t, tid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Println("Text index generation complete.")
+	fmt.Println("Text index file ", tif.postingsHeapFile.fileName, " has ", tif.postingsHeapFile.NumTuples(tid), " postings for ", tif.docsHeapFile.NumTuples(tid), "records.")
+
+	tid.Commit()
+	bp.FlushAllPages()
+	bp.steal = false
+	// nothing in the log before the index is needed to recover from a crash
+	if err := bp.Checkpoint(); err != nil {
+		return nil, err
+	}
+
+	hfile.textIndexes[indexedColName] = tif
+
+	return tif, nil
+}
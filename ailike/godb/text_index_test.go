@@ -0,0 +1,457 @@
+package godb
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// Copies the tweets test table into a fresh directory, and opens it through a catalog.
+func makeTweetsTestCatalog(t *testing.T) (*Catalog, *HeapFile, *BufferPool, string) {
+	dir := t.TempDir()
+	src, err := os.Open("tweets_test_noindex.dat")
+	if err != nil {
+		t.Fatalf("failed to open test table, %s", err.Error())
+	}
+	defer src.Close()
+	dst, err := os.Create(dir + "/tweets_test.dat")
+	if err != nil {
+		t.Fatalf("failed to create test table, %s", err.Error())
+	}
+	defer dst.Close()
+	if _, err = io.Copy(dst, src); err != nil {
+		t.Fatalf("failed to copy test table, %s", err.Error())
+	}
+	c, bp := makeTestCatalog(t, dir, "tweets_test (tweet_id int, sentiment string, content embtext)\n", 10)
+	dbFile, err := c.GetTable("tweets_test")
+	if err != nil {
+		t.Fatalf("failed to get table, %s", err.Error())
+	}
+	return c, dbFile.(*HeapFile), bp, dir
+}
+
+// Opens a copy of the tweets test table, and builds a text index on its content column.
+func makeTextIndexTestVars(t *testing.T) (*Catalog, *HeapFile, *BufferPool) {
+	c, hf, bp, dir := makeTweetsTestCatalog(t)
+	_, err := ConstructTextIndexFileFromHeapFile(hf, "content", dir, "tweets_test", bp)
+	if err != nil {
+		t.Fatalf("failed to construct text index, %s", err.Error())
+	}
+	return c, hf, bp
+}
+
+// Returns the number of tuples in hf whose content contains term
+func countTweetsWithTerm(t *testing.T, hf *HeapFile, term string) int {
+	tid := hf.bufPool.Transactions().Begin()
+	iter, err := hf.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	cnt := 0
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		for _, w := range tokenizeText(tup.Fields[2].(EmbeddedStringField).Value) {
+			if w == term {
+				cnt++
+				break
+			}
+		}
+	}
+	tid.Commit()
+	return cnt
+}
+
+func TestTokenizeText(t *testing.T) {
+	terms := tokenizeText("Re-pinging @ghostridah14: why didn't you go to PROM? #sad")
+	expected := []string{"re", "pinging", "@ghostridah14", "why", "didn", "t", "you", "go", "to", "prom", "#sad"}
+	if len(terms) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, terms)
+	}
+	for i := range terms {
+		if terms[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, terms)
+		}
+	}
+	long := tokenizeText(strings.Repeat("a", StringLength+10))
+	if len(long) != 1 || len(long[0]) != StringLength {
+		t.Errorf("expected long term to be truncated to %d characters", StringLength)
+	}
+	// a two byte character straddles the last byte, and is left out whole
+	accented := tokenizeText("a" + strings.Repeat("é", StringLength))
+	if len(accented) != 1 || !utf8.ValidString(accented[0]) || len(accented[0]) != StringLength-1 {
+		t.Errorf("expected a long term to be truncated to whole characters, got %q", accented)
+	}
+}
+
+func TestTextIndexScoreRecords(t *testing.T) {
+	_, hf, bp := makeTextIndexTestVars(t)
+	index := getTextIndexForField(FieldType{Fname: "content"}, hf)
+	if index == nil {
+		t.Fatalf("expected text index on content")
+	}
+	tid := bp.Transactions().Begin()
+	defer tid.Commit()
+	if err := index.load(tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if index.NumDocs() != 100 {
+		t.Errorf("expected 100 indexed records, got %d", index.NumDocs())
+	}
+
+	scores := index.scoreRecords([]string{"friday"}, tid)
+	if len(scores) != countTweetsWithTerm(t, hf, "friday") || len(scores) == 0 {
+		t.Fatalf("expected a score for each tweet containing friday, got %d", len(scores))
+	}
+	for rid, score := range scores {
+		if score <= 0 {
+			t.Errorf("expected positive score, got %f", score)
+		}
+		tup, err := hf.findTuple(rid, tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		text := tup.Fields[2].(EmbeddedStringField).Value
+		if index.scoreText([]string{"friday"}, text) != score {
+			t.Errorf("score from postings and from text differ for '%s'", text)
+		}
+	}
+
+	// a rare term should be worth more than a common one
+	if index.idf("funeral") <= index.idf("i") {
+		t.Errorf("expected rare term to have a larger idf")
+	}
+}
+
+func TestTextIndexReopenFromCatalog(t *testing.T) {
+	c, _, bp := makeTextIndexTestVars(t)
+	dbFile, err := c.GetTable("tweets_test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	hf := dbFile.(*HeapFile)
+	index := getTextIndexForField(FieldType{Fname: "content"}, hf)
+	if index == nil {
+		t.Fatalf("expected catalog to find text index on content")
+	}
+	if len(hf.indexes) != 0 {
+		t.Errorf("text index should not be loaded as a vector index")
+	}
+	tid := bp.Transactions().Begin()
+	defer tid.Commit()
+	if err := index.load(tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if index.NumDocs() != 100 {
+		t.Errorf("expected 100 indexed records, got %d", index.NumDocs())
+	}
+}
+
+// A term that appears in every record scores so little that its scaled BM25
+// score truncates to 0, but the records still match it.
+func TestTextMatchWeakTerm(t *testing.T) {
+	index := &TextIndexFile{loaded: true, postings: make(map[string]map[heapRecordId]int), records: make(map[heapRecordId]*textRecord)}
+	for i := 0; i < 10000; i++ {
+		index.addRecord(heapRecordId{pageNo: i, slotNo: 0}, &textRecord{tfs: map[string]int{"common": 1}, docLen: 1})
+	}
+	td := TupleDesc{Fields: []FieldType{{Fname: "content", Ftype: StringType}}}
+	field := &FieldExpr{td.Fields[0]}
+	tup := &Tuple{Desc: td, Fields: []DBValue{StringField{"common"}}}
+	if score, _ := NewBM25Expr(field, "common", index).EvalExpr(tup); score != (IntField{0}) {
+		t.Fatalf("expected the scaled score of a term in every record to truncate to 0, got %v", score)
+	}
+	if match, _ := NewTextMatchExpr(field, "common", index).EvalExpr(tup); match != (IntField{1}) {
+		t.Errorf("expected a record containing the term to match it, got %v", match)
+	}
+	other := &Tuple{Desc: td, Fields: []DBValue{StringField{"rare"}}}
+	if match, _ := NewTextMatchExpr(field, "common", index).EvalExpr(other); match != (IntField{0}) {
+		t.Errorf("expected a record without the term not to match it, got %v", match)
+	}
+}
+
+// A text index that cannot be opened fails the table, rather than leaving it
+// without the index.
+func TestTextIndexOpenError(t *testing.T) {
+	c, _, _, dir := makeTweetsTestCatalog(t)
+	// a link to itself cannot be opened
+	postings := dir + "/text__tweets_test__content__postings.dat"
+	if err := os.Symlink(postings, postings); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := os.WriteFile(dir+"/text__tweets_test__content__docs.dat", nil, 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := c.GetTable("tweets_test"); err == nil {
+		t.Errorf("expected an error opening a table whose text index cannot be opened")
+	}
+}
+
+func TestTextIndexInsertDelete(t *testing.T) {
+	_, hf, bp := makeTextIndexTestVars(t)
+	index := getTextIndexForField(FieldType{Fname: "content"}, hf)
+	tid := bp.Transactions().Begin()
+	defer tid.Commit()
+	if err := index.load(tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	tup := Tuple{Desc: *hf.Descriptor(), Fields: []DBValue{
+		IntField{1},
+		StringField{"happy"},
+		EmbeddedStringField{Value: "zebras zebras everywhere", Emb: make(EmbeddingType, TextEmbeddingDim)},
+	}}
+	// bypass insertTuple, which would need to compute an embedding
+	if _, err := hf.insertTupleIntoNewPage(&tup, tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	scores := index.scoreRecords([]string{"zebras"}, tid)
+	if len(scores) != 1 || scores[tup.Rid.(heapRecordId)] <= 0 {
+		t.Fatalf("expected inserted tuple to be found by the index, got %v", scores)
+	}
+
+	// only the pages holding the record's two postings and its length are
+	// read, rather than all of the index
+	read := tid.counters.indexPagesRead.Load()
+	if err := hf.deleteTuple(&tup, tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if n := tid.counters.indexPagesRead.Load() - read; n > 3*3 {
+		t.Errorf("expected the delete to read at most 3 pages per record of the index, read %d of %d", n, index.postingsHeapFile.NumPages()+index.docsHeapFile.NumPages())
+	}
+	if scores := index.scoreRecords([]string{"zebras"}, tid); len(scores) != 0 {
+		t.Fatalf("expected deleted tuple to be removed from the index, got %v", scores)
+	}
+	if index.NumDocs() != 100 {
+		t.Errorf("expected 100 indexed records, got %d", index.NumDocs())
+	}
+	// the postings file should be cleaned up too
+	iter, _ := index.postingsHeapFile.Iterator(tid)
+	for pt, err := iter(); pt != nil || err != nil; pt, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if pt.Fields[0].(StringField).Value == "zebras" {
+			t.Fatalf("expected posting for deleted tuple to be removed")
+		}
+	}
+}
+
+// The changes an aborted transaction made to the in-memory index are undone, so
+// that its postings and BM25 statistics match the table again.
+func TestTextIndexAbort(t *testing.T) {
+	_, hf, bp := makeTextIndexTestVars(t)
+	index := getTextIndexForField(FieldType{Fname: "content"}, hf)
+	tid := bp.Transactions().Begin()
+	if err := index.load(tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	before := index.scoreRecords([]string{"friday"}, tid)
+	avgDocLen := index.avgDocLen()
+	tid.Commit()
+
+	// a transaction inserts a record, deletes it again, and deletes a record
+	// that contains friday
+	tid = bp.Transactions().Begin()
+	tup := Tuple{Desc: *hf.Descriptor(), Fields: []DBValue{
+		IntField{1},
+		StringField{"happy"},
+		EmbeddedStringField{Value: "zebras on friday", Emb: make(EmbeddingType, TextEmbeddingDim)},
+	}}
+	// bypass insertTuple, which would need to compute an embedding
+	if _, err := hf.insertTupleIntoNewPage(&tup, tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := hf.deleteTuple(&tup, tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	var deleted heapRecordId
+	for rid := range before {
+		deleted = rid
+		break
+	}
+	old, err := hf.findTuple(deleted, tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := hf.deleteTuple(old, tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, ok := index.scoreRecords([]string{"friday"}, tid)[deleted]; ok {
+		t.Fatalf("expected the deleted record to be removed from the index")
+	}
+	tid.Abort()
+
+	tid = bp.Transactions().Begin()
+	defer tid.Commit()
+	if scores := index.scoreRecords([]string{"zebras"}, tid); len(scores) != 0 {
+		t.Errorf("expected the aborted insert to be removed from the index, got %v", scores)
+	}
+	after := index.scoreRecords([]string{"friday"}, tid)
+	if len(after) != len(before) {
+		t.Fatalf("expected %d records with friday after the abort, got %d", len(before), len(after))
+	}
+	for rid, score := range before {
+		if after[rid] != score {
+			t.Errorf("expected score %f for %v after the abort, got %f", score, rid, after[rid])
+		}
+	}
+	if index.NumDocs() != 100 || index.avgDocLen() != avgDocLen {
+		t.Errorf("expected 100 records of average length %f, got %d of %f", avgDocLen, index.NumDocs(), index.avgDocLen())
+	}
+}
+
+// The tables opened on a buffer pool share the in-memory copy of their text
+// index, which writes keep up to date instead of it being read again, and
+// which only scores the inserts a transaction sees.
+func TestTextIndexShared(t *testing.T) {
+	c, hf, bp := makeTextIndexTestVars(t)
+	index := getTextIndexForField(FieldType{Fname: "content"}, hf)
+	tid := bp.Transactions().Begin()
+	if err := index.load(tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	tup := Tuple{Desc: *hf.Descriptor(), Fields: []DBValue{
+		IntField{1},
+		StringField{"happy"},
+		EmbeddedStringField{Value: "zebras everywhere", Emb: make(EmbeddingType, TextEmbeddingDim)},
+	}}
+	// bypass insertTuple, which would need to compute an embedding
+	if _, err := hf.insertTupleIntoNewPage(&tup, tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	other := bp.Transactions().Begin()
+	if scores := index.scoreRecords([]string{"zebras"}, other); len(scores) != 0 {
+		t.Errorf("expected an uncommitted insert not to be scored for another transaction, got %v", scores)
+	}
+	other.Commit()
+	tid.Commit()
+
+	dbFile, err := c.GetTable("tweets_test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	reopened := getTextIndexForField(FieldType{Fname: "content"}, dbFile.(*HeapFile))
+	if reopened != index || !reopened.isLoaded() {
+		t.Fatalf("expected the table to be opened with the loaded text index")
+	}
+	tid = bp.Transactions().Begin()
+	defer tid.Commit()
+	if scores := reopened.scoreRecords([]string{"zebras"}, tid); len(scores) != 1 {
+		t.Errorf("expected the committed insert to be scored, got %v", scores)
+	}
+}
+
+// When fewer records than the limit contain a query term, the text index
+// returns records that score 0 after them, as a sort of the table does.
+func TestBM25ScanFewMatches(t *testing.T) {
+	c, hf, bp := makeTextIndexTestVars(t)
+	matches := countTweetsWithTerm(t, hf, "funeral")
+	limit := matches + 5
+	sql := fmt.Sprintf("select tweet_id, bm25(content, 'funeral') score from tweets_test order by score desc limit %d", limit)
+	plan, indexed := queryRows(t, c, bp, sql)
+	if !planContains(plan, &BM25Scan{}) {
+		t.Fatalf("expected the text index to be used")
+	}
+	// a filter that holds for every record keeps the index from being used
+	sql = fmt.Sprintf("select tweet_id, bm25(content, 'funeral') score from tweets_test where tweet_id = tweet_id order by score desc limit %d", limit)
+	plan, sorted := queryRows(t, c, bp, sql)
+	if planContains(plan, &BM25Scan{}) {
+		t.Fatalf("expected the filtered table to be sorted")
+	}
+
+	if len(indexed) != limit || len(sorted) != limit {
+		t.Fatalf("expected %d results from both plans, got %d and %d", limit, len(indexed), len(sorted))
+	}
+	for i := range indexed {
+		if indexed[i][1] != sorted[i][1] {
+			t.Errorf("expected score %v at %d, as the sort returns, got %v", sorted[i][1], i, indexed[i][1])
+		}
+		if i < matches && indexed[i][0] != sorted[i][0] {
+			t.Errorf("expected tweet %v at %d, as the sort returns, got %v", sorted[i][0], i, indexed[i][0])
+		}
+	}
+}
+
+func TestBM25Parse(t *testing.T) {
+	c, hf, bp := makeTextIndexTestVars(t)
+
+	sql := "select tweet_id, content, bm25(content, 'friday') score from tweets_test order by score desc limit 3"
+	_, plan, err := Parse(c, sql)
+	if err != nil {
+		t.Fatalf("failed to parse, q=%s, %s", sql, err.Error())
+	}
+	// the text index should replace the heap scan
+	var usesIndex func(op Operator) bool
+	usesIndex = func(op Operator) bool {
+		switch op := op.(type) {
+		case *BM25Scan:
+			return true
+		case *LimitOp:
+			return usesIndex(op.child)
+		case *OrderBy:
+			return usesIndex(op.child)
+		case *Project:
+			return usesIndex(op.child)
+		}
+		return false
+	}
+	if !usesIndex(plan) {
+		t.Errorf("expected plan to use the text index")
+	}
+
+	tid := bp.Transactions().Begin()
+	iter, err := plan.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// the tweets containing the term come first, followed by tweets that score
+	// 0 if there are fewer of them than the limit
+	matches := countTweetsWithTerm(t, hf, "friday")
+	var last int64 = -1
+	cnt := 0
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		score := tup.Fields[2].(IntField).Value
+		if (cnt < matches) != (score > 0) || (last != -1 && score > last) {
+			t.Errorf("expected %d positive scores in descending order, got %d after %d", matches, score, last)
+		}
+		if (cnt < matches) != strings.Contains(strings.ToLower(tup.Fields[1].(EmbeddedStringField).Value), "friday") {
+			t.Errorf("expected the %d results containing the query term first", matches)
+		}
+		last = score
+		cnt++
+	}
+	tid.Commit()
+	if cnt != 3 || matches == 0 {
+		t.Errorf("expected 3 results, %d of them matching, got %d", matches, cnt)
+	}
+
+	sql = "select tweet_id from tweets_test where match(content) against('friday')"
+	_, plan, err = Parse(c, sql)
+	if err != nil {
+		t.Fatalf("failed to parse, q=%s, %s", sql, err.Error())
+	}
+	tid = bp.Transactions().Begin()
+	iter, err = plan.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	cnt = 0
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		cnt++
+	}
+	tid.Commit()
+	if expected := countTweetsWithTerm(t, hf, "friday"); cnt != expected {
+		t.Errorf("expected %d matches, got %d", expected, cnt)
+	}
+}
@@ -1,13 +1,259 @@
 package godb
 
-type TransactionID *int
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
-var nextTid = 0
+// The state of a transaction; a transaction is active until it commits or
+// aborts, after which it cannot be used.
+type TransactionStatus int
 
-func NewTID() TransactionID {
-	id := nextTid
-	nextTid++
-	return &id
+const (
+	TransactionActive    TransactionStatus = iota
+	TransactionCommitted TransactionStatus = iota
+	TransactionAborted   TransactionStatus = iota
+)
+
+func (s TransactionStatus) String() string {
+	switch s {
+	case TransactionActive:
+		return "active"
+	case TransactionCommitted:
+		return "committed"
+	case TransactionAborted:
+		return "aborted"
+	}
+	return fmt.Sprintf("TransactionStatus(%d)", int(s))
+}
+
+// A Transaction is issued by a [TransactionManager], and is passed to the
+// iterators of operators and to the buffer pool to identify on whose behalf
+// pages are read and locked.  It tracks the pages it has read and written, and
+// is used until it commits or aborts.  It reads the snapshot of the database
+// taken when it began (see [Transaction.canSee]).
+type Transaction struct {
+	id       int64
+	manager  *TransactionManager
+	start    time.Time
+	deadline time.Time // zero if the transaction cannot time out
+	snapshot snapshot
+
+	mutex    sync.Mutex
+	status   TransactionStatus
+	readSet  map[BufferPoolKey]bool
+	writeSet map[BufferPoolKey]bool
+	cleanups []func() // run as the transaction completes; see onFinish
+
+	counters execCounterSet // the work done for the transaction; see [ExecCounters]
+}
+
+// transaction ids are handed out in increasing order by all transaction
+// managers, so that ids are unique within the process, and a larger id means a
+// younger transaction.  Ids are stamped on the versions of tuples on disk, so
+// the log of a database keeps the largest id that has changed it, and the ids
+// handed out once it is opened are larger, so that transactions see the
+// changes of earlier runs of the database.
+var nextTid atomic.Int64
+
+// Makes the ids of the transactions that begin from now on larger than id.
+func advanceTransactionIds(id int64) {
+	for next := nextTid.Load(); next < id; next = nextTid.Load() {
+		if nextTid.CompareAndSwap(next, id) {
+			return
+		}
+	}
+}
+
+// A TransactionManager issues the transactions of a buffer pool, and commits
+// and aborts them.
+type TransactionManager struct {
+	bp      *BufferPool
+	mutex   sync.Mutex
+	active  map[int64]*Transaction
+	timeout time.Duration
+}
+
+func newTransactionManager(bp *BufferPool) *TransactionManager {
+	return &TransactionManager{bp: bp, active: make(map[int64]*Transaction)}
+}
+
+// Sets how long transactions begun from now on may run before they time out;
+// zero, the default, means they never do.  A transaction that times out is
+// aborted the next time it reads a page or while it waits for a lock.
+func (tm *TransactionManager) SetTimeout(timeout time.Duration) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.timeout = timeout
+}
+
+// Begins a new transaction, taking its snapshot of the database.
+func (tm *TransactionManager) Begin() *Transaction {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	t := &Transaction{
+		id:       nextTid.Add(1),
+		manager:  tm,
+		start:    time.Now(),
+		status:   TransactionActive,
+		readSet:  make(map[BufferPoolKey]bool),
+		writeSet: make(map[BufferPoolKey]bool),
+	}
+	t.snapshot = tm.takeSnapshot(t.id)
+	if tm.timeout > 0 {
+		t.deadline = t.start.Add(tm.timeout)
+	}
+	tm.active[t.id] = t
+	return t
+}
+
+// Returns the transactions that are active, oldest first.
+func (tm *TransactionManager) Active() []*Transaction {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	active := make([]*Transaction, 0, len(tm.active))
+	for _, t := range tm.active {
+		active = append(active, t)
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].id < active[j].id })
+	return active
+}
+
+// Marks t as completing with the given status, returning an
+// IllegalTransactionError if it already has.
+func (t *Transaction) finish(status TransactionStatus) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.status != TransactionActive {
+		return ailikeError{IllegalTransactionError, fmt.Sprintf("transaction %d has already %s", t.id, t.status)}
+	}
+	t.status = status
+	return nil
+}
+
+// Removes t from the active transactions once it has committed or rolled back,
+// after which snapshots taken include its changes.
+func (tm *TransactionManager) retire(t *Transaction) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	delete(tm.active, t.id)
+}
+
+// Registers f to be run when t commits or aborts, before its locks are
+// released, to free what a query holds for t until its results have been read,
+// such as the workers of a parallel scan, when they are not read to the end.
+func (t *Transaction) onFinish(f func()) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.cleanups = append(t.cleanups, f)
+}
+
+// Runs the functions registered with onFinish.
+func (t *Transaction) runCleanups() {
+	t.mutex.Lock()
+	cleanups := t.cleanups
+	t.cleanups = nil
+	t.mutex.Unlock()
+	for _, f := range cleanups {
+		f()
+	}
 }
 
-//var tid TransactionID = NewTID()
+// Commits the transaction, making its changes durable and releasing its locks.
+func (t *Transaction) Commit() error {
+	if err := t.finish(TransactionCommitted); err != nil {
+		return err
+	}
+	t.runCleanups()
+	t.manager.bp.commitTransaction(t)
+	t.manager.retire(t)
+	return nil
+}
+
+// Aborts the transaction, rolling back its changes and releasing its locks.
+func (t *Transaction) Abort() error {
+	if err := t.finish(TransactionAborted); err != nil {
+		return err
+	}
+	t.runCleanups()
+	t.manager.bp.abortTransaction(t)
+	t.manager.retire(t)
+	return nil
+}
+
+func (t *Transaction) ID() int64 {
+	return t.id
+}
+
+func (t *Transaction) StartTime() time.Time {
+	return t.start
+}
+
+func (t *Transaction) Status() TransactionStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.status
+}
+
+// Returns an error if the transaction can no longer be used: an
+// IllegalTransactionError if it has completed, or a TransactionTimeoutError if
+// it has run past its deadline.
+func (t *Transaction) check() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.status != TransactionActive {
+		return ailikeError{IllegalTransactionError, fmt.Sprintf("transaction %d has already %s", t.id, t.status)}
+	}
+	if t.expired() {
+		return t.timeoutError()
+	}
+	return nil
+}
+
+func (t *Transaction) expired() bool {
+	return !t.deadline.IsZero() && !time.Now().Before(t.deadline)
+}
+
+func (t *Transaction) timeoutError() error {
+	return ailikeError{TransactionTimeoutError, fmt.Sprintf("transaction %d timed out", t.id)}
+}
+
+// Records that the transaction has read or written the page with the given key.
+func (t *Transaction) recordAccess(key BufferPoolKey, perm RWPerm) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if perm == WritePerm {
+		t.writeSet[key] = true
+	} else {
+		t.readSet[key] = true
+	}
+}
+
+// Returns the keys of the pages the transaction has locked for reading.
+func (t *Transaction) ReadSet() []BufferPoolKey {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return pageKeys(t.readSet)
+}
+
+// Returns the keys of the pages the transaction has locked for writing.
+func (t *Transaction) WriteSet() []BufferPoolKey {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return pageKeys(t.writeSet)
+}
+
+func pageKeys(set map[BufferPoolKey]bool) []BufferPoolKey {
+	keys := make([]BufferPoolKey, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (t *Transaction) String() string {
+	return fmt.Sprintf("transaction %d (%s)", t.id, t.Status())
+}
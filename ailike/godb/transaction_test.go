@@ -10,8 +10,9 @@ import (
 )
 
 func TestTid(t *testing.T) {
-	tid := NewTID()
-	tid2 := NewTID()
+	tm := NewBufferPool(1).Transactions()
+	tid := tm.Begin()
+	tid2 := tm.Begin()
 	var tid3 = tid
 	if tid == tid2 {
 		t.Errorf("different transactions have same id")
@@ -29,8 +30,7 @@ func readXaction(hf *HeapFile, bp *BufferPool, wg *sync.WaitGroup) {
 
 	for {
 	start:
-		tid := NewTID()
-		bp.BeginTransaction(tid)
+		tid := bp.Transactions().Begin()
 		it, _ := hf.Iterator(tid)
 		cnt1 := 0
 
@@ -68,7 +68,7 @@ func readXaction(hf *HeapFile, bp *BufferPool, wg *sync.WaitGroup) {
 			fmt.Printf("ERROR: read different number of tuples both iterators (%d, %d)\n", cnt1, cnt2)
 			c <- 0
 		}
-		bp.CommitTransaction(tid)
+		tid.Commit()
 		wg.Done()
 		return
 	}
@@ -79,8 +79,7 @@ func writeXaction(hf *HeapFile, bp *BufferPool, writeTuple Tuple, wg *sync.WaitG
 
 	for {
 	start:
-		tid := NewTID()
-		bp.BeginTransaction(tid)
+		tid := bp.Transactions().Begin()
 		for i := 0; i < 10; i++ {
 			err := hf.insertTuple(&writeTuple, tid)
 			if err != nil {
@@ -89,7 +88,7 @@ func writeXaction(hf *HeapFile, bp *BufferPool, writeTuple Tuple, wg *sync.WaitG
 				goto start
 			}
 		}
-		bp.CommitTransaction(tid)
+		tid.Commit()
 		break
 	}
 	c <- 1
@@ -100,8 +99,7 @@ func TestTransactions(t *testing.T) {
 
 	_, t1, t2, _, _, _ := makeTestVars()
 	bp := NewBufferPool(20)
-	tid := NewTID()
-	bp.BeginTransaction(tid)
+	tid := bp.Transactions().Begin()
 	hf, _ := NewHeapFile(TestingFile, &t1.Desc, bp)
 	var wg sync.WaitGroup
 
@@ -117,7 +115,7 @@ func TestTransactions(t *testing.T) {
 			t.Errorf("transaction test failed")
 		}
 	}
-	bp.CommitTransaction(tid)
+	tid.Commit()
 	wg.Add(numConcurrentThreads * 2)
 
 	for i := 0; i < numConcurrentThreads; i++ {
@@ -141,11 +139,12 @@ func TestTransactions(t *testing.T) {
 	wg.Wait()
 }
 
-func transactionTestSetUpVarLen(t *testing.T, tupCnt int, pgCnt int) (*BufferPool, *HeapFile, TransactionID, TransactionID, Tuple, Tuple) {
+func transactionTestSetUpVarLen(t *testing.T, tupCnt int, pgCnt int) (*BufferPool, *HeapFile, *Transaction, *Transaction, Tuple, Tuple) {
 
 	td, t1, t2, hf, bp, _ := makeTestVars()
 	if tupCnt < 0 {
-		nTuplesperPage := (PageSize-8)/td.sizeInBytes() - 2
+		slots, _ := td.getNumSlotsPerPage(PageSize)
+		nTuplesperPage := int(slots) - 2
 		tupCnt = nTuplesperPage * pgCnt
 	}
 
@@ -158,14 +157,12 @@ func transactionTestSetUpVarLen(t *testing.T, tupCnt int, pgCnt int) (*BufferPoo
 		t.Fatalf("error making test vars; unexpected number of pages")
 	}
 
-	tid1 := NewTID()
-	bp.BeginTransaction(tid1)
-	tid2 := NewTID()
-	bp.BeginTransaction(tid2)
+	tid1 := bp.Transactions().Begin()
+	tid2 := bp.Transactions().Begin()
 	return bp, hf, tid1, tid2, t1, t2
 }
 
-func transactionTestSetUp(t *testing.T) (*BufferPool, *HeapFile, TransactionID, TransactionID, Tuple) {
+func transactionTestSetUp(t *testing.T) (*BufferPool, *HeapFile, *Transaction, *Transaction, Tuple) {
 
 	bp, hf, tid1, tid2, t1, _ := transactionTestSetUpVarLen(t, -1, 3)
 	return bp, hf, tid1, tid2, t1
@@ -175,7 +172,7 @@ func TestAttemptTransactionTwice(t *testing.T) {
 	bp, hf, tid1, tid2, _ := transactionTestSetUp(t)
 	bp.GetPage(hf, 0, tid1, ReadPerm)
 	bp.GetPage(hf, 1, tid1, WritePerm)
-	bp.CommitTransaction(tid1)
+	tid1.Commit()
 
 	bp.GetPage(hf, 0, tid2, WritePerm)
 	bp.GetPage(hf, 1, tid2, WritePerm)
@@ -190,9 +187,9 @@ func testTransactionComplete(t *testing.T, commit bool) {
 	heapp.setDirty(true)
 
 	if commit {
-		bp.CommitTransaction(tid1)
+		tid1.Commit()
 	} else {
-		bp.AbortTransaction(tid1)
+		tid1.Abort()
 	}
 
 	bp.FlushAllPages()
@@ -235,7 +232,7 @@ func (i *Singleton) Descriptor() *TupleDesc {
 	return &i.tup.Desc
 }
 
-func (i *Singleton) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+func (i *Singleton) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
 	return func() (*Tuple, error) {
 		if i.ran {
 			return nil, nil
@@ -263,9 +260,8 @@ func validateTransactions(t *testing.T, threads int) {
 		// Wait for the signal to start
 		<-startChan
 
-		for tid := TransactionID(nil); ; bp.AbortTransaction(tid) {
-			tid = NewTID()
-			bp.BeginTransaction(tid)
+		for tid := (*Transaction)(nil); ; tid.Abort() {
+			tid = bp.Transactions().Begin()
 			iter1, err := hf.Iterator(tid)
 			if err != nil {
 				continue
@@ -311,7 +307,7 @@ func validateTransactions(t *testing.T, threads int) {
 				t.Errorf("Insert Op should return 1")
 			}
 
-			bp.CommitTransaction(tid)
+			tid.Commit()
 			break //exit on success, so we don't do terminal abort
 		}
 		startWg.Done()
@@ -333,8 +329,7 @@ func validateTransactions(t *testing.T, threads int) {
 	// Wait for all goroutines to finish
 	startWg.Wait()
 
-	tid := NewTID()
-	bp.BeginTransaction(tid)
+	tid := bp.Transactions().Begin()
 	iter, _ := hf.Iterator(tid)
 	tup, _ := iter()
 
@@ -369,12 +364,11 @@ func TestAllDirtyFails(t *testing.T) {
 			t.Fatalf("Heap file should have at least one page after insertion.")
 		}
 	}
-	bp.CommitTransaction(tid) // make three clean pages
+	tid.Commit() // make three clean pages
 
 	os.Remove(TestingFile2)
 	hf2, _ := NewHeapFile(TestingFile2, &td, bp)
-	tid2 := NewTID()
-	bp.BeginTransaction(tid2)
+	tid2 := bp.Transactions().Begin()
 
 	for hf2.NumPages() < 3 { // make three dirty pages
 		hf2.insertTuple(&t1, tid2)
@@ -390,7 +384,7 @@ func TestAllDirtyFails(t *testing.T) {
 }
 
 func TestAbortEviction(t *testing.T) {
-	tupExists := func(t0 Tuple, tid TransactionID, hf *HeapFile) (bool, error) {
+	tupExists := func(t0 Tuple, tid *Transaction, hf *HeapFile) (bool, error) {
 		iter, err := hf.Iterator(tid)
 		if err != nil {
 			return false, err
@@ -411,13 +405,94 @@ func TestAbortEviction(t *testing.T) {
 	if exists, err := tupExists(t1, tid, hf); !(exists == true && err == nil) {
 		t.Errorf("Tuple should exist")
 	}
-	bp.AbortTransaction(tid)
+	tid.Abort()
 
-	tid2 := NewTID()
-	bp.BeginTransaction(tid2)
+	tid2 := bp.Transactions().Begin()
 
 	// tuple should not exist after abortion
 	if exists, err := tupExists(t1, tid2, hf); !(exists == false && err == nil) {
 		t.Errorf("Tuple should not exist")
 	}
 }
+
+func TestTransactionLifecycle(t *testing.T) {
+	_, t1, _, hf, bp, tid := makeTestVars()
+	tm := bp.Transactions()
+	tid2 := tm.Begin()
+	if tid.ID() >= tid2.ID() {
+		t.Errorf("expected ids to increase, got %d and %d", tid.ID(), tid2.ID())
+	}
+	if active := tm.Active(); len(active) != 2 || active[0] != tid || active[1] != tid2 {
+		t.Errorf("expected both transactions to be active, oldest first, got %v", active)
+	}
+
+	if err := hf.insertTuple(&t1, tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := bp.GetPage(hf, 0, tid, ReadPerm); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if keys := tid.WriteSet(); len(keys) != 1 || keys[0] != hf.pageKey(0) {
+		t.Errorf("expected the transaction to have written page 0, got %v", keys)
+	}
+	if err := tid.Commit(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if tid.Status() != TransactionCommitted {
+		t.Errorf("expected the transaction to be committed, got %s", tid.Status())
+	}
+
+	// a transaction that has completed cannot be used, or completed again
+	if _, err := bp.GetPage(hf, 0, tid, ReadPerm); err == nil || err.(ailikeError).code != IllegalTransactionError {
+		t.Errorf("expected reading a page in a committed transaction to fail, got %v", err)
+	}
+	if err := tid.Abort(); err == nil {
+		t.Errorf("expected aborting a committed transaction to fail")
+	}
+	if err := tid2.Abort(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := tid2.Commit(); err == nil {
+		t.Errorf("expected committing an aborted transaction to fail")
+	}
+	if active := tm.Active(); len(active) != 0 {
+		t.Errorf("expected no transactions to be active, got %v", active)
+	}
+}
+
+func TestTransactionTimeout(t *testing.T) {
+	_, t1, _, hf, bp, tid := makeTestVars()
+	if err := hf.insertTuple(&t1, tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// a transaction waiting for a lock is aborted when it times out
+	tm := bp.Transactions()
+	tm.SetTimeout(50 * time.Millisecond)
+	waiter := tm.Begin()
+	start := time.Now()
+	_, err := bp.GetPage(hf, 0, waiter, ReadPerm)
+	if err == nil || err.(ailikeError).code != TransactionTimeoutError {
+		t.Fatalf("expected the lock request to time out, got %v", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond || waited > time.Second {
+		t.Errorf("expected to wait until the timeout, waited %v", waited)
+	}
+	if waiter.Status() != TransactionAborted {
+		t.Errorf("expected the transaction to be aborted, got %s", waiter.Status())
+	}
+
+	// one that times out between reads is aborted on its next read
+	tid.Commit()
+	reader := tm.Begin()
+	if _, err := bp.GetPage(hf, 0, reader, ReadPerm); err != nil {
+		t.Fatalf(err.Error())
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := bp.GetPage(hf, 0, reader, ReadPerm); err == nil || err.(ailikeError).code != TransactionTimeoutError {
+		t.Errorf("expected the read to time out, got %v", err)
+	}
+	if reader.Status() != TransactionAborted {
+		t.Errorf("expected the transaction to be aborted, got %s", reader.Status())
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"math"
 	"strings"
 
 	"github.com/mitchellh/hashstructure/v2"
@@ -21,9 +23,10 @@ const (
 	StringType         DBType = iota
 	EmbeddedStringType DBType = iota
 	VectorFieldType    DBType = iota
+	FloatType          DBType = iota // only produced by expressions, such as float literals in predicates; tables cannot store floats, though temporary files such as sort runs can
 )
 
-var typeNames map[DBType]string = map[DBType]string{IntType: "int", StringType: "string", EmbeddedStringType: "text", VectorFieldType: "vec"}
+var typeNames map[DBType]string = map[DBType]string{IntType: "int", StringType: "string", EmbeddedStringType: "text", VectorFieldType: "vec", FloatType: "float"}
 
 // FieldType is the type of a field in a tuple, e.g., its name, table, and [ailike.DBType].
 // TableQualifier may or may not be an emtpy string, depending on whether the table
@@ -115,27 +118,38 @@ func (desc *TupleDesc) merge(desc2 *TupleDesc) *TupleDesc {
 	return &TupleDesc{Fields: mergedFields}
 }
 
-// Gives the byte size of a Tuple with the given TupleDesc desc
+// Gives the byte size of a field of type ftype
+func fieldSizeInBytes(ftype DBType) int {
+	switch ftype {
+	case IntType:
+		return IntSizeBytes
+	case StringType:
+		return StringLength
+	case EmbeddedStringType:
+		return TextSizeBytes
+	case VectorFieldType:
+		return EmbeddingSizeBytes
+	case FloatType:
+		return FloatSizeBytes
+	}
+	panic("Cannot get size in bytes for unknown field type.")
+}
+
+// Gives the byte size of the null bitmap that precedes the fields of a Tuple
+// with the given TupleDesc desc; it has one bit per field, which is set if the
+// field is NULL.
+func (desc *TupleDesc) nullBitmapBytes() int {
+	return (len(desc.Fields) + 7) / 8
+}
+
+// Gives the byte size of a Tuple with the given TupleDesc desc, including its
+// null bitmap
 func (desc *TupleDesc) sizeInBytes() int {
-	var numVec int = 0
-	var numTexts int = 0
-	var numStrings int = 0
-	var numInts int = 0
+	size := desc.nullBitmapBytes()
 	for _, f := range desc.Fields {
-		switch f.Ftype {
-		case IntType:
-			numInts += 1
-		case StringType:
-			numStrings += 1
-		case EmbeddedStringType:
-			numTexts += 1
-		case VectorFieldType:
-			numVec += 1
-		default:
-			panic("Cannot get size in bytes for unknown field type.")
-		}
+		size += fieldSizeInBytes(f.Ftype)
 	}
-	return StringLength*numStrings + IntSizeBytes*numInts + numTexts*TextSizeBytes + numVec*EmbeddingSizeBytes
+	return size
 }
 
 // Compute number of tuples that fit into a page given the descriptor
@@ -143,9 +157,10 @@ func (desc *TupleDesc) getNumSlotsPerPage(pagesize int) (int32, error) {
 
 	remPageSize := pagesize - 8 // bytes after header
 
-	bytes_per_tuple := desc.sizeInBytes()
+	// each tuple is stored with its creation and deletion stamps
+	bytes_per_tuple := desc.sizeInBytes() + versionStampBytes
 
-	if bytes_per_tuple == 0 {
+	if desc.sizeInBytes() == 0 {
 		return -1, ailikeError{MalformedDataError,
 			fmt.Sprintf("Tuple descriptor is empty. Number of tuples on page is undefined.")}
 	}
@@ -157,7 +172,7 @@ func (desc *TupleDesc) getNumSlotsPerPage(pagesize int) (int32, error) {
 // Interface used for tuple field values
 // Since it implements no methods, any object can be used
 // but having an interface for this improves code readability
-// where tuple values are used
+// where tuple values are used.  A nil DBValue is NULL.
 type DBValue interface {
 }
 
@@ -175,11 +190,18 @@ type StringField struct {
 type EmbeddedStringField struct {
 	Value string
 	Emb   EmbeddingType
+	norm  float64 // the norm of Emb, kept with fields read from pages; 0 if not known
 }
 
 // String field value
 type VectorField struct {
-	Emb EmbeddingType
+	Emb  EmbeddingType
+	norm float64 // the norm of Emb, kept with fields read from pages; 0 if not known
+}
+
+// Float field value
+type FloatField struct {
+	Value float64
 }
 
 // Tuple represents the contents of a tuple read from a database
@@ -193,8 +215,9 @@ type Tuple struct {
 type recordID interface{}
 
 // Serialize the contents of the tuple into a byte array Since all tuples are of
-// fixed size, this method should simply write the fields in sequential order
-// into the supplied buffer.
+// fixed size, this method should simply write the null bitmap of the tuple,
+// followed by the fields in sequential order, into the supplied buffer.  NULL
+// fields are written as zeros, so that every field keeps its offset.
 //
 // See the function [binary.Write].  Objects should be serialized in little
 // endian order.
@@ -207,9 +230,28 @@ type recordID interface{}
 // May return an error if the buffer has insufficient capacity to store the
 // tuple.
 func (t *Tuple) writeTo(b *bytes.Buffer) error {
+	nulls := make([]byte, t.Desc.nullBitmapBytes())
+	for i, f := range t.Fields {
+		if f == nil {
+			nulls[i/8] |= 1 << (i % 8)
+		}
+	}
+	if _, err := b.Write(nulls); err != nil {
+		return err
+	}
+	return t.writeFieldsTo(b)
+}
+
+// Serialize the fields of the tuple, without its null bitmap, as stored on
+// pages written before tuples could have NULLs.
+func (t *Tuple) writeFieldsTo(b *bytes.Buffer) error {
 	for i, f := range t.Fields {
 
 		switch f := f.(type) {
+		case nil:
+			if _, err := b.Write(make([]byte, fieldSizeInBytes(t.Desc.Fields[i].Ftype))); err != nil {
+				return err
+			}
 		case StringField:
 			if t.Desc.Fields[i].Ftype != StringType {
 				return ailikeError{TypeMismatchError, "Tuple's fields do not match its descriptor."}
@@ -225,8 +267,19 @@ func (t *Tuple) writeTo(b *bytes.Buffer) error {
 			if t.Desc.Fields[i].Ftype != IntType {
 				return ailikeError{TypeMismatchError, "Tuple's fields do not match its descriptor."}
 			}
-			err := binary.Write(b, binary.LittleEndian, &f.Value)
-			if err != nil {
+			var raw [8]byte
+			binary.LittleEndian.PutUint64(raw[:], uint64(f.Value))
+			if _, err := b.Write(raw[:]); err != nil {
+				return err
+			}
+
+		case FloatField:
+			if t.Desc.Fields[i].Ftype != FloatType {
+				return ailikeError{TypeMismatchError, "Tuple's fields do not match its descriptor."}
+			}
+			var raw [8]byte
+			binary.LittleEndian.PutUint64(raw[:], math.Float64bits(f.Value))
+			if _, err := b.Write(raw[:]); err != nil {
 				return err
 			}
 
@@ -278,73 +331,118 @@ func (t *Tuple) writeTo(b *bytes.Buffer) error {
 // trailing zeros should be removed from the strings.  A []byte can be cast
 // directly to string.
 //
+// The fields are preceded by a null bitmap, and fields whose bit is set are
+// read as NULL.
+//
 // May return an error if the buffer has insufficent data to deserialize the
 // tuple.
-
 func readTupleFrom(b *bytes.Buffer, desc *TupleDesc) (*Tuple, error) {
-	var stringBytes = make([]byte, StringLength)
-	var textBytes = make([]byte, TextCharLength)
-	var nextString string
-	var nextInt int64
-	var nextFloat float64
-	var nextText string
+	nulls := make([]byte, desc.nullBitmapBytes())
+	if _, err := io.ReadFull(b, nulls); err != nil {
+		return nil, err
+	}
+	return readTupleFieldsFrom(b, desc, nulls)
+}
+
+// Read the fields of a tuple that is not preceded by a null bitmap, as stored
+// on pages written before tuples could have NULLs.
+func readLegacyTupleFrom(b *bytes.Buffer, desc *TupleDesc) (*Tuple, error) {
+	return readTupleFieldsFrom(b, desc, nil)
+}
+
+// Read the fields of a tuple, setting those whose bit is set in nulls to NULL.
+func readTupleFieldsFrom(b *bytes.Buffer, desc *TupleDesc, nulls []byte) (*Tuple, error) {
+	var stringBytes, textBytes []byte
 
 	tupleFields := make([]DBValue, len(desc.Fields))
 	for i, f := range desc.Fields {
 		switch f.Ftype {
 		case StringType:
-			err := binary.Read(b, binary.LittleEndian, &stringBytes)
-			if err != nil {
+			if stringBytes == nil {
+				stringBytes = make([]byte, StringLength)
+			}
+			if _, err := io.ReadFull(b, stringBytes); err != nil {
 				return nil, err
 			}
-			nextString = string(bytes.TrimRight(stringBytes, "\x00"))
-			tupleFields[i] = StringField{nextString}
+			tupleFields[i] = StringField{string(bytes.TrimRight(stringBytes, "\x00"))}
 		case IntType:
-			err := binary.Read(b, binary.LittleEndian, &nextInt)
-			if err != nil {
-				return nil, err
+			raw := b.Next(8)
+			if len(raw) < 8 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			tupleFields[i] = IntField{int64(binary.LittleEndian.Uint64(raw))}
+
+		case FloatType:
+			raw := b.Next(8)
+			if len(raw) < 8 {
+				return nil, io.ErrUnexpectedEOF
 			}
-			tupleFields[i] = IntField{nextInt}
+			tupleFields[i] = FloatField{math.Float64frombits(binary.LittleEndian.Uint64(raw))}
 
 		case EmbeddedStringType:
 
-			//Read embedding
-			var emb EmbeddingType
-			for i := 0; i < TextEmbeddingDim; i++ {
-				err := binary.Read(b, binary.LittleEndian, &nextFloat)
-				if err != nil {
-					return nil, err
-				}
-				emb = append(emb, nextFloat)
+			//Read embedding, into one contiguous array
+			emb := make(EmbeddingType, TextEmbeddingDim)
+			if err := binary.Read(b, binary.LittleEndian, []float64(emb)); err != nil {
+				return nil, err
 			}
 
 			// Read
-			err := binary.Read(b, binary.LittleEndian, &textBytes)
-			if err != nil {
+			if textBytes == nil {
+				textBytes = make([]byte, TextCharLength)
+			}
+			if _, err := io.ReadFull(b, textBytes); err != nil {
 				return nil, err
 			}
-			nextText = string(bytes.TrimRight(textBytes, "\x00"))
-			tupleFields[i] = EmbeddedStringField{Value: nextText, Emb: emb}
+			tupleFields[i] = EmbeddedStringField{Value: string(bytes.TrimRight(textBytes, "\x00")), Emb: emb, norm: normOf(emb)}
 		case VectorFieldType:
-			//Read embedding
-			var emb EmbeddingType
-			for i := 0; i < TextEmbeddingDim; i++ {
-				err := binary.Read(b, binary.LittleEndian, &nextFloat)
-				if err != nil {
-					return nil, err
-				}
-				emb = append(emb, nextFloat)
+			//Read embedding, into one contiguous array
+			emb := make(EmbeddingType, TextEmbeddingDim)
+			if err := binary.Read(b, binary.LittleEndian, []float64(emb)); err != nil {
+				return nil, err
 			}
-			tupleFields[i] = VectorField{Emb: emb}
+			tupleFields[i] = VectorField{Emb: emb, norm: normOf(emb)}
+		}
+		if nulls != nil && nulls[i/8]&(1<<(i%8)) != 0 {
+			tupleFields[i] = nil
 		}
 	}
 	return &Tuple{Desc: *desc, Fields: tupleFields}, nil
 }
 
+// Returns true if any field of the tuple is NULL.
+func (t *Tuple) hasNulls() bool {
+	for _, f := range t.Fields {
+		if f == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the norms of the embeddings of the tuple's fields that do not have them,
+// as the tuple goes onto a page, so that scans of the page do not compute them.
+func (t *Tuple) keepNorms() {
+	for i, f := range t.Fields {
+		switch f := f.(type) {
+		case EmbeddedStringField:
+			if f.norm == 0 {
+				f.norm = normOf(f.Emb)
+				t.Fields[i] = f
+			}
+		case VectorField:
+			if f.norm == 0 {
+				f.norm = normOf(f.Emb)
+				t.Fields[i] = f
+			}
+		}
+	}
+}
+
 // Compare two tuples for equality.  Equality means that the TupleDescs are equal
 // and all of the fields are equal.  TupleDescs should be compared with
 // the [TupleDesc.equals] method, but fields can be compared directly with equality
-// operators.
+// operators.  NULL fields are only equal to each other.
 func (t1 *Tuple) equals(t2 *Tuple) bool {
 
 	if !t1.Desc.equals(&t2.Desc) {
@@ -352,6 +450,12 @@ func (t1 *Tuple) equals(t2 *Tuple) bool {
 	}
 
 	for i, tdesc := range t1.Desc.Fields {
+		if (t1.Fields[i] == nil) != (t2.Fields[i] == nil) {
+			return false
+		}
+		if t1.Fields[i] == nil {
+			continue
+		}
 		switch tdesc.Ftype {
 		case StringType:
 			if t1.Fields[i].(StringField).Value != t2.Fields[i].(StringField).Value {
@@ -413,7 +517,17 @@ const (
 //
 // Calling the [Expr.EvalExpr] method on a tuple will return the value of the
 // expression on the supplied tuple.
+//
+// NULL is ordered after every other value.
 func (t *Tuple) compareField(t2 *Tuple, field Expr) (orderByState, error) {
+	return t.compareFieldDirected(t2, field, true)
+}
+
+// Compares t and t2 on field as [Tuple.compareField] does, or in reverse unless
+// ascending, except that NULL is ordered after every other value in either
+// direction, so that rows without a value, such as rows with NULL text ordered
+// by their AILIKE distance, are never ranked first.
+func (t *Tuple) compareFieldDirected(t2 *Tuple, field Expr, ascending bool) (orderByState, error) {
 	e1, err := field.EvalExpr(t)
 	if err != nil {
 		return OrderedEqual, err
@@ -422,6 +536,18 @@ func (t *Tuple) compareField(t2 *Tuple, field Expr) (orderByState, error) {
 	if err != nil {
 		return OrderedEqual, err
 	}
+	if e1 == nil || e2 == nil {
+		switch {
+		case e1 == e2:
+			return OrderedEqual, nil
+		case e1 == nil:
+			return OrderedGreaterThan, nil
+		}
+		return OrderedLessThan, nil
+	}
+	if !ascending {
+		e1, e2 = e2, e1
+	}
 
 	switch field.GetExprType().Ftype {
 	case StringType:
@@ -485,24 +611,11 @@ func (t *Tuple) compareField(t2 *Tuple, field Expr) (orderByState, error) {
 // do match on TableQualifier (e.g., a field  t1.name in fields should match an
 // entry t2.name in t, but only if there is not an entry t1.name in t)
 func (t *Tuple) project(fields []FieldType) (*Tuple, error) {
-	descWithoutTableQualifiers := *t.Desc.copy()
-	for i, f := range descWithoutTableQualifiers.Fields {
-		f.TableQualifier = ""
-		descWithoutTableQualifiers.Fields[i] = f
-	}
-
 	newFields := make([]DBValue, len(fields))
 	for i, ft := range fields {
-		tfi, err := findFieldInTd(ft, &t.Desc)
+		tfi, err := projectedFieldIndex(ft, &t.Desc)
 		if err != nil {
-			if err.(ailikeError).code == IncompatibleTypesError {
-				tfi, err = findFieldInTd(ft, &descWithoutTableQualifiers)
-				if err != nil {
-					return nil, err
-				}
-			} else {
-				return nil, err
-			}
+			return nil, err
 		}
 		newFields[i] = t.Fields[tfi]
 	}
@@ -514,6 +627,21 @@ func (t *Tuple) project(fields []FieldType) (*Tuple, error) {
 	return &Tuple{Desc: *newTupleDesc, Fields: newFields, Rid: 0}, nil
 }
 
+// Returns the index of the field of desc that [Tuple.project] projects for ft,
+// which is found ignoring table qualifiers if it does not match on them.
+func projectedFieldIndex(ft FieldType, desc *TupleDesc) (int, error) {
+	tfi, err := findFieldInTd(ft, desc)
+	if err != nil && err.(ailikeError).code == IncompatibleTypesError {
+		descWithoutTableQualifiers := *desc.copy()
+		for i, f := range descWithoutTableQualifiers.Fields {
+			f.TableQualifier = ""
+			descWithoutTableQualifiers.Fields[i] = f
+		}
+		return findFieldInTd(ft, &descWithoutTableQualifiers)
+	}
+	return tfi, err
+}
+
 // Compute a key for the tuple to be used in a map structure
 func (t *Tuple) tupleKey() any {
 
@@ -570,6 +698,8 @@ func (t *Tuple) PrettyPrintString(aligned bool) string {
 	for i, f := range t.Fields {
 		str := ""
 		switch f := f.(type) {
+		case nil:
+			str = "NULL"
 		case IntField:
 			str = fmt.Sprintf("%d", f.Value)
 		case StringField:
@@ -579,6 +709,8 @@ func (t *Tuple) PrettyPrintString(aligned bool) string {
 			str = f.Value
 		case VectorField:
 			str = fmt.Sprintf("[%v,...]", f.Emb[0])
+		case FloatField:
+			str = fmt.Sprintf("%g", f.Value)
 		}
 		if aligned {
 			outstr = fmt.Sprintf("%s %s", outstr, fmtCol(str, len(t.Fields)))
@@ -263,3 +263,66 @@ func TestTupleEquals(t *testing.T) {
 	TAssertNotEquals(t, t1, stringTup)
 	TAssertNotEquals(t, stringTup, t2)
 }
+
+func TestTupleNullSerialization(t *testing.T) {
+	td, t1, _, _, _, _ := makeTestVars()
+	withNull := Tuple{Desc: td, Fields: []DBValue{nil, IntField{25}}}
+
+	b := new(bytes.Buffer)
+	if err := withNull.writeTo(b); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if b.Len() != td.sizeInBytes() {
+		t.Errorf("expected a tuple with NULLs to take %d bytes, got %d", td.sizeInBytes(), b.Len())
+	}
+	read, err := readTupleFrom(b, &td)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if read.Fields[0] != nil || read.Fields[1] != (IntField{25}) {
+		t.Errorf("expected (NULL, 25), got %v", read.Fields)
+	}
+	if !read.equals(&withNull) || read.equals(&t1) || t1.equals(read) {
+		t.Errorf("expected NULL to only equal NULL")
+	}
+	if !read.hasNulls() || t1.hasNulls() {
+		t.Errorf("expected hasNulls to report NULL fields")
+	}
+	if s := read.PrettyPrintString(false); s != "NULL,25" {
+		t.Errorf("expected NULL to print as NULL, got %s", s)
+	}
+
+	// NULL is ordered after other values, in either direction
+	name := &FieldExpr{td.Fields[0]}
+	if order, _ := read.compareField(&t1, name); order != OrderedGreaterThan {
+		t.Errorf("expected NULL to sort after a string")
+	}
+	if order, _ := t1.compareField(read, name); order != OrderedLessThan {
+		t.Errorf("expected a string to sort before NULL")
+	}
+	if order, _ := read.compareFieldDirected(&t1, name, false); order != OrderedGreaterThan {
+		t.Errorf("expected NULL to sort after a string in descending order")
+	}
+	if order, _ := read.compareField(&withNull, name); order != OrderedEqual {
+		t.Errorf("expected NULLs to sort together")
+	}
+}
+
+func TestFloatTupleSerialization(t *testing.T) {
+	td := TupleDesc{Fields: []FieldType{{Fname: "id", Ftype: IntType}, {Fname: "dist", Ftype: FloatType}}}
+	tup := Tuple{Desc: td, Fields: []DBValue{IntField{1}, FloatField{0.25}}}
+	b := new(bytes.Buffer)
+	if err := tup.writeTo(b); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if b.Len() != td.sizeInBytes() {
+		t.Errorf("expected a tuple with a float to take %d bytes, got %d", td.sizeInBytes(), b.Len())
+	}
+	read, err := readTupleFrom(b, &td)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !read.equals(&tup) {
+		t.Errorf("expected %v, got %v", tup.Fields, read.Fields)
+	}
+}
@@ -28,6 +28,8 @@ const (
 	FailedEmbedding         ailikeErrorCode = iota
 	UnknownClusterError     ailikeErrorCode = iota
 	OSError                 ailikeErrorCode = iota
+	TransactionTimeoutError ailikeErrorCode = iota
+	WriteConflictError      ailikeErrorCode = iota
 )
 
 type ailikeError struct {
@@ -47,6 +49,32 @@ const (
 	MaxIterKMeans  int     = 10
 	DeltaThrKMeans float64 = 1.0
 	DefaultProbe   int     = 3
+	// BM25 term frequency saturation and document length normalization
+	BM25K1 float64 = 1.2
+	BM25B  float64 = 0.75
+	// reciprocal rank fusion smoothing constant, and the number of candidates
+	// each ranked input contributes when no LIMIT bounds it
+	RRFK             int = 60
+	RRFCandidatePool int = 100
+	// trade-off between relevance and diversity used by mmr() when none is given,
+	// and the minimum number of candidates mmr() chooses its results from
+	DefaultMMRLambda float64 = 0.7
+	MMRCandidatePool int     = 50
+	// number of nearby centroids whose clusters are also searched for near-duplicates
+	DedupNeighbourCentroids int = 2
+	// number of equi-width buckets in the histograms collected by ANALYZE
+	NumHistogramBuckets int = 10
+	// selectivities assumed for predicates on columns without statistics
+	DefaultEqSelectivity    float64 = 0.1
+	DefaultRangeSelectivity float64 = 1.0 / 3.0
+	// lower bound on the selectivity assumed when sizing a filtered vector index scan
+	MinFilterSelectivity float64 = 0.01
+	// cost model weights, in units of reading one page of a table sequentially
+	CostPageRead       float64 = 1.0
+	CostRandomPageRead float64 = 2.0
+	CostTupleCPU       float64 = 0.01
+	CostDistance       float64 = 0.05
+	CostEmbeddingCall  float64 = 100.0
 )
 
 var (
@@ -74,8 +102,9 @@ type BufferPoolKey interface {
 }
 
 type DBFile interface {
-	insertTuple(t *Tuple, tid TransactionID) error
-	deleteTuple(t *Tuple, tid TransactionID) error
+	insertTuple(t *Tuple, tid *Transaction) error
+	deleteTuple(t *Tuple, tid *Transaction) error
+	updateTuple(old *Tuple, updated *Tuple, tid *Transaction) error
 
 	//methods used by buffer pool to manage retrieval of pages
 	readPage(pageNo int) (*Page, error)
@@ -87,7 +116,7 @@ type DBFile interface {
 
 type Operator interface {
 	Descriptor() *TupleDesc
-	Iterator(tid TransactionID) (func() (*Tuple, error), error)
+	Iterator(tid *Transaction) (func() (*Tuple, error), error)
 }
 
 type BoolOp int
@@ -0,0 +1,101 @@
+package godb
+
+import "fmt"
+
+type UpdateOp struct {
+	file     DBFile
+	setCols  []int  // indexes of the columns that are assigned
+	setExprs []Expr // the new value of each assigned column, evaluated on the old record
+	child    Operator
+}
+
+// Construtor.  The update operator replaces each record of the child Operator
+// in the specified DBFile with a copy in which column setCols[i] is set to the
+// value of setExprs[i].  Text assigned to an embedded string column is
+// embedded when the record is updated.
+func NewUpdateOp(updateFile DBFile, setCols []int, setExprs []Expr, child Operator) (*UpdateOp, error) {
+	if len(setCols) != len(setExprs) {
+		return nil, ailikeError{MalformedDataError, "NewUpdateOp expects one expression per column."}
+	}
+	desc := updateFile.Descriptor()
+	for i, col := range setCols {
+		if col < 0 || col >= len(desc.Fields) {
+			return nil, ailikeError{MalformedDataError, "NewUpdateOp column out of range."}
+		}
+		colType, exprType := desc.Fields[col].Ftype, setExprs[i].GetExprType().Ftype
+		// NULL, whose type is unknown, can be assigned to any column
+		if colType != exprType && exprType != UnknownType && !(colType == EmbeddedStringType && exprType == StringType) {
+			return nil, ailikeError{TypeMismatchError, fmt.Sprintf("cannot assign %s to %s column %s",
+				typeNames[exprType], typeNames[colType], desc.Fields[col].Fname)}
+		}
+	}
+	return &UpdateOp{updateFile, setCols, setExprs, child}, nil
+}
+
+// The update TupleDesc is a one column descriptor with an integer field named "count"
+func (u *UpdateOp) Descriptor() *TupleDesc {
+	ft := FieldType{Fname: "count", TableQualifier: "", Ftype: IntType}
+	fts := []FieldType{ft}
+	return &TupleDesc{Fields: fts}
+}
+
+// Returns the updated copy of t.
+func (u *UpdateOp) updatedTuple(t *Tuple) (*Tuple, error) {
+	fields := make([]DBValue, len(t.Fields))
+	copy(fields, t.Fields)
+	for i, col := range u.setCols {
+		v, err := u.setExprs[i].EvalExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := v.(StringField); ok && u.file.Descriptor().Fields[col].Ftype == EmbeddedStringType {
+			v = EmbeddedStringField{Value: s.Value}
+		}
+		fields[col] = v
+	}
+	return &Tuple{Desc: t.Desc, Fields: fields, Rid: t.Rid}, nil
+}
+
+// Return an iterator function that updates all of the tuples from the child
+// iterator in the DBFile passed to the constuctor and then returns a
+// one-field tuple with a "count" field indicating the number of tuples that
+// were updated.  The child is read to completion before any record is
+// updated, so records that move are not seen, and updated, twice.
+func (u *UpdateOp) Iterator(tid *Transaction) (func() (*Tuple, error), error) {
+	childIter, err := u.child.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	if childIter == nil {
+		return nil, ailikeError{MalformedDataError, "UpdateOp child Iterator unexpectedly nil."}
+	}
+	if !u.child.Descriptor().equals(u.file.Descriptor()) {
+		return nil, ailikeError{TypeMismatchError, "Trying to update tuples with wrong type in table."}
+	}
+	complete := false
+
+	return func() (*Tuple, error) {
+		if complete {
+			return nil, nil
+		}
+		var toUpdate []*Tuple
+		for t, err := childIter(); t != nil || err != nil; t, err = childIter() {
+			if err != nil {
+				return nil, err
+			}
+			toUpdate = append(toUpdate, t)
+		}
+		for _, t := range toUpdate {
+			updated, err := u.updatedTuple(t)
+			if err != nil {
+				return nil, err
+			}
+			if err := u.file.updateTuple(t, updated, tid); err != nil {
+				return nil, err
+			}
+		}
+		complete = true
+		countField := IntField{int64(len(toUpdate))}
+		return &Tuple{Desc: *u.Descriptor(), Fields: []DBValue{countField}, Rid: nil}, nil
+	}, nil
+}
@@ -0,0 +1,254 @@
+package godb
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdateOp(t *testing.T) {
+	td, t1, t2, hf, bp, tid := makeTestVars()
+	hf.insertTuple(&t1, tid)
+	hf.insertTuple(&t2, tid)
+	tid.Commit()
+
+	age := &FieldExpr{td.Fields[1]}
+	over30, err := NewCompareExpr(age, OpGt, &ConstExpr{IntField{30}, IntType})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	filt, err := NewFilter(over30, hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var ageArg, oneArg Expr = age, &ConstExpr{IntField{1}, IntType}
+	plusOne := &FuncExpr{op: "+", args: []*Expr{&ageArg, &oneArg}}
+	up, err := NewUpdateOp(hf, []int{0, 1}, []Expr{&ConstExpr{StringField{"george"}, StringType}, plusOne}, filt)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	tid = bp.Transactions().Begin()
+	iter, _ := up.Iterator(tid)
+	tup, err := iter()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if tup == nil || tup.Fields[0].(IntField).Value != 1 {
+		t.Fatalf("expected update to report 1 updated record, got %v", tup)
+	}
+	if tup, _ := iter(); tup != nil {
+		t.Errorf("expected update to return a single count")
+	}
+	tid.Commit()
+
+	tid = bp.Transactions().Begin()
+	defer tid.Commit()
+	iter, _ = hf.Iterator(tid)
+	cnt := 0
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		name, age := tup.Fields[0].(StringField).Value, tup.Fields[1].(IntField).Value
+		if (name != "sam" || age != 25) && (name != "george" || age != 1000) {
+			t.Errorf("unexpected record %v after update", tup.Fields)
+		}
+		cnt++
+	}
+	if cnt != 2 {
+		t.Errorf("expected the update to keep 2 records, got %d", cnt)
+	}
+
+	if _, err := NewUpdateOp(hf, []int{1}, []Expr{&ConstExpr{StringField{"x"}, StringType}}, hf); err == nil {
+		t.Errorf("expected error assigning a string to an int column")
+	}
+}
+
+// Updates a table with a vector column, which cannot be compared with !=,
+// both setting only the scalar column and replacing the vector.
+func TestUpdateVectorColumn(t *testing.T) {
+	td := TupleDesc{Fields: []FieldType{{Fname: "id", Ftype: IntType}, {Fname: "vec", Ftype: VectorFieldType}}}
+	bp := NewBufferPool(3)
+	hf, err := NewHeapFile(filepath.Join(t.TempDir(), "vectors.dat"), &td, bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	vector := func(x float64) VectorField {
+		emb := make(EmbeddingType, TextEmbeddingDim)
+		emb[0] = x
+		return VectorField{Emb: emb}
+	}
+	tid := bp.Transactions().Begin()
+	for i := 0; i < 2; i++ {
+		tup := Tuple{Desc: td, Fields: []DBValue{IntField{int64(i)}, vector(float64(i))}}
+		if err := hf.insertTuple(&tup, tid); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	tid.Commit()
+
+	id := &FieldExpr{td.Fields[0]}
+	var idArg, oneArg Expr = id, &ConstExpr{IntField{1}, IntType}
+	updates := []*UpdateOp{}
+	for _, set := range []struct {
+		col  int
+		expr Expr
+	}{
+		{0, &FuncExpr{op: "+", args: []*Expr{&idArg, &oneArg}}},
+		{1, &ConstExpr{vector(7), VectorFieldType}},
+	} {
+		up, err := NewUpdateOp(hf, []int{set.col}, []Expr{set.expr}, hf)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		updates = append(updates, up)
+	}
+	for _, up := range updates {
+		tid = bp.Transactions().Begin()
+		iter, err := up.Iterator(tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup, err := iter(); err != nil || tup == nil || tup.Fields[0].(IntField).Value != 2 {
+			t.Fatalf("expected update to report 2 updated records, got %v, %v", tup, err)
+		}
+		tid.Commit()
+	}
+
+	tid = bp.Transactions().Begin()
+	defer tid.Commit()
+	iter, _ := hf.Iterator(tid)
+	ids := make(map[int64]bool)
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		ids[tup.Fields[0].(IntField).Value] = true
+		if emb := tup.Fields[1].(VectorField).Emb; emb[0] != 7 {
+			t.Errorf("expected the vector to be replaced, got %v", emb[0])
+		}
+	}
+	if len(ids) != 2 || !ids[1] || !ids[2] {
+		t.Errorf("expected ids 1 and 2 after update, got %v", ids)
+	}
+}
+
+func TestUpdateParse(t *testing.T) {
+	c, bp := makeJoinStatsTestCatalog(t)
+	plan, counts := runIntColumnQuery(t, c, bp, "update r set s_id = s_id + 100, r_id = 0 - r_id where r_id < 10 or r_id >= 495", 0)
+	if len(counts) != 1 || counts[0] != 15 {
+		t.Fatalf("expected update to report 15 updated records, got %v", counts)
+	}
+	if planLabel(plan) != "Update" {
+		t.Errorf("expected update plan, got %s", planLabel(plan))
+	}
+	_, ids := sortedIntColumn(t, c, bp, "select r_id from r where s_id >= 100")
+	if len(ids) != 15 || ids[0] != -499 || ids[len(ids)-1] != 0 {
+		t.Errorf("expected the 15 updated records to be negated, got %v", ids)
+	}
+	_, ids = sortedIntColumn(t, c, bp, "select r_id from r")
+	if len(ids) != 500 {
+		t.Errorf("expected 500 records after update, got %d", len(ids))
+	}
+
+	_, counts = runIntColumnQuery(t, c, bp, "update t set name = 'updated' where t_id = 2", 0)
+	if len(counts) != 1 || counts[0] != 1 {
+		t.Errorf("expected update to report 1 updated record, got %v", counts)
+	}
+	_, ids = sortedIntColumn(t, c, bp, "select t_id from t where name = 'updated'")
+	if len(ids) != 1 || ids[0] != 2 {
+		t.Errorf("expected only t_id 2 to be renamed, got %v", ids)
+	}
+
+	for _, sql := range []string{
+		"update r set missing = 1",
+		"update r set r_id = 'abc'",
+		"update r set r_id = 1, r_id = 2",
+		"update r, s set r_id = 1",
+	} {
+		if _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected error parsing %s", sql)
+		}
+	}
+}
+
+// Returns the ids of the k tweets whose content is most similar to the query,
+// found through the vector index of the table.
+func nearestTweetIds(t *testing.T, c *Catalog, bp *BufferPool, k int) []int64 {
+	plan, ids := runIntColumnQuery(t, c, bp, fmt.Sprintf("select tweet_id, content ailike 'query' d from tweets_test order by d limit %d", k), 0)
+	if !planContains(plan, &NNScan{}) {
+		t.Fatalf("expected the query to use the vector index")
+	}
+	return ids
+}
+
+func TestUpdateEmbeddedString(t *testing.T) {
+	for _, clustered := range []bool{false, true} {
+		c, hf, bp, dir := makeTweetsTestCatalog(t)
+		tweets := readFirstTweets(t, hf, bp, 1)
+		query := tweets[0].Fields[2].(EmbeddedStringField).Emb
+		far := make(EmbeddingType, len(query))
+		for i, v := range query {
+			far[i] = -v
+		}
+		// the query and the new text are embedded to the same point, and any
+		// other text far from it
+		startFakeEmbeddingServerFunc(t, func(text string) EmbeddingType {
+			if text == "query" || text == "updated text" {
+				return query
+			}
+			return far
+		})
+		_, err := ConstructNNIndexFileFromHeapFile(hf, "content", 10, clustered, dir, "tweets_test", bp)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		_, ids := runIntColumnQuery(t, c, bp, "select tweet_id from tweets_test", 0)
+		nTweets := len(ids)
+		var target int64 = -1
+		for _, id := range ids {
+			if id != tweets[0].Fields[0].(IntField).Value {
+				target = id
+				break
+			}
+		}
+
+		_, counts := runIntColumnQuery(t, c, bp, "update tweets_test set content = 'updated text', sentiment = 'updated' where tweet_id = "+fmt.Sprint(target), 0)
+		if len(counts) != 1 || counts[0] != 1 {
+			t.Fatalf("expected update to report 1 updated record, got %v", counts)
+		}
+
+		// the updated record is found through the index by its new embedding
+		nearest := nearestTweetIds(t, c, bp, 2)
+		found := false
+		for _, id := range nearest {
+			found = found || id == target
+		}
+		if !found {
+			t.Errorf("clustered=%v: expected updated tweet %d among the nearest tweets, got %v", clustered, target, nearest)
+		}
+		_, ids = runIntColumnQuery(t, c, bp, "select tweet_id from tweets_test where sentiment = 'updated'", 0)
+		if len(ids) != 1 || ids[0] != target {
+			t.Errorf("clustered=%v: expected only tweet %d to be updated, got %v", clustered, target, ids)
+		}
+		_, ids = runIntColumnQuery(t, c, bp, "select tweet_id from tweets_test", 0)
+		if len(ids) != nTweets {
+			t.Errorf("clustered=%v: expected %d tweets after update, got %d", clustered, nTweets, len(ids))
+		}
+
+		// updating other columns keeps the embedding and the record's place in the index
+		_, counts = runIntColumnQuery(t, c, bp, "update tweets_test set tweet_id = tweet_id + 1000000 where content = 'updated text'", 0)
+		if len(counts) != 1 || counts[0] != 1 {
+			t.Fatalf("expected update to report 1 updated record, got %v", counts)
+		}
+		nearest = nearestTweetIds(t, c, bp, 2)
+		found = false
+		for _, id := range nearest {
+			found = found || id == target+1000000
+		}
+		if !found {
+			t.Errorf("clustered=%v: expected renumbered tweet %d among the nearest tweets, got %v", clustered, target+1000000, nearest)
+		}
+	}
+}
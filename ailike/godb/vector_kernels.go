@@ -0,0 +1,95 @@
+package godb
+
+// The kernels compute distances over contiguous arrays of float64s.  Their
+// loops are unrolled by four, with a separate accumulator for each of the four
+// elements, so that each multiply-add does not wait for the one before it, and
+// the slices are resliced as they go, so that the compiler can prove the
+// indexes in bounds and leave out the bounds checks.  Sums are therefore
+// accumulated in a different order than a simple loop would, and may differ
+// from its in the last bits.
+//
+// The kernels assume their arguments are of the same length; callers check.
+
+// Returns the dot product of a and b.
+func dotKernel(a, b []float64) float64 {
+	b = b[:len(a)]
+	var s0, s1, s2, s3 float64
+	for len(a) >= 4 {
+		s0 += a[0] * b[0]
+		s1 += a[1] * b[1]
+		s2 += a[2] * b[2]
+		s3 += a[3] * b[3]
+		a, b = a[4:], b[4:]
+	}
+	for i := range a {
+		s0 += a[i] * b[i]
+	}
+	return (s0 + s1) + (s2 + s3)
+}
+
+// Returns the squared Euclidean norm of a.
+func sqNormKernel(a []float64) float64 {
+	return dotKernel(a, a)
+}
+
+// Returns the dot product of a and b, and the squared norm of b, in one pass,
+// for the cosine of vectors of which only the norm of a is known.
+func dotSqNormKernel(a, b []float64) (dot float64, sqNorm float64) {
+	b = b[:len(a)]
+	var d0, d1, d2, d3, n0, n1, n2, n3 float64
+	for len(a) >= 4 {
+		d0 += a[0] * b[0]
+		d1 += a[1] * b[1]
+		d2 += a[2] * b[2]
+		d3 += a[3] * b[3]
+		n0 += b[0] * b[0]
+		n1 += b[1] * b[1]
+		n2 += b[2] * b[2]
+		n3 += b[3] * b[3]
+		a, b = a[4:], b[4:]
+	}
+	for i := range a {
+		d0 += a[i] * b[i]
+		n0 += b[i] * b[i]
+	}
+	return (d0 + d1) + (d2 + d3), (n0 + n1) + (n2 + n3)
+}
+
+// Returns the sum of the squared differences of a and b.
+func sqDistKernel(a, b []float64) float64 {
+	b = b[:len(a)]
+	var s0, s1, s2, s3 float64
+	for len(a) >= 4 {
+		e0, e1, e2, e3 := a[0]-b[0], a[1]-b[1], a[2]-b[2], a[3]-b[3]
+		s0 += e0 * e0
+		s1 += e1 * e1
+		s2 += e2 * e2
+		s3 += e3 * e3
+		a, b = a[4:], b[4:]
+	}
+	for i := range a {
+		e := a[i] - b[i]
+		s0 += e * e
+	}
+	return (s0 + s1) + (s2 + s3)
+}
+
+// Sets out[i] to the dot product of query and rows[i], for each of rows, which
+// must all have the length of query.
+func dotBatchKernel(query []float64, rows [][]float64, out []float64) {
+	out = out[:len(rows)]
+	for i, row := range rows {
+		out[i] = dotKernel(query, row)
+	}
+}
+
+// Sets out[i] to the cosine of query, whose norm is queryNorm, and rows[i],
+// whose norm is rowNorms[i], for each of rows, which must all have the length
+// of query.
+func cosineBatchKernel(query []float64, queryNorm float64, rows [][]float64, rowNorms []float64, out []float64) {
+	out = out[:len(rows)]
+	rowNorms = rowNorms[:len(rows)]
+	for i, row := range rows {
+		out[i] = dotKernel(query, row) / (queryNorm * rowNorms[i])
+	}
+}
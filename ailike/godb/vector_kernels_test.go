@@ -0,0 +1,138 @@
+package godb
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Returns a vector of n random components in [-1, 1).
+func randomVector(r *rand.Rand, n int) []float64 {
+	v := make([]float64, n)
+	for i := range v {
+		v[i] = 2*r.Float64() - 1
+	}
+	return v
+}
+
+// The simple loops the kernels replace.
+func naiveDot(a, b []float64) float64 {
+	s := 0.0
+	for i := range a {
+		s += a[i] * b[i]
+	}
+	return s
+}
+
+func naiveSqDist(a, b []float64) float64 {
+	s := 0.0
+	for i := range a {
+		s += (a[i] - b[i]) * (a[i] - b[i])
+	}
+	return s
+}
+
+func closeTo(got, expected float64) bool {
+	return math.Abs(got-expected) <= 1e-9*math.Max(1, math.Abs(expected))
+}
+
+func TestDistanceKernels(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	// lengths around the unrolling, and that of an embedding
+	for _, n := range []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, TextEmbeddingDim} {
+		a, b := randomVector(r, n), randomVector(r, n)
+		if got, expected := dotKernel(a, b), naiveDot(a, b); !closeTo(got, expected) {
+			t.Errorf("length %d: expected dot product %v, got %v", n, expected, got)
+		}
+		if got, expected := sqNormKernel(a), naiveDot(a, a); !closeTo(got, expected) {
+			t.Errorf("length %d: expected squared norm %v, got %v", n, expected, got)
+		}
+		dot, sqNorm := dotSqNormKernel(a, b)
+		if !closeTo(dot, naiveDot(a, b)) || !closeTo(sqNorm, naiveDot(b, b)) {
+			t.Errorf("length %d: expected %v and %v, got %v and %v", n, naiveDot(a, b), naiveDot(b, b), dot, sqNorm)
+		}
+		if got, expected := sqDistKernel(a, b), naiveSqDist(a, b); !closeTo(got, expected) {
+			t.Errorf("length %d: expected squared distance %v, got %v", n, expected, got)
+		}
+	}
+}
+
+// The batch kernels compute the same values as the kernels of one pair.
+func TestBatchKernels(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	query := randomVector(r, TextEmbeddingDim)
+	rows := make([][]float64, 10)
+	for i := range rows {
+		rows[i] = randomVector(r, TextEmbeddingDim)
+	}
+	dots := make([]float64, len(rows))
+	dotBatchKernel(query, rows, dots)
+	norms := make([]float64, len(rows))
+	for i, row := range rows {
+		norms[i] = normOf(row)
+	}
+	cosines := make([]float64, len(rows))
+	cosineBatchKernel(query, normOf(query), rows, norms, cosines)
+	for i, row := range rows {
+		if dots[i] != dotKernel(query, row) {
+			t.Errorf("row %d: expected dot product %v, got %v", i, dotKernel(query, row), dots[i])
+		}
+		q, v := EmbeddingType(query), EmbeddingType(row)
+		expected, err := CosDist(&q, &v)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if cosines[i] != expected {
+			t.Errorf("row %d: expected cosine %v, got %v", i, expected, cosines[i])
+		}
+	}
+}
+
+func BenchmarkDistanceKernels(b *testing.B) {
+	r := rand.New(rand.NewSource(3))
+	query := randomVector(r, TextEmbeddingDim)
+	rows := make([][]float64, BATCH_SIZE)
+	for i := range rows {
+		rows[i] = randomVector(r, TextEmbeddingDim)
+	}
+	norms := make([]float64, len(rows))
+	for i, row := range rows {
+		norms[i] = normOf(row)
+	}
+	out := make([]float64, len(rows))
+	b.Run("dot/loop", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for j, row := range rows {
+				out[j] = naiveDot(query, row)
+			}
+		}
+	})
+	b.Run("dot/kernel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			dotBatchKernel(query, rows, out)
+		}
+	})
+	b.Run("cosine/loop", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for j, row := range rows {
+				out[j] = naiveDot(query, row) / (math.Sqrt(naiveDot(query, query)) * math.Sqrt(naiveDot(row, row)))
+			}
+		}
+	})
+	// the norms of the rows computed with each evaluation, as they were before
+	// they were kept with the rows
+	b.Run("cosine/kernel, row norms computed", func(b *testing.B) {
+		queryNorm := normOf(query)
+		for i := 0; i < b.N; i++ {
+			for j, row := range rows {
+				dot, sqNorm := dotSqNormKernel(query, row)
+				out[j] = dot / (queryNorm * math.Sqrt(sqNorm))
+			}
+		}
+	})
+	b.Run("cosine/kernel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			cosineBatchKernel(query, normOf(query), rows, norms, out)
+		}
+	})
+}
@@ -0,0 +1,514 @@
+package godb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A LogFile is the write-ahead log of a database, stored next to its catalog.
+// It lets the buffer pool write out pages of uncommitted transactions (STEAL)
+// and commit transactions without writing their pages (NO-FORCE): a page is
+// only written once the log records describing it are on disk, and a
+// transaction only commits once its commit record is, so after a crash the
+// log can redo the changes of committed transactions and undo those of the
+// rest, as in ARIES.
+//
+// Log records are identified by their log sequence number (LSN), which is
+// their offset in the file.  Changes are logged as the image of a page before
+// and after a transaction changed it, and are redone physically, by writing
+// the images in the order they were logged.  Pages without versions are locked
+// for writing until the transaction that changed them completes, so their
+// changes are also undone physically, by restoring the image before the
+// change.  Pages with versions can be changed by several transactions at once,
+// each holding locks on its records, so the image logged by one may include
+// the changes of others; their changes are undone logically instead, by
+// removing the versions the transaction created and restoring those it
+// deleted from the page as it is when the change is undone.
+//
+// The first bytes of the file are its master record: the LSN of the last
+// checkpoint, where recovery starts, and the largest id of a transaction that
+// logged a record before it.  Transaction ids are stamped on the versions of
+// tuples, so the ids handed out once the log is opened continue from the
+// largest in the log (see [advanceTransactionIds]).
+//
+// A LogFile is used with the mutex of the buffer pool it is attached to held.
+type LogFile struct {
+	fileName string
+	file     *os.File
+	tail     []byte // records appended since the log was last forced
+	tailLSN  LSN    // the LSN of the first record in tail
+	// the last record of each active transaction that has logged a change
+	lastLSN map[*Transaction]LSN
+	// the first record that changed each page that has not been written since
+	dirtyPages     map[HeapFilePageKey]LSN
+	lastCheckpoint LSN
+	// the largest id of a transaction that has logged a record
+	highestTid int64
+}
+
+type LSN int64
+
+// The LSN of no record, which ends the chain of records of a transaction.
+const noLSN LSN = 0
+
+// The size of the master record at the start of the log.
+const logHeaderSize = 16
+
+// The number of bytes of log written between the checkpoints taken when
+// transactions commit.
+const CHECKPOINT_INTERVAL = 1 << 24
+
+type logRecordType uint8
+
+const (
+	beginRecord      logRecordType = iota
+	updateRecord     logRecordType = iota
+	commitRecord     logRecordType = iota
+	abortRecord      logRecordType = iota
+	clrRecord        logRecordType = iota // a compensation log record, which logs the undo of an update
+	endRecord        logRecordType = iota
+	checkpointRecord logRecordType = iota
+)
+
+type logRecord struct {
+	kind    logRecordType
+	lsn     LSN
+	tid     int64
+	prevLSN LSN // the previous record of the transaction
+	// the page an update or compensation record changes, its image before an
+	// update, and its image after it; a compensation record only has the image
+	// it restores
+	page   HeapFilePageKey
+	before []byte
+	after  []byte
+	// the size of the slots of the page of an update, if it has versions, and
+	// zero if its changes are undone physically
+	slotSize int
+	// the next record of the transaction to undo after a compensation record
+	undoNext LSN
+	// the LSN of the record that follows this one in the log, once it is read
+	nextLSN LSN
+	// the transaction table and dirty page table of a checkpoint, mapping each
+	// active transaction to its last record, and each page that may not have
+	// been written since it was changed to the first record that changed it
+	transactions map[int64]LSN
+	dirtyPages   map[HeapFilePageKey]LSN
+}
+
+var (
+	openLogs      = make(map[string]*LogFile) // logs opened by this process, by absolute path
+	openLogsMutex sync.Mutex
+)
+
+// Returns the name of the log of the catalog catalogFile in rootPath; the log
+// of catalog.txt is catalog.log.
+func logFileName(catalogFile string, rootPath string) string {
+	return rootPath + "/" + strings.TrimSuffix(catalogFile, filepath.Ext(catalogFile)) + ".log"
+}
+
+// Opens the log in fileName, creating it if it does not exist.  The first time
+// the process opens a log, the database is recovered from it: the changes of
+// transactions that committed before the process that wrote it stopped are
+// redone, and those of the rest are undone.  Opening the log again returns the
+// same LogFile.
+func openLogFile(fileName string) (*LogFile, error) {
+	path, err := filepath.Abs(fileName)
+	if err != nil {
+		return nil, ailikeError{OSError, err.Error()}
+	}
+	openLogsMutex.Lock()
+	defer openLogsMutex.Unlock()
+	if l, ok := openLogs[path]; ok {
+		return l, nil
+	}
+	l, err := readLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.recover(); err != nil {
+		l.file.Close()
+		return nil, err
+	}
+	advanceTransactionIds(l.highestTid)
+	openLogs[path] = l
+	return l, nil
+}
+
+// Opens the log in fileName without recovering from it.
+func readLogFile(fileName string) (*LogFile, error) {
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, ailikeError{OSError, err.Error()}
+	}
+	l := &LogFile{fileName: fileName, file: file, lastLSN: make(map[*Transaction]LSN), dirtyPages: make(map[HeapFilePageKey]LSN)}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, ailikeError{OSError, err.Error()}
+	}
+	if info.Size() < logHeaderSize {
+		if err := l.truncate(); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+	header := make([]byte, logHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		file.Close()
+		return nil, ailikeError{OSError, err.Error()}
+	}
+	l.lastCheckpoint = LSN(binary.LittleEndian.Uint64(header))
+	l.highestTid = int64(binary.LittleEndian.Uint64(header[8:]))
+	l.tailLSN = LSN(info.Size())
+	return l, nil
+}
+
+// Closes the log without forcing the records appended since it was last
+// forced, as if the process had crashed.  Opening it again recovers from it.
+func (l *LogFile) close() error {
+	openLogsMutex.Lock()
+	defer openLogsMutex.Unlock()
+	for path, open := range openLogs {
+		if open == l {
+			delete(openLogs, path)
+		}
+	}
+	return l.file.Close()
+}
+
+// Empties the log.  This is only safe when no transaction is active and every
+// page changed by the records in the log has been written.
+func (l *LogFile) truncate() error {
+	if err := l.file.Truncate(0); err != nil {
+		return ailikeError{OSError, err.Error()}
+	}
+	l.tail = nil
+	l.tailLSN = logHeaderSize
+	l.lastCheckpoint = noLSN
+	clear(l.lastLSN)
+	clear(l.dirtyPages)
+	return l.writeMaster()
+}
+
+// Writes the LSN of the last checkpoint and the largest transaction id logged
+// to the master record.
+func (l *LogFile) writeMaster() error {
+	header := make([]byte, logHeaderSize)
+	binary.LittleEndian.PutUint64(header, uint64(l.lastCheckpoint))
+	binary.LittleEndian.PutUint64(header[8:], uint64(l.highestTid))
+	if _, err := l.file.WriteAt(header, 0); err != nil {
+		return ailikeError{OSError, err.Error()}
+	}
+	if err := l.file.Sync(); err != nil {
+		return ailikeError{OSError, err.Error()}
+	}
+	return nil
+}
+
+// Returns the LSN the next record appended to the log will have.
+func (l *LogFile) nextLSN() LSN {
+	return l.tailLSN + LSN(len(l.tail))
+}
+
+// Appends r to the log, setting its LSN.  The record is not on disk until the
+// log is forced.
+func (l *LogFile) append(r *logRecord) LSN {
+	r.lsn = l.nextLSN()
+	b := r.encode()
+	l.tail = binary.LittleEndian.AppendUint32(l.tail, uint32(len(b)))
+	l.tail = append(l.tail, b...)
+	return r.lsn
+}
+
+// Writes the records appended to the log to disk.
+func (l *LogFile) force() error {
+	if len(l.tail) == 0 {
+		return nil
+	}
+	if _, err := l.file.WriteAt(l.tail, int64(l.tailLSN)); err != nil {
+		return ailikeError{OSError, err.Error()}
+	}
+	if err := l.file.Sync(); err != nil {
+		return ailikeError{OSError, err.Error()}
+	}
+	l.tailLSN += LSN(len(l.tail))
+	l.tail = l.tail[:0]
+	return nil
+}
+
+// Reads the record with the given LSN, returning nil at the end of the log.
+// A record that was only partly written before a crash also ends the log.
+func (l *LogFile) readRecord(lsn LSN) (*logRecord, error) {
+	if lsn >= l.tailLSN {
+		if err := l.force(); err != nil {
+			return nil, err
+		}
+	}
+	var size [4]byte
+	if _, err := l.file.ReadAt(size[:], int64(lsn)); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, ailikeError{OSError, err.Error()}
+	}
+	b := make([]byte, binary.LittleEndian.Uint32(size[:]))
+	if _, err := l.file.ReadAt(b, int64(lsn)+4); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, ailikeError{OSError, err.Error()}
+	}
+	r, err := decodeLogRecord(b)
+	if err != nil {
+		return nil, err
+	}
+	r.lsn = lsn
+	r.nextLSN = lsn + 4 + LSN(len(b))
+	return r, nil
+}
+
+// Appends a record of tid to the log, after a begin record if it is the first
+// record of the transaction.
+func (l *LogFile) appendTransactionRecord(tid *Transaction, r *logRecord) LSN {
+	r.tid = tid.id
+	l.highestTid = max(l.highestTid, r.tid)
+	prev, ok := l.lastLSN[tid]
+	if !ok {
+		prev = l.append(&logRecord{kind: beginRecord, tid: r.tid})
+	}
+	r.prevLSN = prev
+	l.lastLSN[tid] = l.append(r)
+	return l.lastLSN[tid]
+}
+
+// Logs that tid changed page from the image before to the image after; the
+// slots of the page are slotSize bytes if it has versions, and slotSize is
+// zero otherwise.
+func (l *LogFile) logUpdate(tid *Transaction, page HeapFilePageKey, before []byte, after []byte, slotSize int) {
+	lsn := l.appendTransactionRecord(tid, &logRecord{kind: updateRecord, page: page, before: before, after: after, slotSize: slotSize})
+	l.pageChanged(page, lsn)
+}
+
+// Records that the record lsn changed page, which is in the buffer pool.
+func (l *LogFile) pageChanged(page HeapFilePageKey, lsn LSN) {
+	if _, ok := l.dirtyPages[page]; !ok {
+		l.dirtyPages[page] = lsn
+	}
+}
+
+// Forces the log before page is written, as the write-ahead rule requires, and
+// records that it no longer has changes that have not been written.
+func (l *LogFile) pageWritten(page HeapFilePageKey) error {
+	if err := l.force(); err != nil {
+		return err
+	}
+	delete(l.dirtyPages, page)
+	return nil
+}
+
+// Logs that tid committed and forces the log.  A transaction that did not
+// change any pages is not logged.
+func (l *LogFile) logCommit(tid *Transaction) error {
+	if _, ok := l.lastLSN[tid]; !ok {
+		return nil
+	}
+	l.appendTransactionRecord(tid, &logRecord{kind: commitRecord})
+	delete(l.lastLSN, tid)
+	return l.force()
+}
+
+// Logs that tid aborted, and rolls back the changes it logged, latest first,
+// calling restore to give each page its image without the change; current
+// returns the image a page has, to undo changes to pages with versions.
+func (l *LogFile) logAbort(tid *Transaction, current func(page HeapFilePageKey) ([]byte, error), restore func(page HeapFilePageKey, image []byte, clr LSN) error) error {
+	if _, ok := l.lastLSN[tid]; !ok {
+		return nil
+	}
+	last := l.appendTransactionRecord(tid, &logRecord{kind: abortRecord})
+	for lsn := last; lsn != noLSN; {
+		r, err := l.readRecord(lsn)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			return ailikeError{MalformedDataError, "log record to undo is missing"}
+		}
+		if lsn, err = l.undoRecord(r, &last, current, restore); err != nil {
+			return err
+		}
+	}
+	l.append(&logRecord{kind: endRecord, tid: tid.id, prevLSN: last})
+	delete(l.lastLSN, tid)
+	return nil
+}
+
+// Writes a checkpoint, which records the active transactions and the pages
+// with changes that may not have been written, so that recovery can start from
+// it rather than from the start of the log.  If there are neither, nothing
+// before the checkpoint is needed, and the log is emptied instead.
+func (l *LogFile) checkpoint() error {
+	if len(l.lastLSN) == 0 && len(l.dirtyPages) == 0 {
+		if err := l.force(); err != nil {
+			return err
+		}
+		return l.truncate()
+	}
+	r := &logRecord{kind: checkpointRecord, transactions: make(map[int64]LSN), dirtyPages: l.dirtyPages}
+	for tid, lsn := range l.lastLSN {
+		r.transactions[tid.id] = lsn
+	}
+	lsn := l.append(r)
+	if err := l.force(); err != nil {
+		return err
+	}
+	l.lastCheckpoint = lsn
+	return l.writeMaster()
+}
+
+// Returns the number of bytes logged since the last checkpoint.
+func (l *LogFile) sinceCheckpoint() int64 {
+	return int64(l.nextLSN() - max(l.lastCheckpoint, logHeaderSize))
+}
+
+func (r *logRecord) encode() []byte {
+	b := new(bytes.Buffer)
+	writeInt := func(v int64) { binary.Write(b, binary.LittleEndian, v) }
+	writeBytes := func(v []byte) {
+		binary.Write(b, binary.LittleEndian, uint32(len(v)))
+		b.Write(v)
+	}
+	writePage := func(p HeapFilePageKey) {
+		writeBytes([]byte(p.fileName))
+		writeInt(int64(p.pageNo))
+	}
+	b.WriteByte(byte(r.kind))
+	writeInt(r.tid)
+	writeInt(int64(r.prevLSN))
+	switch r.kind {
+	case updateRecord:
+		writePage(r.page)
+		writeBytes(r.before)
+		writeBytes(r.after)
+		writeInt(int64(r.slotSize))
+	case clrRecord:
+		writePage(r.page)
+		writeBytes(r.after)
+		writeInt(int64(r.undoNext))
+	case checkpointRecord:
+		writeInt(int64(len(r.transactions)))
+		for tid, lsn := range r.transactions {
+			writeInt(tid)
+			writeInt(int64(lsn))
+		}
+		writeInt(int64(len(r.dirtyPages)))
+		for page, lsn := range r.dirtyPages {
+			writePage(page)
+			writeInt(int64(lsn))
+		}
+	}
+	return b.Bytes()
+}
+
+func decodeLogRecord(data []byte) (*logRecord, error) {
+	b := bytes.NewBuffer(data)
+	var err error
+	readInt := func() int64 {
+		var v int64
+		if err == nil {
+			err = binary.Read(b, binary.LittleEndian, &v)
+		}
+		return v
+	}
+	readBytes := func() []byte {
+		var n uint32
+		if err == nil {
+			err = binary.Read(b, binary.LittleEndian, &n)
+		}
+		if err != nil || int(n) > b.Len() {
+			err = io.ErrUnexpectedEOF
+			return nil
+		}
+		return b.Next(int(n))
+	}
+	readPage := func() HeapFilePageKey {
+		fileName := string(readBytes())
+		return HeapFilePageKey{fileName, int(readInt())}
+	}
+	kind, err := b.ReadByte()
+	r := &logRecord{kind: logRecordType(kind)}
+	r.tid = readInt()
+	r.prevLSN = LSN(readInt())
+	switch r.kind {
+	case beginRecord, commitRecord, abortRecord, endRecord:
+	case updateRecord:
+		r.page = readPage()
+		r.before = readBytes()
+		r.after = readBytes()
+		r.slotSize = int(readInt())
+	case clrRecord:
+		r.page = readPage()
+		r.after = readBytes()
+		r.undoNext = LSN(readInt())
+	case checkpointRecord:
+		r.transactions = make(map[int64]LSN)
+		for n := readInt(); err == nil && n > 0; n-- {
+			tid := readInt()
+			r.transactions[tid] = LSN(readInt())
+		}
+		r.dirtyPages = make(map[HeapFilePageKey]LSN)
+		for n := readInt(); err == nil && n > 0; n-- {
+			page := readPage()
+			r.dirtyPages[page] = LSN(readInt())
+		}
+	default:
+		return nil, ailikeError{MalformedDataError, "unknown log record type"}
+	}
+	if err != nil {
+		return nil, ailikeError{MalformedDataError, "malformed log record"}
+	}
+	return r, nil
+}
+
+// Returns the image of the page of a file on disk, or nil if it is past the
+// end of the file, or the file no longer exists.
+func readPageImage(page HeapFilePageKey) ([]byte, error) {
+	b := make([]byte, PageSize)
+	n, err := sharedFiles.readAt(page.fileName, b, int64(page.pageNo*PageSize))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err == io.EOF && n == 0 {
+		return nil, nil
+	} else if err != nil && err != io.EOF {
+		return nil, ailikeError{OSError, err.Error()}
+	}
+	return b, nil
+}
+
+// Writes image to the page of a file on disk, padding it to a full page.
+// Pages of files that no longer exist, and past the end of their file, are
+// ignored: they belong to files that were dropped or replaced after the
+// changes were logged.
+func writePageImage(page HeapFilePageKey, image []byte) error {
+	info, err := os.Stat(page.fileName)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return ailikeError{OSError, err.Error()}
+	}
+	if int64(page.pageNo*PageSize) >= info.Size() {
+		return nil
+	}
+	b := make([]byte, PageSize)
+	copy(b, image)
+	if _, err := sharedFiles.writeAt(page.fileName, b, int64(page.pageNo*PageSize)); err != nil {
+		return ailikeError{OSError, err.Error()}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package godb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLogRecordEncoding(t *testing.T) {
+	page := HeapFilePageKey{"t.dat", 7}
+	for _, r := range []*logRecord{
+		{kind: beginRecord, tid: 3},
+		{kind: updateRecord, tid: 3, prevLSN: 8, page: page, before: []byte{1, 2}, after: []byte{3, 4, 5}, slotSize: 57},
+		{kind: clrRecord, tid: 3, prevLSN: 40, page: page, after: []byte{1, 2}, undoNext: 8},
+		{kind: checkpointRecord, transactions: map[int64]LSN{3: 40}, dirtyPages: map[HeapFilePageKey]LSN{page: 8}},
+	} {
+		decoded, err := decodeLogRecord(r.encode())
+		if err != nil {
+			t.Fatalf("failed to decode record, %s", err.Error())
+		}
+		if decoded.kind != r.kind || decoded.tid != r.tid || decoded.prevLSN != r.prevLSN || decoded.undoNext != r.undoNext || decoded.slotSize != r.slotSize {
+			t.Errorf("expected %v, got %v", r, decoded)
+		}
+		if decoded.page != r.page || !bytes.Equal(decoded.before, r.before) || !bytes.Equal(decoded.after, r.after) {
+			t.Errorf("expected %v, got %v", r, decoded)
+		}
+		if len(decoded.transactions) != len(r.transactions) || len(decoded.dirtyPages) != len(r.dirtyPages) {
+			t.Errorf("expected %v, got %v", r, decoded)
+		}
+	}
+	if _, err := decodeLogRecord(nil); err == nil {
+		t.Errorf("expected an error decoding an empty record")
+	}
+}
+
+// Commits only write the log, and aborts roll back pages that were written out
+// before the transaction aborted.
+func TestLogStealNoForce(t *testing.T) {
+	dir := t.TempDir()
+	bp, hf := openRecoveryTestTable(t, dir, 3)
+	tid := bp.Transactions().Begin()
+	insertRecoveryTestRows(t, hf, tid, 0, 100)
+	tid.Commit()
+
+	// the committed rows are not on disk, but in the buffer pool and the log
+	noLogBp := NewBufferPool(3)
+	onDisk, err := NewHeapFile(hf.fileName, hf.Descriptor(), noLogBp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if ids := recoveryTestIds(t, noLogBp, onDisk); len(ids) != 0 {
+		t.Errorf("expected committed rows to not be written, found %d", len(ids))
+	}
+	if ids := recoveryTestIds(t, bp, hf); len(ids) != 100 {
+		t.Errorf("expected 100 rows, got %d", len(ids))
+	}
+
+	// the buffer pool only has room for 3 pages, so pages of the aborted
+	// transaction are written out before it aborts
+	tid = bp.Transactions().Begin()
+	deleteRecoveryTestRows(t, hf, tid, 0, 50)
+	insertRecoveryTestRows(t, hf, tid, 100, 1000)
+	if hf.NumPages() < 5 {
+		t.Fatalf("expected the table to have grown past the buffer pool")
+	}
+	tid.Abort()
+	expected := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		expected[i] = true
+	}
+	checkRecoveryTestIds(t, bp, hf, expected, "after abort")
+
+	bp.FlushAllPages()
+	noLogBp = NewBufferPool(3)
+	onDisk, err = NewHeapFile(hf.fileName, hf.Descriptor(), noLogBp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	checkRecoveryTestIds(t, noLogBp, onDisk, expected, "on disk after abort")
+	simulateCrash(t, bp)
+}
+
+// Recovery that crashes while undoing a transaction finishes undoing it the
+// next time, without undoing any update twice.
+func TestCrashDuringRecovery(t *testing.T) {
+	dir := t.TempDir()
+	bp, hf := openRecoveryTestTable(t, dir, 3)
+	tid := bp.Transactions().Begin()
+	insertRecoveryTestRows(t, hf, tid, 0, 300)
+	tid.Commit()
+	tid = bp.Transactions().Begin()
+	deleteRecoveryTestRows(t, hf, tid, 0, 300)
+	insertRecoveryTestRows(t, hf, tid, 300, 1200)
+	bp.FlushAllPages()
+	simulateCrash(t, bp)
+
+	// redo, and undo two of the updates of the transaction, before crashing
+	l, err := readLogFile(dir + "/catalog.log")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	transactions, dirtyPages, err := l.analyze()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(transactions) != 1 {
+		t.Fatalf("expected one transaction to undo, got %d", len(transactions))
+	}
+	if err := l.redo(dirtyPages); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, lsn := range transactions {
+		last := lsn
+		for undone := 0; undone < 2; {
+			r, err := l.readRecord(lsn)
+			if err != nil || r == nil {
+				t.Fatalf("failed to read record to undo")
+			}
+			if r.kind == updateRecord {
+				undone++
+			}
+			lsn, err = l.undoRecord(r, &last, readPageImage, func(page HeapFilePageKey, image []byte, clr LSN) error {
+				if err := l.force(); err != nil {
+					return err
+				}
+				return writePageImage(page, image)
+			})
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+	}
+	if err := l.force(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	l.file.Close()
+
+	bp, hf = openRecoveryTestTable(t, dir, 3)
+	expected := make(map[int]bool)
+	for i := 0; i < 300; i++ {
+		expected[i] = true
+	}
+	checkRecoveryTestIds(t, bp, hf, expected, "after recovering twice")
+	simulateCrash(t, bp)
+}
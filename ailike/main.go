@@ -22,16 +22,20 @@ func check(e error) {
 }
 
 var helpText = `Enter a SQL query terminated by a ; to process it.  Commands prefixed with \ are processed as shell commands.
+Run ANALYZE table_name; to collect the statistics the optimizer uses to estimate plan costs, shown by EXPLAIN.
+Run VACUUM [table_name]; to reclaim the space of deleted and updated records that no transaction can still read.
+Prefix a query with EXPLAIN to show its plan, or with EXPLAIN ANALYZE [FORMAT JSON] to run it and show the work done by each operator.
 
 Available shell commands:
 	\h : This help
 	\c path/to/catalog : Change the current database to a specified catalog file
 	\d : List tables and fields in the current database
+	\dedup : table column_name threshold [delete]: List groups of records whose embeddings have cosine similarity of at least threshold, optionally deleting all but the first record of each group
 	\f : List available functions for use in queries
 	\a : Toggle aligned vs csv output
 	\l : table path/to/file [sep] [hasHeader]: Append csv file to end of table.  Default to sep = ',', hasHeader = 'true'
-	\i : table column_name num_clusters index_type path/to/file
-	\r : retrieval-based fact checker. Syntax: \r [FACT] | [TABLE] | [RETURN COLUMN] | [TEXT COLUMN] | true/falses (whether to use context from database)`
+	\i : table column_name num_clusters index_type path/to/file.  index_type is secondary, clustered, or text (num_clusters is ignored for text indexes)
+	\r : retrieval-based fact checker. Syntax: \r [FACT] | [TABLE] | [RETURN COLUMN] | [TEXT COLUMN] | true/falses (whether to use context from database) [| NUM RESULTS [| MMR LAMBDA]]`
 
 /*func printCatalog(fname string) {
 	f, err := os.Open(fname)
@@ -117,7 +121,7 @@ func main() {
 	fmt.Printf("\033[0m\n")
 	query := ""
 	var autocommit bool = true
-	var tid godb.TransactionID
+	var tid *godb.Transaction
 	aligned := true
 	for {
 
@@ -141,7 +145,62 @@ func main() {
 		if text[0] == '\\' {
 			switch text[1] {
 			case 'd':
-				printCatalog(c) // catPath + "/" + catName)
+				if !strings.HasPrefix(text, "\\dedup") {
+					printCatalog(c) // catPath + "/" + catName)
+					break
+				}
+				splits := strings.Split(text, " ")
+				if len(splits) != 4 && len(splits) != 5 {
+					fmt.Println("Usage is dedup table_name col_name threshold [delete]")
+					break
+				}
+				table := splits[1]
+				col := splits[2]
+				threshold, err := strconv.ParseFloat(splits[3], 64)
+				if err != nil {
+					fmt.Println("Please use a number between 0 and 1 as the similarity threshold")
+					break
+				}
+				doDelete := len(splits) == 5 && splits[4] == "delete"
+				hf, err := c.GetTable(table)
+				if err != nil {
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+					break
+				}
+				heapFile := hf.(*godb.HeapFile)
+
+				dedupTid := tid
+				if autocommit {
+					dedupTid = bp.Transactions().Begin()
+				}
+				groups, err := godb.FindSemanticDuplicates(heapFile, col, threshold, dedupTid)
+				if err == nil {
+					for _, group := range groups {
+						fmt.Printf("\033[32;1m%s\033[0m\n", group.Representative.PrettyPrintString(aligned))
+						for _, dup := range group.Duplicates {
+							fmt.Printf("\033[32m  %s\033[0m\n", dup.PrettyPrintString(aligned))
+						}
+					}
+					fmt.Printf("\033[32;1m(%d groups)\033[0m\n", len(groups))
+				}
+				if err == nil && doDelete {
+					var deleted int
+					deleted, err = godb.DeleteSemanticDuplicates(heapFile, groups, dedupTid)
+					if err == nil {
+						fmt.Printf("\033[32;1mDELETE %d\033[0m\n", deleted)
+					}
+				}
+				if err != nil {
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+				}
+				if autocommit {
+					if err != nil {
+						dedupTid.Abort()
+					} else {
+						dedupTid.Commit()
+					}
+				}
+				fmt.Println()
 			case 'c':
 				if len(text) > 3 {
 					rest := text[3:len(text)]
@@ -188,7 +247,25 @@ func main() {
 					use_context = true
 				}
 
-				query := fmt.Sprintf("SELECT %s,%s,('%s' AILIKE %s) sim FROM %s ORDER BY sim ASC LIMIT 1;", column_return, column_query, fact, column_query, table)
+				// optionally retrieve several diversified results rather than the single best one
+				num_results := 1
+				lambda := godb.DefaultMMRLambda
+				if len(splits) > 5 {
+					num_results, err = strconv.Atoi(splits[5])
+					if err != nil {
+						fmt.Println("Please use an integer as the number of results")
+						break
+					}
+				}
+				if len(splits) > 6 {
+					lambda, err = strconv.ParseFloat(splits[6], 64)
+					if err != nil {
+						fmt.Println("Please use a number between 0 and 1 as the MMR lambda")
+						break
+					}
+				}
+
+				query := godb.FactCheckRetrievalQuery(fact, table, column_return, column_query, num_results, lambda)
 				query_matches, err := godb.RunWikiArticleQuery(query, c, 0, bp)
 				if err != nil {
 					panic(err.Error())
@@ -244,8 +321,8 @@ func main() {
 					break
 				}
 				indexType := splits[4]
-				if indexType != "secondary" && indexType != "clustered" {
-					fmt.Println("Please use secondary or clustered as the index type")
+				if indexType != "secondary" && indexType != "clustered" && indexType != "text" {
+					fmt.Println("Please use secondary, clustered, or text as the index type")
 					break
 				}
 				clustered := indexType == "clustered"
@@ -255,7 +332,11 @@ func main() {
 					fmt.Println("Please load the table first before trying to construct the index")
 				}
 
-				_, err = godb.ConstructNNIndexFileFromHeapFile(hf.(*godb.HeapFile), col, clusters, clustered, path, table, bp)
+				if indexType == "text" {
+					_, err = godb.ConstructTextIndexFileFromHeapFile(hf.(*godb.HeapFile), col, path, table, bp)
+				} else {
+					_, err = godb.ConstructNNIndexFileFromHeapFile(hf.(*godb.HeapFile), col, clusters, clustered, path, table, bp)
+				}
 
 				if err != nil {
 					fmt.Println("failed to construct index file, %s", err.Error())
@@ -272,10 +353,20 @@ func main() {
 		query = strings.TrimSpace(query + " " + text[0:len(text)-1])
 
 		explain := false
+		explainAnalyze := false
+		explainJSON := false
 		if strings.HasPrefix(strings.ToLower(query), "explain") {
-			queryParts := strings.Split(query, " ")
-			query = strings.Join(queryParts[1:], " ")
+			queryParts := strings.Fields(query)[1:]
 			explain = true
+			if len(queryParts) > 0 && strings.ToLower(queryParts[0]) == "analyze" {
+				explainAnalyze = true
+				queryParts = queryParts[1:]
+			}
+			if len(queryParts) > 1 && strings.ToLower(queryParts[0]) == "format" && strings.ToLower(queryParts[1]) == "json" {
+				explainJSON = true
+				queryParts = queryParts[2:]
+			}
+			query = strings.Join(queryParts, " ")
 		}
 
 		queryType, plan, err := godb.Parse(c, query)
@@ -311,6 +402,32 @@ func main() {
 
 		switch queryType {
 		case godb.IteratorType:
+			if explainAnalyze {
+				if autocommit {
+					tid = bp.Transactions().Begin()
+				}
+				result, err := godb.ExplainAnalyze(plan, tid)
+				if err != nil {
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+					if autocommit {
+						tid.Abort()
+					}
+					break
+				}
+				if autocommit {
+					tid.Commit()
+				}
+				out := result.String()
+				if explainJSON {
+					out, err = result.JSON()
+					if err != nil {
+						fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+						break
+					}
+				}
+				fmt.Printf("\033[32m%s\033[0m\n", out)
+				break
+			}
 			if explain {
 				fmt.Printf("\033[32m")
 				godb.PrintPhysicalPlan(plan, "")
@@ -318,8 +435,7 @@ func main() {
 				break
 			}
 			if autocommit {
-				tid = godb.NewTID()
-				bp.BeginTransaction(tid)
+				tid = bp.Transactions().Begin()
 			}
 			start := time.Now()
 
@@ -352,7 +468,7 @@ func main() {
 				}
 			}
 			if autocommit {
-				bp.CommitTransaction(tid)
+				tid.Commit()
 			}
 		outer:
 			fmt.Printf("\033[32;1m(%d results)\033[0m\n", nresults)
@@ -363,8 +479,7 @@ func main() {
 			if !autocommit {
 				fmt.Printf("\033[31;1m%s\033[0m\n", "Cannot start transaction while in transaction")
 			} else {
-				tid = godb.NewTID()
-				bp.BeginTransaction(tid)
+				tid = bp.Transactions().Begin()
 				autocommit = false
 				fmt.Printf("\033[32;1mBEGIN\033[0m\n\n")
 			}
@@ -372,7 +487,7 @@ func main() {
 			if autocommit {
 				fmt.Printf("\033[31;1m%s\033[0m\n", "Cannot abort transaction unless in transaction")
 			} else {
-				bp.AbortTransaction(tid)
+				tid.Abort()
 				autocommit = true
 				fmt.Printf("\033[32;1mABORT\033[0m\n\n")
 			}
@@ -381,8 +496,12 @@ func main() {
 			if autocommit {
 				fmt.Printf("\033[31;1m%s\033[0m\n", "Cannot commit transaction unless in transaction")
 			} else {
-				bp.CommitTransaction(tid)
 				autocommit = true
+				if err := tid.Commit(); err != nil {
+					// the transaction was aborted, for instance to break a deadlock
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+					break
+				}
 				fmt.Printf("\033[32;1mCOMMIT\033[0m\n\n")
 			}
 		case godb.CreateTableQueryType:
@@ -397,6 +516,8 @@ func main() {
 			if err != nil {
 				fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
 			}
+		case godb.SetQueryType:
+			fmt.Printf("\033[32;1mSET\033[0m\n\n")
 		}
 
 	}